@@ -4,15 +4,55 @@ import (
 	"sync"
 )
 
+// Allocator provides the buffers the payloads of packets are received into,
+// for them to be reused rather than allocated for each packet, see
+// UseAllocator, WithPacketAllocator and WithRSPacketAllocator. Get returns a
+// buffer of length n, and Put takes back a buffer returned by Get once it is
+// no longer used. An Allocator must be safe for concurrent use.
+type Allocator interface {
+	Get(n int) []byte
+	Put(b []byte)
+}
+
+// defaultAllocator is the Allocator used unless another is set.
+var defaultAllocator Allocator = new(poolAllocator)
+
+// poolAllocator reuses buffers of maxMsgLength with a sync.Pool, which frees
+// them once unused for a while, allocating the longer ones.
+type poolAllocator struct {
+	pool sync.Pool
+}
+
+func (a *poolAllocator) Get(n int) []byte {
+	if n > maxMsgLength {
+		return make([]byte, n)
+	}
+	if b, ok := a.pool.Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, maxMsgLength)
+}
+
+func (a *poolAllocator) Put(b []byte) {
+	if cap(b) != maxMsgLength {
+		return
+	}
+	b = b[:maxMsgLength]
+	a.pool.Put(&b)
+}
+
 type allocator struct {
 	sync.Mutex
 	available [][]byte
 	// map key is the request order
 	used map[uint32][][]byte
+	// pages provides the pages allocated
+	pages Allocator
 }
 
 func newAllocator() *allocator {
 	return &allocator{
+		pages: defaultAllocator,
 		// micro optimization: initialize available pages with an initial capacity
 		available: make([][]byte, 0, SftpServerWorkerCount*2),
 		used:      make(map[uint32][][]byte),
@@ -39,7 +79,7 @@ func (a *allocator) GetPage(requestOrderID uint32) []byte {
 
 	// no preallocated slice found, just allocate a new one
 	if result == nil {
-		result = make([]byte, maxMsgLength)
+		result = a.pages.Get(maxMsgLength)
 	}
 
 	// put result in used pages
@@ -59,12 +99,16 @@ func (a *allocator) ReleasePages(requestOrderID uint32) {
 	delete(a.used, requestOrderID)
 }
 
-// Free removes all the used and available pages.
+// Free removes all the used and available pages, the available ones given
+// back to the pages Allocator.
 // Call this method when the allocator is not needed anymore
 func (a *allocator) Free() {
 	a.Lock()
 	defer a.Unlock()
 
+	for _, page := range a.available {
+		a.pages.Put(page)
+	}
 	a.available = nil
 	a.used = make(map[uint32][][]byte)
 }
@@ -1,11 +1,17 @@
 package sftp
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAllocator(t *testing.T) {
@@ -133,3 +139,101 @@ func printAllocatorContents(allocator *allocator) {
 		debug("available, values: %+v", v)
 	}
 }
+
+// countingAllocator counts the buffers it provides and takes back.
+type countingAllocator struct {
+	gets, puts int64
+}
+
+func (a *countingAllocator) Get(n int) []byte {
+	atomic.AddInt64(&a.gets, 1)
+	return make([]byte, n, maxMsgLength)
+}
+
+func (a *countingAllocator) Put(b []byte) {
+	atomic.AddInt64(&a.puts, 1)
+}
+
+func TestPoolAllocator(t *testing.T) {
+	a := new(poolAllocator)
+	b := a.Get(10)
+	assert.Len(t, b, 10)
+	assert.Equal(t, maxMsgLength, cap(b))
+	a.Put(b)
+	assert.Len(t, a.Get(maxMsgLength), maxMsgLength)
+
+	long := a.Get(maxMsgLength + 1)
+	assert.Len(t, long, maxMsgLength+1)
+	a.Put(long)
+	a.Put(make([]byte, 10))
+}
+
+func TestAllocatorPages(t *testing.T) {
+	pages := new(countingAllocator)
+	allocator := newAllocator()
+	allocator.pages = pages
+
+	allocator.GetPage(1)
+	allocator.GetPage(1)
+	allocator.ReleasePages(1)
+	allocator.GetPage(2)
+	assert.EqualValues(t, 2, pages.gets)
+	assert.EqualValues(t, 0, pages.puts)
+
+	allocator.Free()
+	assert.EqualValues(t, 1, pages.puts)
+}
+
+func TestAllocatorTransfer(t *testing.T) {
+	serverPages, clientBuffers := new(countingAllocator), new(countingAllocator)
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, WithPacketAllocator(serverPages))
+	require.NoError(t, err)
+	go server.Serve()
+	client, err := NewClientPipe(cr, cw, UseAllocator(clientBuffers))
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-alloc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.ToSlash(filepath.Join(dir, "file"))
+	data := bytes.Repeat([]byte("data"), 64*1024)
+
+	f, err := client.Create(p)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = client.Open(p)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, data, got)
+
+	assert.NotZero(t, atomic.LoadInt64(&serverPages.gets))
+	gets := atomic.LoadInt64(&clientBuffers.gets)
+	assert.NotZero(t, gets)
+	assert.Equal(t, gets, atomic.LoadInt64(&clientBuffers.puts))
+}
+
+func TestRequestAllocatorTransfer(t *testing.T) {
+	pages := new(countingAllocator)
+	p := clientRequestServerPair(t, WithRSPacketAllocator(pages))
+	defer p.Close()
+
+	_, err := putTestFile(p.cli, "/file", "data")
+	require.NoError(t, err)
+	got, err := getTestFile(p.cli, "/file")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), got)
+	assert.NotZero(t, atomic.LoadInt64(&pages.gets))
+}
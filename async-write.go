@@ -0,0 +1,129 @@
+package sftp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// asyncWriteExtension is negotiated to enable early acknowledgment of WRITE requests.
+// The client sends it in SSH_FXP_INIT and the server confirms it in SSH_FXP_VERSION.
+//
+// Once negotiated, the server may acknowledge a WRITE before performing it.
+// The first write failing after its acknowledgment is reported with the
+// response to the SSH_FXP_CLOSE of the handle, the status message being formatted as:
+// "deferred write at offset <offset> failed: <message>"
+const asyncWriteExtension = "async-write@github.com/pkg/sftp"
+
+const deferredWritePrefix = "deferred write at offset "
+
+// DeferredWriteError is returned when closing a File, if the server
+// acknowledged a write early and failed to perform it afterwards.
+// See UseAsyncWrites.
+type DeferredWriteError struct {
+	// Offset is the offset of the first failed write.
+	Offset int64
+	Err    error
+}
+
+func (e *DeferredWriteError) Error() string {
+	return fmt.Sprintf("%s%d failed: %v", deferredWritePrefix, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DeferredWriteError) Unwrap() error { return e.Err }
+
+// deferredWriteErrorFromStatus parses a status reporting a deferred write error,
+// any other error is returned unchanged.
+func deferredWriteErrorFromStatus(err error) error {
+	s, ok := err.(*StatusError)
+	if !ok || !strings.HasPrefix(s.msg, deferredWritePrefix) {
+		return err
+	}
+
+	rest := strings.TrimPrefix(s.msg, deferredWritePrefix)
+	i := strings.Index(rest, " failed: ")
+	if i < 0 {
+		return err
+	}
+	off, perr := strconv.ParseInt(rest[:i], 10, 64)
+	if perr != nil {
+		return err
+	}
+
+	return &DeferredWriteError{
+		Offset: off,
+		Err: normaliseError(&StatusError{
+			Code: s.Code,
+			msg:  rest[i+len(" failed: "):],
+			lang: s.lang,
+		}),
+	}
+}
+
+// hasAsyncWriteExtension returns true if the init packet asks for async writes.
+func (p *sshFxInitPacket) hasAsyncWriteExtension() bool {
+	for _, ext := range p.Extensions {
+		if ext.Name == asyncWriteExtension {
+			return true
+		}
+	}
+	return false
+}
+
+// versionExtensions returns the extensions to report in SSH_FXP_VERSION,
+// with the ping extension, and the async write extension when it has been negotiated.
+func versionExtensions(asyncWrites bool) []sshExtensionPair {
+	exts := make([]sshExtensionPair, 0, len(sftpExtensions)+6)
+	exts = append(exts, sftpExtensions...)
+	exts = append(exts, sshExtensionPair{pingExtension, "1"}, sshExtensionPair{limitsExtension, "1"},
+		sshExtensionPair{checkFileExtension, "1"}, sshExtensionPair{checkFileNameExtension, "1"})
+	if !asyncWrites {
+		return exts
+	}
+	return append(exts, sshExtensionPair{asyncWriteExtension, "1"})
+}
+
+// asyncWrites tracks the WRITE requests acknowledged before being performed for a handle.
+type asyncWrites struct {
+	wg sync.WaitGroup
+
+	mu  sync.Mutex
+	err *DeferredWriteError
+}
+
+// start must be called before the write is acknowledged.
+func (a *asyncWrites) start() {
+	a.wg.Add(1)
+}
+
+// done records the outcome of a write started at off.
+func (a *asyncWrites) done(off int64, err error) {
+	defer a.wg.Done()
+	if err == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err == nil || off < a.err.Offset {
+		a.err = &DeferredWriteError{Offset: off, Err: err}
+	}
+}
+
+// wait waits for all started writes, and returns the error of the
+// write with the lowest offset that failed, if any.
+func (a *asyncWrites) wait() error {
+	if a == nil {
+		return nil
+	}
+	a.wg.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err == nil {
+		return nil
+	}
+	return a.err
+}
@@ -0,0 +1,344 @@
+package sftp
+
+// ssh_FXP_ATTRS of the protocol versions 4 to 6
+// see https://tools.ietf.org/html/draft-ietf-secsh-filexfer-13#section-7
+
+import (
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sshFileXferAttrAccessTime       = 0x00000008 // the bit of sshFileXferAttrACmodTime
+	sshFileXferAttrCreateTime       = 0x00000010
+	sshFileXferAttrModifyTime       = 0x00000020
+	sshFileXferAttrACL              = 0x00000040
+	sshFileXferAttrOwnerGroup       = 0x00000080
+	sshFileXferAttrSubsecondTimes   = 0x00000100
+	sshFileXferAttrBits             = 0x00000200 // version 5 and later
+	sshFileXferAttrAllocationSize   = 0x00000400 // version 6
+	sshFileXferAttrTextHint         = 0x00000800 // version 6
+	sshFileXferAttrMimeType         = 0x00001000 // version 6
+	sshFileXferAttrLinkCount        = 0x00002000 // version 6
+	sshFileXferAttrUntranslatedName = 0x00004000 // version 6
+	sshFileXferAttrCtime            = 0x00008000 // version 6
+)
+
+// The types of the files, sent before their attributes.
+const (
+	sshFileXferTypeRegular     = 1
+	sshFileXferTypeDirectory   = 2
+	sshFileXferTypeSymlink     = 3
+	sshFileXferTypeSpecial     = 4
+	sshFileXferTypeUnknown     = 5
+	sshFileXferTypeSocket      = 6
+	sshFileXferTypeCharDevice  = 7
+	sshFileXferTypeBlockDevice = 8
+	sshFileXferTypeFIFO        = 9
+)
+
+var errShortAttrs = errors.New("sftp: short attributes")
+
+// FileStatV4 holds the attributes of the protocol versions 4 to 6 which
+// FileStat has no room for, see MaxProtocolVersion. Only the attributes
+// told by Flags were sent by the server.
+type FileStatV4 struct {
+	Flags uint32 // the SSH_FILEXFER_ATTR flags of the attributes
+	Type  uint8  // the SSH_FILEXFER_TYPE of the file
+
+	AllocationSize uint64 // version 6
+
+	Owner string
+	Group string
+
+	// The times, in seconds and nanoseconds since the Unix epoch, the
+	// nanoseconds being sent only with SSH_FILEXFER_ATTR_SUBSECOND_TIMES.
+	Atime          int64
+	AtimeNsec      uint32
+	Createtime     int64
+	CreatetimeNsec uint32
+	Mtime          int64
+	MtimeNsec      uint32
+	Ctime          int64 // version 6
+	CtimeNsec      uint32
+
+	ACLFlags uint32 // version 5 and later
+	ACL      []ACE
+
+	AttribBits      uint32 // version 5 and later
+	AttribBitsValid uint32 // version 6
+
+	// version 6
+	TextHint         uint8
+	MIMEType         string
+	LinkCount        uint32
+	UntranslatedName string
+}
+
+// ACE is an entry of the access control list of a file.
+type ACE struct {
+	Type uint32
+	Flag uint32
+	Mask uint32
+	Who  string
+}
+
+// fileTypeModes holds the S_IFMT bits of the file types.
+var fileTypeModes = map[uint8]uint32{
+	sshFileXferTypeRegular:     syscall.S_IFREG,
+	sshFileXferTypeDirectory:   syscall.S_IFDIR,
+	sshFileXferTypeSymlink:     syscall.S_IFLNK,
+	sshFileXferTypeSocket:      syscall.S_IFSOCK,
+	sshFileXferTypeCharDevice:  syscall.S_IFCHR,
+	sshFileXferTypeBlockDevice: syscall.S_IFBLK,
+	sshFileXferTypeFIFO:        syscall.S_IFIFO,
+}
+
+// unmarshalAttrsV4 unmarshals the attributes of the protocol version, 4 or
+// later, into a FileStat, along with its FileStatV4. The times are also
+// set in the FileStat, truncated, and the S_IFMT bits of its Mode from the
+// type of the file unless sent.
+func unmarshalAttrsV4(b []byte, version uint32) (*FileStat, []byte, error) {
+	var v4 FileStatV4
+	var err error
+	if v4.Flags, b, err = unmarshalUint32Safe(b); err != nil {
+		return nil, b, err
+	}
+	if len(b) < 1 {
+		return nil, b, errShortAttrs
+	}
+	v4.Type, b = b[0], b[1:]
+
+	fs := FileStat{V4: &v4}
+	flags := v4.Flags
+	u32 := func() (v uint32) {
+		if err == nil {
+			v, b, err = unmarshalUint32Safe(b)
+		}
+		return v
+	}
+	u64 := func() (v uint64) {
+		if err == nil {
+			v, b, err = unmarshalUint64Safe(b)
+		}
+		return v
+	}
+	str := func() (v string) {
+		if err == nil {
+			v, b, err = unmarshalStringSafe(b)
+		}
+		return v
+	}
+	times := func(flag uint32, sec *int64, nsec *uint32) {
+		if flags&flag == 0 {
+			return
+		}
+		*sec = int64(u64())
+		if flags&sshFileXferAttrSubsecondTimes != 0 {
+			*nsec = u32()
+		}
+	}
+
+	if flags&sshFileXferAttrSize != 0 {
+		fs.Size = u64()
+	}
+	if flags&sshFileXferAttrAllocationSize != 0 {
+		v4.AllocationSize = u64()
+	}
+	if flags&sshFileXferAttrOwnerGroup != 0 {
+		v4.Owner = str()
+		v4.Group = str()
+	}
+	if flags&sshFileXferAttrPermissions != 0 {
+		fs.Mode = u32()
+	}
+	times(sshFileXferAttrAccessTime, &v4.Atime, &v4.AtimeNsec)
+	times(sshFileXferAttrCreateTime, &v4.Createtime, &v4.CreatetimeNsec)
+	times(sshFileXferAttrModifyTime, &v4.Mtime, &v4.MtimeNsec)
+	times(sshFileXferAttrCtime, &v4.Ctime, &v4.CtimeNsec)
+	if flags&sshFileXferAttrACL != 0 {
+		if acl := str(); err == nil {
+			v4.ACLFlags, v4.ACL, err = unmarshalACL([]byte(acl), version)
+		}
+	}
+	if flags&sshFileXferAttrBits != 0 {
+		v4.AttribBits = u32()
+		if version >= 6 {
+			v4.AttribBitsValid = u32()
+		}
+	}
+	if flags&sshFileXferAttrTextHint != 0 && err == nil {
+		if len(b) < 1 {
+			err = errShortAttrs
+		} else {
+			v4.TextHint, b = b[0], b[1:]
+		}
+	}
+	if flags&sshFileXferAttrMimeType != 0 {
+		v4.MIMEType = str()
+	}
+	if flags&sshFileXferAttrLinkCount != 0 {
+		v4.LinkCount = u32()
+	}
+	if flags&sshFileXferAttrUntranslatedName != 0 {
+		v4.UntranslatedName = str()
+	}
+	if flags&sshFileXferAttrExtended != 0 {
+		count := u32()
+		for i := uint32(0); i < count && err == nil; i++ {
+			typ := str()
+			data := str()
+			fs.Extended = append(fs.Extended, StatExtended{typ, data})
+		}
+	}
+	if err != nil {
+		return nil, b, err
+	}
+
+	fs.Atime = uint32(v4.Atime)
+	fs.Mtime = uint32(v4.Mtime)
+	if fs.Mode&S_IFMT == 0 {
+		fs.Mode |= fileTypeModes[v4.Type]
+	}
+	return &fs, b, nil
+}
+
+func unmarshalACL(b []byte, version uint32) (flags uint32, acl []ACE, err error) {
+	if version >= 5 {
+		if flags, b, err = unmarshalUint32Safe(b); err != nil {
+			return 0, nil, err
+		}
+	}
+	count, b, err := unmarshalUint32Safe(b)
+	for i := uint32(0); i < count && err == nil; i++ {
+		var ace ACE
+		if ace.Type, b, err = unmarshalUint32Safe(b); err != nil {
+			break
+		}
+		if ace.Flag, b, err = unmarshalUint32Safe(b); err != nil {
+			break
+		}
+		if ace.Mask, b, err = unmarshalUint32Safe(b); err != nil {
+			break
+		}
+		if ace.Who, b, err = unmarshalStringSafe(b); err != nil {
+			break
+		}
+		acl = append(acl, ace)
+	}
+	return flags, acl, err
+}
+
+func marshalACL(b []byte, version, flags uint32, acl []ACE) []byte {
+	if version >= 5 {
+		b = marshalUint32(b, flags)
+	}
+	b = marshalUint32(b, uint32(len(acl)))
+	for _, ace := range acl {
+		b = marshalUint32(b, ace.Type)
+		b = marshalUint32(b, ace.Flag)
+		b = marshalUint32(b, ace.Mask)
+		b = marshalString(b, ace.Who)
+	}
+	return b
+}
+
+// marshalAttrsV4 marshals the attributes of fs told by the Flags of its
+// FileStatV4 in the layout of the protocol version, 4 or later. The size,
+// permissions and extended attributes are those of fs.
+func marshalAttrsV4(b []byte, version uint32, fs *FileStat) []byte {
+	v4 := fs.V4
+	flags := v4.Flags
+	b = marshalUint32(b, flags)
+	b = append(b, v4.Type)
+
+	times := func(flag uint32, sec int64, nsec uint32) {
+		if flags&flag == 0 {
+			return
+		}
+		b = marshalUint64(b, uint64(sec))
+		if flags&sshFileXferAttrSubsecondTimes != 0 {
+			b = marshalUint32(b, nsec)
+		}
+	}
+
+	if flags&sshFileXferAttrSize != 0 {
+		b = marshalUint64(b, fs.Size)
+	}
+	if flags&sshFileXferAttrAllocationSize != 0 {
+		b = marshalUint64(b, v4.AllocationSize)
+	}
+	if flags&sshFileXferAttrOwnerGroup != 0 {
+		b = marshalString(b, v4.Owner)
+		b = marshalString(b, v4.Group)
+	}
+	if flags&sshFileXferAttrPermissions != 0 {
+		b = marshalUint32(b, fs.Mode)
+	}
+	times(sshFileXferAttrAccessTime, v4.Atime, v4.AtimeNsec)
+	times(sshFileXferAttrCreateTime, v4.Createtime, v4.CreatetimeNsec)
+	times(sshFileXferAttrModifyTime, v4.Mtime, v4.MtimeNsec)
+	times(sshFileXferAttrCtime, v4.Ctime, v4.CtimeNsec)
+	if flags&sshFileXferAttrACL != 0 {
+		b = marshalString(b, string(marshalACL(nil, version, v4.ACLFlags, v4.ACL)))
+	}
+	if flags&sshFileXferAttrBits != 0 {
+		b = marshalUint32(b, v4.AttribBits)
+		if version >= 6 {
+			b = marshalUint32(b, v4.AttribBitsValid)
+		}
+	}
+	if flags&sshFileXferAttrTextHint != 0 {
+		b = append(b, v4.TextHint)
+	}
+	if flags&sshFileXferAttrMimeType != 0 {
+		b = marshalString(b, v4.MIMEType)
+	}
+	if flags&sshFileXferAttrLinkCount != 0 {
+		b = marshalUint32(b, v4.LinkCount)
+	}
+	if flags&sshFileXferAttrUntranslatedName != 0 {
+		b = marshalString(b, v4.UntranslatedName)
+	}
+	if flags&sshFileXferAttrExtended != 0 {
+		b = marshalUint32(b, uint32(len(fs.Extended)))
+		for _, ext := range fs.Extended {
+			b = marshalString(b, ext.ExtType)
+			b = marshalString(b, ext.ExtData)
+		}
+	}
+	return b
+}
+
+// attrsV4FromV3 returns the attributes of the v3 flags of fs, as those of
+// the protocol version 4 and later, of a file of the type typ. The uid and
+// gid become the numeric owner and group names.
+func attrsV4FromV3(flags uint32, fs *FileStat, typ uint8) *FileStat {
+	v4 := &FileStatV4{Type: typ}
+	v4.Flags = flags & (sshFileXferAttrSize | sshFileXferAttrPermissions | sshFileXferAttrExtended)
+	if flags&sshFileXferAttrUIDGID != 0 {
+		v4.Flags |= sshFileXferAttrOwnerGroup
+		v4.Owner = strconv.FormatUint(uint64(fs.UID), 10)
+		v4.Group = strconv.FormatUint(uint64(fs.GID), 10)
+	}
+	if flags&sshFileXferAttrACmodTime != 0 {
+		v4.Flags |= sshFileXferAttrAccessTime | sshFileXferAttrModifyTime
+		v4.Atime = int64(fs.Atime)
+		v4.Mtime = int64(fs.Mtime)
+	}
+
+	fs2 := *fs
+	fs2.V4 = v4
+	return &fs2
+}
+
+// modTime returns the modification time of the attributes.
+func (fs *FileStat) modTime() time.Time {
+	if fs.V4 != nil && fs.V4.Flags&sshFileXferAttrModifyTime != 0 {
+		return time.Unix(fs.V4.Mtime, int64(fs.V4.MtimeNsec))
+	}
+	return time.Unix(int64(fs.Mtime), 0)
+}
@@ -57,6 +57,10 @@ type FileStat struct {
 	UID      uint32
 	GID      uint32
 	Extended []StatExtended
+
+	// V4 holds the attributes of the protocol versions 4 to 6, if
+	// negotiated, see MaxProtocolVersion.
+	V4 *FileStatV4
 }
 
 // StatExtended contains additional, extended information for a FileStat.
@@ -70,7 +74,7 @@ func fileInfoFromStat(st *FileStat, name string) os.FileInfo {
 		name:  name,
 		size:  int64(st.Size),
 		mode:  toFileMode(st.Mode),
-		mtime: time.Unix(int64(st.Mtime), 0),
+		mtime: st.modTime(),
 		sys:   st,
 	}
 	return fs
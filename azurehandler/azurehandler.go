@@ -0,0 +1,158 @@
+// Package azurehandler serves the blobs of an Azure Blob Storage container
+// through the request server of the sftp package.
+//
+// The container is served by sftp.BlobStoreHandler, through the
+// sftp.BlobStore returned by NewStore: blobs are exposed as files, with the
+// slashes of their names separating directories, uploads are streamed to
+// block blobs block by block, and reads are served by ranged downloads. See
+// sftp.BlobStoreHandler for what such files support.
+//
+// It lives in its own module, so that the sftp package does not depend on the
+// Azure SDK.
+package azurehandler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// DefaultBlockSize is the default size of the blocks of the uploads.
+	DefaultBlockSize = 8 << 20
+
+	// minBlockSize is the minimum size of the blocks supported by
+	// azblob.UploadStreamToBlockBlob.
+	minBlockSize = 1 << 20
+
+	// maxRetryRequests is the number of times the downloads interrupted are
+	// resumed.
+	maxRetryRequests = 3
+)
+
+// An Option configures the store returned by NewStore.
+type Option func(*store)
+
+// WithPrefix serves the blobs whose names start with prefix, the prefix
+// being the root directory. A slash is appended to prefix if missing.
+func WithPrefix(prefix string) Option {
+	return func(s *store) {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		s.prefix = prefix
+	}
+}
+
+// WithBlockSize sets the size of the blocks of the uploads, each upload
+// buffering a block in memory. It defaults to DefaultBlockSize, and cannot
+// be less than 1 MiB.
+func WithBlockSize(n int) Option {
+	return func(s *store) {
+		if n >= minBlockSize {
+			s.blockSize = n
+		}
+	}
+}
+
+// New returns the Handlers serving the blobs of container.
+func New(container azblob.ContainerURL, options ...Option) sftp.Handlers {
+	return sftp.BlobStoreHandler(NewStore(container, options...))
+}
+
+// NewStore returns the sftp.BlobStore of the blobs of container, whose keys
+// are the names of the blobs without the prefix set by WithPrefix.
+func NewStore(container azblob.ContainerURL, options ...Option) sftp.BlobStore {
+	s := &store{container: container, blockSize: DefaultBlockSize}
+	for _, o := range options {
+		o(s)
+	}
+	return s
+}
+
+type store struct {
+	container azblob.ContainerURL
+	prefix    string
+	blockSize int
+}
+
+func (s *store) blob(key string) azblob.BlockBlobURL {
+	return s.container.NewBlockBlobURL(s.prefix + key)
+}
+
+// notExist returns os.ErrNotExist for the blobs missing, which
+// sftp.BlobStoreHandler expects.
+func notExist(err error) error {
+	if serr, ok := err.(azblob.StorageError); ok && serr.Response() != nil &&
+		serr.Response().StatusCode == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (s *store) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if length < 0 {
+		length = azblob.CountToEnd
+	}
+	resp, err := s.blob(key).Download(ctx, offset, length, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, notExist(err)
+	}
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: maxRetryRequests}), nil
+}
+
+func (s *store) Put(ctx context.Context, key string, r io.Reader) error {
+	// the blocks are only committed once r is read to its end
+	_, err := azblob.UploadStreamToBlockBlob(ctx, r, s.blob(key), azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: s.blockSize,
+	})
+	return err
+}
+
+func (s *store) List(ctx context.Context, prefix string) ([]sftp.BlobInfo, error) {
+	var blobs []sftp.BlobInfo
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := s.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix: s.prefix + prefix,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range resp.Segment.BlobItems {
+			var size int64
+			if item.Properties.ContentLength != nil {
+				size = *item.Properties.ContentLength
+			}
+			blobs = append(blobs, sftp.BlobInfo{
+				Key:     strings.TrimPrefix(item.Name, s.prefix),
+				Size:    size,
+				ModTime: item.Properties.LastModified,
+			})
+		}
+		marker = resp.NextMarker
+	}
+	return blobs, nil
+}
+
+func (s *store) Delete(ctx context.Context, key string) error {
+	_, err := s.blob(key).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	return notExist(err)
+}
+
+func (s *store) Stat(ctx context.Context, key string) (sftp.BlobInfo, error) {
+	props, err := s.blob(key).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return sftp.BlobInfo{}, notExist(err)
+	}
+	return sftp.BlobInfo{
+		Key:     key,
+		Size:    props.ContentLength(),
+		ModTime: props.LastModified(),
+	}, nil
+}
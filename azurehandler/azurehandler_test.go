@@ -0,0 +1,106 @@
+package azurehandler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/pkg/sftp/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientAzurePair returns a client of a request server serving a fake container.
+func clientAzurePair(t *testing.T, options ...Option) (*sftp.Client, *fakeAzure) {
+	fake, container := newFakeAzure(t)
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, New(container, options...))
+	go server.Serve()
+	client, err := sftp.NewClientPipe(cr, cw)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client, fake
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestBlockUpload(t *testing.T) {
+	client, fake := clientAzurePair(t, WithPrefix("root"), WithBlockSize(1<<20))
+
+	// larger than a block, and than a block of the reads
+	data := testData(3<<20 + 5)
+	f, err := client.Create("/dir/file")
+	require.NoError(t, err)
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, data, fake.blob(t, "root/dir/file"))
+
+	f, err = client.Open("/dir/file")
+	require.NoError(t, err)
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestPaginatedList(t *testing.T) {
+	client, fake := clientAzurePair(t, WithPrefix("/root/"))
+	for _, name := range []string{"root/a", "root/b", "root/c", "root/dir/d", "other/e"} {
+		fake.put(name, []byte(name))
+	}
+
+	names := map[string]int64{}
+	entries, err := client.ReadDir("/")
+	require.NoError(t, err)
+	for _, fi := range entries {
+		names[fi.Name()] = fi.Size()
+	}
+	assert.Equal(t, map[string]int64{"a": 6, "b": 6, "c": 6, "dir": 0}, names)
+	assert.GreaterOrEqual(t, fake.lists, 2)
+
+	_, err = client.Stat("/other/e")
+	assert.True(t, os.IsNotExist(err), err)
+
+	require.NoError(t, client.Remove("/a"))
+	assert.True(t, os.IsNotExist(client.Remove("/a")))
+}
+
+func TestStoreNotExist(t *testing.T) {
+	_, container := newFakeAzure(t)
+	store := NewStore(container)
+	ctx := context.Background()
+
+	_, err := store.Get(ctx, "missing", 0, -1)
+	assert.True(t, os.IsNotExist(err), err)
+	_, err = store.Stat(ctx, "missing")
+	assert.True(t, os.IsNotExist(err), err)
+	assert.True(t, os.IsNotExist(store.Delete(ctx, "missing")))
+}
+
+func TestConformance(t *testing.T) {
+	handlertest.TestHandlers(t, func() sftp.Handlers {
+		_, container := newFakeAzure(t)
+		return New(container)
+	})
+}
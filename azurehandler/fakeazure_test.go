@@ -0,0 +1,198 @@
+package azurehandler
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testContainer = "container"
+
+	// fakePageSize is the number of blobs of the pages of the listings,
+	// small for the listings to be paginated.
+	fakePageSize = 2
+)
+
+// fakeAzure is an in-memory Blob Storage of a single container, serving the
+// REST calls made by the store, with path-style URLs.
+type fakeAzure struct {
+	mu     sync.Mutex
+	blobs  map[string]*fakeBlob
+	blocks map[string]map[string][]byte // staged blocks by blob, by ID
+	lists  int                          // pages listed
+}
+
+type fakeBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+// newFakeAzure returns a fake and the URL of its container.
+func newFakeAzure(t *testing.T) (*fakeAzure, azblob.ContainerURL) {
+	f := &fakeAzure{
+		blobs:  make(map[string]*fakeBlob),
+		blocks: make(map[string]map[string][]byte),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL + "/" + testContainer)
+	require.NoError(t, err)
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{MaxTries: 1},
+	})
+	return f, azblob.NewContainerURL(*u, p)
+}
+
+// blob returns the data of the blob name, failing t if it is missing.
+func (f *fakeAzure) blob(t *testing.T, name string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.blobs[name]
+	require.True(t, ok, "missing blob %q", name)
+	return b.data
+}
+
+func (f *fakeAzure) put(name string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blobs[name] = &fakeBlob{data: data, modTime: time.Now()}
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q := r.URL.Query()
+	name := strings.TrimPrefix(r.URL.Path, "/"+testContainer)
+	if name == "" && q.Get("comp") == "list" {
+		f.list(w, q)
+		return
+	}
+	name = strings.TrimPrefix(name, "/")
+
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		data, _ := ioutil.ReadAll(r.Body)
+		if f.blocks[name] == nil {
+			f.blocks[name] = make(map[string][]byte)
+		}
+		f.blocks[name][q.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+		return
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &list); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		for _, id := range list.Latest {
+			data = append(data, f.blocks[name][id]...)
+		}
+		delete(f.blocks, name)
+		f.blobs[name] = &fakeBlob{data: data, modTime: time.Now()}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	b, ok := f.blobs[name]
+	if !ok {
+		w.Header().Set("x-ms-error-code", "BlobNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != http.MethodHead {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>BlobNotFound</Code><Message>The specified blob does not exist.</Message></Error>`)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		data, status := b.data, http.StatusOK
+		if rng := r.Header.Get("x-ms-range"); rng != "" {
+			var start, end int64
+			bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+			start, _ = strconv.ParseInt(bounds[0], 10, 64)
+			end, err := strconv.ParseInt(bounds[1], 10, 64)
+			if err != nil || end >= int64(len(data)) {
+				end = int64(len(data)) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data, status = data[start:end+1], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", b.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list lists a page of the blobs. f.mu must be held.
+func (f *fakeAzure) list(w http.ResponseWriter, q url.Values) {
+	f.lists++
+	prefix, marker := q.Get("prefix"), q.Get("marker")
+	var names []string
+	for name := range f.blobs {
+		if strings.HasPrefix(name, prefix) && name > marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	next := ""
+	if len(names) > fakePageSize {
+		names = names[:fakePageSize]
+		next = names[fakePageSize-1]
+	}
+
+	type properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int    `xml:"Content-Length"`
+		BlobType      string `xml:"BlobType"`
+	}
+	type blob struct {
+		Name       string     `xml:"Name"`
+		Properties properties `xml:"Properties"`
+	}
+	var resp struct {
+		XMLName    xml.Name `xml:"EnumerationResults"`
+		Prefix     string   `xml:"Prefix"`
+		Blobs      []blob   `xml:"Blobs>Blob"`
+		NextMarker string   `xml:"NextMarker"`
+	}
+	resp.Prefix, resp.NextMarker = prefix, next
+	for _, name := range names {
+		b := f.blobs[name]
+		resp.Blobs = append(resp.Blobs, blob{name, properties{
+			LastModified:  b.modTime.UTC().Format(http.TimeFormat),
+			ContentLength: len(b.data),
+			BlobType:      "BlockBlob",
+		}})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,11 @@
+module github.com/pkg/sftp/azurehandler
+
+go 1.15
+
+require (
+	github.com/Azure/azure-storage-blob-go v0.14.0
+	github.com/pkg/sftp v1.13.0
+	github.com/stretchr/testify v1.7.0
+)
+
+replace github.com/pkg/sftp => ../
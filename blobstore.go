@@ -0,0 +1,506 @@
+package sftp
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BlobStore is a store of blobs addressed by keys, as object stores provide.
+// BlobStoreHandler serves one through the request server, so that a backend
+// only has to implement these few methods rather than the whole Handlers.
+//
+// The methods return an error satisfying os.IsNotExist for missing blobs.
+type BlobStore interface {
+	// Get returns a reader of length bytes of the blob at key from offset,
+	// or up to its end if length is negative.
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Put stores the blob at key with the content of r read until io.EOF,
+	// replacing any blob at key. The blob should not be stored if r fails.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// List returns the blobs whose keys start with prefix.
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+	// Delete deletes the blob at key.
+	Delete(ctx context.Context, key string) error
+	// Stat describes the blob at key.
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+}
+
+// BlobInfo describes a blob of a BlobStore.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+const (
+	// blobBlockSize is the size of the ranged Gets serving the reads.
+	blobBlockSize = 1 << 20
+	// blobCachedBlocks is the number of blocks each open blob keeps.
+	blobCachedBlocks = 4
+	// blobMaxHeld is the size of the writes ahead of the data streamed
+	// to a blob that are held in memory.
+	blobMaxHeld = 4 << 20
+)
+
+var errBlobNotSequential = errors.New("writes to blobs must be sequential")
+
+// BlobStoreHandler returns Handlers serving the blobs of store as files,
+// the slashes of their keys separating directories.
+//
+// Directories exist as long as blobs are stored under them, Mkdir stores an
+// empty marker blob whose key ends with a slash so that empty directories can
+// exist. Keys have no leading slash: the file "/a/b" is the blob "a/b".
+//
+// Files are uploaded with a single Put streaming the writes, which must be
+// sequential from offset 0: writes arriving out of order are held in memory,
+// up to 4 MiB. Files are read by ranged Gets of 1 MiB blocks.
+// Rename copies the blobs then deletes the originals, so renaming a directory
+// is neither atomic nor cheap. Setstat only supports truncating to 0, and
+// accepts but ignores the other attributes; links are not supported.
+func BlobStoreHandler(store BlobStore) Handlers {
+	h := &blobHandler{store: store}
+	return Handlers{h, h, h, h}
+}
+
+type blobHandler struct {
+	store BlobStore
+}
+
+var _ PosixRenameFileCmder = (*blobHandler)(nil)
+
+// blobKey returns the key of the blob of the file at p, "" for the root.
+func blobKey(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// blobDirPrefix returns the prefix of the blobs under the directory at p.
+func blobDirPrefix(p string) string {
+	if k := blobKey(p); k != "" {
+		return k + "/"
+	}
+	return ""
+}
+
+// blobFileInfo describes a blob, or a directory.
+type blobFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *blobFileInfo) Name() string       { return fi.name }
+func (fi *blobFileInfo) Size() int64        { return fi.size }
+func (fi *blobFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *blobFileInfo) IsDir() bool        { return fi.dir }
+func (fi *blobFileInfo) Sys() interface{}   { return nil }
+
+func (fi *blobFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// stat describes the file at p: a blob, or a directory if blobs are stored under it.
+func (h *blobHandler) stat(ctx context.Context, p string) (*blobFileInfo, error) {
+	name := path.Base(path.Clean("/" + p))
+	key := blobKey(p)
+	if key == "" {
+		return &blobFileInfo{name: name, dir: true}, nil
+	}
+
+	info, err := h.store.Stat(ctx, key)
+	if err == nil {
+		return &blobFileInfo{name: name, size: info.Size, modTime: info.ModTime}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	blobs, err := h.store.List(ctx, key+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(blobs) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return &blobFileInfo{name: name, dir: true}, nil
+}
+
+func (h *blobHandler) Fileread(r *Request) (io.ReaderAt, error) {
+	fi, err := h.stat(r.Context(), r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.dir {
+		return nil, ErrSSHFxFailure
+	}
+	return &blobReader{
+		ctx:    r.Context(),
+		store:  h.store,
+		key:    blobKey(r.Filepath),
+		size:   fi.size,
+		blocks: make(map[int64]*blobBlock),
+	}, nil
+}
+
+func (h *blobHandler) Filewrite(r *Request) (io.WriterAt, error) {
+	pflags := r.Pflags()
+	if pflags.Append {
+		return nil, ErrSSHFxOpUnsupported
+	}
+	fi, err := h.stat(r.Context(), r.Filepath)
+	switch {
+	case err == nil && fi.dir:
+		return nil, ErrSSHFxFailure
+	case err == nil && pflags.Excl:
+		return nil, os.ErrExist
+	case err == nil && !pflags.Trunc && fi.size > 0:
+		// blobs are replaced as a whole, writing into
+		// an existing blob without truncating it is not supported
+		return nil, ErrSSHFxOpUnsupported
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+	return newBlobWriter(r.Context(), h.store, blobKey(r.Filepath)), nil
+}
+
+func (h *blobHandler) Filelist(r *Request) (ListerAt, error) {
+	switch r.Method {
+	case "List":
+		return h.list(r.Context(), r.Filepath)
+	case "Stat", "Lstat":
+		fi, err := h.stat(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerat{fi}, nil
+	}
+	return nil, ErrSSHFxOpUnsupported
+}
+
+func (h *blobHandler) list(ctx context.Context, p string) (ListerAt, error) {
+	prefix := blobDirPrefix(p)
+	blobs, err := h.store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(blobs) == 0 {
+		// tell empty directories from missing ones
+		if _, err := h.stat(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+
+	var fis listerat
+	dirs := make(map[string]bool)
+	for _, b := range blobs {
+		name := strings.TrimPrefix(b.Key, prefix)
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			if dir := name[:i]; dir != "" && !dirs[dir] {
+				dirs[dir] = true
+				fis = append(fis, &blobFileInfo{name: dir, dir: true})
+			}
+			continue
+		}
+		if name == "" {
+			// marker of the directory itself
+			continue
+		}
+		fis = append(fis, &blobFileInfo{name: name, size: b.Size, modTime: b.ModTime})
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (h *blobHandler) Filecmd(r *Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		// owners, permissions and times are accepted, since clients set them
+		// after uploads, but cannot be stored
+		if !r.AttrFlags().Size {
+			return nil
+		}
+		if r.Attributes().Size != 0 {
+			return ErrSSHFxOpUnsupported
+		}
+		return h.store.Put(ctx, blobKey(r.Filepath), strings.NewReader(""))
+	case "Rename":
+		if _, err := h.stat(ctx, r.Target); err == nil {
+			return os.ErrExist
+		}
+		return h.rename(ctx, r.Filepath, r.Target)
+	case "Rmdir":
+		prefix := blobDirPrefix(r.Filepath)
+		blobs, err := h.store.List(ctx, prefix)
+		switch {
+		case err != nil:
+			return err
+		case len(blobs) == 0:
+			return &os.PathError{Op: "rmdir", Path: r.Filepath, Err: os.ErrNotExist}
+		case len(blobs) > 1 || blobs[0].Key != prefix:
+			// not empty
+			return ErrSSHFxFailure
+		}
+		return h.store.Delete(ctx, prefix)
+	case "Mkdir":
+		if _, err := h.stat(ctx, r.Filepath); err == nil {
+			return os.ErrExist
+		}
+		return h.store.Put(ctx, blobDirPrefix(r.Filepath), strings.NewReader(""))
+	case "Remove":
+		fi, err := h.stat(ctx, r.Filepath)
+		if err != nil {
+			return err
+		}
+		if fi.dir {
+			return ErrSSHFxFailure
+		}
+		return h.store.Delete(ctx, blobKey(r.Filepath))
+	}
+	return ErrSSHFxOpUnsupported
+}
+
+// PosixRename renames as Rename does, replacing the target if it exists.
+func (h *blobHandler) PosixRename(r *Request) error {
+	return h.rename(r.Context(), r.Filepath, r.Target)
+}
+
+// rename copies the blob at oldpath, or all the blobs under it,
+// then deletes the originals.
+func (h *blobHandler) rename(ctx context.Context, oldpath, newpath string) error {
+	fi, err := h.stat(ctx, oldpath)
+	if err != nil {
+		return err
+	}
+	if !fi.dir {
+		if err := h.copy(ctx, blobKey(oldpath), blobKey(newpath)); err != nil {
+			return err
+		}
+		return h.store.Delete(ctx, blobKey(oldpath))
+	}
+
+	oldPrefix, newPrefix := blobDirPrefix(oldpath), blobDirPrefix(newpath)
+	if oldPrefix == "" || strings.HasPrefix(newPrefix, oldPrefix) {
+		// cannot move a directory into itself
+		return ErrSSHFxFailure
+	}
+	blobs, err := h.store.List(ctx, oldPrefix)
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		if err := h.copy(ctx, b.Key, newPrefix+strings.TrimPrefix(b.Key, oldPrefix)); err != nil {
+			return err
+		}
+	}
+	for _, b := range blobs {
+		if err := h.store.Delete(ctx, b.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *blobHandler) copy(ctx context.Context, src, dst string) error {
+	rd, err := h.store.Get(ctx, src, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	return h.store.Put(ctx, dst, rd)
+}
+
+// blobReader serves the reads of a blob by ranged Gets of whole blocks.
+type blobReader struct {
+	ctx   context.Context
+	store BlobStore
+	key   string
+	size  int64
+
+	mu     sync.Mutex
+	blocks map[int64]*blobBlock // by index
+	order  []int64              // indexes, from the least recently fetched
+}
+
+// blobBlock is a block of a blob, being fetched until done is closed.
+type blobBlock struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// failed returns true if the block was fetched with an error.
+func (b *blobBlock) failed() bool {
+	select {
+	case <-b.done:
+		return b.err != nil
+	default:
+		return false
+	}
+}
+
+func (r *blobReader) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) && off < r.size {
+		blk := r.block(off / blobBlockSize)
+		<-blk.done
+		if blk.err != nil {
+			return n, blk.err
+		}
+		pos := off % blobBlockSize
+		if pos >= int64(len(blk.data)) {
+			// the blob was replaced by a smaller one
+			return n, io.ErrUnexpectedEOF
+		}
+		c := copy(b[n:], blk.data[pos:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns the block at index i, fetching it if not cached or failed.
+func (r *blobReader) block(i int64) *blobBlock {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	blk, ok := r.blocks[i]
+	if ok && !blk.failed() {
+		return blk
+	}
+
+	blk = &blobBlock{done: make(chan struct{})}
+	r.blocks[i] = blk
+	if !ok {
+		r.order = append(r.order, i)
+		if len(r.order) > blobCachedBlocks {
+			delete(r.blocks, r.order[0])
+			r.order = r.order[1:]
+		}
+	}
+
+	go func() {
+		defer close(blk.done)
+		rd, err := r.store.Get(r.ctx, r.key, i*blobBlockSize, blobBlockSize)
+		if err != nil {
+			blk.err = err
+			return
+		}
+		defer rd.Close()
+		blk.data = make([]byte, blobBlockSize)
+		n, err := io.ReadFull(rd, blk.data)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			// last block
+			err = nil
+		}
+		blk.data, blk.err = blk.data[:n], err
+	}()
+	return blk
+}
+
+// blobWriter streams the writes of a file to a single Put, from offset 0.
+// Writes ahead of the end of the data streamed are held until the writes
+// before them arrive.
+type blobWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error // of Put, once done is closed
+
+	mu      sync.Mutex
+	off     int64            // end of the data streamed
+	pending map[int64][]byte // writes ahead of off, by offset
+	held    int64            // bytes in pending
+}
+
+func newBlobWriter(ctx context.Context, store BlobStore, key string) *blobWriter {
+	pr, pw := io.Pipe()
+	w := &blobWriter{
+		pw:      pw,
+		done:    make(chan struct{}),
+		pending: make(map[int64][]byte),
+	}
+	go func() {
+		defer close(w.done)
+		w.err = store.Put(ctx, key, pr)
+		// unblock the writes if Put returned early
+		pr.CloseWithError(errors.New("blob store stopped reading"))
+	}()
+	return w
+}
+
+func (w *blobWriter) WriteAt(b []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case off < w.off:
+		return 0, errBlobNotSequential
+	case off > w.off:
+		if _, ok := w.pending[off]; ok || w.held+int64(len(b)) > blobMaxHeld {
+			return 0, errBlobNotSequential
+		}
+		// b is reused by the server once WriteAt returns
+		w.pending[off] = append([]byte(nil), b...)
+		w.held += int64(len(b))
+		return len(b), nil
+	}
+
+	if err := w.stream(b); err != nil {
+		return 0, err
+	}
+	for {
+		next, ok := w.pending[w.off]
+		if !ok {
+			break
+		}
+		delete(w.pending, w.off)
+		w.held -= int64(len(next))
+		if err := w.stream(next); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// stream writes b at the end of the data streamed. w.mu must be held.
+func (w *blobWriter) stream(b []byte) error {
+	n, err := w.pw.Write(b)
+	w.off += int64(n)
+	if err != nil {
+		<-w.done
+		if w.err != nil {
+			return w.err
+		}
+	}
+	return err
+}
+
+// Close completes Put, and returns its error.
+func (w *blobWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) > 0 {
+		// writes were missing before the pending ones: fail Put
+		w.pw.CloseWithError(errBlobNotSequential)
+		<-w.done
+		return errBlobNotSequential
+	}
+	w.pw.Close()
+	<-w.done
+	return w.err
+}
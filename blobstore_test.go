@@ -0,0 +1,187 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memBlobStore is a BlobStore in memory.
+type memBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	gets  int
+}
+
+func newMemBlobStore() *memBlobStore {
+	return &memBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *memBlobStore) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	b, ok := s.blobs[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	b = b[offset:]
+	if length >= 0 && length < int64(len(b)) {
+		b = b[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = b
+	return nil
+}
+
+func (s *memBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var infos []BlobInfo
+	for key, b := range s.blobs {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, BlobInfo{Key: key, Size: int64(len(b)), ModTime: time.Now()})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+func (s *memBlobStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *memBlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[key]
+	if !ok {
+		return BlobInfo{}, os.ErrNotExist
+	}
+	return BlobInfo{Key: key, Size: int64(len(b)), ModTime: time.Now()}, nil
+}
+
+func TestBlobStoreTransfers(t *testing.T) {
+	store := newMemBlobStore()
+	client, _ := handlersClientPair(t, BlobStoreHandler(store), nil)
+
+	data := make([]byte, 3*blobBlockSize+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	f, err := client.Create("/dir/file")
+	require.NoError(t, err)
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, data, store.blobs["dir/file"])
+
+	f, err = client.Open("/dir/file")
+	require.NoError(t, err)
+	var got bytes.Buffer
+	_, err = f.WriteTo(&got)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, data, got.Bytes())
+	assert.Equal(t, 4, store.gets, "one Get per block")
+
+	fi, err := client.Stat("/dir")
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+}
+
+func TestBlobWriterOutOfOrder(t *testing.T) {
+	store := newMemBlobStore()
+
+	w := newBlobWriter(context.Background(), store, "file")
+	_, err := w.WriteAt([]byte("world"), 6)
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("hello "), 0)
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("x"), 0)
+	assert.Equal(t, errBlobNotSequential, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, "hello world", string(store.blobs["file"]))
+
+	w = newBlobWriter(context.Background(), store, "hole")
+	_, err = w.WriteAt([]byte("world"), 6)
+	require.NoError(t, err)
+	assert.Equal(t, errBlobNotSequential, w.Close())
+	assert.NotContains(t, store.blobs, "hole")
+}
+
+func TestBlobStoreCommands(t *testing.T) {
+	store := newMemBlobStore()
+	store.blobs["a/one"] = []byte("1")
+	store.blobs["a/sub/two"] = []byte("22")
+	store.blobs["top"] = []byte("333")
+	client, _ := handlersClientPair(t, BlobStoreHandler(store), nil)
+
+	names := func(dir string) []string {
+		fis, err := client.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"a", "top"}, names("/"))
+	assert.Equal(t, []string{"one", "sub"}, names("/a"))
+
+	_, err := client.ReadDir("/missing")
+	assert.True(t, os.IsNotExist(err))
+
+	// empty directories are kept by their marker
+	require.NoError(t, client.Mkdir("/empty"))
+	assert.Empty(t, names("/empty"))
+	assert.Error(t, client.Mkdir("/empty"))
+	require.NoError(t, client.RemoveDirectory("/empty"))
+	_, err = client.Stat("/empty")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, client.RemoveDirectory("/a"), "not empty")
+	assert.Error(t, client.Rename("/top", "/a/one"), "target exists")
+
+	require.NoError(t, client.Rename("/a", "/b"))
+	assert.Equal(t, []string{"b", "top"}, names("/"))
+	assert.Equal(t, []byte("22"), store.blobs["b/sub/two"])
+
+	require.NoError(t, client.PosixRename("/top", "/b/one"))
+	assert.Equal(t, []byte("333"), store.blobs["b/one"])
+
+	require.NoError(t, client.Truncate("/b/one", 0))
+	assert.Empty(t, store.blobs["b/one"])
+	assert.Error(t, client.Truncate("/b/one", 10))
+
+	require.NoError(t, client.Remove("/b/one"))
+	_, err = client.Stat("/b/one")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, client.Symlink("/b/sub/two", "/link"))
+}
@@ -0,0 +1,163 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// syncBlockSize is the size of the blocks SyncFileBlocks compares.
+const syncBlockSize = 64 * 1024
+
+// syncBlocksPerRequest is the number of blocks SyncFileBlocks has hashed by
+// a request, for the hashes to fit in a reply.
+const syncBlocksPerRequest = 2048
+
+// syncMaxRun is the most data of consecutive blocks SyncFileBlocks writes at
+// once.
+const syncMaxRun = 1 << 20
+
+// SyncFileBlocks updates the remote file remotePath in place to the content
+// of the local file localPath, like Upload, but sends only the blocks of
+// localPath which differ from those of remotePath at the same offset, as
+// hashed by the server with the check-file-handle extension, so that the
+// large files changed in place, such as disk images or databases, are
+// updated in a fraction of the time.
+//
+// This is an in-place block sync, not rsync: no rolling checksum finds the
+// blocks moved, so the data following data inserted or removed is sent
+// again.
+//
+// remotePath is created if missing, and truncated to the size of localPath.
+// The whole file is sent to the servers without check-file-handle. The
+// attributes selected by opts are applied once the content is updated.
+func (c *Client) SyncFileBlocks(localPath, remotePath string, opts ...TransferOption) error {
+	o := newTransferOptions(opts)
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	// check-file-handle reads the file
+	dst, err := c.createFile(context.Background(), remotePath, os.O_RDWR|os.O_CREATE, o.createParents)
+	if err != nil {
+		return err
+	}
+	if err := syncFile(dst, src, fi.Size()); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return preserveAttrs(c, remotePath, fi, o)
+}
+
+// syncFile updates dst to the content of src, of the given size.
+func syncFile(dst *File, src io.ReaderAt, size int64) error {
+	fi, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+
+	common := fi.Size()
+	if size < common {
+		common = size
+	}
+	if _, ok := dst.c.HasExtension(checkFileExtension); !ok {
+		common = 0
+	}
+	for off := int64(0); off < common; {
+		length := common - off
+		if length > syncBlockSize*syncBlocksPerRequest {
+			length = syncBlockSize * syncBlocksPerRequest
+		}
+		if err := syncRange(dst, src, off, length); err != nil {
+			return err
+		}
+		off += length
+	}
+
+	if size > common {
+		if _, err := dst.Seek(common, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := dst.ReadFrom(io.NewSectionReader(src, common, size-common)); err != nil {
+			return err
+		}
+	}
+	if fi.Size() > size {
+		return dst.Truncate(size)
+	}
+	return nil
+}
+
+// syncRange writes the blocks of the length bytes from off of src which
+// differ from those of dst.
+func syncRange(dst *File, src io.ReaderAt, off, length int64) error {
+	name, hashes, err := dst.checkFileBlocks(checkFileAlgorithms(), off, length, syncBlockSize)
+	if err != nil {
+		return err
+	}
+	h := newCheckFileHash(name)
+	if h == nil {
+		return ErrSSHFxOpUnsupported
+	}
+	blocks := int((length + syncBlockSize - 1) / syncBlockSize)
+	if len(hashes) != blocks*h.Size() {
+		return errors.Errorf("sftp: %d bytes of %s hashes for %d blocks", len(hashes), name, blocks)
+	}
+
+	run := make([]byte, 0, syncMaxRun)
+	var runOff int64
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		_, err := dst.WriteAt(run, runOff)
+		run = run[:0]
+		return err
+	}
+
+	block := make([]byte, syncBlockSize)
+	for i := 0; i < blocks; i++ {
+		blockOff := off + int64(i)*syncBlockSize
+		b := block
+		if rest := off + length - blockOff; rest < syncBlockSize {
+			b = block[:rest]
+		}
+		if _, err := src.ReadAt(b, blockOff); err != nil {
+			return err
+		}
+
+		h.Reset()
+		h.Write(b)
+		if bytes.Equal(h.Sum(nil), hashes[i*h.Size():(i+1)*h.Size()]) {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(run)+len(b) > cap(run) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if len(run) == 0 {
+			runOff = blockOff
+		}
+		run = append(run, b...)
+	}
+	return flush()
+}
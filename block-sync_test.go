@@ -0,0 +1,85 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientSyncFileBlocks(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, InMemHandler())
+	go server.Serve()
+	sent := &countingWriter{WriteCloser: cw}
+	client, err := NewClientPipe(cr, sent)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-sync")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "image")
+
+	content := make([]byte, 16*syncBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(content)
+	require.NoError(t, ioutil.WriteFile(local, content, 0644))
+
+	sync := func(t *testing.T, content []byte) int64 {
+		require.NoError(t, ioutil.WriteFile(local, content, 0644))
+		atomic.StoreInt64(&sent.n, 0)
+		require.NoError(t, client.SyncFileBlocks(local, "/image"))
+		got, err := getTestFile(client, "/image")
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(content, got))
+		return atomic.LoadInt64(&sent.n)
+	}
+
+	t.Run("Created", func(t *testing.T) {
+		assert.Greater(t, sync(t, content), int64(len(content)))
+	})
+
+	t.Run("Unchanged", func(t *testing.T) {
+		assert.Less(t, sync(t, content), int64(syncBlockSize))
+	})
+
+	t.Run("ChangedInPlace", func(t *testing.T) {
+		copy(content[10*syncBlockSize+5:], "changed")
+		copy(content[len(content)-3:], "end")
+		n := sync(t, content)
+		assert.Greater(t, n, int64(syncBlockSize))
+		assert.Less(t, n, int64(3*syncBlockSize))
+	})
+
+	t.Run("Grown", func(t *testing.T) {
+		content = append(content, bytes.Repeat([]byte("x"), syncBlockSize)...)
+		n := sync(t, content)
+		assert.Greater(t, n, int64(syncBlockSize))
+		assert.Less(t, n, int64(3*syncBlockSize))
+	})
+
+	t.Run("Shrunk", func(t *testing.T) {
+		content = content[:8*syncBlockSize+7]
+		assert.Less(t, sync(t, content), int64(2*syncBlockSize))
+	})
+
+	t.Run("NoCheckFile", func(t *testing.T) {
+		delete(client.ext, checkFileExtension)
+		assert.Greater(t, sync(t, content), int64(len(content)))
+	})
+}
@@ -0,0 +1,433 @@
+package sftp
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// checkFileExtension is answered with the hash of a range of an open file,
+// as specified by draft-ietf-secsh-filexfer-extensions-00, for clients to
+// compare files without transferring them.
+const checkFileExtension = "check-file-handle"
+
+// checkFileNameExtension is checkFileExtension for a file given by its name.
+const checkFileNameExtension = "check-file-name"
+
+// checkFileHashes are the hash algorithms of check-file-handle implemented,
+// in the order the Client prefers them.
+var checkFileHashes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+	{"md5", md5.New},
+}
+
+// newCheckFileHash returns a hash of the algorithm name, or nil.
+func newCheckFileHash(name string) hash.Hash {
+	for _, h := range checkFileHashes {
+		if h.name == name {
+			return h.new()
+		}
+	}
+	return nil
+}
+
+// sshFxpExtendedPacketCheckFile requests the hashes of the blocks of
+// BlockSize bytes of the range of Length bytes from Offset of the file of
+// Handle, with the first of the comma separated Algorithms supported.
+// A Length of 0 extends the range to the end of the file, a BlockSize of 0
+// hashes the range as a single block.
+type sshFxpExtendedPacketCheckFile struct {
+	ID              uint32
+	ExtendedRequest string
+	Handle          string
+	Algorithms      string
+	Offset          uint64
+	Length          uint64
+	BlockSize       uint32
+}
+
+func (p *sshFxpExtendedPacketCheckFile) id() uint32     { return p.ID }
+func (p *sshFxpExtendedPacketCheckFile) readonly() bool { return true }
+
+func (p *sshFxpExtendedPacketCheckFile) MarshalBinary() ([]byte, error) {
+	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
+		4 + len(checkFileExtension) +
+		4 + len(p.Handle) +
+		4 + len(p.Algorithms) +
+		8 + 8 + 4 // uint64(offset) + uint64(length) + uint32(block size)
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtended)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, checkFileExtension)
+	b = marshalString(b, p.Handle)
+	b = marshalString(b, p.Algorithms)
+	b = marshalUint64(b, p.Offset)
+	b = marshalUint64(b, p.Length)
+	b = marshalUint32(b, p.BlockSize)
+
+	return b, nil
+}
+
+func (p *sshFxpExtendedPacketCheckFile) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.ExtendedRequest, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Handle, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Algorithms, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Offset, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.Length, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.BlockSize, _, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *sshFxpExtendedPacketCheckFile) respond(s *Server) responsePacket {
+	f, ok := s.getHandle(p.Handle)
+	if !ok {
+		return statusFromError(p.ID, EBADF)
+	}
+	return p.hash(f)
+}
+
+// hash hashes the range requested of the file read with r.
+func (p *sshFxpExtendedPacketCheckFile) hash(r io.ReaderAt) responsePacket {
+	var name string
+	var h hash.Hash
+	for _, name = range strings.Split(p.Algorithms, ",") {
+		if h = newCheckFileHash(name); h != nil {
+			break
+		}
+	}
+	if h == nil || (p.BlockSize != 0 && p.BlockSize < 256) {
+		return statusFromError(p.ID, ErrSSHFxOpUnsupported)
+	}
+	if p.Offset > math.MaxInt64 {
+		return statusFromError(p.ID, os.ErrInvalid)
+	}
+
+	length := int64(p.Length)
+	if p.Length == 0 || p.Length > math.MaxInt64-p.Offset {
+		length = math.MaxInt64 - int64(p.Offset)
+	}
+	src := io.NewSectionReader(r, int64(p.Offset), length)
+
+	block := int64(p.BlockSize)
+	if block == 0 {
+		block = length
+	}
+	reply := &sshFxpCheckFileReplyPacket{ID: p.ID, Algorithm: name}
+	for {
+		h.Reset()
+		n, err := io.CopyN(h, src, block)
+		if err != nil && err != io.EOF {
+			return statusFromError(p.ID, err)
+		}
+		if n == 0 && len(reply.Hashes) > 0 {
+			break
+		}
+		reply.Hashes = h.Sum(reply.Hashes)
+		if err == io.EOF {
+			break
+		}
+	}
+	return reply
+}
+
+// sshFxpExtendedPacketCheckFileName is sshFxpExtendedPacketCheckFile for
+// the file Path.
+type sshFxpExtendedPacketCheckFileName struct {
+	ID              uint32
+	ExtendedRequest string
+	Path            string
+	Algorithms      string
+	Offset          uint64
+	Length          uint64
+	BlockSize       uint32
+}
+
+func (p *sshFxpExtendedPacketCheckFileName) id() uint32     { return p.ID }
+func (p *sshFxpExtendedPacketCheckFileName) readonly() bool { return true }
+
+func (p *sshFxpExtendedPacketCheckFileName) MarshalBinary() ([]byte, error) {
+	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
+		4 + len(checkFileNameExtension) +
+		4 + len(p.Path) +
+		4 + len(p.Algorithms) +
+		8 + 8 + 4 // uint64(offset) + uint64(length) + uint32(block size)
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtended)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, checkFileNameExtension)
+	b = marshalString(b, p.Path)
+	b = marshalString(b, p.Algorithms)
+	b = marshalUint64(b, p.Offset)
+	b = marshalUint64(b, p.Length)
+	b = marshalUint32(b, p.BlockSize)
+
+	return b, nil
+}
+
+func (p *sshFxpExtendedPacketCheckFileName) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.ExtendedRequest, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Path, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Algorithms, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Offset, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.Length, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.BlockSize, _, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// byHandle returns the check-file-handle request of the same range of the
+// file of handle.
+func (p *sshFxpExtendedPacketCheckFileName) byHandle(handle string) *sshFxpExtendedPacketCheckFile {
+	return &sshFxpExtendedPacketCheckFile{
+		ID:         p.ID,
+		Handle:     handle,
+		Algorithms: p.Algorithms,
+		Offset:     p.Offset,
+		Length:     p.Length,
+		BlockSize:  p.BlockSize,
+	}
+}
+
+func (p *sshFxpExtendedPacketCheckFileName) respond(s *Server) responsePacket {
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return statusFromError(p.ID, err)
+	}
+	defer f.Close()
+	return p.byHandle("").hash(f)
+}
+
+// checkFile serves check-file-handle and check-file-name for the file path,
+// with the ChecksumFileLister of the Handlers when they implement it, or
+// else by reading the file with the io.ReaderAt returned by open.
+func (rs *RequestServer) checkFile(ctx context.Context, p *sshFxpExtendedPacketCheckFile, path string, open func() (io.ReaderAt, error)) responsePacket {
+	if p.Offset > math.MaxInt64 || p.Length > math.MaxInt64 {
+		return statusFromError(p.ID, os.ErrInvalid)
+	}
+	if lister, ok := rs.Handlers.FileList.(ChecksumFileLister); ok && p.BlockSize == 0 {
+		request := NewRequest("Checksum", path).WithContext(ctx)
+		for _, name := range strings.Split(p.Algorithms, ",") {
+			var sum []byte
+			err := handleRequest(request, func(r *Request) (err error) {
+				sum, err = lister.Checksum(r, name, int64(p.Offset), int64(p.Length))
+				return err
+			})
+			if err == ErrSSHFxOpUnsupported {
+				continue
+			}
+			if err != nil {
+				return statusFromError(p.ID, err)
+			}
+			return &sshFxpCheckFileReplyPacket{ID: p.ID, Algorithm: name, Hashes: sum}
+		}
+	}
+
+	r, err := open()
+	if err != nil {
+		return statusFromError(p.ID, err)
+	}
+	if r == nil {
+		return statusFromError(p.ID, ErrSSHFxOpUnsupported)
+	}
+	return p.hash(r)
+}
+
+// checkFileName serves check-file-name, reading the file with the FileReader
+// of the Handlers unless hashed by their ChecksumFileLister.
+func (rs *RequestServer) checkFileName(ctx context.Context, p *sshFxpExtendedPacketCheckFileName) responsePacket {
+	var closer io.Closer
+	defer func() {
+		if closer != nil {
+			closer.Close()
+		}
+	}()
+	return rs.checkFile(ctx, p.byHandle(""), p.Path, func() (io.ReaderAt, error) {
+		request := NewRequest("Get", p.Path).WithContext(ctx)
+		request.Flags = sshFxfRead
+		var r io.ReaderAt
+		err := handleRequest(request, func(request *Request) (err error) {
+			r, err = rs.Handlers.FileGet.Fileread(request)
+			return err
+		})
+		closer, _ = r.(io.Closer)
+		return r, err
+	})
+}
+
+// sshFxpCheckFileReplyPacket is the SSH_FXP_EXTENDED_REPLY to
+// check-file-handle, with the hashes of the blocks one after the other.
+type sshFxpCheckFileReplyPacket struct {
+	ID        uint32
+	Algorithm string
+	Hashes    []byte
+}
+
+func (p *sshFxpCheckFileReplyPacket) id() uint32 { return p.ID }
+
+func (p *sshFxpCheckFileReplyPacket) MarshalBinary() ([]byte, error) {
+	const ext = "check-file"
+	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
+		4 + len(ext) +
+		4 + len(p.Algorithm) +
+		len(p.Hashes)
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtendedReply)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, ext)
+	b = marshalString(b, p.Algorithm)
+	b = append(b, p.Hashes...)
+
+	return b, nil
+}
+
+// checkFile returns the hash of the length bytes from off of the file, and
+// its algorithm, computed by the server with the check-file-handle extension.
+// The File must be open for reading.
+func (f *File) checkFile(off, length int64) (string, []byte, error) {
+	return f.checkFileWith(checkFileAlgorithms(), off, length)
+}
+
+// checkFileAlgorithms returns the algorithms of checkFileHashes, in the
+// format of check-file-handle.
+func checkFileAlgorithms() string {
+	names := make([]string, len(checkFileHashes))
+	for i, h := range checkFileHashes {
+		names[i] = h.name
+	}
+	return strings.Join(names, ",")
+}
+
+// checkFileWith is checkFile with the comma separated algorithms to choose from.
+func (f *File) checkFileWith(algorithms string, off, length int64) (string, []byte, error) {
+	return f.checkFileBlocks(algorithms, off, length, 0)
+}
+
+// checkFileBlocks is checkFileWith returning the hashes of the blocks of
+// blockSize bytes of the range, one after the other.
+func (f *File) checkFileBlocks(algorithms string, off, length int64, blockSize uint32) (string, []byte, error) {
+	if err := f.checkOpen("check-file"); err != nil {
+		return "", nil, err
+	}
+
+	id := f.c.nextID()
+	typ, data, err := f.c.sendPacket(nil, &sshFxpExtendedPacketCheckFile{
+		ID:         id,
+		Handle:     f.handle,
+		Algorithms: algorithms,
+		Offset:     uint64(off),
+		Length:     uint64(length),
+		BlockSize:  blockSize,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return unmarshalCheckFileReply(id, typ, data)
+}
+
+// unmarshalCheckFileReply returns the algorithm and the hashes of the reply
+// to the check-file request id.
+func unmarshalCheckFileReply(id uint32, typ byte, data []byte) (string, []byte, error) {
+	switch typ {
+	case sshFxpExtendedReply:
+		sid, data, err := unmarshalUint32Safe(data)
+		if err != nil {
+			return "", nil, err
+		}
+		if sid != id {
+			return "", nil, &unexpectedIDErr{id, sid}
+		}
+		if _, data, err = unmarshalStringSafe(data); err != nil {
+			return "", nil, err
+		}
+		name, data, err := unmarshalStringSafe(data)
+		if err != nil {
+			return "", nil, err
+		}
+		return name, data, nil
+	case sshFxpStatus:
+		return "", nil, normaliseError(unmarshalStatus(id, data))
+	default:
+		return "", nil, unimplementedPacketErr(typ)
+	}
+}
+
+// Checksum returns the hash of the length bytes from offset of the remote
+// file path, or of its data up to the end of the file with a length of 0,
+// computed by the server with the algorithm algo: "md5", "sha1" or
+// "sha256". It uses the check-file-name extension, or else opens the file
+// for check-file-handle; ErrSSHFxOpUnsupported is returned if the server
+// supports neither, or not algo.
+func (c *Client) Checksum(path, algo string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, os.ErrInvalid
+	}
+
+	var name string
+	var sum []byte
+	var err error
+	if _, ok := c.HasExtension(checkFileNameExtension); ok {
+		id := c.nextID()
+		var typ byte
+		var data []byte
+		typ, data, err = c.sendPacket(nil, &sshFxpExtendedPacketCheckFileName{
+			ID:         id,
+			Path:       path,
+			Algorithms: algo,
+			Offset:     uint64(offset),
+			Length:     uint64(length),
+		})
+		if err != nil {
+			return nil, err
+		}
+		name, sum, err = unmarshalCheckFileReply(id, typ, data)
+	} else if _, ok := c.HasExtension(checkFileExtension); ok {
+		var f *File
+		if f, err = c.Open(path); err != nil {
+			return nil, err
+		}
+		name, sum, err = f.checkFileWith(algo, offset, length)
+		f.Close()
+	} else {
+		return nil, ErrSSHFxOpUnsupported
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if name != algo {
+		return nil, ErrSSHFxOpUnsupported
+	}
+	return sum, nil
+}
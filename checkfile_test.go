@@ -0,0 +1,108 @@
+package sftp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientChecksum(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-checksum")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(name, []byte("hello world"), 0600))
+
+	sum, err := client.Checksum(name, "md5", 0, 0)
+	require.NoError(t, err)
+	want := md5.Sum([]byte("hello world"))
+	assert.Equal(t, want[:], sum)
+
+	sum, err = client.Checksum(name, "sha256", 6, 3)
+	require.NoError(t, err)
+	want256 := sha256.Sum256([]byte("wor"))
+	assert.Equal(t, want256[:], sum)
+
+	_, err = client.Checksum(name, "crc32", 0, 0)
+	assert.Equal(t, ErrSSHFxOpUnsupported, err.(*StatusError).FxCode())
+	_, err = client.Checksum(filepath.Join(dir, "missing"), "md5", 0, 0)
+	assert.True(t, os.IsNotExist(err))
+
+	// with check-file-handle only
+	delete(client.ext, checkFileNameExtension)
+	sum, err = client.Checksum(name, "md5", 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, want[:], sum)
+}
+
+// checksumLister answers the checksums requests of sha1 with the algorithm
+// and the range requested.
+type checksumLister struct {
+	FileLister
+}
+
+func (checksumLister) Checksum(r *Request, algorithm string, offset, length int64) ([]byte, error) {
+	if algorithm != "sha1" {
+		return nil, ErrSSHFxOpUnsupported
+	}
+	return []byte(r.Filepath + " " + algorithm), nil
+}
+
+func TestRequestServerChecksum(t *testing.T) {
+	h := InMemHandler()
+	for _, tt := range []struct {
+		name string
+		list FileLister
+		want func(algo string) []byte
+	}{
+		{"FileLister", h.FileList, func(algo string) []byte {
+			sum := newCheckFileHash(algo)
+			io.WriteString(sum, "hello world")
+			return sum.Sum(nil)
+		}},
+		{"ChecksumFileLister", checksumLister{h.FileList}, func(algo string) []byte {
+			if algo != "sha1" {
+				// hashed by reading the file
+				sum := newCheckFileHash(algo)
+				io.WriteString(sum, "hello world")
+				return sum.Sum(nil)
+			}
+			return []byte("/file sha1")
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := handlersClientPair(t, Handlers{h.FileGet, h.FilePut, h.FileCmd, tt.list}, nil)
+
+			_, err := putTestFile(client, "/file", "hello world")
+			require.NoError(t, err)
+
+			for _, algo := range []string{"sha1", "sha256"} {
+				sum, err := client.Checksum("/file", algo, 0, 0)
+				require.NoError(t, err)
+				assert.Equal(t, tt.want(algo), sum, algo)
+			}
+
+			f, err := client.Open("/file")
+			require.NoError(t, err)
+			defer f.Close()
+			name, sum, err := f.checkFileWith("sha1", 0, 0)
+			require.NoError(t, err)
+			assert.Equal(t, "sha1", name)
+			assert.Equal(t, tt.want("sha1"), sum)
+		})
+	}
+}
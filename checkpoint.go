@@ -0,0 +1,124 @@
+package sftp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// A Checkpoint records in a local state file the stripes of a striped transfer
+// completed so far, so that an interrupted transfer can be resumed where it
+// stopped, even after the process restarts.
+// See StripedDownloadWithCheckpoint and StripedUploadWithCheckpoint.
+//
+// The state file is JSON, holding the size of the transfer,
+// the stripe size, and the indexes of the completed stripes.
+type Checkpoint struct {
+	file string
+
+	mu    sync.Mutex
+	state checkpointState
+	done  map[int64]bool
+}
+
+type checkpointState struct {
+	Size       int64   `json:"size"`
+	StripeSize int64   `json:"stripe_size"`
+	Done       []int64 `json:"done"`
+}
+
+// OpenCheckpoint loads the checkpoint saved in file,
+// or returns an empty checkpoint if file does not exist.
+func OpenCheckpoint(file string) (*Checkpoint, error) {
+	cp := &Checkpoint{
+		file: file,
+		done: make(map[int64]bool),
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &cp.state); err != nil {
+		return nil, err
+	}
+	for _, i := range cp.state.Done {
+		cp.done[i] = true
+	}
+	return cp, nil
+}
+
+// Remove removes the state file, typically once the transfer succeeded.
+func (cp *Checkpoint) Remove() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.state.Done = nil
+	cp.done = make(map[int64]bool)
+	if err := os.Remove(cp.file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// resuming returns true if some stripes are recorded as completed.
+func (cp *Checkpoint) resuming() bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return len(cp.done) > 0
+}
+
+// begin starts a transfer, progress recorded for a transfer of another size
+// or with other stripes is dropped.
+func (cp *Checkpoint) begin(size, stripeSize int64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.state.Size != size || cp.state.StripeSize != stripeSize {
+		cp.state = checkpointState{Size: size, StripeSize: stripeSize}
+		cp.done = make(map[int64]bool)
+	}
+}
+
+func (cp *Checkpoint) isDone(stripe int64) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.done[stripe]
+}
+
+// markDone records the stripe as completed, and saves the state file.
+func (cp *Checkpoint) markDone(stripe int64) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.done[stripe] = true
+	cp.state.Done = append(cp.state.Done, stripe)
+	sort.Slice(cp.state.Done, func(i, j int) bool { return cp.state.Done[i] < cp.state.Done[j] })
+
+	b, err := json.Marshal(&cp.state)
+	if err != nil {
+		return err
+	}
+
+	// write then rename, so that a crash never leaves a truncated state file
+	tmp, err := ioutil.TempFile(filepath.Dir(cp.file), filepath.Base(cp.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), cp.file)
+}
@@ -0,0 +1,69 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingReaderAt fails reads from the given offset.
+type failingReaderAt struct {
+	io.ReaderAt
+	off int64
+}
+
+func (r failingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off >= r.off {
+		return 0, errTest
+	}
+	return r.ReaderAt.ReadAt(b, off)
+}
+
+func TestCheckpointResumeUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clients, closeAll := stripedClients(t, 1)
+	defer closeAll()
+
+	data := make([]byte, 10000)
+	rand.Read(data)
+	remote := path.Join(dir, "remote")
+	state := path.Join(dir, "state.json")
+
+	cp, err := OpenCheckpoint(state)
+	require.NoError(t, err)
+	r := failingReaderAt{bytes.NewReader(data), 5000}
+	err = StripedUploadWithCheckpoint(clients, r, int64(len(data)), remote, 1000, cp)
+	assert.Equal(t, errTest, err)
+
+	// as after a restart
+	cp, err = OpenCheckpoint(state)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{0, 1, 2, 3, 4}, cp.state.Done)
+
+	err = StripedUploadWithCheckpoint(clients, bytes.NewReader(data), int64(len(data)), remote, 1000, cp)
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(remote)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Len(t, cp.state.Done, 10)
+
+	require.NoError(t, cp.Remove())
+	_, err = os.Stat(state)
+	assert.True(t, os.IsNotExist(err))
+
+	// progress of another transfer is dropped
+	cp.begin(100, 10)
+	require.NoError(t, cp.markDone(3))
+	cp.begin(100, 20)
+	assert.False(t, cp.isDone(3))
+}
@@ -0,0 +1,62 @@
+package sftp
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// ClientInfo is how the client of a session introduced itself in its
+// SSH_FXP_INIT, for servers and Handlers to adapt to limited clients.
+type ClientInfo struct {
+	// Version is the protocol version of the client.
+	Version uint32
+
+	// Extensions maps the names of the extensions advertised by the client
+	// to their data. It must not be modified.
+	Extensions map[string]string
+}
+
+// HasExtension returns the data of the extension name, and whether the
+// client advertised it.
+func (ci ClientInfo) HasExtension(name string) (string, bool) {
+	data, ok := ci.Extensions[name]
+	return data, ok
+}
+
+type clientInfoKey struct{}
+
+// ClientInfoFromContext returns the ClientInfo of the session serving the
+// request with the context ctx, as returned by Request.Context. It returns
+// false if the client has not sent its SSH_FXP_INIT, or ctx is not the
+// context of a request served by a RequestServer.
+func ClientInfoFromContext(ctx context.Context) (ClientInfo, bool) {
+	h, ok := ctx.Value(clientInfoKey{}).(*clientInfoHolder)
+	if !ok {
+		return ClientInfo{}, false
+	}
+	return h.load()
+}
+
+// clientInfoHolder holds the ClientInfo of a session, once known.
+type clientInfoHolder struct {
+	v atomic.Value // *ClientInfo
+}
+
+func (h *clientInfoHolder) store(p *sshFxInitPacket) {
+	info := &ClientInfo{
+		Version:    p.Version,
+		Extensions: make(map[string]string, len(p.Extensions)),
+	}
+	for _, ext := range p.Extensions {
+		info.Extensions[ext.Name] = ext.Data
+	}
+	h.v.Store(info)
+}
+
+func (h *clientInfoHolder) load() (ClientInfo, bool) {
+	info, ok := h.v.Load().(*ClientInfo)
+	if !ok {
+		return ClientInfo{}, false
+	}
+	return *info, true
+}
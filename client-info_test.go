@@ -0,0 +1,73 @@
+package sftp
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerClientInfo(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	require.NoError(t, err)
+
+	_, ok := server.ClientInfo()
+	assert.False(t, ok)
+
+	go server.Serve()
+	client, err := NewClientPipe(cr, cw, UseAsyncWrites(true))
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	info, ok := server.ClientInfo()
+	require.True(t, ok)
+	assert.Equal(t, uint32(sftpProtocolVersion), info.Version)
+	data, ok := info.HasExtension(asyncWriteExtension)
+	assert.True(t, ok)
+	assert.Equal(t, "1", data)
+	_, ok = info.HasExtension(pingExtension)
+	assert.False(t, ok)
+}
+
+// clientInfoCmder records the ClientInfo of the requests.
+type clientInfoCmder struct {
+	FileCmder
+	infos chan ClientInfo
+}
+
+func (c clientInfoCmder) Filecmd(r *Request) error {
+	info, ok := ClientInfoFromContext(r.Context())
+	if !ok {
+		return ErrSSHFxFailure
+	}
+	c.infos <- info
+	return c.FileCmder.Filecmd(r)
+}
+
+func TestRequestServerClientInfo(t *testing.T) {
+	handlers := InMemHandler()
+	cmder := clientInfoCmder{handlers.FileCmd, make(chan ClientInfo, 1)}
+	handlers.FileCmd = cmder
+
+	client, server := handlersClientPair(t, handlers, nil)
+
+	require.NoError(t, client.Mkdir("/dir"))
+	info := <-cmder.infos
+	assert.Equal(t, uint32(sftpProtocolVersion), info.Version)
+	assert.Empty(t, info.Extensions)
+
+	serverInfo, ok := server.ClientInfo()
+	require.True(t, ok)
+	assert.Equal(t, info, serverInfo)
+
+	_, ok = ClientInfoFromContext(context.Background())
+	assert.False(t, ok)
+}
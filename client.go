@@ -2,6 +2,7 @@ package sftp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"math"
@@ -28,6 +29,10 @@ var (
 	//
 	// Deprecated: please use ErrInternalInconsistency
 	InternalInconsistency = ErrInternalInconsistency
+	// ErrExtensionNotSupported is returned, wrapped with the name of the
+	// extension, by the methods which need an extension the server does not
+	// support; see RequireExtension.
+	ErrExtensionNotSupported = errors.New("extension not supported by the server")
 )
 
 // A ClientOption is a function which applies configuration to a Client.
@@ -39,7 +44,8 @@ type ClientOption func(*Client) error
 // If you get the error "failed to send packet header: EOF" when copying a
 // large file, try lowering this number.
 //
-// The default packet size is 32768 bytes.
+// The default packet size is 32768 bytes, or the size the server allows if
+// it advertises its limits, see Client.Limits.
 func MaxPacketChecked(size int) ClientOption {
 	return func(c *Client) error {
 		if size < 1 {
@@ -49,6 +55,7 @@ func MaxPacketChecked(size int) ClientOption {
 			return errors.New("sizes larger than 32KB might not work with all servers")
 		}
 		c.maxPacket = size
+		c.maxPacketSet = true
 		return nil
 	}
 }
@@ -61,13 +68,15 @@ func MaxPacketChecked(size int) ClientOption {
 // If you get the error "failed to send packet header: EOF" when copying a
 // large file, try lowering this number.
 //
-// The default packet size is 32768 bytes.
+// The default packet size is 32768 bytes, or the size the server allows if
+// it advertises its limits, see Client.Limits.
 func MaxPacketUnchecked(size int) ClientOption {
 	return func(c *Client) error {
 		if size < 1 {
 			return errors.New("size must be greater or equal to 1")
 		}
 		c.maxPacket = size
+		c.maxPacketSet = true
 		return nil
 	}
 }
@@ -79,7 +88,8 @@ func MaxPacketUnchecked(size int) ClientOption {
 // If you get the error "failed to send packet header: EOF" when copying a
 // large file, try lowering this number.
 //
-// The default packet size is 32768 bytes.
+// The default packet size is 32768 bytes, or the size the server allows if
+// it advertises its limits, see Client.Limits.
 func MaxPacket(size int) ClientOption {
 	return MaxPacketChecked(size)
 }
@@ -112,6 +122,49 @@ func UseConcurrentWrites(value bool) ClientOption {
 	}
 }
 
+// UseAllocator sets the Allocator providing the buffers the payloads of the
+// data replies to reads are received into, which are reused once the data is
+// copied out of them. The default uses a sync.Pool.
+func UseAllocator(a Allocator) ClientOption {
+	return func(c *Client) error {
+		c.clientConn.buffers = a
+		return nil
+	}
+}
+
+// UseAsyncWrites requests the server to acknowledge writes before performing them,
+// which reduces the latency of each write and improves upload throughput.
+//
+// The server must support it, see WithAsyncWrites and WithRSAsyncWrites,
+// otherwise writes are acknowledged as usual.
+// A write failing after its acknowledgment is reported when closing the File,
+// as a *DeferredWriteError giving the offset of the first failed write.
+// Data written is not known to be stored until the File is closed successfully.
+func UseAsyncWrites(value bool) ClientOption {
+	return func(c *Client) error {
+		c.useAsyncWrites = value
+		return nil
+	}
+}
+
+// UseProfilerLabels labels the goroutines transferring files with pprof labels,
+// for profiles to be broken down by transfer: "sftp.method" for the File
+// method, as "ReadFrom", "sftp.path" for the first element of the path, and
+// "sftp.session" for the Client.
+//
+// The labels are set on the goroutine calling the File method, and inherited
+// by the goroutines it starts. The labels it had before are cleared when
+// the method returns.
+func UseProfilerLabels(value bool) ClientOption {
+	return func(c *Client) error {
+		c.profileSession = ""
+		if value {
+			c.profileSession = nextSessionID()
+		}
+		return nil
+	}
+}
+
 // UseConcurrentReads allows the Client to perform concurrent Reads.
 //
 // Concurrent reads are generally safe to use and not using them will degrade
@@ -166,13 +219,55 @@ type Client struct {
 
 	maxPacket             int // max packet size read or written.
 	maxConcurrentRequests int
-	nextid                uint32
+
+	// the limits of the server, to which maxPacket is tuned unless set by
+	// its option
+	limits       Limits
+	maxPacketSet bool
 
 	// write concurrency is… error prone.
 	// Default behavior should be to not use it.
 	useConcurrentWrites    bool
 	useFstat               bool
 	disableConcurrentReads bool
+
+	// async writes are requested by useAsyncWrites,
+	// and asyncWrites is set if the server agreed
+	useAsyncWrites bool
+	asyncWrites    bool
+
+	// the file data is compressed if requested by useCompression, and the
+	// server agreed
+	useCompression bool
+
+	// the highest protocol version requested by MaxProtocolVersion, if set,
+	// and the version negotiated
+	maxVersion uint32
+	version    uint32
+
+	// if not empty, transfers are labelled with this session for profiling
+	profileSession string
+
+	// quirks are applied after the handshake, and detected from
+	// serverVersion and the extensions of the server if not set.
+	serverVersion string
+	quirks        *ServerQuirks
+
+	// verifyWrites is set by UseWriteVerification
+	verifyWrites bool
+
+	// if not nil, the results of Stat and Lstat are cached
+	statCache *statCache
+
+	// the working directory set by Chdir, if any
+	dir atomic.Value // string
+
+	// the SSH connection made by Dial, closed along with the Client
+	sshConn *ssh.Client
+
+	// the Files not closed yet, closed by CloseGracefully
+	filesMu sync.Mutex
+	files   map[*File]struct{}
 }
 
 // NewClient creates a new SFTP client on conn, using zero or more option
@@ -194,9 +289,28 @@ func NewClient(conn *ssh.Client, opts ...ClientOption) (*Client, error) {
 		return nil, err
 	}
 
+	opts = append([]ClientOption{withServerVersion(string(conn.ServerVersion()))}, opts...)
 	return NewClientPipe(pr, pw, opts...)
 }
 
+// Close closes the SFTP session, and the SSH connection if the Client was
+// made by Dial, once the outstanding requests are answered and the Files
+// not closed yet are closed, as CloseGracefully does.
+func (c *Client) Close() error {
+	return c.CloseGracefully(context.Background())
+}
+
+// teardown closes the SFTP session without waiting for outstanding requests.
+func (c *Client) teardown() error {
+	err := c.clientConn.Close()
+	if c.sshConn != nil {
+		if err2 := c.sshConn.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
 // NewClientPipe creates a new SFTP client given a Reader and a WriteCloser.
 // This can be used for connecting to an SFTP server over TCP/TLS or by using
 // the system's ssh client program (e.g. via exec.Command).
@@ -207,11 +321,12 @@ func NewClientPipe(rd io.Reader, wr io.WriteCloser, opts ...ClientOption) (*Clie
 				Reader:      rd,
 				WriteCloser: wr,
 			},
-			inflight: make(map[uint32]chan<- result),
-			closed:   make(chan struct{}),
+			buffers: defaultAllocator,
+			closed:  make(chan struct{}),
 		},
 
-		ext: make(map[string]string),
+		ext:   make(map[string]string),
+		files: make(map[*File]struct{}),
 
 		maxPacket:             1 << 15,
 		maxConcurrentRequests: 64,
@@ -236,6 +351,12 @@ func NewClientPipe(rd io.Reader, wr io.WriteCloser, opts ...ClientOption) (*Clie
 	sftp.clientConn.wg.Add(1)
 	go sftp.loop()
 
+	if err := sftp.applyLimits(); err != nil {
+		sftp.teardown()
+		return nil, err
+	}
+	sftp.applyQuirks()
+
 	return sftp, nil
 }
 
@@ -248,22 +369,55 @@ func NewClientPipe(rd io.Reader, wr io.WriteCloser, opts ...ClientOption) (*Clie
 // read/write at the same time. For those services you will need to use
 // `client.OpenFile(os.O_WRONLY|os.O_CREATE|os.O_TRUNC)`.
 func (c *Client) Create(path string) (*File, error) {
-	return c.open(path, flags(os.O_RDWR|os.O_CREATE|os.O_TRUNC))
+	return c.CreateContext(context.Background(), path)
+}
+
+// CreateContext is like Create, but returns ctx.Err() once ctx is done.
+func (c *Client) CreateContext(ctx context.Context, path string) (*File, error) {
+	return c.open(ctx, path, flags(os.O_RDWR|os.O_CREATE|os.O_TRUNC))
+}
+
+// CreateAll creates the named file like Create does, creating the missing
+// parent directories first, like MkdirAll.
+func (c *Client) CreateAll(path string) (*File, error) {
+	return c.CreateAllContext(context.Background(), path)
+}
+
+// CreateAllContext is like CreateAll, but returns ctx.Err() once ctx is done.
+func (c *Client) CreateAllContext(ctx context.Context, path string) (*File, error) {
+	return c.createFile(ctx, path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, true)
+}
+
+// createFile opens path with the flags f, which create it. If parents is
+// set and its directory is missing, the directory is created with MkdirAll
+// before opening path again.
+func (c *Client) createFile(ctx context.Context, p string, f int, parents bool) (*File, error) {
+	file, err := c.open(ctx, p, flags(f))
+	if err == nil || !parents || !os.IsNotExist(err) {
+		return file, err
+	}
+	if err := c.MkdirAllContext(ctx, path.Dir(p)); err != nil {
+		return nil, err
+	}
+	return c.open(ctx, p, flags(f))
 }
 
 const sftpProtocolVersion = 3 // http://tools.ietf.org/html/draft-ietf-secsh-filexfer-02
 
 func (c *Client) sendInit() error {
+	var exts []extensionPair
+	if c.useAsyncWrites {
+		exts = append(exts, extensionPair{Name: asyncWriteExtension, Data: "1"})
+	}
+	if c.useCompression {
+		exts = append(exts, extensionPair{Name: compressionExtension, Data: compressionGzip})
+	}
 	return c.clientConn.conn.sendPacket(&sshFxInitPacket{
-		Version: sftpProtocolVersion, // http://tools.ietf.org/html/draft-ietf-secsh-filexfer-02
+		Version:    c.requestedVersion(),
+		Extensions: exts,
 	})
 }
 
-// returns the next value of c.nextid
-func (c *Client) nextID() uint32 {
-	return atomic.AddUint32(&c.nextid, 1)
-}
-
 func (c *Client) recvVersion() error {
 	typ, data, err := c.recvPacket(0)
 	if err != nil {
@@ -277,9 +431,10 @@ func (c *Client) recvVersion() error {
 	if err != nil {
 		return err
 	}
-	if version != sftpProtocolVersion {
-		return &unexpectedVersionErr{sftpProtocolVersion, version}
+	if version < sftpProtocolVersion || version > c.requestedVersion() {
+		return &unexpectedVersionErr{c.requestedVersion(), version}
 	}
+	c.version = version
 
 	for len(data) > 0 {
 		var ext extensionPair
@@ -290,6 +445,13 @@ func (c *Client) recvVersion() error {
 		c.ext[ext.Name] = ext.Data
 	}
 
+	if _, ok := c.ext[asyncWriteExtension]; ok {
+		c.asyncWrites = c.useAsyncWrites
+	}
+	if c.ext[compressionExtension] == compressionGzip {
+		c.clientConn.conn.setCompressed(c.useCompression)
+	}
+
 	return nil
 }
 
@@ -302,15 +464,57 @@ func (c *Client) HasExtension(name string) (string, bool) {
 	return data, ok
 }
 
+// RequireExtension returns nil if the server supports the named extension,
+// and ErrExtensionNotSupported, wrapped with the name, otherwise.
+func (c *Client) RequireExtension(name string) error {
+	if _, ok := c.HasExtension(name); !ok {
+		return errors.Wrap(ErrExtensionNotSupported, name)
+	}
+	return nil
+}
+
 // Walk returns a new Walker rooted at root.
-func (c *Client) Walk(root string) *fs.Walker {
-	return fs.WalkFS(root, c)
+// The symbolic links are reported as such, without being followed,
+// unless set otherwise with WithSymlinks.
+//
+// The subdirectories of a directory are listed concurrently, ahead of the
+// walk, up to the limit set by MaxConcurrentRequestsPerFile, or else by
+// WithWalkConcurrency.
+func (c *Client) Walk(root string, opts ...TransferOption) *fs.Walker {
+	return fs.WalkFS(root, c.walkFS(newTransferOptions(opts)))
+}
+
+// walkFS returns the FileSystem walked by Walk and WalkDir.
+func (c *Client) walkFS(o transferOptions) fs.FileSystem {
+	var fsys fs.FileSystem = c
+	if o.symlinks != SymlinkRecreate {
+		fsys = newSymlinkFS(c, o.symlinks)
+	}
+	n := o.walkConcurrency
+	if n == 0 {
+		n = c.readDirConcurrency()
+	}
+	if n > 1 {
+		fsys = newPrefetchFS(fsys, n)
+	}
+	return fsys
 }
 
 // ReadDir reads the directory named by dirname and returns a list of
 // directory entries.
 func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
-	handle, err := c.opendir(p)
+	return c.ReadDirContext(context.Background(), p)
+}
+
+// ReadDirContext is like ReadDir, but returns ctx.Err() once ctx is done.
+func (c *Client) ReadDirContext(ctx context.Context, p string) ([]os.FileInfo, error) {
+	return c.cachedReadDir(p, func(p string) ([]os.FileInfo, error) {
+		return c.readDir(ctx, p)
+	})
+}
+
+func (c *Client) readDir(ctx context.Context, p string) ([]os.FileInfo, error) {
+	handle, err := c.opendir(ctx, p)
 	if err != nil {
 		return nil, err
 	}
@@ -319,7 +523,7 @@ func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
 	var done = false
 	for !done {
 		id := c.nextID()
-		typ, data, err1 := c.sendPacket(nil, &sshFxpReaddirPacket{
+		typ, data, err1 := c.sendPacketContext(ctx, nil, &sshFxpReaddirPacket{
 			ID:     id,
 			Handle: handle,
 		})
@@ -330,22 +534,11 @@ func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
 		}
 		switch typ {
 		case sshFxpName:
-			sid, data := unmarshalUint32(data)
-			if sid != id {
-				return nil, &unexpectedIDErr{id, sid}
-			}
-			count, data := unmarshalUint32(data)
-			for i := uint32(0); i < count; i++ {
-				var filename string
-				filename, data = unmarshalString(data)
-				_, data = unmarshalString(data) // discard longname
-				var attr *FileStat
-				attr, data = unmarshalAttrs(data)
-				if filename == "." || filename == ".." {
-					continue
-				}
-				attrs = append(attrs, fileInfoFromStat(attr, path.Base(filename)))
+			entries, err := c.unmarshalDirEntries(id, data)
+			if err != nil {
+				return nil, err
 			}
+			attrs = append(attrs, entries...)
 		case sshFxpStatus:
 			// TODO(dfc) scope warning!
 			err = normaliseError(unmarshalStatus(id, data))
@@ -360,9 +553,9 @@ func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
 	return attrs, err
 }
 
-func (c *Client) opendir(path string) (string, error) {
+func (c *Client) opendir(ctx context.Context, path string) (string, error) {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpOpendirPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpOpendirPacket{
 		ID:   id,
 		Path: path,
 	})
@@ -387,18 +580,32 @@ func (c *Client) opendir(path string) (string, error) {
 // Stat returns a FileInfo structure describing the file specified by path 'p'.
 // If 'p' is a symbolic link, the returned FileInfo structure describes the referent file.
 func (c *Client) Stat(p string) (os.FileInfo, error) {
-	fs, err := c.stat(p)
-	if err != nil {
-		return nil, err
-	}
-	return fileInfoFromStat(fs, path.Base(p)), nil
+	return c.StatContext(context.Background(), p)
+}
+
+// StatContext is like Stat, but returns ctx.Err() once ctx is done.
+func (c *Client) StatContext(ctx context.Context, p string) (os.FileInfo, error) {
+	return c.cachedStat(p, true, func(p string) (*FileStat, error) {
+		return c.stat(ctx, p)
+	})
 }
 
 // Lstat returns a FileInfo structure describing the file specified by path 'p'.
 // If 'p' is a symbolic link, the returned FileInfo structure describes the symbolic link.
 func (c *Client) Lstat(p string) (os.FileInfo, error) {
+	return c.LstatContext(context.Background(), p)
+}
+
+// LstatContext is like Lstat, but returns ctx.Err() once ctx is done.
+func (c *Client) LstatContext(ctx context.Context, p string) (os.FileInfo, error) {
+	return c.cachedStat(p, false, func(p string) (*FileStat, error) {
+		return c.lstat(ctx, p)
+	})
+}
+
+func (c *Client) lstat(ctx context.Context, p string) (*FileStat, error) {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpLstatPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpLstatPacket{
 		ID:   id,
 		Path: p,
 	})
@@ -411,8 +618,8 @@ func (c *Client) Lstat(p string) (os.FileInfo, error) {
 		if sid != id {
 			return nil, &unexpectedIDErr{id, sid}
 		}
-		attr, _ := unmarshalAttrs(data)
-		return fileInfoFromStat(attr, path.Base(p)), nil
+		attr, _, err := c.unmarshalAttrs(data)
+		return attr, err
 	case sshFxpStatus:
 		return nil, normaliseError(unmarshalStatus(id, data))
 	default:
@@ -422,8 +629,13 @@ func (c *Client) Lstat(p string) (os.FileInfo, error) {
 
 // ReadLink reads the target of a symbolic link.
 func (c *Client) ReadLink(p string) (string, error) {
+	return c.ReadLinkContext(context.Background(), p)
+}
+
+// ReadLinkContext is like ReadLink, but returns ctx.Err() once ctx is done.
+func (c *Client) ReadLinkContext(ctx context.Context, p string) (string, error) {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpReadlinkPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpReadlinkPacket{
 		ID:   id,
 		Path: p,
 	})
@@ -449,10 +661,21 @@ func (c *Client) ReadLink(p string) (string, error) {
 	}
 }
 
-// Link creates a hard link at 'newname', pointing at the same inode as 'oldname'
+// Link creates a hard link at 'newname', pointing at the same inode as 'oldname'.
+// The server must support the hardlink@openssh.com extension; otherwise, or
+// if it fails the request as unsupported, ErrExtensionNotSupported is returned.
 func (c *Client) Link(oldname, newname string) error {
+	return c.LinkContext(context.Background(), oldname, newname)
+}
+
+// LinkContext is like Link, but returns ctx.Err() once ctx is done.
+func (c *Client) LinkContext(ctx context.Context, oldname, newname string) error {
+	if err := c.RequireExtension(hardlinkExtension); err != nil {
+		return err
+	}
+
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpHardlinkPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpHardlinkPacket{
 		ID:      id,
 		Oldpath: oldname,
 		Newpath: newname,
@@ -462,7 +685,11 @@ func (c *Client) Link(oldname, newname string) error {
 	}
 	switch typ {
 	case sshFxpStatus:
-		return normaliseError(unmarshalStatus(id, data))
+		err := normaliseError(unmarshalStatus(id, data))
+		if status, ok := err.(*StatusError); ok && status.FxCode() == ErrSSHFxOpUnsupported {
+			return errors.Wrap(ErrExtensionNotSupported, hardlinkExtension)
+		}
+		return err
 	default:
 		return unimplementedPacketErr(typ)
 	}
@@ -470,8 +697,13 @@ func (c *Client) Link(oldname, newname string) error {
 
 // Symlink creates a symbolic link at 'newname', pointing at target 'oldname'
 func (c *Client) Symlink(oldname, newname string) error {
+	return c.SymlinkContext(context.Background(), oldname, newname)
+}
+
+// SymlinkContext is like Symlink, but returns ctx.Err() once ctx is done.
+func (c *Client) SymlinkContext(ctx context.Context, oldname, newname string) error {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpSymlinkPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpSymlinkPacket{
 		ID:         id,
 		Linkpath:   newname,
 		Targetpath: oldname,
@@ -507,9 +739,9 @@ func (c *Client) setfstat(handle string, flags uint32, attrs interface{}) error
 }
 
 // setstat is a convience wrapper to allow for changing of various parts of the file descriptor.
-func (c *Client) setstat(path string, flags uint32, attrs interface{}) error {
+func (c *Client) setstat(ctx context.Context, path string, flags uint32, attrs interface{}) error {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpSetstatPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpSetstatPacket{
 		ID:    id,
 		Path:  path,
 		Flags: flags,
@@ -528,22 +760,32 @@ func (c *Client) setstat(path string, flags uint32, attrs interface{}) error {
 
 // Chtimes changes the access and modification times of the named file.
 func (c *Client) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return c.ChtimesContext(context.Background(), path, atime, mtime)
+}
+
+// ChtimesContext is like Chtimes, but returns ctx.Err() once ctx is done.
+func (c *Client) ChtimesContext(ctx context.Context, path string, atime time.Time, mtime time.Time) error {
 	type times struct {
 		Atime uint32
 		Mtime uint32
 	}
 	attrs := times{uint32(atime.Unix()), uint32(mtime.Unix())}
-	return c.setstat(path, sshFileXferAttrACmodTime, attrs)
+	return c.setstat(ctx, path, sshFileXferAttrACmodTime, attrs)
 }
 
 // Chown changes the user and group owners of the named file.
 func (c *Client) Chown(path string, uid, gid int) error {
+	return c.ChownContext(context.Background(), path, uid, gid)
+}
+
+// ChownContext is like Chown, but returns ctx.Err() once ctx is done.
+func (c *Client) ChownContext(ctx context.Context, path string, uid, gid int) error {
 	type owner struct {
 		UID uint32
 		GID uint32
 	}
 	attrs := owner{uint32(uid), uint32(gid)}
-	return c.setstat(path, sshFileXferAttrUIDGID, attrs)
+	return c.setstat(ctx, path, sshFileXferAttrUIDGID, attrs)
 }
 
 // Chmod changes the permissions of the named file.
@@ -552,7 +794,12 @@ func (c *Client) Chown(path string, uid, gid int) error {
 // possible in a portable way without causing a race condition. Callers
 // should mask off umask bits, if desired.
 func (c *Client) Chmod(path string, mode os.FileMode) error {
-	return c.setstat(path, sshFileXferAttrPermissions, toChmodPerm(mode))
+	return c.ChmodContext(context.Background(), path, mode)
+}
+
+// ChmodContext is like Chmod, but returns ctx.Err() once ctx is done.
+func (c *Client) ChmodContext(ctx context.Context, path string, mode os.FileMode) error {
+	return c.setstat(ctx, path, sshFileXferAttrPermissions, toChmodPerm(mode))
 }
 
 // Truncate sets the size of the named file. Although it may be safely assumed
@@ -560,26 +807,41 @@ func (c *Client) Chmod(path string, mode os.FileMode) error {
 // the SFTP protocol does not specify what behavior the server should do when setting
 // size greater than the current size.
 func (c *Client) Truncate(path string, size int64) error {
-	return c.setstat(path, sshFileXferAttrSize, uint64(size))
+	return c.TruncateContext(context.Background(), path, size)
+}
+
+// TruncateContext is like Truncate, but returns ctx.Err() once ctx is done.
+func (c *Client) TruncateContext(ctx context.Context, path string, size int64) error {
+	return c.setstat(ctx, path, sshFileXferAttrSize, uint64(size))
 }
 
 // Open opens the named file for reading. If successful, methods on the
 // returned file can be used for reading; the associated file descriptor
 // has mode O_RDONLY.
 func (c *Client) Open(path string) (*File, error) {
-	return c.open(path, flags(os.O_RDONLY))
+	return c.OpenContext(context.Background(), path)
+}
+
+// OpenContext is like Open, but returns ctx.Err() once ctx is done.
+func (c *Client) OpenContext(ctx context.Context, path string) (*File, error) {
+	return c.open(ctx, path, flags(os.O_RDONLY))
 }
 
 // OpenFile is the generalized open call; most users will use Open or
 // Create instead. It opens the named file with specified flag (O_RDONLY
 // etc.). If successful, methods on the returned File can be used for I/O.
 func (c *Client) OpenFile(path string, f int) (*File, error) {
-	return c.open(path, flags(f))
+	return c.OpenFileContext(context.Background(), path, f)
 }
 
-func (c *Client) open(path string, pflags uint32) (*File, error) {
+// OpenFileContext is like OpenFile, but returns ctx.Err() once ctx is done.
+func (c *Client) OpenFileContext(ctx context.Context, path string, f int) (*File, error) {
+	return c.open(ctx, path, flags(f))
+}
+
+func (c *Client) open(ctx context.Context, path string, pflags uint32) (*File, error) {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpOpenPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpOpenPacket{
 		ID:     id,
 		Path:   path,
 		Pflags: pflags,
@@ -594,7 +856,12 @@ func (c *Client) open(path string, pflags uint32) (*File, error) {
 			return nil, &unexpectedIDErr{id, sid}
 		}
 		handle, _ := unmarshalString(data)
-		return &File{c: c, path: path, handle: handle}, nil
+		f := &File{c: c, path: path, handle: handle}
+		c.track(f)
+		if c.statCache != nil {
+			c.statCache.opened(handle, c.cachePath(path))
+		}
+		return f, nil
 	case sshFxpStatus:
 		return nil, normaliseError(unmarshalStatus(id, data))
 	default:
@@ -616,15 +883,19 @@ func (c *Client) close(handle string) error {
 	}
 	switch typ {
 	case sshFxpStatus:
-		return normaliseError(unmarshalStatus(id, data))
+		err := unmarshalStatus(id, data)
+		if c.asyncWrites {
+			err = deferredWriteErrorFromStatus(err)
+		}
+		return normaliseError(err)
 	default:
 		return unimplementedPacketErr(typ)
 	}
 }
 
-func (c *Client) stat(path string) (*FileStat, error) {
+func (c *Client) stat(ctx context.Context, path string) (*FileStat, error) {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpStatPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpStatPacket{
 		ID:   id,
 		Path: path,
 	})
@@ -637,8 +908,8 @@ func (c *Client) stat(path string) (*FileStat, error) {
 		if sid != id {
 			return nil, &unexpectedIDErr{id, sid}
 		}
-		attr, _ := unmarshalAttrs(data)
-		return attr, nil
+		attr, _, err := c.unmarshalAttrs(data)
+		return attr, err
 	case sshFxpStatus:
 		return nil, normaliseError(unmarshalStatus(id, data))
 	default:
@@ -661,8 +932,8 @@ func (c *Client) fstat(handle string) (*FileStat, error) {
 		if sid != id {
 			return nil, &unexpectedIDErr{id, sid}
 		}
-		attr, _ := unmarshalAttrs(data)
-		return attr, nil
+		attr, _, err := c.unmarshalAttrs(data)
+		return attr, err
 	case sshFxpStatus:
 		return nil, normaliseError(unmarshalStatus(id, data))
 	default:
@@ -675,9 +946,14 @@ func (c *Client) fstat(handle string) (*FileStat, error) {
 // It implements the statvfs@openssh.com SSH_FXP_EXTENDED feature
 // from http://www.opensource.apple.com/source/OpenSSH/OpenSSH-175/openssh/PROTOCOL?txt.
 func (c *Client) StatVFS(path string) (*StatVFS, error) {
+	return c.StatVFSContext(context.Background(), path)
+}
+
+// StatVFSContext is like StatVFS, but returns ctx.Err() once ctx is done.
+func (c *Client) StatVFSContext(ctx context.Context, path string) (*StatVFS, error) {
 	// send the StatVFS packet to the server
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpStatvfsPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpStatvfsPacket{
 		ID:   id,
 		Path: path,
 	})
@@ -714,25 +990,30 @@ func (c *Client) Join(elem ...string) string { return path.Join(elem...) }
 // file or directory with the specified path exists, or if the specified directory
 // is not empty.
 func (c *Client) Remove(path string) error {
-	err := c.removeFile(path)
+	return c.RemoveContext(context.Background(), path)
+}
+
+// RemoveContext is like Remove, but returns ctx.Err() once ctx is done.
+func (c *Client) RemoveContext(ctx context.Context, path string) error {
+	err := c.removeFile(ctx, path)
 	// some servers, *cough* osx *cough*, return EPERM, not ENODIR.
 	// serv-u returns ssh_FX_FILE_IS_A_DIRECTORY
 	// EPERM is converted to os.ErrPermission so it is not a StatusError
 	if err, ok := err.(*StatusError); ok {
 		switch err.Code {
 		case sshFxFailure, sshFxFileIsADirectory:
-			return c.RemoveDirectory(path)
+			return c.RemoveDirectoryContext(ctx, path)
 		}
 	}
 	if os.IsPermission(err) {
-		return c.RemoveDirectory(path)
+		return c.RemoveDirectoryContext(ctx, path)
 	}
 	return err
 }
 
-func (c *Client) removeFile(path string) error {
+func (c *Client) removeFile(ctx context.Context, path string) error {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpRemovePacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpRemovePacket{
 		ID:       id,
 		Filename: path,
 	})
@@ -749,8 +1030,13 @@ func (c *Client) removeFile(path string) error {
 
 // RemoveDirectory removes a directory path.
 func (c *Client) RemoveDirectory(path string) error {
+	return c.RemoveDirectoryContext(context.Background(), path)
+}
+
+// RemoveDirectoryContext is like RemoveDirectory, but returns ctx.Err() once ctx is done.
+func (c *Client) RemoveDirectoryContext(ctx context.Context, path string) error {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpRmdirPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpRmdirPacket{
 		ID:   id,
 		Path: path,
 	})
@@ -767,8 +1053,13 @@ func (c *Client) RemoveDirectory(path string) error {
 
 // Rename renames a file.
 func (c *Client) Rename(oldname, newname string) error {
+	return c.RenameContext(context.Background(), oldname, newname)
+}
+
+// RenameContext is like Rename, but returns ctx.Err() once ctx is done.
+func (c *Client) RenameContext(ctx context.Context, oldname, newname string) error {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpRenamePacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpRenamePacket{
 		ID:      id,
 		Oldpath: oldname,
 		Newpath: newname,
@@ -787,8 +1078,13 @@ func (c *Client) Rename(oldname, newname string) error {
 // PosixRename renames a file using the posix-rename@openssh.com extension
 // which will replace newname if it already exists.
 func (c *Client) PosixRename(oldname, newname string) error {
+	return c.PosixRenameContext(context.Background(), oldname, newname)
+}
+
+// PosixRenameContext is like PosixRename, but returns ctx.Err() once ctx is done.
+func (c *Client) PosixRenameContext(ctx context.Context, oldname, newname string) error {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpPosixRenamePacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpPosixRenamePacket{
 		ID:      id,
 		Oldpath: oldname,
 		Newpath: newname,
@@ -809,8 +1105,13 @@ func (c *Client) PosixRename(oldname, newname string) error {
 // This is useful for converting path names containing ".." components,
 // or relative pathnames without a leading slash into absolute paths.
 func (c *Client) RealPath(path string) (string, error) {
+	return c.RealPathContext(context.Background(), path)
+}
+
+// RealPathContext is like RealPath, but returns ctx.Err() once ctx is done.
+func (c *Client) RealPathContext(ctx context.Context, path string) (string, error) {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpRealpathPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpRealpathPacket{
 		ID:   id,
 		Path: path,
 	})
@@ -839,15 +1140,25 @@ func (c *Client) RealPath(path string) (string, error) {
 // Getwd returns the current working directory of the server. Operations
 // involving relative paths will be based at this location.
 func (c *Client) Getwd() (string, error) {
-	return c.RealPath(".")
+	return c.GetwdContext(context.Background())
+}
+
+// GetwdContext is like Getwd, but returns ctx.Err() once ctx is done.
+func (c *Client) GetwdContext(ctx context.Context) (string, error) {
+	return c.RealPathContext(ctx, ".")
 }
 
 // Mkdir creates the specified directory. An error will be returned if a file or
 // directory with the specified path already exists, or if the directory's
 // parent folder does not exist (the method cannot create complete paths).
 func (c *Client) Mkdir(path string) error {
+	return c.MkdirContext(context.Background(), path)
+}
+
+// MkdirContext is like Mkdir, but returns ctx.Err() once ctx is done.
+func (c *Client) MkdirContext(ctx context.Context, path string) error {
 	id := c.nextID()
-	typ, data, err := c.sendPacket(nil, &sshFxpMkdirPacket{
+	typ, data, err := c.sendPacketContext(ctx, nil, &sshFxpMkdirPacket{
 		ID:   id,
 		Path: path,
 	})
@@ -867,9 +1178,14 @@ func (c *Client) Mkdir(path string) error {
 // If path is already a directory, MkdirAll does nothing and returns nil.
 // If path contains a regular file, an error is returned
 func (c *Client) MkdirAll(path string) error {
+	return c.MkdirAllContext(context.Background(), path)
+}
+
+// MkdirAllContext is like MkdirAll, but returns ctx.Err() once ctx is done.
+func (c *Client) MkdirAllContext(ctx context.Context, path string) error {
 	// Most of this code mimics https://golang.org/src/os/path.go?s=514:561#L13
 	// Fast path: if we can tell whether path is a directory or file, stop with success or error.
-	dir, err := c.Stat(path)
+	dir, err := c.StatContext(ctx, path)
 	if err == nil {
 		if dir.IsDir() {
 			return nil
@@ -890,18 +1206,18 @@ func (c *Client) MkdirAll(path string) error {
 
 	if j > 1 {
 		// Create parent
-		err = c.MkdirAll(path[0 : j-1])
+		err = c.MkdirAllContext(ctx, path[0:j-1])
 		if err != nil {
 			return err
 		}
 	}
 
 	// Parent now exists; invoke Mkdir and use its result.
-	err = c.Mkdir(path)
+	err = c.MkdirContext(ctx, path)
 	if err != nil {
 		// Handle arguments like "foo/." by
 		// double-checking that directory doesn't exist.
-		dir, err1 := c.Lstat(path)
+		dir, err1 := c.LstatContext(ctx, path)
 		if err1 == nil && dir.IsDir() {
 			return nil
 		}
@@ -911,19 +1227,90 @@ func (c *Client) MkdirAll(path string) error {
 }
 
 // File represents a remote file.
+//
+// A File is safe for concurrent use. ReadAt and WriteAt do not use the
+// offset of the File, so goroutines may share a File to transfer their own
+// parts of it in parallel, instead of opening it each. Read, Write, Seek,
+// ReadFrom and WriteTo use and advance the offset, and so are serialized.
+//
+// Once the File is closed, its methods return an error wrapping os.ErrClosed,
+// without sending requests on the handle. The requests in progress when Close
+// is called are not waited for, and may fail.
 type File struct {
 	c      *Client
 	path   string
 	handle string
 
-	mu     sync.Mutex
-	offset int64 // current offset within remote file
+	closed int32 // set atomically by Close
+
+	ackedEnd int64 // end of the acknowledged writes, set atomically
+
+	// if not 0, the limit set by SetMaxConcurrentRequests, set atomically
+	maxConcurrent int32
+
+	mu          sync.Mutex
+	offset      int64 // current offset within remote file
+	progress    func(transferred, total int64)
+	readAhead   *readAhead   // set by EnableReadAhead
+	writeBuffer *writeBuffer // set by EnableWriteBuffer
+	sparse      bool         // set by SetSparse
+}
+
+// SetMaxConcurrentRequests sets the max number of requests the transfers of
+// the File keep in flight, those of ReadAt, WriteAt, WriteTo and ReadFrom,
+// in place of the limit of the Client set by MaxConcurrentRequestsPerFile:
+// more of them for links with a large bandwidth-delay product, fewer for
+// servers which cannot take many. A limit less than 1 restores the limit of
+// the Client.
+func (f *File) SetMaxConcurrentRequests(n int) {
+	if n < 1 || n > math.MaxInt32 {
+		n = 0
+	}
+	atomic.StoreInt32(&f.maxConcurrent, int32(n))
+}
+
+// maxConcurrentRequests returns the max number of requests the transfers of
+// the File keep in flight.
+func (f *File) maxConcurrentRequests() int {
+	if n := atomic.LoadInt32(&f.maxConcurrent); n > 0 {
+		return int(n)
+	}
+	return f.c.maxConcurrentRequests
 }
 
 // Close closes the File, rendering it unusable for I/O. It returns an
 // error, if any.
 func (f *File) Close() error {
-	return f.c.close(f.handle)
+	f.mu.Lock()
+	flushErr := f.flushWriteBuffer()
+	f.mu.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		return f.closedErr("close")
+	}
+	f.c.untrack(f)
+	if err := f.c.close(f.handle); err != nil {
+		return err
+	}
+	if flushErr != nil {
+		return flushErr
+	}
+	if f.c.verifyWrites {
+		return f.verifyWrites()
+	}
+	return nil
+}
+
+// checkOpen returns an error for op if the File is closed.
+func (f *File) checkOpen(op string) error {
+	if atomic.LoadInt32(&f.closed) != 0 {
+		return f.closedErr(op)
+	}
+	return nil
+}
+
+func (f *File) closedErr(op string) error {
+	return &os.PathError{Op: op, Path: f.path, Err: os.ErrClosed}
 }
 
 // Name returns the name of the file as presented to Open or Create.
@@ -944,6 +1331,12 @@ func (f *File) Read(b []byte) (int, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if err := f.flushWriteBuffer(); err != nil {
+		return 0, err
+	}
+	if f.readAhead != nil {
+		return f.readAheadRead(b)
+	}
 	n, err := f.ReadAt(b, f.offset)
 	f.offset += int64(n)
 	return n, err
@@ -969,13 +1362,14 @@ func (f *File) readChunkAt(ch chan result, b []byte, off int64) (n int, err erro
 			return n, normaliseError(unmarshalStatus(id, data))
 
 		case sshFxpData:
-			sid, data := unmarshalUint32(data)
+			sid, payload := unmarshalUint32(data)
 			if id != sid {
 				return n, &unexpectedIDErr{id, sid}
 			}
 
-			l, data := unmarshalUint32(data)
-			n += copy(b[n:], data[:l])
+			l, payload := unmarshalUint32(payload)
+			n += copy(b[n:], payload[:l])
+			f.c.buffers.Put(data)
 
 		default:
 			return n, unimplementedPacketErr(typ)
@@ -1012,6 +1406,12 @@ func (f *File) readAtSequential(b []byte, off int64) (read int, err error) {
 // the number of bytes read and an error, if any. ReadAt follows io.ReaderAt semantics,
 // so the file offset is not altered during the read.
 func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	defer f.labelTransfer("ReadAt")()
+
+	if err := f.checkOpen("read"); err != nil {
+		return 0, err
+	}
+
 	if len(b) <= f.c.maxPacket {
 		// This should be able to be serviced with 1/2 requests.
 		// So, just do it directly.
@@ -1066,8 +1466,8 @@ func (f *File) ReadAt(b []byte, off int64) (int, error) {
 	errCh := make(chan rErr)
 
 	concurrency := len(b)/f.c.maxPacket + 1
-	if concurrency > f.c.maxConcurrentRequests || concurrency < 1 {
-		concurrency = f.c.maxConcurrentRequests
+	if concurrency > f.maxConcurrentRequests() || concurrency < 1 {
+		concurrency = f.maxConcurrentRequests()
 	}
 
 	var wg sync.WaitGroup
@@ -1121,7 +1521,7 @@ func (f *File) ReadAt(b []byte, off int64) (int, error) {
 }
 
 // writeToSequential implements WriteTo, but works sequentially with no parallelism.
-func (f *File) writeToSequential(w io.Writer) (written int64, err error) {
+func (f *File) writeToSequential(w io.Writer, p *progress) (written int64, err error) {
 	b := make([]byte, f.c.maxPacket)
 	ch := make(chan result, 1) // reusable channel
 
@@ -1136,6 +1536,7 @@ func (f *File) writeToSequential(w io.Writer) (written int64, err error) {
 
 			m, err2 := w.Write(b[:n])
 			written += int64(m)
+			p.add(m)
 
 			if err == nil {
 				err = err2
@@ -1158,13 +1559,33 @@ func (f *File) writeToSequential(w io.Writer) (written int64, err error) {
 //
 // This method is preferred over calling Read multiple times
 // to maximise throughput for transferring the entire file,
-// especially over high latency links.
+// especially over high latency links. The reads in flight are adapted to
+// the round trips and throughput measured, up to the limit set by
+// MaxConcurrentRequestsPerFile.
 func (f *File) WriteTo(w io.Writer) (written int64, err error) {
+	defer f.labelTransfer("WriteTo")()
+
+	if err := f.checkOpen("read"); err != nil {
+		return 0, err
+	}
+
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	if f.c.disableConcurrentReads {
-		return f.writeToSequential(w)
+	if err := f.flushWriteBuffer(); err != nil {
+		return 0, err
+	}
+	if ws, ok := w.(io.WriteSeeker); ok && f.sparse {
+		sw := &sparseWriter{w: ws, off: f.offset}
+		defer func() {
+			if err == nil {
+				err = sw.finish()
+			}
+		}()
+		w = sw
+	}
+	if f.c.disableConcurrentReads && f.progress == nil {
+		return f.writeToSequential(w, nil)
 	}
 
 	// For concurrency, we want to guess how many concurrent workers we should use.
@@ -1172,21 +1593,30 @@ func (f *File) WriteTo(w io.Writer) (written int64, err error) {
 	if f.c.useFstat {
 		fileStat, err = f.c.fstat(f.handle)
 	} else {
-		fileStat, err = f.c.stat(f.path)
+		fileStat, err = f.c.stat(context.Background(), f.path)
 	}
 	if err != nil {
 		return 0, err
 	}
 
 	fileSize := fileStat.Size
-	if fileSize <= uint64(f.c.maxPacket) || !isRegular(fileStat.Mode) {
+	total := int64(-1)
+	if isRegular(fileStat.Mode) && fileStat.Size <= math.MaxInt64 {
+		total = int64(fileStat.Size) - f.offset
+		if total < 0 {
+			total = 0
+		}
+	}
+	p := f.newProgress(total)
+
+	if f.c.disableConcurrentReads || fileSize <= uint64(f.c.maxPacket) || !isRegular(fileStat.Mode) {
 		// only regular files are guaranteed to return (full read) xor (partial read, next error)
-		return f.writeToSequential(w)
+		return f.writeToSequential(w, p)
 	}
 
 	concurrency64 := fileSize/uint64(f.c.maxPacket) + 1 // a bad guess, but better than no guess
-	if concurrency64 > uint64(f.c.maxConcurrentRequests) || concurrency64 < 1 {
-		concurrency64 = uint64(f.c.maxConcurrentRequests)
+	if concurrency64 > uint64(f.maxConcurrentRequests()) || concurrency64 < 1 {
+		concurrency64 = uint64(f.maxConcurrentRequests())
 	}
 	// Now that concurrency64 is saturated to an int value, we know this assignment cannot possibly overflow.
 	concurrency := int(concurrency64)
@@ -1194,12 +1624,15 @@ func (f *File) WriteTo(w io.Writer) (written int64, err error) {
 	chunkSize := f.c.maxPacket
 	pool := newBufPool(concurrency, chunkSize)
 	resPool := newResChanPool(concurrency)
+	// the reads in flight, up to concurrency
+	win := newTransferWindow(concurrency, chunkSize)
 
 	cancel := make(chan struct{})
 	var wg sync.WaitGroup
 	defer func() {
 		// Once the writing Reduce phase has ended, all the feed work needs to unconditionally stop.
 		close(cancel)
+		win.close()
 
 		// We want to wait until all outstanding goroutines with an `f` or `f.c` reference have completed.
 		// Just to be sure we don’t orphan any goroutines any hanging references.
@@ -1216,9 +1649,10 @@ func (f *File) WriteTo(w io.Writer) (written int64, err error) {
 	writeCh := make(chan writeWork)
 
 	type readWork struct {
-		id  uint32
-		res chan result
-		off int64
+		id   uint32
+		res  chan result
+		off  int64
+		sent time.Time
 
 		cur, next chan writeWork
 	}
@@ -1232,14 +1666,19 @@ func (f *File) WriteTo(w io.Writer) (written int64, err error) {
 
 		cur := writeCh
 		for {
+			sent, ok := win.acquire()
+			if !ok {
+				return
+			}
 			id := f.c.nextID()
 			res := resPool.Get()
 
 			next := make(chan writeWork)
 			readWork := readWork{
-				id:  id,
-				res: res,
-				off: off,
+				id:   id,
+				res:  res,
+				off:  off,
+				sent: sent,
 
 				cur:  cur,
 				next: next,
@@ -1292,12 +1731,14 @@ func (f *File) WriteTo(w io.Writer) (written int64, err error) {
 							b = pool.Get()[:l]
 							n = copy(b, data[:l])
 							b = b[:n]
+							f.c.buffers.Put(s.data)
 						}
 
 					default:
 						err = unimplementedPacketErr(s.typ)
 					}
 				}
+				win.done(readWork.sent, n)
 
 				writeWork := writeWork{
 					b:   b,
@@ -1334,6 +1775,7 @@ func (f *File) WriteTo(w io.Writer) (written int64, err error) {
 		if len(packet.b) > 0 {
 			n, err := w.Write(packet.b)
 			written += int64(n)
+			p.add(n)
 			if err != nil {
 				return written, err
 			}
@@ -1355,6 +1797,10 @@ func (f *File) WriteTo(w io.Writer) (written int64, err error) {
 // Stat returns the FileInfo structure describing file. If there is an
 // error.
 func (f *File) Stat() (os.FileInfo, error) {
+	if err := f.checkOpen("stat"); err != nil {
+		return nil, err
+	}
+
 	fs, err := f.c.fstat(f.handle)
 	if err != nil {
 		return nil, err
@@ -1374,6 +1820,10 @@ func (f *File) Write(b []byte) (int, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	f.dropReadAhead()
+	if f.writeBuffer != nil {
+		return f.bufferedWrite(b)
+	}
 	n, err := f.WriteAt(b, f.offset)
 	f.offset += int64(n)
 	return n, err
@@ -1403,6 +1853,7 @@ func (f *File) writeChunkAt(ch chan result, b []byte, off int64) (int, error) {
 		return 0, unimplementedPacketErr(typ)
 	}
 
+	f.acknowledged(off + int64(len(b)))
 	return len(b), nil
 }
 
@@ -1451,8 +1902,8 @@ func (f *File) writeAtConcurrent(b []byte, off int64) (int, error) {
 	errCh := make(chan wErr)
 
 	concurrency := len(b)/f.c.maxPacket + 1
-	if concurrency > f.c.maxConcurrentRequests || concurrency < 1 {
-		concurrency = f.c.maxConcurrentRequests
+	if concurrency > f.maxConcurrentRequests() || concurrency < 1 {
+		concurrency = f.maxConcurrentRequests()
 	}
 
 	var wg sync.WaitGroup
@@ -1507,6 +1958,12 @@ func (f *File) writeAtConcurrent(b []byte, off int64) (int, error) {
 // the number of bytes written and an error, if any. WriteAt follows io.WriterAt semantics,
 // so the file offset is not altered during the write.
 func (f *File) WriteAt(b []byte, off int64) (written int, err error) {
+	defer f.labelTransfer("WriteAt")()
+
+	if err := f.checkOpen("write"); err != nil {
+		return 0, err
+	}
+
 	if len(b) <= f.c.maxPacket {
 		// We can do this in one write.
 		return f.writeChunkAt(nil, b, off)
@@ -1542,10 +1999,29 @@ func (f *File) WriteAt(b []byte, off int64) (written int, err error) {
 // ReadFromWithConcurrency implements ReaderFrom,
 // but uses the given concurrency to issue multiple requests at the same time.
 //
-// Giving a concurrency of less than one will default to the Client’s max concurrency.
+// Giving a concurrency of less than one will default to the File’s max concurrency,
+// see SetMaxConcurrentRequests.
 //
-// Otherwise, the given concurrency will be capped by the Client's max concurrency.
+// Otherwise, the given concurrency will be capped by the File's max concurrency.
 func (f *File) ReadFromWithConcurrency(r io.Reader, concurrency int) (read int64, err error) {
+	defer f.labelTransfer("ReadFromWithConcurrency")()
+
+	if err := f.checkOpen("write"); err != nil {
+		return 0, err
+	}
+
+	var p *progress
+	if f.progress != nil {
+		p = f.newProgress(readerRemaining(r))
+	}
+	return f.readFromWithConcurrency(r, concurrency, false, p)
+}
+
+// readFromWithConcurrency implements ReadFromWithConcurrency, reporting the
+// writes acknowledged to p. With adaptive set, the writes in flight are
+// those of a transferWindow, up to concurrency, rather than concurrency.
+func (f *File) readFromWithConcurrency(r io.Reader, concurrency int, adaptive bool, p *progress) (read int64, err error) {
+
 	// Split the write into multiple maxPacket sized concurrent writes.
 	// This allows writes with a suitably large reader
 	// to transfer data at a much faster rate due to overlapping round trip times.
@@ -1565,11 +2041,15 @@ func (f *File) ReadFromWithConcurrency(r io.Reader, concurrency int) (read int64
 	}
 	errCh := make(chan rwErr)
 
-	if concurrency > f.c.maxConcurrentRequests || concurrency < 1 {
-		concurrency = f.c.maxConcurrentRequests
+	if concurrency > f.maxConcurrentRequests() || concurrency < 1 {
+		concurrency = f.maxConcurrentRequests()
 	}
 
 	pool := newBufPool(concurrency, f.c.maxPacket)
+	var win *transferWindow
+	if adaptive {
+		win = newTransferWindow(concurrency, f.c.maxPacket)
+	}
 
 	// Slice: cut up the Read into any number of buffers of length <= f.c.maxPacket, and at appropriate offsets.
 	go func() {
@@ -1613,7 +2093,10 @@ func (f *File) ReadFromWithConcurrency(r io.Reader, concurrency int) (read int64
 			ch := make(chan result, 1) // reusable channel per mapper.
 
 			for packet := range workCh {
+				sent, _ := win.acquire() // never closed
 				n, err := f.writeChunkAt(ch, packet.b[:packet.n], packet.off)
+				win.done(sent, n)
+				p.add(n)
 				if err != nil {
 					// return the offset as the start + how much we wrote before the error.
 					errCh <- rwErr{packet.off + int64(n), err}
@@ -1671,33 +2154,37 @@ func (f *File) ReadFromWithConcurrency(r io.Reader, concurrency int) (read int64
 //
 // This method is preferred over calling Write multiple times
 // to maximise throughput for transferring the entire file,
-// especially over high-latency links.
+// especially over high-latency links. With UseConcurrentWrites, the writes
+// in flight are adapted to the round trips and throughput measured, up to
+// the limit set by MaxConcurrentRequestsPerFile.
 func (f *File) ReadFrom(r io.Reader) (int64, error) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	defer f.labelTransfer("ReadFrom")()
 
-	if f.c.useConcurrentWrites {
-		var remain int64
-		switch r := r.(type) {
-		case interface{ Len() int }:
-			remain = int64(r.Len())
+	if err := f.checkOpen("write"); err != nil {
+		return 0, err
+	}
 
-		case interface{ Size() int64 }:
-			remain = r.Size()
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-		case *io.LimitedReader:
-			remain = r.N
+	f.dropReadAhead()
+	if err := f.flushWriteBuffer(); err != nil {
+		return 0, err
+	}
+	var p *progress
+	if f.progress != nil {
+		p = f.newProgress(readerRemaining(r))
+	}
 
-		case interface{ Stat() (os.FileInfo, error) }:
-			info, err := r.Stat()
-			if err == nil {
-				remain = info.Size()
-			}
-		}
+	if f.sparse {
+		return f.readFromSparse(r, p)
+	}
+	if f.c.useConcurrentWrites {
+		remain, _ := readerSize(r)
 
 		if remain < 0 {
 			// We can strongly assert that we want default max concurrency here.
-			return f.ReadFromWithConcurrency(r, f.c.maxConcurrentRequests)
+			return f.readFromWithConcurrency(r, f.maxConcurrentRequests(), true, p)
 		}
 
 		if remain > int64(f.c.maxPacket) {
@@ -1707,12 +2194,12 @@ func (f *File) ReadFrom(r io.Reader) (int64, error) {
 			concurrency64 := remain/int64(f.c.maxPacket) + 1
 
 			// We need to cap this value to an `int` size value to avoid overflow on 32-bit machines.
-			// So, we may as well pre-cap it to `f.c.maxConcurrentRequests`.
-			if concurrency64 > int64(f.c.maxConcurrentRequests) {
-				concurrency64 = int64(f.c.maxConcurrentRequests)
+			// So, we may as well pre-cap it to `f.maxConcurrentRequests()`.
+			if concurrency64 > int64(f.maxConcurrentRequests()) {
+				concurrency64 = int64(f.maxConcurrentRequests())
 			}
 
-			return f.ReadFromWithConcurrency(r, int(concurrency64))
+			return f.readFromWithConcurrency(r, int(concurrency64), true, p)
 		}
 	}
 
@@ -1732,6 +2219,7 @@ func (f *File) ReadFrom(r io.Reader) (int64, error) {
 
 			m, err2 := f.writeChunkAt(ch, b[:n], f.offset)
 			f.offset += int64(m)
+			p.add(m)
 
 			if err == nil {
 				err = err2
@@ -1755,6 +2243,9 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if err := f.flushWriteBuffer(); err != nil {
+		return f.offset, err
+	}
 	switch whence {
 	case io.SeekStart:
 	case io.SeekCurrent:
@@ -1778,14 +2269,46 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 }
 
 // Chown changes the uid/gid of the current file.
+//
+// It sends a SSH_FXP_FSETSTAT on the handle of the File, so it applies to
+// the file opened even if it was renamed since.
 func (f *File) Chown(uid, gid int) error {
-	return f.c.Chown(f.path, uid, gid)
+	if err := f.checkOpen("chown"); err != nil {
+		return err
+	}
+
+	type owner struct {
+		UID uint32
+		GID uint32
+	}
+	attrs := owner{uint32(uid), uint32(gid)}
+	return f.c.setfstat(f.handle, sshFileXferAttrUIDGID, attrs)
+}
+
+// Chtimes changes the access and modification times of the current file.
+//
+// Like Chown, it sends a SSH_FXP_FSETSTAT on the handle of the File.
+func (f *File) Chtimes(atime time.Time, mtime time.Time) error {
+	if err := f.checkOpen("chtimes"); err != nil {
+		return err
+	}
+
+	type times struct {
+		Atime uint32
+		Mtime uint32
+	}
+	attrs := times{uint32(atime.Unix()), uint32(mtime.Unix())}
+	return f.c.setfstat(f.handle, sshFileXferAttrACmodTime, attrs)
 }
 
 // Chmod changes the permissions of the current file.
 //
 // See Client.Chmod for details.
 func (f *File) Chmod(mode os.FileMode) error {
+	if err := f.checkOpen("chmod"); err != nil {
+		return err
+	}
+
 	return f.c.setfstat(f.handle, sshFileXferAttrPermissions, toChmodPerm(mode))
 }
 
@@ -1793,6 +2316,13 @@ func (f *File) Chmod(mode os.FileMode) error {
 //
 // Sync requires the server to support the fsync@openssh.com extension.
 func (f *File) Sync() error {
+	if err := f.checkOpen("sync"); err != nil {
+		return err
+	}
+	if err := f.Flush(); err != nil {
+		return err
+	}
+
 	id := f.c.nextID()
 	typ, data, err := f.c.sendPacket(nil, &sshFxpFsyncPacket{
 		ID:     id,
@@ -1815,7 +2345,18 @@ func (f *File) Sync() error {
 // size greater than the current size.
 // We send a SSH_FXP_FSETSTAT here since we have a file handle
 func (f *File) Truncate(size int64) error {
-	return f.c.setfstat(f.handle, sshFileXferAttrSize, uint64(size))
+	if err := f.checkOpen("truncate"); err != nil {
+		return err
+	}
+	if err := f.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.c.setfstat(f.handle, sshFileXferAttrSize, uint64(size)); err != nil {
+		return err
+	}
+	f.truncated(size)
+	return nil
 }
 
 func min(a, b int) int {
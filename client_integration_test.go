@@ -1059,6 +1059,53 @@ func TestClientChtimes(t *testing.T) {
 	}
 }
 
+func TestClientFileChtimes(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	f, err := ioutil.TempFile("", "sftptest-filechtimes")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.Close()
+
+	sf, err := sftp.OpenFile(f.Name(), os.O_WRONLY)
+	require.NoError(t, err)
+	defer sf.Close()
+
+	atime := time.Date(2013, 2, 23, 13, 24, 35, 0, time.UTC)
+	mtime := time.Date(1985, 6, 12, 6, 6, 6, 0, time.UTC)
+	require.NoError(t, sf.Chtimes(atime, mtime))
+	stat, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	assert.True(t, stat.ModTime().Equal(mtime), stat.ModTime())
+}
+
+func TestClientFileChownRenamed(t *testing.T) {
+	skipIfWindows(t) // No UNIX owners.
+	sftp, cmd := testClient(t, READWRITE, NODELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	f, err := ioutil.TempFile("", "sftptest-filechown")
+	require.NoError(t, err)
+	f.Close()
+	renamed := f.Name() + ".renamed"
+	defer os.Remove(renamed)
+
+	sf, err := sftp.OpenFile(f.Name(), os.O_WRONLY)
+	require.NoError(t, err)
+	defer sf.Close()
+
+	// applied to the handle, not to the path
+	require.NoError(t, os.Rename(f.Name(), renamed))
+	require.NoError(t, sf.Chown(os.Getuid(), os.Getgid()))
+	require.NoError(t, sf.Chmod(0600))
+	stat, err := os.Stat(renamed)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+}
+
 func TestClientChtimesReadonly(t *testing.T) {
 	sftp, cmd := testClient(t, READONLY, NODELAY)
 	defer cmd.Wait()
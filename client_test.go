@@ -2,13 +2,20 @@ package sftp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kr/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // assert that *Client implements fs.FileSystem
@@ -257,3 +264,193 @@ func TestClientNoSid(t *testing.T) {
 		t.Fatal("expected ErrSSHFxConnectionLost, got", err)
 	}
 }
+
+func TestFileConcurrentReadWriteAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-concurrent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	f, err := client.OpenFile(filepath.Join(dir, "file"), os.O_RDWR|os.O_CREATE)
+	require.NoError(t, err)
+
+	// parts larger than a packet, written and read through the same handle
+	const parts, size = 8, 100000
+	data := make([]byte, parts*size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < parts; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			_, err := f.WriteAt(data[off:off+size], off)
+			assert.NoError(t, err)
+		}(int64(i * size))
+	}
+	wg.Wait()
+
+	// along with a reader of the offset, not moved by the others
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := f.Seek(size, io.SeekStart)
+		assert.NoError(t, err)
+		b := make([]byte, 10)
+		_, err = io.ReadFull(f, b)
+		assert.NoError(t, err)
+		assert.Equal(t, data[size:size+10], b)
+	}()
+	for i := 0; i < parts; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			b := make([]byte, size)
+			_, err := f.ReadAt(b, off)
+			assert.NoError(t, err)
+			assert.Equal(t, data[off:off+size], b)
+		}(int64(i * size))
+	}
+	wg.Wait()
+
+	n, err := f.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	assert.Equal(t, int64(size+10), n)
+
+	require.NoError(t, f.Close())
+	_, err = f.ReadAt(make([]byte, 10), 0)
+	assert.True(t, errors.Is(err, os.ErrClosed), err)
+	_, err = f.Write([]byte("x"))
+	assert.True(t, errors.Is(err, os.ErrClosed), err)
+	assert.True(t, errors.Is(f.Close(), os.ErrClosed))
+}
+
+// inflightReads records the max number of reads of the files it opens
+// served at the same time.
+type inflightReads struct {
+	FileReader
+
+	mu            sync.Mutex
+	inflight, max int
+}
+
+func (r *inflightReads) Fileread(req *Request) (io.ReaderAt, error) {
+	rd, err := r.FileReader.Fileread(req)
+	if err != nil {
+		return nil, err
+	}
+	return inflightReaderAt{rd, r}, nil
+}
+
+func (r *inflightReads) reset() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	max := r.max
+	r.max = 0
+	return max
+}
+
+type inflightReaderAt struct {
+	io.ReaderAt
+	r *inflightReads
+}
+
+func (rd inflightReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	rd.r.mu.Lock()
+	rd.r.inflight++
+	if rd.r.inflight > rd.r.max {
+		rd.r.max = rd.r.inflight
+	}
+	rd.r.mu.Unlock()
+
+	// for the other reads sent to be served meanwhile
+	time.Sleep(5 * time.Millisecond)
+
+	rd.r.mu.Lock()
+	rd.r.inflight--
+	rd.r.mu.Unlock()
+	return rd.ReaderAt.ReadAt(b, off)
+}
+
+func TestFileSetMaxConcurrentRequests(t *testing.T) {
+	handlers := InMemHandler()
+	reads := &inflightReads{FileReader: handlers.FileGet}
+	handlers.FileGet = reads
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	data := make([]byte, 16*client.maxPacket)
+	_, err := putTestFile(client, "/file", string(data))
+	require.NoError(t, err)
+	f, err := client.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+
+	b := make([]byte, len(data))
+	_, err = f.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Greater(t, reads.reset(), 2)
+
+	f.SetMaxConcurrentRequests(2)
+	_, err = f.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reads.reset())
+	_, err = f.WriteTo(ioutil.Discard)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, reads.reset(), 2)
+
+	f.SetMaxConcurrentRequests(0)
+	assert.Equal(t, client.maxConcurrentRequests, f.maxConcurrentRequests())
+}
+
+func TestClientOpenContext(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	recv := func(want byte) []byte {
+		typ, data, err := recvPacket(sr, nil, 0)
+		require.NoError(t, err)
+		require.Equal(t, fxp(want), fxp(typ))
+		return data
+	}
+	send := func(typ byte, data []byte) {
+		require.NoError(t, sendPacket(sw, rawPacket{typ, data}))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	answer := make(chan struct{})
+	closed := make(chan string, 1)
+	go func() {
+		recv(sshFxpInit)
+		send(sshFxpVersion, marshalUint32(nil, sftpProtocolVersion))
+
+		open := recv(sshFxpOpen)
+		cancel()
+		<-answer
+		send(sshFxpHandle, marshalString(append([]byte(nil), open[:4]...), "handle"))
+
+		// the handle opened too late is closed by the Client
+		close := recv(sshFxpClose)
+		handle, _ := unmarshalString(close[4:])
+		send(sshFxpStatus, marshalUint32(append([]byte(nil), close[:4]...), sshFxOk))
+		closed <- handle
+	}()
+
+	client, err := NewClientPipe(cr, cw)
+	require.NoError(t, err)
+	defer client.Close()
+	defer sw.Close()
+
+	_, err = client.OpenContext(ctx, "/file")
+	assert.Equal(t, context.Canceled, err)
+	close(answer)
+	assert.Equal(t, "handle", <-closed)
+
+	// a done ctx fails before the request is sent
+	_, err = client.StatContext(ctx, "/file")
+	assert.Equal(t, context.Canceled, err)
+}
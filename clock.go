@@ -0,0 +1,39 @@
+package sftp
+
+import (
+	"time"
+)
+
+// clock is the source of time of the package: for modtimes, and for the
+// timers of timeouts, keepalives and idle reaping. Tests swap it for a fake
+// clock they advance by hand, rather than sleeping.
+type clock interface {
+	Now() time.Time
+
+	// AfterFunc calls f in its own goroutine once d has passed.
+	AfterFunc(d time.Duration, f func()) timer
+
+	// NewTimer returns a timer sending the time on the channel once d has passed.
+	NewTimer(d time.Duration) (timer, <-chan time.Time)
+}
+
+// timer is the part of *time.Timer used by the package.
+type timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+
+func (realClock) NewTimer(d time.Duration) (timer, <-chan time.Time) {
+	t := time.NewTimer(d)
+	return t, t.C
+}
+
+// pkgClock is the clock used across the package.
+var pkgClock clock = realClock{}
@@ -0,0 +1,156 @@
+package sftp
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock whose time only passes when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// useFakeClock swaps the clock of the package for a fake one, until the end of the test.
+func useFakeClock(t *testing.T, now time.Time) *fakeClock {
+	c := &fakeClock{now: now}
+	prev := pkgClock
+	pkgClock = c
+	t.Cleanup(func() { pkgClock = prev })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	return c.newTimer(d, f, nil)
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) (timer, <-chan time.Time) {
+	ch := make(chan time.Time, 1)
+	return c.newTimer(d, nil, ch), ch
+}
+
+func (c *fakeClock) newTimer(d time.Duration, f func(), ch chan time.Time) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, when: c.now.Add(d), active: true, f: f, ch: ch}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers due in the order of
+// their deadlines. The functions of AfterFunc are called before it returns.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.now) {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+	c.mu.Unlock()
+
+	for _, t := range due {
+		if t.f != nil {
+			t.f()
+			continue
+		}
+		select {
+		case t.ch <- t.when:
+		default:
+		}
+	}
+}
+
+type fakeTimer struct {
+	c      *fakeClock
+	when   time.Time
+	active bool
+	f      func()
+	ch     chan time.Time
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := t.active
+	t.when = t.c.now.Add(d)
+	t.active = true
+	return wasActive
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	c := useFakeClock(t, start)
+
+	var fired []string
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, "two") })
+	c.AfterFunc(time.Second, func() { fired = append(fired, "one") })
+	stopped := c.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	tm, ch := c.NewTimer(3 * time.Second)
+
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	c.Advance(500 * time.Millisecond)
+	assert.Empty(t, fired)
+
+	c.Advance(2 * time.Second)
+	assert.Equal(t, []string{"one", "two"}, fired)
+	assert.Equal(t, start.Add(2500*time.Millisecond), pkgClock.Now())
+
+	// pushed back before it fires
+	assert.True(t, tm.Reset(time.Second))
+	c.Advance(500 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Fatal("timer fired early")
+	default:
+	}
+	c.Advance(500 * time.Millisecond)
+	assert.Equal(t, start.Add(3500*time.Millisecond), <-ch)
+}
+
+func TestRunLsClock(t *testing.T) {
+	now := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.Local)
+	useFakeClock(t, now)
+
+	// the time of the recent files, the year of the others
+	recent := &memFile{name: "recent", modtime: now.Add(-time.Hour)}
+	old := &memFile{name: "old", modtime: now.AddDate(-1, 0, 0)}
+	assert.Contains(t, runLs(nil, "/", recent), "Jun  1 11:00 recent")
+	assert.Contains(t, runLs(nil, "/", old), "Jun  1  2020 old")
+}
+
+func TestInMemHandlerClock(t *testing.T) {
+	now := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+
+	fs := InMemHandler().FileCmd.(*root)
+	require.NoError(t, fs.mkdir("/dir"))
+	fi, err := fs.fetch("/dir")
+	require.NoError(t, err)
+	assert.True(t, fi.ModTime().Equal(now))
+}
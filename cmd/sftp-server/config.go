@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// config is the configuration file of the server.
+type config struct {
+	// Listen is the address to listen on, ":2022" by default.
+	Listen string `json:"listen"`
+	// HostKeys are the files of the private host keys.
+	HostKeys []string `json:"host_keys"`
+	// MaxFilelist is the number of entries returned by each readdir request.
+	MaxFilelist int `json:"max_filelist"`
+	// AsyncWrites acknowledges writes before they complete, for clients supporting it.
+	AsyncWrites bool `json:"async_writes"`
+
+	Users []*userConfig `json:"users"`
+}
+
+// userConfig is the configuration of a user allowed to log in.
+type userConfig struct {
+	Name string `json:"name"`
+	// PasswordHash is the bcrypt hash of the password, if password authentication is allowed.
+	PasswordHash string `json:"password_hash"`
+	// AuthorizedKeys is an authorized_keys file, if public key authentication is allowed.
+	AuthorizedKeys string `json:"authorized_keys"`
+
+	// Root is the local directory the user is confined to.
+	Root string `json:"root"`
+	// ReadOnly forbids any change to the files under Root.
+	ReadOnly bool `json:"read_only"`
+	// Quota is the maximum number of bytes the files under Root may take, unlimited if 0.
+	Quota int64 `json:"quota"`
+
+	keys  map[string]bool // marshaled authorized keys
+	usage *quota
+}
+
+func loadConfig(file string) (*config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{
+		Listen: ":2022",
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	if len(cfg.HostKeys) == 0 {
+		return nil, fmt.Errorf("%s: no host keys", file)
+	}
+	names := make(map[string]bool)
+	for _, u := range cfg.Users {
+		switch {
+		case u.Name == "":
+			return nil, fmt.Errorf("%s: user without a name", file)
+		case names[u.Name]:
+			return nil, fmt.Errorf("%s: user %q defined twice", file, u.Name)
+		case u.Root == "":
+			return nil, fmt.Errorf("%s: user %q has no root", file, u.Name)
+		case u.PasswordHash == "" && u.AuthorizedKeys == "":
+			return nil, fmt.Errorf("%s: user %q has no password hash nor authorized keys", file, u.Name)
+		case u.Quota < 0:
+			return nil, fmt.Errorf("%s: user %q has a negative quota", file, u.Name)
+		}
+		names[u.Name] = true
+
+		if u.Root, err = filepath.Abs(u.Root); err != nil {
+			return nil, err
+		}
+		if u.AuthorizedKeys != "" {
+			if u.keys, err = loadAuthorizedKeys(u.AuthorizedKeys); err != nil {
+				return nil, err
+			}
+		}
+		if u.Quota > 0 {
+			u.usage = &quota{limit: u.Quota}
+		}
+	}
+
+	return cfg, nil
+}
+
+func loadAuthorizedKeys(file string) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for len(b) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			// ParseAuthorizedKey fails once no key is left,
+			// only a file without any key is an error.
+			if len(keys) == 0 {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			break
+		}
+		keys[string(key.Marshal())] = true
+		b = rest
+	}
+	return keys, nil
+}
+
+func (cfg *config) user(name string) *userConfig {
+	for _, u := range cfg.Users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// quota is the quota of a user, shared by all its sessions. The usage is
+// measured when the first session starts, then updated as files change
+// through the server: changes made outside of the server are not seen.
+type quota struct {
+	limit int64
+
+	once    sync.Once
+	account sftp.QuotaAccount
+}
+
+func (q *quota) measure(root string) sftp.QuotaAccount {
+	q.once.Do(func() {
+		u := sftp.QuotaUsage{MaxBytes: q.limit}
+		filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || p == root {
+				return nil
+			}
+			if fi.Mode().IsRegular() {
+				u.Bytes += fi.Size()
+			}
+			u.Files++
+			return nil
+		})
+		q.account = sftp.NewQuota(u)
+	})
+	return q.account
+}
+
+// handlers serves the local files under a root directory.
+//
+// Paths are resolved lexically under the root, symlinks are followed by
+// the operating system though, so a root should not hold symlinks
+// pointing outside of it. Symlinks created through the server point
+// inside the root, from their parent directory once its symlinks are
+// resolved.
+type handlers struct {
+	root string
+}
+
+func newHandlers(u *userConfig) sftp.Handlers {
+	h := &handlers{root: u.Root}
+	hs := sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+	if u.usage != nil {
+		hs = sftp.QuotaHandlers(hs, u.usage.measure(h.root))
+	}
+	if u.ReadOnly {
+		hs = sftp.ReadOnlyHandlers(hs)
+	}
+	return hs
+}
+
+var _ sftp.PosixRenameFileCmder = (*handlers)(nil)
+
+// local returns the local path of the remote path p.
+func (h *handlers) local(p string) string {
+	return filepath.Join(h.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return os.Open(h.local(r.Filepath))
+}
+
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.open(r)
+}
+
+func (h *handlers) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.open(r)
+}
+
+func (h *handlers) open(r *sftp.Request) (*os.File, error) {
+	pflags := r.Pflags()
+	var flags int
+	switch {
+	case pflags.Read && pflags.Write:
+		flags = os.O_RDWR
+	case pflags.Write:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+	// Append is not passed on: WriteAt cannot be used on files opened with
+	// O_APPEND, and clients write at the end of the file by themselves.
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return os.OpenFile(h.local(r.Filepath), flags, 0644)
+}
+
+func (h *handlers) Filecmd(r *sftp.Request) error {
+	p := h.local(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r, p)
+	case "Rename":
+		// SFTP renames do not replace existing files
+		if _, err := os.Lstat(h.local(r.Target)); err == nil {
+			return os.ErrExist
+		}
+		return os.Rename(p, h.local(r.Target))
+	case "Rmdir":
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return sftp.ErrSSHFxFailure
+		}
+		return os.Remove(p)
+	case "Mkdir":
+		return os.Mkdir(p, 0755)
+	case "Link":
+		return os.Link(h.local(r.Target), p)
+	case "Symlink":
+		return h.symlink(p, h.local(r.Target))
+	case "Remove":
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return sftp.ErrSSHFxFailure
+		}
+		return os.Remove(p)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// symlink creates the link to target, both local paths under the root. The
+// link is relative, from its parent directory with its symlinks resolved:
+// the parent of link is denied if it resolves outside of the root, and the
+// link is created there, so that it cannot be followed out of the root
+// through the symlinks it sits under.
+func (h *handlers) symlink(target, link string) error {
+	root, err := filepath.EvalSymlinks(h.root)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(link))
+	if err != nil {
+		return err
+	}
+	if !within(root, dir) {
+		return os.ErrPermission
+	}
+
+	rel, err := filepath.Rel(h.root, target)
+	if err != nil {
+		return err
+	}
+	rel, err = filepath.Rel(dir, filepath.Join(root, rel))
+	if err != nil {
+		return err
+	}
+	return os.Symlink(rel, filepath.Join(dir, filepath.Base(link)))
+}
+
+// within returns whether p is dir or under it.
+func within(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// PosixRename renames as rename(2) does, replacing the target if it exists.
+func (h *handlers) PosixRename(r *sftp.Request) error {
+	return os.Rename(h.local(r.Filepath), h.local(r.Target))
+}
+
+func (h *handlers) setstat(r *sftp.Request, p string) error {
+	attrs, flags := r.Attributes(), r.AttrFlags()
+
+	if flags.Size {
+		if err := os.Truncate(p, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(p, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(p, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type listerat []os.FileInfo
+
+func (l listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// linkInfo renames the FileInfo of a symlink to its remote target,
+// as returned by Readlink.
+type linkInfo struct {
+	os.FileInfo
+	target string
+}
+
+func (fi linkInfo) Name() string { return fi.target }
+
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	p := h.local(r.Filepath)
+	switch r.Method {
+	case "List":
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fis, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return listerat(fis), nil
+	case "Stat":
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerat{fi}, nil
+	case "Lstat":
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerat{fi}, nil
+	case "Readlink":
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		if filepath.IsAbs(target) {
+			// report absolute targets relative to the root
+			rel, err := filepath.Rel(h.root, target)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				return nil, os.ErrPermission
+			}
+			target = "/" + filepath.ToSlash(rel)
+		}
+		return listerat{linkInfo{fi, filepath.ToSlash(target)}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
@@ -0,0 +1,215 @@
+// Command sftp-server is a lightweight SFTP server, serving each user the
+// local files under its own root directory over SSH.
+//
+// It is configured by a JSON file, given with -config:
+//
+//	{
+//		"listen": ":2022",
+//		"host_keys": ["/etc/sftp-server/ssh_host_ed25519_key"],
+//		"max_filelist": 100,
+//		"async_writes": false,
+//		"users": [
+//			{
+//				"name": "alice",
+//				"authorized_keys": "/etc/sftp-server/alice.keys",
+//				"root": "/srv/sftp/alice",
+//				"quota": 1073741824
+//			},
+//			{
+//				"name": "bob",
+//				"password_hash": "$2a$10$...",
+//				"root": "/srv/sftp/public",
+//				"read_only": true
+//			}
+//		]
+//	}
+//
+// Users log in with a password checked against the bcrypt hash in
+// password_hash, or with a key listed in their authorized_keys file.
+// A quota limits the bytes taken by the files under the root, 0 leaves it
+// unlimited. Run sftp-server -hash to hash a password read from stdin.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+func main() {
+	var (
+		configFile string
+		hash       bool
+		debug      bool
+	)
+	flag.StringVar(&configFile, "config", "/etc/sftp-server/config.json", "configuration file")
+	flag.BoolVar(&hash, "hash", false, "print the bcrypt hash of a password read from stdin, and exit")
+	flag.BoolVar(&debug, "debug", false, "log sessions to stderr")
+	flag.Parse()
+
+	if hash {
+		if err := printHash(os.Stdin); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sshConfig, err := cfg.serverConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	debugLog := log.New(ioutil.Discard, "", log.LstdFlags)
+	if debug {
+		debugLog.SetOutput(os.Stderr)
+	}
+
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %v", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go (&session{cfg: cfg, debug: debugLog}).serve(conn, sshConfig)
+	}
+}
+
+func printHash(r io.Reader) error {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(password, "\r\n")), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(h))
+	return nil
+}
+
+// serverConfig returns the SSH configuration authenticating the users of cfg.
+func (cfg *config) serverConfig() (*ssh.ServerConfig, error) {
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			u := cfg.user(c.User())
+			if u == nil || u.PasswordHash == "" ||
+				bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), password) != nil {
+				return nil, fmt.Errorf("password rejected for %q", c.User())
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			u := cfg.user(c.User())
+			if u == nil || !u.keys[string(key.Marshal())] {
+				return nil, fmt.Errorf("public key rejected for %q", c.User())
+			}
+			return nil, nil
+		},
+	}
+
+	for _, file := range cfg.HostKeys {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		sshConfig.AddHostKey(key)
+	}
+	return sshConfig, nil
+}
+
+// session is an SSH connection of an authenticated user.
+type session struct {
+	cfg   *config
+	user  *userConfig
+	debug *log.Logger
+}
+
+func (s *session) serve(conn net.Conn, sshConfig *ssh.ServerConfig) {
+	defer conn.Close()
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
+	if err != nil {
+		s.debug.Printf("%v: handshake failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	s.user = s.cfg.user(sconn.User())
+	log.Printf("%v: %s logged in", conn.RemoteAddr(), sconn.User())
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			s.debug.Printf("%v: cannot accept channel: %v", conn.RemoteAddr(), err)
+			return
+		}
+		go s.serveChannel(channel, requests)
+	}
+	log.Printf("%v: %s logged out", conn.RemoteAddr(), sconn.User())
+}
+
+// serveChannel serves the sftp subsystem on a session channel.
+func (s *session) serveChannel(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	sftpRequested := make(chan bool, 1)
+	go func() {
+		requested := false
+		for req := range requests {
+			// the payload of a subsystem request is a uint32 length then the name
+			ok := !requested && req.Type == "subsystem" &&
+				len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+			req.Reply(ok, nil)
+			if ok {
+				requested = true
+				sftpRequested <- true
+			}
+		}
+		close(sftpRequested)
+	}()
+	if !<-sftpRequested {
+		return
+	}
+
+	var options []sftp.RequestServerOption
+	if s.cfg.MaxFilelist > 0 {
+		options = append(options, sftp.WithRSMaxFilelist(s.cfg.MaxFilelist))
+	}
+	if s.cfg.AsyncWrites {
+		options = append(options, sftp.WithRSAsyncWrites())
+	}
+
+	server := sftp.NewRequestServer(channel, newHandlers(s.user), options...)
+	if err := server.Serve(); err != nil && err != io.EOF {
+		s.debug.Printf("%s: sftp session failed: %v", s.user.Name, err)
+	}
+	server.Close()
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// checkpointSuffix is appended to the name of a local file to name the
+// checkpoint of its resumed transfers.
+const checkpointSuffix = ".sftp-checkpoint"
+
+var commands = map[string]func(clients []*sftp.Client, args []string) error{
+	"ls":     ls,
+	"rm":     rm,
+	"get":    get,
+	"put":    put,
+	"mirror": mirror,
+}
+
+func parseArgs(name string, flags *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if n := flags.NArg(); n < min || (max >= 0 && n > max) {
+		return nil, fmt.Errorf("%s: wrong number of arguments", name)
+	}
+	return flags.Args(), nil
+}
+
+func ls(clients []*sftp.Client, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := flags.Bool("l", false, "long listing")
+	args, err := parseArgs("ls", flags, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	c := clients[0]
+	for _, p := range args {
+		fis, err := c.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		if len(args) > 1 {
+			fmt.Printf("%s:\n", p)
+		}
+		for _, fi := range fis {
+			if *long {
+				fmt.Printf("%v %12d %s %s\n", fi.Mode(), fi.Size(), fi.ModTime().Format("Jan _2 15:04 2006"), fi.Name())
+			} else {
+				fmt.Println(fi.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func rm(clients []*sftp.Client, args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "remove directories and their contents")
+	args, err := parseArgs("rm", flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	c := clients[0]
+	for _, p := range args {
+		if !*recursive {
+			if err := c.Remove(p); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// remove the files as they are walked,
+		// then the directories, deepest first
+		var dirs []string
+		w := c.Walk(p)
+		for w.Step() {
+			if err := w.Err(); err != nil {
+				return err
+			}
+			if w.Stat().IsDir() {
+				dirs = append(dirs, w.Path())
+			} else if err := c.Remove(w.Path()); err != nil {
+				return err
+			}
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := c.RemoveDirectory(dirs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func get(clients []*sftp.Client, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	resume := flags.Bool("resume", false, "resume an interrupted download")
+	args, err := parseArgs("get", flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	remote, local := args[0], args[1]
+	if fi, err := os.Stat(local); err == nil && fi.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+	return download(clients, remote, local, *resume)
+}
+
+func download(clients []*sftp.Client, remote, local string, resume bool) error {
+	fi, err := clients[0].Stat(remote)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	var cp *sftp.Checkpoint
+	if resume {
+		if cp, err = sftp.OpenCheckpoint(local + checkpointSuffix); err != nil {
+			return err
+		}
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(local, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	m := startMeter(remote, fi.Size())
+	size, err := sftp.StripedDownloadWithCheckpoint(clients, remote, meteredWriterAt{f, m}, *stripeSize, cp)
+	m.finish()
+	if err == nil {
+		// drop what is left of a larger file previously there
+		err = f.Truncate(size)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil && cp != nil {
+		err = cp.Remove()
+	}
+	return err
+}
+
+func put(clients []*sftp.Client, args []string) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	resume := flags.Bool("resume", false, "resume an interrupted upload")
+	args, err := parseArgs("put", flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	local, remote := args[0], args[1]
+	if fi, err := clients[0].Stat(remote); err == nil && fi.IsDir() {
+		remote = path.Join(remote, filepath.Base(local))
+	}
+	return upload(clients, local, remote, *resume)
+}
+
+func upload(clients []*sftp.Client, local, remote string, resume bool) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var cp *sftp.Checkpoint
+	if resume {
+		if cp, err = sftp.OpenCheckpoint(local + checkpointSuffix); err != nil {
+			return err
+		}
+	}
+
+	m := startMeter(local, fi.Size())
+	err = sftp.StripedUploadWithCheckpoint(clients, meteredReaderAt{f, m}, fi.Size(), remote, *stripeSize, cp)
+	m.finish()
+	if err == nil && cp != nil {
+		err = cp.Remove()
+	}
+	return err
+}
+
+func mirror(clients []*sftp.Client, args []string) error {
+	flags := flag.NewFlagSet("mirror", flag.ContinueOnError)
+	down := flags.Bool("down", false, "make the local directory a copy of the remote one")
+	del := flags.Bool("delete", false, "remove the files missing from the source")
+	args, err := parseArgs("mirror", flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	local, remote := args[0], args[1]
+
+	m := &mirrorer{clients: clients, local: local, remote: remote}
+	if *down {
+		return m.down(*del)
+	}
+	return m.up(*del)
+}
+
+// mirrorer copies the regular files of a directory tree whose size or
+// modification time differ from the copy, then sets their modification time.
+type mirrorer struct {
+	clients       []*sftp.Client
+	local, remote string
+}
+
+// mirrorFile describes a file of a tree by its slash separated relative path.
+type mirrorFile struct {
+	rel string
+	fi  os.FileInfo
+}
+
+func (m *mirrorer) localFiles() (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(m.local, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(m.local, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = fi
+		return nil
+	})
+	return files, err
+}
+
+func (m *mirrorer) remoteFiles() (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	root := path.Clean(m.remote)
+	w := m.clients[0].Walk(root)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			if os.IsNotExist(err) && w.Path() == root {
+				return files, nil
+			}
+			return nil, err
+		}
+		rel := "."
+		if p := w.Path(); p != root {
+			rel = p[len(root)+1:]
+		}
+		files[rel] = w.Stat()
+	}
+	return files, nil
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	return b != nil && a.Size() == b.Size() && a.ModTime().Unix() == b.ModTime().Unix()
+}
+
+// sorted returns the files sorted by path, so that directories come before their contents.
+func sorted(files map[string]os.FileInfo) []mirrorFile {
+	s := make([]mirrorFile, 0, len(files))
+	for rel, fi := range files {
+		s = append(s, mirrorFile{rel, fi})
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i].rel < s[j].rel })
+	return s
+}
+
+func (m *mirrorer) up(del bool) error {
+	src, err := m.localFiles()
+	if err != nil {
+		return err
+	}
+	dst, err := m.remoteFiles()
+	if err != nil {
+		return err
+	}
+
+	c := m.clients[0]
+	for _, f := range sorted(src) {
+		r := path.Join(m.remote, f.rel)
+		switch {
+		case f.fi.IsDir():
+			if err := c.MkdirAll(r); err != nil {
+				return err
+			}
+		case f.fi.Mode().IsRegular() && !sameFile(f.fi, dst[f.rel]):
+			if err := upload(m.clients, filepath.Join(m.local, filepath.FromSlash(f.rel)), r, false); err != nil {
+				return err
+			}
+			if err := c.Chtimes(r, time.Now(), f.fi.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !del {
+		return nil
+	}
+	extra := sorted(dst)
+	for i := len(extra) - 1; i >= 0; i-- {
+		f := extra[i]
+		if _, ok := src[f.rel]; ok {
+			continue
+		}
+		r := path.Join(m.remote, f.rel)
+		if f.fi.IsDir() {
+			err = c.RemoveDirectory(r)
+		} else {
+			err = c.Remove(r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mirrorer) down(del bool) error {
+	src, err := m.remoteFiles()
+	if err != nil {
+		return err
+	}
+	if len(src) == 0 {
+		return &os.PathError{Op: "mirror", Path: m.remote, Err: os.ErrNotExist}
+	}
+	if err := os.MkdirAll(m.local, 0755); err != nil {
+		return err
+	}
+	dst, err := m.localFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range sorted(src) {
+		l := filepath.Join(m.local, filepath.FromSlash(f.rel))
+		switch {
+		case f.fi.IsDir():
+			if err := os.MkdirAll(l, 0755); err != nil {
+				return err
+			}
+		case f.fi.Mode().IsRegular() && !sameFile(f.fi, dst[f.rel]):
+			if err := download(m.clients, path.Join(m.remote, f.rel), l, false); err != nil {
+				return err
+			}
+			if err := os.Chtimes(l, time.Now(), f.fi.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !del {
+		return nil
+	}
+	extra := sorted(dst)
+	for i := len(extra) - 1; i >= 0; i-- {
+		f := extra[i]
+		if _, ok := src[f.rel]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.local, filepath.FromSlash(f.rel))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
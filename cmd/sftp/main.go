@@ -0,0 +1,179 @@
+// Command sftp is a client of SFTP servers, transferring files with
+// concurrent and resumable transfers. It also serves as a tool to test
+// this package against arbitrary servers.
+//
+// Usage:
+//
+//	sftp [flags] [user@]host[:port] command [arguments]
+//
+// The commands are:
+//
+//	ls [-l] path...            list directories
+//	rm [-r] path...            remove files, and directories with -r
+//	get [-resume] remote local download a file
+//	put [-resume] local remote upload a file
+//	mirror [-down] [-delete] local remote
+//	                           make remote a copy of local, or local a copy of remote with -down
+//
+// It authenticates with the keys of the running ssh-agent, the keys given
+// with -i, and the password in the SFTP_PASSWORD environment variable, and
+// checks the host key against ~/.ssh/known_hosts.
+//
+// With -n, transfers are split into stripes transferred concurrently over
+// as many SFTP sessions, and -progress reports the progress of transfers.
+// Resumed transfers record their progress in a file named after the local
+// file with a ".sftp-checkpoint" suffix, removed once they complete.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type identities []string
+
+func (ids *identities) String() string     { return strings.Join(*ids, ",") }
+func (ids *identities) Set(v string) error { *ids = append(*ids, v); return nil }
+
+var (
+	sessions   = flag.Int("n", 1, "number of concurrent SFTP sessions for transfers")
+	stripeSize = flag.Int64("stripe", 16<<20, "size of the stripes of concurrent transfers")
+	progress   = flag.Bool("progress", false, "report the progress of transfers on stderr")
+	insecure   = flag.Bool("insecure", false, "do not check the host key")
+	keys       identities
+)
+
+func main() {
+	flag.Var(&keys, "i", "private key file, can be repeated")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sftp [flags] [user@]host[:port] ls|rm|get|put|mirror [arguments]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *sessions < 1 {
+		fatalf("-n must be at least 1")
+	}
+
+	cmd, ok := commands[flag.Arg(1)]
+	if !ok {
+		fatalf("unknown command %q", flag.Arg(1))
+	}
+
+	clients, err := connect(flag.Arg(0), *sessions)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	err = cmd(clients, flag.Args()[2:])
+	for _, c := range clients {
+		c.Close()
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "sftp: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// connect connects to the SSH server at dest, and starts n SFTP sessions,
+// each over its own channel of the connection.
+func connect(dest string, n int) ([]*sftp.Client, error) {
+	username, addr := "", dest
+	if i := strings.LastIndex(dest, "@"); i >= 0 {
+		username, addr = dest[:i], dest[i+1:]
+	}
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = u.Username
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	config := &ssh.ClientConfig{
+		User: username,
+		Auth: authMethods(),
+	}
+	if *insecure {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		config.HostKeyCallback, err = knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]*sftp.Client, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := sftp.NewClient(conn)
+		if err != nil {
+			for _, c := range clients {
+				c.Close()
+			}
+			conn.Close()
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+func authMethods() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, file := range keys {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			fatalf("%s: %v", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if password, ok := os.LookupEnv("SFTP_PASSWORD"); ok {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// meter reports the progress of a transfer on stderr, if -progress is set.
+type meter struct {
+	name  string
+	total int64
+	done  int64 // accessed atomically
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func startMeter(name string, total int64) *meter {
+	m := &meter{
+		name:    name,
+		total:   total,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if !*progress {
+		close(m.stopped)
+		return m
+	}
+
+	go func() {
+		defer close(m.stopped)
+		start := time.Now()
+		t := time.NewTicker(500 * time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				m.report(start, "\r")
+			case <-m.stop:
+				m.report(start, "\n")
+				return
+			}
+		}
+	}()
+	return m
+}
+
+func (m *meter) report(start time.Time, end string) {
+	done := atomic.LoadInt64(&m.done)
+	percent := int64(100)
+	if m.total > 0 {
+		percent = done * 100 / m.total
+	}
+	rate := float64(done) / time.Since(start).Seconds()
+	fmt.Fprintf(os.Stderr, "%s %d/%d bytes %3d%% %.1f MiB/s%s", m.name, done, m.total, percent, rate/(1<<20), end)
+}
+
+func (m *meter) add(n int) {
+	atomic.AddInt64(&m.done, int64(n))
+}
+
+// finish stops reporting, after a last report.
+func (m *meter) finish() {
+	select {
+	case <-m.stopped:
+	default:
+		close(m.stop)
+		<-m.stopped
+	}
+}
+
+type meteredWriterAt struct {
+	io.WriterAt
+	m *meter
+}
+
+func (w meteredWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := w.WriterAt.WriteAt(b, off)
+	w.m.add(n)
+	return n, err
+}
+
+type meteredReaderAt struct {
+	io.ReaderAt
+	m *meter
+}
+
+func (r meteredReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(b, off)
+	r.m.add(n)
+	return n, err
+}
@@ -0,0 +1,264 @@
+package sftp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// compressionExtension is negotiated to compress the file data of the
+// sessions between this client and server. The client sends it in
+// SSH_FXP_INIT with the methods it supports, comma separated, and the server
+// confirms it in SSH_FXP_VERSION with the method chosen.
+//
+// Once negotiated, the data of the SSH_FXP_WRITE requests and SSH_FXP_DATA
+// replies is formatted as:
+//
+//	byte    method, compressedRaw or compressedGzip
+//	uint32  the length of the data once decompressed
+//	byte[]  the data, compressed by method
+const compressionExtension = "compression@github.com/pkg/sftp"
+
+// compressionGzip is the only method of compressionExtension supported.
+const compressionGzip = "gzip"
+
+const (
+	compressedRaw  = 0
+	compressedGzip = 1
+)
+
+// compressMinLength is the length of the data below which it is not worth
+// compressing.
+const compressMinLength = 512
+
+var errCompressedData = errors.New("sftp: invalid compressed data")
+
+// UseCompression requests the server to compress the file data of the
+// session with gzip, that of the reads and writes, which speeds the
+// transfers of text and other compressible data over slow links, at the
+// cost of CPU on both sides. The data which does not compress is sent as it
+// is.
+//
+// The server must be of this package and allow it, see WithCompression and
+// WithRSCompression, otherwise the data is sent as usual.
+func UseCompression(value bool) ClientOption {
+	return func(c *Client) error {
+		c.useCompression = value
+		return nil
+	}
+}
+
+// WithCompression allows clients to negotiate the compression of the file
+// data of their sessions, see UseCompression.
+func WithCompression() ServerOption {
+	return func(s *Server) error {
+		s.allowCompression = true
+		return nil
+	}
+}
+
+// WithRSCompression allows clients to negotiate the compression of the file
+// data of their sessions, see UseCompression.
+func WithRSCompression() RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.allowCompression = true
+	}
+}
+
+// hasCompressionExtension returns true if the init packet asks for the
+// compression of the data with a method supported.
+func (p *sshFxInitPacket) hasCompressionExtension() bool {
+	for _, ext := range p.Extensions {
+		if ext.Name != compressionExtension {
+			continue
+		}
+		for _, method := range strings.Split(ext.Data, ",") {
+			if method == compressionGzip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withCompression adds the compression extension to exts when negotiated.
+func withCompression(exts []sshExtensionPair, compressed bool) []sshExtensionPair {
+	if !compressed {
+		return exts
+	}
+	return append(exts, sshExtensionPair{compressionExtension, compressionGzip})
+}
+
+// setCompressed sets whether the file data of the conn is compressed.
+func (c *conn) setCompressed(compressed bool) {
+	var v int32
+	if compressed {
+		v = 1
+	}
+	atomic.StoreInt32(&c.compressed, v)
+}
+
+func (c *conn) isCompressed() bool {
+	return atomic.LoadInt32(&c.compressed) != 0
+}
+
+// compressPacket returns m with its file data compressed, if any, when the
+// conn compresses it.
+func (c *conn) compressPacket(m encoding.BinaryMarshaler) encoding.BinaryMarshaler {
+	if !c.isCompressed() {
+		return m
+	}
+
+	p := m
+	if r, ok := m.(orderedResponse); ok {
+		p = r.responsePacket
+	}
+	switch p := p.(type) {
+	case *sshFxpWritePacket:
+		w := *p
+		w.Data = compressData(p.Data)
+		w.Length = uint32(len(w.Data))
+		return &w
+	case *sshFxpDataPacket:
+		d := *p
+		d.Data = compressData(p.Data)
+		d.Length = uint32(len(d.Data))
+		return &d
+	}
+	return m
+}
+
+// decompressRequest decompresses the data of pkt, for a server conn
+// compressing it.
+func (c *conn) decompressRequest(pkt requestPacket) error {
+	w, ok := pkt.(*sshFxpWritePacket)
+	if !ok || !c.isCompressed() {
+		return nil
+	}
+	n, err := decompressedLength(w.Data)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, n)
+	if err := decompressData(data, w.Data); err != nil {
+		return err
+	}
+	w.Data, w.Length = data, uint32(n)
+	return nil
+}
+
+// decompressReply decompresses the payload of data, that of a SSH_FXP_DATA
+// reply, into a buffer of c.buffers, which data is put back to.
+func (c *clientConn) decompressReply(data []byte) ([]byte, error) {
+	l, payload, err := unmarshalUint32Safe(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(payload)) < l {
+		return nil, errShortPacket
+	}
+	payload = payload[:l]
+
+	n, err := decompressedLength(payload)
+	if err != nil {
+		return nil, err
+	}
+	b := c.buffers.Get(8 + n)[:8+n]
+	copy(b, data[:4])
+	binary.BigEndian.PutUint32(b[4:], uint32(n))
+	if err := decompressData(b[8:], payload); err != nil {
+		c.buffers.Put(b)
+		return nil, err
+	}
+	c.buffers.Put(data)
+	return b, nil
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+var gzipReaders sync.Pool
+
+// compressData returns data formatted for compressionExtension.
+func compressData(data []byte) []byte {
+	header := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	if len(data) < compressMinLength {
+		return append(header, data...)
+	}
+
+	buf := bytes.NewBuffer(header)
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil || w.Close() != nil || buf.Len() >= 5+len(data) {
+		return append(header, data...)
+	}
+
+	b := buf.Bytes()
+	b[0] = compressedGzip
+	return b
+}
+
+// decompressedLength returns the length of the data of b, formatted for
+// compressionExtension, once decompressed.
+func decompressedLength(b []byte) (int, error) {
+	if len(b) < 5 {
+		return 0, errCompressedData
+	}
+	n := binary.BigEndian.Uint32(b[1:])
+	if n > maxMsgLength {
+		return 0, errCompressedData
+	}
+	return int(n), nil
+}
+
+// decompressData decompresses into dst the data of b, formatted for
+// compressionExtension, of the length of dst.
+func decompressData(dst, b []byte) error {
+	switch b[0] {
+	case compressedRaw:
+		if len(b[5:]) != len(dst) {
+			return errCompressedData
+		}
+		copy(dst, b[5:])
+		return nil
+	case compressedGzip:
+	default:
+		return errCompressedData
+	}
+
+	var r *gzip.Reader
+	if v := gzipReaders.Get(); v != nil {
+		r = v.(*gzip.Reader)
+		if err := r.Reset(bytes.NewReader(b[5:])); err != nil {
+			return errCompressedData
+		}
+	} else {
+		var err error
+		if r, err = gzip.NewReader(bytes.NewReader(b[5:])); err != nil {
+			return errCompressedData
+		}
+	}
+	defer gzipReaders.Put(r)
+
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return errCompressedData
+	}
+	// the data must not be longer than told, and match its checksum
+	if n, err := r.Read(make([]byte, 1)); n > 0 || err != io.EOF {
+		return errCompressedData
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressData(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 100)
+
+	for _, data := range [][]byte{nil, []byte("short"), random, text} {
+		b := compressData(data)
+		n, err := decompressedLength(b)
+		require.NoError(t, err)
+		got := make([]byte, n)
+		require.NoError(t, decompressData(got, b))
+		assert.Equal(t, len(data), len(got))
+		assert.True(t, bytes.Equal(data, got))
+	}
+	assert.Equal(t, byte(compressedRaw), compressData(random)[0])
+	b := compressData(text)
+	assert.Equal(t, byte(compressedGzip), b[0])
+	assert.Less(t, len(b), len(text)/10)
+
+	// longer or shorter than told
+	assert.Error(t, decompressData(make([]byte, len(text)-1), b))
+	assert.Error(t, decompressData(make([]byte, len(text)+1), b))
+	_, err := decompressedLength(b[:3])
+	assert.Error(t, err)
+	b[len(b)-5] ^= 0xff // the checksum
+	assert.Error(t, decompressData(make([]byte, len(text)), b))
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	io.WriteCloser
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&w.n, int64(len(b)))
+	return w.WriteCloser.Write(b)
+}
+
+func TestServerCompression(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	dir, err := ioutil.TempDir("", "sftptest-compression")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var text bytes.Buffer
+	for i := 0; text.Len() < 1<<20; i++ {
+		fmt.Fprintf(&text, "line %d of a log of sorts\n", i)
+	}
+
+	for _, allow := range []bool{true, false} {
+		cr, sw := io.Pipe()
+		sr, cw := io.Pipe()
+		var opts []ServerOption
+		if allow {
+			opts = append(opts, WithCompression())
+		}
+		sent := &countingWriter{WriteCloser: sw}
+		server, err := NewServer(struct {
+			io.Reader
+			io.WriteCloser
+		}{sr, sent}, opts...)
+		require.NoError(t, err)
+		go server.Serve()
+		received := &countingWriter{WriteCloser: cw}
+		client, err := NewClientPipe(cr, received, UseCompression(true))
+		require.NoError(t, err)
+
+		_, ok := client.HasExtension(compressionExtension)
+		assert.Equal(t, allow, ok)
+
+		name := filepath.Join(dir, "log")
+		_, err = putTestFile(client, name, text.String())
+		require.NoError(t, err)
+		got, err := getTestFile(client, name)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(text.Bytes(), got))
+
+		if allow {
+			assert.Less(t, atomic.LoadInt64(&received.n), int64(text.Len()/4), "uploaded")
+			assert.Less(t, atomic.LoadInt64(&sent.n), int64(text.Len()/4), "downloaded")
+		} else {
+			assert.Greater(t, atomic.LoadInt64(&received.n), int64(text.Len()), "uploaded")
+			assert.Greater(t, atomic.LoadInt64(&sent.n), int64(text.Len()), "downloaded")
+		}
+
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestRequestServerCompression(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sent := &countingWriter{WriteCloser: sw}
+	server := NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sent}, InMemHandler(), WithRSCompression())
+	go server.Serve()
+	client, err := NewClientPipe(cr, cw, UseCompression(true))
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	text := bytes.Repeat([]byte("compressible "), 1<<16)
+	_, err = putTestFile(client, "/file", string(text))
+	require.NoError(t, err)
+	f, err := client.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+	var got bytes.Buffer
+	_, err = f.WriteTo(&got)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(text, got.Bytes()))
+	assert.Less(t, atomic.LoadInt64(&sent.n), int64(len(text)/4))
+}
@@ -1,9 +1,11 @@
 package sftp
 
 import (
+	"context"
 	"encoding"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -16,22 +18,81 @@ type conn struct {
 	// this is the same allocator used in packet manager
 	alloc      *allocator
 	sync.Mutex // used to serialise writes to sendPacket
+
+	limit *rateLimiter // of the file data sent and received, if set
+	// if policy is set, limits the file data at the rate of the policy
+	policy      *Policy
+	policyLimit *rateLimiter
+
+	// copyBuf copies the data of the replies read from files once sent,
+	// see WithZeroCopyReads
+	copyBuf []byte
+
+	// set atomically once compressionExtension is negotiated
+	compressed int32
 }
 
 // the orderID is used in server mode if the allocator is enabled.
 // For the client mode just pass 0
 func (c *conn) recvPacket(orderID uint32) (uint8, []byte, error) {
-	return recvPacket(c, c.alloc, orderID)
+	typ, data, err := recvPacket(c, c.alloc, orderID)
+	if err == nil && (typ == sshFxpWrite || typ == sshFxpData) {
+		c.waitLimit(len(data))
+	}
+	return typ, data, err
+}
+
+// setPolicy limits the file data at the rate limit of p too, see
+// Policy.SetRateLimit.
+func (c *conn) setPolicy(p *Policy) {
+	c.policy = p
+	c.policyLimit = &rateLimiter{stopped: make(chan struct{})}
+}
+
+// waitLimit waits for n bytes of file data to be allowed by the rate limits.
+func (c *conn) waitLimit(n int) {
+	c.limit.wait(n)
+	if c.policyLimit != nil {
+		c.policyLimit.setRate(c.policy.RateLimit())
+		c.policyLimit.wait(n)
+	}
+}
+
+// recvReply receives a reply of the server, the payload of a data reply
+// into a buffer of c.buffers.
+func (c *clientConn) recvReply() (uint8, []byte, error) {
+	typ, data, err := recvDataPacket(c, c.buffers)
+	if err == nil && typ == sshFxpData {
+		c.limit.wait(len(data))
+	}
+	return typ, data, err
 }
 
 func (c *conn) sendPacket(m encoding.BinaryMarshaler) error {
+	m = c.compressPacket(m)
+	c.waitLimit(dataLength(m))
+
 	c.Lock()
 	defer c.Unlock()
 
+	if p, ok := fileDataPacket(m); ok {
+		if c.copyBuf == nil {
+			c.copyBuf = make([]byte, maxTxPacket)
+		}
+		if err := p.writeTo(c.WriteCloser, c.copyBuf); err != nil {
+			// the packet may be partly written
+			c.WriteCloser.Close()
+			return err
+		}
+		return nil
+	}
 	return sendPacket(c, m)
 }
 
 func (c *conn) Close() error {
+	c.limit.stop()
+	c.policyLimit.stop()
+
 	c.Lock()
 	defer c.Unlock()
 	return c.WriteCloser.Close()
@@ -41,8 +102,19 @@ type clientConn struct {
 	conn
 	wg sync.WaitGroup
 
-	sync.Mutex                          // protects inflight
-	inflight   map[uint32]chan<- result // outstanding requests
+	sync.Mutex               // protects inflight
+	inflight   inflightTable // outstanding requests
+
+	// buffers provides the buffers the data replies are received into
+	buffers Allocator
+
+	// if not nil, the requests are logged to it once replied
+	logger Logger
+	// if not nil, the requests and handles are measured by it
+	metrics Metrics
+
+	// idle, if not nil, is closed once no request is outstanding
+	idle chan struct{}
 
 	closed chan struct{}
 	err    error
@@ -76,7 +148,7 @@ func (c *clientConn) recv() error {
 	defer c.conn.Close()
 
 	for {
-		typ, data, err := c.recvPacket(0)
+		typ, data, err := c.recvReply()
 		if err != nil {
 			return err
 		}
@@ -85,19 +157,40 @@ func (c *clientConn) recv() error {
 			return err
 		}
 
-		ch, ok := c.getChannel(sid)
+		ch, pkt, sent, ok := c.takeRequest(sid)
 		if !ok {
 			// This is an unexpected occurrence. Send the error
 			// back to all listeners so that they terminate
 			// gracefully.
 			return errors.Errorf("sid not found: %d", sid)
 		}
+		if typ == sshFxpData && c.isCompressed() {
+			if data, err = c.decompressReply(data); err != nil {
+				ch <- result{err: err}
+				return err
+			}
+		}
+		if pkt != nil {
+			// before the payload is handed over, and maybe reused
+			c.logReply(pkt, sent, typ, data)
+		}
 
 		ch <- result{typ: typ, data: data}
 	}
 }
 
-func (c *clientConn) putChannel(ch chan<- result, sid uint32) bool {
+// nextID reserves and returns the ID of a new request.
+// The request must then be sent with dispatchRequest.
+func (c *clientConn) nextID() uint32 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.inflight.reserve()
+}
+
+func (c *clientConn) putChannel(ch chan<- result, p idmarshaler) bool {
+	sid := p.id()
+
 	c.Lock()
 	defer c.Unlock()
 
@@ -109,18 +202,91 @@ func (c *clientConn) putChannel(ch chan<- result, sid uint32) bool {
 	default:
 	}
 
-	c.inflight[sid] = ch
+	if !c.inflight.put(sid, ch) {
+		ch <- result{err: errors.Errorf("request id %d not reserved", sid)}
+		return false
+	}
+	if c.logged() {
+		slot := c.inflight.slot(sid)
+		slot.pkt, slot.sent = p, pkgClock.Now()
+	}
 	return true
 }
 
 func (c *clientConn) getChannel(sid uint32) (chan<- result, bool) {
+	ch, _, _, ok := c.takeRequest(sid)
+	return ch, ok
+}
+
+// takeRequest returns the channel of the request sid, and the request
+// along with the time it was sent if it is to be logged.
+func (c *clientConn) takeRequest(sid uint32) (ch chan<- result, pkt idmarshaler, sent time.Time, ok bool) {
 	c.Lock()
 	defer c.Unlock()
 
-	ch, ok := c.inflight[sid]
-	delete(c.inflight, sid)
+	if slot := c.inflight.slot(sid); slot != nil {
+		pkt, sent = slot.pkt, slot.sent
+	}
+	ch, ok = c.inflight.take(sid)
+	if ok && c.idle != nil && c.inflight.outstanding() == 0 {
+		close(c.idle)
+		c.idle = nil
+	}
+	return ch, pkt, sent, ok
+}
 
-	return ch, ok
+// release frees the ID of a request reserved with nextID, which is not to
+// be dispatched.
+func (c *clientConn) release(id uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.inflight.release(id) && c.idle != nil && c.inflight.outstanding() == 0 {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+// outstanding returns the number of requests reserved and not answered yet.
+func (c *clientConn) outstanding() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.inflight.outstanding()
+}
+
+// lost reports whether the conn has shut down.
+func (c *clientConn) lost() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitIdle blocks until no request is outstanding, the conn has shut down,
+// or ctx is done.
+func (c *clientConn) waitIdle(ctx context.Context) error {
+	c.Lock()
+	if c.inflight.outstanding() == 0 {
+		c.Unlock()
+		return nil
+	}
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+	}
+	idle := c.idle
+	c.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-c.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // result captures the result of receiving the a packet from the server
@@ -150,7 +316,7 @@ func (c *clientConn) sendPacket(ch chan result, p idmarshaler) (byte, []byte, er
 func (c *clientConn) dispatchRequest(ch chan<- result, p idmarshaler) {
 	sid := p.id()
 
-	if !c.putChannel(ch, sid) {
+	if !c.putChannel(ch, p) {
 		// already closed.
 		return
 	}
@@ -168,21 +334,119 @@ func (c *clientConn) broadcastErr(err error) {
 	defer c.Unlock()
 
 	bcastRes := result{err: ErrSSHFxConnectionLost}
-	for sid, ch := range c.inflight {
-		ch <- bcastRes
+	for i := range c.inflight.slots {
+		slot := &c.inflight.slots[i]
+		if slot.ch == nil {
+			continue
+		}
+		slot.ch <- bcastRes
 
 		// Replace the chan in inflight,
 		// we have hijacked this chan,
 		// and this guarantees always-only-once sending.
-		c.inflight[sid] = make(chan<- result, 1)
+		slot.ch = make(chan<- result, 1)
 	}
 
 	c.err = err
 	close(c.closed)
 }
 
+// inflightSlotBits is the number of bits of a request ID indexing its slot,
+// the remaining bits hold the generation of the slot.
+const inflightSlotBits = 24
+
+const inflightSlotMask = 1<<inflightSlotBits - 1
+
+// inflightTable holds the channels of the requests awaiting a response.
+// A request ID indexes a slot of the table, and the slots of completed
+// requests are reused through a freelist, so that the table only grows
+// with the number of concurrent requests,
+// rather than with the number of requests issued over the session.
+type inflightTable struct {
+	slots []inflightSlot
+	free  []uint32 // indexes of the unused slots
+}
+
+type inflightSlot struct {
+	gen      uint32 // incremented each time the slot is reserved
+	reserved bool
+	ch       chan<- result // set once the request is dispatched
+
+	// the request and the time it was sent, if logged
+	pkt  idmarshaler
+	sent time.Time
+}
+
+func (t *inflightTable) reserve() uint32 {
+	var i uint32
+	if n := len(t.free); n > 0 {
+		i = t.free[n-1]
+		t.free = t.free[:n-1]
+	} else {
+		i = uint32(len(t.slots))
+		t.slots = append(t.slots, inflightSlot{})
+	}
+
+	slot := &t.slots[i]
+	slot.gen = (slot.gen + 1) & (1<<(32-inflightSlotBits) - 1)
+	slot.reserved = true
+	return slot.gen<<inflightSlotBits | i
+}
+
+// slot returns the slot reserved for the request id, or nil.
+func (t *inflightTable) slot(id uint32) *inflightSlot {
+	i := id & inflightSlotMask
+	if i >= uint32(len(t.slots)) {
+		return nil
+	}
+	slot := &t.slots[i]
+	if !slot.reserved || slot.gen != id>>inflightSlotBits {
+		return nil
+	}
+	return slot
+}
+
+func (t *inflightTable) put(id uint32, ch chan<- result) bool {
+	slot := t.slot(id)
+	if slot == nil {
+		return false
+	}
+	slot.ch = ch
+	return true
+}
+
+// outstanding returns the number of requests reserved and not yet taken.
+func (t *inflightTable) outstanding() int {
+	return len(t.slots) - len(t.free)
+}
+
+// take returns the channel of the request id, and frees its slot.
+func (t *inflightTable) take(id uint32) (chan<- result, bool) {
+	slot := t.slot(id)
+	if slot == nil || slot.ch == nil {
+		return nil, false
+	}
+	ch := slot.ch
+	slot.ch, slot.pkt = nil, nil
+	slot.reserved = false
+	t.free = append(t.free, id&inflightSlotMask)
+	return ch, true
+}
+
+// release frees the slot of the request id, reserved and not dispatched.
+func (t *inflightTable) release(id uint32) bool {
+	slot := t.slot(id)
+	if slot == nil || slot.ch != nil {
+		return false
+	}
+	slot.reserved = false
+	t.free = append(t.free, id&inflightSlotMask)
+	return true
+}
+
 type serverConn struct {
 	conn
+	idle idleTimer // see WithIdleTimeout
 }
 
 func (s *serverConn) sendError(id uint32, err error) error {
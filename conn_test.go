@@ -0,0 +1,47 @@
+package sftp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflightTable(t *testing.T) {
+	var table inflightTable
+	ch := make(chan result, 1)
+
+	id1 := table.reserve()
+	id2 := table.reserve()
+	assert.NotEqual(t, id1, id2)
+	assert.True(t, table.put(id1, ch))
+	assert.True(t, table.put(id2, ch))
+
+	_, ok := table.take(id1 + 1<<inflightSlotBits)
+	assert.False(t, ok, "id of another generation")
+
+	got, ok := table.take(id1)
+	assert.True(t, ok)
+	assert.Equal(t, chan<- result(ch), got)
+	_, ok = table.take(id1)
+	assert.False(t, ok, "id taken twice")
+
+	// the freed slot is reused with a new id
+	id3 := table.reserve()
+	assert.NotEqual(t, id1, id3)
+	assert.Equal(t, id1&inflightSlotMask, id3&inflightSlotMask)
+	assert.False(t, table.put(id1, ch), "stale id")
+	assert.Len(t, table.slots, 2)
+
+	// ids that were never reserved
+	assert.False(t, table.put(12345, ch))
+	_, ok = table.take(12345)
+	assert.False(t, ok)
+
+	for i := 0; i < 1000; i++ {
+		id := table.reserve()
+		assert.True(t, table.put(id, ch))
+		_, ok := table.take(id)
+		assert.True(t, ok)
+	}
+	assert.Len(t, table.slots, 3)
+}
@@ -0,0 +1,310 @@
+package sftp
+
+import (
+	"io"
+	"math"
+	"os"
+	"syscall"
+)
+
+// copyDataExtension copies data between two open files on the server, as
+// specified by the PROTOCOL file of OpenSSH.
+const copyDataExtension = "copy-data"
+
+// copyFileExtension copies a file on the server, as specified by
+// draft-ietf-secsh-filexfer-extensions-00.
+const copyFileExtension = "copy-file"
+
+// sshFxpExtendedPacketCopyData copies Length bytes, or the data up to the
+// end of the file with a Length of 0, from ReadOffset of the file of
+// ReadHandle to WriteOffset of the file of WriteHandle.
+type sshFxpExtendedPacketCopyData struct {
+	ID              uint32
+	ExtendedRequest string
+	ReadHandle      string
+	ReadOffset      uint64
+	Length          uint64
+	WriteHandle     string
+	WriteOffset     uint64
+}
+
+func (p *sshFxpExtendedPacketCopyData) id() uint32     { return p.ID }
+func (p *sshFxpExtendedPacketCopyData) readonly() bool { return false }
+
+func (p *sshFxpExtendedPacketCopyData) MarshalBinary() ([]byte, error) {
+	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
+		4 + len(copyDataExtension) +
+		4 + len(p.ReadHandle) +
+		8 + 8 + // uint64(read offset) + uint64(length)
+		4 + len(p.WriteHandle) +
+		8 // uint64(write offset)
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtended)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, copyDataExtension)
+	b = marshalString(b, p.ReadHandle)
+	b = marshalUint64(b, p.ReadOffset)
+	b = marshalUint64(b, p.Length)
+	b = marshalString(b, p.WriteHandle)
+	b = marshalUint64(b, p.WriteOffset)
+
+	return b, nil
+}
+
+func (p *sshFxpExtendedPacketCopyData) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.ExtendedRequest, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.ReadHandle, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.ReadOffset, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.Length, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.WriteHandle, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.WriteOffset, _, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *sshFxpExtendedPacketCopyData) respond(s *Server) responsePacket {
+	r, ok := s.getHandle(p.ReadHandle)
+	if !ok {
+		return statusFromError(p.ID, EBADF)
+	}
+	w, ok := s.getHandle(p.WriteHandle)
+	if !ok {
+		return statusFromError(p.ID, EBADF)
+	}
+	return statusFromError(p.ID, p.copy(r, w))
+}
+
+// copy copies the data requested from r to w.
+func (p *sshFxpExtendedPacketCopyData) copy(r io.ReaderAt, w io.WriterAt) error {
+	if p.ReadOffset > math.MaxInt64 || p.WriteOffset > math.MaxInt64 {
+		return os.ErrInvalid
+	}
+	length := int64(p.Length)
+	if p.Length == 0 || p.Length > math.MaxInt64-p.ReadOffset {
+		length = math.MaxInt64 - int64(p.ReadOffset)
+	}
+	src := io.NewSectionReader(r, int64(p.ReadOffset), length)
+	_, err := io.Copy(&offsetWriter{w: w, off: int64(p.WriteOffset)}, src)
+	return err
+}
+
+// offsetWriter writes to w sequentially from off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (w *offsetWriter) Write(b []byte) (int, error) {
+	n, err := w.w.WriteAt(b, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// copyData serves copy-data between the objects opened for the requests of
+// the two handles.
+func (rs *RequestServer) copyData(p *sshFxpExtendedPacketCopyData) error {
+	rreq, ok := rs.getRequest(p.ReadHandle)
+	if !ok {
+		return EBADF
+	}
+	wreq, ok := rs.getRequest(p.WriteHandle)
+	if !ok {
+		return EBADF
+	}
+	r, w := rreq.readerAt(), wreq.writerAt()
+	if r == nil || w == nil {
+		return os.ErrPermission
+	}
+	return p.copy(r, w)
+}
+
+// sshFxpExtendedPacketCopyFile copies the file Source to Destination,
+// replacing it if Overwrite is set.
+type sshFxpExtendedPacketCopyFile struct {
+	ID              uint32
+	ExtendedRequest string
+	Source          string
+	Destination     string
+	Overwrite       bool
+}
+
+func (p *sshFxpExtendedPacketCopyFile) id() uint32     { return p.ID }
+func (p *sshFxpExtendedPacketCopyFile) readonly() bool { return false }
+
+func (p *sshFxpExtendedPacketCopyFile) MarshalBinary() ([]byte, error) {
+	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
+		4 + len(copyFileExtension) +
+		4 + len(p.Source) +
+		4 + len(p.Destination) +
+		1 // bool(overwrite)
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtended)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, copyFileExtension)
+	b = marshalString(b, p.Source)
+	b = marshalString(b, p.Destination)
+	if p.Overwrite {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+
+	return b, nil
+}
+
+func (p *sshFxpExtendedPacketCopyFile) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.ExtendedRequest, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Source, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Destination, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if len(b) < 1 {
+		return errShortPacket
+	}
+	p.Overwrite = b[0] != 0
+	return nil
+}
+
+// pflags returns the flags to open the Destination with.
+func (p *sshFxpExtendedPacketCopyFile) pflags() uint32 {
+	pflags := uint32(sshFxfWrite | sshFxfCreat | sshFxfTrunc)
+	if !p.Overwrite {
+		pflags |= sshFxfExcl
+	}
+	return pflags
+}
+
+func (p *sshFxpExtendedPacketCopyFile) respond(s *Server) responsePacket {
+	return statusFromError(p.ID, p.copy())
+}
+
+// copy copies the local file Source to Destination, which is created with
+// the permissions of Source.
+func (p *sshFxpExtendedPacketCopyFile) copy() error {
+	src, err := os.Open(p.Source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return syscall.EISDIR
+	}
+
+	dst, err := os.OpenFile(p.Destination, newFileOpenFlags(p.pflags()).OSFlags(), fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// withoutExtension returns exts without the extension name.
+func withoutExtension(exts []sshExtensionPair, name string) []sshExtensionPair {
+	kept := exts[:0:0]
+	for _, ext := range exts {
+		if ext.Name != name {
+			kept = append(kept, ext)
+		}
+	}
+	return kept
+}
+
+// CopyRemote copies the remote file src to dst, creating or truncating it,
+// on the server, without transferring the data through the Client. The
+// server must support the copy-file or the copy-data extension, as OpenSSH
+// does the latter; otherwise ErrSSHFxOpUnsupported is returned, with dst
+// left untouched.
+func (c *Client) CopyRemote(src, dst string) error {
+	if _, ok := c.HasExtension(copyFileExtension); ok {
+		err := c.copyFile(src, dst)
+		if status, ok := err.(*StatusError); !ok || status.FxCode() != ErrSSHFxOpUnsupported {
+			return err
+		}
+	}
+	if _, ok := c.HasExtension(copyDataExtension); !ok {
+		return ErrSSHFxOpUnsupported
+	}
+
+	r, err := c.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := c.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if err := c.copyData(r, w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// copyFile copies src to dst with the copy-file extension.
+func (c *Client) copyFile(src, dst string) error {
+	id := c.nextID()
+	typ, data, err := c.sendPacket(nil, &sshFxpExtendedPacketCopyFile{
+		ID:          id,
+		Source:      src,
+		Destination: dst,
+		Overwrite:   true,
+	})
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case sshFxpStatus:
+		return normaliseError(unmarshalStatus(id, data))
+	default:
+		return unimplementedPacketErr(typ)
+	}
+}
+
+// copyData copies the content of r to w with the copy-data extension.
+func (c *Client) copyData(r, w *File) error {
+	if err := r.checkOpen("copy"); err != nil {
+		return err
+	}
+	if err := w.checkOpen("copy"); err != nil {
+		return err
+	}
+
+	id := c.nextID()
+	typ, data, err := c.sendPacket(nil, &sshFxpExtendedPacketCopyData{
+		ID:          id,
+		ReadHandle:  r.handle,
+		WriteHandle: w.handle,
+	})
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case sshFxpStatus:
+		return normaliseError(unmarshalStatus(id, data))
+	default:
+		return unimplementedPacketErr(typ)
+	}
+}
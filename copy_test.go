@@ -0,0 +1,77 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyRemote(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-copy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	require.NoError(t, ioutil.WriteFile(src, []byte("hello world"), 0640))
+	dst := filepath.Join(dir, "dst")
+	require.NoError(t, ioutil.WriteFile(dst, []byte("something longer"), 0600))
+
+	require.NoError(t, client.CopyRemote(src, dst))
+	b, err := ioutil.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(b))
+
+	// copy-data, between open files
+	r, err := client.Open(src)
+	require.NoError(t, err)
+	defer r.Close()
+	w, err := client.OpenFile(filepath.Join(dir, "data"), os.O_WRONLY|os.O_CREATE)
+	require.NoError(t, err)
+	require.NoError(t, client.copyData(r, w))
+	require.NoError(t, w.Close())
+	b, err = ioutil.ReadFile(filepath.Join(dir, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(b))
+
+	assert.True(t, os.IsNotExist(client.CopyRemote(filepath.Join(dir, "missing"), dst)))
+}
+
+func TestRequestServerCopyRemote(t *testing.T) {
+	h := InMemHandler()
+	for _, tt := range []struct {
+		name     string
+		put      FileWriter
+		copyFile bool
+	}{
+		{"CopyFileWriter", h.FilePut, true},
+		{"FileWriter", struct{ FileWriter }{h.FilePut}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := handlersClientPair(t, Handlers{h.FileGet, tt.put, h.FileCmd, h.FileList}, nil)
+
+			_, ok := client.HasExtension(copyFileExtension)
+			assert.Equal(t, tt.copyFile, ok)
+
+			_, err := putTestFile(client, "/src", "hello world")
+			require.NoError(t, err)
+			_, err = putTestFile(client, "/dst", "something longer")
+			require.NoError(t, err)
+
+			require.NoError(t, client.CopyRemote("/src", "/dst"))
+			b, err := getTestFile(client, "/dst")
+			require.NoError(t, err)
+			assert.Equal(t, "hello world", string(b))
+		})
+	}
+}
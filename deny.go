@@ -0,0 +1,276 @@
+package sftp
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DenyOp is a set of the operations a DenyRule denies.
+type DenyOp uint
+
+// The operations denied by DenyRules.
+const (
+	// DenyRead denies opening files for reading.
+	DenyRead DenyOp = 1 << iota
+
+	// DenyWrite denies opening files for writing, setting their attributes,
+	// and creating directories and links, or renaming files, at the paths.
+	DenyWrite
+
+	// DenyDelete denies removing files and directories, and renaming them
+	// away from the paths.
+	DenyDelete
+
+	// DenyList denies listing directories.
+	DenyList
+
+	// DenyHide hides the paths: the requests on them fail as if they did
+	// not exist, rather than with a permission denied error, and they are
+	// left out of the directory listings. The files of a directory hidden
+	// are hidden only if they match too, as with "/secret/**".
+	DenyHide
+)
+
+// DenyRule denies the operations Ops on the paths matching Pattern, or on
+// the paths not matching it if Except is set.
+//
+// A Pattern without a slash matches the base name of the files, in any
+// directory, like "*.lock". Otherwise it matches the whole path, from the
+// root, element by element, each element as in Match. The element "**"
+// matches any number of elements, "**/.ssh/*" matching the files of any
+// .ssh directory.
+//
+// The rules with Except allow their Ops on the paths matching them only:
+// an operation is denied on the paths matching none of the rules with
+// Except it is for, as well as on the paths matching a rule without
+// Except. The rules
+//
+//	DenyRule{Pattern: "/incoming/**", Ops: DenyWrite | DenyDelete, Except: true}
+//	DenyRule{Pattern: "/incoming/*.done", Ops: DenyDelete}
+//
+// allow changing files under /incoming only, except removing those marked
+// done. Hiding every path but some hides the directories leading to them,
+// unless they match a rule with Except too.
+type DenyRule struct {
+	Pattern string
+	Ops     DenyOp
+	Except  bool
+}
+
+// WithDenyRules denies the operations of the rules, whatever the
+// permissions of the files, with a permission denied error. The paths are
+// matched after being made absolute. It returns an error if a pattern is
+// malformed. The RequestServer equivalent is WithRSDenyRules.
+func WithDenyRules(rules ...DenyRule) ServerOption {
+	return func(s *Server) error {
+		for _, rule := range rules {
+			if err := checkDenyPattern(rule.Pattern); err != nil {
+				return err
+			}
+		}
+		s.denyRules = append(s.denyRules, rules...)
+		return nil
+	}
+}
+
+// WithRSDenyRules denies the operations of the rules with a permission
+// denied error, before the Handlers are called. The paths are matched as
+// given to the Handlers. A malformed pattern matches every path. The Server
+// equivalent is WithDenyRules.
+func WithRSDenyRules(rules ...DenyRule) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.denyRules = append(rs.denyRules, rules...)
+	}
+}
+
+func checkDenyPattern(pattern string) error {
+	for _, elem := range strings.Split(pattern, "/") {
+		if _, err := path.Match(elem, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type denyRules []DenyRule
+
+// denied reports whether the rules deny op on a path p, which is slash
+// separated. Malformed patterns fail closed.
+func (rules denyRules) denied(op DenyOp, p string) bool {
+	excepted, allowed := false, false
+	for _, rule := range rules {
+		if rule.Ops&op == 0 {
+			continue
+		}
+		ok, err := matchDenyPattern(rule.Pattern, p)
+		if err != nil {
+			return true
+		}
+		if rule.Except {
+			excepted = true
+			allowed = allowed || ok
+		} else if ok {
+			return true
+		}
+	}
+	return excepted && !allowed
+}
+
+// checkPath returns the error denying op on the path p, which is
+// os.ErrNotExist if p is hidden, or nil if op is allowed. An op of 0 only
+// checks whether p is hidden.
+func (rules denyRules) checkPath(op DenyOp, p string) error {
+	if rules.denied(DenyHide, p) {
+		return os.ErrNotExist
+	}
+	if op != 0 && rules.denied(op, p) {
+		return ErrSSHFxPermissionDenied
+	}
+	return nil
+}
+
+// checkPacket returns the error denying pkt, or nil if the rules allow it.
+// The paths of pkt are made into those matched by clean, and the paths of
+// the handles are returned by handlePath.
+func (rules denyRules) checkPacket(pkt requestPacket, clean func(string) string, handlePath func(string) (string, bool)) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	type check struct {
+		op   DenyOp
+		path string
+	}
+	var checks []check
+	switch pkt := pkt.(type) {
+	case *sshFxpExtendedPacket:
+		if pkt.SpecificPacket == nil {
+			return nil
+		}
+		return rules.checkPacket(pkt.SpecificPacket, clean, handlePath)
+	case *sshFxpStatPacket:
+		checks = append(checks, check{0, pkt.Path})
+	case *sshFxpLstatPacket:
+		checks = append(checks, check{0, pkt.Path})
+	case *sshFxpReadlinkPacket:
+		checks = append(checks, check{0, pkt.Path})
+	case *sshFxpExtendedPacketStatVFS:
+		checks = append(checks, check{0, pkt.Path})
+	case *sshFxpOpenPacket:
+		if pkt.hasPflags(sshFxfRead) {
+			checks = append(checks, check{DenyRead, pkt.Path})
+		}
+		if !pkt.readonly() {
+			checks = append(checks, check{DenyWrite, pkt.Path})
+		}
+	case *sshFxpOpendirPacket:
+		checks = append(checks, check{DenyList, pkt.Path})
+	case *sshFxpSetstatPacket:
+		checks = append(checks, check{DenyWrite, pkt.Path})
+	case *sshFxpFsetstatPacket:
+		if name, ok := handlePath(pkt.Handle); ok {
+			return rules.checkPath(DenyWrite, name)
+		}
+	case *sshFxpMkdirPacket:
+		checks = append(checks, check{DenyWrite, pkt.Path})
+	case *sshFxpSymlinkPacket:
+		checks = append(checks, check{DenyWrite, pkt.Linkpath})
+	case *sshFxpExtendedPacketHardlink:
+		checks = append(checks, check{DenyWrite, pkt.Newpath})
+	case *sshFxpExtendedPacketCopyFile:
+		checks = append(checks, check{DenyRead, pkt.Source}, check{DenyWrite, pkt.Destination})
+	case *sshFxpExtendedPacketCheckFileName:
+		checks = append(checks, check{DenyRead, pkt.Path})
+	case *sshFxpRemovePacket:
+		checks = append(checks, check{DenyDelete, pkt.Filename})
+	case *sshFxpRmdirPacket:
+		checks = append(checks, check{DenyDelete, pkt.Path})
+	case *sshFxpRenamePacket:
+		checks = append(checks, check{DenyDelete, pkt.Oldpath}, check{DenyWrite, pkt.Newpath})
+	case *sshFxpExtendedPacketPosixRename:
+		checks = append(checks, check{DenyDelete, pkt.Oldpath}, check{DenyWrite, pkt.Newpath})
+	}
+
+	for _, c := range checks {
+		if err := rules.checkPath(c.op, clean(c.path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hides reports whether some of the rules hide paths.
+func (rules denyRules) hides() bool {
+	for _, rule := range rules {
+		if rule.Ops&DenyHide != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// listFilter returns filter, leaving out first the entries of the paths
+// the rules hide, which are made into those matched by clean.
+func (rules denyRules) listFilter(filter ListFilter, clean func(string) string) ListFilter {
+	if !rules.hides() {
+		return filter
+	}
+	return func(dir string, fi os.FileInfo) (os.FileInfo, bool) {
+		if rules.denied(DenyHide, clean(path.Join(dir, fi.Name()))) {
+			return nil, false
+		}
+		if filter == nil {
+			return fi, true
+		}
+		return filter(dir, fi)
+	}
+}
+
+// localDenyPath is the path of a local file name, as matched by the rules
+// of a Server.
+func localDenyPath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	return filepath.ToSlash(name)
+}
+
+// matchDenyPattern reports whether the slash separated path p matches the
+// pattern of a DenyRule.
+func matchDenyPattern(pattern, p string) (bool, error) {
+	if !strings.Contains(pattern, "/") {
+		return path.Match(pattern, path.Base(p))
+	}
+	return matchDenyElems(splitDenyPath(pattern), splitDenyPath(p))
+}
+
+func splitDenyPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func matchDenyElems(pattern, elems []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(elems) == 0, nil
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if ok, err := matchDenyElems(pattern[1:], elems[i:]); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	if len(elems) == 0 {
+		return false, nil
+	}
+	if ok, err := path.Match(pattern[0], elems[0]); !ok || err != nil {
+		return false, err
+	}
+	return matchDenyElems(pattern[1:], elems[1:])
+}
@@ -0,0 +1,180 @@
+package sftp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchDenyPattern(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, path string
+		ok            bool
+	}{
+		{"*.lock", "/a/b/c.lock", true},
+		{"*.lock", "/a/b.lock/c", false},
+		{"**/.ssh/*", "/home/user/.ssh/authorized_keys", true},
+		{"**/.ssh/*", "/.ssh/authorized_keys", true},
+		{"**/.ssh/*", "/home/user/.ssh", false},
+		{"**/.ssh/*", "/home/user/.ssh/sub/file", false},
+		{"/etc/**", "/etc/passwd", true},
+		{"/etc/**", "/etc", true},
+		{"/etc/**", "/var/etc/passwd", false},
+		{"home/*/public", "/home/user/public", true},
+		{"home/*/public", "/home/user/private", false},
+	} {
+		ok, err := matchDenyPattern(tt.pattern, tt.path)
+		require.NoError(t, err)
+		assert.Equal(t, tt.ok, ok, "%s %s", tt.pattern, tt.path)
+	}
+
+	assert.True(t, denyRules{{Pattern: "[", Ops: DenyRead}}.denied(DenyRead, "/file"))
+}
+
+func TestServerDenyRules(t *testing.T) {
+	_, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{}, WithDenyRules(DenyRule{Pattern: "a/[", Ops: DenyWrite}))
+	require.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "sftptest-deny")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, ".ssh"), 0755))
+	keys := filepath.Join(dir, ".ssh", "authorized_keys")
+	require.NoError(t, ioutil.WriteFile(keys, []byte("key"), 0644))
+	lock := filepath.Join(dir, "app.lock")
+	require.NoError(t, ioutil.WriteFile(lock, nil, 0644))
+
+	client, server := clientServerPair(t, WithDenyRules(
+		DenyRule{Pattern: "**/.ssh/*", Ops: DenyWrite},
+		DenyRule{Pattern: "*.lock", Ops: DenyDelete},
+	))
+	defer client.Close()
+	defer server.Close()
+
+	testDenyRules(t, client, keys, lock)
+}
+
+func TestRequestDenyRules(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+
+	require.NoError(t, p.cli.Mkdir("/.ssh"))
+	putTestFile(p.cli, "/.ssh/authorized_keys", "key")
+	putTestFile(p.cli, "/app.lock", "")
+	WithRSDenyRules(
+		DenyRule{Pattern: "**/.ssh/*", Ops: DenyWrite},
+		DenyRule{Pattern: "*.lock", Ops: DenyDelete},
+	)(p.svr)
+
+	testDenyRules(t, p.cli, "/.ssh/authorized_keys", "/app.lock")
+}
+
+func testDenyRules(t *testing.T, client *Client, keys, lock string) {
+	_, err := client.OpenFile(keys, os.O_WRONLY)
+	assert.True(t, os.IsPermission(err), err)
+	_, err = client.Create(keys + "2")
+	assert.True(t, os.IsPermission(err), err)
+	assert.True(t, os.IsPermission(client.Truncate(keys, 0)))
+	assert.True(t, os.IsPermission(client.Rename(lock, keys)))
+
+	// reads are allowed
+	f, err := client.Open(keys)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "key", string(data))
+	// but not setting the attributes of a file opened for reading
+	assert.True(t, os.IsPermission(f.Truncate(0)))
+	require.NoError(t, f.Close())
+
+	assert.True(t, os.IsPermission(client.Remove(lock)))
+	assert.True(t, os.IsPermission(client.Rename(lock, lock+".old")))
+	_, err = client.Stat(lock)
+	assert.NoError(t, err)
+
+	require.NoError(t, client.Remove(keys))
+}
+
+func TestDenyRulesExcept(t *testing.T) {
+	rules := denyRules{
+		{Pattern: "/incoming/**", Ops: DenyWrite | DenyDelete, Except: true},
+		{Pattern: "/incoming/*.done", Ops: DenyDelete},
+	}
+	assert.False(t, rules.denied(DenyWrite, "/incoming/file"))
+	assert.False(t, rules.denied(DenyDelete, "/incoming/file"))
+	assert.True(t, rules.denied(DenyDelete, "/incoming/file.done"))
+	assert.True(t, rules.denied(DenyWrite, "/outgoing/file"))
+	assert.True(t, rules.denied(DenyDelete, "/outgoing/file"))
+	assert.False(t, rules.denied(DenyRead, "/outgoing/file"))
+}
+
+var testHideRules = []DenyRule{
+	{Pattern: ".*", Ops: DenyHide},
+	{Pattern: "/secret/**", Ops: DenyHide},
+	{Pattern: "/pub/**", Ops: DenyWrite | DenyDelete, Except: true},
+}
+
+func TestServerDenyRulesHide(t *testing.T) {
+	skipIfWindows(t) // the jail resolves the links
+	skipIfPlan9(t)
+
+	dir, err := ioutil.TempDir("", "sftptest-deny")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"pub", "secret"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".hidden"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret", "key"), nil, 0644))
+
+	// the jail, for the rules to match the same paths as a RequestServer
+	client, server := clientServerPair(t, WithJail(dir), WithDenyRules(testHideRules...))
+	defer client.Close()
+	defer server.Close()
+
+	testDenyRulesHide(t, client)
+}
+
+func TestRequestDenyRulesHide(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+
+	require.NoError(t, p.cli.Mkdir("/pub"))
+	require.NoError(t, p.cli.Mkdir("/secret"))
+	putTestFile(p.cli, "/.hidden", "")
+	putTestFile(p.cli, "/secret/key", "")
+	WithRSDenyRules(testHideRules...)(p.svr)
+
+	testDenyRulesHide(t, p.cli)
+}
+
+func testDenyRulesHide(t *testing.T, client *Client) {
+	assert.Equal(t, []string{"pub"}, readDirNames(t, client, "/"))
+	_, err := client.Stat("/.hidden")
+	assert.True(t, os.IsNotExist(err), err)
+	_, err = client.Lstat("/secret")
+	assert.True(t, os.IsNotExist(err), err)
+	_, err = client.Open("/secret/key")
+	assert.True(t, os.IsNotExist(err), err)
+	_, err = client.ReadDir("/secret")
+	assert.True(t, os.IsNotExist(err), err)
+
+	// changes under /pub only
+	_, err = client.Create("/new")
+	assert.True(t, os.IsPermission(err), err)
+	assert.True(t, os.IsPermission(client.Mkdir("/dir")))
+	f, err := client.Create("/pub/new")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, []string{"new"}, readDirNames(t, client, "/pub"))
+	assert.True(t, os.IsPermission(client.Rename("/pub/new", "/new")))
+	require.NoError(t, client.Remove("/pub/new"))
+}
@@ -0,0 +1,199 @@
+package sftp
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A DialOption configures how Dial connects and authenticates.
+type DialOption func(*dialConfig)
+
+type dialConfig struct {
+	auth            []ssh.AuthMethod
+	hostKeyCallback ssh.HostKeyCallback
+	clientOptions   []ClientOption
+}
+
+// DialPassword authenticates with password, as does a password in the URL.
+func DialPassword(password string) DialOption {
+	return func(c *dialConfig) {
+		c.auth = append(c.auth, ssh.Password(password))
+	}
+}
+
+// DialPublicKeys authenticates with the keys of signers, such as the private
+// keys parsed by ssh.ParsePrivateKey.
+func DialPublicKeys(signers ...ssh.Signer) DialOption {
+	return func(c *dialConfig) {
+		c.auth = append(c.auth, ssh.PublicKeys(signers...))
+	}
+}
+
+// DialAgent authenticates with the keys of the ssh-agent listening on the
+// socket named by the SSH_AUTH_SOCK environment variable, if any.
+func DialAgent() DialOption {
+	return func(c *dialConfig) {
+		c.auth = append(c.auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			sock := os.Getenv("SSH_AUTH_SOCK")
+			if sock == "" {
+				return nil, nil
+			}
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			return agent.NewClient(conn).Signers()
+		}))
+	}
+}
+
+// DialHostKeyCallback verifies the host key of the server with callback,
+// instead of with the ~/.ssh/known_hosts file of the user.
+func DialHostKeyCallback(callback ssh.HostKeyCallback) DialOption {
+	return func(c *dialConfig) {
+		c.hostKeyCallback = callback
+	}
+}
+
+// DialClientOptions configures the Client with opts.
+func DialClientOptions(opts ...ClientOption) DialOption {
+	return func(c *dialConfig) {
+		c.clientOptions = append(c.clientOptions, opts...)
+	}
+}
+
+// Dial connects to the SSH server of the URL rawurl, of the form
+// sftp://[user[:password]@]host[:port][/path], and starts an SFTP session.
+// The user defaults to the current user, and the port to 22. The Client
+// is changed to the directory path, if any, an absolute path or, starting
+// with /~/, a path relative to the home directory of the user. Closing the
+// Client closes the SSH connection.
+//
+// The host key of the server is checked against the ~/.ssh/known_hosts file of
+// the user, unless DialHostKeyCallback is given. The authentication methods
+// are those given as options, tried in turn, then the password of the URL.
+//
+// ctx bounds connecting, authenticating and starting the session only.
+func Dial(ctx context.Context, rawurl string, opts ...DialOption) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "sftp" {
+		return nil, errors.Errorf("sftp: unsupported URL scheme %q", u.Scheme)
+	}
+
+	var cfg dialConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	config := &ssh.ClientConfig{
+		Auth:            cfg.auth,
+		HostKeyCallback: cfg.hostKeyCallback,
+	}
+	if u.User != nil {
+		// ignore the connection parameters following the user name
+		config.User = strings.SplitN(u.User.Username(), ";", 2)[0]
+		if password, ok := u.User.Password(); ok {
+			config.Auth = append(config.Auth, ssh.Password(password))
+		}
+	}
+	if config.User == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		config.User = current.Username
+	}
+	if config.HostKeyCallback == nil {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		if config.HostKeyCallback, err = knownhosts.New(filepath.Join(home, ".ssh", "known_hosts")); err != nil {
+			return nil, err
+		}
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	var dir string
+	switch p := u.Path; {
+	case p == "/~" || strings.HasPrefix(p, "/~/"):
+		dir = strings.TrimPrefix(strings.TrimPrefix(p, "/~"), "/")
+	case p != "/":
+		dir = p
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// interrupt the handshakes once ctx is done
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	c, err := dialClient(nc, addr, config, cfg.clientOptions, dir)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		if c != nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	return c, err
+}
+
+// dialClient starts an SFTP session over the SSH connection on nc.
+func dialClient(nc net.Conn, addr string, config *ssh.ClientConfig, opts []ClientOption, dir string) (*Client, error) {
+	sc, chans, reqs, err := ssh.NewClientConn(nc, addr, config)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	conn := ssh.NewClient(sc, chans, reqs)
+
+	c, err := NewClient(conn, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.sshConn = conn
+
+	if dir != "" {
+		if err := c.Chdir(dir); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,98 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialTestServer serves SFTP over SSH on a local port.
+func dialTestServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				svr, err := sshServerFromConn(conn, true, basicServerConfig())
+				if err != nil {
+					return
+				}
+				svr.Wait()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDial(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	l := dialTestServer(t)
+	defer l.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-dial")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	require.NoError(t, err)
+
+	hostKey := DialHostKeyCallback(ssh.FixedHostKey(hostPrivateKeySigner.PublicKey()))
+	url := fmt.Sprintf("sftp://user:password@%s%s", l.Addr(), dir)
+
+	c, err := Dial(context.Background(), url, hostKey)
+	require.NoError(t, err)
+	wd, err := c.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, dir, wd)
+
+	// relative paths are resolved against the directory of the URL
+	f, err := c.Create("file")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, c.Mkdir("sub"))
+	require.NoError(t, c.Chdir("sub"))
+	require.NoError(t, c.Rename("../file", "moved"))
+	_, err = os.Stat(filepath.Join(dir, "sub", "moved"))
+	assert.NoError(t, err)
+	assert.Error(t, c.Chdir("moved"))
+	require.NoError(t, c.Close())
+
+	_, err = Dial(context.Background(), fmt.Sprintf("sftp://user:password@%s%s", l.Addr(), filepath.Join(dir, "missing")), hostKey)
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	_, err = Dial(context.Background(), url, DialHostKeyCallback(ssh.FixedHostKey(testOtherHostKey(t))))
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Dial(ctx, url, hostKey)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = Dial(context.Background(), "ssh://"+l.Addr().String(), hostKey)
+	assert.Error(t, err)
+}
+
+func testOtherHostKey(t *testing.T) ssh.PublicKey {
+	key, err := makeDummyKey()
+	require.NoError(t, err)
+	defer os.Remove(key)
+	b, err := ioutil.ReadFile(key)
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(b)
+	require.NoError(t, err)
+	return signer.PublicKey()
+}
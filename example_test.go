@@ -96,6 +96,51 @@ func ExampleNewClientPipe() {
 	client.Close()
 }
 
+func ExampleWithConnConfig() {
+	var sconn *ssh.ServerConn // an accepted ssh connection
+	var channel ssh.Channel   // a channel of sconn, requesting the sftp subsystem
+
+	// guests have read-only access, other users are refused
+	config := func(meta ssh.ConnMetadata) ([]sftp.ServerOption, error) {
+		switch meta.User() {
+		case "admin":
+			return nil, nil
+		case "guest":
+			return []sftp.ServerOption{sftp.ReadOnly()}, nil
+		}
+		return nil, fmt.Errorf("user %q from %v is not allowed", meta.User(), meta.RemoteAddr())
+	}
+
+	server, err := sftp.NewServer(channel, sftp.WithConnConfig(sconn, config))
+	if err != nil {
+		log.Print(err)
+		channel.Close()
+		return
+	}
+	if err := server.Serve(); err != io.EOF {
+		log.Print(err)
+	}
+	server.Close()
+}
+
+func ExampleMountHandlers() {
+	var channel ssh.Channel  // a channel requesting the sftp subsystem
+	var store sftp.BlobStore // an object store, to archive files into
+
+	// "/" lists "archive" and "tmp", and files cannot be renamed from one
+	// to the other
+	handlers := sftp.MountHandlers(map[string]sftp.Handlers{
+		"/archive": sftp.BlobStoreHandler(store),
+		"/tmp":     sftp.InMemHandler(),
+	})
+
+	server := sftp.NewRequestServer(channel, handlers)
+	if err := server.Serve(); err != io.EOF {
+		log.Print(err)
+	}
+	server.Close()
+}
+
 func ExampleClient_Mkdir_parents() {
 	// Example of mimicing 'mkdir --parents'; I.E. recursively create
 	// directoryies and don't error if any directories already exists.
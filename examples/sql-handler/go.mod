@@ -0,0 +1,13 @@
+module github.com/pkg/sftp/examples/sql-handler
+
+go 1.15
+
+require (
+	github.com/lib/pq v1.10.2
+	github.com/pkg/sftp v1.13.0
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
+	modernc.org/sqlite v1.10.6
+)
+
+replace github.com/pkg/sftp => ../..
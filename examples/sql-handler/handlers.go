@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// chunkSize is the size of the chunks the contents of the files are stored by.
+const chunkSize = 64 << 10
+
+// schema stores the files by their absolute path, along with the path of their
+// parent directory to list it, and their contents by chunks. The types are
+// replaced by those of the dialect.
+const schema = `
+CREATE TABLE IF NOT EXISTS files (
+	id     {{id}},
+	path   TEXT NOT NULL UNIQUE,
+	parent TEXT NOT NULL,
+	is_dir INTEGER NOT NULL,
+	size   BIGINT NOT NULL DEFAULT 0,
+	mode   INTEGER NOT NULL,
+	mtime  BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_parent ON files (parent);
+CREATE TABLE IF NOT EXISTS chunks (
+	file_id BIGINT NOT NULL,
+	idx     BIGINT NOT NULL,
+	data    {{blob}} NOT NULL,
+	PRIMARY KEY (file_id, idx)
+);
+`
+
+// dialect adapts the statements, written with ? placeholders in the SQL
+// common to SQLite and PostgreSQL, to a database.
+type dialect struct {
+	// id and blob are the types of the ids of the files, generated by the
+	// database, and of their chunks.
+	id, blob string
+	// numbered tells whether the placeholders are numbered, as $1.
+	numbered bool
+}
+
+var dialects = map[string]*dialect{
+	"sqlite":   {id: "INTEGER PRIMARY KEY", blob: "BLOB"},
+	"postgres": {id: "BIGSERIAL PRIMARY KEY", blob: "BYTEA", numbered: true},
+}
+
+func (d *dialect) schema() string {
+	return strings.NewReplacer("{{id}}", d.id, "{{blob}}", d.blob).Replace(schema)
+}
+
+// rebind replaces the ? placeholders of query with those of the dialect.
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for {
+		i := strings.IndexByte(query, '?')
+		if i < 0 {
+			b.WriteString(query)
+			return b.String()
+		}
+		n++
+		b.WriteString(query[:i])
+		b.WriteString("$" + strconv.Itoa(n))
+		query = query[i+1:]
+	}
+}
+
+// sqlHandler serves files stored in a SQL database, SQLite or PostgreSQL.
+//
+// Renames and removals are transactions: a directory is renamed along with
+// all its contents, or not at all. Each write is a transaction too, updating
+// the chunks it covers, so files can be written at any offset. The writes
+// and truncations of a file update its row first, which locks it until they
+// are committed where the database locks rows, so that they do not
+// interleave.
+type sqlHandler struct {
+	db *sql.DB
+	d  *dialect
+}
+
+// newSQLHandlers creates the schema in db if needed, and returns Handlers
+// serving it. driver is the name of the driver of db, "sqlite" or "postgres".
+func newSQLHandlers(db *sql.DB, driver string) (sftp.Handlers, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return sftp.Handlers{}, fmt.Errorf("unsupported database driver %q", driver)
+	}
+	if _, err := db.Exec(d.schema()); err != nil {
+		return sftp.Handlers{}, err
+	}
+	// the root directory
+	if _, err := db.Exec(d.rebind(`INSERT INTO files (path, parent, is_dir, mode, mtime)
+		VALUES ('/', '', 1, ?, ?) ON CONFLICT (path) DO NOTHING`),
+		0755, time.Now().Unix()); err != nil {
+		return sftp.Handlers{}, err
+	}
+
+	h := &sqlHandler{db: db, d: d}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}, nil
+}
+
+var (
+	_ sftp.OpenFileWriter       = (*sqlHandler)(nil)
+	_ sftp.PosixRenameFileCmder = (*sqlHandler)(nil)
+)
+
+func notExist(p string) error {
+	return &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+}
+
+// querier is a *sql.DB or a *sql.Tx.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// conn runs the statements on a querier, rebound for the dialect.
+type conn struct {
+	q querier
+	d *dialect
+}
+
+func (c conn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRowContext(ctx, c.d.rebind(query), args...)
+}
+
+func (c conn) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.QueryContext(ctx, c.d.rebind(query), args...)
+}
+
+func (c conn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return c.q.ExecContext(ctx, c.d.rebind(query), args...)
+}
+
+// conn returns the conn of the database, outside of transactions.
+func (h *sqlHandler) conn() conn {
+	return conn{h.db, h.d}
+}
+
+// boolInt stores booleans as integers, in SQLite and PostgreSQL alike.
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fileInfo is a row of the files table.
+type fileInfo struct {
+	id    int64
+	path  string
+	dir   bool
+	size  int64
+	mode  uint32
+	mtime int64
+}
+
+func (fi *fileInfo) Name() string       { return path.Base(fi.path) }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(fi.mtime, 0) }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.mode).Perm()
+	if fi.dir {
+		mode |= os.ModeDir
+	}
+	return mode
+}
+
+const fileColumns = `id, path, is_dir, size, mode, mtime`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFile(row scanner) (*fileInfo, error) {
+	fi := new(fileInfo)
+	err := row.Scan(&fi.id, &fi.path, &fi.dir, &fi.size, &fi.mode, &fi.mtime)
+	return fi, err
+}
+
+func stat(ctx context.Context, q querier, p string) (*fileInfo, error) {
+	fi, err := scanFile(q.QueryRowContext(ctx, `SELECT `+fileColumns+` FROM files WHERE path = ?`, p))
+	if err == sql.ErrNoRows {
+		return nil, notExist(p)
+	}
+	return fi, err
+}
+
+// inTx runs fn in a transaction, committed if fn succeeds.
+func (h *sqlHandler) inTx(ctx context.Context, fn func(tx conn) error) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(conn{tx, h.d}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (h *sqlHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	fi, err := stat(r.Context(), h.conn(), r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.dir {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return &file{h: h, id: fi.id}, nil
+}
+
+func (h *sqlHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.open(r)
+}
+
+func (h *sqlHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.open(r)
+}
+
+func (h *sqlHandler) open(r *sftp.Request) (*file, error) {
+	pflags := r.Pflags()
+	var id int64
+	err := h.inTx(r.Context(), func(tx conn) error {
+		fi, err := stat(r.Context(), tx, r.Filepath)
+		switch {
+		case err == nil && fi.dir:
+			return sftp.ErrSSHFxFailure
+		case err == nil && pflags.Creat && pflags.Excl:
+			return os.ErrExist
+		case err == nil:
+			id = fi.id
+			if pflags.Trunc {
+				return truncate(r.Context(), tx, id, 0)
+			}
+			return nil
+		case !os.IsNotExist(err) || !pflags.Creat:
+			return err
+		}
+
+		id, err = create(r.Context(), tx, r.Filepath, false, 0644)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &file{h: h, id: id}, nil
+}
+
+// create inserts a file, or a directory, in its parent directory.
+func create(ctx context.Context, q querier, p string, dir bool, mode uint32) (int64, error) {
+	parent, err := stat(ctx, q, path.Dir(p))
+	if err != nil {
+		return 0, err
+	}
+	if !parent.dir {
+		return 0, sftp.ErrSSHFxFailure
+	}
+	// RETURNING rather than LastInsertId, which PostgreSQL does not have
+	var id int64
+	err = q.QueryRowContext(ctx, `INSERT INTO files (path, parent, is_dir, mode, mtime) VALUES (?, ?, ?, ?, ?) RETURNING id`,
+		p, parent.path, boolInt(dir), mode, time.Now().Unix()).Scan(&id)
+	return id, err
+}
+
+// truncate changes the size of the file id, dropping the chunks beyond it.
+func truncate(ctx context.Context, q querier, id, size int64) error {
+	if _, err := q.ExecContext(ctx, `UPDATE files SET size = ?, mtime = ? WHERE id = ?`, size, time.Now().Unix(), id); err != nil {
+		return err
+	}
+	last := (size + chunkSize - 1) / chunkSize // index of the first chunk dropped
+	if _, err := q.ExecContext(ctx, `DELETE FROM chunks WHERE file_id = ? AND idx >= ?`, id, last); err != nil {
+		return err
+	}
+	if size%chunkSize != 0 {
+		// cut the last chunk kept
+		if _, err := q.ExecContext(ctx, `UPDATE chunks SET data = substr(data, 1, ?) WHERE file_id = ? AND idx = ?`,
+			size%chunkSize, id, last-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// file is an open file, identified by its id so that it survives renames.
+type file struct {
+	h  *sqlHandler
+	id int64
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	ctx := context.Background()
+	sqlTx, err := f.h.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer sqlTx.Rollback()
+	tx := conn{sqlTx, f.h.d}
+
+	var size int64
+	if err := tx.QueryRowContext(ctx, `SELECT size FROM files WHERE id = ?`, f.id).Scan(&size); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, os.ErrNotExist
+		}
+		return 0, err
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := len(b)
+	if int64(n) > size-off {
+		n = int(size - off)
+	}
+
+	// chunks never written, in sparse files, read as zeroes
+	for i := range b[:n] {
+		b[i] = 0
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT idx, data FROM chunks WHERE file_id = ? AND idx BETWEEN ? AND ?`,
+		f.id, off/chunkSize, (off+int64(n)-1)/chunkSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var idx int64
+		var data []byte
+		if err := rows.Scan(&idx, &data); err != nil {
+			return 0, err
+		}
+		start := idx * chunkSize // offset of the chunk in the file
+		if start < off {
+			if skip := off - start; skip < int64(len(data)) {
+				copy(b[:n], data[skip:])
+			}
+		} else {
+			copy(b[start-off:n], data)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	ctx := context.Background()
+	err := f.h.inTx(ctx, func(tx conn) error {
+		end := off + int64(len(b))
+		res, err := tx.ExecContext(ctx, `UPDATE files SET size = CASE WHEN size < ? THEN ? ELSE size END, mtime = ? WHERE id = ?`,
+			end, end, time.Now().Unix(), f.id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			// removed while open
+			return os.ErrNotExist
+		}
+
+		for done := 0; done < len(b); {
+			pos := off + int64(done)
+			idx, start := pos/chunkSize, int(pos%chunkSize)
+			n := chunkSize - start
+			if n > len(b)-done {
+				n = len(b) - done
+			}
+
+			var data []byte
+			err := tx.QueryRowContext(ctx, `SELECT data FROM chunks WHERE file_id = ? AND idx = ?`, f.id, idx).Scan(&data)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if len(data) < start+n {
+				data = append(data, make([]byte, start+n-len(data))...)
+			}
+			copy(data[start:], b[done:done+n])
+
+			if err == sql.ErrNoRows {
+				_, err = tx.ExecContext(ctx, `INSERT INTO chunks (file_id, idx, data) VALUES (?, ?, ?)`, f.id, idx, data)
+			} else {
+				_, err = tx.ExecContext(ctx, `UPDATE chunks SET data = ? WHERE file_id = ? AND idx = ?`, data, f.id, idx)
+			}
+			if err != nil {
+				return err
+			}
+			done += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+type listerat []os.FileInfo
+
+func (l listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *sqlHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	ctx := r.Context()
+	switch r.Method {
+	case "List":
+		dir, err := stat(ctx, h.conn(), r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		if !dir.dir {
+			return nil, sftp.ErrSSHFxFailure
+		}
+		rows, err := h.conn().QueryContext(ctx, `SELECT `+fileColumns+` FROM files WHERE parent = ? ORDER BY path`, dir.path)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var fis listerat
+		for rows.Next() {
+			fi, err := scanFile(rows)
+			if err != nil {
+				return nil, err
+			}
+			fis = append(fis, fi)
+		}
+		return fis, rows.Err()
+	case "Stat", "Lstat":
+		fi, err := stat(ctx, h.conn(), r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerat{fi}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sqlHandler) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		return h.inTx(ctx, func(tx conn) error {
+			return setstat(ctx, tx, r)
+		})
+	case "Rename":
+		return h.inTx(ctx, func(tx conn) error {
+			if _, err := stat(ctx, tx, r.Target); err == nil {
+				return os.ErrExist
+			}
+			return rename(ctx, tx, r.Filepath, r.Target)
+		})
+	case "Mkdir":
+		return h.inTx(ctx, func(tx conn) error {
+			if _, err := stat(ctx, tx, r.Filepath); err == nil {
+				return os.ErrExist
+			}
+			_, err := create(ctx, tx, r.Filepath, true, 0755)
+			return err
+		})
+	case "Rmdir", "Remove":
+		return h.inTx(ctx, func(tx conn) error {
+			fi, err := stat(ctx, tx, r.Filepath)
+			if err != nil {
+				return err
+			}
+			if fi.dir != (r.Method == "Rmdir") || fi.path == "/" {
+				return sftp.ErrSSHFxFailure
+			}
+			return remove(ctx, tx, fi)
+		})
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename renames as Rename does, replacing the target if it is a file
+// or an empty directory, in a single transaction.
+func (h *sqlHandler) PosixRename(r *sftp.Request) error {
+	ctx := r.Context()
+	return h.inTx(ctx, func(tx conn) error {
+		target, err := stat(ctx, tx, r.Target)
+		switch {
+		case err == nil:
+			if err := remove(ctx, tx, target); err != nil {
+				return err
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+		return rename(ctx, tx, r.Filepath, r.Target)
+	})
+}
+
+// remove removes a file with its chunks, or an empty directory.
+func remove(ctx context.Context, tx conn, fi *fileInfo) error {
+	if fi.dir {
+		var children int
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM files WHERE parent = ?`, fi.path).Scan(&children); err != nil {
+			return err
+		}
+		if children > 0 {
+			return sftp.ErrSSHFxFailure
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chunks WHERE file_id = ?`, fi.id); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM files WHERE id = ?`, fi.id)
+	return err
+}
+
+// rename renames the file at oldpath, and all the files under it if it is a directory.
+func rename(ctx context.Context, tx conn, oldpath, newpath string) error {
+	fi, err := stat(ctx, tx, oldpath)
+	if err != nil {
+		return err
+	}
+	if fi.path == "/" || (fi.dir && len(newpath) > len(oldpath) && newpath[:len(oldpath)+1] == oldpath+"/") {
+		// cannot move a directory into itself
+		return sftp.ErrSSHFxFailure
+	}
+	parent, err := stat(ctx, tx, path.Dir(newpath))
+	if err != nil {
+		return err
+	}
+	if !parent.dir {
+		return sftp.ErrSSHFxFailure
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE files SET path = ?, parent = ? WHERE id = ?`,
+		newpath, parent.path, fi.id); err != nil {
+		return err
+	}
+	if !fi.dir {
+		return nil
+	}
+
+	// the paths under the directory start with oldpath + "/",
+	// compared with substr rather than LIKE not to escape the paths
+	prefix := oldpath + "/"
+	if _, err := tx.ExecContext(ctx, `UPDATE files SET path = ? || substr(path, ?) WHERE substr(path, 1, ?) = ?`,
+		newpath+"/", len(prefix)+1, len(prefix), prefix); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE files SET parent = ? || substr(parent, ?) WHERE parent = ? OR substr(parent, 1, ?) = ?`,
+		newpath, len(oldpath)+1, oldpath, len(prefix), prefix)
+	return err
+}
+
+func setstat(ctx context.Context, tx conn, r *sftp.Request) error {
+	fi, err := stat(ctx, tx, r.Filepath)
+	if err != nil {
+		return err
+	}
+	attrs, flags := r.Attributes(), r.AttrFlags()
+
+	if flags.Size {
+		if fi.dir {
+			return sftp.ErrSSHFxFailure
+		}
+		if err := truncate(ctx, tx, fi.id, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if _, err := tx.ExecContext(ctx, `UPDATE files SET mode = ? WHERE id = ?`, attrs.Mode&0777, fi.id); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if _, err := tx.ExecContext(ctx, `UPDATE files SET mtime = ? WHERE id = ?`, attrs.Mtime, fi.id); err != nil {
+			return err
+		}
+	}
+	// owners are not stored
+	return nil
+}
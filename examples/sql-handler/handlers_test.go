@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"io"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/pkg/sftp"
+	"github.com/pkg/sftp/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+var testPostgres = flag.String("postgres", "", "run the tests against the PostgreSQL database of this connection string, whose tables are dropped")
+
+// newTestHandlers returns Handlers serving an empty database: a SQLite
+// database in memory, or the PostgreSQL one of the -postgres flag.
+func newTestHandlers(t *testing.T) (sftp.Handlers, *sql.DB) {
+	driver, dsn := "sqlite", ":memory:"
+	if *testPostgres != "" {
+		driver, dsn = "postgres", *testPostgres
+	}
+	db, err := sql.Open(driver, dsn)
+	require.NoError(t, err)
+	if driver == "sqlite" {
+		// each connection would open another database in memory
+		db.SetMaxOpenConns(1)
+	} else {
+		_, err = db.Exec(`DROP TABLE IF EXISTS files, chunks`)
+		require.NoError(t, err)
+	}
+	handlers, err := newSQLHandlers(db, driver)
+	require.NoError(t, err)
+	return handlers, db
+}
+
+// clientSQLPair returns a client of a request server serving an empty database.
+func clientSQLPair(t *testing.T) (*sftp.Client, *sql.DB) {
+	handlers, db := newTestHandlers(t)
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, handlers)
+	go server.Serve()
+	client, err := sftp.NewClientPipe(cr, cw)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client, db
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func writeFile(t *testing.T, client *sftp.Client, name string, data []byte) {
+	f, err := client.Create(name)
+	require.NoError(t, err)
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func readFile(t *testing.T, client *sftp.Client, name string) []byte {
+	f, err := client.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	var buf bytes.Buffer
+	_, err = f.WriteTo(&buf)
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+func TestTransfers(t *testing.T) {
+	client, db := clientSQLPair(t)
+
+	data := testData(5*chunkSize + 100)
+	writeFile(t, client, "/file", data)
+	assert.Equal(t, data, readFile(t, client, "/file"))
+
+	var chunks int
+	require.NoError(t, db.QueryRow(`SELECT count(*) FROM chunks`).Scan(&chunks))
+	assert.Equal(t, 6, chunks)
+
+	fi, err := client.Stat("/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), fi.Size())
+
+	// overwrite in the middle, across chunks
+	f, err := client.OpenFile("/file", os.O_RDWR)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("hello"), chunkSize-2)
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = f.ReadAt(buf, chunkSize-2)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	require.NoError(t, f.Close())
+
+	// extend past the end, leaving a hole read as zeroes
+	f, err = client.OpenFile("/file", os.O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("end"), 8*chunkSize)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	got := readFile(t, client, "/file")
+	require.Len(t, got, 8*chunkSize+3)
+	assert.Equal(t, make([]byte, 8*chunkSize-len(data)), got[len(data):8*chunkSize])
+
+	require.NoError(t, client.Truncate("/file", chunkSize+10))
+	assert.Equal(t, data[:chunkSize-2], readFile(t, client, "/file")[:chunkSize-2])
+	fi, err = client.Stat("/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(chunkSize+10), fi.Size())
+	require.NoError(t, db.QueryRow(`SELECT count(*) FROM chunks`).Scan(&chunks))
+	assert.Equal(t, 2, chunks)
+
+	_, err = client.Open("/missing")
+	assert.True(t, os.IsNotExist(err))
+	_, err = client.Create("/missing/file")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCommands(t *testing.T) {
+	client, db := clientSQLPair(t)
+
+	require.NoError(t, client.MkdirAll("/a/sub"))
+	writeFile(t, client, "/a/one", []byte("1"))
+	writeFile(t, client, "/a/sub/two", []byte("22"))
+	writeFile(t, client, "/top", []byte("333"))
+
+	names := func(dir string) []string {
+		fis, err := client.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"a", "top"}, names("/"))
+	assert.Equal(t, []string{"one", "sub"}, names("/a"))
+
+	assert.Error(t, client.Mkdir("/a"))
+	assert.Error(t, client.RemoveDirectory("/a"), "not empty")
+	assert.Error(t, client.Rename("/top", "/a/one"), "target exists")
+	assert.Error(t, client.Rename("/a", "/a/sub/a"), "into itself")
+
+	// the directory is renamed with all its contents
+	require.NoError(t, client.Rename("/a", "/b"))
+	assert.Equal(t, []string{"b", "top"}, names("/"))
+	assert.Equal(t, []string{"two"}, names("/b/sub"))
+	assert.Equal(t, []byte("22"), readFile(t, client, "/b/sub/two"))
+	_, err := client.Stat("/a/sub/two")
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, client.PosixRename("/top", "/b/one"))
+	assert.Equal(t, []byte("333"), readFile(t, client, "/b/one"))
+	assert.Error(t, client.PosixRename("/b/one", "/b/sub"), "target not empty")
+
+	require.NoError(t, client.Chmod("/b/one", 0600))
+	fi, err := client.Stat("/b/one")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode())
+
+	assert.Error(t, client.Remove("/b/sub"), "Remove of a directory")
+	require.NoError(t, client.Remove("/b/one"))
+	_, err = client.Stat("/b/one")
+	assert.True(t, os.IsNotExist(err))
+
+	// the chunks of the removed and replaced files are gone
+	var chunks int
+	require.NoError(t, db.QueryRow(`SELECT count(*) FROM chunks`).Scan(&chunks))
+	assert.Equal(t, 1, chunks)
+
+	assert.Error(t, client.Symlink("/b/sub/two", "/link"))
+}
+
+func TestConformance(t *testing.T) {
+	handlertest.TestHandlers(t, func() sftp.Handlers {
+		handlers, _ := newTestHandlers(t)
+		return handlers
+	})
+}
+
+func TestRebind(t *testing.T) {
+	const query = `UPDATE files SET path = ? || substr(path, ?) WHERE id = ?`
+	assert.Equal(t, query, dialects["sqlite"].rebind(query))
+	assert.Equal(t, `UPDATE files SET path = $1 || substr(path, $2) WHERE id = $3`, dialects["postgres"].rebind(query))
+}
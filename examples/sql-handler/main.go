@@ -0,0 +1,120 @@
+// An example SFTP server storing its files in a SQLite or PostgreSQL database,
+// through database/sql.
+// Has a hard-coded username and password, so not for real use!
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+
+	_ "github.com/lib/pq"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	_ "modernc.org/sqlite"
+)
+
+func main() {
+	var (
+		driver  string
+		dbPath  string
+		keyPath string
+		listen  string
+	)
+
+	flag.StringVar(&driver, "driver", "sqlite", `database driver, "sqlite" or "postgres"`)
+	flag.StringVar(&dbPath, "db", "sftp.db", "database storing the files, a SQLite file or a PostgreSQL connection string")
+	flag.StringVar(&keyPath, "key", "id_rsa", "host key")
+	flag.StringVar(&listen, "listen", "0.0.0.0:2022", "address to listen on")
+	flag.Parse()
+
+	db, err := sql.Open(driver, dbPath)
+	if err != nil {
+		log.Fatal("failed to open database: ", err)
+	}
+	defer db.Close()
+	if driver == "sqlite" {
+		// SQLite allows a single writer at a time
+		db.SetMaxOpenConns(1)
+	}
+
+	handlers, err := newSQLHandlers(db, driver)
+	if err != nil {
+		log.Fatal("failed to create the schema: ", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "testuser" && string(pass) == "tiger" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		},
+	}
+
+	privateBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		log.Fatal("Failed to load private key: ", err)
+	}
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		log.Fatal("Failed to parse private key: ", err)
+	}
+	config.AddHostKey(private)
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatal("failed to listen for connection: ", err)
+	}
+	log.Printf("Listening on %v", listener.Addr())
+
+	for {
+		nConn, err := listener.Accept()
+		if err != nil {
+			log.Fatal("failed to accept incoming connection: ", err)
+		}
+		go serve(nConn, config, handlers)
+	}
+}
+
+func serve(nConn net.Conn, config *ssh.ServerConfig, handlers sftp.Handlers) {
+	sconn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+	if err != nil {
+		log.Print("failed to handshake: ", err)
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Print("could not accept channel: ", err)
+			return
+		}
+
+		// only the sftp subsystem is served
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}(requests)
+
+		go func() {
+			server := sftp.NewRequestServer(channel, handlers)
+			if err := server.Serve(); err != nil && err != io.EOF {
+				log.Print("sftp server completed with error: ", err)
+			}
+			server.Close()
+		}()
+	}
+}
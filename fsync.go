@@ -0,0 +1,72 @@
+package sftp
+
+import "context"
+
+// fsyncExtension flushes an open file to stable storage, as specified by
+// the PROTOCOL file of OpenSSH.
+const fsyncExtension = "fsync@openssh.com"
+
+type sshFxpExtendedPacketFsync struct {
+	ID              uint32
+	ExtendedRequest string
+	Handle          string
+}
+
+func (p *sshFxpExtendedPacketFsync) id() uint32     { return p.ID }
+func (p *sshFxpExtendedPacketFsync) readonly() bool { return false }
+func (p *sshFxpExtendedPacketFsync) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.ExtendedRequest, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Handle, _, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *sshFxpExtendedPacketFsync) respond(s *Server) responsePacket {
+	f, ok := s.getServerFile(p.Handle)
+	if !ok {
+		return statusFromError(p.ID, EBADF)
+	}
+
+	f.mu.Lock()
+	pending := f.pendingWrites
+	f.mu.Unlock()
+
+	// the writes acknowledged early are flushed too
+	if err := pending.wait(); err != nil {
+		return statusFromError(p.ID, err)
+	}
+	return statusFromError(p.ID, f.Sync())
+}
+
+// fsync serves fsync@openssh.com for the request of the handle, with the
+// FsyncFileCmder of the Handlers, or else the Sync method of the object
+// opened for writing.
+func (rs *RequestServer) fsync(ctx context.Context, p *sshFxpExtendedPacketFsync) error {
+	request, ok := rs.getRequest(p.Handle)
+	if !ok {
+		return EBADF
+	}
+
+	request.state.RLock()
+	pending := request.state.pendingWrites
+	request.state.RUnlock()
+	if err := pending.wait(); err != nil {
+		return err
+	}
+
+	if syncer, ok := rs.Handlers.FileCmd.(FsyncFileCmder); ok {
+		err := handleRequest(NewRequest("Fsync", request.Filepath).WithContext(ctx), syncer.Fsync)
+		if err != ErrSSHFxOpUnsupported {
+			return err
+		}
+	}
+	if syncer, ok := request.writerAt().(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return ErrSSHFxOpUnsupported
+}
@@ -0,0 +1,77 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerFsync(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t, WithAsyncWrites())
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-fsync")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, ok := client.HasExtension(fsyncExtension)
+	assert.True(t, ok)
+
+	f, err := client.Create(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(b))
+}
+
+// fsyncCmder records the files synced.
+type fsyncCmder struct {
+	FileCmder
+	synced []string
+}
+
+func (c *fsyncCmder) Fsync(r *Request) error {
+	c.synced = append(c.synced, r.Filepath+" "+r.Method)
+	return nil
+}
+
+func TestRequestServerFsync(t *testing.T) {
+	h := InMemHandler()
+	cmder := &fsyncCmder{FileCmder: h.FileCmd}
+	for _, tt := range []struct {
+		name string
+		cmd  FileCmder
+		err  bool
+	}{
+		{"FsyncFileCmder", cmder, false},
+		{"FileCmder", struct{ FileCmder }{h.FileCmd}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := handlersClientPair(t, Handlers{h.FileGet, h.FilePut, tt.cmd, h.FileList}, nil)
+
+			f, err := client.Create("/file")
+			require.NoError(t, err)
+			defer f.Close()
+			err = f.Sync()
+			if tt.err {
+				// the InMemHandler files cannot be synced
+				assert.Equal(t, ErrSSHFxOpUnsupported, err.(*StatusError).FxCode())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, []string{"/file Fsync"}, cmder.synced)
+		})
+	}
+}
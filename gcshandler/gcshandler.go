@@ -0,0 +1,141 @@
+// Package gcshandler serves the objects of a Google Cloud Storage bucket
+// through the request server of the sftp package.
+//
+// The bucket is served by sftp.BlobStoreHandler, through the sftp.BlobStore
+// returned by NewStore: objects are exposed as files, with the slashes of
+// their names separating directories, uploads are streamed to GCS as
+// resumable uploads, and reads are served by ranged reads. See
+// sftp.BlobStoreHandler for what such files support.
+//
+// It lives in its own module, so that the sftp package does not depend on the
+// Google Cloud SDK.
+package gcshandler
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/sftp"
+	"google.golang.org/api/iterator"
+)
+
+// An Option configures the store returned by NewStore.
+type Option func(*store)
+
+// WithPrefix serves the objects whose names start with prefix, the prefix
+// being the root directory. A slash is appended to prefix if missing.
+func WithPrefix(prefix string) Option {
+	return func(s *store) {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		s.prefix = prefix
+	}
+}
+
+// WithChunkSize sets the size of the chunks of the uploads, each upload
+// buffering a chunk in memory. It defaults to the ChunkSize of
+// storage.Writer; 0 uploads each object in a single request, which buffers
+// nothing but cannot be retried.
+func WithChunkSize(n int) Option {
+	return func(s *store) {
+		if n >= 0 {
+			s.chunkSize = &n
+		}
+	}
+}
+
+// New returns the Handlers serving the objects of bucket.
+func New(bucket *storage.BucketHandle, options ...Option) sftp.Handlers {
+	return sftp.BlobStoreHandler(NewStore(bucket, options...))
+}
+
+// NewStore returns the sftp.BlobStore of the objects of bucket, whose keys
+// are the names of the objects without the prefix set by WithPrefix.
+func NewStore(bucket *storage.BucketHandle, options ...Option) sftp.BlobStore {
+	s := &store{bucket: bucket}
+	for _, o := range options {
+		o(s)
+	}
+	return s
+}
+
+type store struct {
+	bucket    *storage.BucketHandle
+	prefix    string
+	chunkSize *int
+}
+
+// notExist returns os.ErrNotExist for the objects missing, which
+// sftp.BlobStoreHandler expects.
+func notExist(err error) error {
+	if err == storage.ErrObjectNotExist {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (s *store) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	rd, err := s.bucket.Object(s.prefix+key).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	return rd, nil
+}
+
+func (s *store) Put(ctx context.Context, key string, r io.Reader) error {
+	// an upload canceled is not stored
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := s.bucket.Object(s.prefix + key).NewWriter(ctx)
+	if s.chunkSize != nil {
+		w.ChunkSize = *s.chunkSize
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *store) List(ctx context.Context, prefix string) ([]sftp.BlobInfo, error) {
+	var blobs []sftp.BlobInfo
+	// the iterator fetches the pages of the listing as they are needed
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.prefix + prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return blobs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, s.blobInfo(attrs))
+	}
+}
+
+func (s *store) Delete(ctx context.Context, key string) error {
+	return notExist(s.bucket.Object(s.prefix + key).Delete(ctx))
+}
+
+func (s *store) Stat(ctx context.Context, key string) (sftp.BlobInfo, error) {
+	attrs, err := s.bucket.Object(s.prefix + key).Attrs(ctx)
+	if err != nil {
+		return sftp.BlobInfo{}, notExist(err)
+	}
+	return s.blobInfo(attrs), nil
+}
+
+func (s *store) blobInfo(attrs *storage.ObjectAttrs) sftp.BlobInfo {
+	return sftp.BlobInfo{
+		Key:     strings.TrimPrefix(attrs.Name, s.prefix),
+		Size:    attrs.Size,
+		ModTime: attrs.Updated,
+	}
+}
@@ -0,0 +1,125 @@
+package gcshandler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/pkg/sftp"
+	"github.com/pkg/sftp/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBucket = "bucket"
+
+// newFakeGCS returns an in-process fake GCS, with an empty bucket.
+func newFakeGCS(t *testing.T) *fakestorage.Server {
+	gcs, err := fakestorage.NewServerWithOptions(fakestorage.Options{
+		NoListener: true,
+		Writer:     ioutil.Discard,
+	})
+	require.NoError(t, err)
+	t.Cleanup(gcs.Stop)
+	gcs.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: testBucket})
+	return gcs
+}
+
+// clientGCSPair returns a client of a request server serving a fake GCS bucket.
+func clientGCSPair(t *testing.T, options ...Option) (*sftp.Client, *fakestorage.Server) {
+	gcs := newFakeGCS(t)
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, New(gcs.Client().Bucket(testBucket), options...))
+	go server.Serve()
+	client, err := sftp.NewClientPipe(cr, cw)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client, gcs
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestChunkedUpload(t *testing.T) {
+	client, gcs := clientGCSPair(t, WithPrefix("root"), WithChunkSize(256<<10))
+
+	// larger than a chunk, and than a block of the reads
+	data := testData(3<<20 + 5)
+	f, err := client.Create("/dir/file")
+	require.NoError(t, err)
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	obj, err := gcs.GetObject(testBucket, "root/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, data, obj.Content)
+
+	f, err = client.Open("/dir/file")
+	require.NoError(t, err)
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestPrefix(t *testing.T) {
+	client, gcs := clientGCSPair(t, WithPrefix("/root/"))
+	gcs.CreateObject(fakestorage.Object{
+		ObjectAttrs: fakestorage.ObjectAttrs{BucketName: testBucket, Name: "root/a"},
+		Content:     []byte("a"),
+	})
+	gcs.CreateObject(fakestorage.Object{
+		ObjectAttrs: fakestorage.ObjectAttrs{BucketName: testBucket, Name: "other/b"},
+		Content:     []byte("b"),
+	})
+
+	entries, err := client.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a", entries[0].Name())
+	assert.Equal(t, int64(1), entries[0].Size())
+
+	_, err = client.Stat("/other/b")
+	assert.True(t, os.IsNotExist(err), err)
+
+	require.NoError(t, client.Remove("/a"))
+	_, err = gcs.GetObject(testBucket, "root/a")
+	assert.Error(t, err)
+	assert.True(t, os.IsNotExist(client.Remove("/a")))
+}
+
+func TestStoreNotExist(t *testing.T) {
+	store := NewStore(newFakeGCS(t).Client().Bucket(testBucket))
+	ctx := context.Background()
+
+	_, err := store.Get(ctx, "missing", 0, -1)
+	assert.True(t, os.IsNotExist(err), err)
+	_, err = store.Stat(ctx, "missing")
+	assert.True(t, os.IsNotExist(err), err)
+	assert.True(t, os.IsNotExist(store.Delete(ctx, "missing")))
+}
+
+func TestConformance(t *testing.T) {
+	handlertest.TestHandlers(t, func() sftp.Handlers {
+		return New(newFakeGCS(t).Client().Bucket(testBucket))
+	})
+}
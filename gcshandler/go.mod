@@ -0,0 +1,13 @@
+module github.com/pkg/sftp/gcshandler
+
+go 1.15
+
+require (
+	cloud.google.com/go/storage v1.16.0
+	github.com/fsouza/fake-gcs-server v1.30.0
+	github.com/pkg/sftp v1.13.0
+	github.com/stretchr/testify v1.7.0
+	google.golang.org/api v0.54.0
+)
+
+replace github.com/pkg/sftp => ../
@@ -0,0 +1,94 @@
+package sftp
+
+import (
+	"context"
+	"sync"
+)
+
+// CloseGracefully closes the SFTP session like Close does, after waiting for
+// the outstanding requests, such as writes, to be answered, and closing the
+// Files not closed yet for their handles not to leak on the server.
+// If ctx is done first, the session is closed at once and ctx.Err() is
+// returned. Otherwise the first error closing a File or the session is
+// returned.
+func (c *Client) CloseGracefully(ctx context.Context) error {
+	err := c.drain(ctx)
+	if err2 := c.teardown(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// drain waits for the outstanding requests, then closes the open Files.
+func (c *Client) drain(ctx context.Context) error {
+	select {
+	case <-c.closed:
+		// the session is lost already
+		return nil
+	default:
+	}
+
+	if err := c.waitIdle(ctx); err != nil {
+		return err
+	}
+
+	c.filesMu.Lock()
+	files := make([]*File, 0, len(c.files))
+	for f := range c.files {
+		files = append(files, f)
+	}
+	c.filesMu.Unlock()
+	if len(files) == 0 {
+		return nil
+	}
+
+	errs := make(chan error, len(files))
+	sem := make(chan struct{}, c.maxConcurrentRequests)
+	var wg sync.WaitGroup
+	for _, f := range files {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func(f *File) {
+			defer wg.Done()
+			errs <- f.Close()
+			<-sem
+		}(f)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) track(f *File) {
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	c.files[f] = struct{}{}
+}
+
+func (c *Client) untrack(f *File) {
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	delete(c.files, f)
+}
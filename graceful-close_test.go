@@ -0,0 +1,58 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCloseGracefully(t *testing.T) {
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-closegracefully")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var files []*File
+	for _, name := range []string{"a", "b", "c"} {
+		f, err := client.Create(filepath.Join(dir, name))
+		require.NoError(t, err)
+		files = append(files, f)
+	}
+	_, err = files[0].Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, files[1].Close())
+	require.Equal(t, 2, server.openFiles.len())
+
+	require.NoError(t, client.drain(context.Background()))
+	assert.Zero(t, server.openFiles.len())
+	for _, f := range files {
+		assert.True(t, errors.Is(f.Close(), os.ErrClosed))
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestClientCloseGracefullyTimeout(t *testing.T) {
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// a request never answered
+	client.nextID()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.drain(ctx))
+}
@@ -0,0 +1,150 @@
+package sftp
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// handleShardCount is the number of shards of a handleTable.
+const handleShardCount = 32
+
+// handleTable maps the handles of a server to the state of their open file.
+// The table is split into shards guarded by their own lock, so that requests
+// on different handles do not contend for a single lock.
+type handleTable struct {
+	count  uint64 // accessed atomically, kept first for alignment
+	open   int64  // the handles reserved, accessed atomically
+	max    int64  // if > 0, the handles which can be reserved at once
+	shards [handleShardCount]handleShard
+
+	// if not nil, the handles put and removed are counted by it
+	metrics Metrics
+}
+
+type handleShard struct {
+	sync.RWMutex
+	handles map[string]interface{}
+}
+
+func newHandleTable() *handleTable {
+	t := new(handleTable)
+	for i := range t.shards {
+		t.shards[i].handles = make(map[string]interface{})
+	}
+	return t
+}
+
+// newHandle returns a handle that was never returned before.
+func (t *handleTable) newHandle() string {
+	return strconv.FormatUint(atomic.AddUint64(&t.count, 1), 10)
+}
+
+// shard returns the shard of handle, using the FNV-1a hash.
+func (t *handleTable) shard(handle string) *handleShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(handle); i++ {
+		h ^= uint32(handle[i])
+		h *= 16777619
+	}
+	return &t.shards[h%handleShardCount]
+}
+
+// reserve reserves the room for a handle to be put, and returns false if
+// max handles are reserved already. The room is released once the handle
+// is removed, or by release if it is not put.
+func (t *handleTable) reserve() bool {
+	for {
+		n := atomic.LoadInt64(&t.open)
+		if t.max > 0 && n >= t.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&t.open, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release releases the room reserved for a handle.
+func (t *handleTable) release() {
+	atomic.AddInt64(&t.open, -1)
+}
+
+// put maps handle to v, in the room reserved for it.
+func (t *handleTable) put(handle string, v interface{}) {
+	s := t.shard(handle)
+	s.Lock()
+	defer s.Unlock()
+	s.handles[handle] = v
+	if t.metrics != nil {
+		t.metrics.AddOpenHandles(1)
+	}
+}
+
+func (t *handleTable) get(handle string) (interface{}, bool) {
+	s := t.shard(handle)
+	s.RLock()
+	defer s.RUnlock()
+	v, ok := s.handles[handle]
+	return v, ok
+}
+
+// remove removes handle from the table, returning the value it was mapped to.
+func (t *handleTable) remove(handle string) (interface{}, bool) {
+	s := t.shard(handle)
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.handles[handle]
+	if ok {
+		delete(s.handles, handle)
+		t.release()
+		if t.metrics != nil {
+			t.metrics.AddOpenHandles(-1)
+		}
+	}
+	return v, ok
+}
+
+// removeAll empties the table, returning what it contained.
+func (t *handleTable) removeAll() map[string]interface{} {
+	all := make(map[string]interface{})
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		for handle, v := range s.handles {
+			all[handle] = v
+			delete(s.handles, handle)
+		}
+		s.Unlock()
+	}
+	atomic.AddInt64(&t.open, -int64(len(all)))
+	if t.metrics != nil && len(all) > 0 {
+		t.metrics.AddOpenHandles(-len(all))
+	}
+	return all
+}
+
+// len returns the number of handles in the table.
+func (t *handleTable) len() int {
+	n := 0
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.RLock()
+		n += len(s.handles)
+		s.RUnlock()
+	}
+	return n
+}
+
+// each calls fn with each handle of the table and its value, a shard at a
+// time.
+func (t *handleTable) each(fn func(handle string, v interface{})) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.RLock()
+		for handle, v := range s.handles {
+			fn(handle, v)
+		}
+		s.RUnlock()
+	}
+}
@@ -0,0 +1,50 @@
+package sftp
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleTable(t *testing.T) {
+	table := newHandleTable()
+
+	var wg sync.WaitGroup
+	handles := make(chan string, 1000)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				handle := table.newHandle()
+				table.put(handle, handle)
+				handles <- handle
+			}
+		}()
+	}
+	wg.Wait()
+	close(handles)
+
+	seen := make(map[string]bool)
+	for handle := range handles {
+		assert.False(t, seen[handle], "handle %s returned twice", handle)
+		seen[handle] = true
+
+		v, ok := table.get(handle)
+		assert.True(t, ok)
+		assert.Equal(t, handle, v)
+	}
+	assert.Equal(t, 1000, table.len())
+
+	v, ok := table.remove("1")
+	assert.True(t, ok)
+	assert.Equal(t, "1", v)
+	_, ok = table.get("1")
+	assert.False(t, ok)
+	_, ok = table.remove("1")
+	assert.False(t, ok)
+
+	assert.Len(t, table.removeAll(), 999)
+	assert.Equal(t, 0, table.len())
+}
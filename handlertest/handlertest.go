@@ -0,0 +1,437 @@
+// Package handlertest provides a conformance test suite for sftp.Handlers backends.
+//
+// Backend authors call TestHandlers from their own tests, to check that their
+// Handlers behave as the request server and its clients expect:
+//
+//	func TestConformance(t *testing.T) {
+//		handlertest.TestHandlers(t, func() sftp.Handlers {
+//			return mybackend.New(...)
+//		})
+//	}
+//
+// Each subtest serves a new Handlers, which must be empty but for its root directory.
+package handlertest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// TestHandlers runs the conformance suite against the Handlers returned by newHandlers.
+//
+// Symlinks are optional: their subtest is skipped if creating one fails with
+// SSH_FX_OP_UNSUPPORTED. If the Handlers implement sftp.PosixRenameFileCmder,
+// posix renames are expected to replace their target.
+func TestHandlers(t *testing.T, newHandlers func() sftp.Handlers) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, client *sftp.Client, handlers sftp.Handlers)
+	}{
+		{"Open", testOpen},
+		{"ConcurrentReadWrite", testConcurrentReadWrite},
+		{"Rename", testRename},
+		{"List", testList},
+		{"Symlink", testSymlink},
+		{"Errors", testErrors},
+		{"Close", testClose},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handlers := newHandlers()
+			tt.fn(t, newClient(t, handlers), handlers)
+		})
+	}
+}
+
+// newClient returns a client of a request server serving handlers.
+func newClient(t *testing.T, handlers sftp.Handlers) *sftp.Client {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, handlers)
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func writeFile(t *testing.T, client *sftp.Client, name string, data []byte) {
+	t.Helper()
+	f, err := client.Create(name)
+	if err != nil {
+		t.Fatalf("Create(%q): %v", name, err)
+	}
+	if _, err := f.ReadFrom(bytes.NewReader(data)); err != nil {
+		f.Close()
+		t.Fatalf("writing %q: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("closing %q: %v", name, err)
+	}
+}
+
+func readFile(t *testing.T, client *sftp.Client, name string) []byte {
+	t.Helper()
+	f, err := client.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", name, err)
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatalf("reading %q: %v", name, err)
+	}
+	return buf.Bytes()
+}
+
+func checkFile(t *testing.T, client *sftp.Client, name string, want []byte) {
+	t.Helper()
+	if got := readFile(t, client, name); !bytes.Equal(got, want) {
+		t.Errorf("%q has %d bytes, not the %d written", name, len(got), len(want))
+	}
+}
+
+func checkNotExist(t *testing.T, err error, what string) {
+	t.Helper()
+	if !os.IsNotExist(err) {
+		t.Errorf("%s: got %v, want SSH_FX_NO_SUCH_FILE", what, err)
+	}
+}
+
+func mkdir(t *testing.T, client *sftp.Client, name string) {
+	t.Helper()
+	if err := client.Mkdir(name); err != nil {
+		t.Fatalf("Mkdir(%q): %v", name, err)
+	}
+}
+
+func testOpen(t *testing.T, client *sftp.Client, _ sftp.Handlers) {
+	writeFile(t, client, "/file", []byte("hello world"))
+	checkFile(t, client, "/file", []byte("hello world"))
+
+	fi, err := client.Stat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 11 || fi.IsDir() {
+		t.Errorf("Stat: got size %d, directory %v", fi.Size(), fi.IsDir())
+	}
+
+	_, err = client.Open("/missing")
+	checkNotExist(t, err, "Open of a missing file")
+
+	if f, err := client.OpenFile("/file", os.O_WRONLY|os.O_CREATE|os.O_EXCL); err == nil {
+		f.Close()
+		t.Error("exclusive create of an existing file succeeded")
+	}
+
+	f, err := client.OpenFile("/file", os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, client, "/file", []byte("bye"))
+
+	// files are created in the directories
+	mkdir(t, client, "/dir")
+	writeFile(t, client, "/dir/file", []byte("nested"))
+	checkFile(t, client, "/dir/file", []byte("nested"))
+}
+
+func testConcurrentReadWrite(t *testing.T, client *sftp.Client, _ sftp.Handlers) {
+	// written and read by the client with concurrent requests
+	data := testData(1<<20 + 123)
+	writeFile(t, client, "/large", data)
+	checkFile(t, client, "/large", data)
+
+	f, err := client.Open("/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// concurrent reads of the same handle, at their own offsets
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			buf := make([]byte, 10000)
+			n, err := f.ReadAt(buf, off)
+			if err != nil && err != io.EOF {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+				errs <- fmt.Errorf("ReadAt(%d) read other bytes", off)
+			}
+		}(int64(i) * 130000)
+	}
+
+	// concurrent writes of other files
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := client.Create(fmt.Sprintf("/file%d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := f.ReadFrom(bytes.NewReader(data[i:])); err != nil {
+				f.Close()
+				errs <- err
+				return
+			}
+			if err := f.Close(); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		checkFile(t, client, fmt.Sprintf("/file%d", i), data[i:])
+	}
+}
+
+func testRename(t *testing.T, client *sftp.Client, handlers sftp.Handlers) {
+	writeFile(t, client, "/old", []byte("old"))
+	if err := client.Rename("/old", "/new"); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, client, "/new", []byte("old"))
+	_, err := client.Stat("/old")
+	checkNotExist(t, err, "Stat of the old name")
+
+	writeFile(t, client, "/other", []byte("other"))
+	if err := client.Rename("/other", "/new"); err == nil {
+		t.Error("Rename onto an existing file succeeded")
+	}
+	checkFile(t, client, "/new", []byte("old"))
+
+	err = client.Rename("/missing", "/renamed")
+	checkNotExist(t, err, "Rename of a missing file")
+
+	// directories are renamed with their contents
+	mkdir(t, client, "/dir")
+	mkdir(t, client, "/dir/sub")
+	writeFile(t, client, "/dir/sub/file", []byte("nested"))
+	if err := client.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, client, "/moved/sub/file", []byte("nested"))
+	_, err = client.Stat("/dir/sub/file")
+	checkNotExist(t, err, "Stat in the old directory")
+
+	if _, ok := handlers.FileCmd.(sftp.PosixRenameFileCmder); ok {
+		if err := client.PosixRename("/other", "/new"); err != nil {
+			t.Fatal("PosixRename onto an existing file: ", err)
+		}
+		checkFile(t, client, "/new", []byte("other"))
+		_, err = client.Stat("/other")
+		checkNotExist(t, err, "Stat of the old name")
+	}
+}
+
+func testList(t *testing.T, client *sftp.Client, _ sftp.Handlers) {
+	mkdir(t, client, "/dir")
+	mkdir(t, client, "/dir/sub")
+
+	// more than the entries returned by a single readdir
+	var want []string
+	for i := 0; i < 150; i++ {
+		name := fmt.Sprintf("file%03d", i)
+		writeFile(t, client, "/dir/"+name, testData(i))
+		want = append(want, name)
+	}
+	want = append(want, "sub")
+
+	fis, err := client.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fi := range fis {
+		got = append(got, fi.Name())
+		switch {
+		case fi.Name() == "sub":
+			if !fi.IsDir() {
+				t.Errorf("%s is not listed as a directory", fi.Name())
+			}
+		case fi.IsDir():
+			t.Errorf("%s is listed as a directory", fi.Name())
+		default:
+			var i int64
+			fmt.Sscanf(fi.Name(), "file%d", &i)
+			if fi.Size() != i {
+				t.Errorf("%s is listed with size %d, want %d", fi.Name(), fi.Size(), i)
+			}
+		}
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("listed %d entries %v, want %d", len(got), got, len(want))
+	}
+
+	fis, err = client.ReadDir("/dir/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 0 {
+		t.Errorf("empty directory has %d entries", len(fis))
+	}
+
+	fi, err := client.Stat("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() || fi.Name() != "dir" {
+		t.Errorf("Stat: got %s, directory %v", fi.Name(), fi.IsDir())
+	}
+
+	_, err = client.ReadDir("/missing")
+	checkNotExist(t, err, "ReadDir of a missing directory")
+}
+
+func testSymlink(t *testing.T, client *sftp.Client, _ sftp.Handlers) {
+	writeFile(t, client, "/target", []byte("target"))
+	if err := client.Symlink("/target", "/link"); err != nil {
+		if err, ok := err.(*sftp.StatusError); ok && err.FxCode() == sftp.ErrSSHFxOpUnsupported {
+			t.Skip("symlinks are not supported")
+		}
+		t.Fatal(err)
+	}
+
+	target, err := client.ReadLink("/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Join("/", target) != "/target" {
+		t.Errorf("ReadLink: got %q, want /target", target)
+	}
+	checkFile(t, client, "/link", []byte("target"))
+
+	fi, err := client.Lstat("/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat: got mode %v, want a symlink", fi.Mode())
+	}
+
+	if _, err := client.ReadLink("/target"); err == nil {
+		t.Error("ReadLink of a file succeeded")
+	}
+	if err := client.Symlink("/target", "/link"); err == nil {
+		t.Error("Symlink onto an existing link succeeded")
+	}
+}
+
+func testErrors(t *testing.T, client *sftp.Client, _ sftp.Handlers) {
+	_, err := client.Stat("/missing")
+	checkNotExist(t, err, "Stat of a missing file")
+	checkNotExist(t, client.Remove("/missing"), "Remove of a missing file")
+
+	mkdir(t, client, "/dir")
+	writeFile(t, client, "/dir/file", []byte("file"))
+	if err := client.Mkdir("/dir"); err == nil {
+		t.Error("Mkdir of an existing directory succeeded")
+	}
+	if err := client.RemoveDirectory("/dir"); err == nil {
+		t.Error("RemoveDirectory of a non-empty directory succeeded")
+	}
+	if _, err := client.Open("/dir"); err == nil {
+		t.Error("Open of a directory succeeded")
+	}
+
+	if err := client.Remove("/dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Stat("/dir/file")
+	checkNotExist(t, err, "Stat of a removed file")
+	if err := client.RemoveDirectory("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Stat("/dir")
+	checkNotExist(t, err, "Stat of a removed directory")
+}
+
+func testClose(t *testing.T, client *sftp.Client, _ sftp.Handlers) {
+	f, err := client.Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data is stored once the close returns
+	fi, err := client.Stat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 5 {
+		t.Errorf("Stat after Close: got size %d, want 5", fi.Size())
+	}
+	checkFile(t, client, "/file", []byte("hello"))
+
+	// the handle is gone
+	if err := f.Close(); err == nil {
+		t.Error("second Close succeeded")
+	}
+	if _, err := f.Write([]byte("more")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+	checkFile(t, client, "/file", []byte("hello"))
+
+	f, err = client.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 5)); err == nil || err == io.EOF {
+		t.Errorf("Read after Close: got %v, want an error", err)
+	}
+}
@@ -0,0 +1,11 @@
+package handlertest
+
+import (
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestInMemHandler(t *testing.T) {
+	TestHandlers(t, sftp.InMemHandler)
+}
@@ -0,0 +1,169 @@
+package sftp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrIdleTimeout is returned by Serve once the session is closed for having
+// received no packet for its idle timeout, see WithIdleTimeout.
+var ErrIdleTimeout = errors.New("sftp: session idle timeout")
+
+// WithIdleTimeout closes the session once no packet has been received from
+// the client for d, so that the sessions abandoned without their connection
+// being closed do not hold their files open forever. Serve then returns
+// ErrIdleTimeout. The session is not idle while serving requests, however
+// long they take, such as a copy-data of a large file or a slow Handler: d
+// counts from the reply to the last of them.
+//
+// The timeout of a session is changed with SetIdleTimeout, and that of each
+// user with WithConnConfig.
+func WithIdleTimeout(d time.Duration) ServerOption {
+	return func(s *Server) error {
+		s.SetIdleTimeout(d)
+		return nil
+	}
+}
+
+// WithRSIdleTimeout closes the session once no packet has been received from
+// the client for d, see WithIdleTimeout.
+//
+// The timeout of a session is changed with SetIdleTimeout, and that of each
+// user with WithRSConnConfig.
+func WithRSIdleTimeout(d time.Duration) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.SetIdleTimeout(d)
+	}
+}
+
+// SetIdleTimeout sets the idle timeout of the session, see WithIdleTimeout,
+// for instance from the Handlers of a client known to pause for longer. A d
+// less than 1 disables it. When waiting for a packet, d counts from the call.
+func (svr *Server) SetIdleTimeout(d time.Duration) {
+	svr.serverConn.idle.set(d, svr.serverConn.expireIdle)
+}
+
+// SetIdleTimeout sets the idle timeout of the session, see
+// WithRSIdleTimeout, for instance from the Handlers of a client known to
+// pause for longer. A d less than 1 disables it. When waiting for a packet,
+// d counts from the call.
+func (rs *RequestServer) SetIdleTimeout(d time.Duration) {
+	rs.serverConn.idle.set(d, rs.serverConn.expireIdle)
+}
+
+// idleTimer times the waits for the packets of a session, while no request
+// is served.
+type idleTimer struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	t        timer // while waiting and serving none, if timeout is set
+	deadline time.Time
+	waiting  bool
+	serving  int // the requests received, not yet replied
+	expired  bool
+	expire   func()
+}
+
+// set sets the timeout, calling expire once passed.
+func (it *idleTimer) set(d time.Duration, expire func()) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.timeout, it.expire = d, expire
+	if it.waiting {
+		it.stop()
+		it.start()
+	}
+}
+
+// wait starts timing a wait for a packet.
+func (it *idleTimer) wait() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.waiting = true
+	it.start()
+}
+
+// replied counts a request replied, the timer counting from the reply to
+// the last one served.
+func (it *idleTimer) replied() {
+	if it == nil {
+		return
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.serving--
+	if it.serving == 0 && it.waiting {
+		it.start()
+	}
+}
+
+// received stops timing the wait, counting the request received if ok as
+// served until replied, and returns whether it expired.
+func (it *idleTimer) received(ok bool) bool {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.waiting = false
+	if ok {
+		it.serving++
+	}
+	it.stop()
+	return it.expired
+}
+
+// start starts the timer, if the timeout is set and no request is served.
+// it.mu is held.
+func (it *idleTimer) start() {
+	if it.timeout <= 0 || it.expired || it.serving > 0 {
+		return
+	}
+	it.deadline = pkgClock.Now().Add(it.timeout)
+	if it.t == nil {
+		it.t = pkgClock.AfterFunc(it.timeout, it.fire)
+		return
+	}
+	it.t.Reset(it.timeout)
+}
+
+// stop stops the timer. it.mu is held.
+func (it *idleTimer) stop() {
+	if it.t != nil {
+		it.t.Stop()
+	}
+}
+
+func (it *idleTimer) fire() {
+	it.mu.Lock()
+	if !it.waiting || it.serving > 0 || it.expired || pkgClock.Now().Before(it.deadline) {
+		// a packet was received, a request served, or the timer restarted,
+		// as it fired
+		it.mu.Unlock()
+		return
+	}
+	it.expired = true
+	expire := it.expire
+	it.mu.Unlock()
+
+	expire()
+}
+
+// expireIdle closes the conn, for its wait for a packet to fail.
+func (s *serverConn) expireIdle() {
+	debug("sftp session idle timeout")
+	s.conn.Close()
+}
+
+// recvPacket receives a packet like conn.recvPacket, timing the wait for the
+// idle timeout.
+func (s *serverConn) recvPacket(orderID uint32) (uint8, []byte, error) {
+	s.idle.wait()
+	typ, data, err := s.conn.recvPacket(orderID)
+	if s.idle.received(err == nil) {
+		return 0, nil, ErrIdleTimeout
+	}
+	return typ, data, err
+}
@@ -0,0 +1,146 @@
+package sftp
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerIdleTimeout(t *testing.T) {
+	clock := useFakeClock(t, time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, WithIdleTimeout(time.Minute))
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	client, err := NewClientPipe(cr, cw)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the packets keep the session open
+	for i := 0; i < 3; i++ {
+		clock.Advance(59 * time.Second)
+		_, err = client.Getwd()
+		require.NoError(t, err)
+	}
+
+	// idle once the last reply is sent
+	require.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		select {
+		case err := <-served:
+			assert.Equal(t, ErrIdleTimeout, err)
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+	_, err = client.Getwd()
+	assert.Error(t, err)
+}
+
+func TestRequestServerSetIdleTimeout(t *testing.T) {
+	clock := useFakeClock(t, time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+	client, server := handlersClientPair(t, InMemHandler(), nil)
+
+	clock.Advance(time.Hour)
+	_, err := client.Getwd()
+	require.NoError(t, err)
+
+	server.SetIdleTimeout(time.Minute)
+	f, err := client.Create("/upload")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		return server.openRequests.len() == 0
+	}, time.Second, time.Millisecond)
+	assert.Error(t, client.Wait())
+	_, err = f.Write([]byte("data"))
+	assert.Error(t, err)
+}
+
+func TestIdleTimerDisabled(t *testing.T) {
+	clock := useFakeClock(t, time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+	var expired int
+	var it idleTimer
+	it.set(time.Minute, func() { expired++ })
+
+	it.wait()
+	clock.Advance(30 * time.Second)
+	it.set(0, func() { expired++ })
+	clock.Advance(time.Hour)
+	assert.False(t, it.received(true))
+
+	// not while serving the request received
+	it.set(time.Minute, func() { expired++ })
+	it.wait()
+	clock.Advance(time.Hour)
+	assert.Zero(t, expired)
+	it.replied()
+
+	// restarted by set while waiting
+	clock.Advance(30 * time.Second)
+	it.set(time.Minute, func() { expired++ })
+	clock.Advance(45 * time.Second)
+	assert.Zero(t, expired)
+	clock.Advance(15 * time.Second)
+	assert.Equal(t, 1, expired)
+	assert.True(t, it.received(true))
+}
+
+// blockingLister blocks the Stats until unblock is closed.
+type blockingLister struct {
+	FileLister
+	stating chan struct{}
+	unblock chan struct{}
+}
+
+func (l blockingLister) Filelist(r *Request) (ListerAt, error) {
+	if r.Method == "Stat" {
+		l.stating <- struct{}{}
+		<-l.unblock
+	}
+	return l.FileLister.Filelist(r)
+}
+
+func TestRequestServerIdleTimeoutServing(t *testing.T) {
+	clock := useFakeClock(t, time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+	handlers := InMemHandler()
+	lister := blockingLister{handlers.FileList, make(chan struct{}), make(chan struct{})}
+	handlers.FileList = lister
+	client, server := handlersClientPair(t, handlers, nil)
+	server.SetIdleTimeout(time.Minute)
+
+	// not idle while the Stat is served
+	stated := make(chan error, 1)
+	go func() {
+		_, err := client.Stat("/")
+		stated <- err
+	}()
+	<-lister.stating
+	clock.Advance(time.Hour)
+	close(lister.unblock)
+	require.NoError(t, <-stated)
+	_, err := client.Getwd()
+	require.NoError(t, err)
+
+	closed := make(chan error, 1)
+	go func() { closed <- client.Wait() }()
+	require.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		select {
+		case <-closed:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+}
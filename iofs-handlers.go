@@ -0,0 +1,437 @@
+// +build go1.16
+
+package sftp
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewFSHandlers returns the Handlers serving fsys read-only, such as an
+// embed.FS, a fstest.MapFS or a zip.Reader: the files are read and listed,
+// while the requests changing them fail with a permission denied error. The
+// root directory of the clients is the root "." of fsys.
+//
+// The files are read at any offset, those of fsys which are no io.ReaderAt
+// or io.Seeker being opened again, and skipped through, to read them
+// backwards. fs.FS has no links, Lstat is served as Stat and Readlink is not
+// supported.
+func NewFSHandlers(fsys fs.FS) Handlers {
+	h := fsHandler{fsys}
+	return Handlers{
+		FileGet:  h,
+		FilePut:  readOnlyWriter{},
+		FileCmd:  readOnlyCmder{},
+		FileList: h,
+	}
+}
+
+// WriteFS is an fs.FS whose files can be created, removed and made, which
+// NewWriteFSHandlers serves. The names are those of fs.FS.
+type WriteFS interface {
+	fs.FS
+	// Create creates the file name, or truncates it, open for writing. The
+	// file is closed once written if it is an io.Closer.
+	Create(name string) (io.WriterAt, error)
+	// Remove removes the file or the empty directory name.
+	Remove(name string) error
+	// Mkdir creates the directory name, with the permissions perm.
+	Mkdir(name string, perm fs.FileMode) error
+}
+
+// NewWriteFSHandlers returns the Handlers serving fsys, read as by
+// NewFSHandlers, whose files can be uploaded, removed and made.
+//
+// As Create truncates the files, existing ones can only be opened for
+// writing to be truncated; Setstat only supports truncating to 0, and
+// accepts but ignores the other attributes, which fsys cannot set. Rename and
+// links are not supported.
+func NewWriteFSHandlers(fsys WriteFS) Handlers {
+	h := writeFSHandler{fsHandler{fsys}, fsys}
+	return Handlers{
+		FileGet:  h.fsHandler,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h.fsHandler,
+	}
+}
+
+// fsName returns the name in an fs.FS of the file at p, "." for the root.
+func fsName(p string) string {
+	if name := strings.TrimPrefix(path.Clean("/"+p), "/"); name != "" {
+		return name
+	}
+	return "."
+}
+
+type fsHandler struct {
+	fsys fs.FS
+}
+
+func (h fsHandler) Fileread(r *Request) (io.ReaderAt, error) {
+	name := fsName(r.Filepath)
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, ErrSSHFxFailure
+	}
+	if ra, ok := f.(io.ReaderAt); ok {
+		return ra, nil
+	}
+	return &fsReaderAt{fsys: h.fsys, name: name, f: f}, nil
+}
+
+func (h fsHandler) Filelist(r *Request) (ListerAt, error) {
+	name := fsName(r.Filepath)
+	switch r.Method {
+	case "List":
+		entries, err := fs.ReadDir(h.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		list := make(listerat, 0, len(entries))
+		for _, e := range entries {
+			fi, err := e.Info()
+			if err != nil {
+				// removed meanwhile
+				continue
+			}
+			list = append(list, fi)
+		}
+		return list, nil
+	case "Stat", "Lstat":
+		fi, err := fs.Stat(h.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		return listerat{fi}, nil
+	}
+	return nil, ErrSSHFxOpUnsupported
+}
+
+// fsReaderAt reads at any offset a file of an fs.FS which is no io.ReaderAt,
+// seeking it if it is an io.Seeker, and else opening it again to read it
+// backwards.
+type fsReaderAt struct {
+	fsys fs.FS
+	name string
+
+	mu  sync.Mutex
+	f   fs.File
+	pos int64 // of f
+}
+
+func (r *fsReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.seek(off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.f, b)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// seek moves r.f to off. r.mu must be held.
+func (r *fsReaderAt) seek(off int64) error {
+	if off == r.pos {
+		return nil
+	}
+	if s, ok := r.f.(io.Seeker); ok {
+		pos, err := s.Seek(off, io.SeekStart)
+		r.pos = pos
+		return err
+	}
+
+	if off < r.pos {
+		f, err := r.fsys.Open(r.name)
+		if err != nil {
+			return err
+		}
+		r.f.Close()
+		r.f, r.pos = f, 0
+	}
+	n, err := io.CopyN(io.Discard, r.f, off-r.pos)
+	r.pos += n
+	if err == io.EOF {
+		// reads past the end read nothing
+		err = nil
+	}
+	return err
+}
+
+func (r *fsReaderAt) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+type writeFSHandler struct {
+	fsHandler
+	fsys WriteFS
+}
+
+func (h writeFSHandler) Filewrite(r *Request) (io.WriterAt, error) {
+	name := fsName(r.Filepath)
+	pflags := r.Pflags()
+	fi, err := fs.Stat(h.fsys, name)
+	switch {
+	case err == nil && fi.IsDir():
+		return nil, ErrSSHFxFailure
+	case err == nil && pflags.Creat && pflags.Excl:
+		return nil, os.ErrExist
+	case err == nil && !pflags.Trunc && fi.Size() > 0:
+		// Create would truncate the file
+		return nil, ErrSSHFxOpUnsupported
+	case err != nil && (!os.IsNotExist(err) || !pflags.Creat):
+		return nil, err
+	}
+	return h.fsys.Create(name)
+}
+
+func (h writeFSHandler) Filecmd(r *Request) error {
+	name := fsName(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		if !r.AttrFlags().Size {
+			return nil
+		}
+		if r.Attributes().Size != 0 {
+			return ErrSSHFxOpUnsupported
+		}
+		if _, err := fs.Stat(h.fsys, name); err != nil {
+			return err
+		}
+		w, err := h.fsys.Create(name)
+		if err != nil {
+			return err
+		}
+		if c, ok := w.(io.Closer); ok {
+			return c.Close()
+		}
+		return nil
+	case "Mkdir":
+		return h.fsys.Mkdir(name, 0755)
+	case "Rmdir", "Remove":
+		if name == "." {
+			return ErrSSHFxPermissionDenied
+		}
+		fi, err := fs.Stat(h.fsys, name)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() != (r.Method == "Rmdir") {
+			return ErrSSHFxFailure
+		}
+		return h.fsys.Remove(name)
+	}
+	return ErrSSHFxOpUnsupported
+}
+
+// AsFS returns the Handlers as an fs.FS, which also implements fs.StatFS and
+// fs.ReadDirFS, calling them with the requests of a request server without
+// serving them, for backends to be tested by the io/fs test suites such as
+// fstest.TestFS. As the names of an fs.FS are unrooted, "." is the root
+// directory "/" of the Handlers.
+func (h Handlers) AsFS() fs.FS {
+	return handlersFS{h}
+}
+
+type handlersFS struct {
+	h Handlers
+}
+
+// request returns the request of method for the file name of the fs.FS.
+func (fsys handlersFS) request(method, name string) *Request {
+	return NewRequest(method, "/"+name)
+}
+
+func (fsys handlersFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("stat", name, fs.ErrInvalid)
+	}
+	r := fsys.request("Stat", name)
+	lister, err := fsys.h.FileList.Filelist(r)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	var fi [1]fs.FileInfo
+	n, err := listAt(r.Context(), lister, fi[:], 0)
+	if n == 0 {
+		if err == nil || err == io.EOF {
+			err = fs.ErrNotExist
+		}
+		return nil, pathError("stat", name, err)
+	}
+	if name == "." {
+		// the name of the root of an fs.FS
+		return renamedFileInfo{fi[0], "."}, nil
+	}
+	return fi[0], nil
+}
+
+func (fsys handlersFS) Open(name string) (fs.File, error) {
+	fi, err := fsys.Stat(name)
+	if err != nil {
+		return nil, pathError("open", name, err.(*fs.PathError).Err)
+	}
+	if fi.IsDir() {
+		return &handlersDir{fsys: fsys, name: name, fi: fi}, nil
+	}
+
+	r := fsys.request("Get", name)
+	r.Flags = sshFxfRead
+	rd, err := fsys.h.FileGet.Fileread(r)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &handlersFile{name: name, fi: fi, rd: rd}, nil
+}
+
+func (fsys handlersFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, pathError("readdir", name, err.(*fs.PathError).Err)
+	}
+	defer f.Close()
+	d, ok := f.(*handlersDir)
+	if !ok {
+		return nil, pathError("readdir", name, ErrSSHFxFailure)
+	}
+	entries, err := d.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// handlersFile is a file opened by the Open of a handlersFS.
+type handlersFile struct {
+	name string
+	fi   fs.FileInfo
+	rd   io.ReaderAt
+	off  int64
+}
+
+func (f *handlersFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+
+func (f *handlersFile) Read(b []byte) (int, error) {
+	n, err := f.rd.ReadAt(b, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		// the next Read returns io.EOF
+		err = nil
+	}
+	if err != nil && err != io.EOF {
+		err = pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+func (f *handlersFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, pathError("readat", f.name, fs.ErrInvalid)
+	}
+	n, err := f.rd.ReadAt(b, off)
+	if n == len(b) && err == io.EOF {
+		err = nil
+	}
+	if err != nil && err != io.EOF {
+		err = pathError("readat", f.name, err)
+	}
+	return n, err
+}
+
+func (f *handlersFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.fi.Size()
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.name, fs.ErrInvalid)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *handlersFile) Close() error {
+	if c, ok := f.rd.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// handlersDir is a directory opened by the Open of a handlersFS, listed by
+// its ReadDir.
+type handlersDir struct {
+	fsys handlersFS
+	name string
+	fi   fs.FileInfo
+
+	r      *Request
+	lister ListerAt // of the first ReadDir
+	off    int64
+}
+
+func (d *handlersDir) Stat() (fs.FileInfo, error) { return d.fi, nil }
+
+func (d *handlersDir) Read([]byte) (int, error) {
+	return 0, pathError("read", d.name, errIsDir)
+}
+
+func (d *handlersDir) Close() error { return nil }
+
+func (d *handlersDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.lister == nil {
+		d.r = d.fsys.request("List", d.name)
+		lister, err := d.fsys.h.FileList.Filelist(d.r)
+		if err != nil {
+			return nil, pathError("readdir", d.name, err)
+		}
+		d.lister = lister
+	}
+
+	var entries []fs.DirEntry
+	for n <= 0 || len(entries) < n {
+		size := 128
+		if n > 0 && n-len(entries) < size {
+			size = n - len(entries)
+		}
+		list := make([]fs.FileInfo, size)
+		got, err := listAt(d.r.Context(), d.lister, list, d.off)
+		d.off += int64(got)
+		for _, fi := range list[:got] {
+			entries = append(entries, dirEntry{fi})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, pathError("readdir", d.name, err)
+		}
+	}
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
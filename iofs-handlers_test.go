@@ -0,0 +1,150 @@
+// +build go1.16
+
+package sftp
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSHandlers(t *testing.T) {
+	client, _ := handlersClientPair(t, NewFSHandlers(fstest.MapFS{
+		"dir/file": {Data: []byte("data"), Mode: 0644},
+		"top":      {Data: []byte("top")},
+	}), nil)
+
+	data, err := getTestFile(client, "/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	assert.Equal(t, []string{"dir", "top"}, readDirNames(t, client, "/"))
+	assert.Equal(t, []string{"file"}, readDirNames(t, client, "dir"))
+	fi, err := client.Lstat("/dir")
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+
+	_, err = client.Stat("/missing")
+	assert.True(t, os.IsNotExist(err), err)
+	_, err = client.Open("/dir")
+	assert.Error(t, err)
+
+	_, err = client.Create("/new")
+	assert.True(t, os.IsPermission(err), err)
+	assert.True(t, os.IsPermission(client.Mkdir("/newdir")))
+	assert.True(t, os.IsPermission(client.Remove("/top")))
+}
+
+func TestFSHandlersZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("file")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	client, _ := handlersClientPair(t, NewFSHandlers(zr), nil)
+
+	// the files of zip archives are neither io.ReaderAt nor io.Seeker
+	f, err := client.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+	b := make([]byte, 3)
+	_, err = f.ReadAt(b, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "678", string(b))
+	_, err = f.ReadAt(b, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "234", string(b))
+	n, err := f.ReadAt(b, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "89", string(b[:n]))
+}
+
+// dirWriteFS is the WriteFS of a local directory.
+type dirWriteFS struct {
+	fs.FS
+	dir string
+}
+
+func (fsys dirWriteFS) Create(name string) (io.WriterAt, error) {
+	return os.Create(filepath.Join(fsys.dir, filepath.FromSlash(name)))
+}
+
+func (fsys dirWriteFS) Remove(name string) error {
+	return os.Remove(filepath.Join(fsys.dir, filepath.FromSlash(name)))
+}
+
+func (fsys dirWriteFS) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(filepath.Join(fsys.dir, filepath.FromSlash(name)), perm)
+}
+
+func TestWriteFSHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-iofs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client, _ := handlersClientPair(t, NewWriteFSHandlers(dirWriteFS{os.DirFS(dir), dir}), nil)
+
+	require.NoError(t, client.Mkdir("/dir"))
+	_, err = putTestFile(client, "/dir/file", "data")
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	data, err = getTestFile(client, "/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	// existing files are only written truncated
+	_, err = client.OpenFile("/dir/file", os.O_WRONLY)
+	assert.Error(t, err)
+	_, err = client.OpenFile("/dir/file", os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	assert.Error(t, err)
+	require.NoError(t, client.Truncate("/dir/file", 0))
+	fi, err := client.Stat("/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), fi.Size())
+
+	assert.Error(t, client.RemoveDirectory("/dir"), "not empty")
+	assert.Error(t, client.Remove("/dir"), "Remove of a directory")
+	assert.Error(t, client.Rename("/dir/file", "/file"))
+	require.NoError(t, client.Remove("/dir/file"))
+	require.NoError(t, client.RemoveDirectory("/dir"))
+	_, err = os.Stat(filepath.Join(dir, "dir"))
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+func TestHandlersAsFS(t *testing.T) {
+	h := InMemHandler()
+	client, _ := handlersClientPair(t, h, nil)
+
+	require.NoError(t, client.MkdirAll("/a/b"))
+	for _, name := range []string{"/a/b/file", "/a/other", "/top"} {
+		_, err := putTestFile(client, name, "data of "+name)
+		require.NoError(t, err)
+	}
+
+	fsys := h.AsFS()
+	require.NoError(t, fstest.TestFS(fsys, "a/b/file", "a/other", "top"))
+
+	data, err := fs.ReadFile(fsys, "a/b/file")
+	require.NoError(t, err)
+	assert.Equal(t, "data of /a/b/file", string(data))
+	_, err = fs.Stat(fsys, "missing")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), err)
+	_, err = fsys.Open("/top")
+	assert.True(t, errors.Is(err, fs.ErrInvalid), err)
+}
@@ -0,0 +1,159 @@
+// +build go1.16
+
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// AsFS returns the remote filesystem as an fs.FS, which also implements
+// fs.ReadDirFS, fs.StatFS and fs.ReadFileFS, for the remote trees to be
+// passed to the functions taking one, such as fs.WalkDir, http.FS or
+// template.ParseFS. As the names of an fs.FS are unrooted, they are relative
+// to the working directory of the Client: "." is the directory set by
+// Chdir, or else the working directory of the server.
+func (c *Client) AsFS() fs.FS {
+	return clientFS{c}
+}
+
+// errIsDir is returned reading a directory opened by a clientFS.
+var errIsDir = errors.New("is a directory")
+
+type clientFS struct {
+	c *Client
+}
+
+// pathError returns err as the error of the operation op on the file name.
+func pathError(op, name string, err error) error {
+	if _, ok := err.(*fs.PathError); ok {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fsys clientFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("open", name, fs.ErrInvalid)
+	}
+
+	fi, err := fsys.c.Stat(name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if fi.IsDir() {
+		return &clientDir{c: fsys.c, name: name, fi: fi}, nil
+	}
+
+	f, err := fsys.c.Open(name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return f, nil
+}
+
+func (fsys clientFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("stat", name, fs.ErrInvalid)
+	}
+	fi, err := fsys.c.Stat(name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return fi, nil
+}
+
+func (fsys clientFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("readdir", name, fs.ErrInvalid)
+	}
+	list, err := fsys.c.ReadDir(name)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	return dirEntries(list), nil
+}
+
+func (fsys clientFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("readfile", name, fs.ErrInvalid)
+	}
+	f, err := fsys.c.Open(name)
+	if err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// dirEntries returns the entries of list, sorted by name.
+func dirEntries(list []fs.FileInfo) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(list))
+	for i, fi := range list {
+		entries[i] = dirEntry{fi}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// dirEntry is the fs.DirEntry of a FileInfo.
+type dirEntry struct {
+	fi fs.FileInfo
+}
+
+func (e dirEntry) Name() string               { return e.fi.Name() }
+func (e dirEntry) IsDir() bool                { return e.fi.IsDir() }
+func (e dirEntry) Type() fs.FileMode          { return e.fi.Mode().Type() }
+func (e dirEntry) Info() (fs.FileInfo, error) { return e.fi, nil }
+
+// clientDir is a directory opened by the Open of a clientFS.
+type clientDir struct {
+	c    *Client
+	name string
+	fi   fs.FileInfo
+
+	entries []fs.DirEntry // read by the first ReadDir
+	read    bool
+}
+
+func (d *clientDir) Stat() (fs.FileInfo, error) { return d.fi, nil }
+
+func (d *clientDir) Read([]byte) (int, error) {
+	return 0, pathError("read", d.name, errIsDir)
+}
+
+func (d *clientDir) Close() error { return nil }
+
+func (d *clientDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		list, err := d.c.ReadDir(d.name)
+		if err != nil {
+			return nil, pathError("readdir", d.name, err)
+		}
+		d.entries = dirEntries(list)
+		d.read = true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
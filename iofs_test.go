@@ -0,0 +1,52 @@
+// +build go1.16
+
+package sftp
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAsFS(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	dir, err := ioutil.TempDir("", "sftptest-iofs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "file"), []byte("data"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "top"), []byte("top"), 0644))
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+	require.NoError(t, client.Chdir(dir))
+
+	fsys := client.AsFS()
+	require.NoError(t, fstest.TestFS(fsys, "a/b/file", "top", "a", "a/b"))
+
+	data, err := fs.ReadFile(fsys, "a/b/file")
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	var walked []string
+	require.NoError(t, fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		walked = append(walked, p)
+		return err
+	}))
+	assert.Equal(t, []string{".", "a", "a/b", "a/b/file", "top"}, walked)
+
+	_, err = fsys.Open("/top")
+	assert.True(t, errors.Is(err, fs.ErrInvalid), err)
+	_, err = fs.Stat(fsys, "missing")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), err)
+}
@@ -0,0 +1,191 @@
+package sftp
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// WithJail confines the clients of the Server to the directory root, which
+// they see as "/": the paths of the requests are resolved against root, and
+// cannot lead out of it, with ".." or with symbolic links. The links are
+// resolved by the Server as if root were the root directory, so that a link
+// to "/etc" is one to the "etc" of root, and the files are then opened with
+// O_NOFOLLOW where the system has it, for a link swapped in meanwhile not to
+// be followed out of root.
+//
+// The targets of the links created are stored as sent by the clients.
+// Other processes changing the directories of root while it is served may
+// still have a path resolved out of root, as the directories leading to a
+// file are not opened one by one.
+func WithJail(root string) ServerOption {
+	return func(s *Server) error {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		// the paths resolved are prefixed with a root free of links
+		if root, err = filepath.EvalSymlinks(root); err != nil {
+			return err
+		}
+		fi, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return &os.PathError{Op: "jail", Path: root, Err: syscall.ENOTDIR}
+		}
+		s.jail = root
+		return nil
+	}
+}
+
+// toJailPaths replaces the paths of an incoming packet with the local paths
+// they resolve to in the jail. The path of a RealPath stays a path of the
+// jail, resolved.
+func (svr *Server) toJailPaths(p requestPacket) error {
+	if _, ok := p.(*sshFxpSymlinkPacket); ok && svr.symlinks == SymlinkDeny {
+		return ErrSSHFxPermissionDenied
+	}
+	if p, ok := p.(*sshFxpRealpathPacket); ok {
+		var err error
+		p.Path, err = svr.jailResolve(p.Path, true)
+		return err
+	}
+
+	var err error
+	packetPaths(p, func(name *string, follow, change bool) {
+		if err == nil {
+			*name, err = svr.jailLocalPath(*name, follow)
+		}
+		// the root is neither removed nor replaced
+		if err == nil && change && *name == svr.jail {
+			err = ErrSSHFxPermissionDenied
+		}
+	})
+	return err
+}
+
+// packetPaths calls fn with each path of the packet p naming a file, telling
+// whether the last element of the path is followed if it is a link, rather
+// than it being the link itself served, and whether the file is removed or
+// replaced.
+func packetPaths(p requestPacket, fn func(name *string, follow, change bool)) {
+	switch p := p.(type) {
+	case *sshFxpExtendedPacket:
+		if p.SpecificPacket != nil {
+			packetPaths(p.SpecificPacket, fn)
+		}
+	case *sshFxpStatPacket:
+		fn(&p.Path, true, false)
+	case *sshFxpLstatPacket:
+		fn(&p.Path, false, false)
+	case *sshFxpMkdirPacket:
+		fn(&p.Path, false, false)
+	case *sshFxpRmdirPacket:
+		fn(&p.Path, false, true)
+	case *sshFxpRemovePacket:
+		fn(&p.Filename, false, true)
+	case *sshFxpRenamePacket:
+		fn(&p.Oldpath, false, true)
+		fn(&p.Newpath, false, true)
+	case *sshFxpSymlinkPacket:
+		fn(&p.Linkpath, false, false)
+	case *sshFxpReadlinkPacket:
+		fn(&p.Path, false, false)
+	case *sshFxpOpendirPacket:
+		fn(&p.Path, true, false)
+	case *sshFxpOpenPacket:
+		fn(&p.Path, true, false)
+	case *sshFxpSetstatPacket:
+		fn(&p.Path, true, false)
+	case *sshFxpExtendedPacketStatVFS:
+		fn(&p.Path, true, false)
+	case *sshFxpExtendedPacketPosixRename:
+		fn(&p.Oldpath, false, true)
+		fn(&p.Newpath, false, true)
+	case *sshFxpExtendedPacketHardlink:
+		fn(&p.Oldpath, false, false)
+		fn(&p.Newpath, false, false)
+	case *sshFxpExtendedPacketCopyFile:
+		fn(&p.Source, true, false)
+		fn(&p.Destination, true, false)
+	case *sshFxpExtendedPacketCheckFileName:
+		fn(&p.Path, true, false)
+	}
+}
+
+// jailLocalPath returns the local path the path p of the jail resolves to,
+// see jailResolve.
+func (svr *Server) jailLocalPath(p string, follow bool) (string, error) {
+	resolved, err := svr.jailResolve(p, follow)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(svr.jail, filepath.FromSlash(resolved)), nil
+}
+
+// jailResolve returns the absolute path of the jail p resolves to once the
+// links leading to its last element are followed, in the jail, and the last
+// element too if follow is true, like Client.evalSymlinks does.
+func (svr *Server) jailResolve(p string, follow bool) (string, error) {
+	resolved := "/"
+	rest := strings.Split(cleanPath(p), "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, name)
+		if len(rest) == 0 && !follow {
+			return next, nil
+		}
+		local := filepath.Join(svr.jail, filepath.FromSlash(next))
+		fi, err := os.Lstat(local)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// what is missing is left for the request to fail, or create
+			resolved = next
+			continue
+		}
+
+		if svr.symlinks == SymlinkDeny {
+			return "", ErrSSHFxPermissionDenied
+		}
+		links++
+		if links > maxSymlinks {
+			return "", errors.Errorf("sftp: too many links resolving %q", p)
+		}
+		target, err := os.Readlink(local)
+		if err != nil {
+			return "", err
+		}
+		target = filepath.ToSlash(target)
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		// cleaned, for the last element to be told apart
+		rest = strings.Split(path.Join(target, strings.Join(rest, "/")), "/")
+	}
+	return resolved, nil
+}
+
+// jailPath returns the path of the jail of the local path name.
+func (svr *Server) jailPath(name string) string {
+	rel, err := filepath.Rel(svr.jail, name)
+	if err != nil {
+		return name
+	}
+	return cleanPath(rel)
+}
@@ -0,0 +1,6 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package sftp
+
+// oNoFollow is not supported.
+const oNoFollow = 0
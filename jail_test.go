@@ -0,0 +1,128 @@
+package sftp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerJail(t *testing.T) {
+	skipIfWindows(t) // the links
+	skipIfPlan9(t)
+
+	dir, err := ioutil.TempDir("", "sftptest-jail")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "dir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte("inside"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("outside"), 0644))
+	require.NoError(t, os.Symlink("/", filepath.Join(root, "abs")))
+	require.NoError(t, os.Symlink("../../..", filepath.Join(root, "dir", "up")))
+	require.NoError(t, os.Symlink("/created", filepath.Join(root, "dangling")))
+
+	client, server := clientServerPair(t, WithJail(root))
+	defer client.Close()
+	defer server.Close()
+
+	read := func(p string) (string, error) {
+		f, err := client.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		return string(data), err
+	}
+
+	// the paths are those of the jail
+	data, err := read("/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "inside", data)
+	data, err = read("dir/../dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "inside", data)
+	real, err := client.RealPath(".")
+	require.NoError(t, err)
+	assert.Equal(t, "/", real)
+
+	// no way out
+	_, err = read("/../secret")
+	assert.True(t, os.IsNotExist(err), err)
+	_, err = client.Stat("/dir/up/secret")
+	assert.True(t, os.IsNotExist(err), err)
+	data, err = read("/abs/dir/up/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "inside", data)
+	real, err = client.RealPath("/abs/dir/up")
+	require.NoError(t, err)
+	assert.Equal(t, "/", real)
+
+	// the links themselves
+	fi, err := client.Lstat("/abs")
+	require.NoError(t, err)
+	assert.True(t, fi.Mode()&os.ModeSymlink != 0)
+	target, err := client.ReadLink("/dir/up")
+	require.NoError(t, err)
+	assert.Equal(t, "../../..", target)
+
+	// a file created through a link is created in the jail
+	f, err := client.Create("/dangling")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = os.Stat(filepath.Join(root, "created"))
+	assert.NoError(t, err)
+
+	require.NoError(t, client.Symlink("/dir/file", "/link"))
+	target, err = os.Readlink(filepath.Join(root, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "/dir/file", target)
+	data, err = read("/link")
+	require.NoError(t, err)
+	assert.Equal(t, "inside", data)
+
+	assert.True(t, os.IsPermission(client.RemoveDirectory("/")))
+	assert.True(t, os.IsPermission(client.Rename("/", "/moved")))
+	assert.True(t, os.IsPermission(client.Rename("/dir", "/")))
+}
+
+func TestServerJailNotDir(t *testing.T) {
+	f, err := ioutil.TempFile("", "sftptest-jail")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	_, err = NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{nil, nil}, WithJail(f.Name()))
+	assert.Error(t, err)
+}
+
+func TestServerJailDenyRules(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftptest-jail")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "app.lock"), nil, 0644))
+
+	client, server := clientServerPair(t, WithJail(root), WithDenyRules(
+		DenyRule{Pattern: "/app.lock", Ops: DenyDelete | DenyWrite},
+	))
+	defer client.Close()
+	defer server.Close()
+
+	// the rules match the paths of the jail, relative ones too
+	assert.True(t, os.IsPermission(client.Remove("app.lock")))
+	assert.True(t, os.IsPermission(client.Chmod("app.lock", 0600)))
+	f, err := client.Open("/app.lock")
+	require.NoError(t, err)
+	defer f.Close()
+	assert.True(t, os.IsPermission(f.Chmod(0600)))
+	_, err = os.Stat(filepath.Join(root, "app.lock"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,8 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package sftp
+
+import "syscall"
+
+// oNoFollow fails opening a symbolic link.
+const oNoFollow = syscall.O_NOFOLLOW
@@ -0,0 +1,241 @@
+package sftp
+
+import "github.com/pkg/errors"
+
+// limitsExtension is answered with the limits of the server, as specified
+// by the PROTOCOL file of OpenSSH, for clients to size their requests.
+const limitsExtension = "limits@openssh.com"
+
+// limitsWriteOverhead is the room left in a packet for the fields of a
+// write request other than its data, as OpenSSH does.
+const limitsWriteOverhead = 1024
+
+type sshFxpExtendedPacketLimits struct {
+	ID              uint32
+	ExtendedRequest string
+}
+
+func (p *sshFxpExtendedPacketLimits) id() uint32     { return p.ID }
+func (p *sshFxpExtendedPacketLimits) readonly() bool { return true }
+func (p *sshFxpExtendedPacketLimits) MarshalBinary() ([]byte, error) {
+	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
+		4 + len(limitsExtension)
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtended)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, limitsExtension)
+
+	return b, nil
+}
+
+func (p *sshFxpExtendedPacketLimits) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.ExtendedRequest, _, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *sshFxpExtendedPacketLimits) respond(s *Server) responsePacket {
+	return serverLimits(p.ID, s.limits)
+}
+
+// sshFxpLimitsPacket is the SSH_FXP_EXTENDED_REPLY to limits@openssh.com.
+// A limit of 0 is no limit.
+type sshFxpLimitsPacket struct {
+	ID              uint32
+	MaxPacketLength uint64
+	MaxReadLength   uint64
+	MaxWriteLength  uint64
+	MaxOpenHandles  uint64
+}
+
+func (p *sshFxpLimitsPacket) id() uint32 { return p.ID }
+
+func (p *sshFxpLimitsPacket) MarshalBinary() ([]byte, error) {
+	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
+		4*8 // 4*uint64
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtendedReply)
+	b = marshalUint32(b, p.ID)
+	b = marshalUint64(b, p.MaxPacketLength)
+	b = marshalUint64(b, p.MaxReadLength)
+	b = marshalUint64(b, p.MaxWriteLength)
+	b = marshalUint64(b, p.MaxOpenHandles)
+
+	return b, nil
+}
+
+// errTooManyHandles fails the opening of a file beyond the MaxOpenHandles
+// set by WithLimits or WithRSLimits.
+var errTooManyHandles = errors.New("too many open handles")
+
+// tooManyHandles returns the error failing the opening of a handle beyond
+// the max of t, telling the client the limit of the session.
+func (t *handleTable) tooManyHandles() error {
+	return errors.Errorf("%s: at most %d per session", errTooManyHandles, t.max)
+}
+
+// WithLimits sets the limits the Server advertises with the
+// limits@openssh.com extension, for the clients to size their requests.
+// The limits not set, or higher than what the Server accepts, are the ones
+// it accepts: packets of 256KiB, with reads of at most 32KiB. Longer reads
+// are shortened to MaxReadLength, and the files and directories opened
+// beyond MaxOpenHandles at once fail to open, with a SSH_FX_FAILURE telling
+// the limit, for the clients leaking handles not to exhaust those of the
+// server. The other limits are only advertised.
+//
+// The RequestServer equivalent is WithRSLimits.
+func WithLimits(l Limits) ServerOption {
+	return func(s *Server) error {
+		s.limits = l
+		s.openFiles.max = int64(l.MaxOpenHandles)
+		return nil
+	}
+}
+
+// WithRSLimits sets the limits the RequestServer advertises with the
+// limits@openssh.com extension, as WithLimits does for Server.
+//
+// The Server equivalent is WithLimits.
+func WithRSLimits(l Limits) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.limits = l
+		rs.openRequests.max = int64(l.MaxOpenHandles)
+	}
+}
+
+// serverLimits returns the limits advertised by Server and RequestServer:
+// the ones they enforce, incoming packets of at most maxMsgLength and data
+// read clamped to maxTxPacket, lowered to the ones set.
+func serverLimits(id uint32, set Limits) *sshFxpLimitsPacket {
+	l := Limits{
+		MaxPacketLength: maxMsgLength,
+		MaxReadLength:   uint64(maxTxPacket),
+		MaxWriteLength:  maxMsgLength - limitsWriteOverhead,
+	}.lower(set)
+	return &sshFxpLimitsPacket{
+		ID:              id,
+		MaxPacketLength: l.MaxPacketLength,
+		MaxReadLength:   l.MaxReadLength,
+		MaxWriteLength:  l.MaxWriteLength,
+		MaxOpenHandles:  l.MaxOpenHandles,
+	}
+}
+
+// lower returns l with the limits set in to, where lower.
+func (l Limits) lower(to Limits) Limits {
+	for _, v := range []struct{ l, to *uint64 }{
+		{&l.MaxPacketLength, &to.MaxPacketLength},
+		{&l.MaxReadLength, &to.MaxReadLength},
+		{&l.MaxWriteLength, &to.MaxWriteLength},
+		{&l.MaxOpenHandles, &to.MaxOpenHandles},
+	} {
+		if *v.to > 0 && (*v.l == 0 || *v.to < *v.l) {
+			*v.l = *v.to
+		}
+	}
+	return l
+}
+
+// clampRead shortens pkt, if a read, to the MaxReadLength of l.
+func (l Limits) clampRead(pkt requestPacket) {
+	if p, ok := pkt.(*sshFxpReadPacket); ok && l.MaxReadLength > 0 && uint64(p.Len) > l.MaxReadLength {
+		p.Len = uint32(l.MaxReadLength)
+	}
+}
+
+// Limits are the limits of a server, as advertised with the
+// limits@openssh.com extension. A limit of 0 is no limit, or not known.
+type Limits struct {
+	MaxPacketLength uint64 // of the packets sent to the server
+	MaxReadLength   uint64 // of the data of a read request
+	MaxWriteLength  uint64 // of the data of a write request
+	MaxOpenHandles  uint64
+}
+
+// Limits returns the limits of the server, queried by the Client when
+// connecting, or the zero Limits if the server does not support the
+// limits@openssh.com extension.
+//
+// The size of the reads and writes the Client makes, see MaxPacket, is set
+// to what the server allows, unless set by an option, in which case it is
+// lowered to fit.
+func (c *Client) Limits() Limits {
+	return c.limits
+}
+
+// applyLimits queries the limits of the server, if it supports it, and
+// tunes the options of the Client to them. A server failing the query is
+// treated as not supporting it.
+func (c *Client) applyLimits() error {
+	if _, ok := c.HasExtension(limitsExtension); !ok {
+		return nil
+	}
+
+	id := c.nextID()
+	typ, data, err := c.sendPacket(nil, &sshFxpExtendedPacketLimits{ID: id})
+	if err != nil {
+		return err
+	}
+	if typ == sshFxpStatus {
+		return nil
+	}
+	limits, err := unmarshalLimitsReply(id, typ, data)
+	if err != nil {
+		return err
+	}
+	c.limits = limits
+
+	if size := limits.dataLength(); size > 0 && (!c.maxPacketSet || c.maxPacket > size) {
+		c.maxPacket = size
+	}
+	return nil
+}
+
+// dataLength returns the largest data the Client may read or write in a
+// request within the limits, and receive in a reply, or 0 if none of the
+// limits on the data is set.
+func (l Limits) dataLength() int {
+	if l.MaxPacketLength == 0 && l.MaxReadLength == 0 && l.MaxWriteLength == 0 {
+		return 0
+	}
+	size := uint64(maxMsgLength - limitsWriteOverhead)
+	if n := l.MaxPacketLength; n > limitsWriteOverhead && n-limitsWriteOverhead < size {
+		size = n - limitsWriteOverhead
+	}
+	for _, n := range []uint64{l.MaxReadLength, l.MaxWriteLength} {
+		if n > 0 && n < size {
+			size = n
+		}
+	}
+	return int(size)
+}
+
+// unmarshalLimitsReply returns the limits of the reply to the limits
+// request id.
+func unmarshalLimitsReply(id uint32, typ byte, data []byte) (Limits, error) {
+	switch typ {
+	case sshFxpExtendedReply:
+		sid, data, err := unmarshalUint32Safe(data)
+		if err != nil {
+			return Limits{}, err
+		}
+		if sid != id {
+			return Limits{}, &unexpectedIDErr{id, sid}
+		}
+		var l Limits
+		for _, v := range []*uint64{&l.MaxPacketLength, &l.MaxReadLength, &l.MaxWriteLength, &l.MaxOpenHandles} {
+			if *v, data, err = unmarshalUint64Safe(data); err != nil {
+				return Limits{}, err
+			}
+		}
+		return l, nil
+	default:
+		return Limits{}, unimplementedPacketErr(typ)
+	}
+}
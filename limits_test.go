@@ -0,0 +1,205 @@
+package sftp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requestLimits sends a limits@openssh.com request to the server of c.
+func requestLimits(t *testing.T, c *Client) sshFxpLimitsPacket {
+	_, ok := c.HasExtension(limitsExtension)
+	require.True(t, ok, "server doesn't list limits extension")
+
+	id := c.nextID()
+	typ, data, err := c.clientConn.sendPacket(nil, &sshFxpExtendedPacketLimits{ID: id})
+	require.NoError(t, err)
+	require.EqualValues(t, sshFxpExtendedReply, typ)
+
+	var limits sshFxpLimitsPacket
+	limits.ID, data = unmarshalUint32(data)
+	limits.MaxPacketLength, data = unmarshalUint64(data)
+	limits.MaxReadLength, data = unmarshalUint64(data)
+	limits.MaxWriteLength, data = unmarshalUint64(data)
+	limits.MaxOpenHandles, data = unmarshalUint64(data)
+	require.Empty(t, data)
+	require.Equal(t, id, limits.ID)
+	return limits
+}
+
+func checkLimits(t *testing.T, limits sshFxpLimitsPacket) {
+	assert.EqualValues(t, maxMsgLength, limits.MaxPacketLength)
+	assert.EqualValues(t, maxTxPacket, limits.MaxReadLength)
+	assert.EqualValues(t, maxMsgLength-limitsWriteOverhead, limits.MaxWriteLength)
+	assert.Zero(t, limits.MaxOpenHandles)
+}
+
+func TestServerLimits(t *testing.T) {
+	client, server := clientServerPair(t, ReadOnly())
+	defer client.Close()
+	defer server.Close()
+
+	checkLimits(t, requestLimits(t, client))
+	checkServerAllocator(t, server)
+}
+
+func TestRequestLimits(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+
+	checkLimits(t, requestLimits(t, p.cli))
+	checkRequestServerAllocator(t, p)
+}
+
+func TestClientLimits(t *testing.T) {
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	assert.Equal(t, Limits{
+		MaxPacketLength: maxMsgLength,
+		MaxReadLength:   uint64(maxTxPacket),
+		MaxWriteLength:  maxMsgLength - limitsWriteOverhead,
+	}, client.Limits())
+	assert.Equal(t, int(maxTxPacket), client.maxPacket)
+	assert.Equal(t, 64, client.maxConcurrentRequests)
+}
+
+// limitsServer answers the handshake of a Client, advertising limits, and
+// its limits request.
+func limitsServer(t *testing.T, limits Limits, opts ...ClientOption) *Client {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	t.Cleanup(func() {
+		sw.Close()
+		sr.Close()
+	})
+
+	go func() {
+		if _, _, err := recvPacket(sr, nil, 0); err != nil {
+			return
+		}
+		sendPacket(sw, &sshFxVersionPacket{
+			Version:    sftpProtocolVersion,
+			Extensions: []sshExtensionPair{{limitsExtension, "1"}},
+		})
+		_, data, err := recvPacket(sr, nil, 0)
+		if err != nil {
+			return
+		}
+		id, _ := unmarshalUint32(data)
+		sendPacket(sw, &sshFxpLimitsPacket{
+			ID:              id,
+			MaxPacketLength: limits.MaxPacketLength,
+			MaxReadLength:   limits.MaxReadLength,
+			MaxWriteLength:  limits.MaxWriteLength,
+			MaxOpenHandles:  limits.MaxOpenHandles,
+		})
+	}()
+
+	client, err := NewClientPipe(cr, cw, opts...)
+	require.NoError(t, err)
+	return client
+}
+
+func TestClientLimitsTuning(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		limits   Limits
+		opts     []ClientOption
+		packet   int
+		requests int
+	}{
+		{"none", Limits{}, nil, 1 << 15, 64},
+		{"raised", Limits{MaxReadLength: 1 << 17, MaxWriteLength: 1 << 16}, nil, 1 << 16, 64},
+		{"packet length", Limits{MaxPacketLength: 1 << 14}, nil, 1<<14 - limitsWriteOverhead, 64},
+		{"beyond replies", Limits{MaxReadLength: 1 << 30, MaxWriteLength: 1 << 30}, nil, maxMsgLength - limitsWriteOverhead, 64},
+		{"handles", Limits{MaxOpenHandles: 16}, nil, 1 << 15, 64},
+		{"options", Limits{MaxReadLength: 1 << 20, MaxWriteLength: 1 << 20, MaxOpenHandles: 16},
+			[]ClientOption{MaxPacketUnchecked(1 << 16), MaxConcurrentRequestsPerFile(100)}, 1 << 16, 100},
+		{"options lowered", Limits{MaxReadLength: 1 << 12, MaxWriteLength: 1 << 12},
+			[]ClientOption{MaxPacket(1 << 14)}, 1 << 12, 64},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := limitsServer(t, tt.limits, tt.opts...)
+			assert.Equal(t, tt.limits, client.Limits())
+			assert.Equal(t, tt.packet, client.maxPacket)
+			assert.Equal(t, tt.requests, client.maxConcurrentRequests)
+		})
+	}
+}
+
+// setLimits lower the read length and the open handles, and exceed the
+// packet length the servers accept.
+var setLimits = Limits{MaxPacketLength: 1 << 20, MaxReadLength: 4096, MaxOpenHandles: 2}
+
+// checkSetLimits checks the servers enforce and advertise setLimits, using
+// the file p of 8192 bytes.
+func checkSetLimits(t *testing.T, c *Client, p string) {
+	limits := requestLimits(t, c)
+	assert.EqualValues(t, maxMsgLength, limits.MaxPacketLength)
+	assert.EqualValues(t, 4096, limits.MaxReadLength)
+	assert.EqualValues(t, maxMsgLength-limitsWriteOverhead, limits.MaxWriteLength)
+	assert.EqualValues(t, 2, limits.MaxOpenHandles)
+	assert.Equal(t, 4096, c.maxPacket)
+
+	f1, err := c.Open(p)
+	require.NoError(t, err)
+	defer f1.Close()
+	f2, err := c.Open(p)
+	require.NoError(t, err)
+	_, err = c.Open(p)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), errTooManyHandles.Error()+": at most 2 per session")
+	assert.Contains(t, err.Error(), "SSH_FX_FAILURE")
+	_, err = c.ReadDir(path.Dir(p))
+	require.Error(t, err)
+	require.NoError(t, f2.Close())
+	_, err = c.ReadDir(path.Dir(p))
+	require.NoError(t, err)
+
+	// a read longer than MaxReadLength is shortened
+	id := c.nextID()
+	typ, data, err := c.clientConn.sendPacket(nil, &sshFxpReadPacket{ID: id, Handle: f1.handle, Len: 8192})
+	require.NoError(t, err)
+	require.EqualValues(t, sshFxpData, typ)
+	_, data = unmarshalUint32(data)
+	n, _ := unmarshalUint32(data)
+	assert.EqualValues(t, 4096, n)
+}
+
+func TestServerSetLimits(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t, WithLimits(setLimits))
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-limits")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(p, make([]byte, 8192), 0600))
+
+	checkSetLimits(t, client, filepath.ToSlash(p))
+	checkServerAllocator(t, server)
+}
+
+func TestRequestSetLimits(t *testing.T) {
+	p := clientRequestServerPair(t, WithRSLimits(setLimits))
+	defer p.Close()
+
+	require.NoError(t, p.cli.Mkdir("/dir"))
+	_, err := putTestFile(p.cli, "/dir/file", string(make([]byte, 8192)))
+	require.NoError(t, err)
+
+	checkSetLimits(t, p.cli, "/dir/file")
+	checkRequestServerAllocator(t, p)
+}
@@ -0,0 +1,99 @@
+package sftp
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ChanLister returns a ListerAt listing the entries received from ch, until
+// ch is closed, for Filelist to stream a listing without holding all of it.
+// The sender should stop once the context of the Request is done, as it is
+// when the client closes the directory without listing it all.
+func ChanLister(ch <-chan os.FileInfo) ListerAt {
+	return FuncLister(func() (os.FileInfo, error) {
+		fi, ok := <-ch
+		if !ok {
+			return nil, io.EOF
+		}
+		return fi, nil
+	})
+}
+
+// ContextListerAt returns a ListerAt listing the entries of l, for a
+// FileLister to return. The RequestServer lists them with the context of the
+// Request; a plain ListAt lists them with context.Background().
+func ContextListerAt(l ListerAtContext) ListerAt {
+	return contextListerAt{l}
+}
+
+type contextListerAt struct {
+	l ListerAtContext
+}
+
+func (l contextListerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	return l.l.ListAt(context.Background(), ls, offset)
+}
+
+// listAt lists the entries of lister from offset into ls, with ctx if it is
+// a ListerAtContext wrapped with ContextListerAt.
+func listAt(ctx context.Context, lister ListerAt, ls []os.FileInfo, offset int64) (int, error) {
+	if l, ok := lister.(contextListerAt); ok {
+		return l.l.ListAt(ctx, ls, offset)
+	}
+	return lister.ListAt(ls, offset)
+}
+
+// FuncLister returns a ListerAt listing the entries returned by next, until
+// it returns an error, for Filelist to stream a listing without holding all
+// of it. next returns io.EOF at the end of the listing; another error is
+// returned to the client once the entries before it are listed.
+func FuncLister(next func() (os.FileInfo, error)) ListerAt {
+	return &streamLister{next: next}
+}
+
+// streamLister lists the entries of next, buffering those from the offset
+// of the last ListAt on, which the server lists again if they are not all
+// sent in a single response.
+type streamLister struct {
+	next func() (os.FileInfo, error)
+
+	mu     sync.Mutex
+	offset int64 // of buf[0]
+	buf    []os.FileInfo
+	err    error // returned by next
+}
+
+func (l *streamLister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if offset < l.offset {
+		return 0, errors.Errorf("sftp: listing from offset %d, already past %d", offset, l.offset)
+	}
+	want := offset - l.offset + int64(len(ls))
+	for int64(len(l.buf)) < want && l.err == nil {
+		fi, err := l.next()
+		if err != nil {
+			l.err = err
+			break
+		}
+		l.buf = append(l.buf, fi)
+	}
+
+	skip := offset - l.offset
+	if skip > int64(len(l.buf)) {
+		skip = int64(len(l.buf))
+	}
+	l.buf = append(l.buf[:0], l.buf[skip:]...)
+	l.offset += skip
+
+	n := copy(ls, l.buf)
+	if n < len(ls) {
+		return n, l.err
+	}
+	return n, nil
+}
@@ -0,0 +1,167 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntries(n int) []os.FileInfo {
+	entries := make([]os.FileInfo, n)
+	for i := range entries {
+		entries[i] = &memFile{name: fmt.Sprintf("file%03d", i)}
+	}
+	return entries
+}
+
+func TestFuncLister(t *testing.T) {
+	entries := testEntries(10)
+	var calls int
+	l := FuncLister(func() (os.FileInfo, error) {
+		if calls == len(entries) {
+			return nil, io.EOF
+		}
+		calls++
+		return entries[calls-1], nil
+	})
+
+	ls := make([]os.FileInfo, 4)
+	n, err := l.ListAt(ls, 0)
+	require.NoError(t, err)
+	assert.Equal(t, entries[:4], ls[:n])
+	assert.Equal(t, 4, calls)
+
+	// listing again the entries not all sent
+	n, err = l.ListAt(ls, 2)
+	require.NoError(t, err)
+	assert.Equal(t, entries[2:6], ls[:n])
+	assert.Equal(t, 6, calls)
+
+	n, err = l.ListAt(ls, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, entries[8:], ls[:n])
+
+	_, err = l.ListAt(ls, 2)
+	assert.Error(t, err)
+}
+
+func TestChanListerError(t *testing.T) {
+	ch := make(chan os.FileInfo)
+	go func() {
+		for _, fi := range testEntries(3) {
+			ch <- fi
+		}
+		close(ch)
+	}()
+	l := ChanLister(ch)
+
+	ls := make([]os.FileInfo, 2)
+	n, err := l.ListAt(ls, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = l.ListAt(ls, 2)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, n)
+
+	failing := FuncLister(func() (os.FileInfo, error) { return nil, os.ErrPermission })
+	n, err = failing.ListAt(ls, 0)
+	assert.Equal(t, os.ErrPermission, err)
+	assert.Equal(t, 0, n)
+}
+
+// streamingLister lists directories of many entries from a channel.
+type streamingLister struct {
+	FileLister
+	n int
+}
+
+func (l streamingLister) Filelist(r *Request) (ListerAt, error) {
+	if r.Method != "List" {
+		return l.FileLister.Filelist(r)
+	}
+	ch := make(chan os.FileInfo)
+	go func() {
+		defer close(ch)
+		for _, fi := range testEntries(l.n) {
+			select {
+			case ch <- fi:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+	return ChanLister(ch), nil
+}
+
+func TestRequestChanLister(t *testing.T) {
+	handlers := InMemHandler()
+	handlers.FileList = streamingLister{handlers.FileList, 1000}
+
+	client, _ := handlersClientPair(t, handlers, nil, WithRSMaxFilelist(128))
+
+	fis, err := client.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, fis, 1000)
+	for i, fi := range fis {
+		assert.Equal(t, fmt.Sprintf("file%03d", i), fi.Name())
+	}
+}
+
+// ctxLister records the contexts its directory listings are given.
+type ctxLister struct {
+	FileLister
+	ctxs chan context.Context
+}
+
+func (l ctxLister) Filelist(r *Request) (ListerAt, error) {
+	if r.Method != "List" {
+		return l.FileLister.Filelist(r)
+	}
+	return ContextListerAt(ctxListerAt{listerat(testEntries(10)), l.ctxs}), nil
+}
+
+type ctxListerAt struct {
+	ListerAt
+	ctxs chan context.Context
+}
+
+func (l ctxListerAt) ListAt(ctx context.Context, ls []os.FileInfo, offset int64) (int, error) {
+	select {
+	case l.ctxs <- ctx:
+	default:
+	}
+	return l.ListerAt.ListAt(ls, offset)
+}
+
+func TestRequestListerAtContext(t *testing.T) {
+	handlers := InMemHandler()
+	ctxs := make(chan context.Context, 1)
+	handlers.FileList = ctxLister{handlers.FileList, ctxs}
+
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	fis, err := client.ReadDir("/")
+	require.NoError(t, err)
+	assert.Len(t, fis, 10)
+
+	ctx := <-ctxs
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context of the listing not canceled once the directory closed")
+	}
+
+	// listed without the RequestServer
+	l := ContextListerAt(ctxListerAt{listerat(testEntries(3)), ctxs})
+	ls := make([]os.FileInfo, 4)
+	n, err := l.ListAt(ls, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, context.Background(), <-ctxs)
+}
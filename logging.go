@@ -0,0 +1,151 @@
+package sftp
+
+import "time"
+
+// Logger receives a RequestEvent for each request a Client sends, or a
+// Server or RequestServer serves, once replied, see UseLogger, WithLogger
+// and WithRSLogger. LogRequest is called as the replies are received, or
+// before they are sent, and should not block.
+type Logger interface {
+	LogRequest(e RequestEvent)
+}
+
+// LoggerFunc is a function as a Logger.
+type LoggerFunc func(e RequestEvent)
+
+// LogRequest calls f(e).
+func (f LoggerFunc) LogRequest(e RequestEvent) {
+	f(e)
+}
+
+// RequestEvent describes a request and its reply.
+type RequestEvent struct {
+	// Method is the packet type of the request, as "SSH_FXP_READ", or the
+	// name of an extended request.
+	Method string
+	// Path is the path of a request on a path, and Handle the handle of a
+	// request on a handle.
+	Path   string
+	Handle string
+	// Duration is the time from the request sent to its reply received,
+	// for a Client, and from the request received to its reply being
+	// sent, for a server.
+	Duration time.Duration
+	// Bytes is the length of the file data read or written.
+	Bytes int
+	// Err is the *StatusError of a reply with a status other than
+	// SSH_FX_OK, such as SSH_FX_EOF, or the *PanicError of a request whose
+	// serving panicked, for a server.
+	Err error
+}
+
+// UseLogger sets the Logger of the requests the Client sends.
+func UseLogger(l Logger) ClientOption {
+	return func(c *Client) error {
+		c.clientConn.logger = l
+		return nil
+	}
+}
+
+// WithLogger sets the Logger of the requests the Server serves.
+//
+// The RequestServer equivalent is WithRSLogger.
+func WithLogger(l Logger) ServerOption {
+	return func(s *Server) error {
+		s.pktMgr.logger = l
+		return nil
+	}
+}
+
+// WithRSLogger sets the Logger of the requests the RequestServer serves.
+//
+// The Server equivalent is WithLogger.
+func WithRSLogger(l Logger) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.pktMgr.logger = l
+	}
+}
+
+// newRequestEvent returns the event of the request pkt, sent or received at
+// start, without its reply.
+func newRequestEvent(pkt interface{}, start time.Time) RequestEvent {
+	e := RequestEvent{Duration: pkgClock.Now().Sub(start)}
+	if p, ok := pkt.(*versionedPacket); ok {
+		pkt = p.idmarshaler
+	}
+	if p, ok := pkt.(requestPacket); ok {
+		e.Method = packetMethod(p)
+		e.Path = packetPath(p)
+	}
+	if p, ok := pkt.(hasHandle); ok {
+		e.Handle = p.getHandle()
+	}
+	if p, ok := pkt.(*sshFxpWritePacket); ok {
+		e.Bytes = len(p.Data)
+	}
+	return e
+}
+
+// logged returns whether the requests are logged, or measured.
+func (s *packetManager) logged() bool {
+	return s.logger != nil || s.metrics != nil
+}
+
+// logResponse logs and measures the request in, served with the reply out.
+func (s *packetManager) logResponse(in orderedRequest, out orderedResponse) {
+	e := newRequestEvent(in.requestPacket, in.received)
+	switch p := out.responsePacket.(type) {
+	case *sshFxpStatusPacket:
+		if p.StatusError.Code != sshFxOk {
+			err := p.StatusError
+			e.Err = &err
+		}
+	case *panicStatus:
+		e.Err = p.err
+	case *sshFxpDataPacket:
+		e.Bytes = len(p.Data)
+	case *sshFxpFileDataPacket:
+		e.Bytes = int(p.Length)
+	}
+	if s.logger != nil {
+		s.logger.LogRequest(e)
+	}
+	if s.metrics != nil {
+		observeRequest(s.metrics, e)
+	}
+}
+
+// logged returns whether the requests are logged, or measured.
+func (c *clientConn) logged() bool {
+	return c.logger != nil || c.metrics != nil
+}
+
+// logReply logs and measures the request pkt, sent at start, with the reply
+// of type typ and payload data.
+func (c *clientConn) logReply(pkt idmarshaler, start time.Time, typ uint8, data []byte) {
+	e := newRequestEvent(pkt, start)
+	switch typ {
+	case sshFxpStatus:
+		if err, ok := unmarshalStatus(pkt.id(), data).(*StatusError); ok && err.Code != sshFxOk {
+			e.Err = err
+		}
+	case sshFxpData:
+		if _, data, err := unmarshalUint32Safe(data); err == nil {
+			l, _, _ := unmarshalUint32Safe(data)
+			e.Bytes = int(l)
+		}
+	}
+	if c.logger != nil {
+		c.logger.LogRequest(e)
+	}
+	if c.metrics != nil {
+		observeRequest(c.metrics, e)
+		switch {
+		case typ == sshFxpHandle:
+			c.metrics.AddOpenHandles(1)
+		case e.Method == fxp(sshFxpClose).String():
+			// the handle is gone, even if closing its file failed
+			c.metrics.AddOpenHandles(-1)
+		}
+	}
+}
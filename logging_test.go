@@ -0,0 +1,125 @@
+package sftp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventLog collects the events logged to it.
+type eventLog struct {
+	mu     sync.Mutex
+	events []RequestEvent
+}
+
+func (l *eventLog) LogRequest(e RequestEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+}
+
+// find returns the events of method.
+func (l *eventLog) find(method string) []RequestEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []RequestEvent
+	for _, e := range l.events {
+		if e.Method == method {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// checkLoggedRequests writes and reads back the file p with client, and
+// checks the events logged of it.
+func checkLoggedRequests(t *testing.T, client *Client, log *eventLog, p string) {
+	f, err := client.Create(p)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = client.Open(p)
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	n, err := f.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(b[:n]))
+	_, err = f.Read(b)
+	assert.Equal(t, io.EOF, err)
+	require.NoError(t, f.Close())
+
+	opens := log.find("SSH_FXP_OPEN")
+	require.Len(t, opens, 2)
+	for _, e := range opens {
+		assert.Equal(t, p, e.Path)
+		assert.NoError(t, e.Err)
+	}
+
+	writes := log.find("SSH_FXP_WRITE")
+	require.Len(t, writes, 1)
+	assert.NotEmpty(t, writes[0].Handle)
+	assert.Equal(t, 4, writes[0].Bytes)
+
+	reads := log.find("SSH_FXP_READ")
+	require.Len(t, reads, 2)
+	assert.NotEmpty(t, reads[0].Handle)
+	assert.Equal(t, 4, reads[0].Bytes)
+	assert.NoError(t, reads[0].Err)
+	assert.Equal(t, 0, reads[1].Bytes)
+	if assert.IsType(t, &StatusError{}, reads[1].Err) {
+		assert.Equal(t, uint32(sshFxEOF), reads[1].Err.(*StatusError).Code)
+	}
+
+	assert.Len(t, log.find("SSH_FXP_CLOSE"), 2)
+}
+
+func TestClientLogger(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	require.NoError(t, err)
+	go server.Serve()
+	log := new(eventLog)
+	client, err := NewClientPipe(cr, cw, UseLogger(log))
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-logger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	checkLoggedRequests(t, client, log, filepath.ToSlash(filepath.Join(dir, "file")))
+}
+
+func TestServerLogger(t *testing.T) {
+	log := new(eventLog)
+	client, server := clientServerPair(t, WithLogger(log))
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-logger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	checkLoggedRequests(t, client, log, filepath.ToSlash(filepath.Join(dir, "file")))
+}
+
+func TestRequestLogger(t *testing.T) {
+	log := new(eventLog)
+	p := clientRequestServerPair(t, WithRSLogger(log))
+	defer p.Close()
+
+	checkLoggedRequests(t, p.cli, log, "/file")
+}
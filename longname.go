@@ -0,0 +1,56 @@
+package sftp
+
+import (
+	"os"
+)
+
+// LongNameFormatter returns the longname of the entry fi of the directory
+// dirname, listed in the reply to a SSH_FXP_READDIR. Clients display it as
+// is, and some parse it, expecting the output of ls -l: a formatter sets
+// the columns, the owner and group, and the dates to send.
+type LongNameFormatter func(dirname string, fi os.FileInfo) string
+
+// FormatLongName is the LongNameFormatter used by default, formatting the
+// entries like the OpenSSH server does. Owners and groups are their IDs,
+// or their names for a server set with a NamesLookup.
+func FormatLongName(dirname string, fi os.FileInfo) string {
+	return runLs(nil, dirname, fi)
+}
+
+// WithLongNameFormatter sets the formatter of the longnames of the
+// directory entries listed. The RequestServer equivalent is
+// WithRSLongNameFormatter.
+func WithLongNameFormatter(format LongNameFormatter) ServerOption {
+	return func(s *Server) error {
+		s.longName = format
+		return nil
+	}
+}
+
+// WithRSLongNameFormatter sets the formatter of the longnames of the
+// directory entries listed by the FileLister. The Server equivalent is
+// WithLongNameFormatter.
+func WithRSLongNameFormatter(format LongNameFormatter) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.longName = format
+	}
+}
+
+// formatLongName formats fi with format, or FormatLongName if nil.
+func formatLongName(format LongNameFormatter, dirname string, fi os.FileInfo) string {
+	if format == nil {
+		return runLs(nil, dirname, fi)
+	}
+	return format(dirname, fi)
+}
+
+// longNameFormatter returns format, or if nil and names is not, the
+// formatting of FormatLongName with the names of names.
+func longNameFormatter(format LongNameFormatter, names NamesLookup) LongNameFormatter {
+	if format != nil || names == nil {
+		return format
+	}
+	return func(dirname string, fi os.FileInfo) string {
+		return runLs(names, dirname, fi)
+	}
+}
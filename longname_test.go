@@ -0,0 +1,78 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readdirLongNames lists the directory p with c, and returns the longnames
+// sent by the server.
+func readdirLongNames(t *testing.T, c *Client, p string) []string {
+	handle, err := c.opendir(context.Background(), p)
+	require.NoError(t, err)
+	defer c.close(handle)
+
+	var longNames []string
+	for {
+		id := c.nextID()
+		typ, data, err := c.sendPacket(nil, &sshFxpReaddirPacket{ID: id, Handle: handle})
+		require.NoError(t, err)
+		if typ == sshFxpStatus {
+			require.Equal(t, io.EOF, normaliseError(unmarshalStatus(id, data)))
+			sort.Strings(longNames)
+			return longNames
+		}
+		require.EqualValues(t, sshFxpName, typ)
+		_, data = unmarshalUint32(data)
+		count, data := unmarshalUint32(data)
+		for i := uint32(0); i < count; i++ {
+			var longName string
+			_, data = unmarshalString(data)
+			longName, data = unmarshalString(data)
+			_, data = unmarshalAttrs(data)
+			longNames = append(longNames, longName)
+		}
+	}
+}
+
+func testLongName(dirname string, fi os.FileInfo) string {
+	return fmt.Sprintf("%s %d %s", fi.Mode(), fi.Size(), fi.Name())
+}
+
+func TestServerLongNameFormatter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-longname")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+
+	client, server := clientServerPair(t, WithLongNameFormatter(testLongName))
+	defer client.Close()
+	defer server.Close()
+
+	assert.Equal(t, []string{"-rw-r--r-- 4 file"}, readdirLongNames(t, client, dir))
+}
+
+func TestRequestLongNameFormatter(t *testing.T) {
+	p := clientRequestServerPair(t, WithRSLongNameFormatter(testLongName))
+	defer p.Close()
+
+	putTestFile(p.cli, "/file", "data")
+	assert.Equal(t, []string{"-rw-r--r-- 4 file"}, readdirLongNames(t, p.cli, "/"))
+
+	p2 := clientRequestServerPair(t)
+	defer p2.Close()
+
+	putTestFile(p2.cli, "/file", "data")
+	longNames := readdirLongNames(t, p2.cli, "/")
+	require.Len(t, longNames, 1)
+	assert.Regexp(t, `^-rw-r--r-- +0 .* 4 .* file$`, longNames[0])
+}
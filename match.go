@@ -1,6 +1,8 @@
 package sftp
 
 import (
+	"errors"
+	"os"
 	"path"
 	"strings"
 )
@@ -32,15 +34,35 @@ func Split(p string) (dir, file string) {
 	return path.Split(p)
 }
 
+// ErrGlobLimit is returned by Glob, along with the matches found, once it
+// has found the number of matches set by WithMatchLimit.
+var ErrGlobLimit = errors.New("sftp: glob match limit reached")
+
+// WithMatchLimit stops Glob once it has found n matches, which it returns
+// along with ErrGlobLimit, for patterns such as "/**" not to list a whole
+// tree. 0, the default, sets no limit.
+func WithMatchLimit(n int) TransferOption {
+	return func(o *transferOptions) {
+		o.matchLimit = n
+	}
+}
+
 // Glob returns the names of all files matching pattern or nil
 // if there is no matching file. The syntax of patterns is the same
 // as in Match. The pattern may describe hierarchical names such as
 // /usr/*/bin/ed.
 //
+// An element "**" of the pattern matches any number of directories,
+// including none, such as "logs/**/*.gz" does "logs/a.gz" and
+// "logs/2021/01/b.gz"; the links to directories are not followed, and a
+// trailing "**" matches all the files under the directory it ends. Only
+// the directories of the elements with magic characters are listed, the
+// files named by the other elements are looked for with Lstat.
+//
 // Glob ignores file system errors such as I/O errors reading directories.
-// The only possible returned error is ErrBadPattern, when pattern
-// is malformed.
-func (c *Client) Glob(pattern string) (matches []string, err error) {
+// The only possible returned errors are ErrBadPattern, when pattern
+// is malformed, and ErrGlobLimit.
+func (c *Client) Glob(pattern string, opts ...TransferOption) (matches []string, err error) {
 	if !hasMeta(pattern) {
 		file, err := c.Lstat(pattern)
 		if err != nil {
@@ -51,30 +73,27 @@ func (c *Client) Glob(pattern string) (matches []string, err error) {
 		return []string{Join(dir, file.Name())}, nil
 	}
 
-	dir, file := Split(pattern)
-	dir = cleanGlobPath(dir)
-
-	if !hasMeta(dir) {
-		return c.glob(dir, file, nil)
+	g := &globber{c: c, limit: newTransferOptions(opts).matchLimit}
+	dir := "."
+	if strings.HasPrefix(pattern, "/") {
+		dir = "/"
 	}
-
-	// Prevent infinite recursion. See issue 15879.
-	if dir == pattern {
-		return nil, ErrBadPattern
+	var elems []string
+	for _, elem := range strings.Split(pattern, "/") {
+		switch {
+		case elem == "":
+		case elem == "**" && len(elems) > 0 && elems[len(elems)-1] == "**":
+			// the same as a single one
+		default:
+			elems = append(elems, elem)
+		}
 	}
 
-	var m []string
-	m, err = c.Glob(dir)
-	if err != nil {
-		return
-	}
-	for _, d := range m {
-		matches, err = c.glob(d, file, matches)
-		if err != nil {
-			return
-		}
+	err = g.glob(dir, elems)
+	if err == errGlobLimit {
+		err = ErrGlobLimit
 	}
-	return
+	return g.matches, err
 }
 
 // cleanGlobPath prepares path for glob matching.
@@ -89,35 +108,84 @@ func cleanGlobPath(path string) string {
 	}
 }
 
-// glob searches for files matching pattern in the directory dir
-// and appends them to matches. If the directory cannot be
-// opened, it returns the existing matches. New matches are
-// added in lexicographical order.
-func (c *Client) glob(dir, pattern string, matches []string) (m []string, e error) {
-	m = matches
-	fi, err := c.Stat(dir)
-	if err != nil {
-		return
+// errGlobLimit stops a globber once it has its limit of matches.
+var errGlobLimit = errors.New("glob limit")
+
+// globber collects the matches of a pattern, element by element.
+type globber struct {
+	c       *Client
+	limit   int
+	matches []string
+}
+
+func (g *globber) add(p string) error {
+	g.matches = append(g.matches, p)
+	if g.limit > 0 && len(g.matches) >= g.limit {
+		return errGlobLimit
+	}
+	return nil
+}
+
+// glob adds the matches of the pattern elements elems in the directory dir.
+// The directories which cannot be listed have no matches.
+func (g *globber) glob(dir string, elems []string) error {
+	elem, rest := elems[0], elems[1:]
+
+	if !hasMeta(elem) {
+		p := Join(dir, elem)
+		if len(rest) > 0 {
+			return g.glob(p, rest)
+		}
+		if _, err := g.c.Lstat(p); err != nil {
+			return nil
+		}
+		return g.add(p)
 	}
-	if !fi.IsDir() {
-		return
+
+	if elem == "**" && len(rest) > 0 {
+		// no directory
+		if err := g.glob(dir, rest); err != nil {
+			return err
+		}
 	}
-	names, err := c.ReadDir(dir)
+	list, err := g.c.ReadDir(dir)
 	if err != nil {
-		return
+		return nil
 	}
-	//sort.Strings(names)
+	for _, fi := range list {
+		p := Join(dir, fi.Name())
+		if elem == "**" {
+			if len(rest) == 0 {
+				if err := g.add(p); err != nil {
+					return err
+				}
+			}
+			if fi.IsDir() {
+				if err := g.glob(p, elems); err != nil {
+					return err
+				}
+			}
+			continue
+		}
 
-	for _, n := range names {
-		matched, err := Match(pattern, n.Name())
+		matched, err := Match(elem, fi.Name())
 		if err != nil {
-			return m, err
+			return err
 		}
-		if matched {
-			m = append(m, Join(dir, n.Name()))
+		switch {
+		case !matched:
+		case len(rest) == 0:
+			if err := g.add(p); err != nil {
+				return err
+			}
+		case fi.IsDir() || fi.Mode()&os.ModeSymlink != 0:
+			// the links may lead to directories
+			if err := g.glob(p, rest); err != nil {
+				return err
+			}
 		}
 	}
-	return
+	return nil
 }
 
 // Join joins any number of path elements into a single path, separating
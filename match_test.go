@@ -0,0 +1,106 @@
+package sftp
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listCounter records the directories listed through its FileLister.
+type listCounter struct {
+	FileLister
+
+	mu     sync.Mutex
+	listed []string
+}
+
+func (l *listCounter) Filelist(r *Request) (ListerAt, error) {
+	if r.Method == "List" {
+		l.mu.Lock()
+		l.listed = append(l.listed, r.Filepath)
+		l.mu.Unlock()
+	}
+	return l.FileLister.Filelist(r)
+}
+
+func (l *listCounter) reset() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	listed := l.listed
+	l.listed = nil
+	sort.Strings(listed)
+	return listed
+}
+
+func globClient(t *testing.T) (*Client, *listCounter) {
+	h := InMemHandler()
+	lister := &listCounter{FileLister: h.FileList}
+	h.FileList = lister
+
+	client, _ := handlersClientPair(t, h, nil)
+
+	for _, dir := range []string{"/logs/2021/01", "/logs/2021/02", "/logs/old", "/src"} {
+		require.NoError(t, client.MkdirAll(dir))
+	}
+	for _, name := range []string{"/logs/a.gz", "/logs/2021/01/b.gz", "/logs/2021/02/c.gz", "/logs/2021/02/c.txt", "/src/main.go"} {
+		_, err := putTestFile(client, name, "data")
+		require.NoError(t, err)
+	}
+	lister.reset()
+	return client, lister
+}
+
+func TestGlobElements(t *testing.T) {
+	client, lister := globClient(t)
+
+	matches, err := client.Glob("/logs/*/02/c.gz")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/logs/2021/02/c.gz"}, matches)
+	// only the directory of the element with magic characters
+	assert.Equal(t, []string{"/logs"}, lister.reset())
+
+	matches, err = client.Glob("/*/main.go")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/src/main.go"}, matches)
+	assert.Equal(t, []string{"/"}, lister.reset())
+
+	matches, err = client.Glob("/logs/missing/*")
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestGlobRecursive(t *testing.T) {
+	client, _ := globClient(t)
+
+	matches, err := client.Glob("/logs/**/*.gz")
+	require.NoError(t, err)
+	sort.Strings(matches)
+	assert.Equal(t, []string{"/logs/2021/01/b.gz", "/logs/2021/02/c.gz", "/logs/a.gz"}, matches)
+
+	matches, err = client.Glob("/logs/**/**/02")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/logs/2021/02"}, matches)
+
+	matches, err = client.Glob("/logs/2021/**")
+	require.NoError(t, err)
+	sort.Strings(matches)
+	assert.Equal(t, []string{
+		"/logs/2021/01", "/logs/2021/01/b.gz",
+		"/logs/2021/02", "/logs/2021/02/c.gz", "/logs/2021/02/c.txt",
+	}, matches)
+}
+
+func TestGlobMatchLimit(t *testing.T) {
+	client, _ := globClient(t)
+
+	matches, err := client.Glob("/**", WithMatchLimit(3))
+	assert.Equal(t, ErrGlobLimit, err)
+	assert.Len(t, matches, 3)
+
+	matches, err = client.Glob("/logs/*.gz", WithMatchLimit(3))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/logs/a.gz"}, matches)
+}
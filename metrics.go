@@ -0,0 +1,63 @@
+package sftp
+
+import "time"
+
+// Metrics receives the measures of the requests a Client sends, or a Server
+// or RequestServer serves, see UseMetrics, WithMetrics and WithRSMetrics,
+// for them to be exported as counters, histograms and gauges, such as the
+// ones of Prometheus or OpenTelemetry. Its methods are called concurrently,
+// and should not block.
+type Metrics interface {
+	// ObserveRequest observes a request of method, as "SSH_FXP_READ",
+	// replied after d with the status code, which is SSH_FX_OK for the
+	// replies other than a status, and bytes of file data read or written.
+	ObserveRequest(method string, code uint32, d time.Duration, bytes int)
+	// AddOpenHandles adds delta, which may be negative, to the number of
+	// open handles.
+	AddOpenHandles(delta int)
+}
+
+// UseMetrics sets the Metrics of the requests the Client sends. The open
+// handles are the ones the server returned, and the Client did not close
+// yet.
+func UseMetrics(m Metrics) ClientOption {
+	return func(c *Client) error {
+		c.clientConn.metrics = m
+		return nil
+	}
+}
+
+// WithMetrics sets the Metrics of the requests the Server serves, and of
+// the files it has open.
+//
+// The RequestServer equivalent is WithRSMetrics.
+func WithMetrics(m Metrics) ServerOption {
+	return func(s *Server) error {
+		s.pktMgr.metrics = m
+		s.openFiles.metrics = m
+		return nil
+	}
+}
+
+// WithRSMetrics sets the Metrics of the requests the RequestServer serves,
+// and of the Requests it has open.
+//
+// The Server equivalent is WithMetrics.
+func WithRSMetrics(m Metrics) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.pktMgr.metrics = m
+		rs.openRequests.metrics = m
+	}
+}
+
+// observeRequest passes the measures of e to m.
+func observeRequest(m Metrics, e RequestEvent) {
+	code := uint32(sshFxOk)
+	switch err := e.Err.(type) {
+	case *StatusError:
+		code = err.Code
+	case *PanicError:
+		code = sshFxFailure
+	}
+	m.ObserveRequest(e.Method, code, e.Duration, e.Bytes)
+}
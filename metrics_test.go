@@ -0,0 +1,128 @@
+package sftp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMetrics counts the requests and handles measured.
+type testMetrics struct {
+	mu       sync.Mutex
+	requests map[string]int // by method and code
+	bytes    map[string]int // by method
+	handles  int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		requests: make(map[string]int),
+		bytes:    make(map[string]int),
+	}
+}
+
+func (m *testMetrics) ObserveRequest(method string, code uint32, d time.Duration, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[method+" "+fx(code).String()]++
+	m.bytes[method] += bytes
+}
+
+func (m *testMetrics) AddOpenHandles(delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handles += delta
+}
+
+func (m *testMetrics) openHandles() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.handles
+}
+
+// checkMetrics writes and reads back the file p with client, and checks
+// the measures of it.
+func checkMetrics(t *testing.T, client *Client, m *testMetrics, p string) {
+	f, err := client.Create(p)
+	require.NoError(t, err)
+	assert.Equal(t, 1, m.openHandles())
+	_, err = f.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, 0, m.openHandles())
+
+	f, err = client.Open(p)
+	require.NoError(t, err)
+	assert.Equal(t, 1, m.openHandles())
+	b := make([]byte, 4)
+	_, err = f.Read(b)
+	require.NoError(t, err)
+	_, err = f.Read(b)
+	assert.Equal(t, io.EOF, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, 0, m.openHandles())
+
+	_, err = client.Stat(p + ".missing")
+	assert.True(t, os.IsNotExist(err), "got %v", err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	assert.Equal(t, 2, m.requests["SSH_FXP_OPEN SSH_FX_OK"])
+	assert.Equal(t, 1, m.requests["SSH_FXP_WRITE SSH_FX_OK"])
+	assert.Equal(t, 1, m.requests["SSH_FXP_READ SSH_FX_OK"])
+	assert.Equal(t, 1, m.requests["SSH_FXP_READ SSH_FX_EOF"])
+	assert.Equal(t, 2, m.requests["SSH_FXP_CLOSE SSH_FX_OK"])
+	assert.Equal(t, 1, m.requests["SSH_FXP_STAT SSH_FX_NO_SUCH_FILE"])
+	assert.Equal(t, 4, m.bytes["SSH_FXP_WRITE"])
+	assert.Equal(t, 4, m.bytes["SSH_FXP_READ"])
+}
+
+func TestClientMetrics(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	require.NoError(t, err)
+	go server.Serve()
+	m := newTestMetrics()
+	client, err := NewClientPipe(cr, cw, UseMetrics(m))
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	checkMetrics(t, client, m, filepath.ToSlash(filepath.Join(dir, "file")))
+}
+
+func TestServerMetrics(t *testing.T) {
+	m := newTestMetrics()
+	client, server := clientServerPair(t, WithMetrics(m))
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	checkMetrics(t, client, m, filepath.ToSlash(filepath.Join(dir, "file")))
+}
+
+func TestRequestMetrics(t *testing.T) {
+	m := newTestMetrics()
+	p := clientRequestServerPair(t, WithRSMetrics(m))
+	defer p.Close()
+
+	checkMetrics(t, p.cli, m, "/file")
+}
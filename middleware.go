@@ -0,0 +1,58 @@
+package sftp
+
+import "context"
+
+// Handler handles a Request of a RequestServer by calling its Handlers,
+// see WithRSMiddleware.
+type Handler interface {
+	HandleRequest(r *Request) error
+}
+
+// HandlerFunc is a function as a Handler.
+type HandlerFunc func(r *Request) error
+
+// HandleRequest calls f(r).
+func (f HandlerFunc) HandleRequest(r *Request) error {
+	return f(r)
+}
+
+// WithRSMiddleware wraps each call of the Handlers with the middleware,
+// the first one outermost, for logging, authorizing or measuring the
+// Requests without implementing the Handlers again. A middleware returns
+// the Handler calling next, once it is done with the Request: it may change
+// the Request before, such as its Filepath or Target, and must then call
+// next with it. It may instead not call next, and return an error to the
+// client, to deny the Request. The error of next is the one of the
+// Handlers, which the middleware may replace.
+//
+// The Requests are those given to the Handlers, after the fallbacks of the
+// RequestServer, such as the Stat of an Lstat for a FileLister which is not
+// a LstatFileLister.
+func WithRSMiddleware(middleware ...func(next Handler) Handler) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.middleware = append(rs.middleware, middleware...)
+	}
+}
+
+type middlewareKey struct{}
+
+// baseContext returns the context the Requests of rs derive from, with the
+// client info and the middleware.
+func (rs *RequestServer) baseContext() context.Context {
+	ctx := context.WithValue(context.Background(), clientInfoKey{}, &rs.client)
+	if len(rs.middleware) > 0 {
+		ctx = context.WithValue(ctx, middlewareKey{}, rs.middleware)
+	}
+	return ctx
+}
+
+// handleRequest calls h with r, through the middleware of the
+// RequestServer r is from, if any.
+func handleRequest(r *Request, h HandlerFunc) error {
+	middleware, _ := r.Context().Value(middlewareKey{}).([]func(next Handler) Handler)
+	var next Handler = h
+	for i := len(middleware) - 1; i >= 0; i-- {
+		next = middleware[i](next)
+	}
+	return next.HandleRequest(r)
+}
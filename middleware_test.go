@@ -0,0 +1,80 @@
+package sftp
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requestLog records the Requests it sees, as middleware.
+type requestLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *requestLog) middleware(name string) func(next Handler) Handler {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) error {
+			l.mu.Lock()
+			l.calls = append(l.calls, name+" "+r.Method+" "+r.Filepath)
+			l.mu.Unlock()
+			return next.HandleRequest(r)
+		})
+	}
+}
+
+func (l *requestLog) take() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	calls := l.calls
+	l.calls = nil
+	return calls
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	var log requestLog
+	rewrite := func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) error {
+			if r.Filepath == "/alias" {
+				r.Filepath = "/file"
+			}
+			return next.HandleRequest(r)
+		})
+	}
+	deny := func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) error {
+			if r.Method == "Rename" {
+				return ErrSSHFxPermissionDenied
+			}
+			return next.HandleRequest(r)
+		})
+	}
+	p := clientRequestServerPair(t, WithRSMiddleware(log.middleware("outer"), rewrite), WithRSMiddleware(log.middleware("inner"), deny))
+	defer p.Close()
+
+	_, err := putTestFile(p.cli, "/file", "data")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"outer Open /file", "inner Open /file"}, log.take())
+
+	fi, err := p.cli.Stat("/alias")
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, fi.Size())
+	assert.Equal(t, []string{"outer Stat /alias", "inner Stat /file"}, log.take())
+
+	_, err = p.cli.Lstat("/file")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"outer Lstat /file", "inner Lstat /file"}, log.take())
+
+	_, err = p.cli.ReadDir("/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"outer List /", "inner List /"}, log.take())
+
+	err = p.cli.Rename("/file", "/other")
+	assert.True(t, os.IsPermission(err), "got %v", err)
+	assert.Equal(t, []string{"outer Rename /file", "inner Rename /file"}, log.take())
+	_, err = p.cli.Stat("/file")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,98 @@
+package sftp
+
+import (
+	"os"
+	runtimedebug "runtime/debug"
+
+	"github.com/pkg/errors"
+)
+
+// WithMmapReads memory-maps the regular files of at least minSize bytes
+// opened read-only, and serves their reads from the mapping, which saves
+// a read syscall per request on hot large-file downloads. Reads past the
+// end of the mapping, such as of data appended after the open, and reads
+// of a mapping made invalid by the truncation of the file, fall back to
+// reading the file. Platforms without mmap ignore the option.
+func WithMmapReads(minSize int64) ServerOption {
+	return func(s *Server) error {
+		if minSize < 1 {
+			return errors.New("minSize must be greater or equal to 1")
+		}
+		s.mmapMinSize = minSize
+		return nil
+	}
+}
+
+// mmapReadOnly returns the mapping of f, opened read-only, or nil if f is
+// not to be mapped.
+func (svr *Server) mmapReadOnly(f *os.File) []byte {
+	if svr.mmapMinSize == 0 {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() < svr.mmapMinSize {
+		return nil
+	}
+	return mmapRegular(f, fi)
+}
+
+// mmapRegular returns the mapping of f, opened for reading, with the
+// FileInfo fi, or nil if f is not a regular file or cannot be mapped.
+func mmapRegular(f *os.File, fi os.FileInfo) []byte {
+	if !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return nil
+	}
+	size := int(fi.Size())
+	if int64(size) != fi.Size() {
+		// too large for the address space
+		return nil
+	}
+	mapped, err := mmapFile(f, size)
+	if err != nil {
+		return nil
+	}
+	return mapped
+}
+
+// readAt reads the file from its mapping, if any.
+func (f *serverFile) readAt(b []byte, off int64) (int, error) {
+	f.mapMu.RLock()
+	defer f.mapMu.RUnlock()
+
+	var n int
+	if off >= 0 && off < int64(len(f.mapped)) {
+		n = copyMapped(b, f.mapped[off:])
+		if n == len(b) {
+			return n, nil
+		}
+	}
+	m, err := f.ReadAt(b[n:], off+int64(n))
+	return n + m, err
+}
+
+// copyMapped copies src, part of a mapping, to dst. It returns 0 if
+// reading src faults, such as when the mapped file got truncated.
+func copyMapped(dst, src []byte) (n int) {
+	defer runtimedebug.SetPanicOnFault(runtimedebug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			n = 0
+		}
+	}()
+	return copy(dst, src)
+}
+
+// close closes the file and removes its mapping, if any.
+func (f *serverFile) close() error {
+	err := f.Close()
+
+	f.mapMu.Lock()
+	defer f.mapMu.Unlock()
+	if f.mapped != nil {
+		if err2 := munmapFile(f.mapped); err == nil {
+			err = err2
+		}
+		f.mapped = nil
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package sftp
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported")
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
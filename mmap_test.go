@@ -0,0 +1,129 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerMmapReads(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+	client, server := clientServerPair(t, WithMmapReads(64*1024))
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-mmap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	large := filepath.Join(dir, "large")
+	require.NoError(t, ioutil.WriteFile(large, content, 0644))
+	small := filepath.Join(dir, "small")
+	require.NoError(t, ioutil.WriteFile(small, content[:1024], 0644))
+
+	mapped := func(f *File) []byte {
+		sf, ok := server.getServerFile(f.handle)
+		require.True(t, ok)
+		return sf.mapped
+	}
+
+	f, err := client.Open(large)
+	require.NoError(t, err)
+	assert.Len(t, mapped(f), len(content))
+	got, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// data appended after the open is read from the file
+	appended := []byte("appended")
+	af, err := os.OpenFile(large, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = af.Write(appended)
+	require.NoError(t, err)
+	require.NoError(t, af.Close())
+	buf := make([]byte, 2*len(appended))
+	_, err = f.ReadAt(buf, int64(len(content)-len(appended)))
+	require.NoError(t, err)
+	assert.Equal(t, append(content[len(content)-len(appended):], appended...), buf)
+	require.NoError(t, f.Close())
+
+	f, err = client.Open(small)
+	require.NoError(t, err)
+	assert.Nil(t, mapped(f))
+	require.NoError(t, f.Close())
+
+	f, err = client.OpenFile(large, os.O_RDWR)
+	require.NoError(t, err)
+	assert.Nil(t, mapped(f))
+	require.NoError(t, f.Close())
+}
+
+func TestServerMmapReadsTruncated(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+	dir, err := ioutil.TempDir("", "sftptest-mmap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(name, make([]byte, 256*1024), 0644))
+	osf, err := os.Open(name)
+	require.NoError(t, err)
+
+	svr := &Server{mmapMinSize: 1}
+	f := &serverFile{File: osf, mapped: svr.mmapReadOnly(osf)}
+	require.NotNil(t, f.mapped)
+	defer f.close()
+
+	require.NoError(t, os.Truncate(name, 1024))
+	buf := make([]byte, 32*1024)
+	n, err := f.readAt(buf, 128*1024)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWithMmapReadsInvalid(t *testing.T) {
+	assert.Error(t, WithMmapReads(0)(&Server{}))
+}
+
+func TestUploadMmap(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	dir, err := ioutil.TempDir("", "sftptest-mmap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024+1)
+	src := filepath.Join(dir, "src")
+	require.NoError(t, ioutil.WriteFile(src, content, 0644))
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, ioutil.WriteFile(empty, nil, 0644))
+
+	for _, concurrent := range []bool{false, true} {
+		client, server := clientServerPair(t)
+		client.useConcurrentWrites = concurrent
+
+		dst := filepath.Join(dir, "dst")
+		require.NoError(t, client.Upload(src, dst, UseMmap()))
+		got, err := ioutil.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, content, got, "concurrent writes %v", concurrent)
+
+		require.NoError(t, client.Upload(empty, dst, UseMmap()))
+		got, err = ioutil.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Empty(t, got)
+
+		server.Close()
+		client.Close()
+	}
+}
@@ -0,0 +1,377 @@
+package sftp
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errCrossMount is returned for the renames and links across the mounts of
+// MountHandlers.
+var errCrossMount = errors.New("cross-mount rename or link not supported")
+
+// MountHandlers returns the Handlers serving each path with the Handlers
+// mounted on the longest prefix of the path, like a mount table: with
+// Handlers mounted on "/home" and "/archive", "/home/user/file" is served as
+// "/user/file" by the Handlers of "/home".
+//
+// The mount points are listed in the directories they are in, such as "/"
+// if nothing is mounted on it, as directories. Renames and links from one
+// mount to another fail, as do renames and removals of the mount points.
+// The paths returned by the RealPath and the Readlink of the Handlers
+// mounted are made paths of the mount table again.
+func MountHandlers(mounts map[string]Handlers) Handlers {
+	m := &mountTable{created: pkgClock.Now()}
+	for prefix, h := range mounts {
+		m.mounts = append(m.mounts, mount{prefix: cleanPath(prefix), h: h})
+	}
+	// longest prefixes first
+	sort.Slice(m.mounts, func(i, j int) bool {
+		return len(m.mounts[i].prefix) > len(m.mounts[j].prefix)
+	})
+	return Handlers{m, m, m, m}
+}
+
+type mount struct {
+	prefix string
+	h      Handlers
+}
+
+// inner returns the path of p within the mount, if under it.
+func (m *mount) inner(p string) (string, bool) {
+	switch {
+	case m.prefix == "/":
+		return p, true
+	case p == m.prefix:
+		return "/", true
+	case strings.HasPrefix(p, m.prefix+"/"):
+		return p[len(m.prefix):], true
+	}
+	return "", false
+}
+
+// outer returns the path of the path p of the mount.
+func (m *mount) outer(p string) string {
+	return path.Join(m.prefix, p)
+}
+
+type mountTable struct {
+	mounts  []mount // longest prefixes first
+	created time.Time
+}
+
+// lookup returns the mount serving p, and the path of p within it.
+func (m *mountTable) lookup(p string) (*mount, string, bool) {
+	for i := range m.mounts {
+		if inner, ok := m.mounts[i].inner(p); ok {
+			return &m.mounts[i], inner, true
+		}
+	}
+	return nil, "", false
+}
+
+// mountPoints returns the names of the entries of dir leading to mount
+// points, as directories.
+func (m *mountTable) mountPoints(dir string) []os.FileInfo {
+	var entries []os.FileInfo
+	seen := make(map[string]bool)
+	dirPrefix := strings.TrimSuffix(dir, "/") + "/"
+	for _, mnt := range m.mounts {
+		if mnt.prefix == "/" || !strings.HasPrefix(mnt.prefix, dirPrefix) {
+			continue
+		}
+		name := strings.SplitN(mnt.prefix[len(dirPrefix):], "/", 2)[0]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		entries = append(entries, m.dirInfo(name))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+func (m *mountTable) dirInfo(name string) os.FileInfo {
+	return &fileInfo{name: name, mode: os.ModeDir | 0755, mtime: m.created}
+}
+
+// route returns the mount serving r, and a copy of r with the paths of the
+// mount.
+func (m *mountTable) route(r *Request) (*mount, *Request, error) {
+	mnt, inner, ok := m.lookup(r.Filepath)
+	if r.Method == "Symlink" {
+		// the link is the Target, and the Filepath what it points to
+		mnt, inner, ok = m.lookup(r.Target)
+	}
+	if !ok {
+		// the directories leading to the mount points are read-only
+		if len(m.mountPoints(r.Filepath)) > 0 || len(m.mountPoints(path.Dir(r.Filepath))) > 0 {
+			return nil, nil, ErrSSHFxPermissionDenied
+		}
+		return nil, nil, os.ErrNotExist
+	}
+
+	r2 := r.copy()
+	switch r.Method {
+	case "Rename", "PosixRename", "Link", "CopyFile":
+		if r.Method != "Link" && inner == "/" {
+			return nil, nil, ErrSSHFxPermissionDenied
+		}
+		target, ok := mnt.inner(r.Target)
+		if !ok {
+			return nil, nil, errCrossMount
+		}
+		if target == "/" {
+			return nil, nil, ErrSSHFxPermissionDenied
+		}
+		r2.Filepath, r2.Target = inner, target
+	case "Symlink":
+		r2.Target = inner
+		if path.IsAbs(r.Filepath) {
+			target, ok := mnt.inner(r.Filepath)
+			if !ok {
+				return nil, nil, errCrossMount
+			}
+			r2.Filepath = target
+		}
+	case "Remove", "Rmdir":
+		if inner == "/" {
+			return nil, nil, ErrSSHFxPermissionDenied
+		}
+		r2.Filepath = inner
+	default:
+		r2.Filepath = inner
+	}
+	return mnt, r2, nil
+}
+
+func (m *mountTable) Fileread(r *Request) (io.ReaderAt, error) {
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		return nil, err
+	}
+	return mnt.h.FileGet.Fileread(r2)
+}
+
+func (m *mountTable) Filewrite(r *Request) (io.WriterAt, error) {
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		return nil, err
+	}
+	return mnt.h.FilePut.Filewrite(r2)
+}
+
+// OpenFile implements OpenFileWriter, falling back to Filewrite for the
+// Handlers which do not: the file can then not be read.
+func (m *mountTable) OpenFile(r *Request) (WriterAtReaderAt, error) {
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		return nil, err
+	}
+	if openFileWriter, ok := mnt.h.FilePut.(OpenFileWriter); ok {
+		return openFileWriter.OpenFile(r2)
+	}
+	r2.Method = "Put"
+	wr, err := mnt.h.FilePut.Filewrite(r2)
+	if err != nil {
+		return nil, err
+	}
+	if rw, ok := wr.(WriterAtReaderAt); ok {
+		return rw, nil
+	}
+	return writeOnlyFile{wr}, nil
+}
+
+// writeOnlyFile is a WriterAtReaderAt which cannot be read.
+type writeOnlyFile struct {
+	io.WriterAt
+}
+
+func (writeOnlyFile) ReadAt([]byte, int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (m *mountTable) Filecmd(r *Request) error {
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		return err
+	}
+	if r2.Method == "Setstat" {
+		return setstat(mnt.h.FileCmd, r2)
+	}
+	return mnt.h.FileCmd.Filecmd(r2)
+}
+
+// PosixRename implements PosixRenameFileCmder, falling back to Rename for
+// the Handlers which do not.
+func (m *mountTable) PosixRename(r *Request) error {
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		return err
+	}
+	if posixRenamer, ok := mnt.h.FileCmd.(PosixRenameFileCmder); ok {
+		return posixRenamer.PosixRename(r2)
+	}
+	r2.Method = "Rename"
+	return mnt.h.FileCmd.Filecmd(r2)
+}
+
+// StatVFS implements StatVFSFileCmder, for the Handlers which do.
+func (m *mountTable) StatVFS(r *Request) (*StatVFS, error) {
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		return nil, err
+	}
+	if statVFSCmdr, ok := mnt.h.FileCmd.(StatVFSFileCmder); ok {
+		return statVFSCmdr.StatVFS(r2)
+	}
+	return nil, ErrSSHFxOpUnsupported
+}
+
+// Fsync implements FsyncFileCmder, for the Handlers which do.
+func (m *mountTable) Fsync(r *Request) error {
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		return err
+	}
+	if syncer, ok := mnt.h.FileCmd.(FsyncFileCmder); ok {
+		return syncer.Fsync(r2)
+	}
+	return ErrSSHFxOpUnsupported
+}
+
+// CopyFile implements CopyFileWriter, for the Handlers which do.
+func (m *mountTable) CopyFile(r *Request) error {
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		return err
+	}
+	if copier, ok := mnt.h.FilePut.(CopyFileWriter); ok {
+		return copier.CopyFile(r2)
+	}
+	return ErrSSHFxOpUnsupported
+}
+
+// Checksum implements ChecksumFileLister, for the Handlers which do.
+func (m *mountTable) Checksum(r *Request, algorithm string, offset, length int64) ([]byte, error) {
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		return nil, err
+	}
+	if lister, ok := mnt.h.FileList.(ChecksumFileLister); ok {
+		return lister.Checksum(r2, algorithm, offset, length)
+	}
+	return nil, ErrSSHFxOpUnsupported
+}
+
+func (m *mountTable) Filelist(r *Request) (ListerAt, error) {
+	return m.list(r, func(h FileLister, r2 *Request) (ListerAt, error) {
+		return h.Filelist(r2)
+	})
+}
+
+// Lstat implements LstatFileLister, falling back to Stat for the Handlers
+// which do not.
+func (m *mountTable) Lstat(r *Request) (ListerAt, error) {
+	return m.list(r, func(h FileLister, r2 *Request) (ListerAt, error) {
+		if lstatFileLister, ok := h.(LstatFileLister); ok {
+			return lstatFileLister.Lstat(r2)
+		}
+		r2.Method = "Stat"
+		return h.Filelist(r2)
+	})
+}
+
+func (m *mountTable) list(r *Request, list func(FileLister, *Request) (ListerAt, error)) (ListerAt, error) {
+	mountPoints := m.mountPoints(r.Filepath)
+
+	mnt, r2, err := m.route(r)
+	if err != nil {
+		if len(mountPoints) == 0 {
+			return nil, os.ErrNotExist
+		}
+		// a directory leading to mount points, not mounted itself
+		if r.Method == "List" {
+			return listerat(mountPoints), nil
+		}
+		return listerat{m.dirInfo(path.Base(r.Filepath))}, nil
+	}
+
+	lister, err := list(mnt.h.FileList, r2)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case r.Method == "Readlink":
+		return ContextListerAt(mountReadlinkLister{lister, mnt}), nil
+	case r.Method == "List" && len(mountPoints) > 0:
+		return mergeMountPoints(r.Context(), lister, mountPoints)
+	}
+	return lister, nil
+}
+
+// mergeMountPoints lists the entries of lister, with the mount points in
+// place of the entries of the same name, with ctx.
+func mergeMountPoints(ctx context.Context, lister ListerAt, mountPoints []os.FileInfo) (ListerAt, error) {
+	names := make(map[string]bool, len(mountPoints))
+	for _, fi := range mountPoints {
+		names[fi.Name()] = true
+	}
+
+	entries := append([]os.FileInfo(nil), mountPoints...)
+	buf := make([]os.FileInfo, 128)
+	for offset := int64(0); ; {
+		n, err := listAt(ctx, lister, buf, offset)
+		for _, fi := range buf[:n] {
+			if !names[fi.Name()] {
+				entries = append(entries, fi)
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || err == nil && n == 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return listerat(entries), nil
+}
+
+// mountReadlinkLister makes the absolute targets of links paths of the
+// mount table.
+type mountReadlinkLister struct {
+	lister ListerAt
+	mnt    *mount
+}
+
+func (l mountReadlinkLister) ListAt(ctx context.Context, ls []os.FileInfo, offset int64) (int, error) {
+	n, err := listAt(ctx, l.lister, ls, offset)
+	for i, fi := range ls[:n] {
+		if path.IsAbs(fi.Name()) {
+			ls[i] = renamedFileInfo{fi, l.mnt.outer(fi.Name())}
+		}
+	}
+	return n, err
+}
+
+// RealPath implements RealPathFileLister, for the Handlers which do, and
+// cleans the path otherwise.
+func (m *mountTable) RealPath(p string) (string, error) {
+	p = cleanPath(p)
+	mnt, inner, ok := m.lookup(p)
+	if !ok {
+		return p, nil
+	}
+	real, err := realPath(mnt.h.FileList, inner)
+	if err != nil {
+		return "", err
+	}
+	return mnt.outer(real), nil
+}
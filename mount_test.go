@@ -0,0 +1,94 @@
+package sftp
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readDirNames(t *testing.T, c *Client, p string) []string {
+	entries, err := c.ReadDir(p)
+	require.NoError(t, err)
+	var names []string
+	for _, fi := range entries {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestMountHandlers(t *testing.T) {
+	archive := InMemHandler()
+	client, _ := handlersClientPair(t, MountHandlers(map[string]Handlers{
+		"/home":         InMemHandler(),
+		"/archive/old":  archive,
+		"/archive/copy": archive,
+	}), nil)
+
+	_, err := putTestFile(client, "/home/file", "home")
+	require.NoError(t, err)
+	_, err = putTestFile(client, "/archive/old/file", "archive")
+	require.NoError(t, err)
+
+	// the paths are those of the mounts
+	data, err := getTestFile(client, "/archive/copy/file")
+	require.NoError(t, err)
+	assert.Equal(t, "archive", string(data))
+	data, err = getTestFile(client, "/home/file")
+	require.NoError(t, err)
+	assert.Equal(t, "home", string(data))
+
+	// the mount points are listed
+	assert.Equal(t, []string{"archive", "home"}, readDirNames(t, client, "/"))
+	assert.Equal(t, []string{"copy", "old"}, readDirNames(t, client, "/archive"))
+	assert.Equal(t, []string{"file"}, readDirNames(t, client, "/home"))
+	fi, err := client.Stat("/archive")
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	fi, err = client.Lstat("/home")
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	_, err = client.Stat("/missing")
+	assert.True(t, os.IsNotExist(err), err)
+
+	// nothing is mounted on the directories leading to the mount points
+	assert.True(t, os.IsPermission(client.Mkdir("/dir")))
+	_, err = client.Create("/archive/file")
+	assert.True(t, os.IsPermission(err), err)
+
+	// renames within a mount, not across mounts
+	require.NoError(t, client.Rename("/home/file", "/home/renamed"))
+	assert.Error(t, client.Rename("/home/renamed", "/archive/old/renamed"))
+	assert.Error(t, client.PosixRename("/home/renamed", "/archive/old/renamed"))
+	assert.True(t, os.IsPermission(client.Rename("/home", "/home2")))
+	assert.True(t, os.IsPermission(client.RemoveDirectory("/home")))
+
+	// links
+	require.NoError(t, client.Symlink("/home/renamed", "/home/link"))
+	target, err := client.ReadLink("/home/link")
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", target)
+	assert.Error(t, client.Symlink("/archive/old/file", "/home/link2"))
+
+	real, err := client.RealPath("/home/../home/renamed")
+	require.NoError(t, err)
+	assert.Equal(t, "/home/renamed", real)
+}
+
+func TestMountHandlersRoot(t *testing.T) {
+	client, _ := handlersClientPair(t, MountHandlers(map[string]Handlers{
+		"/":     InMemHandler(),
+		"/home": InMemHandler(),
+	}), nil)
+
+	_, err := putTestFile(client, "/file", "root")
+	require.NoError(t, err)
+	require.NoError(t, client.Mkdir("/home/user"))
+
+	assert.Equal(t, []string{"file", "home"}, readDirNames(t, client, "/"))
+	assert.Equal(t, []string{"user"}, readDirNames(t, client, "/home"))
+	assert.Error(t, client.Rename("/file", "/home/file"))
+}
@@ -0,0 +1,94 @@
+package sftp
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HandleInfo describes a handle open on a RequestServer, see OpenHandles.
+type HandleInfo struct {
+	Handle string
+	// Get, Put and Open for the files, List for the directories
+	Method string
+	Path   string
+	// the time the handle was opened at, and for how long it has been open
+	Opened   time.Time
+	Duration time.Duration
+	// the file data read and written through the handle so far
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// handleStats are the statistics of an open handle, shared by the copies
+// of its Request.
+type handleStats struct {
+	read, written int64 // accessed atomically, kept first for alignment
+	opened        time.Time
+
+	mu     sync.Mutex
+	method string // set once opened, the method of the Request changing until then
+}
+
+// setMethod records the method the handle was opened with.
+func (s *handleStats) setMethod(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.method = method
+}
+
+// addRead counts n bytes read through the handle.
+func (s *handleStats) addRead(n int) {
+	if s != nil && n > 0 {
+		atomic.AddInt64(&s.read, int64(n))
+	}
+}
+
+// addWritten counts n bytes written through the handle.
+func (s *handleStats) addWritten(n int) {
+	if s != nil && n > 0 {
+		atomic.AddInt64(&s.written, int64(n))
+	}
+}
+
+// OpenHandles returns the handles open on rs, the longest open first, for
+// an administrator to see the transfers in progress, and find those stuck.
+func (rs *RequestServer) OpenHandles() []HandleInfo {
+	now := pkgClock.Now()
+	var handles []HandleInfo
+	rs.openRequests.each(func(handle string, v interface{}) {
+		s := v.(*Request).stats
+		s.mu.Lock()
+		method := s.method
+		s.mu.Unlock()
+		if method == "" {
+			// still opening
+			return
+		}
+		handles = append(handles, HandleInfo{
+			Handle:       handle,
+			Method:       method,
+			Path:         v.(*Request).Filepath,
+			Opened:       s.opened,
+			Duration:     now.Sub(s.opened),
+			BytesRead:    atomic.LoadInt64(&s.read),
+			BytesWritten: atomic.LoadInt64(&s.written),
+		})
+	})
+	sort.Slice(handles, func(i, j int) bool {
+		if !handles[i].Opened.Equal(handles[j].Opened) {
+			return handles[i].Opened.Before(handles[j].Opened)
+		}
+		return handles[i].Handle < handles[j].Handle
+	})
+	return handles
+}
+
+// CloseHandle closes the handle open on rs, as the client closing it would,
+// such as to evict a transfer stuck, and returns the error of closing it,
+// or EBADF if it is not open. The requests of the client on the handle then
+// fail with EBADF.
+func (rs *RequestServer) CloseHandle(handle string) error {
+	return rs.closeRequest(handle)
+}
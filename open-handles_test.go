@@ -0,0 +1,69 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestServerOpenHandles(t *testing.T) {
+	start := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	clock := useFakeClock(t, start)
+	client, server := handlersClientPair(t, InMemHandler(), nil)
+
+	assert.Empty(t, server.OpenHandles())
+
+	w, err := client.Create("/upload")
+	require.NoError(t, err)
+	_, err = w.Write(make([]byte, 100))
+	require.NoError(t, err)
+
+	clock.Advance(time.Minute)
+	_, err = putTestFile(client, "/download", "some data")
+	require.NoError(t, err)
+	r, err := client.Open("/download")
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = io.ReadFull(r, make([]byte, 4))
+	require.NoError(t, err)
+
+	clock.Advance(time.Minute)
+	d, err := client.ReadDirIter("/")
+	require.NoError(t, err)
+	defer d.Close()
+
+	handles := server.OpenHandles()
+	require.Len(t, handles, 3)
+	assert.Equal(t, HandleInfo{
+		Handle:       w.handle,
+		Method:       "Open", // Create opens for reading too
+		Path:         "/upload",
+		Opened:       start,
+		Duration:     2 * time.Minute,
+		BytesWritten: 100,
+	}, handles[0])
+	assert.Equal(t, "Get", handles[1].Method)
+	assert.Equal(t, "/download", handles[1].Path)
+	assert.Equal(t, time.Minute, handles[1].Duration)
+	assert.Equal(t, int64(4), handles[1].BytesRead)
+	assert.Equal(t, "List", handles[2].Method)
+	assert.Equal(t, time.Duration(0), handles[2].Duration)
+
+	// evicted
+	require.NoError(t, server.CloseHandle(handles[0].Handle))
+	assert.Equal(t, EBADF, server.CloseHandle(handles[0].Handle))
+	assert.Len(t, server.OpenHandles(), 2)
+	_, err = w.Write([]byte("more"))
+	assert.Error(t, err)
+	assert.Error(t, w.Close())
+
+	fi, err := client.Stat("/upload")
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), fi.Size())
+	_, err = client.Stat("/missing")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,278 @@
+// Package opensshtest runs the sftp package against the OpenSSH binaries, to
+// test their interoperability: the Client against an OpenSSH sftp-server, and
+// servers against the OpenSSH sftp client.
+//
+// The helpers skip the test calling them if the binary they need is not found.
+package opensshtest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// serverLocations are the usual paths of sftp-server, which is rarely in the PATH.
+var serverLocations = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/sftp-server",
+	"/usr/lib/sftp-server",
+}
+
+// ServerBinary returns the path of the OpenSSH sftp-server binary, from the
+// SFTP_SERVER environment variable, the PATH, or the usual locations.
+func ServerBinary() (string, error) {
+	if p := os.Getenv("SFTP_SERVER"); p != "" {
+		return p, nil
+	}
+	if p, err := exec.LookPath("sftp-server"); err == nil {
+		return p, nil
+	}
+	for _, p := range serverLocations {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", errors.New("sftp-server binary not found")
+}
+
+// ClientBinary returns the path of the OpenSSH sftp binary, from the
+// SFTP_CLIENT environment variable or the PATH.
+func ClientBinary() (string, error) {
+	if p := os.Getenv("SFTP_CLIENT"); p != "" {
+		return p, nil
+	}
+	return exec.LookPath("sftp")
+}
+
+// NewClient starts an OpenSSH sftp-server, with the extra args, and returns a
+// Client talking to it over its standard input and output. The client is
+// closed, and the server waited for, when the test finishes.
+func NewClient(t testing.TB, args []string, opts ...sftp.ClientOption) *sftp.Client {
+	t.Helper()
+	bin, err := ServerBinary()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	cmd := exec.Command(bin, append([]string{"-e"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting %s: %v", bin, err)
+	}
+
+	client, err := sftp.NewClientPipe(r, w, opts...)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatalf("%s: %v: %s", bin, err, stderr.Bytes())
+	}
+	t.Cleanup(func() {
+		client.Close()
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("%s: %v: %s", bin, err, stderr.Bytes())
+		}
+	})
+	return client
+}
+
+// ServeSSH listens on a localhost port, returned as host:port, and serves the
+// sftp subsystem of the SSH connections accepted with serve, called with each
+// channel. Any user and public key is accepted. The listener is closed when
+// the test finishes.
+func ServeSSH(t testing.TB, serve func(channel io.ReadWriteCloser) error) string {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := serveConn(conn, config, serve); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig, serve func(io.ReadWriteCloser) error) error {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return err
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	errs := make(chan error, 1)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer channel.Close()
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				status := uint32(0)
+				if err := serve(channel); err != nil && err != io.EOF {
+					status = 1
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// RunClient runs the OpenSSH sftp client in batch mode against addr, as
+// returned by ServeSSH, with the commands of script, and returns its
+// standard output. Its error output is part of the error returned.
+func RunClient(t testing.TB, addr, script string) (string, error) {
+	t.Helper()
+	bin, err := ClientBinary()
+	if err != nil {
+		t.Skip(err)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a key of its own, not to rely on an agent
+	key, err := clientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(key)
+
+	cmd := exec.Command(bin,
+		"-b", "-",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+		"-o", "IdentityFile="+key,
+		"-o", "IdentitiesOnly=yes",
+		"-o", "BatchMode=yes",
+		"-P", port,
+		host,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewBufferString(script)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("%s: %v: %s", filepath.Base(bin), err, stderr.Bytes())
+	}
+	return stdout.String(), nil
+}
+
+// clientKey writes a new private key to a temporary file.
+func clientKey() (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "opensshtest-key-")
+	if err != nil {
+		return "", err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
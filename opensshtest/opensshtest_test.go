@@ -0,0 +1,222 @@
+package opensshtest
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testOpenSSH = flag.Bool("openssh", false, "run the interoperability tests against the OpenSSH binaries")
+
+func skipUnlessOpenSSH(t *testing.T) {
+	if !*testOpenSSH {
+		t.Skip("skipping interoperability test, enable with -openssh")
+	}
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestClient(t *testing.T) {
+	skipUnlessOpenSSH(t)
+	client := NewClient(t, nil)
+	dir := t.TempDir()
+
+	for _, ext := range []string{"posix-rename@openssh.com", "statvfs@openssh.com", "hardlink@openssh.com", "fsync@openssh.com"} {
+		_, ok := client.HasExtension(ext)
+		assert.True(t, ok, ext)
+	}
+
+	// large enough for concurrent requests, not a multiple of their size
+	data := testData(3<<20 + 17)
+	f, err := client.Create(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Close())
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	f, err = client.Open(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = f.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, data, buf.Bytes())
+
+	// reads past the end
+	n, err := f.ReadAt(make([]byte, 100), int64(len(data))-10)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, io.EOF, err)
+	n, err = f.ReadAt(make([]byte, 100), int64(len(data))+10)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	require.NoError(t, f.Close())
+
+	// an empty file
+	f, err = client.Create(filepath.Join(dir, "empty"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	fi, err := client.Stat(filepath.Join(dir, "empty"))
+	require.NoError(t, err)
+	assert.Zero(t, fi.Size())
+
+	require.NoError(t, client.Symlink(filepath.Join(dir, "file"), filepath.Join(dir, "symlink")))
+	target, err := client.ReadLink(filepath.Join(dir, "symlink"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "file"), target)
+	fi, err = client.Lstat(filepath.Join(dir, "symlink"))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeSymlink)
+
+	require.NoError(t, client.Link(filepath.Join(dir, "file"), filepath.Join(dir, "hardlink")))
+	require.NoError(t, client.PosixRename(filepath.Join(dir, "hardlink"), filepath.Join(dir, "empty")))
+	fi, err = client.Stat(filepath.Join(dir, "empty"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), fi.Size())
+	assert.Error(t, client.Rename(filepath.Join(dir, "empty"), filepath.Join(dir, "file")), "target exists")
+
+	require.NoError(t, client.Chmod(filepath.Join(dir, "file"), 0600))
+	require.NoError(t, client.Truncate(filepath.Join(dir, "file"), 10))
+	fi, err = client.Stat(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	assert.Equal(t, int64(10), fi.Size())
+
+	vfs, err := client.StatVFS(dir)
+	require.NoError(t, err)
+	assert.NotZero(t, vfs.Bsize)
+
+	// names with spaces and non-ASCII
+	name := filepath.Join(dir, "a dir", "ünïcode")
+	require.NoError(t, client.MkdirAll(name))
+	fis, err := client.ReadDir(filepath.Join(dir, "a dir"))
+	require.NoError(t, err)
+	require.Len(t, fis, 1)
+	assert.Equal(t, "ünïcode", fis[0].Name())
+
+	_, err = client.Stat(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, os.IsNotExist(client.Remove(filepath.Join(dir, "missing"))))
+	assert.Error(t, client.RemoveDirectory(filepath.Join(dir, "a dir")), "not empty")
+}
+
+func TestClientReadOnly(t *testing.T) {
+	skipUnlessOpenSSH(t)
+	client := NewClient(t, []string{"-R"})
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+
+	f, err := client.Open(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = client.Create(filepath.Join(dir, "new"))
+	assert.Error(t, err)
+	assert.Error(t, client.Remove(filepath.Join(dir, "file")))
+}
+
+// testServerAgainstClient runs a session of the OpenSSH client against serve,
+// serving the local filesystem.
+func testServerAgainstClient(t *testing.T, serve func(io.ReadWriteCloser) error) {
+	addr := ServeSSH(t, serve)
+	local, remote := t.TempDir(), t.TempDir()
+
+	data := testData(1<<20 + 17)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "in"), data, 0644))
+
+	script := strings.NewReplacer("$L", local, "$R", remote).Replace(`
+cd $R
+put $L/in in
+get in $L/out
+mkdir d
+rename in d/moved
+ln -s d/moved symlink
+ln d/moved hardlink
+chmod 600 d/moved
+ls -1
+df
+rm hardlink
+`)
+	out, err := RunClient(t, addr, script)
+	require.NoError(t, err, out)
+
+	got, err := ioutil.ReadFile(filepath.Join(local, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	got, err = ioutil.ReadFile(filepath.Join(remote, "symlink"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	fi, err := os.Stat(filepath.Join(remote, "d", "moved"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	_, err = os.Stat(filepath.Join(remote, "hardlink"))
+	assert.True(t, os.IsNotExist(err))
+
+	for _, name := range []string{"d", "symlink", "hardlink"} {
+		assert.Contains(t, out, name)
+	}
+	assert.Contains(t, out, "Size", "df output")
+
+	_, err = RunClient(t, addr, "get "+filepath.Join(remote, "missing")+" "+local+"\n")
+	assert.Error(t, err)
+}
+
+func TestServer(t *testing.T) {
+	skipUnlessOpenSSH(t)
+	testServerAgainstClient(t, func(channel io.ReadWriteCloser) error {
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return err
+		}
+		return server.Serve()
+	})
+}
+
+func TestRequestServer(t *testing.T) {
+	skipUnlessOpenSSH(t)
+	addr := ServeSSH(t, func(channel io.ReadWriteCloser) error {
+		server := sftp.NewRequestServer(channel, sftp.InMemHandler())
+		defer server.Close()
+		return server.Serve()
+	})
+	local := t.TempDir()
+	data := testData(1<<20 + 17)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "in"), data, 0644))
+
+	script := strings.NewReplacer("$L", local).Replace(`
+mkdir /d
+put $L/in /d/in
+rename /d/in /d/moved
+ln -s /d/moved /symlink
+get /symlink $L/out
+ls -1 /d
+rm /d/moved
+`)
+	out, err := RunClient(t, addr, script)
+	require.NoError(t, err, out)
+	assert.Contains(t, out, "moved")
+
+	got, err := ioutil.ReadFile(filepath.Join(local, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
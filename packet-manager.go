@@ -4,6 +4,7 @@ import (
 	"encoding"
 	"sort"
 	"sync"
+	"time"
 )
 
 // The goal of the packetManager is to keep the outgoing packets in the same
@@ -13,6 +14,7 @@ type packetManager struct {
 	requests    chan orderedPacket
 	responses   chan orderedPacket
 	fini        chan struct{}
+	flushes     chan chan struct{}
 	incoming    orderedPackets
 	outgoing    orderedPackets
 	sender      packetSender // connection object
@@ -20,6 +22,14 @@ type packetManager struct {
 	packetCount uint32
 	// it is not nil if the allocator is enabled
 	alloc *allocator
+	// if not nil, the requests are logged to it once replied
+	logger Logger
+	// if not nil, the requests are measured by it once replied
+	metrics Metrics
+	// closed once no request is awaiting its response, see flushed
+	flushWaiters []chan struct{}
+	// if not nil, told of the responses sent
+	idle *idleTimer
 }
 
 type packetSender interface {
@@ -31,11 +41,16 @@ func newPktMgr(sender packetSender) *packetManager {
 		requests:  make(chan orderedPacket, SftpServerWorkerCount),
 		responses: make(chan orderedPacket, SftpServerWorkerCount),
 		fini:      make(chan struct{}),
+		flushes:   make(chan chan struct{}),
 		incoming:  make([]orderedPacket, 0, SftpServerWorkerCount),
 		outgoing:  make([]orderedPacket, 0, SftpServerWorkerCount),
 		sender:    sender,
 		working:   &sync.WaitGroup{},
 	}
+	if sc, ok := sender.(*serverConn); ok {
+		// the session is not idle while requests are served
+		s.idle = &sc.idle
+	}
 	go s.controller()
 	return s
 }
@@ -56,11 +71,16 @@ func (s *packetManager) getNextOrderID() uint32 {
 
 type orderedRequest struct {
 	requestPacket
-	orderid uint32
+	orderid  uint32
+	received time.Time // set if the requests are logged, or measured
 }
 
 func (s *packetManager) newOrderedRequest(p requestPacket) orderedRequest {
-	return orderedRequest{requestPacket: p, orderid: s.newOrderID()}
+	r := orderedRequest{requestPacket: p, orderid: s.newOrderID()}
+	if s.logged() {
+		r.received = pkgClock.Now()
+	}
+	return r
 }
 func (p orderedRequest) orderID() uint32       { return p.orderid }
 func (p orderedRequest) setOrderID(oid uint32) { p.orderid = oid }
@@ -102,6 +122,18 @@ func (s *packetManager) readyPacket(pkt orderedResponse) {
 	s.working.Done()
 }
 
+// flushed returns a channel closed once no request is awaiting its
+// response, the responses of the requests received so far being sent.
+func (s *packetManager) flushed() <-chan struct{} {
+	ch := make(chan struct{})
+	select {
+	case s.flushes <- ch:
+	case <-s.fini:
+		close(ch)
+	}
+	return ch
+}
+
 // shut down packetManager controller
 func (s *packetManager) close() {
 	// pause until current packets are processed
@@ -161,10 +193,18 @@ func (s *packetManager) controller() {
 			debug("outgoing id (oid): %v (%v)", pkt.id(), pkt.orderID())
 			s.outgoing = append(s.outgoing, pkt)
 			s.outgoing.Sort()
+		case ch := <-s.flushes:
+			s.flushWaiters = append(s.flushWaiters, ch)
 		case <-s.fini:
 			return
 		}
 		s.maybeSendPackets()
+		if len(s.incoming) == 0 {
+			for _, ch := range s.flushWaiters {
+				close(ch)
+			}
+			s.flushWaiters = nil
+		}
 	}
 }
 
@@ -182,7 +222,11 @@ func (s *packetManager) maybeSendPackets() {
 		// debug("outgoing: %v", ids(s.outgoing))
 		if in.orderID() == out.orderID() {
 			debug("Sending packet: %v", out.id())
+			if s.logged() {
+				s.logResponse(in.(orderedRequest), out.(orderedResponse))
+			}
 			s.sender.sendPacket(out.(encoding.BinaryMarshaler))
+			s.idle.replied()
 			if s.alloc != nil {
 				// mark for reuse the slices allocated for this request
 				s.alloc.ReleasePages(in.orderID())
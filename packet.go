@@ -192,6 +192,45 @@ func recvPacket(r io.Reader, alloc *allocator, orderID uint32) (uint8, []byte, e
 	return b[0], b[1:length], nil
 }
 
+// recvDataPacket receives a packet like recvPacket, with the payload of a data
+// packet read into a buffer of buffers, and the others into new ones.
+func recvDataPacket(r io.Reader, buffers Allocator) (uint8, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+		return 0, nil, err
+	}
+	length, _ := unmarshalUint32(hdr[:])
+	if length > maxMsgLength {
+		debug("recv packet %d bytes too long", length)
+		return 0, nil, errLongPacket
+	}
+	if length == 0 {
+		debug("recv packet of 0 bytes too short")
+		return 0, nil, errShortPacket
+	}
+	if _, err := io.ReadFull(r, hdr[4:]); err != nil {
+		return 0, nil, err
+	}
+	typ := hdr[4]
+
+	var b []byte
+	if typ == sshFxpData {
+		b = buffers.Get(int(length) - 1)
+	} else {
+		b = make([]byte, length-1)
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		debug("recv packet %d bytes: err %v", length, err)
+		return 0, nil, err
+	}
+	if debugDumpRxPacketBytes {
+		debug("recv packet: %s %d bytes %x", fxp(typ), length, b)
+	} else if debugDumpRxPacket {
+		debug("recv packet: %s %d bytes", fxp(typ), length)
+	}
+	return typ, b, nil
+}
+
 type extensionPair struct {
 	Name string
 	Data string
@@ -455,6 +494,10 @@ func (p *sshFxpSymlinkPacket) UnmarshalBinary(b []byte) error {
 	return nil
 }
 
+// hardlinkExtension creates a hard link, as specified by the PROTOCOL file
+// of OpenSSH.
+const hardlinkExtension = "hardlink@openssh.com"
+
 type sshFxpHardlinkPacket struct {
 	ID      uint32
 	Oldpath string
@@ -464,7 +507,7 @@ type sshFxpHardlinkPacket struct {
 func (p *sshFxpHardlinkPacket) id() uint32 { return p.ID }
 
 func (p *sshFxpHardlinkPacket) MarshalBinary() ([]byte, error) {
-	const ext = "hardlink@openssh.com"
+	const ext = hardlinkExtension
 	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
 		4 + len(ext) +
 		4 + len(p.Oldpath) +
@@ -558,11 +601,30 @@ func (p *sshFxpNamePacket) MarshalBinary() ([]byte, error) {
 	return append(header, payload...), err
 }
 
+// fitNameAttrs returns how many of the leading nameAttrs can be sent in a
+// single SSH_FXP_NAME packet without exceeding maxMsgLength.
+// At least one entry is always counted, so a directory listing always progresses.
+func fitNameAttrs(nameAttrs []*sshFxpNameAttr) int {
+	length := 1 + 4 + 4 // byte(type) + uint32(id) + uint32(count)
+	for i, na := range nameAttrs {
+		b, _ := na.MarshalBinary() // never fails
+		length += len(b)
+		if length > maxMsgLength && i > 0 {
+			return i
+		}
+	}
+	return len(nameAttrs)
+}
+
 type sshFxpOpenPacket struct {
 	ID     uint32
 	Path   string
 	Pflags uint32
-	Flags  uint32 // ignored
+	Flags  uint32 // attribute flags
+	Attrs  interface{}
+
+	// the open flags of the protocol version 6 without a pflags equivalent
+	flagsV6 uint32
 }
 
 func (p *sshFxpOpenPacket) id() uint32 { return p.ID }
@@ -578,6 +640,7 @@ func (p *sshFxpOpenPacket) MarshalBinary() ([]byte, error) {
 	b = marshalString(b, p.Path)
 	b = marshalUint32(b, p.Pflags)
 	b = marshalUint32(b, p.Flags)
+	b = marshal(b, p.Attrs)
 
 	return b, nil
 }
@@ -590,9 +653,10 @@ func (p *sshFxpOpenPacket) UnmarshalBinary(b []byte) error {
 		return err
 	} else if p.Pflags, b, err = unmarshalUint32Safe(b); err != nil {
 		return err
-	} else if p.Flags, _, err = unmarshalUint32Safe(b); err != nil {
+	} else if p.Flags, b, err = unmarshalUint32Safe(b); err != nil {
 		return err
 	}
+	p.Attrs = b
 	return nil
 }
 
@@ -1030,15 +1094,14 @@ type sshFxpFsyncPacket struct {
 func (p *sshFxpFsyncPacket) id() uint32 { return p.ID }
 
 func (p *sshFxpFsyncPacket) MarshalBinary() ([]byte, error) {
-	const ext = "fsync@openssh.com"
 	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
-		4 + len(ext) +
+		4 + len(fsyncExtension) +
 		4 + len(p.Handle)
 
 	b := make([]byte, 4, l)
 	b = append(b, sshFxpExtended)
 	b = marshalUint32(b, p.ID)
-	b = marshalString(b, ext)
+	b = marshalString(b, fsyncExtension)
 	b = marshalString(b, p.Handle)
 
 	return b, nil
@@ -1083,8 +1146,24 @@ func (p *sshFxpExtendedPacket) UnmarshalBinary(b []byte) error {
 		p.SpecificPacket = &sshFxpExtendedPacketStatVFS{}
 	case "posix-rename@openssh.com":
 		p.SpecificPacket = &sshFxpExtendedPacketPosixRename{}
-	case "hardlink@openssh.com":
+	case hardlinkExtension:
 		p.SpecificPacket = &sshFxpExtendedPacketHardlink{}
+	case fsyncExtension:
+		p.SpecificPacket = &sshFxpExtendedPacketFsync{}
+	case pingExtension:
+		p.SpecificPacket = &sshFxpExtendedPacketPing{}
+	case limitsExtension:
+		p.SpecificPacket = &sshFxpExtendedPacketLimits{}
+	case usersGroupsExtension:
+		p.SpecificPacket = &sshFxpExtendedPacketUsersGroupsByID{}
+	case checkFileExtension:
+		p.SpecificPacket = &sshFxpExtendedPacketCheckFile{}
+	case checkFileNameExtension:
+		p.SpecificPacket = &sshFxpExtendedPacketCheckFileName{}
+	case copyDataExtension:
+		p.SpecificPacket = &sshFxpExtendedPacketCopyData{}
+	case copyFileExtension:
+		p.SpecificPacket = &sshFxpExtendedPacketCopyFile{}
 	default:
 		return errors.Wrapf(errUnknownExtendedPacket, "packet type %v", p.SpecificPacket)
 	}
@@ -1168,3 +1247,28 @@ func (p *sshFxpExtendedPacketHardlink) respond(s *Server) responsePacket {
 	err := os.Link(p.Oldpath, p.Newpath)
 	return statusFromError(p.ID, err)
 }
+
+// pingExtension is answered with an SSH_FX_OK status, without side effects,
+// so clients can probe that the server is alive without touching the filesystem.
+const pingExtension = "ping@github.com/pkg/sftp"
+
+type sshFxpExtendedPacketPing struct {
+	ID              uint32
+	ExtendedRequest string
+}
+
+func (p *sshFxpExtendedPacketPing) id() uint32     { return p.ID }
+func (p *sshFxpExtendedPacketPing) readonly() bool { return true }
+func (p *sshFxpExtendedPacketPing) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.ExtendedRequest, _, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *sshFxpExtendedPacketPing) respond(s *Server) responsePacket {
+	return statusFromError(p.ID, nil)
+}
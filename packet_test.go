@@ -311,6 +311,31 @@ func sp(data encoding.BinaryMarshaler) []byte {
 	return b.Bytes()
 }
 
+func TestFitNameAttrs(t *testing.T) {
+	na := &sshFxpNameAttr{
+		Name:     string(make([]byte, 60000)),
+		LongName: "x",
+		Attrs:    emptyFileStat,
+	}
+	// 4+60000 + 4+1 + 4 bytes per entry, so four of them fit in maxMsgLength.
+	nameAttrs := []*sshFxpNameAttr{na, na, na, na, na, na}
+	if got := fitNameAttrs(nameAttrs); got != 4 {
+		t.Errorf("fitNameAttrs: got %d want 4", got)
+	}
+	if got := fitNameAttrs(nameAttrs[:3]); got != 3 {
+		t.Errorf("fitNameAttrs: got %d want 3", got)
+	}
+
+	huge := &sshFxpNameAttr{
+		Name:     string(make([]byte, maxMsgLength)),
+		LongName: "x",
+		Attrs:    emptyFileStat,
+	}
+	if got := fitNameAttrs([]*sshFxpNameAttr{huge, na}); got != 1 {
+		t.Errorf("fitNameAttrs: got %d want 1", got)
+	}
+}
+
 func TestRecvPacket(t *testing.T) {
 	var recvPacketTests = []struct {
 		b []byte
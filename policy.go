@@ -0,0 +1,122 @@
+package sftp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Policy holds the options of the servers given it which can be changed
+// while they serve, for operators to tighten the policy of the sessions
+// running without dropping them. A change applies to the requests received
+// from then on, by every session sharing the Policy. The options of a
+// Policy apply in addition to those set when creating the servers.
+//
+// The quotas of QuotaHandlers are changed while serving by their
+// QuotaAccount, one whose Reserve checks limits it reads as they change.
+//
+// The methods of a Policy are safe for concurrent use.
+type Policy struct {
+	mu sync.Mutex // serializes changes
+	v  atomic.Value
+}
+
+type policyState struct {
+	readOnly  bool
+	denyRules denyRules
+	rateLimit int64
+}
+
+// NewPolicy returns a Policy allowing every operation.
+func NewPolicy() *Policy {
+	p := new(Policy)
+	p.v.Store(&policyState{})
+	return p
+}
+
+// WithPolicy makes the Server apply the options of p. The RequestServer
+// equivalent is WithRSPolicy.
+func WithPolicy(p *Policy) ServerOption {
+	return func(s *Server) error {
+		s.policy = p
+		s.serverConn.setPolicy(p)
+		return nil
+	}
+}
+
+// WithRSPolicy makes the RequestServer apply the options of p, before the
+// Handlers are called. The Server equivalent is WithPolicy.
+func WithRSPolicy(p *Policy) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.policy = p
+		rs.serverConn.setPolicy(p)
+	}
+}
+
+// state returns the options in force, none if p is nil.
+func (p *Policy) state() *policyState {
+	if p == nil {
+		return &policyState{}
+	}
+	return p.v.Load().(*policyState)
+}
+
+// update applies change to a copy of the options in force.
+func (p *Policy) update(change func(*policyState)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := *p.state()
+	change(&st)
+	p.v.Store(&st)
+}
+
+// SetReadOnly sets whether the requests changing files are denied with
+// a permission denied error, as with the ReadOnly option of Server.
+func (p *Policy) SetReadOnly(readOnly bool) {
+	p.update(func(st *policyState) {
+		st.readOnly = readOnly
+	})
+}
+
+// ReadOnly reports whether the requests changing files are denied.
+func (p *Policy) ReadOnly() bool {
+	return p.state().readOnly
+}
+
+// SetDenyRules replaces the rules denying operations, as set by
+// WithDenyRules and WithRSDenyRules. It returns an error, leaving the rules
+// unchanged, if a pattern is malformed.
+func (p *Policy) SetDenyRules(rules ...DenyRule) error {
+	for _, rule := range rules {
+		if err := checkDenyPattern(rule.Pattern); err != nil {
+			return err
+		}
+	}
+	rules = append([]DenyRule(nil), rules...)
+	p.update(func(st *policyState) {
+		st.denyRules = rules
+	})
+	return nil
+}
+
+// DenyRules returns the rules denying operations.
+func (p *Policy) DenyRules() []DenyRule {
+	return append([]DenyRule(nil), p.state().denyRules...)
+}
+
+// SetRateLimit caps the throughput of the data each session reads and writes
+// for its client to bytesPerSecond, as WithRateLimit and WithRSRateLimit do,
+// from the next transfer on. A bytesPerSecond of 0 or less removes the cap.
+func (p *Policy) SetRateLimit(bytesPerSecond int64) {
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	p.update(func(st *policyState) {
+		st.rateLimit = bytesPerSecond
+	})
+}
+
+// RateLimit returns the cap of the throughput of each session, 0 if none.
+func (p *Policy) RateLimit() int64 {
+	return p.state().rateLimit
+}
@@ -0,0 +1,89 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	var p *Policy
+	assert.False(t, p.ReadOnly())
+
+	p = NewPolicy()
+	assert.False(t, p.ReadOnly())
+	assert.Empty(t, p.DenyRules())
+
+	rules := []DenyRule{{Pattern: "*.lock", Ops: DenyDelete}}
+	require.NoError(t, p.SetDenyRules(rules...))
+	rules[0].Pattern = "changed"
+	assert.Equal(t, []DenyRule{{Pattern: "*.lock", Ops: DenyDelete}}, p.DenyRules())
+
+	assert.Error(t, p.SetDenyRules(DenyRule{Pattern: "[", Ops: DenyRead}))
+	assert.Len(t, p.DenyRules(), 1)
+
+	assert.Zero(t, p.RateLimit())
+	p.SetRateLimit(1024)
+	assert.EqualValues(t, 1024, p.RateLimit())
+	p.SetRateLimit(-1)
+	assert.Zero(t, p.RateLimit())
+}
+
+func TestServerPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-policy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	policy := NewPolicy()
+	client, server := clientServerPair(t, WithPolicy(policy))
+	defer client.Close()
+	defer server.Close()
+
+	testPolicy(t, client, policy, filepath.Join(dir, "a.lock"))
+}
+
+func TestRequestPolicy(t *testing.T) {
+	policy := NewPolicy()
+	p := clientRequestServerPair(t, WithRSPolicy(policy))
+	defer p.Close()
+
+	testPolicy(t, p.cli, policy, "/a.lock")
+}
+
+func testPolicy(t *testing.T, client *Client, policy *Policy, name string) {
+	f, err := client.Create(name)
+	require.NoError(t, err)
+
+	policy.SetReadOnly(true)
+	_, err = f.Write([]byte("data"))
+	assert.True(t, os.IsPermission(err), err)
+	_, err = client.Create(name + "2")
+	assert.True(t, os.IsPermission(err), err)
+	_, err = client.Stat(name)
+	assert.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	policy.SetReadOnly(false)
+	require.NoError(t, policy.SetDenyRules(DenyRule{Pattern: "*.lock", Ops: DenyDelete}))
+	assert.True(t, os.IsPermission(client.Remove(name)))
+
+	require.NoError(t, policy.SetDenyRules())
+	assert.NoError(t, client.Remove(name))
+
+	// a second of data passes at once, the rest at the rate limited
+	policy.SetRateLimit(64 * 1024)
+	start := time.Now()
+	f, err = client.Create(name)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 96*1024))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "took %v", time.Since(start))
+	policy.SetRateLimit(0)
+	assert.NoError(t, client.Remove(name))
+}
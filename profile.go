@@ -0,0 +1,145 @@
+package sftp
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The pprof labels of the goroutines serving requests and transferring files,
+// enabled with WithProfilerLabels, WithRSProfilerLabels and UseProfilerLabels.
+const (
+	// labelMethod is the packet type of a request, as "SSH_FXP_READ",
+	// the name of an extended request, or the File method of a transfer.
+	labelMethod = "sftp.method"
+	// labelPath is the first element of the path, as "/home".
+	labelPath = "sftp.path"
+	// labelSession identifies the Server, RequestServer or Client in the process.
+	labelSession = "sftp.session"
+)
+
+var lastSessionID uint64
+
+// nextSessionID returns a new session ID for the profiler labels.
+func nextSessionID() string {
+	return strconv.FormatUint(atomic.AddUint64(&lastSessionID, 1), 10)
+}
+
+// pathPrefix returns the first element of a path, with its leading slash, to
+// tell the operations on different trees apart whatever the depth of their files.
+func pathPrefix(p string) string {
+	i := 0
+	if strings.HasPrefix(p, "/") {
+		i = 1
+	}
+	if j := strings.IndexByte(p[i:], '/'); j >= 0 {
+		return p[:i+j]
+	}
+	return p
+}
+
+// profileLabels returns the labels of an operation on the path p.
+func profileLabels(session, method, p string) pprof.LabelSet {
+	return pprof.Labels(labelMethod, method, labelPath, pathPrefix(p), labelSession, session)
+}
+
+// labelRequest labels the calling goroutine, and the goroutines it starts,
+// with the request pkt on the path p, until labelled again.
+func labelRequest(session string, pkt requestPacket, p string) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), profileLabels(session, packetMethod(pkt), p)))
+}
+
+// labelTransfer labels the calling goroutine, and the goroutines it starts,
+// with the File method of a transfer if the Client uses profiler labels,
+// until the function returned is called.
+func (f *File) labelTransfer(method string) func() {
+	if f.c.profileSession == "" {
+		return func() {}
+	}
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), profileLabels(f.c.profileSession, method, f.path)))
+	return func() { pprof.SetGoroutineLabels(context.Background()) }
+}
+
+// packetMethod returns the method label of a request packet.
+func packetMethod(pkt requestPacket) string {
+	var t fxp
+	switch pkt := pkt.(type) {
+	case *sshFxInitPacket:
+		t = sshFxpInit
+	case *sshFxpOpenPacket:
+		t = sshFxpOpen
+	case *sshFxpClosePacket:
+		t = sshFxpClose
+	case *sshFxpReadPacket:
+		t = sshFxpRead
+	case *sshFxpWritePacket:
+		t = sshFxpWrite
+	case *sshFxpLstatPacket:
+		t = sshFxpLstat
+	case *sshFxpFstatPacket:
+		t = sshFxpFstat
+	case *sshFxpSetstatPacket:
+		t = sshFxpSetstat
+	case *sshFxpFsetstatPacket:
+		t = sshFxpFsetstat
+	case *sshFxpOpendirPacket:
+		t = sshFxpOpendir
+	case *sshFxpReaddirPacket:
+		t = sshFxpReaddir
+	case *sshFxpRemovePacket:
+		t = sshFxpRemove
+	case *sshFxpMkdirPacket:
+		t = sshFxpMkdir
+	case *sshFxpRmdirPacket:
+		t = sshFxpRmdir
+	case *sshFxpRealpathPacket:
+		t = sshFxpRealpath
+	case *sshFxpStatPacket:
+		t = sshFxpStat
+	case *sshFxpRenamePacket:
+		t = sshFxpRename
+	case *sshFxpReadlinkPacket:
+		t = sshFxpReadlink
+	case *sshFxpSymlinkPacket:
+		t = sshFxpSymlink
+	case *sshFxpExtendedPacket:
+		if pkt.SpecificPacket != nil {
+			return packetMethod(pkt.SpecificPacket)
+		}
+		return pkt.ExtendedRequest
+	case *sshFxpExtendedPacketStatVFS:
+		return pkt.ExtendedRequest
+	case *sshFxpExtendedPacketPosixRename:
+		return pkt.ExtendedRequest
+	case *sshFxpExtendedPacketHardlink:
+		return pkt.ExtendedRequest
+	case *sshFxpExtendedPacketPing:
+		return pkt.ExtendedRequest
+	case *sshFxpExtendedPacketLimits:
+		return pkt.ExtendedRequest
+	default:
+		t = sshFxpExtended
+	}
+	return t.String()
+}
+
+// packetPath returns the path of a request packet not using a handle.
+func packetPath(pkt requestPacket) string {
+	switch pkt := pkt.(type) {
+	case hasPath:
+		return pkt.getPath()
+	case *sshFxpExtendedPacket:
+		if pkt.SpecificPacket != nil {
+			return packetPath(pkt.SpecificPacket)
+		}
+	case *sshFxpExtendedPacketStatVFS:
+		return pkt.Path
+	case *sshFxpExtendedPacketPosixRename:
+		return pkt.Oldpath
+	case *sshFxpExtendedPacketHardlink:
+		return pkt.Oldpath
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// goroutineProfile returns the goroutine profile, with the labels of the goroutines.
+func goroutineProfile(t *testing.T) string {
+	var buf bytes.Buffer
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+	return buf.String()
+}
+
+func TestPathPrefix(t *testing.T) {
+	for p, want := range map[string]string{
+		"":             "",
+		"/":            "/",
+		"/home":        "/home",
+		"/home/me/dir": "/home",
+		"relative/dir": "relative",
+	} {
+		assert.Equal(t, want, pathPrefix(p), p)
+	}
+}
+
+func TestPacketMethod(t *testing.T) {
+	assert.Equal(t, "SSH_FXP_READ", packetMethod(&sshFxpReadPacket{}))
+	assert.Equal(t, "posix-rename@openssh.com", packetMethod(&sshFxpExtendedPacket{
+		ExtendedRequest: "posix-rename@openssh.com",
+		SpecificPacket:  &sshFxpExtendedPacketPosixRename{ExtendedRequest: "posix-rename@openssh.com"},
+	}))
+}
+
+// labelledReader records the goroutine profile when read.
+type labelledReader struct {
+	io.Reader
+	t       *testing.T
+	profile string
+}
+
+func (r *labelledReader) Read(b []byte) (int, error) {
+	if r.profile == "" {
+		r.profile = goroutineProfile(r.t)
+	}
+	return r.Reader.Read(b)
+}
+
+func (r *labelledReader) ReadAt(b []byte, off int64) (int, error) {
+	if r.profile == "" {
+		r.profile = goroutineProfile(r.t)
+	}
+	return r.Reader.(io.ReaderAt).ReadAt(b, off)
+}
+
+// profiledReader is a FileReader returning a labelledReader.
+type profiledReader struct {
+	r *labelledReader
+}
+
+func (h profiledReader) Fileread(*Request) (io.ReaderAt, error) { return h.r, nil }
+
+func TestRequestServerProfilerLabels(t *testing.T) {
+	r := &labelledReader{Reader: bytes.NewReader([]byte("data")), t: t}
+	handlers := InMemHandler()
+	handlers.FileGet = profiledReader{r}
+	client, server := handlersClientPair(t, handlers, nil, WithRSProfilerLabels())
+
+	f, err := client.Open("/dir/file")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Contains(t, r.profile, `"sftp.method":"SSH_FXP_READ"`)
+	assert.Contains(t, r.profile, `"sftp.path":"/dir"`)
+	assert.Contains(t, r.profile, `"sftp.session":"`+server.profileSession+`"`)
+}
+
+func TestServerProfilerLabels(t *testing.T) {
+	client, server := clientServerPair(t, WithProfilerLabels())
+	defer client.Close()
+	defer server.Close()
+
+	// the workers keep the labels of the last request they served
+	_, err := client.Lstat(os.TempDir())
+	require.NoError(t, err)
+	profile := goroutineProfile(t)
+	assert.Contains(t, profile, `"sftp.method":"SSH_FXP_LSTAT"`)
+	assert.Contains(t, profile, `"sftp.path":"`+pathPrefix(os.TempDir())+`"`)
+	assert.Contains(t, profile, `"sftp.session":"`+server.profileSession+`"`)
+}
+
+func TestClientProfilerLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-labels")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+	require.NoError(t, UseProfilerLabels(true)(client))
+
+	f, err := client.Create(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	r := &labelledReader{Reader: bytes.NewReader([]byte("data")), t: t}
+	_, err = f.ReadFrom(r)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Contains(t, r.profile, `"sftp.method":"ReadFrom"`)
+	assert.Contains(t, r.profile, `"sftp.path":"`+pathPrefix(dir)+`"`)
+	assert.Contains(t, r.profile, `"sftp.session":"`+client.profileSession+`"`)
+
+	// cleared once done
+	assert.NotContains(t, goroutineProfile(t), `"sftp.method":"ReadFrom"`)
+}
@@ -0,0 +1,96 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// WithProgress reports the progress of the content copied by Upload,
+// Download, ResumeUpload and ResumeDownload to fn, like File.SetProgress
+// does for the remote file.
+func WithProgress(fn func(transferred, total int64)) TransferOption {
+	return func(o *transferOptions) {
+		o.progress = fn
+	}
+}
+
+// SetProgress reports the progress of the next transfers of WriteTo,
+// ReadFrom and ReadFromWithConcurrency of the File to fn, with the number of
+// bytes transferred so far by the call, as they are acknowledged by the
+// server for ReadFrom, and the number of bytes to transfer, or -1 when
+// unknown. The calls to fn are one at a time, in a goroutine of the
+// transfer, which waits for them to return. A nil fn stops the reports.
+func (f *File) SetProgress(fn func(transferred, total int64)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.progress = fn
+}
+
+// progress reports the bytes transferred by a call of a File.
+type progress struct {
+	fn    func(transferred, total int64)
+	total int64
+
+	mu   sync.Mutex
+	done int64
+}
+
+// newProgress returns the progress of a transfer of total bytes, or nil
+// without a function to report it to.
+func (f *File) newProgress(total int64) *progress {
+	if f.progress == nil {
+		return nil
+	}
+	return &progress{fn: f.progress, total: total}
+}
+
+// add reports n more bytes transferred.
+func (p *progress) add(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += int64(n)
+	p.fn(p.done, p.total)
+}
+
+// readerSize returns the size of the data of r, when r tells.
+func readerSize(r io.Reader) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+
+	case interface{ Size() int64 }:
+		return r.Size(), true
+
+	case *io.LimitedReader:
+		return r.N, true
+
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := r.Stat()
+		if err == nil {
+			return info.Size(), true
+		}
+	}
+	return 0, false
+}
+
+// readerRemaining returns the number of bytes left to read from r, or -1
+// when unknown.
+func readerRemaining(r io.Reader) int64 {
+	size, ok := readerSize(r)
+	if !ok {
+		return -1
+	}
+	if _, isLen := r.(interface{ Len() int }); isLen {
+		return size
+	}
+	if s, ok := r.(io.Seeker); ok {
+		if off, err := s.Seek(0, io.SeekCurrent); err == nil && off <= size {
+			size -= off
+		}
+	}
+	return size
+}
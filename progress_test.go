@@ -0,0 +1,84 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileProgress(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-progress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 200000)
+	var calls [][2]int64
+	record := func(transferred, total int64) {
+		calls = append(calls, [2]int64{transferred, total})
+	}
+	// check asserts the calls recorded report all of data, in order
+	check := func(t *testing.T, total int64) {
+		require.NotEmpty(t, calls)
+		var last int64
+		for _, c := range calls {
+			assert.True(t, c[0] > last, "%d after %d", c[0], last)
+			assert.Equal(t, total, c[1])
+			last = c[0]
+		}
+		assert.Equal(t, int64(len(data)), last)
+		calls = nil
+	}
+
+	name := filepath.Join(dir, "file")
+	t.Run("ReadFrom", func(t *testing.T) {
+		f, err := client.Create(name)
+		require.NoError(t, err)
+		defer f.Close()
+		f.SetProgress(record)
+		_, err = f.ReadFrom(bytes.NewReader(data))
+		require.NoError(t, err)
+		check(t, int64(len(data)))
+
+		// of a reader of an unknown size
+		_, err = f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		_, err = f.ReadFrom(struct{ io.Reader }{bytes.NewReader(data)})
+		require.NoError(t, err)
+		check(t, -1)
+	})
+
+	t.Run("WriteTo", func(t *testing.T) {
+		f, err := client.Open(name)
+		require.NoError(t, err)
+		defer f.Close()
+		f.SetProgress(record)
+		_, err = f.WriteTo(ioutil.Discard)
+		require.NoError(t, err)
+		check(t, int64(len(data)))
+	})
+
+	local := filepath.Join(dir, "local")
+	require.NoError(t, ioutil.WriteFile(local, data, 0600))
+	t.Run("Upload", func(t *testing.T) {
+		require.NoError(t, client.Upload(local, name, WithProgress(record)))
+		check(t, int64(len(data)))
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		require.NoError(t, client.Download(name, local, WithProgress(record)))
+		check(t, int64(len(data)))
+	})
+}
@@ -0,0 +1,142 @@
+package sftp
+
+import (
+	"strings"
+)
+
+// ServerQuirks are workarounds for the known misbehaviors of some servers.
+// The Client detects them from the SSH version of the server, and from the
+// "vendor-id" extension the server sends, and applies them on top of its
+// options. Quirks only ever tighten the options: they never raise a limit.
+//
+// The zero value applies no workaround.
+type ServerQuirks struct {
+	// MaxPacket, if not zero, caps the size of the data read or written per
+	// request, for servers returning short reads or failing larger requests.
+	MaxPacket int
+
+	// MaxConcurrentRequests, if not zero, caps the requests in flight per File.
+	MaxConcurrentRequests int
+
+	// NoConcurrentReads disables concurrent reads, for servers mishandling
+	// out of order reads, or wrongly reporting EOF while reads are in flight.
+	NoConcurrentReads bool
+
+	// NoConcurrentWrites disables concurrent writes, even if requested
+	// with UseConcurrentWrites.
+	NoConcurrentWrites bool
+}
+
+// merge returns the tightest of the workarounds of q and o.
+func (q ServerQuirks) merge(o ServerQuirks) ServerQuirks {
+	q.MaxPacket = minLimit(q.MaxPacket, o.MaxPacket)
+	q.MaxConcurrentRequests = minLimit(q.MaxConcurrentRequests, o.MaxConcurrentRequests)
+	q.NoConcurrentReads = q.NoConcurrentReads || o.NoConcurrentReads
+	q.NoConcurrentWrites = q.NoConcurrentWrites || o.NoConcurrentWrites
+	return q
+}
+
+// minLimit returns the smallest of a and b, where zero means no limit.
+func minLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// serverQuirk are the quirks of the servers whose SSH version,
+// or "vendor-id" product, starts with prefix.
+type serverQuirk struct {
+	prefix string
+	quirks ServerQuirks
+}
+
+// knownQuirks are the quirks of the known servers.
+var knownQuirks = []serverQuirk{
+	// sftp-server truncates reads to SFTP_MAX_READ_LENGTH, 256 KiB less some
+	// room for the header, and drops the connection on larger messages.
+	// This only matters for a Client set with MaxPacketUnchecked.
+	{prefix: "SSH-2.0-OpenSSH_", quirks: ServerQuirks{MaxPacket: 255 * 1024}},
+}
+
+// detectQuirks returns the quirks of the server with the given SSH version
+// and "vendor-id" product, as returned by vendorProduct.
+// Either may be empty if unknown.
+func detectQuirks(sshVersion, product string) ServerQuirks {
+	var q ServerQuirks
+	for _, known := range knownQuirks {
+		if matchQuirk(sshVersion, known.prefix) || matchQuirk(product, known.prefix) {
+			q = q.merge(known.quirks)
+		}
+	}
+	return q
+}
+
+func matchQuirk(s, prefix string) bool {
+	return s != "" && strings.HasPrefix(s, prefix)
+}
+
+// vendorProduct returns the "vendor-name product-name product-version" of
+// the data of a "vendor-id" extension, or the empty string if malformed.
+func vendorProduct(data string) string {
+	b := []byte(data)
+	var fields []string
+	for i := 0; i < 3; i++ {
+		var s string
+		var err error
+		if s, b, err = unmarshalStringSafe(b); err != nil {
+			return ""
+		}
+		fields = append(fields, s)
+	}
+	return strings.Join(fields, " ")
+}
+
+// UseServerQuirks makes the Client apply quirks, instead of the workarounds
+// detected from the version of the server. UseServerQuirks(ServerQuirks{})
+// disables all of the workarounds.
+func UseServerQuirks(quirks ServerQuirks) ClientOption {
+	return func(c *Client) error {
+		c.quirks = &quirks
+		return nil
+	}
+}
+
+// withServerVersion sets the SSH version of the server, to detect its quirks.
+func withServerVersion(version string) ClientOption {
+	return func(c *Client) error {
+		c.serverVersion = version
+		return nil
+	}
+}
+
+// ServerQuirks returns the workarounds the Client applies for the server.
+func (c *Client) ServerQuirks() ServerQuirks {
+	if c.quirks == nil {
+		return ServerQuirks{}
+	}
+	return *c.quirks
+}
+
+// applyQuirks tightens the options of the Client with the quirks set by
+// UseServerQuirks, or else detected from the server.
+func (c *Client) applyQuirks() {
+	if c.quirks == nil {
+		q := detectQuirks(c.serverVersion, vendorProduct(c.ext["vendor-id"]))
+		c.quirks = &q
+	}
+	q := c.quirks
+
+	if q.MaxPacket > 0 && c.maxPacket > q.MaxPacket {
+		c.maxPacket = q.MaxPacket
+	}
+	if q.MaxConcurrentRequests > 0 && c.maxConcurrentRequests > q.MaxConcurrentRequests {
+		c.maxConcurrentRequests = q.MaxConcurrentRequests
+	}
+	if q.NoConcurrentReads {
+		c.disableConcurrentReads = true
+	}
+	if q.NoConcurrentWrites {
+		c.useConcurrentWrites = false
+	}
+}
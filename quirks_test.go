@@ -0,0 +1,74 @@
+package sftp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectQuirks(t *testing.T) {
+	defer func(known []serverQuirk) { knownQuirks = known }(knownQuirks)
+	knownQuirks = []serverQuirk{
+		{prefix: "SSH-2.0-Lazy", quirks: ServerQuirks{MaxPacket: 1 << 14, NoConcurrentReads: true}},
+		{prefix: "SSH-2.0-LazyAndSlow", quirks: ServerQuirks{MaxPacket: 1 << 15, MaxConcurrentRequests: 4}},
+		{prefix: "Acme SFTP 1.", quirks: ServerQuirks{NoConcurrentWrites: true}},
+	}
+
+	tests := []struct {
+		version, product string
+		want             ServerQuirks
+	}{
+		{"", "", ServerQuirks{}},
+		{"SSH-2.0-Other", "", ServerQuirks{}},
+		{"SSH-2.0-Lazy_1.0", "", ServerQuirks{MaxPacket: 1 << 14, NoConcurrentReads: true}},
+		{"SSH-2.0-LazyAndSlow", "", ServerQuirks{MaxPacket: 1 << 14, MaxConcurrentRequests: 4, NoConcurrentReads: true}},
+		{"", "Acme SFTP 1.2", ServerQuirks{NoConcurrentWrites: true}},
+		{"SSH-2.0-Lazy", "Acme SFTP 1.2", ServerQuirks{MaxPacket: 1 << 14, NoConcurrentReads: true, NoConcurrentWrites: true}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, detectQuirks(tt.version, tt.product), "%q %q", tt.version, tt.product)
+	}
+}
+
+func TestVendorProduct(t *testing.T) {
+	var b []byte
+	b = marshalString(b, "Acme")
+	b = marshalString(b, "SFTP")
+	b = marshalString(b, "1.2")
+	b = marshalUint64(b, 42)
+	assert.Equal(t, "Acme SFTP 1.2", vendorProduct(string(b)))
+
+	assert.Equal(t, "", vendorProduct(""))
+	assert.Equal(t, "", vendorProduct(string(b[:10])))
+}
+
+func quirksClient(t *testing.T, opts ...ClientOption) *Client {
+	// the server advertises no limits, which would tune the Client too
+	return limitsServer(t, Limits{}, opts...)
+}
+
+func TestClientServerQuirks(t *testing.T) {
+	client := quirksClient(t, withServerVersion("SSH-2.0-OpenSSH_8.4"), MaxPacketUnchecked(1<<20))
+	assert.Equal(t, 255*1024, client.maxPacket)
+	assert.Equal(t, ServerQuirks{MaxPacket: 255 * 1024}, client.ServerQuirks())
+
+	// quirks never raise the limits
+	client = quirksClient(t, withServerVersion("SSH-2.0-OpenSSH_8.4"))
+	assert.Equal(t, 1<<15, client.maxPacket)
+
+	client = quirksClient(t,
+		withServerVersion("SSH-2.0-OpenSSH_8.4"),
+		MaxPacketUnchecked(1<<20),
+		UseServerQuirks(ServerQuirks{}),
+	)
+	assert.Equal(t, 1<<20, client.maxPacket)
+	assert.Equal(t, ServerQuirks{}, client.ServerQuirks())
+
+	client = quirksClient(t,
+		UseConcurrentWrites(true),
+		UseServerQuirks(ServerQuirks{MaxConcurrentRequests: 2, NoConcurrentReads: true, NoConcurrentWrites: true}),
+	)
+	assert.Equal(t, 2, client.maxConcurrentRequests)
+	assert.True(t, client.disableConcurrentReads)
+	assert.False(t, client.useConcurrentWrites)
+}
@@ -0,0 +1,404 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrQuotaExceeded is the error of the requests of QuotaHandlers exceeding
+// the quota, sent to the clients as a SSH_FX_FAILURE "quota exceeded".
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// quotaBlockSize is the block size of the StatVFS of QuotaHandlers, for the
+// Handlers which have none.
+const quotaBlockSize = 4096
+
+// QuotaUsage is the usage of a quota, and its limits.
+type QuotaUsage struct {
+	// Bytes is the size of the regular files, and Files the number of the
+	// files, directories and links.
+	Bytes, Files int64
+	// MaxBytes and MaxFiles limit Bytes and Files, unless 0.
+	MaxBytes, MaxFiles int64
+}
+
+// QuotaAccount accounts for the usage of QuotaHandlers. Its methods are
+// called concurrently, by the sessions sharing it.
+type QuotaAccount interface {
+	// Reserve adds bytes and files, which are negative once released, to
+	// the usage, or fails with ErrQuotaExceeded, adding nothing, if the
+	// usage would go over its limits. Releasing never fails.
+	Reserve(bytes, files int64) error
+	// Usage returns the usage, and its limits.
+	Usage() QuotaUsage
+}
+
+// NewQuota returns a QuotaAccount starting with the usage u, such as the
+// one of the files served measured beforehand, and keeping it in memory.
+func NewQuota(u QuotaUsage) QuotaAccount {
+	return &memQuota{u: u}
+}
+
+type memQuota struct {
+	mu sync.Mutex
+	u  QuotaUsage
+}
+
+func (q *memQuota) Reserve(bytes, files int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if bytes > 0 && q.u.MaxBytes > 0 && q.u.Bytes+bytes > q.u.MaxBytes ||
+		files > 0 && q.u.MaxFiles > 0 && q.u.Files+files > q.u.MaxFiles {
+		return ErrQuotaExceeded
+	}
+	q.u.Bytes += bytes
+	q.u.Files += files
+	return nil
+}
+
+func (q *memQuota) Usage() QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.u
+}
+
+// QuotaHandlers returns the Handlers serving h within the quota of account:
+// the writes, truncations, copies and creations of files taking more bytes
+// or files than left fail with ErrQuotaExceeded, and the StatVFS reports the
+// space and the files left. A QuotaAccount per session limits the session,
+// and one shared by the sessions of a user limits the user.
+//
+// The usage is accounted for as the files change through the Handlers
+// returned, with the sizes their FileLister reports: a change made to the
+// files otherwise is not accounted for.
+func QuotaHandlers(h Handlers, account QuotaAccount) Handlers {
+	q := &quotaHandlers{h: h, account: account}
+	return Handlers{
+		FileGet:  h.FileGet,
+		FilePut:  q,
+		FileCmd:  q,
+		FileList: h.FileList,
+	}
+}
+
+type quotaHandlers struct {
+	h       Handlers
+	account QuotaAccount
+}
+
+// lstat describes the file at p, or returns nil if there is none.
+func (q *quotaHandlers) lstat(r *Request, p string) (os.FileInfo, error) {
+	stat := NewRequest("Lstat", p).WithContext(r.Context())
+	list := q.h.FileList.Filelist
+	if lstatFileLister, ok := q.h.FileList.(LstatFileLister); ok {
+		list = lstatFileLister.Lstat
+	} else {
+		stat.Method = "Stat"
+	}
+	lister, err := list(stat)
+	if err == nil {
+		var fi [1]os.FileInfo
+		var n int
+		n, err = listAt(stat.Context(), lister, fi[:], 0)
+		if n == 1 {
+			return fi[0], nil
+		}
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	if err == io.EOF || errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return nil, err
+}
+
+// quotaSize returns the bytes fi takes in the quota.
+func quotaSize(fi os.FileInfo) int64 {
+	if fi == nil || !fi.Mode().IsRegular() {
+		return 0
+	}
+	return fi.Size()
+}
+
+func (q *quotaHandlers) Filewrite(r *Request) (io.WriterAt, error) {
+	return q.open(r, q.h.FilePut.Filewrite)
+}
+
+// OpenFile implements OpenFileWriter, falling back to Filewrite for the
+// Handlers which do not: the file can then not be read.
+func (q *quotaHandlers) OpenFile(r *Request) (WriterAtReaderAt, error) {
+	openFileWriter, ok := q.h.FilePut.(OpenFileWriter)
+	if !ok {
+		r.Method = "Put"
+		return q.open(r, q.h.FilePut.Filewrite)
+	}
+	return q.open(r, func(r *Request) (io.WriterAt, error) {
+		return openFileWriter.OpenFile(r)
+	})
+}
+
+// open opens the file of r with open, accounting for its creation or its
+// truncation.
+func (q *quotaHandlers) open(r *Request, open func(*Request) (io.WriterAt, error)) (*quotaFile, error) {
+	fi, err := q.lstat(r, r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if fi == nil {
+		if err := q.account.Reserve(0, 1); err != nil {
+			return nil, err
+		}
+	}
+	// measured before the open, which may change fi
+	size := quotaSize(fi)
+	w, err := open(r)
+	if err != nil {
+		if fi == nil {
+			q.account.Reserve(0, -1)
+		}
+		return nil, err
+	}
+	if r.Pflags().Trunc {
+		q.account.Reserve(-size, 0)
+		size = 0
+	}
+	return &quotaFile{q: q, WriterAt: w, size: size}, nil
+}
+
+// quotaFile is a file of QuotaHandlers open for writing, accounting for
+// its growth. It has the Close, Sync and TransferError of the file, and its
+// ReadAt if it was opened with OpenFile.
+type quotaFile struct {
+	io.WriterAt
+	q *quotaHandlers
+
+	mu   sync.Mutex
+	size int64
+}
+
+func (f *quotaFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	growth := off + int64(len(b)) - f.size
+	if growth < 0 {
+		growth = 0
+	}
+	if err := f.q.account.Reserve(growth, 0); err != nil {
+		return 0, err
+	}
+
+	n, err := f.WriterAt.WriteAt(b, off)
+	size := f.size
+	if end := off + int64(n); end > size {
+		size = end
+	}
+	// release what was reserved but not written
+	f.q.account.Reserve(size-f.size-growth, 0)
+	f.size = size
+	return n, err
+}
+
+func (f *quotaFile) ReadAt(b []byte, off int64) (int, error) {
+	if r, ok := f.WriterAt.(io.ReaderAt); ok {
+		return r.ReadAt(b, off)
+	}
+	return 0, os.ErrInvalid
+}
+
+// Fsetstat implements FsetStater, accounting for the truncation of the
+// file, which is then set by the file if it is an FsetStater itself, or
+// else by the FileCmder.
+func (f *quotaFile) Fsetstat(r *Request) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	setstat := f.q.h.FileCmd.Filecmd
+	if s, ok := f.WriterAt.(FsetStater); ok {
+		setstat = s.Fsetstat
+	}
+	if !r.AttrFlags().Size {
+		return setstat(r)
+	}
+
+	size := int64(r.Attributes().Size)
+	if err := f.q.account.Reserve(size-f.size, 0); err != nil {
+		return err
+	}
+	if err := setstat(r); err != nil {
+		f.q.account.Reserve(f.size-size, 0)
+		return err
+	}
+	f.size = size
+	return nil
+}
+
+func (f *quotaFile) Close() error {
+	if c, ok := f.WriterAt.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (f *quotaFile) Sync() error {
+	if s, ok := f.WriterAt.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return ErrSSHFxOpUnsupported
+}
+
+func (f *quotaFile) TransferError(err error) {
+	if t, ok := f.WriterAt.(TransferError); ok {
+		t.TransferError(err)
+	}
+}
+
+// CopyFile implements CopyFileWriter, for the Handlers which do,
+// accounting for the copy, and the file it replaces.
+func (q *quotaHandlers) CopyFile(r *Request) error {
+	copier, ok := q.h.FilePut.(CopyFileWriter)
+	if !ok {
+		return ErrSSHFxOpUnsupported
+	}
+	src, err := q.lstat(r, r.Filepath)
+	if err != nil {
+		return err
+	}
+	dst, err := q.lstat(r, r.Target)
+	if err != nil {
+		return err
+	}
+	bytes, files := quotaSize(src)-quotaSize(dst), int64(0)
+	if dst == nil {
+		files = 1
+	}
+	return q.reserve(bytes, files, func() error {
+		return copier.CopyFile(r)
+	})
+}
+
+// reserve reserves bytes and files for change, releasing them if it fails.
+func (q *quotaHandlers) reserve(bytes, files int64, change func() error) error {
+	if err := q.account.Reserve(bytes, files); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		q.account.Reserve(-bytes, -files)
+		return err
+	}
+	return nil
+}
+
+// release calls change, and releases what the file at p took if it does
+// not fail.
+func (q *quotaHandlers) release(r *Request, p string, change func() error) error {
+	fi, err := q.lstat(r, p)
+	if err != nil {
+		return err
+	}
+	size := quotaSize(fi)
+	if err := change(); err != nil {
+		return err
+	}
+	if fi != nil {
+		q.account.Reserve(-size, -1)
+	}
+	return nil
+}
+
+func (q *quotaHandlers) Filecmd(r *Request) error {
+	change := func() error {
+		if r.Method == "Setstat" {
+			return setstat(q.h.FileCmd, r)
+		}
+		return q.h.FileCmd.Filecmd(r)
+	}
+	switch r.Method {
+	case "Setstat":
+		if !r.AttrFlags().Size {
+			return change()
+		}
+		fi, err := q.lstat(r, r.Filepath)
+		if err != nil {
+			return err
+		}
+		return q.reserve(int64(r.Attributes().Size)-quotaSize(fi), 0, change)
+	case "Mkdir":
+		return q.reserve(0, 1, change)
+	case "Link", "Symlink":
+		return q.reserve(0, 1, change)
+	case "Remove", "Rmdir":
+		return q.release(r, r.Filepath, change)
+	}
+	return change()
+}
+
+// PosixRename implements PosixRenameFileCmder, falling back to Rename for
+// the Handlers which do not, accounting for the file it replaces.
+func (q *quotaHandlers) PosixRename(r *Request) error {
+	return q.release(r, r.Target, func() error {
+		if posixRenamer, ok := q.h.FileCmd.(PosixRenameFileCmder); ok {
+			return posixRenamer.PosixRename(r)
+		}
+		r.Method = "Rename"
+		return q.h.FileCmd.Filecmd(r)
+	})
+}
+
+// Fsync implements FsyncFileCmder, for the Handlers which do.
+func (q *quotaHandlers) Fsync(r *Request) error {
+	if syncer, ok := q.h.FileCmd.(FsyncFileCmder); ok {
+		return syncer.Fsync(r)
+	}
+	return ErrSSHFxOpUnsupported
+}
+
+// StatVFS implements StatVFSFileCmder, reporting the space and the files
+// left in the quota, or in the file system of the Handlers if they report
+// less.
+func (q *quotaHandlers) StatVFS(r *Request) (*StatVFS, error) {
+	stat := &StatVFS{Bsize: quotaBlockSize, Frsize: quotaBlockSize, Namemax: 255}
+	inner := false
+	if statVFSCmdr, ok := q.h.FileCmd.(StatVFSFileCmder); ok {
+		st, err := statVFSCmdr.StatVFS(r)
+		switch {
+		case err == nil:
+			s := *st
+			stat, inner = &s, true
+		case err != ErrSSHFxOpUnsupported:
+			return nil, err
+		}
+	}
+	if stat.Frsize == 0 {
+		stat.Frsize = quotaBlockSize
+	}
+
+	// left returns what is left of max after used, capped to what the
+	// file system has left, if any
+	left := func(max, used int64, fs uint64) uint64 {
+		n := uint64(0)
+		if used < max {
+			n = uint64(max - used)
+		}
+		if inner && fs < n {
+			n = fs
+		}
+		return n
+	}
+	u := q.account.Usage()
+	if u.MaxBytes > 0 {
+		stat.Blocks = uint64(u.MaxBytes) / stat.Frsize
+		stat.Bfree = left(u.MaxBytes, u.Bytes, stat.Bfree*stat.Frsize) / stat.Frsize
+		stat.Bavail = left(u.MaxBytes, u.Bytes, stat.Bavail*stat.Frsize) / stat.Frsize
+	}
+	if u.MaxFiles > 0 {
+		stat.Files = uint64(u.MaxFiles)
+		stat.Ffree = left(u.MaxFiles, u.Files, stat.Ffree)
+		stat.Favail = left(u.MaxFiles, u.Files, stat.Favail)
+	}
+	return stat, nil
+}
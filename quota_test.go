@@ -0,0 +1,83 @@
+package sftp
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func assertQuotaExceeded(t *testing.T, err error) {
+	t.Helper()
+	if assert.IsType(t, &StatusError{}, err) {
+		assert.Equal(t, uint32(sshFxFailure), err.(*StatusError).Code)
+		assert.Contains(t, err.Error(), "quota exceeded")
+	}
+}
+
+func TestQuotaHandlers(t *testing.T) {
+	quota := NewQuota(QuotaUsage{MaxBytes: 10, MaxFiles: 3})
+	client, _ := handlersClientPair(t, MountHandlers(map[string]Handlers{
+		"/q": QuotaHandlers(InMemHandler(), quota),
+	}), nil)
+
+	require.NoError(t, client.Mkdir("/q/dir"))
+	_, err := putTestFile(client, "/q/dir/file", "data")
+	require.NoError(t, err)
+	assert.Equal(t, QuotaUsage{Bytes: 4, Files: 2, MaxBytes: 10, MaxFiles: 3}, quota.Usage())
+
+	// rewriting a file takes no more
+	_, err = putTestFile(client, "/q/dir/file", "other")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), quota.Usage().Bytes)
+
+	// over the bytes
+	f, err := client.OpenFile("/q/dir/file", os.O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte(strings.Repeat("x", 6)), 5)
+	assertQuotaExceeded(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, int64(5), quota.Usage().Bytes)
+	assertQuotaExceeded(t, client.Truncate("/q/dir/file", 11))
+	require.NoError(t, client.Truncate("/q/dir/file", 10))
+	assert.Equal(t, int64(10), quota.Usage().Bytes)
+
+	// over the files
+	_, err = putTestFile(client, "/q/empty", "")
+	require.NoError(t, err)
+	_, err = client.Create("/q/new")
+	assertQuotaExceeded(t, err)
+	assertQuotaExceeded(t, client.Mkdir("/q/newdir"))
+	assertQuotaExceeded(t, client.Symlink("/q/empty", "/q/link"))
+	_, err = client.Stat("/q/new")
+	assert.True(t, os.IsNotExist(err), err)
+	assert.Equal(t, QuotaUsage{Bytes: 10, Files: 3, MaxBytes: 10, MaxFiles: 3}, quota.Usage())
+
+	// released
+	require.NoError(t, client.PosixRename("/q/empty", "/q/dir/file"))
+	assert.Equal(t, QuotaUsage{Bytes: 0, Files: 2, MaxBytes: 10, MaxFiles: 3}, quota.Usage())
+	require.NoError(t, client.Remove("/q/dir/file"))
+	require.NoError(t, client.RemoveDirectory("/q/dir"))
+	assert.Equal(t, QuotaUsage{MaxBytes: 10, MaxFiles: 3}, quota.Usage())
+}
+
+func TestQuotaHandlersStatVFS(t *testing.T) {
+	quota := NewQuota(QuotaUsage{Bytes: 4096, Files: 1, MaxBytes: 4 * 4096, MaxFiles: 10})
+	client, _ := handlersClientPair(t, MountHandlers(map[string]Handlers{
+		"/q": QuotaHandlers(InMemHandler(), quota),
+	}), nil)
+
+	_, err := putTestFile(client, "/q/file", strings.Repeat("x", 4096))
+	require.NoError(t, err)
+
+	stat, err := client.StatVFS("/q")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4*4096), stat.Blocks*stat.Frsize)
+	assert.Equal(t, uint64(2*4096), stat.Bfree*stat.Frsize)
+	assert.Equal(t, uint64(2*4096), stat.Bavail*stat.Frsize)
+	assert.Equal(t, uint64(10), stat.Files)
+	assert.Equal(t, uint64(8), stat.Ffree)
+	assert.Equal(t, uint64(8), stat.Favail)
+}
@@ -0,0 +1,145 @@
+package sftp
+
+import (
+	"encoding"
+	"sync"
+	"time"
+)
+
+// UseRateLimit caps the throughput of the data the Client reads and writes
+// to bytesPerSecond, across the files of the session, allowing bursts of
+// up to a second of transfer. The other requests are not limited.
+// A bytesPerSecond of 0 or less removes the limit.
+func UseRateLimit(bytesPerSecond int64) ClientOption {
+	return func(c *Client) error {
+		c.clientConn.conn.limit = newRateLimiter(bytesPerSecond)
+		return nil
+	}
+}
+
+// WithRateLimit caps the throughput of the data the Server reads and writes
+// for the client to bytesPerSecond, across the files of the session,
+// allowing bursts of up to a second of transfer. A bytesPerSecond of 0 or
+// less removes the limit.
+//
+// The RequestServer equivalent is WithRSRateLimit.
+func WithRateLimit(bytesPerSecond int64) ServerOption {
+	return func(s *Server) error {
+		s.serverConn.limit = newRateLimiter(bytesPerSecond)
+		return nil
+	}
+}
+
+// WithRSRateLimit caps the throughput of the data the RequestServer reads
+// and writes for the client to bytesPerSecond, across the files of the
+// session, allowing bursts of up to a second of transfer. A bytesPerSecond
+// of 0 or less removes the limit.
+//
+// The Server equivalent is WithRateLimit.
+func WithRSRateLimit(bytesPerSecond int64) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.serverConn.limit = newRateLimiter(bytesPerSecond)
+	}
+}
+
+// rateLimiter is a token bucket, filled with rate tokens per second up to
+// a second worth of them, and taken a token per byte transferred. It does
+// not limit while its rate is 0.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64 // negative when owed
+	last   time.Time
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// newRateLimiter returns a rateLimiter of bytesPerSecond, or nil for no limit.
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    float64(bytesPerSecond),
+		tokens:  float64(bytesPerSecond),
+		last:    pkgClock.Now(),
+		stopped: make(chan struct{}),
+	}
+}
+
+// wait takes n tokens, and blocks until they are available, or the
+// rateLimiter is stopped. The tokens of a transfer larger than the bucket
+// are owed by the next ones.
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	rate := l.rate
+	if rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := pkgClock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	owed := l.tokens
+	l.mu.Unlock()
+
+	if owed >= 0 {
+		return
+	}
+	t, ch := pkgClock.NewTimer(time.Duration(-owed / rate * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-ch:
+	case <-l.stopped:
+	}
+}
+
+// setRate sets the rate to bytesPerSecond, 0 for no limit. The tokens owed
+// are then owed at the new rate.
+func (l *rateLimiter) setRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := float64(bytesPerSecond)
+	if rate == l.rate {
+		return
+	}
+	if l.rate == 0 {
+		// a full bucket, as a new rateLimiter
+		l.tokens, l.last = rate, pkgClock.Now()
+	}
+	l.rate = rate
+}
+
+// stop releases the transfers waiting for tokens, once the conn is closed.
+func (l *rateLimiter) stop() {
+	if l == nil {
+		return
+	}
+	l.stopOnce.Do(func() { close(l.stopped) })
+}
+
+// dataLength returns the length of the file data carried by m, as limited
+// by the rateLimiter of the conn.
+func dataLength(m encoding.BinaryMarshaler) int {
+	switch p := m.(type) {
+	case orderedResponse:
+		return dataLength(p.responsePacket)
+	case *sshFxpWritePacket:
+		return len(p.Data)
+	case *sshFxpDataPacket:
+		return len(p.Data)
+	case *sshFxpFileDataPacket:
+		return int(p.Length)
+	}
+	return 0
+}
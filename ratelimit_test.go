@@ -0,0 +1,136 @@
+package sftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	c := useFakeClock(t, time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+
+	// pending returns the number of timers not fired yet
+	pending := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		n := 0
+		for _, t := range c.timers {
+			if t.active {
+				n++
+			}
+		}
+		return n
+	}
+
+	l := newRateLimiter(100)
+	l.wait(100) // the bucket starts full
+
+	done := make(chan struct{})
+	go func() {
+		l.wait(50)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return pending() == 1 }, time.Second, time.Millisecond)
+
+	c.Advance(400 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("wait returned early")
+	default:
+	}
+	c.Advance(100 * time.Millisecond)
+	<-done
+
+	// released when stopped
+	done = make(chan struct{})
+	go func() {
+		l.wait(1000)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return pending() == 1 }, time.Second, time.Millisecond)
+	l.stop()
+	<-done
+
+	assert.Nil(t, newRateLimiter(0))
+	newRateLimiter(0).wait(1000)
+
+	// not limiting at a rate of 0, and starting full once set
+	l = &rateLimiter{stopped: make(chan struct{})}
+	l.wait(1000)
+	l.setRate(100)
+	l.wait(100)
+	assert.Zero(t, pending())
+	done = make(chan struct{})
+	go func() {
+		l.wait(50)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return pending() == 1 }, time.Second, time.Millisecond)
+	c.Advance(500 * time.Millisecond)
+	<-done
+}
+
+func TestServerRateLimit(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t, WithRateLimit(64*1024))
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-ratelimit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a second of data passes at once, the rest at the rate limited
+	data := make([]byte, 96*1024)
+	start := time.Now()
+	f, err := client.Create(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "took %v", time.Since(start))
+
+	// and so does the data read
+	start = time.Now()
+	f, err = client.Open(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "took %v", time.Since(start))
+}
+
+func TestRequestServerRateLimit(t *testing.T) {
+	p := clientRequestServerPair(t, WithRSRateLimit(64*1024))
+	defer p.Close()
+
+	data := make([]byte, 96*1024)
+	_, err := putTestFile(p.cli, "/file", string(data))
+	require.NoError(t, err)
+
+	start := time.Now()
+	f, err := p.cli.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "took %v", time.Since(start))
+}
+
+func TestUseRateLimit(t *testing.T) {
+	c := &Client{}
+	require.NoError(t, UseRateLimit(1024)(c))
+	assert.NotNil(t, c.clientConn.conn.limit)
+	require.NoError(t, UseRateLimit(0)(c))
+	assert.Nil(t, c.clientConn.conn.limit)
+}
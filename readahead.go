@@ -0,0 +1,178 @@
+package sftp
+
+import "io"
+
+// EnableReadAhead makes the Reads of the File prefetch the data following
+// them in the background, up to windowBytes past the offset read, so that a
+// loop calling Read, such as one copying the file to a tar archive, has the
+// data read as fast as a WriteTo would, rather than waiting for a round trip
+// each call. The reads in flight are at most those of the limit set by
+// SetMaxConcurrentRequests or MaxConcurrentRequestsPerFile.
+//
+// The data prefetched is dropped once the offset is moved other than by Read,
+// as by Seek, and by the Write and ReadFrom of the File. The changes made to
+// the file by other means, such as WriteAt or other clients, may not be seen
+// by the data already prefetched. A windowBytes less than 1 disables the
+// read-ahead.
+func (f *File) EnableReadAhead(windowBytes int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dropReadAhead()
+	if windowBytes < 1 {
+		f.readAhead = nil
+		return
+	}
+	f.readAhead = &readAhead{window: int64(windowBytes)}
+}
+
+// readAhead is the data prefetched for the Reads of a File.
+type readAhead struct {
+	window int64 // bytes requested ahead of the offset of the File
+
+	off    int64 // offset of the File the data prefetched is for
+	next   int64 // offset of the next chunk to request
+	chunks []readAheadChunk
+
+	// the rest of the first chunk received, at off, in the packet pkt,
+	// and the error it came with
+	buf []byte
+	pkt []byte
+	err error
+}
+
+// readAheadChunk is a read request in flight.
+type readAheadChunk struct {
+	id  uint32
+	res chan result
+	off int64
+	len int
+}
+
+// dropReadAhead drops the data prefetched, for the next Read to start
+// prefetching from the offset of the File. f.mu is held.
+func (f *File) dropReadAhead() {
+	ra := f.readAhead
+	if ra == nil {
+		return
+	}
+
+	if ra.pkt != nil {
+		f.c.buffers.Put(ra.pkt)
+	}
+	ra.drain(f)
+	ra.buf, ra.pkt, ra.err = nil, nil, nil
+}
+
+// drain forgets the chunks in flight, their replies being discarded as
+// they come.
+func (ra *readAhead) drain(f *File) {
+	if len(ra.chunks) == 0 {
+		return
+	}
+	chunks := ra.chunks
+	ra.chunks = nil
+	go func() {
+		for _, chunk := range chunks {
+			if s := <-chunk.res; s.err == nil {
+				f.c.buffers.Put(s.data)
+			}
+		}
+	}()
+}
+
+// fill sends the read requests of the chunks missing from the window.
+func (ra *readAhead) fill(f *File) {
+	chunkSize := f.c.maxPacket
+	max := f.maxConcurrentRequests()
+	for len(ra.chunks) < max && (len(ra.chunks) == 0 || ra.next-ra.off < ra.window) {
+		chunk := readAheadChunk{
+			id:  f.c.nextID(),
+			res: make(chan result, 1),
+			off: ra.next,
+			len: chunkSize,
+		}
+		f.c.dispatchRequest(chunk.res, &sshFxpReadPacket{
+			ID:     chunk.id,
+			Handle: f.handle,
+			Offset: uint64(chunk.off),
+			Len:    uint32(chunk.len),
+		})
+		ra.chunks = append(ra.chunks, chunk)
+		ra.next += int64(chunkSize)
+	}
+}
+
+// receive waits for the first chunk in flight, at the offset of the File.
+func (ra *readAhead) receive(f *File) {
+	chunk := ra.chunks[0]
+	ra.chunks = ra.chunks[1:]
+
+	s := <-chunk.res
+	err := s.err
+	if err == nil {
+		switch s.typ {
+		case sshFxpStatus:
+			err = normaliseError(unmarshalStatus(chunk.id, s.data))
+		case sshFxpData:
+			sid, data := unmarshalUint32(s.data)
+			if sid != chunk.id {
+				err = &unexpectedIDErr{chunk.id, sid}
+				break
+			}
+			l, data := unmarshalUint32(data)
+			ra.buf, ra.pkt = data[:l], s.data
+			if l == 0 {
+				err = io.EOF
+			}
+		default:
+			err = unimplementedPacketErr(s.typ)
+		}
+	}
+
+	if err != nil || len(ra.buf) < chunk.len {
+		// the chunks requested next are past an error, or past the data
+		// of a short read which is to be requested again
+		ra.drain(f)
+		ra.next = chunk.off + int64(len(ra.buf))
+		ra.err = err
+	}
+}
+
+// readAheadRead implements Read with the data prefetched. f.mu is held.
+func (f *File) readAheadRead(b []byte) (int, error) {
+	if err := f.checkOpen("read"); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	ra := f.readAhead
+	if ra.off != f.offset {
+		f.dropReadAhead()
+	}
+	if len(ra.chunks) == 0 && len(ra.buf) == 0 && ra.err == nil {
+		ra.off, ra.next = f.offset, f.offset
+	}
+	for len(ra.buf) == 0 && ra.err == nil {
+		if ra.pkt != nil {
+			f.c.buffers.Put(ra.pkt)
+			ra.pkt = nil
+		}
+		ra.fill(f)
+		ra.receive(f)
+	}
+
+	n := copy(b, ra.buf)
+	ra.buf = ra.buf[n:]
+	ra.off += int64(n)
+	f.offset += int64(n)
+	if n == 0 {
+		// the error is returned once, the next Read trying again
+		err := ra.err
+		f.dropReadAhead()
+		return 0, err
+	}
+	return n, nil
+}
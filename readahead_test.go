@@ -0,0 +1,76 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileEnableReadAhead(t *testing.T) {
+	handlers := InMemHandler()
+	reads := &inflightReads{FileReader: handlers.FileGet}
+	handlers.FileGet = reads
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	data := make([]byte, 8*client.maxPacket+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, err := putTestFile(client, "/file", string(data))
+	require.NoError(t, err)
+	f, err := client.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+
+	f.EnableReadAhead(4 * client.maxPacket)
+	// reads smaller than the chunks, as io.Copy into a small buffer would
+	got, err := ioutil.ReadAll(io.LimitReader(f, int64(len(data)/2)))
+	require.NoError(t, err)
+	assert.Greater(t, reads.reset(), 1)
+
+	// the data prefetched past the offset is dropped
+	_, err = f.Seek(100, io.SeekStart)
+	require.NoError(t, err)
+	b := make([]byte, 1000)
+	_, err = io.ReadFull(f, b)
+	require.NoError(t, err)
+	assert.Equal(t, data[100:1100], b)
+
+	_, err = f.Seek(int64(len(got)), io.SeekStart)
+	require.NoError(t, err)
+	rest, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, append(got, rest...)))
+	n, err := f.Read(b)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	// the Writes are seen by the Reads following them
+	w, err := client.OpenFile("/file", 0x2) // os.O_RDWR
+	require.NoError(t, err)
+	defer w.Close()
+	w.EnableReadAhead(4 * client.maxPacket)
+	_, err = io.ReadFull(w, b[:10])
+	require.NoError(t, err)
+	_, err = w.Write([]byte("written"))
+	require.NoError(t, err)
+	_, err = w.Seek(10, io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.ReadFull(w, b[:7])
+	require.NoError(t, err)
+	assert.Equal(t, "written", string(b[:7]))
+
+	f.EnableReadAhead(0)
+	assert.Nil(t, f.readAhead)
+	reads.reset()
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	for err == nil {
+		_, err = f.Read(b)
+	}
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, reads.reset())
+}
@@ -0,0 +1,120 @@
+package sftp
+
+import (
+	"os"
+	"sync"
+
+	"github.com/kr/fs"
+)
+
+// maxConcurrentReadDirs is the max number of directories listed at once,
+// by ReadDirBatch, and by Walk and WalkDir unless set with
+// WithWalkConcurrency, in addition to the limit of the Client set by
+// MaxConcurrentRequestsPerFile.
+const maxConcurrentReadDirs = 16
+
+func (c *Client) readDirConcurrency() int {
+	if c.maxConcurrentRequests < maxConcurrentReadDirs {
+		return c.maxConcurrentRequests
+	}
+	return maxConcurrentReadDirs
+}
+
+// WithWalkConcurrency sets the max number of directories Walk and WalkDir
+// list at once, ahead of the walk. A limit of 1 lists them in turns.
+func WithWalkConcurrency(n int) TransferOption {
+	return func(o *transferOptions) {
+		o.walkConcurrency = n
+	}
+}
+
+// ReadDirBatch reads the directories named by paths concurrently, as ReadDir
+// does, which on high latency links is much faster than reading them in
+// turns. The entries and error of paths[i] are entries[i] and errs[i].
+func (c *Client) ReadDirBatch(paths []string) (entries [][]os.FileInfo, errs []error) {
+	entries = make([][]os.FileInfo, len(paths))
+	errs = make([]error, len(paths))
+
+	sem := make(chan struct{}, c.readDirConcurrency())
+	var wg sync.WaitGroup
+	for i, p := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, p string) {
+			defer wg.Done()
+			entries[i], errs[i] = c.ReadDir(p)
+			<-sem
+		}(i, p)
+	}
+	wg.Wait()
+
+	return entries, errs
+}
+
+// prefetchFS lists ahead of a walk the subdirectories of each directory
+// listed, concurrently, while the walk goes through the entries listed.
+// The ReadDir of its FileSystem must be safe for concurrent use.
+type prefetchFS struct {
+	fs.FileSystem
+	sem chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]*dirListing
+}
+
+// dirListing is the result of the ReadDir of a directory, once done is closed.
+type dirListing struct {
+	done    chan struct{}
+	entries []os.FileInfo
+	err     error
+}
+
+func newPrefetchFS(fsys fs.FileSystem, concurrency int) *prefetchFS {
+	return &prefetchFS{
+		FileSystem: fsys,
+		sem:        make(chan struct{}, concurrency),
+		pending:    make(map[string]*dirListing),
+	}
+}
+
+func (p *prefetchFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	p.mu.Lock()
+	l, ok := p.pending[dirname]
+	delete(p.pending, dirname)
+	p.mu.Unlock()
+
+	var entries []os.FileInfo
+	var err error
+	if ok {
+		<-l.done
+		entries, err = l.entries, l.err
+	} else {
+		entries, err = p.FileSystem.ReadDir(dirname)
+	}
+	if err == nil {
+		p.prefetch(dirname, entries)
+	}
+	return entries, err
+}
+
+// prefetch starts listing the subdirectories among the entries of dirname.
+func (p *prefetchFS) prefetch(dirname string, entries []os.FileInfo) {
+	for _, fi := range entries {
+		if !fi.IsDir() {
+			continue
+		}
+		name := p.Join(dirname, fi.Name())
+		l := &dirListing{done: make(chan struct{})}
+
+		p.mu.Lock()
+		p.pending[name] = l
+		p.mu.Unlock()
+
+		go func() {
+			p.sem <- struct{}{}
+			l.entries, l.err = p.FileSystem.ReadDir(name)
+			<-p.sem
+			close(l.done)
+		}()
+	}
+}
@@ -0,0 +1,97 @@
+package sftp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestTree creates a tree of depth levels with width directories and
+// files in each directory.
+func makeTestTree(t *testing.T, dir string, depth, width int) {
+	for i := 0; i < width; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		require.NoError(t, ioutil.WriteFile(name, []byte(name), 0644))
+		if depth > 1 {
+			sub := filepath.Join(dir, fmt.Sprintf("dir%d", i))
+			require.NoError(t, os.Mkdir(sub, 0755))
+			makeTestTree(t, sub, depth-1, width)
+		}
+	}
+}
+
+func TestReadDirBatch(t *testing.T) {
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-readdirbatch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	makeTestTree(t, dir, 2, 4)
+
+	paths := []string{
+		filepath.Join(dir, "dir0"),
+		filepath.Join(dir, "missing"),
+		dir,
+		filepath.Join(dir, "dir3"),
+	}
+	entries, errs := client.ReadDirBatch(paths)
+	require.Len(t, entries, len(paths))
+	require.Len(t, errs, len(paths))
+
+	for i, p := range paths {
+		want, wantErr := client.ReadDir(p)
+		if wantErr != nil {
+			assert.Equal(t, wantErr, errs[i], p)
+			continue
+		}
+		require.NoError(t, errs[i], p)
+		require.Len(t, entries[i], len(want), p)
+		for j := range want {
+			assert.Equal(t, want[j].Name(), entries[i][j].Name(), p)
+		}
+	}
+	assert.True(t, os.IsNotExist(errs[1]), "%v", errs[1])
+	assert.Len(t, entries[2], 8)
+}
+
+func TestWalkPrefetch(t *testing.T) {
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-walkprefetch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	makeTestTree(t, dir, 4, 3)
+
+	walk := func() []string {
+		var paths []string
+		w := client.Walk(dir)
+		for w.Step() {
+			require.NoError(t, w.Err())
+			paths = append(paths, w.Path())
+			if filepath.Base(w.Path()) == "dir2" {
+				w.SkipDir()
+			}
+		}
+		return paths
+	}
+
+	client.maxConcurrentRequests = 1
+	sequential := walk()
+	require.Len(t, sequential, 67)
+	for _, p := range sequential {
+		assert.NotContains(t, p, "dir2"+string(filepath.Separator), "skipped")
+	}
+
+	client.maxConcurrentRequests = 64
+	assert.Equal(t, sequential, walk())
+	assert.Equal(t, sequential, walk())
+}
@@ -0,0 +1,174 @@
+package sftp
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+)
+
+// DirIter iterates over the entries of a remote directory as the server
+// sends them, a batch at a time, rather than reading them all first like
+// ReadDir does: the next batch is requested while the entries of the
+// current one are iterated over.
+//
+//	it, err := client.ReadDirIter(dir)
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Stat().Name())
+//	}
+//	return it.Err()
+//
+// A DirIter is not safe for concurrent use.
+type DirIter struct {
+	c      *Client
+	ctx    context.Context
+	handle string
+
+	cur     os.FileInfo
+	entries []os.FileInfo // left in the current batch
+	err     error         // io.EOF once all the entries are read
+
+	// the request for the next batch, if sent
+	pkt     *sshFxpReaddirPacket
+	pending chan result
+
+	closed bool
+}
+
+// ReadDirIter opens the directory named by p, to iterate over its entries
+// with the returned DirIter, which must be closed.
+func (c *Client) ReadDirIter(p string) (*DirIter, error) {
+	return c.ReadDirIterContext(context.Background(), p)
+}
+
+// ReadDirIterContext is like ReadDirIter, but the DirIter stops with
+// ctx.Err() once ctx is done.
+func (c *Client) ReadDirIterContext(ctx context.Context, p string) (*DirIter, error) {
+	handle, err := c.opendir(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	it := &DirIter{c: c, ctx: ctx, handle: handle}
+	it.request()
+	return it, nil
+}
+
+// Next advances to the next entry, which Stat returns. It returns false
+// once all the entries are read, or after an error, which Err returns.
+func (it *DirIter) Next() bool {
+	for len(it.entries) == 0 {
+		if it.err != nil {
+			it.cur = nil
+			return false
+		}
+		it.entries, it.err = it.recv()
+		if it.err == nil {
+			it.request()
+		}
+	}
+	it.cur, it.entries = it.entries[0], it.entries[1:]
+	return true
+}
+
+// Stat returns the entry Next advanced to.
+func (it *DirIter) Stat() os.FileInfo {
+	return it.cur
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *DirIter) Err() error {
+	if it.err == io.EOF {
+		return nil
+	}
+	return it.err
+}
+
+// Close closes the directory, once the batch requested, if any, is
+// received.
+func (it *DirIter) Close() error {
+	if it.closed {
+		return os.ErrClosed
+	}
+	it.closed = true
+	if it.err == nil {
+		it.err = os.ErrClosed
+	}
+	it.entries, it.cur = nil, nil
+	if it.pending != nil {
+		<-it.pending
+		it.pending = nil
+	}
+	return it.c.close(it.handle)
+}
+
+// request requests the next batch of entries.
+func (it *DirIter) request() {
+	it.pkt = &sshFxpReaddirPacket{ID: it.c.nextID(), Handle: it.handle}
+	if err := it.ctx.Err(); err != nil {
+		it.c.clientConn.release(it.pkt.ID)
+		it.err = err
+		return
+	}
+	it.pending = make(chan result, 1)
+	it.c.clientConn.dispatchRequest(it.pending, it.c.versioned(it.pkt))
+}
+
+// recv receives the batch of entries requested.
+func (it *DirIter) recv() ([]os.FileInfo, error) {
+	var s result
+	select {
+	case s = <-it.pending:
+	case <-it.ctx.Done():
+		go it.c.abandon(it.pending, it.pkt)
+		it.pending = nil
+		return nil, it.ctx.Err()
+	}
+	it.pending = nil
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	switch s.typ {
+	case sshFxpName:
+		return it.c.unmarshalDirEntries(it.pkt.ID, s.data)
+	case sshFxpStatus:
+		if err := normaliseError(unmarshalStatus(it.pkt.ID, s.data)); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	default:
+		return nil, unimplementedPacketErr(s.typ)
+	}
+}
+
+// unmarshalDirEntries decodes the entries of the reply to the READDIR
+// request id, without the entries . and ..
+func (c *Client) unmarshalDirEntries(id uint32, data []byte) ([]os.FileInfo, error) {
+	sid, data := unmarshalUint32(data)
+	if sid != id {
+		return nil, &unexpectedIDErr{id, sid}
+	}
+	count, data := unmarshalUint32(data)
+	var entries []os.FileInfo
+	for i := uint32(0); i < count; i++ {
+		var filename string
+		filename, data = unmarshalString(data)
+		if c.version <= sftpProtocolVersion {
+			_, data = unmarshalString(data) // discard longname
+		}
+		attr, rest, err := c.unmarshalAttrs(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		if filename == "." || filename == ".." {
+			continue
+		}
+		entries = append(entries, fileInfoFromStat(attr, path.Base(filename)))
+	}
+	return entries, nil
+}
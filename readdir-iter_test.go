@@ -0,0 +1,77 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDirIter(t *testing.T) {
+	client, server := clientServerPair(t, WithMaxFilelist(16))
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-readdiriter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 50; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%02d", i))
+		require.NoError(t, ioutil.WriteFile(name, []byte(name), 0644))
+	}
+
+	want, err := client.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, want, 50)
+
+	it, err := client.ReadDirIter(dir)
+	require.NoError(t, err)
+	var got []os.FileInfo
+	for it.Next() {
+		got = append(got, it.Stat())
+	}
+	require.NoError(t, it.Err())
+	require.Len(t, got, len(want))
+	for i := range want {
+		assert.Equal(t, want[i].Name(), got[i].Name())
+		assert.Equal(t, want[i].Size(), got[i].Size())
+	}
+	assert.False(t, it.Next())
+	assert.Nil(t, it.Stat())
+	require.NoError(t, it.Close())
+	assert.Equal(t, os.ErrClosed, it.Close())
+
+	// closed while a batch is requested
+	it, err = client.ReadDirIter(dir)
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	require.NoError(t, it.Close())
+	assert.False(t, it.Next())
+	assert.Equal(t, os.ErrClosed, it.Err())
+
+	// stopped by its context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it, err = client.ReadDirIterContext(ctx, dir)
+	require.NoError(t, err)
+	n := 0
+	for it.Next() {
+		if n++; n == 20 {
+			cancel()
+		}
+	}
+	assert.Equal(t, context.Canceled, it.Err())
+	assert.True(t, n >= 20 && n < 50, "%d entries", n)
+	require.NoError(t, it.Close())
+
+	_, err = client.ReadDirIter(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	// the handles are closed
+	assert.Equal(t, 0, server.openFiles.len())
+}
@@ -0,0 +1,87 @@
+package sftp
+
+import "io"
+
+// ReadOnlyHandlers returns the Handlers serving h read-only: the files are
+// read and listed by h, while the requests changing them, as writing,
+// Setstat, Rename, Remove, Mkdir or Symlink, fail with a permission denied
+// error without reaching h.
+func ReadOnlyHandlers(h Handlers) Handlers {
+	return Handlers{
+		FileGet:  readOnlyReader{h.FileGet},
+		FilePut:  readOnlyWriter{},
+		FileCmd:  readOnlyCmder{h.FileCmd},
+		FileList: h.FileList,
+	}
+}
+
+// readOnlyReader opens the files of a FileReader read-only.
+type readOnlyReader struct {
+	FileReader
+}
+
+func (h readOnlyReader) Fileread(r *Request) (io.ReaderAt, error) {
+	rd, err := h.FileReader.Fileread(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := rd.(FsetStater); ok {
+		// the attributes are set with Filecmd instead, which is denied
+		return readOnlyFile{rd}, nil
+	}
+	return rd, nil
+}
+
+// OpenFlagsV6 implements OpenFlagsV6Handler, for the FileReaders which do.
+func (h readOnlyReader) OpenFlagsV6() FileOpenFlagsV6 {
+	if v6, ok := h.FileReader.(OpenFlagsV6Handler); ok {
+		return v6.OpenFlagsV6()
+	}
+	return FileOpenFlagsV6{}
+}
+
+// readOnlyFile hides the Fsetstat of an io.ReaderAt, keeping its Close and
+// TransferError.
+type readOnlyFile struct {
+	io.ReaderAt
+}
+
+func (f readOnlyFile) Close() error {
+	if c, ok := f.ReaderAt.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (f readOnlyFile) TransferError(err error) {
+	if t, ok := f.ReaderAt.(TransferError); ok {
+		t.TransferError(err)
+	}
+}
+
+// readOnlyWriter denies opening files for writing. It is no CopyFileWriter,
+// for the copy-file extension not to be advertised.
+type readOnlyWriter struct{}
+
+func (readOnlyWriter) Filewrite(*Request) (io.WriterAt, error) {
+	return nil, ErrSSHFxPermissionDenied
+}
+
+// readOnlyCmder denies the commands of a FileCmder, which all change files,
+// but StatVFS. The PosixRenames are denied as the Renames they fall back to,
+// and the Fsyncs, of files opened to be read only, are not supported.
+type readOnlyCmder struct {
+	FileCmder
+}
+
+func (readOnlyCmder) Filecmd(*Request) error {
+	return ErrSSHFxPermissionDenied
+}
+
+// StatVFS implements StatVFSFileCmder, for the FileCmders which do.
+func (h readOnlyCmder) StatVFS(r *Request) (*StatVFS, error) {
+	if statVFSCmdr, ok := h.FileCmder.(StatVFSFileCmder); ok {
+		return statVFSCmdr.StatVFS(r)
+	}
+	return nil, ErrSSHFxOpUnsupported
+}
@@ -0,0 +1,97 @@
+package sftp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyHandlers(t *testing.T) {
+	// the same files, read-write on "/rw" and read-only on "/ro"
+	h := InMemHandler()
+	client, _ := handlersClientPair(t, MountHandlers(map[string]Handlers{
+		"/rw": h,
+		"/ro": ReadOnlyHandlers(h),
+	}), nil)
+
+	require.NoError(t, client.Mkdir("/rw/dir"))
+	_, err := putTestFile(client, "/rw/dir/file", "data")
+	require.NoError(t, err)
+
+	// reads and lists
+	data, err := getTestFile(client, "/ro/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	assert.Equal(t, []string{"file"}, readDirNames(t, client, "/ro/dir"))
+	fi, err := client.Stat("/ro/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), fi.Size())
+
+	// changes
+	_, err = client.Create("/ro/dir/new")
+	assert.True(t, os.IsPermission(err), err)
+	_, err = client.OpenFile("/ro/dir/file", os.O_RDWR)
+	assert.True(t, os.IsPermission(err), err)
+	assert.True(t, os.IsPermission(client.Mkdir("/ro/new")))
+	assert.True(t, os.IsPermission(client.Remove("/ro/dir/file")))
+	assert.True(t, os.IsPermission(client.Rename("/ro/dir/file", "/ro/dir/renamed")))
+	assert.True(t, os.IsPermission(client.PosixRename("/ro/dir/file", "/ro/dir/renamed")))
+	assert.True(t, os.IsPermission(client.Symlink("/ro/dir/file", "/ro/dir/link")))
+	assert.True(t, os.IsPermission(client.Chmod("/ro/dir/file", 0600)))
+
+	data, err = getTestFile(client, "/rw/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	assert.Equal(t, []string{"file"}, readDirNames(t, client, "/rw/dir"))
+}
+
+// fsetStatReader records the Fsetstat requests made on its handles.
+type fsetStatReader struct {
+	FileReader
+	reqs chan *Request
+}
+
+func (h fsetStatReader) Fileread(r *Request) (io.ReaderAt, error) {
+	rd, err := h.FileReader.Fileread(r)
+	if err != nil {
+		return nil, err
+	}
+	return fsetStatReaderAt{rd, h.reqs}, nil
+}
+
+type fsetStatReaderAt struct {
+	io.ReaderAt
+	reqs chan *Request
+}
+
+func (rd fsetStatReaderAt) Fsetstat(r *Request) error {
+	rd.reqs <- r
+	return nil
+}
+
+func TestReadOnlyHandlersFsetstat(t *testing.T) {
+	h := InMemHandler()
+	reader := fsetStatReader{h.FileGet, make(chan *Request, 1)}
+	ro := h
+	ro.FileGet = reader
+	client, _ := handlersClientPair(t, MountHandlers(map[string]Handlers{
+		"/rw": h,
+		"/ro": ReadOnlyHandlers(ro),
+	}), nil)
+
+	_, err := putTestFile(client, "/rw/file", "data")
+	require.NoError(t, err)
+
+	f, err := client.Open("/ro/file")
+	require.NoError(t, err)
+	defer f.Close()
+	assert.True(t, os.IsPermission(f.Chmod(0600)))
+	assert.Empty(t, reader.reqs)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
@@ -0,0 +1,302 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The defaults of the ReconnectOptions.
+const (
+	defaultMaxReconnects     = 5
+	defaultReconnectBackoff  = 100 * time.Millisecond
+	defaultReconnectMaxDelay = 10 * time.Second
+)
+
+// ReconnectingClient wraps the Client returned by a dial function, to dial
+// again when the connection is lost, and retry the operation interrupted.
+// Only the operations which can be repeated are retried by its methods;
+// the others may be done with Client, or Do. Upload and Download resume
+// the transfer interrupted rather than starting over. The retries wait
+// for an exponential backoff, see ReconnectBackoff, up to MaxReconnects
+// times.
+// A ReconnectingClient is safe for concurrent use.
+type ReconnectingClient struct {
+	dial       func() (*Client, error)
+	maxRetries int
+	backoff    time.Duration
+	maxDelay   time.Duration
+
+	mu     sync.Mutex
+	c      *Client // lost when dialing it again failed
+	closed bool
+}
+
+// ReconnectOption configures a ReconnectingClient.
+type ReconnectOption func(*ReconnectingClient)
+
+// MaxReconnects sets the number of times an operation is retried once
+// its connection is lost, dialing again each time. The default is 5.
+func MaxReconnects(n int) ReconnectOption {
+	return func(rc *ReconnectingClient) {
+		rc.maxRetries = n
+	}
+}
+
+// ReconnectBackoff sets the delay before the first retry of an operation,
+// which doubles for each of the next ones up to max. The defaults are
+// 100ms and 10s.
+func ReconnectBackoff(initial, max time.Duration) ReconnectOption {
+	return func(rc *ReconnectingClient) {
+		rc.backoff = initial
+		rc.maxDelay = max
+	}
+}
+
+// NewReconnectingClient returns a ReconnectingClient of the Client
+// returned by dial, which is called again for a new Client each time the
+// connection is lost.
+func NewReconnectingClient(dial func() (*Client, error), opts ...ReconnectOption) (*ReconnectingClient, error) {
+	rc := &ReconnectingClient{
+		dial:       dial,
+		maxRetries: defaultMaxReconnects,
+		backoff:    defaultReconnectBackoff,
+		maxDelay:   defaultReconnectMaxDelay,
+	}
+	for _, opt := range opts {
+		opt(rc)
+	}
+
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	rc.c = c
+	return rc, nil
+}
+
+// Client returns the current Client, to do the operations which are not
+// retried. It may have lost its connection since.
+func (rc *ReconnectingClient) Client() *Client {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.c
+}
+
+// Close closes the current Client.
+func (rc *ReconnectingClient) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return os.ErrClosed
+	}
+	rc.closed = true
+	if rc.c.clientConn.lost() {
+		return rc.c.teardown()
+	}
+	return rc.c.Close()
+}
+
+// Do calls op with the current Client, and again with a new one, as long
+// as it fails because the connection was lost. op must be safe to repeat,
+// such as by doing nothing if done already.
+func (rc *ReconnectingClient) Do(op func(*Client) error) error {
+	return rc.retry(op, op)
+}
+
+// retry calls first with the current Client, and then, each time the
+// connection of the last Client is lost, redials and calls again with the
+// new Client.
+func (rc *ReconnectingClient) retry(first, again func(*Client) error) error {
+	c, err := rc.current()
+	if err != nil {
+		return err
+	}
+	err = first(c)
+	for retry := 0; err != nil && retry < rc.maxRetries; retry++ {
+		if c != nil && !lostConn(c, err) {
+			return err
+		}
+		rc.sleep(retry)
+
+		var redialErr error
+		if c, redialErr = rc.redial(c); redialErr != nil {
+			if rc.isClosed() {
+				return redialErr
+			}
+			// dialing failed, it counts as an attempt
+			c, err = nil, redialErr
+			continue
+		}
+		err = again(c)
+	}
+	return err
+}
+
+// current returns the current Client, to be dialed again if lost.
+func (rc *ReconnectingClient) current() (*Client, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return nil, os.ErrClosed
+	}
+	return rc.c, nil
+}
+
+func (rc *ReconnectingClient) isClosed() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.closed
+}
+
+// redial replaces the Client lost, unless it was replaced already, and
+// returns the new Client. A nil lost replaces the current Client if it is
+// lost too.
+func (rc *ReconnectingClient) redial(lost *Client) (*Client, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return nil, os.ErrClosed
+	}
+	if rc.c != lost && (lost != nil || !rc.c.clientConn.lost()) {
+		return rc.c, nil
+	}
+
+	c, err := rc.dial()
+	if err != nil {
+		return nil, err
+	}
+	rc.c.teardown()
+	rc.c = c
+	return c, nil
+}
+
+// sleep waits for the backoff of the retry, counted from 0.
+func (rc *ReconnectingClient) sleep(retry int) {
+	delay := rc.backoff
+	for i := 0; i < retry && delay < rc.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > rc.maxDelay {
+		delay = rc.maxDelay
+	}
+	t, ch := pkgClock.NewTimer(delay)
+	defer t.Stop()
+	<-ch
+}
+
+// lostConn reports whether err, returned by an operation of c, is due to
+// the loss of its connection.
+func lostConn(c *Client, err error) bool {
+	return errors.Is(err, ErrSSHFxConnectionLost) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) || c.clientConn.lost()
+}
+
+// Stat returns a FileInfo structure describing the file specified by path,
+// as Client.Stat does, retried once reconnected.
+func (rc *ReconnectingClient) Stat(p string) (fi os.FileInfo, err error) {
+	err = rc.Do(func(c *Client) (err error) {
+		fi, err = c.Stat(p)
+		return err
+	})
+	return fi, err
+}
+
+// Lstat returns a FileInfo structure describing the file specified by path,
+// as Client.Lstat does, retried once reconnected.
+func (rc *ReconnectingClient) Lstat(p string) (fi os.FileInfo, err error) {
+	err = rc.Do(func(c *Client) (err error) {
+		fi, err = c.Lstat(p)
+		return err
+	})
+	return fi, err
+}
+
+// ReadDir reads the directory named by dirname, as Client.ReadDir does,
+// retried once reconnected.
+func (rc *ReconnectingClient) ReadDir(dirname string) (list []os.FileInfo, err error) {
+	err = rc.Do(func(c *Client) (err error) {
+		list, err = c.ReadDir(dirname)
+		return err
+	})
+	return list, err
+}
+
+// ReadLink reads the target of a symbolic link, as Client.ReadLink does,
+// retried once reconnected.
+func (rc *ReconnectingClient) ReadLink(p string) (target string, err error) {
+	err = rc.Do(func(c *Client) (err error) {
+		target, err = c.ReadLink(p)
+		return err
+	})
+	return target, err
+}
+
+// RealPath returns the canonical absolute path of p, as Client.RealPath
+// does, retried once reconnected.
+func (rc *ReconnectingClient) RealPath(p string) (real string, err error) {
+	err = rc.Do(func(c *Client) (err error) {
+		real, err = c.RealPath(p)
+		return err
+	})
+	return real, err
+}
+
+// Chmod changes the permissions of the named file, as Client.Chmod does,
+// retried once reconnected.
+func (rc *ReconnectingClient) Chmod(p string, mode os.FileMode) error {
+	return rc.Do(func(c *Client) error { return c.Chmod(p, mode) })
+}
+
+// Chown changes the user and group owners of the named file, as
+// Client.Chown does, retried once reconnected.
+func (rc *ReconnectingClient) Chown(p string, uid, gid int) error {
+	return rc.Do(func(c *Client) error { return c.Chown(p, uid, gid) })
+}
+
+// Chtimes changes the access and modification times of the named file, as
+// Client.Chtimes does, retried once reconnected.
+func (rc *ReconnectingClient) Chtimes(p string, atime, mtime time.Time) error {
+	return rc.Do(func(c *Client) error { return c.Chtimes(p, atime, mtime) })
+}
+
+// Truncate sets the size of the named file, as Client.Truncate does,
+// retried once reconnected.
+func (rc *ReconnectingClient) Truncate(p string, size int64) error {
+	return rc.Do(func(c *Client) error { return c.Truncate(p, size) })
+}
+
+// MkdirAll creates a directory named path, along with any necessary
+// parents, as Client.MkdirAll does, retried once reconnected.
+func (rc *ReconnectingClient) MkdirAll(p string) error {
+	return rc.Do(func(c *Client) error { return c.MkdirAll(p) })
+}
+
+// Upload copies the local file localPath to remotePath, as Client.Upload
+// does. Once reconnected, the upload interrupted is resumed as by
+// ResumeUpload, or started over if the writes were concurrent, see
+// UseConcurrentWrites, as the data acknowledged may then have gaps.
+func (rc *ReconnectingClient) Upload(localPath, remotePath string, opts ...TransferOption) error {
+	return rc.retry(func(c *Client) error {
+		return c.Upload(localPath, remotePath, opts...)
+	}, func(c *Client) error {
+		if c.useConcurrentWrites {
+			return c.Upload(localPath, remotePath, opts...)
+		}
+		return c.ResumeUpload(localPath, remotePath, opts...)
+	})
+}
+
+// Download copies the remote file remotePath to localPath, as
+// Client.Download does. Once reconnected, the download interrupted is
+// resumed as by ResumeDownload.
+func (rc *ReconnectingClient) Download(remotePath, localPath string, opts ...TransferOption) error {
+	return rc.retry(func(c *Client) error {
+		return c.Download(remotePath, localPath, opts...)
+	}, func(c *Client) error {
+		return c.ResumeDownload(remotePath, localPath, opts...)
+	})
+}
@@ -0,0 +1,89 @@
+package sftp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconnectingClient(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	dir, err := ioutil.TempDir("", "sftptest-reconnect")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(name, []byte("hello world"), 0600))
+
+	var servers []*Server
+	var dialErr error
+	dial := func() (*Client, error) {
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		client, server := clientServerPair(t)
+		servers = append(servers, server)
+		return client, nil
+	}
+	// lose closes the connection of the current Client, once it knows
+	lose := func(rc *ReconnectingClient) {
+		servers[len(servers)-1].Close()
+		require.Eventually(t, rc.Client().clientConn.lost, time.Second, time.Millisecond)
+	}
+
+	rc, err := NewReconnectingClient(dial, ReconnectBackoff(time.Millisecond, time.Millisecond), MaxReconnects(2))
+	require.NoError(t, err)
+
+	fi, err := rc.Stat(name)
+	require.NoError(t, err)
+	assert.EqualValues(t, 11, fi.Size())
+
+	lose(rc)
+	fi, err = rc.Stat(name)
+	require.NoError(t, err)
+	assert.EqualValues(t, 11, fi.Size())
+	assert.Len(t, servers, 2)
+
+	// the download resumes where it stopped
+	local := filepath.Join(dir, "local")
+	require.NoError(t, ioutil.WriteFile(local, []byte("hello"), 0600))
+	lose(rc)
+	calls := 0
+	require.NoError(t, rc.retry(func(c *Client) error {
+		calls++
+		return ErrSSHFxConnectionLost
+	}, func(c *Client) error {
+		calls++
+		return c.ResumeDownload(name, local)
+	}))
+	assert.Equal(t, 2, calls)
+	b, err := ioutil.ReadFile(local)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(b))
+
+	// the other errors are not retried
+	_, err = rc.Stat(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, servers, 3)
+
+	// up to the max retries
+	dialErr = errors.New("unreachable")
+	lose(rc)
+	_, err = rc.Stat(name)
+	assert.Equal(t, dialErr, err)
+
+	dialErr = nil
+	require.NoError(t, rc.Download(name, local))
+	servers[len(servers)-1].Close()
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, os.ErrClosed, rc.Close())
+	_, err = rc.Stat(name)
+	assert.Equal(t, os.ErrClosed, err)
+}
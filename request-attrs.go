@@ -2,7 +2,8 @@ package sftp
 
 // Methods on the Request object to make working with the Flags bitmasks and
 // Attr(ibutes) byte blob easier. Use Pflags() when working with an Open/Write
-// request and AttrFlags() and Attributes() when working with SetStat requests.
+// request, OpenAttributes() for the attributes of an Open/Write request, and
+// AttrFlags() and Attributes() when working with SetStat requests.
 import "os"
 
 // FileOpenFlags defines Open and Write Flags. Correlate directly with with os.OpenFile flags
@@ -28,6 +29,49 @@ func (r *Request) Pflags() FileOpenFlags {
 	return newFileOpenFlags(r.Flags)
 }
 
+// OSFlags returns the flags of os.OpenFile equivalent to f, for backends
+// opening files with it. Append is ignored, as O_APPEND conflicts with WriteAt
+// and the clients send the offsets to write at.
+func (f FileOpenFlags) OSFlags() int {
+	var flags int
+	switch {
+	case f.Read && f.Write:
+		flags = os.O_RDWR
+	case f.Write:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+	if f.Creat {
+		flags |= os.O_CREATE
+	}
+	if f.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if f.Excl {
+		flags |= os.O_EXCL
+	}
+	return flags
+}
+
+// Check enforces f, as os.OpenFile does, for backends knowing whether the
+// file to open exists, and returns whether the file is to be created, or to
+// be truncated. It fails with os.ErrExist when the file exists and f is an
+// exclusive create, and with os.ErrNotExist when the file does not exist and
+// f is not a create.
+func (f FileOpenFlags) Check(exists bool) (create, truncate bool, err error) {
+	switch {
+	case exists && f.Creat && f.Excl:
+		return false, false, os.ErrExist
+	case exists:
+		return false, f.Trunc, nil
+	case f.Creat:
+		return true, false, nil
+	default:
+		return false, false, os.ErrNotExist
+	}
+}
+
 // FileAttrFlags that indicate whether SFTP file attributes were passed. When a flag is
 // true the corresponding attribute should be available from the FileStat
 // object returned by Attributes method. Used with SetStat.
@@ -55,6 +99,14 @@ func (a FileStat) FileMode() os.FileMode {
 	return os.FileMode(a.Mode)
 }
 
+// OpenAttributes returns the attributes sent with the SSH_FXP_OPEN of an Open,
+// Get or Put request, and which of them were sent, such as the permissions
+// for a file created by the request.
+func (r *Request) OpenAttributes() (FileAttrFlags, *FileStat) {
+	fs, _ := getFileStat(r.openAttrFlags, r.Attrs)
+	return newFileAttrFlags(r.openAttrFlags), fs
+}
+
 // Attributes parses file attributes byte blob and return them in a
 // FileStat object.
 func (r *Request) Attributes() *FileStat {
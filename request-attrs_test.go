@@ -56,3 +56,33 @@ func TestRequestAttributesEmpty(t *testing.T) {
 	}, fs)
 	assert.Empty(t, b)
 }
+
+func TestFileOpenFlagsOSFlags(t *testing.T) {
+	assert.Equal(t, os.O_RDONLY, newFileOpenFlags(sshFxfRead).OSFlags())
+	assert.Equal(t, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		newFileOpenFlags(sshFxfWrite|sshFxfCreat|sshFxfTrunc).OSFlags())
+	assert.Equal(t, os.O_RDWR|os.O_CREATE|os.O_EXCL,
+		newFileOpenFlags(sshFxfRead|sshFxfWrite|sshFxfAppend|sshFxfCreat|sshFxfExcl).OSFlags())
+}
+
+func TestFileOpenFlagsCheck(t *testing.T) {
+	for _, tt := range []struct {
+		flags            uint32
+		exists           bool
+		create, truncate bool
+		err              error
+	}{
+		{flags: sshFxfWrite, exists: true},
+		{flags: sshFxfWrite, err: os.ErrNotExist},
+		{flags: sshFxfWrite | sshFxfTrunc, exists: true, truncate: true},
+		{flags: sshFxfWrite | sshFxfCreat | sshFxfTrunc, exists: true, truncate: true},
+		{flags: sshFxfWrite | sshFxfCreat | sshFxfTrunc, create: true},
+		{flags: sshFxfWrite | sshFxfCreat | sshFxfExcl, exists: true, err: os.ErrExist},
+		{flags: sshFxfWrite | sshFxfCreat | sshFxfExcl, create: true},
+	} {
+		create, truncate, err := newFileOpenFlags(tt.flags).Check(tt.exists)
+		assert.Equal(t, tt.err, err, "%#x exists %v", tt.flags, tt.exists)
+		assert.Equal(t, tt.create, create, "%#x exists %v", tt.flags, tt.exists)
+		assert.Equal(t, tt.truncate, truncate, "%#x exists %v", tt.flags, tt.exists)
+	}
+}
@@ -23,7 +23,7 @@ var errTooManySymlinks = errors.New("too many symbolic links")
 // InMemHandler returns a Hanlders object with the test handlers.
 func InMemHandler() Handlers {
 	root := &root{
-		rootFile: &memFile{name: "/", modtime: time.Now(), isdir: true},
+		rootFile: &memFile{name: "/", modtime: pkgClock.Now(), isdir: true},
 		files:    make(map[string]*memFile),
 	}
 	return Handlers{root, root, root, root}
@@ -109,7 +109,7 @@ func (fs *root) openfile(pathname string, flags uint32) (*memFile, error) {
 		}
 
 		file := &memFile{
-			modtime: time.Now(),
+			modtime: pkgClock.Now(),
 		}
 
 		if err := fs.putfile(pathname, file); err != nil {
@@ -266,6 +266,37 @@ func (fs *root) PosixRename(r *Request) error {
 	return fs.rename(r.Filepath, r.Target)
 }
 
+func (fs *root) CopyFile(r *Request) error {
+	if fs.mockErr != nil {
+		return fs.mockErr
+	}
+	_ = r.WithContext(r.Context()) // initialize context for deadlock testing
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	src, err := fs.fetch(r.Filepath)
+	if err != nil {
+		return err
+	}
+	if src.IsDir() {
+		return os.ErrInvalid
+	}
+	src.mu.RLock()
+	content := append([]byte(nil), src.content...)
+	src.mu.RUnlock()
+
+	dst, err := fs.openfile(r.Target, r.Flags)
+	if err != nil {
+		return err
+	}
+	dst.mu.Lock()
+	dst.content = content
+	dst.mu.Unlock()
+
+	return nil
+}
+
 func (fs *root) StatVFS(r *Request) (*StatVFS, error) {
 	if fs.mockErr != nil {
 		return nil, fs.mockErr
@@ -276,7 +307,7 @@ func (fs *root) StatVFS(r *Request) (*StatVFS, error) {
 
 func (fs *root) mkdir(pathname string) error {
 	dir := &memFile{
-		modtime: time.Now(),
+		modtime: pkgClock.Now(),
 		isdir:   true,
 	}
 
@@ -326,7 +357,7 @@ func (fs *root) link(oldpath, newpath string) error {
 // NOTE! This would be called with `symlink(req.Filepath, req.Target)` due to different semantics.
 func (fs *root) symlink(target, linkpath string) error {
 	link := &memFile{
-		modtime: time.Now(),
+		modtime: pkgClock.Now(),
 		symlink: target,
 	}
 
@@ -464,12 +495,12 @@ func (fs *root) Lstat(r *Request) (ListerAt, error) {
 	return listerat{file}, nil
 }
 
-// implements RealpathFileLister interface
-func (fs *root) Realpath(p string) string {
+// implements RealPathFileLister interface
+func (fs *root) RealPath(p string) (string, error) {
 	if fs.startDirectory == "" || fs.startDirectory == "/" {
-		return cleanPath(p)
+		return cleanPath(p), nil
 	}
-	return cleanPathWithBase(fs.startDirectory, p)
+	return cleanPathWithBase(fs.startDirectory, p), nil
 }
 
 // In memory file-system-y thing that the Hanlders live on
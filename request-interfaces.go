@@ -1,8 +1,10 @@
 package sftp
 
 import (
+	"context"
 	"io"
 	"os"
+	"time"
 )
 
 // WriterAtReaderAt defines the interface to return when a file is to
@@ -48,6 +50,20 @@ type OpenFileWriter interface {
 	OpenFile(*Request) (WriterAtReaderAt, error)
 }
 
+// CopyFileWriter is a FileWriter that implements the CopyFile method, to
+// serve the copy-file extension by copying the file Filepath to Target
+// itself, such as with a copy made by the storage. The Flags of the Request
+// are the ones to open Target with: its Pflags have Excl set when an
+// existing Target must not be replaced. If this interface is not
+// implemented, copy-file requests are not supported; the copy-data
+// requests, copying data between open files, are served with the
+// io.ReaderAt and io.WriterAt of the files.
+// Called for Methods: CopyFile
+type CopyFileWriter interface {
+	FileWriter
+	CopyFile(*Request) error
+}
+
 // FileCmder should return an error
 // Note in cases of an error, the error text will be sent to the client.
 // Called for Methods: Setstat, Rename, Rmdir, Mkdir, Link, Symlink, Remove
@@ -57,7 +73,10 @@ type FileCmder interface {
 
 // PosixRenameFileCmder is a FileCmder that implements the PosixRename method.
 // If this interface is implemented PosixRename requests will call it
-// otherwise they will be handled in the same way as Rename
+// otherwise they will be handled in the same way as Rename.
+// PosixRename serves posix-rename@openssh.com, renaming Filepath to Target
+// like rename(2): an existing Target is replaced, atomically when the
+// backend can.
 type PosixRenameFileCmder interface {
 	FileCmder
 	PosixRename(*Request) error
@@ -71,6 +90,32 @@ type StatVFSFileCmder interface {
 	StatVFS(*Request) (*StatVFS, error)
 }
 
+// SetstatFileCmder is a FileCmder that implements typed methods to change
+// the attributes of the file Filepath. If this interface is implemented,
+// Setstat requests call the methods of the attributes sent, rather than
+// Filecmd: Truncate, Chmod, Chtimes and then Chown, stopping at the first
+// error, returned to the client, the changes made before it included.
+// Called for Methods: Setstat
+type SetstatFileCmder interface {
+	FileCmder
+	Truncate(r *Request, size int64) error
+	Chmod(r *Request, mode os.FileMode) error
+	Chtimes(r *Request, atime, mtime time.Time) error
+	Chown(r *Request, uid, gid int) error
+}
+
+// FsyncFileCmder is a FileCmder that implements the Fsync method, to serve
+// the fsync@openssh.com extension by flushing the file Filepath, open for
+// writing, to durable storage. If this interface is not implemented, or
+// Fsync returns ErrSSHFxOpUnsupported, the io.WriterAt or
+// WriterAtReaderAt of the file is synced if it has a Sync() error method,
+// as *os.File does; otherwise the request is not supported.
+// Called for Methods: Fsync
+type FsyncFileCmder interface {
+	FileCmder
+	Fsync(*Request) error
+}
+
 // FileLister should return an object that fulfils the ListerAt interface
 // Note in cases of an error, the error text will be sent to the client.
 // Called for Methods: List, Stat, Readlink
@@ -87,14 +132,38 @@ type LstatFileLister interface {
 }
 
 // RealPathFileLister is a FileLister that implements the Realpath method.
-// We use "/" as start directory for relative paths, implementing this
-// interface you can customize the start directory.
-// You have to return an absolute POSIX path.
+// We use "/" as start directory for relative paths, and clean the paths
+// lexically, implementing this interface you can customize the start
+// directory, or resolve the paths as the backend does, such as following its
+// links or mapping virtual paths. You have to return an absolute POSIX path,
+// or an error, sent to the client, such as os.ErrNotExist.
+// Called for Methods: Realpath
 type RealPathFileLister interface {
+	FileLister
+	RealPath(string) (string, error)
+}
+
+// legacyRealPathFileLister is the RealPathFileLister of the implementations
+// predating the error of RealPath, still supported.
+type legacyRealPathFileLister interface {
 	FileLister
 	RealPath(string) string
 }
 
+// ChecksumFileLister is a FileLister that implements the Checksum method, to
+// serve the check-file-name and check-file-handle extensions with the hashes
+// of the files it computes itself, such as the checksums kept by the storage.
+// Checksum returns the hash of the length bytes from offset of the file
+// Filepath, or of its data up to the end of the file with a length of 0,
+// with the algorithm "md5", "sha1" or "sha256". Returning
+// ErrSSHFxOpUnsupported tries the next algorithm requested by the client,
+// before hashing the data read with the io.ReaderAt of the file instead.
+// Called for Methods: Checksum
+type ChecksumFileLister interface {
+	FileLister
+	Checksum(r *Request, algorithm string, offset, length int64) ([]byte, error)
+}
+
 // ListerAt does for file lists what io.ReaderAt does for files.
 // ListAt should return the number of entries copied and an io.EOF
 // error if at end of list. This is testable by comparing how many you
@@ -105,6 +174,26 @@ type ListerAt interface {
 	ListAt([]os.FileInfo, int64) (int, error)
 }
 
+// ListerAtContext is like ListerAt, with the context of the Request listed,
+// for slow backends to abort a listing once it is canceled: when the client
+// closes the directory or disconnects, or the call times out, see
+// WithRSHandlerTimeout. A FileLister returns it as a ListerAt wrapped with
+// ContextListerAt.
+type ListerAtContext interface {
+	ListAt(ctx context.Context, ls []os.FileInfo, offset int64) (int, error)
+}
+
+// FsetStater is an optional interface that the io.ReaderAt, io.WriterAt or
+// WriterAtReaderAt returned for a handle can implement to apply the attribute
+// changes made on the handle, with SSH_FXP_FSETSTAT, to the open object itself,
+// such as to set the metadata of an upload in progress. The Request has the
+// Filepath of the handle, and the Flags and Attrs to set.
+// If not implemented, the changes are handled by FileCmder.Filecmd.
+// Called for Methods: Setstat
+type FsetStater interface {
+	Fsetstat(*Request) error
+}
+
 // TransferError is an optional interface that readerAt and writerAt
 // can implement to be notified about the error causing Serve() to exit
 // with the request still open
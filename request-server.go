@@ -3,12 +3,14 @@ package sftp
 import (
 	"context"
 	"io"
+	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 )
 
 var maxTxPacket uint32 = 1 << 15
@@ -22,15 +24,56 @@ type Handlers struct {
 }
 
 // RequestServer abstracts the sftp protocol with an http request-like protocol
+//
+// A panic in the Handlers fails the request being served, and is logged,
+// rather than tearing down the session.
 type RequestServer struct {
 	*serverConn
-	Handlers        Handlers
-	pktMgr          *packetManager
-	openRequests    map[string]*Request
-	openRequestLock sync.RWMutex
-	handleCount     int
+	Handlers     Handlers
+	pktMgr       *packetManager
+	openRequests *handleTable // handle -> *Request
+	maxFilelist  int64
+	// async writes are allowed by WithRSAsyncWrites and enabled once
+	// negotiated with the client
+	allowAsyncWrites bool
+	allowCompression bool
+	asyncWrites      bool
+	// if not empty, requests are served with profiler labels of this session
+	profileSession string
+	// if not zero, the maximum duration of a call to the Handlers
+	handlerTimeout time.Duration
+	// if not nil, the directory entries are passed through it
+	listFilter ListFilter
+	// the INIT of the client, once received
+	client clientInfoHolder
+	// set by WithRSStagedUploads
+	stagedUploads bool
+	// set by WithRSLongNameFormatter
+	longName LongNameFormatter
+	// set by WithRSDenyRules
+	denyRules denyRules
+	// set by WithRSPolicy
+	policy *Policy
+	// set by WithRSLimits
+	limits Limits
+	// set by WithRSNamesLookup
+	names NamesLookup
+	// set by WithRSMiddleware
+	middleware []func(next Handler) Handler
+	// the version 6 is allowed by WithRSProtocolVersion6, and version is
+	// the version negotiated, set atomically
+	allowV6 bool
+	version uint32
+	// set by Shutdown, shuttingDown atomically
+	drainMu      sync.Mutex
+	drain        *requestServerDrain
+	shuttingDown int32
 }
 
+// errHandlerTimeout is returned to the client for a call to the Handlers
+// exceeding the duration set by WithRSHandlerTimeout.
+var errHandlerTimeout = errors.New("request timed out")
+
 // A RequestServerOption is a function which applies configuration to a RequestServer.
 type RequestServerOption func(*RequestServer)
 
@@ -46,6 +89,100 @@ func WithRSAllocator() RequestServerOption {
 	}
 }
 
+// WithRSPacketAllocator enables the allocator, as WithRSAllocator does,
+// with its pages provided by a rather than the default sync.Pool.
+//
+// The Server equivalent is WithPacketAllocator.
+func WithRSPacketAllocator(a Allocator) RequestServerOption {
+	return func(rs *RequestServer) {
+		alloc := newAllocator()
+		alloc.pages = a
+		rs.pktMgr.alloc = alloc
+		rs.conn.alloc = alloc
+	}
+}
+
+// WithRSMaxFilelist sets the max number of entries requested from a ListerAt
+// for a single readdir batch. Fewer entries are returned if sending all of
+// them would exceed the max packet length accepted by clients.
+//
+// If this option is not used, or n is less than 1, MaxFilelist is used:
+// unlike WithMaxFilelist for Server, invalid values are ignored,
+// as a RequestServerOption cannot return an error.
+func WithRSMaxFilelist(n int) RequestServerOption {
+	return func(rs *RequestServer) {
+		if n > 0 {
+			rs.maxFilelist = int64(n)
+		}
+	}
+}
+
+// WithRSAsyncWrites allows clients to negotiate asynchronous writes.
+// Write requests are then acknowledged before being passed to the WriterAt,
+// and the first failed write is reported, along with its offset,
+// when the file is closed.
+//
+// Clients enable it with the UseAsyncWrites option.
+func WithRSAsyncWrites() RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.allowAsyncWrites = true
+	}
+}
+
+// WithRSProfilerLabels labels the goroutines serving the requests, and so the
+// Handlers they call, with pprof labels, for profiles to be broken down by
+// operation: "sftp.method" for the packet type, "sftp.path" for the first
+// element of the path, and "sftp.session" for the RequestServer.
+//
+// The Server equivalent is WithProfilerLabels.
+func WithRSProfilerLabels() RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.profileSession = nextSessionID()
+	}
+}
+
+// WithRSHandlerTimeout sets the maximum duration of any single call to the
+// Handlers. Once exceeded, the context of the Request is canceled, and the
+// client is returned a failure, while the call is left to return on its own.
+// Calls on an open file cancel the context of its Request, which lasts
+// until the file is closed.
+//
+// Asynchronous writes, as allowed by WithRSAsyncWrites, are not timed out.
+func WithRSHandlerTimeout(d time.Duration) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.handlerTimeout = d
+	}
+}
+
+// ListFilter filters or rewrites the entries of directory listings:
+// it returns the entry fi of the directory dir as it is to be listed,
+// or false to hide it.
+type ListFilter func(dir string, fi os.FileInfo) (os.FileInfo, bool)
+
+// WithRSListFilter passes the entries of the directories listed by the
+// FileLister through filter, before they are sent to the client, for instance
+// to hide dotfiles. Hidden entries are only hidden from listings: a Stat of
+// their path is passed to the FileLister as usual.
+func WithRSListFilter(filter ListFilter) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.listFilter = filter
+	}
+}
+
+// WithRSConnConfig calls config with the metadata of the SSH connection the
+// RequestServer serves, such as the name of the user and their remote
+// address, and applies the options it returns, for a single accept loop to
+// serve each user with their own privileges.
+//
+// The Server equivalent is WithConnConfig.
+func WithRSConnConfig(meta ssh.ConnMetadata, config func(meta ssh.ConnMetadata) []RequestServerOption) RequestServerOption {
+	return func(rs *RequestServer) {
+		for _, o := range config(meta) {
+			o(rs)
+		}
+	}
+}
+
 // NewRequestServer creates/allocates/returns new RequestServer.
 // Normally there will be one server per user-session.
 func NewRequestServer(rwc io.ReadWriteCloser, h Handlers, options ...RequestServerOption) *RequestServer {
@@ -59,7 +196,7 @@ func NewRequestServer(rwc io.ReadWriteCloser, h Handlers, options ...RequestServ
 		serverConn:   svrConn,
 		Handlers:     h,
 		pktMgr:       newPktMgr(svrConn),
-		openRequests: make(map[string]*Request),
+		openRequests: newHandleTable(),
 	}
 
 	for _, o := range options {
@@ -68,14 +205,16 @@ func NewRequestServer(rwc io.ReadWriteCloser, h Handlers, options ...RequestServ
 	return rs
 }
 
-// New Open packet/Request
+// New Open packet/Request, or "" if the handles allowed are open already,
+// see WithRSLimits.
 func (rs *RequestServer) nextRequest(r *Request) string {
-	rs.openRequestLock.Lock()
-	defer rs.openRequestLock.Unlock()
-	rs.handleCount++
-	handle := strconv.Itoa(rs.handleCount)
+	if !rs.openRequests.reserve() {
+		return ""
+	}
+	handle := rs.openRequests.newHandle()
 	r.handle = handle
-	rs.openRequests[handle] = r
+	r.stats = &handleStats{opened: pkgClock.Now()}
+	rs.openRequests.put(handle, r)
 	return handle
 }
 
@@ -84,22 +223,73 @@ func (rs *RequestServer) nextRequest(r *Request) string {
 // The Requests in openRequests work essentially as open file descriptors that
 // you can do different things with. What you are doing with it are denoted by
 // the first packet of that type (read/write/etc).
+// denyHandlePath returns the path of the request opened for handle, as
+// matched by the deny rules.
+func (rs *RequestServer) denyHandlePath(handle string) (string, bool) {
+	r, ok := rs.getRequest(handle)
+	if !ok {
+		return "", false
+	}
+	if r.stagedPath != "" {
+		return r.stagedPath, true
+	}
+	return r.Filepath, true
+}
+
 func (rs *RequestServer) getRequest(handle string) (*Request, bool) {
-	rs.openRequestLock.RLock()
-	defer rs.openRequestLock.RUnlock()
-	r, ok := rs.openRequests[handle]
-	return r, ok
+	v, ok := rs.openRequests.get(handle)
+	if !ok {
+		return nil, false
+	}
+	return v.(*Request), true
+}
+
+// labelPath returns the path of a request for the profiler labels.
+func (rs *RequestServer) labelPath(pkt requestPacket) string {
+	if pkt, ok := pkt.(hasHandle); ok {
+		if r, ok := rs.getRequest(pkt.getHandle()); ok {
+			return r.Filepath
+		}
+		return ""
+	}
+	return packetPath(pkt)
 }
 
 // Close the Request and clear from openRequests map
 func (rs *RequestServer) closeRequest(handle string) error {
-	rs.openRequestLock.Lock()
-	defer rs.openRequestLock.Unlock()
-	if r, ok := rs.openRequests[handle]; ok {
-		delete(rs.openRequests, handle)
-		return r.close()
+	v, ok := rs.openRequests.remove(handle)
+	if !ok {
+		return EBADF
 	}
-	return EBADF
+	r := v.(*Request)
+	opened := r.writable()
+	err := r.close()
+	if r.stagedPath != "" && opened {
+		err = rs.commitStaged(r, err)
+	}
+	rs.closedDuringShutdown(r)
+	return err
+}
+
+// ClientInfo returns how the client introduced itself, and false if it has
+// not yet. Handlers get it from the context of a Request with
+// ClientInfoFromContext.
+func (rs *RequestServer) ClientInfo() (ClientInfo, bool) {
+	return rs.client.load()
+}
+
+// filter returns the ListFilter of rs, leaving out first the entries the
+// deny rules hide.
+func (rs *RequestServer) filter() ListFilter {
+	filter := rs.denyRules.listFilter(rs.listFilter, cleanPath)
+	return rs.policy.state().denyRules.listFilter(filter, cleanPath)
+}
+
+func (rs *RequestServer) getMaxFilelist() int64 {
+	if rs.maxFilelist > 0 {
+		return rs.maxFilelist
+	}
+	return MaxFilelist
 }
 
 // Close the read/write/closer to trigger exiting the main server loop
@@ -120,7 +310,10 @@ func (rs *RequestServer) serveLoop(pktChan chan<- orderedRequest) error {
 			return err
 		}
 
-		pkt, err = makePacket(rxPacket{fxp(pktType), pktBytes})
+		pkt, err = rs.makePacket(rxPacket{fxp(pktType), pktBytes})
+		if err == nil {
+			err = rs.conn.decompressRequest(pkt)
+		}
 		if err != nil {
 			switch errors.Cause(err) {
 			case errUnknownExtendedPacket:
@@ -143,7 +336,7 @@ func (rs *RequestServer) Serve() error {
 			rs.pktMgr.alloc.Free()
 		}
 	}()
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(rs.baseContext())
 	defer cancel()
 	var wg sync.WaitGroup
 	runWorker := func(ch chan orderedRequest) {
@@ -161,19 +354,20 @@ func (rs *RequestServer) Serve() error {
 
 	wg.Wait() // wait for all workers to exit
 
-	rs.openRequestLock.Lock()
-	defer rs.openRequestLock.Unlock()
-
 	// make sure all open requests are properly closed
 	// (eg. possible on dropped connections, client crashes, etc.)
-	for handle, req := range rs.openRequests {
+	for _, v := range rs.openRequests.removeAll() {
+		req := v.(*Request)
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
 		}
 		req.transferError(err)
 
-		delete(rs.openRequests, handle)
+		opened := req.writable()
 		req.close()
+		if req.stagedPath != "" && opened {
+			rs.commitStaged(req, io.ErrUnexpectedEOF)
+		}
 	}
 
 	return err
@@ -189,85 +383,327 @@ func (rs *RequestServer) packetWorker(
 				pkt.requestPacket = epkt.SpecificPacket
 			}
 		}
+		if rs.profileSession != "" {
+			labelRequest(rs.profileSession, pkt.requestPacket, rs.labelPath(pkt.requestPacket))
+		}
+		rs.limits.clampRead(pkt.requestPacket)
+
+		policy := rs.policy.state()
+
+		var err error
+		if rs.refuses(pkt.requestPacket) {
+			err = errShuttingDown
+		} else if policy.readOnly && !packetReadOnly(pkt.requestPacket) {
+			err = ErrSSHFxPermissionDenied
+		} else if err = rs.denyRules.checkPacket(pkt.requestPacket, cleanPath, rs.denyHandlePath); err == nil {
+			err = policy.denyRules.checkPacket(pkt.requestPacket, cleanPath, rs.denyHandlePath)
+		}
 
 		var rpkt responsePacket
-		switch pkt := pkt.requestPacket.(type) {
-		case *sshFxInitPacket:
-			rpkt = &sshFxVersionPacket{Version: sftpProtocolVersion, Extensions: sftpExtensions}
-		case *sshFxpClosePacket:
-			handle := pkt.getHandle()
-			rpkt = statusFromError(pkt.ID, rs.closeRequest(handle))
-		case *sshFxpRealpathPacket:
-			var realPath string
-			if realPather, ok := rs.Handlers.FileList.(RealPathFileLister); ok {
-				realPath = realPather.RealPath(pkt.getPath())
-			} else {
-				realPath = cleanPath(pkt.getPath())
-			}
-			rpkt = cleanPacketPath(pkt, realPath)
-		case *sshFxpOpendirPacket:
-			request := requestFromPacket(ctx, pkt)
-			handle := rs.nextRequest(request)
-			rpkt = request.opendir(rs.Handlers, pkt)
-			if _, ok := rpkt.(*sshFxpHandlePacket); !ok {
-				// if we return an error we have to remove the handle from the active ones
-				rs.closeRequest(handle)
-			}
-		case *sshFxpOpenPacket:
-			request := requestFromPacket(ctx, pkt)
-			handle := rs.nextRequest(request)
-			rpkt = request.open(rs.Handlers, pkt)
-			if _, ok := rpkt.(*sshFxpHandlePacket); !ok {
-				// if we return an error we have to remove the handle from the active ones
-				rs.closeRequest(handle)
-			}
-		case *sshFxpFstatPacket:
-			handle := pkt.getHandle()
-			request, ok := rs.getRequest(handle)
-			if !ok {
-				rpkt = statusFromError(pkt.ID, EBADF)
-			} else {
-				request = NewRequest("Stat", request.Filepath)
-				rpkt = request.call(rs.Handlers, pkt, rs.pktMgr.alloc, orderID)
-			}
-		case *sshFxpFsetstatPacket:
-			handle := pkt.getHandle()
-			request, ok := rs.getRequest(handle)
-			if !ok {
-				rpkt = statusFromError(pkt.ID, EBADF)
-			} else {
-				request = NewRequest("Setstat", request.Filepath)
-				rpkt = request.call(rs.Handlers, pkt, rs.pktMgr.alloc, orderID)
-			}
-		case *sshFxpExtendedPacketPosixRename:
-			request := NewRequest("PosixRename", pkt.Oldpath)
-			request.Target = pkt.Newpath
-			rpkt = request.call(rs.Handlers, pkt, rs.pktMgr.alloc, orderID)
-		case *sshFxpExtendedPacketStatVFS:
-			request := NewRequest("StatVFS", pkt.Path)
-			rpkt = request.call(rs.Handlers, pkt, rs.pktMgr.alloc, orderID)
-		case hasHandle:
-			handle := pkt.getHandle()
-			request, ok := rs.getRequest(handle)
-			if !ok {
-				rpkt = statusFromError(pkt.id(), EBADF)
-			} else {
-				rpkt = request.call(rs.Handlers, pkt, rs.pktMgr.alloc, orderID)
-			}
-		case hasPath:
-			request := requestFromPacket(ctx, pkt)
-			rpkt = request.call(rs.Handlers, pkt, rs.pktMgr.alloc, orderID)
-			request.close()
-		default:
-			rpkt = statusFromError(pkt.id(), ErrSSHFxOpUnsupported)
+		if err != nil {
+			rpkt = statusFromError(pkt.id(), err)
+		} else if rs.handlerTimeout > 0 {
+			rpkt = rs.handleWithTimeout(ctx, pkt.requestPacket, orderID)
+		} else {
+			rpkt = rs.handle(ctx, &handlerCall{ctx: ctx, alloc: rs.pktMgr.alloc}, pkt.requestPacket, orderID)
+		}
+		if rpkt == nil {
+			// already acknowledged
+			continue
 		}
 
 		rs.pktMgr.readyPacket(
-			rs.pktMgr.newOrderedResponse(rpkt, orderID))
+			rs.pktMgr.newOrderedResponse(rs.versioned(rpkt), orderID))
 	}
 	return nil
 }
 
+// handle calls the Handlers for pkt, and returns the response to send,
+// or nil if it has already been sent. Requests lasting until closed are
+// given ctx, and the others the context of the call.
+func (rs *RequestServer) handle(ctx context.Context, call *handlerCall, pkt requestPacket, orderID uint32) (rpkt responsePacket) {
+	defer recoverHandler(pkt, &rpkt)
+
+	switch pkt := pkt.(type) {
+	case *sshFxInitPacket:
+		rs.client.store(pkt)
+		rs.asyncWrites = rs.allowAsyncWrites && pkt.hasAsyncWriteExtension()
+		rs.conn.setCompressed(rs.allowCompression && pkt.hasCompressionExtension())
+		exts := withCompression(withUsersGroups(versionExtensions(rs.asyncWrites), rs.names), rs.conn.isCompressed())
+		if _, ok := rs.Handlers.FilePut.(CopyFileWriter); !ok {
+			exts = withoutExtension(exts, copyFileExtension)
+		}
+		rpkt = &sshFxVersionPacket{Version: rs.negotiateVersion(pkt.Version), Extensions: exts}
+	case *sshFxpClosePacket:
+		handle := pkt.getHandle()
+		rpkt = statusFromError(pkt.ID, rs.closeRequest(handle))
+	case *sshFxpRealpathPacket:
+		realPath, err := realPath(rs.Handlers.FileList, pkt.getPath())
+		if err != nil {
+			rpkt = statusFromError(pkt.ID, err)
+			break
+		}
+		rpkt = cleanPacketPath(pkt, realPath)
+	case *sshFxpOpendirPacket:
+		request := call.use(requestFromPacket(ctx, pkt))
+		handle := rs.nextRequest(request)
+		if handle == "" {
+			rpkt = statusFromError(pkt.ID, rs.openRequests.tooManyHandles())
+			break
+		}
+		rpkt = request.opendir(rs.Handlers, pkt)
+		if _, ok := rpkt.(*sshFxpHandlePacket); !ok {
+			// if we return an error we have to remove the handle from the active ones
+			rs.closeRequest(handle)
+		} else {
+			request.stats.setMethod(request.Method)
+		}
+	case *sshFxpOpenPacket:
+		request := call.use(requestFromPacket(ctx, pkt))
+		if err := rs.checkOpenFlagsV6(request); err != nil {
+			rpkt = statusFromError(pkt.ID, err)
+			break
+		}
+		if rs.stagedUploads {
+			if err := rs.stageUpload(request); err != nil {
+				rpkt = statusFromError(pkt.ID, err)
+				break
+			}
+		}
+		handle := rs.nextRequest(request)
+		if handle == "" {
+			rpkt = statusFromError(pkt.ID, rs.openRequests.tooManyHandles())
+			break
+		}
+		rpkt = request.open(rs.Handlers, pkt)
+		if _, ok := rpkt.(*sshFxpHandlePacket); !ok {
+			// if we return an error we have to remove the handle from the active ones
+			rs.closeRequest(handle)
+		} else {
+			request.stats.setMethod(request.Method)
+		}
+	case *sshFxpFstatPacket:
+		handle := pkt.getHandle()
+		request, ok := rs.getRequest(handle)
+		if !ok {
+			rpkt = statusFromError(pkt.ID, EBADF)
+		} else {
+			request = NewRequest("Stat", request.Filepath).WithContext(call.ctx)
+			rpkt = request.call(rs.Handlers, pkt, call.alloc, orderID)
+		}
+	case *sshFxpFsetstatPacket:
+		handle := pkt.getHandle()
+		request, ok := rs.getRequest(handle)
+		if !ok {
+			rpkt = statusFromError(pkt.ID, EBADF)
+		} else if setter := request.fsetStater(); setter != nil {
+			request = NewRequest("Setstat", request.Filepath).WithContext(call.ctx)
+			rpkt = fsetstat(setter, request, pkt)
+		} else {
+			request = NewRequest("Setstat", request.Filepath).WithContext(call.ctx)
+			rpkt = request.call(rs.Handlers, pkt, call.alloc, orderID)
+		}
+	case *sshFxpExtendedPacketPosixRename:
+		request := NewRequest("PosixRename", pkt.Oldpath).WithContext(call.ctx)
+		request.Target = pkt.Newpath
+		rpkt = request.call(rs.Handlers, pkt, call.alloc, orderID)
+	case *sshFxpReaddirPacket:
+		handle := pkt.getHandle()
+		request, ok := rs.getRequest(handle)
+		if !ok {
+			rpkt = statusFromError(pkt.ID, EBADF)
+		} else {
+			rpkt = filelist(rs.Handlers.FileList, call.use(request), pkt, rs.getMaxFilelist(), rs.filter(), longNameFormatter(rs.longName, rs.names))
+		}
+	case *sshFxpWritePacket:
+		request, ok := rs.getRequest(pkt.getHandle())
+		switch {
+		case !ok:
+			rpkt = statusFromError(pkt.ID, EBADF)
+		case !rs.asyncWrites:
+			rpkt = call.use(request).call(rs.Handlers, pkt, call.alloc, orderID)
+		case !request.writable():
+			// reject now, there is nothing to report on close for it
+			rpkt = statusFromError(pkt.ID, errors.New("unexpected write packet"))
+		default:
+			rs.writeAsync(request, pkt, orderID)
+			return nil
+		}
+	case *sshFxpExtendedPacketStatVFS:
+		request := NewRequest("StatVFS", pkt.Path).WithContext(call.ctx)
+		rpkt = request.call(rs.Handlers, pkt, call.alloc, orderID)
+	case *sshFxpExtendedPacketFsync:
+		rpkt = statusFromError(pkt.ID, rs.fsync(call.ctx, pkt))
+	case *sshFxpExtendedPacketPing:
+		rpkt = statusFromError(pkt.ID, nil)
+	case *sshFxpExtendedPacketLimits:
+		rpkt = serverLimits(pkt.ID, rs.limits)
+	case *sshFxpExtendedPacketUsersGroupsByID:
+		rpkt = usersGroupsReply(pkt, rs.names)
+	case *sshFxpExtendedPacketCopyData:
+		rpkt = statusFromError(pkt.ID, rs.copyData(pkt))
+	case *sshFxpExtendedPacketCopyFile:
+		copier, ok := rs.Handlers.FilePut.(CopyFileWriter)
+		if !ok {
+			rpkt = statusFromError(pkt.ID, ErrSSHFxOpUnsupported)
+			break
+		}
+		request := NewRequest("CopyFile", pkt.Source).WithContext(call.ctx)
+		request.Target = cleanPath(pkt.Destination)
+		request.Flags = pkt.pflags()
+		rpkt = statusFromError(pkt.ID, handleRequest(request, copier.CopyFile))
+	case *sshFxpExtendedPacketCheckFile:
+		request, ok := rs.getRequest(pkt.Handle)
+		if !ok {
+			rpkt = statusFromError(pkt.ID, EBADF)
+			break
+		}
+		rpkt = rs.checkFile(call.ctx, pkt, request.Filepath, func() (io.ReaderAt, error) {
+			return request.readerAt(), nil
+		})
+	case *sshFxpExtendedPacketCheckFileName:
+		rpkt = rs.checkFileName(call.ctx, pkt)
+	case hasHandle:
+		handle := pkt.getHandle()
+		request, ok := rs.getRequest(handle)
+		if !ok {
+			rpkt = statusFromError(pkt.id(), EBADF)
+		} else {
+			rpkt = call.use(request).call(rs.Handlers, pkt, call.alloc, orderID)
+		}
+	case hasPath:
+		request := requestFromPacket(call.ctx, pkt)
+		rpkt = request.call(rs.Handlers, pkt, call.alloc, orderID)
+		request.close()
+	default:
+		rpkt = statusFromError(pkt.id(), ErrSSHFxOpUnsupported)
+	}
+
+	return rpkt
+}
+
+// handleWithTimeout calls handle, and returns a failure once the timeout set
+// by WithRSHandlerTimeout expires, after canceling the contexts of the call.
+func (rs *RequestServer) handleWithTimeout(ctx context.Context, pkt requestPacket, orderID uint32) responsePacket {
+	if _, ok := pkt.(*sshFxpWritePacket); ok && rs.asyncWrites {
+		// acknowledged before calling the WriterAt, failures are reported on close
+		return rs.handle(ctx, &handlerCall{ctx: ctx, alloc: rs.pktMgr.alloc}, pkt, orderID)
+	}
+
+	callCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// no allocator, as a call timing out still uses its pages once they are released
+	call := &handlerCall{ctx: callCtx}
+
+	timer, expired := pkgClock.NewTimer(rs.handlerTimeout)
+	defer timer.Stop()
+
+	done := make(chan responsePacket, 1)
+	go func() {
+		done <- rs.handle(ctx, call, pkt, orderID)
+	}()
+
+	select {
+	case rpkt := <-done:
+		return rpkt
+	case <-expired:
+	}
+
+	call.timeout()
+	go func() {
+		// the client will never know of a handle opened too late
+		if hpkt, ok := (<-done).(*sshFxpHandlePacket); ok {
+			rs.closeRequest(hpkt.Handle)
+		}
+	}()
+	return statusFromError(pkt.id(), errHandlerTimeout)
+}
+
+// recoverHandler recovers from a panic of the Handlers serving pkt, so only
+// that request fails rather than the whole session, the panic being logged
+// as its PanicError. It must be deferred.
+func recoverHandler(pkt requestPacket, rpkt *responsePacket) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	*rpkt = recovered(pkt, v)
+}
+
+// handlerCall is the invocation of the Handlers for a packet.
+type handlerCall struct {
+	ctx   context.Context // context of the requests lasting the call
+	alloc *allocator
+
+	mu       sync.Mutex
+	request  *Request // request lasting until closed, used by the call
+	timedOut bool
+}
+
+// use records that the call uses r, a request lasting until closed,
+// whose context is canceled if the call times out.
+func (c *handlerCall) use(r *Request) *Request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.request = r
+	if c.timedOut {
+		r.cancel()
+	}
+	return r
+}
+
+func (c *handlerCall) timeout() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timedOut = true
+	if c.request != nil {
+		c.request.cancel()
+	}
+}
+
+// writeAsync acknowledges the write request before passing it to the handler,
+// a failure is reported when closing the request.
+func (rs *RequestServer) writeAsync(request *Request, pkt *sshFxpWritePacket, orderID uint32) {
+	request.state.Lock()
+	pending := request.state.pendingWrites
+	if pending == nil {
+		pending = new(asyncWrites)
+		request.state.pendingWrites = pending
+	}
+	request.state.Unlock()
+
+	if rs.pktMgr.alloc != nil {
+		// the allocated pages are released as soon as the response is sent
+		pkt.Data = append([]byte(nil), pkt.Data...)
+	}
+
+	pending.start()
+	rs.pktMgr.readyPacket(rs.pktMgr.newOrderedResponse(statusFromError(pkt.ID, nil), orderID))
+
+	var err error
+	var rpkt responsePacket
+	func() {
+		defer recoverHandler(pkt, &rpkt)
+		rpkt = request.call(rs.Handlers, pkt, nil, orderID)
+	}()
+	if spkt, ok := rpkt.(*sshFxpStatusPacket); ok && spkt.StatusError.Code != sshFxOk {
+		err = &spkt.StatusError
+	}
+	pending.done(int64(pkt.Offset), err)
+}
+
+// realPath returns the path p resolves to with the RealPath of fl if it is
+// a RealPathFileLister, and cleaned against "/" otherwise.
+func realPath(fl FileLister, p string) (string, error) {
+	switch realPather := fl.(type) {
+	case RealPathFileLister:
+		return realPather.RealPath(p)
+	case legacyRealPathFileLister:
+		return realPather.RealPath(p), nil
+	}
+	return cleanPath(p), nil
+}
+
 // clean and return name packet for file
 func cleanPacketPath(pkt *sshFxpRealpathPacket, realPath string) responsePacket {
 	return &sshFxpNamePacket{
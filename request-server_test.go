@@ -2,6 +2,7 @@ package sftp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,11 +10,13 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 var _ = fmt.Print
@@ -37,7 +40,7 @@ func (cs csPair) testHandler() *root {
 
 const sock = "/tmp/rstest.sock"
 
-func clientRequestServerPair(t *testing.T) *csPair {
+func clientRequestServerPair(t *testing.T, options ...RequestServerOption) *csPair {
 	skipIfWindows(t)
 	skipIfPlan9(t)
 
@@ -62,9 +65,9 @@ func clientRequestServerPair(t *testing.T) *csPair {
 		require.NoError(t, err)
 
 		handlers := InMemHandler()
-		var options []RequestServerOption
 		if *testAllocator {
-			options = append(options, WithRSAllocator())
+			// the options of the test come after, to set another allocator
+			options = append([]RequestServerOption{WithRSAllocator()}, options...)
 		}
 
 		server = NewRequestServer(fd, handlers, options...)
@@ -126,7 +129,7 @@ func TestRequestCache(t *testing.T) {
 	bar := NewRequest("", "bar")
 	fh := p.svr.nextRequest(foo)
 	bh := p.svr.nextRequest(bar)
-	assert.Len(t, p.svr.openRequests, 2)
+	assert.Equal(t, 2, p.svr.openRequests.len())
 	_foo, ok := p.svr.getRequest(fh)
 	assert.Equal(t, foo.Method, _foo.Method)
 	assert.Equal(t, foo.Filepath, _foo.Filepath)
@@ -142,7 +145,7 @@ func TestRequestCache(t *testing.T) {
 	p.svr.closeRequest(fh)
 	assert.Equal(t, _foo.Context().Err(), context.Canceled, "context is now canceled")
 	p.svr.closeRequest(bh)
-	assert.Len(t, p.svr.openRequests, 0)
+	assert.Equal(t, 0, p.svr.openRequests.len())
 	checkRequestServerAllocator(t, p)
 }
 
@@ -152,11 +155,11 @@ func TestRequestCacheState(t *testing.T) {
 	defer p.Close()
 	_, err := putTestFile(p.cli, "/foo", "hello")
 	require.NoError(t, err)
-	assert.Len(t, p.svr.openRequests, 0)
+	assert.Equal(t, 0, p.svr.openRequests.len())
 	// test operation that doesn't open/close
 	err = p.cli.Remove("/foo")
 	assert.NoError(t, err)
-	assert.Len(t, p.svr.openRequests, 0)
+	assert.Equal(t, 0, p.svr.openRequests.len())
 	checkRequestServerAllocator(t, p)
 }
 
@@ -254,7 +257,7 @@ func TestRequestOpenFail(t *testing.T) {
 	assert.Nil(t, rf)
 	// if we return an error the sftp client will not close the handle
 	// ensure that we close it ourself
-	assert.Len(t, p.svr.openRequests, 0)
+	assert.Equal(t, 0, p.svr.openRequests.len())
 	checkRequestServerAllocator(t, p)
 }
 
@@ -433,6 +436,23 @@ func TestRequestRenameFail(t *testing.T) {
 	checkRequestServerAllocator(t, p)
 }
 
+func TestRequestPosixRenameFallback(t *testing.T) {
+	h := InMemHandler()
+	// without PosixRenameFileCmder, a PosixRename is handled as a Rename
+	client, _ := handlersClientPair(t, Handlers{h.FileGet, h.FilePut, struct{ FileCmder }{h.FileCmd}, h.FileList}, nil)
+
+	_, err := putTestFile(client, "/foo", "hello")
+	require.NoError(t, err)
+	_, err = putTestFile(client, "/bar", "goodbye")
+	require.NoError(t, err)
+	assert.IsType(t, &StatusError{}, client.PosixRename("/foo", "/bar"))
+
+	require.NoError(t, client.PosixRename("/foo", "/baz"))
+	content, err := getTestFile(client, "/baz")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), content)
+}
+
 func TestRequestStat(t *testing.T) {
 	p := clientRequestServerPair(t)
 	defer p.Close()
@@ -513,6 +533,118 @@ func TestRequestFsetstat(t *testing.T) {
 	checkRequestServerAllocator(t, p)
 }
 
+// fsetStatWriter records the Fsetstat requests made on its handles.
+type fsetStatWriter struct {
+	FileWriter
+	reqs chan *Request
+}
+
+func (w fsetStatWriter) Filewrite(r *Request) (io.WriterAt, error) {
+	wr, err := w.FileWriter.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+	return fsetStatWriterAt{wr, w.reqs}, nil
+}
+
+type fsetStatWriterAt struct {
+	io.WriterAt
+	reqs chan *Request
+}
+
+func (w fsetStatWriterAt) Fsetstat(r *Request) error {
+	w.reqs <- r
+	return nil
+}
+
+func TestRequestFsetstatHandle(t *testing.T) {
+	handlers := InMemHandler()
+	writer := fsetStatWriter{handlers.FilePut, make(chan *Request, 1)}
+	handlers.FilePut = writer
+
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	_, err := putTestFile(client, "/foo", "hello")
+	require.NoError(t, err)
+
+	fp, err := client.OpenFile("/foo", os.O_WRONLY)
+	require.NoError(t, err)
+	require.NoError(t, fp.Truncate(2))
+	r := <-writer.reqs
+	assert.Equal(t, "Setstat", r.Method)
+	assert.Equal(t, "/foo", r.Filepath)
+	assert.True(t, r.AttrFlags().Size)
+	assert.Equal(t, uint64(2), r.Attributes().Size)
+	require.NoError(t, fp.Close())
+
+	// the change went to the open object only
+	fi, err := client.Stat("/foo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), fi.Size())
+
+	// the read handles of InMemHandler are not FsetStaters
+	fp, err = client.Open("/foo")
+	require.NoError(t, err)
+	require.NoError(t, fp.Truncate(2))
+	require.NoError(t, fp.Close())
+	fi, err = client.Stat("/foo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), fi.Size())
+}
+
+// openRecorder records the requests opening files for writing.
+type openRecorder struct {
+	FileWriter
+	reqs chan *Request
+}
+
+func (w openRecorder) Filewrite(r *Request) (io.WriterAt, error) {
+	w.reqs <- r
+	return w.FileWriter.Filewrite(r)
+}
+
+func TestRequestOpenFlagsAndAttrs(t *testing.T) {
+	handlers := InMemHandler()
+	recorder := openRecorder{handlers.FilePut, make(chan *Request, 1)}
+	handlers.FilePut = recorder
+
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	open := func(pflags int, attrs interface{}) (uint8, FileOpenFlags, FileAttrFlags, *FileStat) {
+		pkt := &sshFxpOpenPacket{ID: client.nextID(), Path: "/foo", Pflags: flags(pflags)}
+		if attrs != nil {
+			pkt.Flags = sshFileXferAttrPermissions
+			pkt.Attrs = attrs
+		}
+		typ, data, err := client.sendPacket(nil, pkt)
+		require.NoError(t, err)
+		if typ == sshFxpHandle {
+			_, data = unmarshalUint32(data)
+			handle, _ := unmarshalString(data)
+			require.NoError(t, client.close(handle))
+		}
+		r := <-recorder.reqs
+		aflags, attrsFs := r.OpenAttributes()
+		return typ, r.Pflags(), aflags, attrsFs
+	}
+
+	typ, pflags, aflags, fs := open(os.O_WRONLY|os.O_CREATE|os.O_EXCL, uint32(0600))
+	assert.EqualValues(t, sshFxpHandle, typ)
+	assert.Equal(t, FileOpenFlags{Write: true, Creat: true, Excl: true}, pflags)
+	assert.True(t, aflags.Permissions)
+	assert.Equal(t, os.FileMode(0600), fs.FileMode())
+
+	// exclusive create of an existing file
+	typ, pflags, _, _ = open(os.O_WRONLY|os.O_CREATE|os.O_EXCL, uint32(0600))
+	assert.EqualValues(t, sshFxpStatus, typ)
+	assert.True(t, pflags.Excl)
+
+	typ, pflags, aflags, _ = open(os.O_WRONLY|os.O_APPEND|os.O_TRUNC, nil)
+	assert.EqualValues(t, sshFxpHandle, typ)
+	assert.Equal(t, FileOpenFlags{Write: true, Append: true, Trunc: true}, pflags)
+	assert.Equal(t, FileAttrFlags{}, aflags)
+}
+
 func TestRequestStatFail(t *testing.T) {
 	p := clientRequestServerPair(t)
 	defer p.Close()
@@ -561,6 +693,42 @@ func TestRequestLinkFail(t *testing.T) {
 	checkRequestServerAllocator(t, p)
 }
 
+// noLinkCmder fails the links as unsupported.
+type noLinkCmder struct {
+	FileCmder
+}
+
+func (c noLinkCmder) Filecmd(r *Request) error {
+	if r.Method == "Link" {
+		return ErrSSHFxOpUnsupported
+	}
+	return c.FileCmder.Filecmd(r)
+}
+
+func TestRequestLinkUnsupported(t *testing.T) {
+	h := InMemHandler()
+	client, _ := handlersClientPair(t, Handlers{h.FileGet, h.FilePut, noLinkCmder{h.FileCmd}, h.FileList}, nil)
+
+	_, err := putTestFile(client, "/foo", "hello")
+	require.NoError(t, err)
+
+	// refused by the server
+	require.NoError(t, client.RequireExtension(hardlinkExtension))
+	err = client.Link("/foo", "/bar")
+	assert.True(t, errors.Is(err, ErrExtensionNotSupported), "got %v", err)
+
+	// not advertised
+	delete(client.ext, hardlinkExtension)
+	err = client.RequireExtension(hardlinkExtension)
+	assert.True(t, errors.Is(err, ErrExtensionNotSupported), "got %v", err)
+	assert.Contains(t, err.Error(), hardlinkExtension)
+	err = client.Link("/foo", "/bar")
+	assert.True(t, errors.Is(err, ErrExtensionNotSupported), "got %v", err)
+
+	_, err = client.Lstat("/bar")
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestRequestSymlink(t *testing.T) {
 	p := clientRequestServerPair(t)
 	defer p.Close()
@@ -738,7 +906,78 @@ func TestRequestReaddir(t *testing.T) {
 	require.Len(t, di, 100)
 	names := []string{di[18].Name(), di[81].Name()}
 	assert.Equal(t, []string{"foo_18", "foo_81"}, names)
-	assert.Len(t, p.svr.openRequests, 0)
+	assert.Equal(t, 0, p.svr.openRequests.len())
+	checkRequestServerAllocator(t, p)
+}
+
+func TestRequestReaddirMaxPacketLength(t *testing.T) {
+	p := clientRequestServerPair(t, WithRSMaxFilelist(1000))
+	defer p.Close()
+	// each entry is sent with name and longname, so only a few fit in a single packet
+	for i := 0; i < 20; i++ {
+		fname := fmt.Sprintf("/%02d_%s", i, strings.Repeat("x", 20000))
+		_, err := putTestFile(p.cli, fname, fname)
+		require.NoError(t, err)
+	}
+	di, err := p.cli.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, di, 20)
+	assert.True(t, strings.HasPrefix(di[19].Name(), "19_"))
+	checkRequestServerAllocator(t, p)
+}
+
+// upperFileInfo upper cases the name of a FileInfo.
+type upperFileInfo struct {
+	os.FileInfo
+}
+
+func (fi upperFileInfo) Name() string { return strings.ToUpper(fi.FileInfo.Name()) }
+
+func TestRequestReaddirListFilter(t *testing.T) {
+	filter := func(dir string, fi os.FileInfo) (os.FileInfo, bool) {
+		if dir != "/" {
+			return fi, true
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			return nil, false
+		}
+		return upperFileInfo{fi}, true
+	}
+	// entire batches are hidden
+	p := clientRequestServerPair(t, WithRSListFilter(filter), WithRSMaxFilelist(3))
+	defer p.Close()
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		fname := fmt.Sprintf("/.hidden_%02d", i)
+		if i%7 == 0 {
+			fname = fmt.Sprintf("/shown_%02d", i)
+			want = append(want, strings.ToUpper(fname[1:]))
+		}
+		_, err := putTestFile(p.cli, fname, fname)
+		require.NoError(t, err)
+	}
+	require.NoError(t, p.cli.Mkdir("/dir"))
+	want = append(want, "DIR")
+	_, err := putTestFile(p.cli, "/dir/.dotfile", "in a subdirectory")
+	require.NoError(t, err)
+
+	di, err := p.cli.ReadDir("/")
+	require.NoError(t, err)
+	var names []string
+	for _, fi := range di {
+		names = append(names, fi.Name())
+	}
+	assert.ElementsMatch(t, want, names)
+
+	di, err = p.cli.ReadDir("/dir")
+	require.NoError(t, err)
+	require.Len(t, di, 1)
+	assert.Equal(t, ".dotfile", di[0].Name())
+
+	// only hidden from listings
+	_, err = p.cli.Stat("/.hidden_01")
+	assert.NoError(t, err)
 	checkRequestServerAllocator(t, p)
 }
 
@@ -765,6 +1004,20 @@ func TestRequestStatVFS(t *testing.T) {
 	checkRequestServerAllocator(t, p)
 }
 
+func TestRequestPing(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+
+	_, ok := p.cli.HasExtension(pingExtension)
+	require.True(t, ok, "request server doesn't list ping extension")
+
+	id := p.cli.nextID()
+	typ, data, err := p.cli.clientConn.sendPacket(nil, sshFxpTestPingPacket{id})
+	require.NoError(t, err)
+	require.EqualValues(t, sshFxpStatus, typ)
+	assert.NoError(t, normaliseError(unmarshalStatus(id, data)))
+}
+
 func TestRequestStatVFSError(t *testing.T) {
 	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
 		t.Skip("StatVFS is implemented on linux and darwin")
@@ -815,18 +1068,176 @@ func TestRealPath(t *testing.T) {
 		startDirectory: "/apath",
 	}
 
-	p := root.Realpath(".")
+	p, err := root.RealPath(".")
+	require.NoError(t, err)
 	assert.Equal(t, root.startDirectory, p)
-	p = root.Realpath("/")
+	p, _ = root.RealPath("/")
 	assert.Equal(t, "/", p)
-	p = root.Realpath("..")
+	p, _ = root.RealPath("..")
 	assert.Equal(t, "/", p)
-	p = root.Realpath("../../..")
+	p, _ = root.RealPath("../../..")
 	assert.Equal(t, "/", p)
-	p = root.Realpath("relpath")
+	p, _ = root.RealPath("relpath")
 	assert.Equal(t, path.Join(root.startDirectory, "relpath"), p)
 }
 
+// virtualLister resolves the paths under /home to those of /users, and
+// fails those of /missing.
+type virtualLister struct {
+	FileLister
+}
+
+func (l virtualLister) RealPath(p string) (string, error) {
+	p = cleanPath(p)
+	if strings.HasPrefix(p, "/missing") {
+		return "", os.ErrNotExist
+	}
+	if p == "/home" || strings.HasPrefix(p, "/home/") {
+		return "/users" + strings.TrimPrefix(p, "/home"), nil
+	}
+	return p, nil
+}
+
+// legacyLister implements RealPath without an error.
+type legacyLister struct {
+	FileLister
+}
+
+func (legacyLister) RealPath(p string) string {
+	return path.Join("/start", p)
+}
+
+// handlersClientPair returns a client, with clientOptions, of a request
+// server serving handlers, with options, over pipes. Both are closed once
+// the test is done, the server first.
+func handlersClientPair(t *testing.T, handlers Handlers, clientOptions []ClientOption, options ...RequestServerOption) (*Client, *RequestServer) {
+	if *testAllocator {
+		// the options of the test come after, to set another allocator
+		options = append([]RequestServerOption{WithRSAllocator()}, options...)
+	}
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, handlers, options...)
+	go server.Serve()
+	client, err := NewClientPipe(cr, cw, clientOptions...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client, server
+}
+
+func TestRequestRealPathFileLister(t *testing.T) {
+	handlers := InMemHandler()
+	handlers.FileList = virtualLister{handlers.FileList}
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	real, err := client.RealPath("/home/../home/me")
+	require.NoError(t, err)
+	assert.Equal(t, "/users/me", real)
+	real, err = client.RealPath("/other")
+	require.NoError(t, err)
+	assert.Equal(t, "/other", real)
+	_, err = client.RealPath("/missing/file")
+	assert.True(t, os.IsNotExist(err), err)
+
+	// through a mount too
+	mclient, _ := handlersClientPair(t, MountHandlers(map[string]Handlers{"/mnt": handlers}), nil)
+
+	real, err = mclient.RealPath("/mnt/home/me")
+	require.NoError(t, err)
+	assert.Equal(t, "/mnt/users/me", real)
+	_, err = mclient.RealPath("/mnt/missing")
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+func TestRequestRealPathLegacy(t *testing.T) {
+	handlers := InMemHandler()
+	handlers.FileList = legacyLister{handlers.FileList}
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	real, err := client.RealPath("dir")
+	require.NoError(t, err)
+	assert.Equal(t, "/start/dir", real)
+}
+
+// setstatRecorder records the typed setstat calls, failing those of
+// the file named "denied" with chmod.
+type setstatRecorder struct {
+	FileCmder
+	calls []string
+}
+
+func (s *setstatRecorder) Truncate(r *Request, size int64) error {
+	s.calls = append(s.calls, fmt.Sprintf("truncate %s %d", r.Filepath, size))
+	return nil
+}
+
+func (s *setstatRecorder) Chmod(r *Request, mode os.FileMode) error {
+	if path.Base(r.Filepath) == "denied" {
+		return ErrSSHFxPermissionDenied
+	}
+	s.calls = append(s.calls, fmt.Sprintf("chmod %s %v", r.Filepath, mode))
+	return nil
+}
+
+func (s *setstatRecorder) Chtimes(r *Request, atime, mtime time.Time) error {
+	s.calls = append(s.calls, fmt.Sprintf("chtimes %s %d %d", r.Filepath, atime.Unix(), mtime.Unix()))
+	return nil
+}
+
+func (s *setstatRecorder) Chown(r *Request, uid, gid int) error {
+	s.calls = append(s.calls, fmt.Sprintf("chown %s %d %d", r.Filepath, uid, gid))
+	return nil
+}
+
+func TestRequestSetstatFileCmder(t *testing.T) {
+	handlers := InMemHandler()
+	recorder := &setstatRecorder{FileCmder: handlers.FileCmd}
+	handlers.FileCmd = recorder
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	require.NoError(t, client.Truncate("/file", 5))
+	require.NoError(t, client.Chmod("/file", 0600))
+	require.NoError(t, client.Chtimes("/file", time.Unix(1, 0), time.Unix(2, 0)))
+	require.NoError(t, client.Chown("/file", 1000, 100))
+	f, err := client.Create("/open")
+	require.NoError(t, err)
+	require.NoError(t, f.Chmod(0640))
+	require.NoError(t, f.Close())
+
+	// stopped by the error of chmod, after truncate
+	type sizeMode struct {
+		Size uint64
+		Mode uint32
+	}
+	err = client.setstat(context.Background(), "/denied", sshFileXferAttrSize|sshFileXferAttrPermissions, sizeMode{7, 0600})
+	assert.True(t, os.IsPermission(err), err)
+
+	assert.Equal(t, []string{
+		"truncate /file 5",
+		"chmod /file -rw-------",
+		"chtimes /file 1 2",
+		"chown /file 1000 100",
+		"chmod /open -rw-r-----",
+		"truncate /denied 7",
+	}, recorder.calls)
+}
+
+func TestRequestSetstatMount(t *testing.T) {
+	handlers := InMemHandler()
+	recorder := &setstatRecorder{FileCmder: handlers.FileCmd}
+	handlers.FileCmd = recorder
+	client, _ := handlersClientPair(t, MountHandlers(map[string]Handlers{"/mnt": handlers}), nil)
+
+	require.NoError(t, client.Chmod("/mnt/file", 0600))
+	assert.Equal(t, []string{"chmod /file -rw-------"}, recorder.calls)
+}
+
 func TestCleanPath(t *testing.T) {
 	assert.Equal(t, "/", cleanPath("/"))
 	assert.Equal(t, "/", cleanPath("."))
@@ -852,3 +1263,136 @@ func TestCleanPath(t *testing.T) {
 		cleanPath(bslash+"a"+bslash+bslash+"b"+bslash+bslash+"c"+bslash))
 	assert.Equal(t, "/C:/a", cleanPath("C:"+bslash+"a"))
 }
+
+type errWriterAt struct {
+	off int64 // writes fail from this offset
+}
+
+func (w errWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off >= w.off {
+		return 0, errTest
+	}
+	return len(p), nil
+}
+
+func TestRequestAsyncWrites(t *testing.T) {
+	handlers := newTestHandlers()
+	handlers.FilePut.(*testHandler).output = errWriterAt{off: 8}
+	client, _ := handlersClientPair(t, handlers, []ClientOption{UseAsyncWrites(true)}, WithRSAsyncWrites())
+
+	f, err := client.OpenFile("/foo", os.O_WRONLY|os.O_CREATE)
+	require.NoError(t, err)
+	for _, off := range []int64{0, 16, 8} {
+		_, err = f.WriteAt([]byte("data"), off)
+		require.NoError(t, err)
+	}
+	err = f.Close()
+	dwe, ok := err.(*DeferredWriteError)
+	require.True(t, ok, "unexpected error: %v", err)
+	assert.EqualValues(t, 8, dwe.Offset)
+	assert.Contains(t, dwe.Err.Error(), errTest.Error())
+
+	// writes to a file opened read-only are not acknowledged
+	f, err = client.Open("/foo")
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("data"), 0)
+	assert.Error(t, err)
+	assert.NoError(t, f.Close())
+}
+
+// blockingCmder stalls Mkdir until its context is canceled.
+type blockingCmder struct {
+	FileCmder
+	entered  chan struct{}
+	canceled chan struct{}
+}
+
+func (c blockingCmder) Filecmd(r *Request) error {
+	if r.Method != "Mkdir" {
+		return c.FileCmder.Filecmd(r)
+	}
+	close(c.entered)
+	<-r.Context().Done()
+	close(c.canceled)
+	return r.Context().Err()
+}
+
+func TestRequestHandlerTimeout(t *testing.T) {
+	clock := useFakeClock(t, time.Unix(0, 0))
+
+	handlers := InMemHandler()
+	cmder := blockingCmder{FileCmder: handlers.FileCmd, entered: make(chan struct{}), canceled: make(chan struct{})}
+	handlers.FileCmd = cmder
+
+	client, _ := handlersClientPair(t, handlers, nil, WithRSHandlerTimeout(time.Minute))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Mkdir("/stalled")
+	}()
+
+	<-cmder.entered
+	clock.Advance(time.Minute)
+	err := <-done
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), errHandlerTimeout.Error())
+
+	<-cmder.canceled
+
+	// the other calls go on
+	_, err = putTestFile(client, "/foo", "hello")
+	require.NoError(t, err)
+	content, err := getTestFile(client, "/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), content)
+}
+
+// panickingCmder panics on Mkdir.
+type panickingCmder struct {
+	FileCmder
+}
+
+func (c panickingCmder) Filecmd(r *Request) error {
+	if r.Method == "Mkdir" {
+		panic("mkdir is broken")
+	}
+	return c.FileCmder.Filecmd(r)
+}
+
+func TestRequestHandlerPanic(t *testing.T) {
+	var logged []RequestEvent
+	logger := LoggerFunc(func(e RequestEvent) { logged = append(logged, e) })
+
+	handlers := InMemHandler()
+	handlers.FileCmd = panickingCmder{handlers.FileCmd}
+
+	client, _ := handlersClientPair(t, handlers, nil, WithRSLogger(logger))
+
+	err := client.Mkdir("/broken")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), errPanic.Error())
+	require.NotEmpty(t, logged)
+	perr, ok := logged[len(logged)-1].Err.(*PanicError)
+	require.True(t, ok, "%v", logged[len(logged)-1].Err)
+	assert.Equal(t, "mkdir is broken", perr.Value)
+
+	// the session is still alive
+	_, err = putTestFile(client, "/foo", "hello")
+	require.NoError(t, err)
+	require.NoError(t, client.Remove("/foo"))
+}
+
+func TestRequestServerConnConfig(t *testing.T) {
+	config := func(meta ssh.ConnMetadata) []RequestServerOption {
+		if meta.User() == "guest" {
+			return []RequestServerOption{WithRSMaxFilelist(10)}
+		}
+		return nil
+	}
+
+	rs := NewRequestServer(nil, InMemHandler(), WithRSConnConfig(testConnMeta{"admin"}, config))
+	assert.Equal(t, MaxFilelist, rs.getMaxFilelist())
+
+	rs = NewRequestServer(nil, InMemHandler(), WithRSConnConfig(testConnMeta{"guest"}, config))
+	assert.Equal(t, int64(10), rs.getMaxFilelist())
+}
@@ -0,0 +1,424 @@
+package sftp
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// protocolVersion6 is the version of the protocol the RequestServer speaks
+// besides the version 3, see WithRSProtocolVersion6.
+const protocolVersion6 = 6
+
+// WithRSProtocolVersion6 makes the RequestServer advertise the version 6 of
+// the SFTP protocol, and speak it with the clients requesting it, the others
+// being served the version 3. The Server speaks the version 3 only.
+//
+// The requests of the version 6 are translated into those of the version 3
+// for the Handlers. The open flags the version 3 has no equivalent of are
+// returned by Request.PflagsV6, and a file opened with them fails with
+// SSH_FX_OP_UNSUPPORTED unless the Handlers opening it honor them, see
+// OpenFlagsV6Handler. A rename overwriting its target is a PosixRename,
+// failing with SSH_FX_OP_UNSUPPORTED unless the FileCmder implements
+// PosixRenameFileCmder. The attributes set by the client which the version 3
+// has no equivalent of, such as the owner and group names which are not
+// numeric, or the creation times, are ignored.
+func WithRSProtocolVersion6() RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.allowV6 = true
+	}
+}
+
+// FileOpenFlagsV6 are the flags of an SSH_FXP_OPEN of the protocol version
+// 6 which the version 3 has no equivalent of, see WithRSProtocolVersion6.
+type FileOpenFlagsV6 struct {
+	// BlockRead, BlockWrite and BlockDelete lock the file against the opens
+	// of others for reading, writing and deleting it until closed, as
+	// advisory locks if BlockAdvisory is set.
+	BlockRead, BlockWrite, BlockDelete, BlockAdvisory bool
+
+	// TextMode opens the file as text, whose newlines are translated to
+	// and from those of the client.
+	TextMode bool
+}
+
+func newFileOpenFlagsV6(flags uint32) FileOpenFlagsV6 {
+	return FileOpenFlagsV6{
+		BlockRead:     flags&sshFxfBlockRead != 0,
+		BlockWrite:    flags&sshFxfBlockWrite != 0,
+		BlockDelete:   flags&sshFxfBlockDelete != 0,
+		BlockAdvisory: flags&sshFxfBlockAdvisory != 0,
+		TextMode:      flags&sshFxfTextMode != 0,
+	}
+}
+
+func (f FileOpenFlagsV6) bits() uint32 {
+	var flags uint32
+	if f.BlockRead {
+		flags |= sshFxfBlockRead
+	}
+	if f.BlockWrite {
+		flags |= sshFxfBlockWrite
+	}
+	if f.BlockDelete {
+		flags |= sshFxfBlockDelete
+	}
+	if f.BlockAdvisory {
+		flags |= sshFxfBlockAdvisory
+	}
+	if f.TextMode {
+		flags |= sshFxfTextMode
+	}
+	return flags
+}
+
+// PflagsV6 returns the open flags of the protocol version 6 of an Open
+// request which the version 3 has no equivalent of, and so are not returned
+// by Pflags.
+func (r *Request) PflagsV6() FileOpenFlagsV6 {
+	return newFileOpenFlagsV6(r.flagsV6)
+}
+
+// OpenFlagsV6Handler is implemented by the FileReader and by the FileWriter
+// of the Handlers honoring open flags of the protocol version 6, opting in
+// to receive the files opened with them, see WithRSProtocolVersion6. The
+// FileReader opens the files for reading, and the FileWriter the others.
+type OpenFlagsV6Handler interface {
+	// OpenFlagsV6 returns the flags honored.
+	OpenFlagsV6() FileOpenFlagsV6
+}
+
+// negotiateVersion returns the version of the protocol spoken with a client
+// requesting version, and records it.
+func (rs *RequestServer) negotiateVersion(version uint32) uint32 {
+	if !rs.allowV6 || version < protocolVersion6 {
+		version = sftpProtocolVersion
+	} else {
+		version = protocolVersion6
+	}
+	atomic.StoreUint32(&rs.version, version)
+	return version
+}
+
+// makePacket makes the packet p in the layout of the version negotiated.
+func (rs *RequestServer) makePacket(p rxPacket) (requestPacket, error) {
+	if atomic.LoadUint32(&rs.version) != protocolVersion6 {
+		return makePacket(p)
+	}
+
+	var pkt requestPacket
+	var err error
+	b := p.pktBytes
+	switch p.pktType {
+	case sshFxpOpen:
+		pkt, err = unmarshalOpenV6(b)
+	case sshFxpSetstat:
+		pkt, err = unmarshalSetstatV6(b)
+	case sshFxpFsetstat:
+		pkt, err = unmarshalFsetstatV6(b)
+	case sshFxpMkdir:
+		pkt, err = unmarshalMkdirV6(b)
+	case sshFxpRename:
+		pkt, err = rs.unmarshalRenameV6(b)
+	case sshFxpLink:
+		pkt, err = unmarshalLinkV6(b)
+	case sshFxpBlock, sshFxpUnblock:
+		pkt = &sshFxpUnsupportedPacket{}
+		err = pkt.UnmarshalBinary(b)
+	default:
+		return makePacket(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// sshFxpUnsupportedPacket is a request of the version 6 the RequestServer
+// answers with SSH_FX_OP_UNSUPPORTED.
+type sshFxpUnsupportedPacket struct {
+	ID uint32
+}
+
+func (p *sshFxpUnsupportedPacket) id() uint32 { return p.ID }
+
+func (p *sshFxpUnsupportedPacket) UnmarshalBinary(b []byte) error {
+	var err error
+	p.ID, _, err = unmarshalUint32Safe(b)
+	return err
+}
+
+// unmarshalAttrsV3 unmarshals attributes of the version 6 as those of the
+// version 3, returning their flags and marshalled attributes.
+func unmarshalAttrsV3(b []byte) (uint32, []byte, error) {
+	fs, _, err := unmarshalAttrsV4(b, protocolVersion6)
+	if err != nil {
+		return 0, nil, err
+	}
+	v4 := fs.V4
+
+	var flags uint32
+	var attrs []byte
+	if v4.Flags&sshFileXferAttrSize != 0 {
+		flags |= sshFileXferAttrSize
+		attrs = marshalUint64(attrs, fs.Size)
+	}
+	if v4.Flags&sshFileXferAttrOwnerGroup != 0 {
+		uid, err1 := strconv.ParseUint(v4.Owner, 10, 32)
+		gid, err2 := strconv.ParseUint(v4.Group, 10, 32)
+		if err1 == nil && err2 == nil {
+			flags |= sshFileXferAttrUIDGID
+			attrs = marshalUint32(attrs, uint32(uid))
+			attrs = marshalUint32(attrs, uint32(gid))
+		}
+	}
+	if v4.Flags&sshFileXferAttrPermissions != 0 {
+		flags |= sshFileXferAttrPermissions
+		attrs = marshalUint32(attrs, fs.Mode)
+	}
+	if v4.Flags&(sshFileXferAttrAccessTime|sshFileXferAttrModifyTime) == sshFileXferAttrAccessTime|sshFileXferAttrModifyTime {
+		flags |= sshFileXferAttrACmodTime
+		attrs = marshalUint32(attrs, fs.Atime)
+		attrs = marshalUint32(attrs, fs.Mtime)
+	}
+	return flags, attrs, nil
+}
+
+func unmarshalOpenV6(b []byte) (*sshFxpOpenPacket, error) {
+	p := &sshFxpOpenPacket{}
+	var access, flags uint32
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return nil, err
+	} else if p.Path, b, err = unmarshalStringSafe(b); err != nil {
+		return nil, err
+	} else if access, b, err = unmarshalUint32Safe(b); err != nil {
+		return nil, err
+	} else if flags, b, err = unmarshalUint32Safe(b); err != nil {
+		return nil, err
+	}
+	p.Pflags, p.flagsV6 = openPflags(access, flags)
+	if p.Flags, p.Attrs, err = unmarshalAttrsV3(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// openPflags returns the v3 pflags of the desired access and the flags of
+// the SSH_FXP_OPEN of the version 6, and the flags without an equivalent.
+func openPflags(access, flags uint32) (pflags, flagsV6 uint32) {
+	if access&ace4ReadData != 0 {
+		pflags |= sshFxfRead
+	}
+	if access&(ace4WriteData|ace4AppendData) != 0 {
+		pflags |= sshFxfWrite
+	}
+	if flags&(sshFxfAppendData|sshFxfAppendDataAtomic) != 0 {
+		pflags |= sshFxfWrite | sshFxfAppend
+	}
+	if pflags == 0 {
+		// opened for its attributes only
+		pflags = sshFxfRead
+	}
+
+	switch flags & sshFxfAccessDisposition {
+	case sshFxfCreateNew:
+		pflags |= sshFxfCreat | sshFxfExcl
+	case sshFxfCreateTruncate:
+		pflags |= sshFxfCreat | sshFxfTrunc
+	case sshFxfOpenOrCreate:
+		pflags |= sshFxfCreat
+	case sshFxfTruncateExisting:
+		pflags |= sshFxfTrunc
+	}
+	return pflags, flags &^ (sshFxfAccessDisposition | sshFxfAppendData | sshFxfAppendDataAtomic)
+}
+
+func unmarshalSetstatV6(b []byte) (*sshFxpSetstatPacket, error) {
+	p := &sshFxpSetstatPacket{}
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return nil, err
+	} else if p.Path, b, err = unmarshalStringSafe(b); err != nil {
+		return nil, err
+	}
+	if p.Flags, p.Attrs, err = unmarshalAttrsV3(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func unmarshalFsetstatV6(b []byte) (*sshFxpFsetstatPacket, error) {
+	p := &sshFxpFsetstatPacket{}
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return nil, err
+	} else if p.Handle, b, err = unmarshalStringSafe(b); err != nil {
+		return nil, err
+	}
+	if p.Flags, p.Attrs, err = unmarshalAttrsV3(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func unmarshalMkdirV6(b []byte) (*sshFxpMkdirPacket, error) {
+	p := &sshFxpMkdirPacket{}
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return nil, err
+	} else if p.Path, b, err = unmarshalStringSafe(b); err != nil {
+		return nil, err
+	}
+	if p.Flags, _, err = unmarshalAttrsV3(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// unmarshalRenameV6 returns a Rename, or a PosixRename if the rename is to
+// overwrite its target.
+func (rs *RequestServer) unmarshalRenameV6(b []byte) (requestPacket, error) {
+	var id, flags uint32
+	var oldpath, newpath string
+	var err error
+	if id, b, err = unmarshalUint32Safe(b); err != nil {
+		return nil, err
+	} else if oldpath, b, err = unmarshalStringSafe(b); err != nil {
+		return nil, err
+	} else if newpath, b, err = unmarshalStringSafe(b); err != nil {
+		return nil, err
+	} else if flags, _, err = unmarshalUint32Safe(b); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case flags&sshFxfRenameOverwrite != 0:
+		if _, ok := rs.Handlers.FileCmd.(PosixRenameFileCmder); !ok {
+			return &sshFxpUnsupportedPacket{ID: id}, nil
+		}
+		return &sshFxpExtendedPacketPosixRename{ID: id, Oldpath: oldpath, Newpath: newpath}, nil
+	case flags&sshFxfRenameAtomic != 0:
+		// only the renames overwriting their target are atomic
+		return &sshFxpUnsupportedPacket{ID: id}, nil
+	}
+	return &sshFxpRenamePacket{ID: id, Oldpath: oldpath, Newpath: newpath}, nil
+}
+
+// unmarshalLinkV6 returns a Symlink, or a Link if the link is a hard link.
+func unmarshalLinkV6(b []byte) (requestPacket, error) {
+	var id uint32
+	var newpath, existing string
+	var err error
+	if id, b, err = unmarshalUint32Safe(b); err != nil {
+		return nil, err
+	} else if newpath, b, err = unmarshalStringSafe(b); err != nil {
+		return nil, err
+	} else if existing, b, err = unmarshalStringSafe(b); err != nil {
+		return nil, err
+	}
+	if len(b) < 1 {
+		return nil, errShortPacket
+	}
+	if b[0] == 0 {
+		return &sshFxpExtendedPacketHardlink{ID: id, Oldpath: existing, Newpath: newpath}, nil
+	}
+	return &sshFxpSymlinkPacket{ID: id, Targetpath: existing, Linkpath: newpath}, nil
+}
+
+// checkOpenFlagsV6 fails with ErrSSHFxOpUnsupported if the Handlers opening
+// r do not honor its flags of the version 6.
+func (rs *RequestServer) checkOpenFlagsV6(r *Request) error {
+	if r.flagsV6 == 0 {
+		return nil
+	}
+	var h interface{} = rs.Handlers.FileGet
+	if f := r.Pflags(); f.Write || f.Append || f.Creat || f.Trunc {
+		h = rs.Handlers.FilePut
+	}
+	opener, ok := h.(OpenFlagsV6Handler)
+	if !ok || r.flagsV6&^opener.OpenFlagsV6().bits() != 0 {
+		return ErrSSHFxOpUnsupported
+	}
+	return nil
+}
+
+// versioned returns rpkt marshalled in the layout of the version negotiated,
+// for the responses the version 6 changed.
+func (rs *RequestServer) versioned(rpkt responsePacket) responsePacket {
+	if atomic.LoadUint32(&rs.version) != protocolVersion6 {
+		return rpkt
+	}
+	switch rpkt.(type) {
+	case *sshFxpStatResponse, *sshFxpNamePacket:
+		return &versionedResponse{rpkt}
+	}
+	return rpkt
+}
+
+// versionedResponse is a response of the version 3 layout, marshalled in the
+// layout of the version 6.
+type versionedResponse struct {
+	responsePacket
+}
+
+func (p *versionedResponse) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 4, 64)
+	switch pkt := p.responsePacket.(type) {
+	case *sshFxpStatResponse:
+		b = append(b, sshFxpAttrs)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalAttrsV4(b, protocolVersion6, fileStatV4FromInfo(pkt.info))
+	case *sshFxpNamePacket:
+		b = append(b, sshFxpName)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalUint32(b, uint32(len(pkt.NameAttrs)))
+		for _, na := range pkt.NameAttrs {
+			b = marshalString(b, na.Name)
+			fs := &FileStat{V4: &FileStatV4{Type: sshFileXferTypeUnknown}}
+			if len(na.Attrs) == 1 {
+				if fi, ok := na.Attrs[0].(os.FileInfo); ok {
+					fs = fileStatV4FromInfo(fi)
+				}
+			}
+			b = marshalAttrsV4(b, protocolVersion6, fs)
+		}
+	default:
+		return p.responsePacket.MarshalBinary()
+	}
+	return b, nil
+}
+
+// fileStatV4FromInfo returns the attributes of fi in the version 6, with
+// the times in nanoseconds.
+func fileStatV4FromInfo(fi os.FileInfo) *FileStat {
+	flags, fileStat := fileStatFromInfo(fi)
+	fs := attrsV4FromV3(flags, &fileStat, fileTypeV4(fi.Mode()))
+
+	mtime := fi.ModTime()
+	fs.V4.Flags |= sshFileXferAttrSubsecondTimes
+	fs.V4.Atime, fs.V4.AtimeNsec = mtime.Unix(), uint32(mtime.Nanosecond())
+	fs.V4.Mtime, fs.V4.MtimeNsec = mtime.Unix(), uint32(mtime.Nanosecond())
+	return fs
+}
+
+// fileTypeV4 returns the SSH_FILEXFER_TYPE of a file of the mode.
+func fileTypeV4(mode os.FileMode) uint8 {
+	switch {
+	case mode.IsRegular():
+		return sshFileXferTypeRegular
+	case mode.IsDir():
+		return sshFileXferTypeDirectory
+	case mode&os.ModeSymlink != 0:
+		return sshFileXferTypeSymlink
+	case mode&os.ModeSocket != 0:
+		return sshFileXferTypeSocket
+	case mode&os.ModeCharDevice != 0:
+		return sshFileXferTypeCharDevice
+	case mode&os.ModeDevice != 0:
+		return sshFileXferTypeBlockDevice
+	case mode&os.ModeNamedPipe != 0:
+		return sshFileXferTypeFIFO
+	}
+	return sshFileXferTypeSpecial
+}
@@ -0,0 +1,151 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sshFxpTestV6Packet is a request of the type typ sent as is.
+type sshFxpTestV6Packet struct {
+	ID   uint32
+	typ  byte
+	data []byte
+}
+
+func (p sshFxpTestV6Packet) id() uint32 { return p.ID }
+
+func (p sshFxpTestV6Packet) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 4, 9+len(p.data))
+	b = append(b, p.typ)
+	b = marshalUint32(b, p.ID)
+	return append(b, p.data...), nil
+}
+
+// sendV6 sends a request of the type typ and returns the error of its
+// status, if answered with one.
+func sendV6(t *testing.T, c *Client, typ byte, data []byte) error {
+	id := c.nextID()
+	rtyp, rdata, err := c.clientConn.sendPacket(nil, sshFxpTestV6Packet{id, typ, data})
+	require.NoError(t, err)
+	if rtyp != sshFxpStatus {
+		return nil
+	}
+	return normaliseError(unmarshalStatus(id, rdata))
+}
+
+func TestRequestServerVersion6(t *testing.T) {
+	client3, _ := handlersClientPair(t, InMemHandler(), []ClientOption{MaxProtocolVersion(6)})
+	// without the option, the version 3 is spoken
+	assert.Equal(t, 3, client3.ProtocolVersion())
+
+	client, _ := handlersClientPair(t, InMemHandler(), []ClientOption{MaxProtocolVersion(6)}, WithRSProtocolVersion6())
+	assert.Equal(t, 6, client.ProtocolVersion())
+
+	_, err := putTestFile(client, "/file", "hello world")
+	require.NoError(t, err)
+	data, err := getTestFile(client, "/file")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	fi, err := client.Stat("/file")
+	require.NoError(t, err)
+	assert.EqualValues(t, 11, fi.Size())
+	assert.True(t, fi.Mode().IsRegular())
+	fs := fi.Sys().(*FileStat)
+	require.NotNil(t, fs.V4)
+	assert.EqualValues(t, sshFileXferTypeRegular, fs.V4.Type)
+	assert.Equal(t, fi.ModTime().Unix(), fs.V4.Mtime)
+
+	require.NoError(t, client.Truncate("/file", 5))
+	fi, err = client.Stat("/file")
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, fi.Size())
+
+	require.NoError(t, client.Mkdir("/dir"))
+	require.NoError(t, client.Rename("/file", "/dir/file"))
+	require.NoError(t, client.Symlink("/dir/file", "/link"))
+	target, err := client.ReadLink("/link")
+	require.NoError(t, err)
+	assert.Equal(t, "file", target) // InMemHandler returns base names
+
+	entries, err := client.ReadDir("/dir")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "file", entries[0].Name())
+	assert.EqualValues(t, 5, entries[0].Size())
+
+	// a hard link, with the link mode of SSH_FXP_LINK unset
+	link := marshalString(nil, "/hardlink")
+	link = marshalString(link, "/dir/file")
+	link = append(link, 0)
+	require.NoError(t, sendV6(t, client, sshFxpLink, link))
+	_, err = client.Stat("/hardlink")
+	assert.NoError(t, err)
+
+	assert.Error(t, client.Rename("/link", "/hardlink"))
+
+	// renames overwriting their target are PosixRenames
+	rename := func(oldpath, newpath string, flags uint32) error {
+		b := marshalString(nil, oldpath)
+		b = marshalString(b, newpath)
+		return sendV6(t, client, sshFxpRename, marshalUint32(b, flags))
+	}
+	require.NoError(t, rename("/link", "/hardlink", sshFxfRenameOverwrite|sshFxfRenameAtomic))
+	fi, err = client.Lstat("/hardlink")
+	require.NoError(t, err)
+	assert.True(t, fi.Mode()&os.ModeSymlink != 0)
+	assertUnsupported(t, rename("/hardlink", "/link", sshFxfRenameAtomic))
+
+	assertUnsupported(t, sendV6(t, client, sshFxpBlock, nil))
+}
+
+func assertUnsupported(t *testing.T, err error) {
+	t.Helper()
+	if assert.IsType(t, &StatusError{}, err) {
+		assert.EqualValues(t, sshFxOPUnsupported, err.(*StatusError).Code)
+	}
+}
+
+// v6Opener opts in to the open flags BlockRead and TextMode.
+type v6Opener struct {
+	FileReader
+	got chan FileOpenFlagsV6
+}
+
+func (o v6Opener) OpenFlagsV6() FileOpenFlagsV6 {
+	return FileOpenFlagsV6{BlockRead: true, TextMode: true}
+}
+
+func (o v6Opener) Fileread(r *Request) (io.ReaderAt, error) {
+	o.got <- r.PflagsV6()
+	return o.FileReader.Fileread(r)
+}
+
+func TestRequestServerOpenFlagsV6(t *testing.T) {
+	open := func(c *Client, flags uint32) error {
+		b := marshalString(nil, "/file")
+		b = marshalUint32(b, ace4ReadData)
+		b = marshalUint32(b, sshFxfOpenExisting|flags)
+		b = marshalUint32(b, 0) // attribute flags
+		return sendV6(t, c, sshFxpOpen, append(b, sshFileXferTypeRegular))
+	}
+
+	h := InMemHandler()
+	client, server := handlersClientPair(t, h, []ClientOption{MaxProtocolVersion(6)}, WithRSProtocolVersion6())
+	_, err := putTestFile(client, "/file", "data")
+	require.NoError(t, err)
+
+	assert.NoError(t, open(client, 0))
+	assertUnsupported(t, open(client, sshFxfBlockRead))
+
+	opener := v6Opener{h.FileGet, make(chan FileOpenFlagsV6, 1)}
+	server.Handlers.FileGet = opener
+	assert.NoError(t, open(client, sshFxfBlockRead|sshFxfTextMode))
+	assert.Equal(t, FileOpenFlagsV6{BlockRead: true, TextMode: true}, <-opener.got)
+	// the flags the Handlers do not honor fail
+	assertUnsupported(t, open(client, sshFxfBlockWrite))
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -26,8 +27,18 @@ type Request struct {
 	Attrs    []byte // convert to sub-struct
 	Target   string // for renames and sym-links
 	handle   string
+	// attribute flags of the Attrs of an SSH_FXP_OPEN
+	openAttrFlags uint32
+	// the open flags of the protocol version 6, see PflagsV6
+	flagsV6 uint32
+	// if not empty, the path of a staged upload, see WithRSStagedUploads,
+	// opened with Excl if stagedExcl
+	stagedPath string
+	stagedExcl bool
 	// reader/writer/readdir from handlers
 	state state
+	// of the handle opened, see RequestServer.OpenHandles
+	stats *handleStats
 	// context lasts duration of request
 	ctx       context.Context
 	cancelCtx context.CancelFunc
@@ -40,6 +51,8 @@ type state struct {
 	writerReaderAt WriterAtReaderAt
 	listerAt       ListerAt
 	lsoffset       int64
+	// writes acknowledged before being performed
+	pendingWrites *asyncWrites
 }
 
 // New Request initialized based on packet data
@@ -51,6 +64,9 @@ func requestFromPacket(ctx context.Context, pkt hasPath) *Request {
 	switch p := pkt.(type) {
 	case *sshFxpOpenPacket:
 		request.Flags = p.Pflags
+		request.openAttrFlags = p.Flags
+		request.flagsV6 = p.flagsV6
+		request.Attrs, _ = p.Attrs.([]byte)
 	case *sshFxpSetstatPacket:
 		request.Flags = p.Flags
 		request.Attrs = p.Attrs.([]byte)
@@ -136,6 +152,13 @@ func (r *Request) getLister() ListerAt {
 }
 
 // Close reader/writer if possible
+// cancel cancels the context of the request, if it can be.
+func (r *Request) cancel() {
+	if r.cancelCtx != nil {
+		r.cancelCtx()
+	}
+}
+
 func (r *Request) close() error {
 	defer func() {
 		if r.cancelCtx != nil {
@@ -147,9 +170,11 @@ func (r *Request) close() error {
 	wr := r.state.writerAt
 	rd := r.state.readerAt
 	rw := r.state.writerReaderAt
+	pending := r.state.pendingWrites
 	r.state.RUnlock()
 
-	var err error
+	// A failed write that was acknowledged early is a loss of data.
+	err := pending.wait()
 
 	// Close errors on a Writer are far more likely to be the important one.
 	// As they can be information that there was a loss of data.
@@ -178,6 +203,52 @@ func (r *Request) close() error {
 	return err
 }
 
+// writable returns true if the request was opened for writing.
+func (r *Request) writable() bool {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	return r.state.writerAt != nil || r.state.writerReaderAt != nil
+}
+
+// readerAt returns the object opened for reading the request, or nil.
+func (r *Request) readerAt() io.ReaderAt {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	if r.state.readerAt != nil {
+		return r.state.readerAt
+	}
+	if r.state.writerReaderAt != nil {
+		return r.state.writerReaderAt
+	}
+	return nil
+}
+
+// writerAt returns the object opened for writing the request, or nil.
+func (r *Request) writerAt() io.WriterAt {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	if r.state.writerAt != nil {
+		return r.state.writerAt
+	}
+	if r.state.writerReaderAt != nil {
+		return r.state.writerReaderAt
+	}
+	return nil
+}
+
+// fsetStater returns the object opened for the request if it implements
+// FsetStater, or nil.
+func (r *Request) fsetStater() FsetStater {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	for _, v := range []interface{}{r.state.writerAt, r.state.writerReaderAt, r.state.readerAt} {
+		if s, ok := v.(FsetStater); ok {
+			return s
+		}
+	}
+	return nil
+}
+
 // Notify transfer error if any
 func (r *Request) transferError(err error) {
 	if err == nil {
@@ -215,7 +286,7 @@ func (r *Request) call(handlers Handlers, pkt requestPacket, alloc *allocator, o
 	case "Setstat", "Rename", "Rmdir", "Mkdir", "Link", "Symlink", "Remove", "PosixRename", "StatVFS":
 		return filecmd(handlers.FileCmd, r, pkt)
 	case "List":
-		return filelist(handlers.FileList, r, pkt)
+		return filelist(handlers.FileList, r, pkt, MaxFilelist, nil, nil)
 	case "Stat", "Lstat", "Readlink":
 		return filestat(handlers.FileList, r, pkt)
 	default:
@@ -235,7 +306,11 @@ func (r *Request) open(h Handlers, pkt requestPacket) responsePacket {
 		if flags.Read {
 			if openFileWriter, ok := h.FilePut.(OpenFileWriter); ok {
 				r.Method = "Open"
-				rw, err := openFileWriter.OpenFile(r)
+				var rw WriterAtReaderAt
+				err := handleRequest(r, func(r *Request) (err error) {
+					rw, err = openFileWriter.OpenFile(r)
+					return err
+				})
 				if err != nil {
 					return statusFromError(id, err)
 				}
@@ -245,14 +320,22 @@ func (r *Request) open(h Handlers, pkt requestPacket) responsePacket {
 		}
 
 		r.Method = "Put"
-		wr, err := h.FilePut.Filewrite(r)
+		var wr io.WriterAt
+		err := handleRequest(r, func(r *Request) (err error) {
+			wr, err = h.FilePut.Filewrite(r)
+			return err
+		})
 		if err != nil {
 			return statusFromError(id, err)
 		}
 		r.state.writerAt = wr
 	case flags.Read:
 		r.Method = "Get"
-		rd, err := h.FileGet.Fileread(r)
+		var rd io.ReaderAt
+		err := handleRequest(r, func(r *Request) (err error) {
+			rd, err = h.FileGet.Fileread(r)
+			return err
+		})
 		if err != nil {
 			return statusFromError(id, err)
 		}
@@ -265,7 +348,11 @@ func (r *Request) open(h Handlers, pkt requestPacket) responsePacket {
 
 func (r *Request) opendir(h Handlers, pkt requestPacket) responsePacket {
 	r.Method = "List"
-	la, err := h.FileList.Filelist(r)
+	var la ListerAt
+	err := handleRequest(r, func(r *Request) (err error) {
+		la, err = h.FileList.Filelist(r)
+		return err
+	})
 	if err != nil {
 		return statusFromError(pkt.id(), wrapPathError(r.Filepath, err))
 	}
@@ -284,6 +371,7 @@ func fileget(h FileReader, r *Request, pkt requestPacket, alloc *allocator, orde
 
 	data, offset, _ := packetData(pkt, alloc, orderID)
 	n, err := reader.ReadAt(data, offset)
+	r.stats.addRead(n)
 	// only return EOF error if no data left to read
 	if err != nil && (err != io.EOF || n == 0) {
 		return statusFromError(pkt.id(), err)
@@ -305,7 +393,8 @@ func fileput(h FileWriter, r *Request, pkt requestPacket, alloc *allocator, orde
 	}
 
 	data, offset, _ := packetData(pkt, alloc, orderID)
-	_, err := writer.WriteAt(data, offset)
+	n, err := writer.WriteAt(data, offset)
+	r.stats.addWritten(n)
 	return statusFromError(pkt.id(), err)
 }
 
@@ -321,6 +410,7 @@ func fileputget(h FileWriter, r *Request, pkt requestPacket, alloc *allocator, o
 	case *sshFxpReadPacket:
 		data, offset := p.getDataSlice(alloc, orderID), int64(p.Offset)
 		n, err := writerReader.ReadAt(data, offset)
+		r.stats.addRead(n)
 		// only return EOF error if no data left to read
 		if err != nil && (err != io.EOF || n == 0) {
 			return statusFromError(pkt.id(), err)
@@ -332,7 +422,8 @@ func fileputget(h FileWriter, r *Request, pkt requestPacket, alloc *allocator, o
 		}
 	case *sshFxpWritePacket:
 		data, offset := p.Data, int64(p.Offset)
-		_, err := writerReader.WriteAt(data, offset)
+		n, err := writerReader.WriteAt(data, offset)
+		r.stats.addWritten(n)
 		return statusFromError(pkt.id(), err)
 	default:
 		return statusFromError(pkt.id(), errors.New("unexpected packet type for read or write"))
@@ -360,19 +451,23 @@ func filecmd(h FileCmder, r *Request, pkt requestPacket) responsePacket {
 
 	if r.Method == "PosixRename" {
 		if posixRenamer, ok := h.(PosixRenameFileCmder); ok {
-			err := posixRenamer.PosixRename(r)
+			err := handleRequest(r, posixRenamer.PosixRename)
 			return statusFromError(pkt.id(), err)
 		}
 
 		// PosixRenameFileCmder not implemented handle this request as a Rename
 		r.Method = "Rename"
-		err := h.Filecmd(r)
+		err := handleRequest(r, h.Filecmd)
 		return statusFromError(pkt.id(), err)
 	}
 
 	if r.Method == "StatVFS" {
 		if statVFSCmdr, ok := h.(StatVFSFileCmder); ok {
-			stat, err := statVFSCmdr.StatVFS(r)
+			var stat *StatVFS
+			err := handleRequest(r, func(r *Request) (err error) {
+				stat, err = statVFSCmdr.StatVFS(r)
+				return err
+			})
 			if err != nil {
 				return statusFromError(pkt.id(), err)
 			}
@@ -383,12 +478,60 @@ func filecmd(h FileCmder, r *Request, pkt requestPacket) responsePacket {
 		return statusFromError(pkt.id(), ErrSSHFxOpUnsupported)
 	}
 
-	err := h.Filecmd(r)
+	if r.Method == "Setstat" {
+		err := handleRequest(r, func(r *Request) error {
+			return setstat(h, r)
+		})
+		return statusFromError(pkt.id(), err)
+	}
+
+	err := handleRequest(r, h.Filecmd)
 	return statusFromError(pkt.id(), err)
 }
 
+// setstat serves the Setstat request r with the typed methods of h if it is
+// a SetstatFileCmder, and with its Filecmd otherwise.
+func setstat(h FileCmder, r *Request) error {
+	setter, ok := h.(SetstatFileCmder)
+	if !ok {
+		return h.Filecmd(r)
+	}
+
+	flags, attrs := r.AttrFlags(), r.Attributes()
+	if flags.Size {
+		if err := setter.Truncate(r, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := setter.Chmod(r, attrs.FileMode()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		atime := time.Unix(int64(attrs.Atime), 0)
+		mtime := time.Unix(int64(attrs.Mtime), 0)
+		if err := setter.Chtimes(r, atime, mtime); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := setter.Chown(r, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrap FsetStater of the object opened for a handle
+func fsetstat(s FsetStater, r *Request, pkt *sshFxpFsetstatPacket) responsePacket {
+	r.Flags = pkt.Flags
+	r.Attrs = pkt.Attrs.([]byte)
+	return statusFromError(pkt.id(), s.Fsetstat(r))
+}
+
 // wrap FileLister handler
-func filelist(h FileLister, r *Request, pkt requestPacket) responsePacket {
+func filelist(h FileLister, r *Request, pkt requestPacket, maxEntries int64, filter ListFilter, longName LongNameFormatter) responsePacket {
 	var err error
 	lister := r.getLister()
 	if lister == nil {
@@ -396,18 +539,15 @@ func filelist(h FileLister, r *Request, pkt requestPacket) responsePacket {
 	}
 
 	offset := r.lsNext()
-	finfo := make([]os.FileInfo, MaxFilelist)
-	n, err := lister.ListAt(finfo, offset)
-	r.lsInc(int64(n))
+	finfo, ends, err := listEntries(r.Context(), lister, r.Filepath, offset, maxEntries, filter)
 	// ignore EOF as we only return it when there are no results
-	finfo = finfo[:n] // avoid need for nil tests below
 
 	switch r.Method {
 	case "List":
 		if err != nil && err != io.EOF {
 			return statusFromError(pkt.id(), err)
 		}
-		if err == io.EOF && n == 0 {
+		if err == io.EOF && len(finfo) == 0 {
 			return statusFromError(pkt.id(), io.EOF)
 		}
 		dirname := filepath.ToSlash(path.Base(r.Filepath))
@@ -416,10 +556,15 @@ func filelist(h FileLister, r *Request, pkt requestPacket) responsePacket {
 		for _, fi := range finfo {
 			ret.NameAttrs = append(ret.NameAttrs, &sshFxpNameAttr{
 				Name:     fi.Name(),
-				LongName: runLs(dirname, fi),
+				LongName: formatLongName(longName, dirname, fi),
 				Attrs:    []interface{}{fi},
 			})
 		}
+		// entries that do not fit are listed again from the next offset
+		ret.NameAttrs = ret.NameAttrs[:fitNameAttrs(ret.NameAttrs)]
+		if n := len(ret.NameAttrs); n > 0 {
+			r.lsInc(ends[n-1] - offset)
+		}
 		return ret
 	default:
 		err = errors.Errorf("unexpected method: %s", r.Method)
@@ -427,26 +572,54 @@ func filelist(h FileLister, r *Request, pkt requestPacket) responsePacket {
 	}
 }
 
-func filestat(h FileLister, r *Request, pkt requestPacket) responsePacket {
-	var lister ListerAt
-	var err error
+// listEntries lists up to maxEntries entries of the directory dir from offset,
+// with ctx,
+// passed through filter if not nil. Batches are listed until an entry passes
+// the filter, or the end of the directory. ends has the offset following each
+// of the entries returned.
+func listEntries(ctx context.Context, lister ListerAt, dir string, offset, maxEntries int64, filter ListFilter) (entries []os.FileInfo, ends []int64, err error) {
+	finfo := make([]os.FileInfo, maxEntries)
+	for {
+		var n int
+		n, err = listAt(ctx, lister, finfo, offset)
+		for i, fi := range finfo[:n] {
+			if filter != nil {
+				var ok bool
+				if fi, ok = filter(dir, fi); !ok {
+					continue
+				}
+			}
+			entries = append(entries, fi)
+			ends = append(ends, offset+int64(i)+1)
+		}
+		offset += int64(n)
 
+		if filter == nil || len(entries) > 0 || err != nil || n == 0 {
+			return entries, ends, err
+		}
+	}
+}
+
+func filestat(h FileLister, r *Request, pkt requestPacket) responsePacket {
+	list := h.Filelist
 	if r.Method == "Lstat" {
 		if lstatFileLister, ok := h.(LstatFileLister); ok {
-			lister, err = lstatFileLister.Lstat(r)
+			list = lstatFileLister.Lstat
 		} else {
 			// LstatFileLister not implemented handle this request as a Stat
 			r.Method = "Stat"
-			lister, err = h.Filelist(r)
 		}
-	} else {
-		lister, err = h.Filelist(r)
 	}
+	var lister ListerAt
+	err := handleRequest(r, func(r *Request) (err error) {
+		lister, err = list(r)
+		return err
+	})
 	if err != nil {
 		return statusFromError(pkt.id(), err)
 	}
 	finfo := make([]os.FileInfo, 1)
-	n, err := lister.ListAt(finfo, 0)
+	n, err := listAt(r.Context(), lister, finfo, 0)
 	finfo = finfo[:n] // avoid need for nil tests below
 
 	switch r.Method {
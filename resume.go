@@ -0,0 +1,183 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+)
+
+// VerifyResume makes ResumeUpload and ResumeDownload check that the last
+// tail bytes the source and the destination have in common are the same,
+// hashed on the server with the check-file-handle extension, before
+// resuming after them. When they differ, or the server cannot hash them,
+// the transfer restarts from the beginning of the file.
+func VerifyResume(tail int64) TransferOption {
+	return func(o *transferOptions) {
+		o.verifyTail = tail
+	}
+}
+
+// ResumeUpload copies the local file localPath to remotePath like Upload,
+// but continues an interrupted upload where it stopped instead of starting
+// over: the data already in remotePath is kept, up to the size of localPath,
+// and only the rest of localPath is sent. A remotePath larger than
+// localPath is uploaded again. See VerifyResume to check the data kept.
+func (c *Client) ResumeUpload(localPath, remotePath string, opts ...TransferOption) error {
+	o := newTransferOptions(opts)
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	f := os.O_WRONLY | os.O_CREATE
+	if o.verifyTail > 0 {
+		f = os.O_RDWR | os.O_CREATE // check-file-handle reads the file
+	}
+	dst, err := c.createFile(context.Background(), remotePath, f, o.createParents)
+	if err != nil {
+		return err
+	}
+	dst.SetProgress(o.progress)
+	dst.SetSparse(o.sparse)
+	if err := resumeUpload(dst, src, fi.Size(), o); err != nil {
+		dst.Close()
+		return err
+	}
+	if _, err := dst.ReadFrom(src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		short, ok := err.(*ShortWriteError)
+		if !ok {
+			return err
+		}
+		if err := c.rewrite(remotePath, src, short); err != nil {
+			return err
+		}
+	}
+
+	return preserveAttrs(c, remotePath, fi, o)
+}
+
+// ResumeDownload copies the remote file remotePath to localPath like
+// Download, but continues an interrupted download where it stopped instead
+// of starting over: the data already in localPath is kept, up to the size
+// of remotePath, and only the rest of remotePath is received. A localPath
+// larger than remotePath is downloaded again. See VerifyResume to check the
+// data kept.
+func (c *Client) ResumeDownload(remotePath, localPath string, opts ...TransferOption) error {
+	o := newTransferOptions(opts)
+
+	src, err := c.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	src.SetProgress(o.progress)
+	src.SetSparse(o.sparse)
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if err := resumeDownload(src, dst, fi.Size(), o); err != nil {
+		dst.Close()
+		return err
+	}
+	if _, err := src.WriteTo(dst); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return preserveAttrs(localAttrs{}, localPath, fi, o)
+}
+
+// resumeUpload seeks dst and src to the end of the data dst has in
+// common with src, of the given size, truncating dst to it.
+func resumeUpload(dst *File, src *os.File, size int64, o transferOptions) error {
+	fi, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	off := resumeOffset(dst, src, fi.Size(), size, o)
+	if off != fi.Size() {
+		if err := dst.Truncate(off); err != nil {
+			return err
+		}
+	}
+	return seekAll(off, dst, src)
+}
+
+// resumeDownload seeks src and dst to the end of the data dst has in
+// common with src, of the given size, truncating dst to it.
+func resumeDownload(src *File, dst *os.File, size int64, o transferOptions) error {
+	fi, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	off := resumeOffset(src, dst, fi.Size(), size, o)
+	if off != fi.Size() {
+		if err := dst.Truncate(off); err != nil {
+			return err
+		}
+	}
+	return seekAll(off, src, dst)
+}
+
+// resumeOffset returns where to resume the transfer of a source of the
+// given size, of which the destination has the first have bytes, between
+// the remote and local files.
+func resumeOffset(remote *File, local io.ReaderAt, have, size int64, o transferOptions) int64 {
+	if have > size {
+		return 0
+	}
+	if have > 0 && o.verifyTail > 0 && !resumeMatches(remote, local, have, o.verifyTail) {
+		return 0
+	}
+	return have
+}
+
+// seekAll seeks each of seekers to off.
+func seekAll(off int64, seekers ...io.Seeker) error {
+	for _, s := range seekers {
+		if _, err := s.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeMatches reports whether the tail bytes before off of remote and
+// local are the same, with remote hashed by the server.
+func resumeMatches(remote *File, local io.ReaderAt, off, tail int64) bool {
+	if tail > off {
+		tail = off
+	}
+	name, sum, err := remote.checkFile(off-tail, tail)
+	if err != nil {
+		return false
+	}
+	h := newCheckFileHash(name)
+	if h == nil {
+		return false
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(local, off-tail, tail)); err != nil {
+		return false
+	}
+	return bytes.Equal(h.Sum(nil), sum)
+}
@@ -0,0 +1,111 @@
+package sftp
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeUploadDownload(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+	src := filepath.Join(dir, "src")
+	require.NoError(t, ioutil.WriteFile(src, data, 0600))
+
+	// partial returns the first half of data, with the byte at i changed
+	partial := func(i int) []byte {
+		b := append([]byte(nil), data[:100000]...)
+		b[i] ^= 0xff
+		return b
+	}
+	dst := filepath.Join(dir, "dst")
+
+	tests := []struct {
+		name     string
+		transfer func(opts ...TransferOption) error
+	}{
+		{"ResumeUpload", func(opts ...TransferOption) error {
+			return client.ResumeUpload(src, dst, opts...)
+		}},
+		{"ResumeDownload", func(opts ...TransferOption) error {
+			return client.ResumeDownload(src, dst, opts...)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the data in common is kept as is
+			require.NoError(t, ioutil.WriteFile(dst, partial(99990), 0600))
+			require.NoError(t, tt.transfer())
+			got, err := ioutil.ReadFile(dst)
+			require.NoError(t, err)
+			assert.Equal(t, append(partial(99990), data[100000:]...), got)
+
+			// with its tail checked
+			require.NoError(t, ioutil.WriteFile(dst, partial(0), 0600))
+			require.NoError(t, tt.transfer(VerifyResume(4096)))
+			got, err = ioutil.ReadFile(dst)
+			require.NoError(t, err)
+			assert.Equal(t, append(partial(0), data[100000:]...), got)
+
+			// unless the tail does not match
+			require.NoError(t, ioutil.WriteFile(dst, partial(99990), 0600))
+			require.NoError(t, tt.transfer(VerifyResume(4096)))
+			got, err = ioutil.ReadFile(dst)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+
+			// a larger destination starts over
+			require.NoError(t, ioutil.WriteFile(dst, append(data, "extra"...), 0600))
+			require.NoError(t, tt.transfer(VerifyResume(4096)))
+			got, err = ioutil.ReadFile(dst)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+
+			require.NoError(t, os.Remove(dst))
+			require.NoError(t, tt.transfer())
+			got, err = ioutil.ReadFile(dst)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+		})
+	}
+}
+
+func TestRequestServerCheckFile(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+
+	_, err := putTestFile(p.cli, "/file", "hello world")
+	require.NoError(t, err)
+	f, err := p.cli.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+
+	name, sum, err := f.checkFile(6, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "sha256", name)
+	want := sha256.Sum256([]byte("world"))
+	assert.Equal(t, want[:], sum)
+
+	w, err := p.cli.OpenFile("/file", os.O_WRONLY)
+	require.NoError(t, err)
+	defer w.Close()
+	_, _, err = w.checkFile(0, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,225 @@
+package s3handler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-memory S3 of a single bucket, implementing the calls made
+// by the handlers. The other calls panic, through the nil S3API embedded.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+	uploads  map[string]map[int64][]byte // parts by upload ID
+	nextID   int
+	failPart bool // fail uploads of parts
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]map[int64][]byte),
+	}
+}
+
+func notFound(key string) error {
+	return awserr.NewRequestFailure(awserr.New("NotFound", key+" not found", nil), 404, "")
+}
+
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = &fakeObject{data: data, modTime: time.Now()}
+}
+
+func (f *fakeS3) get(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[key]
+	if !ok {
+		return nil, false
+	}
+	return obj.data, true
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, notFound(*in.Key)
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.data))),
+		LastModified:  aws.Time(obj.modTime),
+	}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, *in.Key, nil)
+	}
+	data := obj.data
+	if in.Range != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(*in.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		data = data[start : end+1]
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.put(*in.Key, data)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(ctx aws.Context, in *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, *in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) CopyObjectWithContext(ctx aws.Context, in *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+	src := strings.TrimPrefix(*in.CopySource, testBucket+"/")
+	data, ok := f.get(src)
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, src, nil)
+	}
+	f.put(*in.Key, data)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	prefix, delim := aws.StringValue(in.Prefix), aws.StringValue(in.Delimiter)
+	out := &s3.ListObjectsV2Output{}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delim != "" {
+			if i := strings.Index(key[len(prefix):], delim); i >= 0 {
+				cp := key[:len(prefix)+i+1]
+				if !seen[cp] {
+					seen[cp] = true
+					out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(cp)})
+				}
+				continue
+			}
+		}
+		obj := f.objects[key]
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.data))),
+			LastModified: aws.Time(obj.modTime),
+		})
+		if in.MaxKeys != nil && int64(len(out.Contents)) == *in.MaxKeys {
+			break
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(ctx aws.Context, in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	out, err := f.ListObjectsV2WithContext(ctx, in)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+func (f *fakeS3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := fmt.Sprint(f.nextID)
+	f.uploads[id] = make(map[int64][]byte)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, _ ...request.Option) (*s3.UploadPartOutput, error) {
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failPart {
+		return nil, awserr.New("InternalError", "part upload failed", nil)
+	}
+	f.uploads[*in.UploadId][*in.PartNumber] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprint("etag", *in.PartNumber))}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, _ ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	parts := f.uploads[*in.UploadId]
+	delete(f.uploads, *in.UploadId)
+	f.mu.Unlock()
+
+	var data []byte
+	for i, p := range in.MultipartUpload.Parts {
+		if *p.PartNumber != int64(i+1) || aws.StringValue(p.ETag) != fmt.Sprint("etag", i+1) {
+			return nil, awserr.New("InvalidPart", fmt.Sprint("part ", i+1), nil)
+		}
+		data = append(data, parts[*p.PartNumber]...)
+	}
+	f.put(*in.Key, data)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUploadWithContext(ctx aws.Context, in *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, *in.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) object(t *testing.T, key string) []byte {
+	data, ok := f.get(key)
+	require.True(t, ok, key)
+	return data
+}
@@ -0,0 +1,11 @@
+module github.com/pkg/sftp/s3handler
+
+go 1.15
+
+require (
+	github.com/aws/aws-sdk-go v1.38.30
+	github.com/pkg/sftp v1.13.0
+	github.com/stretchr/testify v1.7.0
+)
+
+replace github.com/pkg/sftp => ../
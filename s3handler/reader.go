@@ -0,0 +1,129 @@
+package s3handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// cachedBlocks is the number of blocks a reader keeps, enough for the
+// concurrent reads of a client reading sequentially to hit the cache.
+const cachedBlocks = 4
+
+// reader serves the reads of an object by ranged GETs of whole blocks.
+type reader struct {
+	h    *handler
+	ctx  context.Context
+	key  string
+	size int64
+
+	mu     sync.Mutex
+	blocks map[int64]*block // by index
+	order  []int64          // indexes, from the least recently fetched
+}
+
+// block is a block of the object, being fetched until done is closed.
+type block struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// failed returns true if the block was fetched with an error.
+func (blk *block) failed() bool {
+	select {
+	case <-blk.done:
+		return blk.err != nil
+	default:
+		return false
+	}
+}
+
+func (h *handler) newReader(ctx context.Context, key string, size int64) *reader {
+	return &reader{
+		h:      h,
+		ctx:    ctx,
+		key:    key,
+		size:   size,
+		blocks: make(map[int64]*block),
+	}
+}
+
+func (r *reader) ReadAt(b []byte, off int64) (int, error) {
+	bs := int64(r.h.blockSize)
+	n := 0
+	for n < len(b) && off < r.size {
+		blk := r.block(off / bs)
+		<-blk.done
+		if blk.err != nil {
+			return n, blk.err
+		}
+		pos := off % bs
+		if pos >= int64(len(blk.data)) {
+			// the object was replaced by a smaller one
+			return n, io.ErrUnexpectedEOF
+		}
+		c := copy(b[n:], blk.data[pos:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns the block at index i, fetching it if not cached.
+func (r *reader) block(i int64) *block {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if blk, ok := r.blocks[i]; ok {
+		if !blk.failed() {
+			return blk
+		}
+		// fetch it again
+		blk = &block{done: make(chan struct{})}
+		r.blocks[i] = blk
+		go r.fetch(i, blk)
+		return blk
+	}
+
+	blk := &block{done: make(chan struct{})}
+	r.blocks[i] = blk
+	r.order = append(r.order, i)
+	if len(r.order) > cachedBlocks {
+		delete(r.blocks, r.order[0])
+		r.order = r.order[1:]
+	}
+
+	go r.fetch(i, blk)
+	return blk
+}
+
+func (r *reader) fetch(i int64, blk *block) {
+	defer close(blk.done)
+
+	start := i * int64(r.h.blockSize)
+	end := start + int64(r.h.blockSize)
+	if end > r.size {
+		end = r.size
+	}
+	out, err := r.h.client.GetObjectWithContext(r.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.h.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+	})
+	if err == nil {
+		blk.data, err = ioutil.ReadAll(out.Body)
+		out.Body.Close()
+	}
+	if err != nil {
+		blk.err = toError(r.key, err)
+	}
+}
@@ -0,0 +1,500 @@
+// Package s3handler serves the objects of an S3 bucket through the
+// request server of the sftp package.
+//
+// Objects are exposed as files, with the slashes of their keys separating
+// directories. Directories exist as long as objects are stored under them,
+// Mkdir stores an empty marker object whose key ends with a slash so that
+// empty directories can exist.
+//
+// Uploads are streamed to S3 as multipart uploads, and reads are served by
+// ranged GETs. S3 has no rename: Rename and PosixRename copy the objects then
+// delete the originals, so renaming a directory is not atomic. Permissions,
+// owners and times cannot be set, Setstat only supports truncating to 0;
+// links are not supported.
+//
+// It lives in its own module, so that the sftp package does not depend on the AWS SDK.
+package s3handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// DefaultPartSize is the default size of the parts of multipart uploads.
+	DefaultPartSize = 8 << 20
+
+	// minPartSize is the minimum size of the parts of multipart uploads supported by S3.
+	minPartSize = 5 << 20
+
+	// DefaultReadBlockSize is the default size of the ranged GETs serving reads.
+	DefaultReadBlockSize = 1 << 20
+
+	// maxCopySize is the size above which objects must be copied by parts.
+	maxCopySize = 5 << 30
+)
+
+// An Option configures the handlers returned by New.
+type Option func(*handler)
+
+// WithPrefix serves the objects whose keys start with prefix, the prefix
+// being the root directory. A slash is appended to prefix if missing.
+func WithPrefix(prefix string) Option {
+	return func(h *handler) {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		h.prefix = prefix
+	}
+}
+
+// WithPartSize sets the size of the parts of multipart uploads,
+// the larger the part the less memory each upload requires.
+// It defaults to DefaultPartSize, S3 requires at least 5 MiB.
+func WithPartSize(n int64) Option {
+	return func(h *handler) {
+		if n >= minPartSize {
+			h.partSize = n
+		}
+	}
+}
+
+// WithReadBlockSize sets the size of the ranged GETs serving the reads,
+// the blocks being cached so that sequential reads need one GET per block.
+// It defaults to DefaultReadBlockSize.
+func WithReadBlockSize(n int) Option {
+	return func(h *handler) {
+		if n > 0 {
+			h.blockSize = n
+		}
+	}
+}
+
+var _ sftp.PosixRenameFileCmder = (*handler)(nil)
+
+type handler struct {
+	client    s3iface.S3API
+	bucket    string
+	prefix    string
+	partSize  int64
+	blockSize int
+}
+
+// New returns handlers serving the objects of bucket through client.
+func New(client s3iface.S3API, bucket string, options ...Option) sftp.Handlers {
+	h := &handler{
+		client:    client,
+		bucket:    bucket,
+		partSize:  DefaultPartSize,
+		blockSize: DefaultReadBlockSize,
+	}
+	for _, o := range options {
+		o(h)
+	}
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
+
+// key returns the key of the object of the file at p, "" for the root.
+func (h *handler) key(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return strings.TrimSuffix(h.prefix, "/")
+	}
+	return h.prefix + p
+}
+
+// dirPrefix returns the prefix of the objects under the directory at p.
+func (h *handler) dirPrefix(p string) string {
+	if k := h.key(p); k != "" {
+		return k + "/"
+	}
+	return ""
+}
+
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// toError converts the errors of S3 for the request server.
+func toError(p string, err error) error {
+	if isNotFound(err) {
+		return &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 403 {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+// fileInfo describes an object, or a directory.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// stat describes the file at p: an object, or a directory if objects are stored under it.
+func (h *handler) stat(ctx context.Context, p string) (*fileInfo, error) {
+	name := path.Base(path.Clean("/" + p))
+	key := h.key(p)
+	if key == "" {
+		return &fileInfo{name: name, dir: true}, nil
+	}
+
+	out, err := h.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(h.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return &fileInfo{
+			name:    name,
+			size:    aws.Int64Value(out.ContentLength),
+			modTime: aws.TimeValue(out.LastModified),
+		}, nil
+	}
+	if !isNotFound(err) {
+		return nil, toError(p, err)
+	}
+
+	empty, err := h.emptyDir(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if empty == nil {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return &fileInfo{name: name, dir: true}, nil
+}
+
+// emptyDir tells if the directory at p is empty, it is nil if the directory does not exist.
+func (h *handler) emptyDir(ctx context.Context, p string) (*bool, error) {
+	prefix := h.dirPrefix(p)
+	out, err := h.client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(h.bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(2),
+	})
+	if err != nil {
+		return nil, toError(p, err)
+	}
+	if len(out.Contents) == 0 {
+		return nil, nil
+	}
+	empty := len(out.Contents) == 1 && aws.StringValue(out.Contents[0].Key) == prefix
+	return &empty, nil
+}
+
+func (h *handler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	fi, err := h.stat(r.Context(), r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.dir {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return h.newReader(r.Context(), h.key(r.Filepath), fi.size), nil
+}
+
+func (h *handler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	pflags := r.Pflags()
+	if pflags.Append {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	if pflags.Excl {
+		if _, err := h.stat(r.Context(), r.Filepath); err == nil {
+			return nil, os.ErrExist
+		}
+	}
+	if !pflags.Trunc {
+		// objects are replaced as a whole, writing into
+		// an existing object without truncating it is not supported
+		if fi, err := h.stat(r.Context(), r.Filepath); err == nil && fi.size > 0 {
+			return nil, sftp.ErrSSHFxOpUnsupported
+		}
+	}
+	return h.newWriter(r.Context(), h.key(r.Filepath)), nil
+}
+
+// listerat is a ListerAt over a slice.
+type listerat []os.FileInfo
+
+func (l listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		return h.list(r.Context(), r.Filepath)
+	case "Stat", "Lstat":
+		fi, err := h.stat(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerat{fi}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *handler) list(ctx context.Context, p string) (sftp.ListerAt, error) {
+	prefix := h.dirPrefix(p)
+	var fis listerat
+	err := h.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(h.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(out *s3.ListObjectsV2Output, last bool) bool {
+		for _, cp := range out.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(cp.Prefix), prefix), "/")
+			fis = append(fis, &fileInfo{name: name, dir: true})
+		}
+		for _, obj := range out.Contents {
+			key := aws.StringValue(obj.Key)
+			if key == prefix {
+				// marker of the directory itself
+				continue
+			}
+			fis = append(fis, &fileInfo{
+				name:    strings.TrimPrefix(key, prefix),
+				size:    aws.Int64Value(obj.Size),
+				modTime: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, toError(p, err)
+	}
+	if len(fis) == 0 {
+		// tell empty directories from missing ones
+		if _, err := h.stat(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+	return fis, nil
+}
+
+func (h *handler) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r)
+	case "Rename":
+		if _, err := h.stat(ctx, r.Target); err == nil {
+			return os.ErrExist
+		}
+		return h.rename(ctx, r.Filepath, r.Target)
+	case "Rmdir":
+		empty, err := h.emptyDir(ctx, r.Filepath)
+		switch {
+		case err != nil:
+			return err
+		case empty == nil:
+			return &os.PathError{Op: "rmdir", Path: r.Filepath, Err: os.ErrNotExist}
+		case !*empty:
+			return sftp.ErrSSHFxFailure
+		}
+		return h.delete(ctx, h.dirPrefix(r.Filepath))
+	case "Mkdir":
+		if _, err := h.stat(ctx, r.Filepath); err == nil {
+			return os.ErrExist
+		}
+		_, err := h.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(h.bucket),
+			Key:    aws.String(h.dirPrefix(r.Filepath)),
+			Body:   strings.NewReader(""),
+		})
+		return toError(r.Filepath, err)
+	case "Remove":
+		fi, err := h.stat(ctx, r.Filepath)
+		if err != nil {
+			return err
+		}
+		if fi.dir {
+			return sftp.ErrSSHFxFailure
+		}
+		return h.delete(ctx, h.key(r.Filepath))
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename renames as Rename does, replacing the target if it exists.
+func (h *handler) PosixRename(r *sftp.Request) error {
+	return h.rename(r.Context(), r.Filepath, r.Target)
+}
+
+func (h *handler) setstat(r *sftp.Request) error {
+	// owners, permissions and times are accepted, since clients set them
+	// after uploads, but cannot be stored
+	if !r.AttrFlags().Size {
+		return nil
+	}
+	if r.Attributes().Size != 0 {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	_, err := h.client.PutObjectWithContext(r.Context(), &s3.PutObjectInput{
+		Bucket: aws.String(h.bucket),
+		Key:    aws.String(h.key(r.Filepath)),
+		Body:   strings.NewReader(""),
+	})
+	return toError(r.Filepath, err)
+}
+
+func (h *handler) delete(ctx context.Context, key string) error {
+	_, err := h.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(h.bucket),
+		Key:    aws.String(key),
+	})
+	return toError(key, err)
+}
+
+// rename copies the object at oldpath, or all the objects under it,
+// then deletes the originals.
+func (h *handler) rename(ctx context.Context, oldpath, newpath string) error {
+	fi, err := h.stat(ctx, oldpath)
+	if err != nil {
+		return err
+	}
+	if !fi.dir {
+		if err := h.copy(ctx, h.key(oldpath), h.key(newpath), fi.size); err != nil {
+			return err
+		}
+		return h.delete(ctx, h.key(oldpath))
+	}
+
+	oldPrefix, newPrefix := h.dirPrefix(oldpath), h.dirPrefix(newpath)
+	if oldPrefix == "" || strings.HasPrefix(newPrefix, oldPrefix) {
+		// cannot move a directory into itself
+		return sftp.ErrSSHFxFailure
+	}
+	var objects []*s3.Object
+	err = h.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(h.bucket),
+		Prefix: aws.String(oldPrefix),
+	}, func(out *s3.ListObjectsV2Output, last bool) bool {
+		objects = append(objects, out.Contents...)
+		return true
+	})
+	if err != nil {
+		return toError(oldpath, err)
+	}
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		if err := h.copy(ctx, key, newPrefix+strings.TrimPrefix(key, oldPrefix), aws.Int64Value(obj.Size)); err != nil {
+			return err
+		}
+	}
+	for _, obj := range objects {
+		if err := h.delete(ctx, aws.StringValue(obj.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy copies the object at src of the given size to dst,
+// by parts if it is larger than what CopyObject supports.
+func (h *handler) copy(ctx context.Context, src, dst string, size int64) error {
+	source := h.bucket + "/" + escapeKey(src)
+	if size <= maxCopySize {
+		_, err := h.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(h.bucket),
+			Key:        aws.String(dst),
+			CopySource: aws.String(source),
+		})
+		return toError(src, err)
+	}
+
+	up, err := h.client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(h.bucket),
+		Key:    aws.String(dst),
+	})
+	if err != nil {
+		return toError(dst, err)
+	}
+	var parts []*s3.CompletedPart
+	for off, n := int64(0), int64(1); off < size; off, n = off+maxCopySize, n+1 {
+		end := off + maxCopySize
+		if end > size {
+			end = size
+		}
+		out, err := h.client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(h.bucket),
+			Key:             aws.String(dst),
+			UploadId:        up.UploadId,
+			PartNumber:      aws.Int64(n),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", off, end-1)),
+		})
+		if err != nil {
+			h.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(h.bucket),
+				Key:      aws.String(dst),
+				UploadId: up.UploadId,
+			})
+			return toError(src, err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(n)})
+	}
+	_, err = h.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(h.bucket),
+		Key:             aws.String(dst),
+		UploadId:        up.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return toError(dst, err)
+}
+
+// escapeKey escapes a key for the CopySource parameters, keeping the slashes.
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
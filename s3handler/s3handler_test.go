@@ -0,0 +1,186 @@
+package s3handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/pkg/sftp/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBucket = "bucket"
+
+// clientS3Pair returns a client of a request server serving a fake S3 bucket.
+func clientS3Pair(t *testing.T, options ...Option) (*sftp.Client, *fakeS3) {
+	s3c := newFakeS3()
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, New(s3c, testBucket, options...))
+	go server.Serve()
+	client, err := sftp.NewClientPipe(cr, cw)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client, s3c
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestMultipartUpload(t *testing.T) {
+	client, s3c := clientS3Pair(t, WithPrefix("root"), WithPartSize(5<<20))
+
+	// larger than a part, written concurrently by the client
+	data := testData(12 << 20)
+	f, err := client.Create("/dir/file")
+	require.NoError(t, err)
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, data, s3c.object(t, "root/dir/file"))
+
+	fi, err := client.Stat("/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), fi.Size())
+	assert.False(t, fi.IsDir())
+
+	fi, err = client.Stat("/dir")
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+}
+
+func TestMultipartUploadFailure(t *testing.T) {
+	client, s3c := clientS3Pair(t, WithPartSize(5<<20))
+	s3c.failPart = true
+
+	f, err := client.Create("/file")
+	require.NoError(t, err)
+	_, err = f.ReadFrom(bytes.NewReader(testData(11 << 20)))
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	assert.Error(t, err)
+
+	_, err = client.Stat("/file")
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, s3c.uploads, "aborted")
+}
+
+func TestRangedReads(t *testing.T) {
+	client, s3c := clientS3Pair(t, WithReadBlockSize(1000))
+	data := testData(10500)
+	s3c.put("file", data)
+
+	f, err := client.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := make([]byte, 2500)
+	n, err := f.ReadAt(buf, 900)
+	require.NoError(t, err)
+	assert.Equal(t, data[900:3400], buf[:n])
+
+	n, err = f.ReadAt(buf, 9000)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, data[9000:], buf[:n])
+
+	var got bytes.Buffer
+	_, err = f.WriteTo(&got)
+	require.NoError(t, err)
+	assert.Equal(t, data, got.Bytes())
+}
+
+func TestWriterOutOfOrder(t *testing.T) {
+	_, s3c := clientS3Pair(t)
+	h := &handler{client: s3c, bucket: testBucket, partSize: DefaultPartSize}
+
+	w := h.newWriter(context.Background(), "file")
+	_, err := w.WriteAt([]byte("world"), 6)
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("hello "), 0)
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("x"), 0)
+	assert.Equal(t, errNotSequential, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, "hello world", string(s3c.object(t, "file")))
+
+	w = h.newWriter(context.Background(), "hole")
+	_, err = w.WriteAt([]byte("world"), 6)
+	require.NoError(t, err)
+	assert.Error(t, w.Close())
+}
+
+func TestListAndCommands(t *testing.T) {
+	client, s3c := clientS3Pair(t)
+	s3c.put("a/one", []byte("1"))
+	s3c.put("a/sub/two", []byte("22"))
+	s3c.put("top", []byte("333"))
+
+	names := func(dir string) []string {
+		fis, err := client.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+	assert.Equal(t, []string{"a", "top"}, names("/"))
+	assert.Equal(t, []string{"one", "sub"}, names("/a"))
+
+	_, err := client.ReadDir("/missing")
+	assert.True(t, os.IsNotExist(err))
+
+	// empty directories are kept by their marker
+	require.NoError(t, client.Mkdir("/empty"))
+	assert.Empty(t, names("/empty"))
+	assert.Error(t, client.Mkdir("/empty"))
+	require.NoError(t, client.RemoveDirectory("/empty"))
+	_, err = client.Stat("/empty")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, client.RemoveDirectory("/a"), "not empty")
+	assert.Error(t, client.Rename("/top", "/a/one"), "target exists")
+
+	require.NoError(t, client.Rename("/a", "/b"))
+	assert.Equal(t, []string{"b", "top"}, names("/"))
+	assert.Equal(t, []byte("22"), s3c.object(t, "b/sub/two"))
+
+	require.NoError(t, client.PosixRename("/top", "/b/one"))
+	assert.Equal(t, []byte("333"), s3c.object(t, "b/one"))
+
+	require.NoError(t, client.Remove("/b/one"))
+	_, err = client.Stat("/b/one")
+	assert.True(t, os.IsNotExist(err))
+	assert.Error(t, client.Remove("/b/one"))
+
+	assert.Error(t, client.Symlink("/b/sub/two", "/link"))
+}
+
+func TestConformance(t *testing.T) {
+	handlertest.TestHandlers(t, func() sftp.Handlers {
+		return New(newFakeS3(), testBucket)
+	})
+}
@@ -0,0 +1,213 @@
+package s3handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// uploadConcurrency is the number of parts of a file uploaded at once.
+const uploadConcurrency = 4
+
+var errNotSequential = errors.New("s3handler: writes must be sequential")
+
+// writer uploads the writes of a file from offset 0, by parts of a multipart upload.
+// Files smaller than a part are uploaded with a single PUT when closed.
+//
+// The writes of SFTP clients are concurrent, so they may arrive out of order:
+// writes ahead of the end of the data received so far are held in memory until
+// the writes before them arrive, up to a part size. Writes before the end of
+// the data received, rewriting it, are not supported.
+type writer struct {
+	h   *handler
+	ctx context.Context
+	key string
+
+	mu      sync.Mutex
+	off     int64            // end of the data received
+	part    []byte           // data of the next part
+	pending map[int64][]byte // writes ahead of off, by offset
+	held    int64            // bytes in pending
+
+	uploadID *string
+	sem      chan struct{} // limits the parts uploaded at once
+	wg       sync.WaitGroup
+	partsMu  sync.Mutex
+	parts    []*s3.CompletedPart
+	err      error // first error of a part upload
+}
+
+func (h *handler) newWriter(ctx context.Context, key string) *writer {
+	return &writer{
+		h:       h,
+		ctx:     ctx,
+		key:     key,
+		pending: make(map[int64][]byte),
+		sem:     make(chan struct{}, uploadConcurrency),
+	}
+}
+
+func (w *writer) WriteAt(b []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.uploadErr(); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case off < w.off:
+		return 0, errNotSequential
+	case off > w.off:
+		if _, ok := w.pending[off]; ok || w.held+int64(len(b)) > w.h.partSize {
+			return 0, errNotSequential
+		}
+		// b is reused by the server once WriteAt returns
+		w.pending[off] = append([]byte(nil), b...)
+		w.held += int64(len(b))
+		return len(b), nil
+	}
+
+	if err := w.append(b); err != nil {
+		return 0, err
+	}
+	for {
+		next, ok := w.pending[w.off]
+		if !ok {
+			break
+		}
+		delete(w.pending, w.off)
+		w.held -= int64(len(next))
+		if err := w.append(next); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// append appends b to the data received, uploading the parts filled. w.mu must be held.
+func (w *writer) append(b []byte) error {
+	w.off += int64(len(b))
+	for len(b) > 0 {
+		n := int(w.h.partSize) - len(w.part)
+		if n > len(b) {
+			n = len(b)
+		}
+		w.part = append(w.part, b[:n]...)
+		b = b[n:]
+
+		if int64(len(w.part)) == w.h.partSize {
+			if err := w.uploadPart(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// uploadPart starts the upload of w.part, once fewer than uploadConcurrency
+// parts are being uploaded. w.mu must be held.
+func (w *writer) uploadPart() error {
+	if w.uploadID == nil {
+		out, err := w.h.client.CreateMultipartUploadWithContext(w.ctx, &s3.CreateMultipartUploadInput{
+			Bucket: aws.String(w.h.bucket),
+			Key:    aws.String(w.key),
+		})
+		if err != nil {
+			return toError(w.key, err)
+		}
+		w.uploadID = out.UploadId
+	}
+
+	w.partsMu.Lock()
+	number := int64(len(w.parts) + 1)
+	w.parts = append(w.parts, &s3.CompletedPart{PartNumber: aws.Int64(number)})
+	w.partsMu.Unlock()
+
+	data := w.part
+	w.part = nil
+
+	w.sem <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() { <-w.sem }()
+
+		out, err := w.h.client.UploadPartWithContext(w.ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(w.h.bucket),
+			Key:        aws.String(w.key),
+			UploadId:   w.uploadID,
+			PartNumber: aws.Int64(number),
+			Body:       bytes.NewReader(data),
+		})
+
+		w.partsMu.Lock()
+		defer w.partsMu.Unlock()
+		if err != nil {
+			if w.err == nil {
+				w.err = toError(w.key, err)
+			}
+			return
+		}
+		w.parts[number-1].ETag = out.ETag
+	}()
+	return nil
+}
+
+func (w *writer) uploadErr() error {
+	w.partsMu.Lock()
+	defer w.partsMu.Unlock()
+	return w.err
+}
+
+// Close completes the upload, and returns its error.
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.uploadErr()
+	if err == nil && len(w.pending) > 0 {
+		// writes were missing before the pending ones
+		err = errNotSequential
+	}
+
+	if w.uploadID == nil {
+		if err != nil {
+			return err
+		}
+		_, err := w.h.client.PutObjectWithContext(w.ctx, &s3.PutObjectInput{
+			Bucket: aws.String(w.h.bucket),
+			Key:    aws.String(w.key),
+			Body:   bytes.NewReader(w.part),
+		})
+		return toError(w.key, err)
+	}
+
+	if err == nil && len(w.part) > 0 {
+		err = w.uploadPart()
+	}
+	w.wg.Wait()
+	if err == nil {
+		err = w.uploadErr()
+	}
+	if err != nil {
+		w.h.client.AbortMultipartUploadWithContext(w.ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(w.h.bucket),
+			Key:      aws.String(w.key),
+			UploadId: w.uploadID,
+		})
+		return err
+	}
+
+	_, err = w.h.client.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.h.bucket),
+		Key:             aws.String(w.key),
+		UploadId:        w.uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: w.parts},
+	})
+	return toError(w.key, err)
+}
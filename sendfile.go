@@ -0,0 +1,132 @@
+package sftp
+
+import (
+	"encoding"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// WithZeroCopyReads sends the data of the reads of regular files straight
+// from the files to the connection, with io.Copy at the time the replies
+// are sent, rather than reading it into a buffer first. The runtime then
+// uses sendfile or splice where the connection allows it, as a
+// *net.TCPConn does; otherwise the data is copied through a single buffer
+// of the connection. Files mapped into memory, see WithMmapReads, are read
+// from their mappings instead.
+//
+// The data sent is that of the file as the reply is sent, up to its size
+// then. A file truncated while its data is being sent still aborts the
+// session, the reply being only partly written.
+func WithZeroCopyReads() ServerOption {
+	return func(s *Server) error {
+		s.zeroCopyReads = true
+		return nil
+	}
+}
+
+// fileData returns the reply to p sent straight from f, or nil if p is to
+// be read as usual: for a file mapped or not regular, or reading from its
+// end. Its length is that requested, cut to the size of f once sent.
+func (f *serverFile) fileData(p *sshFxpReadPacket) responsePacket {
+	f.mapMu.RLock()
+	mapped := f.mapped != nil
+	f.mapMu.RUnlock()
+	if mapped {
+		return nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	if int64(p.Offset) < 0 || fi.Size() <= int64(p.Offset) {
+		return nil
+	}
+
+	f.sends.Add(1)
+	return &sshFxpFileDataPacket{
+		ID:     p.ID,
+		f:      f,
+		Offset: int64(p.Offset),
+		Length: clamp(p.Len, maxTxPacket),
+	}
+}
+
+// sshFxpFileDataPacket is a SSH_FXP_DATA reply of at most Length bytes,
+// read from the file f at Offset once sent.
+type sshFxpFileDataPacket struct {
+	ID     uint32
+	f      *serverFile
+	Offset int64
+	Length uint32
+}
+
+func (p *sshFxpFileDataPacket) id() uint32 { return p.ID }
+
+// MarshalBinary reads the data into the packet, for the senders which do
+// not copy it, see writeTo.
+func (p *sshFxpFileDataPacket) MarshalBinary() ([]byte, error) {
+	data := make([]byte, p.Length, p.Length+dataHeaderLen)
+	n, err := p.f.ReadAt(data, p.Offset)
+	if n == 0 {
+		return statusFromError(p.ID, err).MarshalBinary()
+	}
+	return (&sshFxpDataPacket{ID: p.ID, Length: uint32(n), Data: data[:n]}).MarshalBinary()
+}
+
+// writeTo writes the packet to w, copying its data from the file with buf,
+// unless a fast path of io.CopyBuffer avoids it. The packets are written
+// one at a time, as they seek the file, the lock of the conn held, and
+// their Length is cut to the size of the file right before the header is
+// written.
+func (p *sshFxpFileDataPacket) writeTo(w io.Writer, buf []byte) error {
+	defer p.f.sends.Done()
+
+	fi, err := p.f.Stat()
+	if err != nil {
+		return sendPacket(w, statusFromError(p.ID, err))
+	}
+	n := fi.Size() - p.Offset
+	if n <= 0 {
+		return sendPacket(w, statusFromError(p.ID, io.EOF))
+	}
+	if n < int64(p.Length) {
+		p.Length = uint32(n)
+	}
+	if _, err := p.f.Seek(p.Offset, io.SeekStart); err != nil {
+		return sendPacket(w, statusFromError(p.ID, err))
+	}
+
+	header := make([]byte, 4, dataHeaderLen)
+	header = append(header, sshFxpData)
+	header = marshalUint32(header, p.ID)
+	header = marshalUint32(header, p.Length)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(header)-4)+p.Length)
+	if debugDumpTxPacket || debugDumpTxPacketBytes {
+		debug("send packet: %s %d bytes", fxp(sshFxpData), len(header)-4+int(p.Length))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return errors.Wrap(err, "failed to send packet")
+	}
+	copied, err := io.CopyBuffer(w, io.LimitReader(p.f.File, int64(p.Length)), buf)
+	if copied < int64(p.Length) {
+		// the file got truncated while sent, the connection is out of sync
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Wrap(err, "failed to send packet payload")
+	}
+	return nil
+}
+
+// fileDataPacket returns m if it is a reply read from a file once sent.
+func fileDataPacket(m encoding.BinaryMarshaler) (*sshFxpFileDataPacket, bool) {
+	if r, ok := m.(orderedResponse); ok {
+		m = r.responsePacket
+	}
+	p, ok := m.(*sshFxpFileDataPacket)
+	return p, ok
+}
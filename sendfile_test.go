@@ -0,0 +1,125 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func checkZeroCopyReads(t *testing.T, client *Client) {
+	dir, err := ioutil.TempDir("", "sftptest-sendfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "file")
+	data := make([]byte, 1<<20+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	require.NoError(t, ioutil.WriteFile(p, data, 0644))
+
+	f, err := client.Open(filepath.ToSlash(p))
+	require.NoError(t, err)
+	defer f.Close()
+
+	var buf bytes.Buffer
+	_, err = f.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, data, buf.Bytes())
+
+	b := make([]byte, 1000)
+	n, err := f.ReadAt(b, int64(len(data)-100))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, data[len(data)-100:], b[:n])
+	_, err = f.ReadAt(b, int64(len(data)))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServerZeroCopyReads(t *testing.T) {
+	client, server := clientServerPair(t, WithZeroCopyReads())
+	defer client.Close()
+	defer server.Close()
+
+	checkZeroCopyReads(t, client)
+}
+
+func TestServerZeroCopyReadsTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		server, err := NewServer(conn, WithZeroCopyReads())
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- server.Serve()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	client, err := NewClientPipe(conn, conn)
+	require.NoError(t, err)
+
+	checkZeroCopyReads(t, client)
+	require.NoError(t, client.Close())
+	assert.Equal(t, io.EOF, <-done)
+}
+
+func TestFileDataPacketMarshal(t *testing.T) {
+	f, err := ioutil.TempFile("", "sftptest-sendfile")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.WriteString("some data")
+	require.NoError(t, err)
+
+	sf := &serverFile{File: f}
+	rpkt := sf.fileData(&sshFxpReadPacket{ID: 1, Offset: 5, Len: 10})
+	require.NotNil(t, rpkt)
+	var want bytes.Buffer
+	require.NoError(t, sendPacket(&want, &sshFxpDataPacket{ID: 1, Length: 4, Data: []byte("data")}))
+
+	var buf bytes.Buffer
+	require.NoError(t, sendPacket(&buf, rpkt))
+	assert.Equal(t, want.Bytes(), buf.Bytes())
+
+	buf.Reset()
+	require.NoError(t, rpkt.(*sshFxpFileDataPacket).writeTo(&buf, make([]byte, 2)))
+	assert.Equal(t, want.Bytes(), buf.Bytes())
+	sf.sends.Wait()
+
+	assert.Nil(t, sf.fileData(&sshFxpReadPacket{ID: 2, Offset: 9, Len: 10}))
+
+	// cut to the file truncated before it is sent
+	rpkt = sf.fileData(&sshFxpReadPacket{ID: 3, Offset: 2, Len: 10})
+	require.NotNil(t, rpkt)
+	require.NoError(t, f.Truncate(4))
+	want.Reset()
+	require.NoError(t, sendPacket(&want, &sshFxpDataPacket{ID: 3, Length: 2, Data: []byte("me")}))
+	buf.Reset()
+	require.NoError(t, rpkt.(*sshFxpFileDataPacket).writeTo(&buf, make([]byte, 2)))
+	assert.Equal(t, want.Bytes(), buf.Bytes())
+
+	rpkt = sf.fileData(&sshFxpReadPacket{ID: 4, Offset: 2, Len: 10})
+	require.NotNil(t, rpkt)
+	require.NoError(t, f.Truncate(1))
+	want.Reset()
+	require.NoError(t, sendPacket(&want, statusFromError(4, io.EOF)))
+	buf.Reset()
+	require.NoError(t, rpkt.(*sshFxpFileDataPacket).writeTo(&buf, make([]byte, 2)))
+	assert.Equal(t, want.Bytes(), buf.Bytes())
+	sf.sends.Wait()
+}
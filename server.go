@@ -9,17 +9,22 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
+	runtimedebug "runtime/debug"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
 	// SftpServerWorkerCount defines the number of workers for the SFTP server
 	SftpServerWorkerCount = 8
+
+	// defaultMaxFilelist is the default max number of entries
+	// the Server returns in a single readdir batch.
+	defaultMaxFilelist = 128
 )
 
 // Server is an SSH File Transfer Protocol (sftp) server.
@@ -28,39 +33,130 @@ const (
 // as specified at http://tools.ietf.org/html/draft-ietf-secsh-filexfer-02
 type Server struct {
 	*serverConn
-	debugStream   io.Writer
-	readOnly      bool
-	pktMgr        *packetManager
-	openFiles     map[string]*os.File
-	openFilesLock sync.RWMutex
-	handleCount   int
+	debugStream io.Writer
+	readOnly    bool
+	uploadOnly  bool // set by UploadOnly
+	pktMgr      *packetManager
+	openFiles   *handleTable // handle -> *serverFile
+	maxFilelist int
+	// if not nil, filenames are stored on disk in this encoding
+	filenameEncoding FilenameEncoding
+	// set by WithLongNameFormatter
+	longName LongNameFormatter
+	// set by WithDenyRules
+	denyRules denyRules
+	// set by WithPolicy
+	policy *Policy
+	// async writes are allowed by WithAsyncWrites and enabled once
+	// negotiated with the client
+	allowAsyncWrites bool
+	allowCompression bool
+	asyncWrites      bool
+	// if not empty, requests are served with profiler labels of this session
+	profileSession string
+	// the INIT of the client, once received
+	client clientInfoHolder
+	// if not 0, the min size of the read-only files mapped into memory
+	mmapMinSize int64
+	// set by WithStagedUploads
+	stagedUploads bool
+	// set by WithLimits
+	limits Limits
+	// set by WithNamesLookup
+	names NamesLookup
+	// set by WithZeroCopyReads
+	zeroCopyReads bool
+	// if not empty, the root directory the clients are confined to
+	jail string
+	// set by WithSymlinkPolicy, with the working directory of the process
+	symlinks    ServerSymlinkPolicy
+	symlinkRoot string
+}
+
+// ClientInfo returns how the client introduced itself, and false if it has
+// not yet.
+func (svr *Server) ClientInfo() (ClientInfo, bool) {
+	return svr.client.load()
 }
 
+// serverFile is the state of a handle opened by the Server.
+type serverFile struct {
+	*os.File
+
+	mu sync.Mutex
+	// directory entries read from disk that did not fit into the last
+	// readdir response
+	pendingDirents []os.FileInfo
+	// writes acknowledged before being performed
+	pendingWrites *asyncWrites
+
+	// if not nil, the file mapped into memory, see WithMmapReads
+	mapMu  sync.RWMutex
+	mapped []byte
+
+	// if not empty, the path the file is renamed to once closed,
+	// see WithStagedUploads, without replacing a file if stagedExcl
+	stagedPath string
+	stagedExcl bool
+
+	// replies to be read from the file once sent, see WithZeroCopyReads
+	sends sync.WaitGroup
+}
+
+// nextHandle returns the handle of f, or "" if the handles allowed are
+// open already, see WithLimits.
 func (svr *Server) nextHandle(f *os.File) string {
-	svr.openFilesLock.Lock()
-	defer svr.openFilesLock.Unlock()
-	svr.handleCount++
-	handle := strconv.Itoa(svr.handleCount)
-	svr.openFiles[handle] = f
+	if !svr.openFiles.reserve() {
+		return ""
+	}
+	return svr.nextFileHandle(&serverFile{File: f})
+}
+
+// nextFileHandle returns the handle of f, in the room reserved for it in
+// openFiles.
+func (svr *Server) nextFileHandle(f *serverFile) string {
+	handle := svr.openFiles.newHandle()
+	svr.openFiles.put(handle, f)
 	return handle
 }
 
 func (svr *Server) closeHandle(handle string) error {
-	svr.openFilesLock.Lock()
-	defer svr.openFilesLock.Unlock()
-	if f, ok := svr.openFiles[handle]; ok {
-		delete(svr.openFiles, handle)
-		return f.Close()
+	v, ok := svr.openFiles.remove(handle)
+	if !ok {
+		return EBADF
 	}
+	f := v.(*serverFile)
 
-	return EBADF
+	f.mu.Lock()
+	pending := f.pendingWrites
+	f.mu.Unlock()
+
+	// report the writes acknowledged early that failed
+	err := pending.wait()
+	f.sends.Wait()
+	if err2 := f.close(); err == nil {
+		err = err2
+	}
+	if f.stagedPath != "" {
+		err = f.commitStaged(err)
+	}
+	return err
 }
 
 func (svr *Server) getHandle(handle string) (*os.File, bool) {
-	svr.openFilesLock.RLock()
-	defer svr.openFilesLock.RUnlock()
-	f, ok := svr.openFiles[handle]
-	return f, ok
+	f, ok := svr.getServerFile(handle)
+	if !ok {
+		return nil, false
+	}
+	return f.File, true
+}
+
+func (svr *Server) getServerFile(handle string) (*serverFile, bool) {
+	v, ok := svr.openFiles.get(handle)
+	if !ok {
+		return nil, false
+	}
+	return v.(*serverFile), true
 }
 
 type serverRespondablePacket interface {
@@ -85,7 +181,8 @@ func NewServer(rwc io.ReadWriteCloser, options ...ServerOption) (*Server, error)
 		serverConn:  svrConn,
 		debugStream: ioutil.Discard,
 		pktMgr:      newPktMgr(svrConn),
-		openFiles:   make(map[string]*os.File),
+		openFiles:   newHandleTable(),
+		maxFilelist: defaultMaxFilelist,
 	}
 
 	for _, o := range options {
@@ -129,6 +226,113 @@ func WithAllocator() ServerOption {
 	}
 }
 
+// WithPacketAllocator enables the allocator, as WithAllocator does, with
+// its pages provided by a rather than the default sync.Pool.
+//
+// The RequestServer equivalent is WithRSPacketAllocator.
+func WithPacketAllocator(a Allocator) ServerOption {
+	return func(s *Server) error {
+		alloc := newAllocator()
+		alloc.pages = a
+		s.pktMgr.alloc = alloc
+		s.conn.alloc = alloc
+		return nil
+	}
+}
+
+// WithMaxFilelist sets the max number of entries the Server returns in a
+// single readdir batch. Fewer entries are returned if sending all of them
+// would exceed the max packet length accepted by clients.
+//
+// The default is 128 entries, and n less than 1 is an error.
+// The RequestServer equivalent is WithRSMaxFilelist, defaulting to MaxFilelist.
+func WithMaxFilelist(n int) ServerOption {
+	return func(s *Server) error {
+		if n < 1 {
+			return errors.New("n must be greater or equal to 1")
+		}
+		s.maxFilelist = n
+		return nil
+	}
+}
+
+// FilenameEncoding translates filenames between the UTF-8 encoding
+// used on the wire, and the encoding used on disk.
+//
+// An encoding from golang.org/x/text/encoding can be adapted by calling
+// enc.NewEncoder().String in Encode, and enc.NewDecoder().String in Decode.
+type FilenameEncoding interface {
+	// Encode converts a UTF-8 filename into the encoding used on disk.
+	Encode(name string) (string, error)
+	// Decode converts a filename read from disk into UTF-8.
+	Decode(name string) (string, error)
+}
+
+// WithFilenameEncoding configures a Server to translate filenames between
+// the given encoding used on disk, and the UTF-8 encoding used on the wire.
+// This allows serving filesystems created with a legacy charset,
+// such as ISO 8859-1 or Shift JIS, to modern clients.
+//
+// Filenames that cannot be encoded are rejected with an error.
+// Filenames read from disk that cannot be decoded are sent unchanged,
+// as they would be without this option.
+//
+// This option only applies to Server: a RequestServer passes the
+// filenames to its Handlers, which are free to translate them.
+func WithFilenameEncoding(enc FilenameEncoding) ServerOption {
+	return func(s *Server) error {
+		s.filenameEncoding = enc
+		return nil
+	}
+}
+
+// WithAsyncWrites allows clients to negotiate asynchronous writes.
+// Write requests are then acknowledged before the data is written to disk,
+// and the first failed write is reported, along with its offset,
+// when the file is closed.
+//
+// Clients enable it with the UseAsyncWrites option.
+func WithAsyncWrites() ServerOption {
+	return func(s *Server) error {
+		s.allowAsyncWrites = true
+		return nil
+	}
+}
+
+// WithProfilerLabels labels the goroutines serving the requests with pprof
+// labels, for profiles to be broken down by operation: "sftp.method" for the
+// packet type, "sftp.path" for the first element of the path, and
+// "sftp.session" for the Server.
+//
+// The RequestServer equivalent is WithRSProfilerLabels.
+func WithProfilerLabels() ServerOption {
+	return func(s *Server) error {
+		s.profileSession = nextSessionID()
+		return nil
+	}
+}
+
+// WithConnConfig calls config with the metadata of the SSH connection the
+// Server serves, such as the name of the user and their remote address, and
+// applies the options it returns, for a single accept loop to serve each user
+// with their own privileges. An error returned by config fails NewServer.
+//
+// The RequestServer equivalent is WithRSConnConfig.
+func WithConnConfig(meta ssh.ConnMetadata, config func(meta ssh.ConnMetadata) ([]ServerOption, error)) ServerOption {
+	return func(s *Server) error {
+		options, err := config(meta)
+		if err != nil {
+			return err
+		}
+		for _, o := range options {
+			if err := o(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
 type rxPacket struct {
 	pktType  fxp
 	pktBytes []byte
@@ -137,41 +341,147 @@ type rxPacket struct {
 // Up to N parallel servers
 func (svr *Server) sftpServerWorker(pktChan chan orderedRequest) error {
 	for pkt := range pktChan {
-		// readonly checks
-		readonly := true
-		switch pkt := pkt.requestPacket.(type) {
-		case notReadOnly:
-			readonly = false
-		case *sshFxpOpenPacket:
-			readonly = pkt.readonly()
-		case *sshFxpExtendedPacket:
-			readonly = pkt.readonly()
+		if svr.profileSession != "" {
+			labelRequest(svr.profileSession, pkt.requestPacket, svr.labelPath(pkt.requestPacket))
 		}
 
+		policy := svr.policy.state()
+
 		// If server is operating read-only and a write operation is requested,
 		// return permission denied
-		if !readonly && svr.readOnly {
+		if (svr.readOnly || policy.readOnly) && !packetReadOnly(pkt.requestPacket) {
 			svr.pktMgr.readyPacket(
 				svr.pktMgr.newOrderedResponse(statusFromError(pkt.id(), syscall.EPERM), pkt.orderID()),
 			)
 			continue
 		}
+		if svr.uploadOnly {
+			if err := checkUploadOnly(pkt.requestPacket); err != nil {
+				svr.pktMgr.readyPacket(
+					svr.pktMgr.newOrderedResponse(statusFromError(pkt.id(), err), pkt.orderID()),
+				)
+				continue
+			}
+		}
+
+		clean := localDenyPath
+		if svr.jail != "" {
+			// the paths are those of the jail, not yet resolved
+			clean = cleanPath
+		}
+		err := svr.denyRules.checkPacket(pkt.requestPacket, clean, svr.denyHandlePath)
+		if err == nil {
+			err = policy.denyRules.checkPacket(pkt.requestPacket, clean, svr.denyHandlePath)
+		}
+		if err != nil {
+			svr.pktMgr.readyPacket(
+				svr.pktMgr.newOrderedResponse(statusFromError(pkt.id(), err), pkt.orderID()),
+			)
+			continue
+		}
 
-		if err := handlePacket(svr, pkt); err != nil {
+		if svr.filenameEncoding != nil {
+			if err := svr.toLocalFilenames(pkt.requestPacket); err != nil {
+				svr.pktMgr.readyPacket(
+					svr.pktMgr.newOrderedResponse(statusFromError(pkt.id(), err), pkt.orderID()),
+				)
+				continue
+			}
+		}
+
+		if svr.jail != "" {
+			if err := svr.toJailPaths(pkt.requestPacket); err != nil {
+				svr.pktMgr.readyPacket(
+					svr.pktMgr.newOrderedResponse(statusFromError(pkt.id(), err), pkt.orderID()),
+				)
+				continue
+			}
+		} else if svr.symlinks != SymlinkFollowAll {
+			if err := svr.checkSymlinks(pkt.requestPacket); err != nil {
+				svr.pktMgr.readyPacket(
+					svr.pktMgr.newOrderedResponse(statusFromError(pkt.id(), err), pkt.orderID()),
+				)
+				continue
+			}
+		}
+
+		svr.limits.clampRead(pkt.requestPacket)
+		if err := svr.handlePacket(pkt); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// packetReadOnly reports whether pkt does not change files.
+func packetReadOnly(pkt requestPacket) bool {
+	switch pkt := pkt.(type) {
+	case notReadOnly:
+		return false
+	case interface{ readonly() bool }:
+		return pkt.readonly()
+	}
+	return true
+}
+
+// denyHandlePath returns the path of the file opened for handle, as matched
+// by the deny rules.
+func (svr *Server) denyHandlePath(handle string) (string, bool) {
+	f, ok := svr.getServerFile(handle)
+	if !ok {
+		return "", false
+	}
+	name := f.Name()
+	if f.stagedPath != "" {
+		name = f.stagedPath
+	}
+	return svr.localDenyPath(name), true
+}
+
+// localDenyPath is the path of a local file name, as matched by the deny
+// rules: a path of the jail if any.
+func (svr *Server) localDenyPath(name string) string {
+	if svr.jail != "" {
+		return svr.jailPath(name)
+	}
+	return localDenyPath(name)
+}
+
+// labelPath returns the path of a request for the profiler labels.
+func (svr *Server) labelPath(pkt requestPacket) string {
+	if pkt, ok := pkt.(hasHandle); ok {
+		if f, ok := svr.getHandle(pkt.getHandle()); ok {
+			return f.Name()
+		}
+		return ""
+	}
+	return packetPath(pkt)
+}
+
+// handlePacket serves the request p. A panic serving it is recovered from,
+// and the request fails, rather than crashing the process.
+func (svr *Server) handlePacket(p orderedRequest) error {
+	defer func() {
+		if v := recover(); v != nil {
+			svr.pktMgr.readyPacket(
+				svr.pktMgr.newOrderedResponse(recovered(p.requestPacket, v), p.orderID()),
+			)
+		}
+	}()
+	return handlePacket(svr, p)
+}
+
 func handlePacket(s *Server, p orderedRequest) error {
 	var rpkt responsePacket
 	orderID := p.orderID()
 	switch p := p.requestPacket.(type) {
 	case *sshFxInitPacket:
+		s.client.store(p)
+		s.asyncWrites = s.allowAsyncWrites && p.hasAsyncWriteExtension()
+		s.conn.setCompressed(s.allowCompression && p.hasCompressionExtension())
 		rpkt = &sshFxVersionPacket{
 			Version:    sftpProtocolVersion,
-			Extensions: sftpExtensions,
+			Extensions: withCompression(withUsersGroups(versionExtensions(s.asyncWrites), s.names), s.conn.isCompressed()),
 		}
 	case *sshFxpStatPacket:
 		// stat the requested file
@@ -241,8 +551,11 @@ func handlePacket(s *Server, p orderedRequest) error {
 			rpkt = statusFromError(p.ID, err)
 		}
 	case *sshFxpRealpathPacket:
-		f, err := filepath.Abs(p.Path)
-		f = cleanPath(f)
+		f, err := p.Path, error(nil)
+		if s.jail == "" {
+			f, err = filepath.Abs(p.Path)
+			f = cleanPath(f)
+		}
 		rpkt = &sshFxpNamePacket{
 			ID: p.ID,
 			NameAttrs: []*sshFxpNameAttr{
@@ -271,11 +584,16 @@ func handlePacket(s *Server, p orderedRequest) error {
 		}
 	case *sshFxpReadPacket:
 		var err error = EBADF
-		f, ok := s.getHandle(p.Handle)
+		f, ok := s.getServerFile(p.Handle)
+		if ok && s.zeroCopyReads && !s.conn.isCompressed() {
+			if rpkt = f.fileData(p); rpkt != nil {
+				break
+			}
+		}
 		if ok {
 			err = nil
 			data := p.getDataSlice(s.pktMgr.alloc, orderID)
-			n, _err := f.ReadAt(data, int64(p.Offset))
+			n, _err := f.readAt(data, int64(p.Offset))
 			if _err != nil && (_err != io.EOF || n == 0) {
 				err = _err
 			}
@@ -291,7 +609,11 @@ func handlePacket(s *Server, p orderedRequest) error {
 		}
 
 	case *sshFxpWritePacket:
-		f, ok := s.getHandle(p.Handle)
+		f, ok := s.getServerFile(p.Handle)
+		if ok && s.asyncWrites {
+			s.writeAsync(f, p, orderID)
+			return nil
+		}
 		var err error = EBADF
 		if ok {
 			_, err = f.WriteAt(p.Data, int64(p.Offset))
@@ -306,15 +628,115 @@ func handlePacket(s *Server, p orderedRequest) error {
 	case serverRespondablePacket:
 		rpkt = p.respond(s)
 	default:
-		return errors.Errorf("unexpected packet type %T", p)
+		rpkt = statusFromError(p.id(), ErrSSHFxOpUnsupported)
+	}
+
+	if npkt, ok := rpkt.(*sshFxpNamePacket); ok && s.filenameEncoding != nil {
+		s.toWireFilenames(npkt)
 	}
 
 	s.pktMgr.readyPacket(s.pktMgr.newOrderedResponse(rpkt, orderID))
 	return nil
 }
 
+// writeAsync acknowledges the write request before performing it,
+// a failure is reported when closing the handle.
+func (svr *Server) writeAsync(f *serverFile, p *sshFxpWritePacket, orderID uint32) {
+	f.mu.Lock()
+	pending := f.pendingWrites
+	if pending == nil {
+		pending = new(asyncWrites)
+		f.pendingWrites = pending
+	}
+	f.mu.Unlock()
+
+	data := p.Data
+	if svr.pktMgr.alloc != nil {
+		// the allocated pages are released as soon as the response is sent
+		data = append([]byte(nil), data...)
+	}
+
+	pending.start()
+	svr.pktMgr.readyPacket(svr.pktMgr.newOrderedResponse(statusFromError(p.ID, nil), orderID))
+
+	_, err := f.WriteAt(data, int64(p.Offset))
+	pending.done(int64(p.Offset), err)
+}
+
+// toLocalFilenames translates the UTF-8 filenames of an incoming packet
+// into the encoding used on disk.
+func (svr *Server) toLocalFilenames(p requestPacket) error {
+	if p, ok := p.(*sshFxpExtendedPacket); ok {
+		if p.SpecificPacket == nil {
+			return nil
+		}
+		return svr.toLocalFilenames(p.SpecificPacket)
+	}
+
+	var names []*string
+	switch p := p.(type) {
+	case *sshFxpStatPacket:
+		names = []*string{&p.Path}
+	case *sshFxpLstatPacket:
+		names = []*string{&p.Path}
+	case *sshFxpMkdirPacket:
+		names = []*string{&p.Path}
+	case *sshFxpRmdirPacket:
+		names = []*string{&p.Path}
+	case *sshFxpRemovePacket:
+		names = []*string{&p.Filename}
+	case *sshFxpRenamePacket:
+		names = []*string{&p.Oldpath, &p.Newpath}
+	case *sshFxpSymlinkPacket:
+		names = []*string{&p.Targetpath, &p.Linkpath}
+	case *sshFxpReadlinkPacket:
+		names = []*string{&p.Path}
+	case *sshFxpRealpathPacket:
+		names = []*string{&p.Path}
+	case *sshFxpOpendirPacket:
+		names = []*string{&p.Path}
+	case *sshFxpOpenPacket:
+		names = []*string{&p.Path}
+	case *sshFxpSetstatPacket:
+		names = []*string{&p.Path}
+	case *sshFxpExtendedPacketStatVFS:
+		names = []*string{&p.Path}
+	case *sshFxpExtendedPacketPosixRename:
+		names = []*string{&p.Oldpath, &p.Newpath}
+	case *sshFxpExtendedPacketHardlink:
+		names = []*string{&p.Oldpath, &p.Newpath}
+	case *sshFxpExtendedPacketCopyFile:
+		names = []*string{&p.Source, &p.Destination}
+	case *sshFxpExtendedPacketCheckFileName:
+		names = []*string{&p.Path}
+	}
+
+	for _, name := range names {
+		local, err := svr.filenameEncoding.Encode(*name)
+		if err != nil {
+			return &os.PathError{Op: "encode", Path: *name, Err: syscall.EINVAL}
+		}
+		*name = local
+	}
+	return nil
+}
+
+// toWireFilenames translates the filenames of an outgoing name packet
+// from the encoding used on disk into UTF-8.
+// Filenames that cannot be decoded are left unchanged.
+func (svr *Server) toWireFilenames(p *sshFxpNamePacket) {
+	for _, na := range p.NameAttrs {
+		if name, err := svr.filenameEncoding.Decode(na.Name); err == nil {
+			na.Name = name
+		}
+		if longName, err := svr.filenameEncoding.Decode(na.LongName); err == nil {
+			na.LongName = longName
+		}
+	}
+}
+
 // Serve serves SFTP connections until the streams stop or the SFTP subsystem
-// is stopped.
+// is stopped. A malformed packet stops it, returning the error.
 func (svr *Server) Serve() error {
 	defer func() {
 		if svr.pktMgr.alloc != nil {
@@ -337,6 +759,7 @@ func (svr *Server) Serve() error {
 	var pkt requestPacket
 	var pktType uint8
 	var pktBytes []byte
+loop:
 	for {
 		pktType, pktBytes, err = svr.serverConn.recvPacket(svr.pktMgr.getNextOrderID())
 		if err != nil {
@@ -345,6 +768,9 @@ func (svr *Server) Serve() error {
 		}
 
 		pkt, err = makePacket(rxPacket{fxp(pktType), pktBytes})
+		if err == nil {
+			err = svr.conn.decompressRequest(pkt)
+		}
 		if err != nil {
 			switch errors.Cause(err) {
 			case errUnknownExtendedPacket:
@@ -354,9 +780,10 @@ func (svr *Server) Serve() error {
 				//	break
 				//}
 			default:
+				// only this session is aborted, with the error returned
 				debug("makePacket err: %v", err)
 				svr.conn.Close() // shuts down recvPacket
-				break
+				break loop
 			}
 		}
 
@@ -367,11 +794,48 @@ func (svr *Server) Serve() error {
 	wg.Wait()      // wait for all workers to exit
 
 	// close any still-open files
-	for handle, file := range svr.openFiles {
+	for handle, v := range svr.openFiles.removeAll() {
+		file := v.(*serverFile)
 		fmt.Fprintf(svr.debugStream, "sftp server file with handle %q left open: %v\n", handle, file.Name())
-		file.Close()
+		file.close()
+		if file.stagedPath != "" {
+			file.commitStaged(io.ErrUnexpectedEOF)
+		}
+	}
+	return err // error from recvPacket or makePacket
+}
+
+// errPanic is returned to the client for a request whose serving panicked.
+var errPanic = errors.New("panic serving request")
+
+// PanicError is the Err of the RequestEvent of a request whose serving
+// panicked, see WithLogger and WithRSLogger. The panic is recovered from, and
+// the request fails with a SSH_FX_FAILURE.
+type PanicError struct {
+	// Value is the value passed to panic, and Stack the stack trace of the
+	// goroutine which panicked.
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("sftp: panic serving request: %v", e.Value)
+}
+
+// panicStatus is the failure replied to a request whose serving panicked,
+// logged with its PanicError.
+type panicStatus struct {
+	*sshFxpStatusPacket
+	err *PanicError
+}
+
+// recovered returns the reply to pkt, whose serving panicked with v.
+func recovered(pkt requestPacket, v interface{}) responsePacket {
+	debug("panic serving %s %q: %v", packetMethod(pkt), packetPath(pkt), v)
+	return &panicStatus{
+		sshFxpStatusPacket: statusFromError(pkt.id(), errPanic),
+		err:                &PanicError{Value: v, Stack: runtimedebug.Stack()},
 	}
-	return err // error from recvPacket
 }
 
 type ider interface {
@@ -445,38 +909,114 @@ func (p *sshFxpOpenPacket) respond(svr *Server) responsePacket {
 		osFlags |= os.O_EXCL
 	}
 
-	f, err := os.OpenFile(p.Path, osFlags, 0644)
+	if !svr.openFiles.reserve() {
+		return statusFromError(p.ID, svr.openFiles.tooManyHandles())
+	}
+
+	sf := &serverFile{}
+	var f *os.File
+	var err error
+	if svr.stagedUploads {
+		if f, err = svr.openStaged(p.Path, p.Pflags); f != nil {
+			sf.stagedPath = p.Path
+			sf.stagedExcl = p.hasPflags(sshFxfExcl)
+		}
+	}
+	if f == nil && err == nil {
+		flags := osFlags
+		if svr.jail != "" || svr.symlinks == SymlinkDeny {
+			// the links are resolved in the jail already, or not followed
+			flags |= oNoFollow
+		}
+		f, err = os.OpenFile(p.Path, flags, 0644)
+	}
 	if err != nil {
+		svr.openFiles.release()
 		return statusFromError(p.ID, err)
 	}
 
-	handle := svr.nextHandle(f)
+	sf.File = f
+	if osFlags == os.O_RDONLY {
+		sf.mapped = svr.mmapReadOnly(f)
+	}
+	handle := svr.nextFileHandle(sf)
 	return &sshFxpHandlePacket{ID: p.ID, Handle: handle}
 }
 
 func (p *sshFxpReaddirPacket) respond(svr *Server) responsePacket {
-	f, ok := svr.getHandle(p.Handle)
+	f, ok := svr.getServerFile(p.Handle)
 	if !ok {
 		return statusFromError(p.ID, EBADF)
 	}
 
 	dirname := f.Name()
-	dirents, err := f.Readdir(128)
-	if err != nil {
-		return statusFromError(p.ID, err)
+	dirents := f.takePendingDirents()
+	filter := svr.listFilter()
+	for len(dirents) < svr.maxFilelist {
+		more, err := f.Readdir(svr.maxFilelist - len(dirents))
+		if filter != nil {
+			more = filterDirents(filter, dirname, more)
+		}
+		if err != nil && (err != io.EOF || len(dirents)+len(more) == 0) {
+			return statusFromError(p.ID, err)
+		}
+		dirents = append(dirents, more...)
+		// read on if all the entries read are hidden
+		if err != nil || len(dirents) > 0 {
+			break
+		}
 	}
 
 	ret := &sshFxpNamePacket{ID: p.ID}
 	for _, dirent := range dirents {
 		ret.NameAttrs = append(ret.NameAttrs, &sshFxpNameAttr{
 			Name:     dirent.Name(),
-			LongName: runLs(dirname, dirent),
+			LongName: formatLongName(longNameFormatter(svr.longName, svr.names), dirname, dirent),
 			Attrs:    []interface{}{dirent},
 		})
 	}
+
+	if n := fitNameAttrs(ret.NameAttrs); n < len(ret.NameAttrs) {
+		// keep what does not fit for the next readdir request
+		f.putPendingDirents(dirents[n:])
+		ret.NameAttrs = ret.NameAttrs[:n]
+	}
 	return ret
 }
 
+// listFilter returns the filter leaving out of the listings the entries
+// the deny rules hide, or nil if they hide none.
+func (svr *Server) listFilter() ListFilter {
+	filter := svr.denyRules.listFilter(nil, svr.localDenyPath)
+	return svr.policy.state().denyRules.listFilter(filter, svr.localDenyPath)
+}
+
+// filterDirents returns the entries of the directory dir passing filter.
+func filterDirents(filter ListFilter, dir string, dirents []os.FileInfo) []os.FileInfo {
+	n := 0
+	for _, fi := range dirents {
+		if fi, ok := filter(dir, fi); ok {
+			dirents[n] = fi
+			n++
+		}
+	}
+	return dirents[:n]
+}
+
+func (f *serverFile) takePendingDirents() []os.FileInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dirents := f.pendingDirents
+	f.pendingDirents = nil
+	return dirents
+}
+
+func (f *serverFile) putPendingDirents(dirents []os.FileInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pendingDirents = dirents
+}
+
 func (p *sshFxpSetstatPacket) respond(svr *Server) responsePacket {
 	// additional unmarshalling is required for each possibility here
 	b := p.Attrs.([]byte)
@@ -586,6 +1126,16 @@ func statusFromError(id uint32, err error) *sshFxpStatusPacket {
 		return ret
 	}
 
+	if e, ok := err.(*DeferredWriteError); ok {
+		if se, ok := e.Err.(*StatusError); ok {
+			ret.StatusError = *se
+		} else {
+			ret = statusFromError(id, e.Err)
+		}
+		ret.StatusError.msg = fmt.Sprintf("%s%d failed: %s", deferredWritePrefix, e.Offset, ret.StatusError.msg)
+		return ret
+	}
+
 	debug("statusFromError: error is %T %#v", err, err)
 	ret.StatusError.Code = sshFxFailure
 	ret.StatusError.msg = err.Error()
@@ -14,6 +14,7 @@ func (p *sshFxpExtendedPacketStatVFS) respond(svr *Server) responsePacket {
 	if err != nil {
 		return statusFromError(p.ID, err)
 	}
+	retPkt.ID = p.ID
 
 	return retPkt
 }
@@ -8,7 +8,7 @@ import (
 	"time"
 )
 
-func runLs(dirname string, dirent os.FileInfo) string {
+func runLs(names NamesLookup, dirname string, dirent os.FileInfo) string {
 	typeword := runLsTypeWord(dirent)
 	numLinks := 1
 	if dirent.IsDir() {
@@ -20,7 +20,7 @@ func runLs(dirname string, dirent os.FileInfo) string {
 	monthStr := mtime.Month().String()[0:3]
 	day := mtime.Day()
 	year := mtime.Year()
-	now := time.Now()
+	now := pkgClock.Now()
 	isOld := mtime.Before(now.Add(-time.Hour * 24 * 365 / 2))
 
 	yearOrTime := fmt.Sprintf("%02d:%02d", mtime.Hour(), mtime.Minute())
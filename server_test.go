@@ -2,11 +2,15 @@ package sftp
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"regexp"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -15,6 +19,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
@@ -25,14 +30,14 @@ const (
 func TestRunLsWithExamplesDirectory(t *testing.T) {
 	path := "examples"
 	item, _ := os.Stat(path)
-	result := runLs(path, item)
+	result := runLs(nil, path, item)
 	runLsTestHelper(t, result, typeDirectory, path)
 }
 
 func TestRunLsWithLicensesFile(t *testing.T) {
 	path := "LICENSE"
 	item, _ := os.Stat(path)
-	result := runLs(path, item)
+	result := runLs(nil, path, item)
 	runLsTestHelper(t, result, typeFile, path)
 }
 
@@ -162,12 +167,12 @@ func runLsTestHelper(t *testing.T, result, expectedType, path string) {
 	}
 }
 
-func clientServerPair(t *testing.T) (*Client, *Server) {
+func clientServerPair(t *testing.T, options ...ServerOption) (*Client, *Server) {
 	cr, sw := io.Pipe()
 	sr, cw := io.Pipe()
-	var options []ServerOption
 	if *testAllocator {
-		options = append(options, WithAllocator())
+		// the options of the test come after, to set another allocator
+		options = append([]ServerOption{WithAllocator()}, options...)
 	}
 	server, err := NewServer(struct {
 		io.Reader
@@ -242,6 +247,40 @@ func TestInvalidExtendedPacket(t *testing.T) {
 	checkServerAllocator(t, server)
 }
 
+type sshFxpTestPingPacket struct {
+	ID uint32
+}
+
+func (p sshFxpTestPingPacket) id() uint32 { return p.ID }
+
+func (p sshFxpTestPingPacket) MarshalBinary() ([]byte, error) {
+	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
+		4 + len(pingExtension)
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtended)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, pingExtension)
+
+	return b, nil
+}
+
+func TestServerPing(t *testing.T) {
+	client, server := clientServerPair(t, ReadOnly())
+	defer client.Close()
+	defer server.Close()
+
+	_, ok := client.HasExtension(pingExtension)
+	require.True(t, ok, "server doesn't list ping extension")
+
+	id := client.nextID()
+	typ, data, err := client.clientConn.sendPacket(nil, sshFxpTestPingPacket{id})
+	require.NoError(t, err)
+	require.EqualValues(t, sshFxpStatus, typ)
+	assert.NoError(t, normaliseError(unmarshalStatus(id, data)))
+	checkServerAllocator(t, server)
+}
+
 // test that server handles concurrent requests correctly
 func TestConcurrentRequests(t *testing.T) {
 	skipIfWindows(t)
@@ -396,3 +435,323 @@ func TestServerWithBrokenClient(t *testing.T) {
 		srv.Close()
 	}
 }
+
+// readdirPackets reads the whole directory at p, calling respond directly,
+// and returns every NAME packet received.
+func readdirPackets(t *testing.T, svr *Server, p string) []*sshFxpNamePacket {
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	handle := svr.nextHandle(f)
+	defer svr.closeHandle(handle)
+
+	var pkts []*sshFxpNamePacket
+	for id := uint32(1); ; id++ {
+		rpkt := (&sshFxpReaddirPacket{ID: id, Handle: handle}).respond(svr)
+		if spkt, ok := rpkt.(*sshFxpStatusPacket); ok {
+			require.EqualValues(t, sshFxEOF, spkt.StatusError.Code, spkt.StatusError.msg)
+			return pkts
+		}
+		npkt, ok := rpkt.(*sshFxpNamePacket)
+		require.True(t, ok, "unexpected packet %T", rpkt)
+		require.NotEmpty(t, npkt.NameAttrs)
+		pkts = append(pkts, npkt)
+	}
+}
+
+func TestServerReaddirMaxFilelist(t *testing.T) {
+	_, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{}, WithMaxFilelist(0))
+	require.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "sftptest-readdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 10; i++ {
+		f, err := os.Create(path.Join(dir, fmt.Sprintf("file%d", i)))
+		require.NoError(t, err)
+		f.Close()
+	}
+
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{}, WithMaxFilelist(3))
+	require.NoError(t, err)
+
+	pkts := readdirPackets(t, server, dir)
+	assert.Len(t, pkts, 4)
+	count := 0
+	for _, pkt := range pkts {
+		assert.LessOrEqual(t, len(pkt.NameAttrs), 3)
+		count += len(pkt.NameAttrs)
+	}
+	assert.Equal(t, 10, count)
+
+	client, server := clientServerPair(t, WithMaxFilelist(3))
+	defer client.Close()
+	defer server.Close()
+
+	entries, err := client.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 10)
+}
+
+func TestServerReaddirMaxPacketLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-readdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// each entry takes more than 500 bytes, name and long name included
+	const numFiles = 1000
+	for i := 0; i < numFiles; i++ {
+		name := fmt.Sprintf("%04d", i) + strings.Repeat("x", 240)
+		f, err := os.Create(path.Join(dir, name))
+		require.NoError(t, err)
+		f.Close()
+	}
+
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{}, WithMaxFilelist(numFiles))
+	require.NoError(t, err)
+
+	pkts := readdirPackets(t, server, dir)
+	assert.Greater(t, len(pkts), 1)
+	names := make(map[string]bool)
+	for _, pkt := range pkts {
+		b, err := pkt.MarshalBinary()
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(b)-4, maxMsgLength) // without uint32(length)
+		for _, na := range pkt.NameAttrs {
+			assert.False(t, names[na.Name], "duplicate entry %s", na.Name)
+			names[na.Name] = true
+		}
+	}
+	assert.Len(t, names, numFiles)
+
+	// the entries left over are dropped with the handle
+	assert.Zero(t, server.openFiles.len())
+}
+
+// latin1 is the ISO 8859-1 FilenameEncoding.
+type latin1 struct{}
+
+func (latin1) Encode(name string) (string, error) {
+	b := make([]byte, 0, len(name))
+	for _, r := range name {
+		if r > 0xff {
+			return "", errors.Errorf("%q not representable in ISO 8859-1", r)
+		}
+		b = append(b, byte(r))
+	}
+	return string(b), nil
+}
+
+func (latin1) Decode(name string) (string, error) {
+	r := make([]rune, len(name))
+	for i := 0; i < len(name); i++ {
+		r[i] = rune(name[i])
+	}
+	return string(r), nil
+}
+
+func TestServerFilenameEncoding(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+	if runtime.GOOS == "darwin" {
+		t.Skip("filesystem does not allow non UTF-8 filenames")
+	}
+
+	dir, err := ioutil.TempDir("", "sftptest-encoding")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// "café" encoded as ISO 8859-1
+	f, err := os.Create(path.Join(dir, "caf\xe9"))
+	require.NoError(t, err)
+	f.Close()
+
+	client, server := clientServerPair(t, WithFilenameEncoding(latin1{}))
+	defer client.Close()
+	defer server.Close()
+
+	entries, err := client.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "café", entries[0].Name())
+
+	_, err = client.Stat(path.Join(dir, "café"))
+	require.NoError(t, err)
+
+	w, err := client.Create(path.Join(dir, "naïve"))
+	require.NoError(t, err)
+	w.Close()
+	_, err = os.Stat(path.Join(dir, "na\xefve"))
+	require.NoError(t, err)
+
+	// not representable in ISO 8859-1
+	_, err = client.Create(path.Join(dir, "日本"))
+	require.Error(t, err)
+}
+
+func TestServerStatVFSID(t *testing.T) {
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// the response must carry the request ID, as the statuses returned on other platforms do
+	pkt := &sshFxpExtendedPacketStatVFS{ID: 42, Path: os.TempDir()}
+	assert.Equal(t, uint32(42), pkt.respond(server).id())
+}
+
+func TestServerAsyncWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-async")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "file")
+
+	// not negotiated unless the client asks for it
+	client, server := clientServerPair(t, WithAsyncWrites())
+	_, ok := client.HasExtension(asyncWriteExtension)
+	assert.False(t, ok)
+	server.Close()
+	client.Close()
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err = NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, WithAsyncWrites())
+	require.NoError(t, err)
+	go server.Serve()
+	client, err = NewClientPipe(cr, cw, UseAsyncWrites(true))
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	_, ok = client.HasExtension(asyncWriteExtension)
+	assert.True(t, ok)
+
+	f, err := client.Create(p)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	b, err := ioutil.ReadFile(p)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(b))
+
+	// writing to a file opened read-only fails once acknowledged
+	f, err = client.Open(p)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("there"), 6)
+	require.NoError(t, err)
+	err = f.Close()
+	dwe, ok := err.(*DeferredWriteError)
+	require.True(t, ok, "unexpected error: %v", err)
+	assert.EqualValues(t, 6, dwe.Offset)
+}
+
+// panickingEncoding panics decoding filenames.
+type panickingEncoding struct{}
+
+func (panickingEncoding) Encode(name string) (string, error) { return name, nil }
+func (panickingEncoding) Decode(name string) (string, error) { panic("decode is broken") }
+
+func TestServerPanic(t *testing.T) {
+	var logged []RequestEvent
+	logger := LoggerFunc(func(e RequestEvent) { logged = append(logged, e) })
+	client, server := clientServerPair(t, WithFilenameEncoding(panickingEncoding{}), WithLogger(logger))
+	defer client.Close()
+	defer server.Close()
+
+	_, err := client.RealPath(".")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), errPanic.Error())
+	require.NotEmpty(t, logged)
+	perr, ok := logged[len(logged)-1].Err.(*PanicError)
+	require.True(t, ok, "%v", logged[len(logged)-1].Err)
+	assert.Equal(t, "decode is broken", perr.Value)
+	assert.Contains(t, string(perr.Stack), "Decode")
+
+	// the session is still alive
+	_, err = client.Stat(".")
+	require.NoError(t, err)
+}
+
+func TestServerMalformedPacket(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	require.NoError(t, err)
+	defer server.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+	go io.Copy(ioutil.Discard, cr)
+
+	// a server only ever sends SSH_FXP_STATUS
+	b := marshalUint32(nil, 5)
+	b = append(b, sshFxpStatus)
+	b = marshalUint32(b, 1)
+	_, err = cw.Write(b)
+	require.NoError(t, err)
+
+	err = <-served
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unhandled packet type")
+}
+
+// testConnMeta is the metadata of a fake SSH connection.
+type testConnMeta struct {
+	user string
+}
+
+func (m testConnMeta) User() string          { return m.user }
+func (m testConnMeta) SessionID() []byte     { return []byte("session") }
+func (m testConnMeta) ClientVersion() []byte { return []byte("SSH-2.0-client") }
+func (m testConnMeta) ServerVersion() []byte { return []byte("SSH-2.0-server") }
+func (m testConnMeta) RemoteAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222} }
+func (m testConnMeta) LocalAddr() net.Addr   { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 22} }
+
+func TestServerConnConfig(t *testing.T) {
+	config := func(meta ssh.ConnMetadata) ([]ServerOption, error) {
+		switch meta.User() {
+		case "admin":
+			return nil, nil
+		case "guest":
+			return []ServerOption{ReadOnly()}, nil
+		}
+		return nil, errors.Errorf("unknown user %q from %v", meta.User(), meta.RemoteAddr())
+	}
+
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{nil, nil}, WithConnConfig(testConnMeta{"admin"}, config))
+	require.NoError(t, err)
+	assert.False(t, server.readOnly)
+
+	server, err = NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{nil, nil}, WithConnConfig(testConnMeta{"guest"}, config))
+	require.NoError(t, err)
+	assert.True(t, server.readOnly)
+
+	_, err = NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{nil, nil}, WithConnConfig(testConnMeta{"mallory"}, config))
+	assert.EqualError(t, err, `unknown user "mallory" from 192.0.2.1:2222`)
+}
@@ -11,7 +11,7 @@ import (
 	"time"
 )
 
-func runLsStatt(dirent os.FileInfo, statt *syscall.Stat_t) string {
+func runLsStatt(names NamesLookup, dirent os.FileInfo, statt *syscall.Stat_t) string {
 	// example from openssh sftp server:
 	// crw-rw-rw-    1 root     wheel           0 Jul 31 20:52 ttyvd
 	// format:
@@ -23,13 +23,20 @@ func runLsStatt(dirent os.FileInfo, statt *syscall.Stat_t) string {
 	gid := statt.Gid
 	username := fmt.Sprintf("%d", uid)
 	groupname := fmt.Sprintf("%d", gid)
-	// TODO FIXME: uid -> username, gid -> groupname lookup for ls -l format output
+	if names != nil {
+		if name := names.LookupUserName(uid); name != "" {
+			username = name
+		}
+		if name := names.LookupGroupName(gid); name != "" {
+			groupname = name
+		}
+	}
 
 	mtime := dirent.ModTime()
 	monthStr := mtime.Month().String()[0:3]
 	day := mtime.Day()
 	year := mtime.Year()
-	now := time.Now()
+	now := pkgClock.Now()
 	isOld := mtime.Before(now.Add(-time.Hour * 24 * 365 / 2))
 
 	yearOrTime := fmt.Sprintf("%02d:%02d", mtime.Hour(), mtime.Minute())
@@ -42,12 +49,13 @@ func runLsStatt(dirent os.FileInfo, statt *syscall.Stat_t) string {
 
 // ls -l style output for a file, which is in the 'long output' section of a readdir response packet
 // this is a very simple (lazy) implementation, just enough to look almost like openssh in a few basic cases
-func runLs(dirname string, dirent os.FileInfo) string {
+// with the names of the owner and group looked up by names, if not nil
+func runLs(names NamesLookup, dirname string, dirent os.FileInfo) string {
 	dsys := dirent.Sys()
 	if dsys == nil {
 	} else if statt, ok := dsys.(*syscall.Stat_t); !ok {
 	} else {
-		return runLsStatt(dirent, statt)
+		return runLsStatt(names, dirent, statt)
 	}
 
 	return path.Join(dirname, dirent.Name())
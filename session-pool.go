@@ -0,0 +1,89 @@
+package sftp
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Pool is a set of Clients, over one or more SSH connections, to spread a
+// heavy parallel workload over several SFTP sessions rather than queue it
+// behind the limit of outstanding requests of a single one. Each operation
+// goes to the Client returned by Client, and the transfers striped over
+// several sessions, such as by StripedDownload, to the Clients.
+// A Pool is safe for concurrent use.
+type Pool struct {
+	clients []*Client
+	next    uint32 // the first Client considered by Client, set atomically
+}
+
+// NewPool opens n SFTP sessions over the SSH connections conns, spread
+// over them in turn, as NewClient does with opts.
+func NewPool(conns []*ssh.Client, n int, opts ...ClientOption) (*Pool, error) {
+	if len(conns) == 0 || n < 1 {
+		return nil, errors.New("sftp: a pool needs a connection and a session")
+	}
+
+	clients := make([]*Client, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := NewClient(conns[i%len(conns)], opts...)
+		if err != nil {
+			for _, c := range clients {
+				c.teardown()
+			}
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return NewPoolWithClients(clients...), nil
+}
+
+// NewPoolWithClients returns a Pool of the Clients clients, which it closes
+// on Close.
+func NewPoolWithClients(clients ...*Client) *Pool {
+	return &Pool{clients: clients}
+}
+
+// Client returns the Client of the pool with the fewest outstanding
+// requests, the others taking turns when tied, for the next operation.
+// The Clients whose connection is lost are only returned when all are.
+func (p *Pool) Client() *Client {
+	if len(p.clients) == 0 {
+		return nil
+	}
+
+	start := int(atomic.AddUint32(&p.next, 1) % uint32(len(p.clients)))
+	var best *Client
+	least := -1
+	for i := range p.clients {
+		c := p.clients[(start+i)%len(p.clients)]
+		if c.clientConn.lost() {
+			continue
+		}
+		if n := c.clientConn.outstanding(); least < 0 || n < least {
+			best, least = c, n
+		}
+	}
+	if best == nil {
+		return p.clients[start]
+	}
+	return best
+}
+
+// Clients returns the Clients of the pool.
+func (p *Pool) Clients() []*Client {
+	return append([]*Client(nil), p.clients...)
+}
+
+// Close closes the Clients of the pool, as Client.Close does, and returns
+// the first error.
+func (p *Pool) Close() error {
+	var first error
+	for _, c := range p.clients {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,57 @@
+package sftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-pool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c1, s1 := clientServerPair(t)
+	c2, s2 := clientServerPair(t)
+	clients := []*Client{c1, c2}
+	pool := NewPoolWithClients(clients...)
+	assert.Equal(t, clients, pool.Clients())
+
+	// the least busy Client is chosen
+	id := clients[0].nextID()
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, clients[1], pool.Client())
+	}
+	clients[0].clientConn.release(id)
+
+	// the others take turns
+	seen := map[*Client]bool{}
+	for i := 0; i < 4; i++ {
+		seen[pool.Client()] = true
+	}
+	assert.Len(t, seen, 2)
+
+	data := []byte("hello world")
+	remote := path.Join(dir, "remote")
+	require.NoError(t, StripedUpload(pool.Clients(), bytes.NewReader(data), int64(len(data)), remote, 4))
+	b, err := getTestFile(pool.Client(), remote)
+	require.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	// as long as their connection is not lost
+	require.NoError(t, s2.Close())
+	require.Eventually(t, c2.clientConn.lost, time.Second, time.Millisecond)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, c1, pool.Client())
+	}
+
+	s1.Close()
+	pool.Close()
+	assert.True(t, c1.clientConn.lost())
+}
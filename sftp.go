@@ -29,6 +29,9 @@ const (
 	sshFxpRename        = 18
 	sshFxpReadlink      = 19
 	sshFxpSymlink       = 20
+	sshFxpLink          = 21 // protocol version 6
+	sshFxpBlock         = 22 // protocol version 6
+	sshFxpUnblock       = 23 // protocol version 6
 	sshFxpStatus        = 101
 	sshFxpHandle        = 102
 	sshFxpData          = 103
@@ -88,9 +91,12 @@ const (
 var (
 	// supportedSFTPExtensions defines the supported extensions
 	supportedSFTPExtensions = []sshExtensionPair{
-		{"hardlink@openssh.com", "1"},
+		{hardlinkExtension, "1"},
 		{"posix-rename@openssh.com", "1"},
 		{"statvfs@openssh.com", "2"},
+		{fsyncExtension, "1"},
+		{copyDataExtension, "1"},
+		{copyFileExtension, "1"},
 	}
 	sftpExtensions = supportedSFTPExtensions
 )
@@ -139,6 +145,12 @@ func (f fxp) String() string {
 		return "SSH_FXP_READLINK"
 	case sshFxpSymlink:
 		return "SSH_FXP_SYMLINK"
+	case sshFxpLink:
+		return "SSH_FXP_LINK"
+	case sshFxpBlock:
+		return "SSH_FXP_BLOCK"
+	case sshFxpUnblock:
+		return "SSH_FXP_UNBLOCK"
 	case sshFxpStatus:
 		return "SSH_FXP_STATUS"
 	case sshFxpHandle:
@@ -0,0 +1,144 @@
+package sftpfs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/sftp"
+)
+
+// file is an open remote file.
+//
+// Reads smaller than the read-ahead size fetch a whole read-ahead window,
+// the following reads in that window being served from memory.
+// Any write or truncation drops the window.
+type file struct {
+	f         *sftp.File
+	readAhead int
+
+	mu     sync.Mutex
+	buf    []byte // data of the read-ahead window
+	bufOff int64  // offset of buf in the file
+	bufEOF bool   // the window ends at the end of the file
+}
+
+var (
+	_ fs.FileReader    = (*file)(nil)
+	_ fs.FileWriter    = (*file)(nil)
+	_ fs.FileGetattrer = (*file)(nil)
+	_ fs.FileFsyncer   = (*file)(nil)
+	_ fs.FileFlusher   = (*file)(nil)
+	_ fs.FileReleaser  = (*file)(nil)
+)
+
+func (fsys *filesystem) newFile(f *sftp.File) *file {
+	return &file{
+		f:         f,
+		readAhead: fsys.readAhead,
+	}
+}
+
+func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.readAhead <= len(dest) {
+		n, err := f.f.ReadAt(dest, off)
+		if err != nil && err != io.EOF {
+			return nil, toErrno(err)
+		}
+		return fuse.ReadResultData(dest[:n]), fs.OK
+	}
+
+	if !f.inWindow(off, len(dest)) {
+		if f.buf == nil {
+			f.buf = make([]byte, f.readAhead)
+		}
+		n, err := f.f.ReadAt(f.buf[:cap(f.buf)], off)
+		if err != nil && err != io.EOF {
+			f.buf = f.buf[:0]
+			return nil, toErrno(err)
+		}
+		f.buf = f.buf[:n]
+		f.bufOff = off
+		f.bufEOF = err == io.EOF || n < cap(f.buf)
+	}
+
+	start := off - f.bufOff
+	if start > int64(len(f.buf)) {
+		start = int64(len(f.buf))
+	}
+	end := start + int64(len(dest))
+	if end > int64(len(f.buf)) {
+		end = int64(len(f.buf))
+	}
+	n := copy(dest, f.buf[start:end])
+	return fuse.ReadResultData(dest[:n]), fs.OK
+}
+
+// inWindow returns true if the read of n bytes at off can be served from the
+// read-ahead window. f.mu must be held.
+func (f *file) inWindow(off int64, n int) bool {
+	if off < f.bufOff || f.buf == nil {
+		return false
+	}
+	end := off + int64(n)
+	return end <= f.bufOff+int64(len(f.buf)) || (f.bufEOF && off <= f.bufOff+int64(len(f.buf)))
+}
+
+// dropWindow drops the read-ahead window. f.mu must be held.
+func (f *file) dropWindow() {
+	f.buf = f.buf[:0]
+	f.bufOff = 0
+	f.bufEOF = false
+}
+
+func (f *file) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dropWindow()
+	n, err := f.f.WriteAt(data, off)
+	if err != nil {
+		return uint32(n), toErrno(err)
+	}
+	return uint32(n), fs.OK
+}
+
+func (f *file) truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dropWindow()
+	return f.f.Truncate(size)
+}
+
+func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	fi, err := f.f.Stat()
+	if err != nil {
+		return toErrno(err)
+	}
+	fillAttr(fi, &out.Attr)
+	return fs.OK
+}
+
+func (f *file) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	errno := toErrno(f.f.Sync())
+	if errno == syscall.ENOTSUP {
+		// fsync@openssh.com not supported, the server writes on its own schedule
+		return fs.OK
+	}
+	return errno
+}
+
+func (f *file) Flush(ctx context.Context) syscall.Errno {
+	return fs.OK
+}
+
+func (f *file) Release(ctx context.Context) syscall.Errno {
+	return toErrno(f.f.Close())
+}
@@ -0,0 +1,326 @@
+// Package sftpfs serves a remote directory as a FUSE filesystem over a sftp.Client,
+// so that remote trees can be mounted by Go applications without sshfs.
+//
+// It lives in its own module, so that the sftp package does not depend on a FUSE library.
+package sftpfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/sftp"
+)
+
+// DefaultReadAhead is the default number of bytes read at once from the
+// server when a file is read sequentially.
+const DefaultReadAhead = 1 << 20
+
+// Options configures a filesystem.
+type Options struct {
+	// ReadAhead is the number of bytes read at once from the server,
+	// the following reads being served from memory.
+	// Defaults to DefaultReadAhead, and is disabled if negative.
+	ReadAhead int
+
+	// FUSE contains the options of the FUSE mount, if not nil.
+	FUSE *fs.Options
+}
+
+type filesystem struct {
+	client    *sftp.Client
+	dir       string
+	readAhead int
+}
+
+// node is an inode of the filesystem, a remote file, directory or symlink.
+type node struct {
+	fs.Inode
+	fsys *filesystem
+}
+
+var (
+	_ fs.NodeLookuper   = (*node)(nil)
+	_ fs.NodeReaddirer  = (*node)(nil)
+	_ fs.NodeGetattrer  = (*node)(nil)
+	_ fs.NodeSetattrer  = (*node)(nil)
+	_ fs.NodeOpener     = (*node)(nil)
+	_ fs.NodeCreater    = (*node)(nil)
+	_ fs.NodeMkdirer    = (*node)(nil)
+	_ fs.NodeUnlinker   = (*node)(nil)
+	_ fs.NodeRmdirer    = (*node)(nil)
+	_ fs.NodeRenamer    = (*node)(nil)
+	_ fs.NodeSymlinker  = (*node)(nil)
+	_ fs.NodeReadlinker = (*node)(nil)
+)
+
+// NewRoot returns the root node of a filesystem serving dir through client,
+// to be mounted with fs.Mount. opts may be nil.
+func NewRoot(client *sftp.Client, dir string, opts *Options) fs.InodeEmbedder {
+	fsys := &filesystem{
+		client:    client,
+		dir:       dir,
+		readAhead: DefaultReadAhead,
+	}
+	if opts != nil && opts.ReadAhead != 0 {
+		fsys.readAhead = opts.ReadAhead
+	}
+	return &node{fsys: fsys}
+}
+
+// Mount mounts dir of client at mountpoint, and serves it until the returned
+// server is unmounted. opts may be nil.
+func Mount(client *sftp.Client, dir, mountpoint string, opts *Options) (*fuse.Server, error) {
+	var fopts *fs.Options
+	if opts != nil {
+		fopts = opts.FUSE
+	}
+	return fs.Mount(mountpoint, NewRoot(client, dir, opts), fopts)
+}
+
+func (n *node) remotePath() string {
+	return path.Join(n.fsys.dir, n.Path(nil))
+}
+
+func (n *node) childPath(name string) string {
+	return path.Join(n.remotePath(), name)
+}
+
+// newChild returns the inode of the remote file at p described by fi.
+func (n *node) newChild(ctx context.Context, fi os.FileInfo, out *fuse.EntryOut) *fs.Inode {
+	fillAttr(fi, &out.Attr)
+	child := &node{fsys: n.fsys}
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: out.Attr.Mode & syscall.S_IFMT})
+}
+
+func (n *node) lookupChild(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fi, err := n.fsys.client.Lstat(n.childPath(name))
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, fi, out), fs.OK
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return n.lookupChild(ctx, name, out)
+}
+
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	fis, err := n.fsys.client.ReadDir(n.remotePath())
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	entries := make([]fuse.DirEntry, 0, len(fis))
+	for _, fi := range fis {
+		var attr fuse.Attr
+		fillAttr(fi, &attr)
+		entries = append(entries, fuse.DirEntry{Name: fi.Name(), Mode: attr.Mode})
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (n *node) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f, ok := fh.(*file); ok {
+		return f.Getattr(ctx, out)
+	}
+	fi, err := n.fsys.client.Lstat(n.remotePath())
+	if err != nil {
+		return toErrno(err)
+	}
+	fillAttr(fi, &out.Attr)
+	return fs.OK
+}
+
+func (n *node) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	c, p := n.fsys.client, n.remotePath()
+
+	if size, ok := in.GetSize(); ok {
+		var err error
+		if f, ok := fh.(*file); ok {
+			err = f.truncate(int64(size))
+		} else {
+			err = c.Truncate(p, int64(size))
+		}
+		if err != nil {
+			return toErrno(err)
+		}
+	}
+	if mode, ok := in.GetMode(); ok {
+		if err := c.Chmod(p, os.FileMode(mode&07777)); err != nil {
+			return toErrno(err)
+		}
+	}
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		fi, err := c.Lstat(p)
+		if err != nil {
+			return toErrno(err)
+		}
+		st := fi.Sys().(*sftp.FileStat)
+		if !uok {
+			uid = st.UID
+		}
+		if !gok {
+			gid = st.GID
+		}
+		if err := c.Chown(p, int(uid), int(gid)); err != nil {
+			return toErrno(err)
+		}
+	}
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		now := time.Now()
+		if !mok {
+			mtime = now
+		}
+		if !aok {
+			atime = now
+		}
+		if err := c.Chtimes(p, atime, mtime); err != nil {
+			return toErrno(err)
+		}
+	}
+
+	return n.Getattr(ctx, fh, out)
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	f, err := n.fsys.client.OpenFile(n.remotePath(), openFlags(flags))
+	if err != nil {
+		return nil, 0, toErrno(err)
+	}
+	return n.fsys.newFile(f), 0, fs.OK
+}
+
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	p := n.childPath(name)
+	f, err := n.fsys.client.OpenFile(p, openFlags(flags)|os.O_CREATE)
+	if err != nil {
+		return nil, nil, 0, toErrno(err)
+	}
+	if err := f.Chmod(os.FileMode(mode & 07777)); err != nil {
+		f.Close()
+		return nil, nil, 0, toErrno(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, toErrno(err)
+	}
+	return n.newChild(ctx, fi, out), n.fsys.newFile(f), 0, fs.OK
+}
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p := n.childPath(name)
+	if err := n.fsys.client.Mkdir(p); err != nil {
+		return nil, toErrno(err)
+	}
+	if err := n.fsys.client.Chmod(p, os.FileMode(mode&07777)); err != nil {
+		return nil, toErrno(err)
+	}
+	return n.lookupChild(ctx, name, out)
+}
+
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	return toErrno(n.fsys.client.Remove(n.childPath(name)))
+}
+
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return toErrno(n.fsys.client.RemoveDirectory(n.childPath(name)))
+}
+
+func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		// RENAME_EXCHANGE and RENAME_NOREPLACE
+		return syscall.ENOTSUP
+	}
+	parent, ok := newParent.(*node)
+	if !ok {
+		return syscall.EXDEV
+	}
+
+	c := n.fsys.client
+	oldpath, newpath := n.childPath(name), parent.childPath(newName)
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		// replaces the target as rename(2) does
+		return toErrno(c.PosixRename(oldpath, newpath))
+	}
+	return toErrno(c.Rename(oldpath, newpath))
+}
+
+func (n *node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if err := n.fsys.client.Symlink(target, n.childPath(name)); err != nil {
+		return nil, toErrno(err)
+	}
+	return n.lookupChild(ctx, name, out)
+}
+
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := n.fsys.client.ReadLink(n.remotePath())
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return []byte(target), fs.OK
+}
+
+// openFlags returns the flags of os.OpenFile matching the FUSE open flags.
+func openFlags(flags uint32) int {
+	const mask = syscall.O_ACCMODE | syscall.O_APPEND | syscall.O_TRUNC | syscall.O_CREAT | syscall.O_EXCL
+	return int(flags) & mask
+}
+
+func fillAttr(fi os.FileInfo, attr *fuse.Attr) {
+	attr.Size = uint64(fi.Size())
+	attr.Blocks = (attr.Size + 511) / 512
+	attr.Blksize = 4096
+	attr.Mtime = uint64(fi.ModTime().Unix())
+	attr.Ctime = attr.Mtime
+	attr.Atime = attr.Mtime
+	attr.Nlink = 1
+
+	st, ok := fi.Sys().(*sftp.FileStat)
+	if !ok {
+		attr.Mode = uint32(fi.Mode().Perm()) | syscall.S_IFREG
+		if fi.IsDir() {
+			attr.Mode = uint32(fi.Mode().Perm()) | syscall.S_IFDIR
+		}
+		return
+	}
+	attr.Mode = st.Mode
+	attr.Atime = uint64(st.Atime)
+	attr.Uid = st.UID
+	attr.Gid = st.GID
+}
+
+// toErrno converts the errors of the sftp client into errno values.
+func toErrno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return fs.OK
+	case os.IsNotExist(err):
+		return syscall.ENOENT
+	case os.IsPermission(err):
+		return syscall.EACCES
+	case os.IsExist(err):
+		return syscall.EEXIST
+	}
+
+	if status, ok := err.(*sftp.StatusError); ok {
+		switch status.FxCode() {
+		case sftp.ErrSSHFxOpUnsupported:
+			return syscall.ENOTSUP
+		case sftp.ErrSSHFxNoConnection, sftp.ErrSSHFxConnectionLost:
+			return syscall.ENOTCONN
+		}
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,158 @@
+package sftpfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve serves a temporary directory through an in-process server,
+// and returns a client of that server along with the directory.
+func serve(t *testing.T) (*sftp.Client, string) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	require.NoError(t, err)
+	go server.Serve()
+	client, err := sftp.NewClientPipe(cr, cw)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "sftpfs-remote")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+		os.RemoveAll(dir)
+	})
+	return client, dir
+}
+
+// mount serves a temporary directory through an in-process server,
+// and mounts it. It returns the served directory and the mountpoint.
+// The test is skipped if FUSE filesystems cannot be mounted.
+func mount(t *testing.T, opts *Options) (string, string) {
+	client, dir := serve(t)
+	mnt, err := ioutil.TempDir("", "sftpfs-mnt")
+	require.NoError(t, err)
+
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.FUSE = &fs.Options{
+		MountOptions: fuse.MountOptions{DirectMount: true},
+	}
+	fsrv, err := Mount(client, dir, mnt, opts)
+	if err != nil {
+		os.RemoveAll(mnt)
+		t.Skip("cannot mount FUSE filesystems:", err)
+	}
+
+	t.Cleanup(func() {
+		fsrv.Unmount()
+		os.RemoveAll(mnt)
+	})
+	return dir, mnt
+}
+
+func TestFilesystem(t *testing.T) {
+	dir, mnt := mount(t, nil)
+
+	require.NoError(t, os.Mkdir(filepath.Join(mnt, "sub"), 0750))
+	fi, err := os.Stat(filepath.Join(dir, "sub"))
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+
+	data := bytes.Repeat([]byte("sftpfs"), 1000)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mnt, "sub", "file"), data, 0640))
+	got, err := ioutil.ReadFile(filepath.Join(dir, "sub", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	got, err = ioutil.ReadFile(filepath.Join(mnt, "sub", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	require.NoError(t, os.Rename(filepath.Join(mnt, "sub", "file"), filepath.Join(mnt, "renamed")))
+	_, err = os.Stat(filepath.Join(dir, "sub", "file"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "renamed"))
+	assert.NoError(t, err)
+
+	require.NoError(t, os.Symlink("renamed", filepath.Join(mnt, "link")))
+	target, err := os.Readlink(filepath.Join(mnt, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", target)
+
+	f, err := os.Open(filepath.Join(mnt, "."))
+	require.NoError(t, err)
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"sub", "renamed", "link"}, names)
+
+	require.NoError(t, os.Remove(filepath.Join(mnt, "renamed")))
+	require.NoError(t, os.Remove(filepath.Join(mnt, "sub")))
+	_, err = os.Stat(filepath.Join(mnt, "sub"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileReadAhead(t *testing.T) {
+	client, dir := serve(t)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), data, 0600))
+
+	sf, err := client.OpenFile(filepath.Join(dir, "file"), os.O_RDWR)
+	require.NoError(t, err)
+	fsys := &filesystem{client: client, dir: dir, readAhead: 4096}
+	f := fsys.newFile(sf)
+	defer f.Release(context.Background())
+
+	read := func(n int, off int64) []byte {
+		res, errno := f.Read(context.Background(), make([]byte, n), off)
+		require.Equal(t, fs.OK, errno)
+		b, status := res.Bytes(nil)
+		require.Equal(t, fuse.OK, status)
+		return b
+	}
+
+	assert.Equal(t, data[1000:1100], read(100, 1000))
+	assert.Equal(t, int64(1000), f.bufOff)
+	assert.Len(t, f.buf, 4096)
+
+	// served from the window, which is not moved
+	assert.Equal(t, data[2000:2100], read(100, 2000))
+	assert.Equal(t, int64(1000), f.bufOff)
+
+	// a write drops the window
+	_, errno := f.Write(context.Background(), []byte("overwritten"), 2100)
+	require.Equal(t, fs.OK, errno)
+	assert.Empty(t, f.buf)
+	assert.Equal(t, []byte("overwritten"), read(11, 2100))
+
+	// the window is cut at the end of the file
+	assert.Equal(t, data[9950:], read(100, 9950))
+	assert.True(t, f.bufEOF)
+	assert.Empty(t, read(100, 10000))
+
+	// reads larger than the window bypass it
+	assert.Equal(t, data[5000:], read(8192, 5000)[:5000])
+}
@@ -0,0 +1,11 @@
+module github.com/pkg/sftp/sftpfs
+
+go 1.15
+
+require (
+	github.com/hanwen/go-fuse/v2 v2.1.0
+	github.com/pkg/sftp v1.13.0
+	github.com/stretchr/testify v1.7.0
+)
+
+replace github.com/pkg/sftp => ../
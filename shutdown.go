@@ -0,0 +1,138 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// errShuttingDown fails the requests refused by RequestServer.Shutdown.
+var errShuttingDown = errors.New("server shutting down")
+
+// ShutdownStats are the statistics of a RequestServer.Shutdown.
+type ShutdownStats struct {
+	// the handles closed by the client while draining, and those left open
+	// closed by Shutdown once ctx is done
+	Completed, Interrupted int
+	// the requests refused while draining
+	Refused int
+	// the file data read and written through the handles closed
+	BytesRead, BytesWritten int64
+}
+
+// requestServerDrain tracks the shutdown of a RequestServer.
+type requestServerDrain struct {
+	closed chan struct{} // signaled as handles are closed
+
+	mu           sync.Mutex
+	stats        ShutdownStats
+	interrupting bool
+}
+
+// Shutdown shuts the RequestServer down gracefully: the new requests are
+// refused, with a failure, but for the reads, writes, readdir, fstat,
+// fsetstat and close of the handles open, so that their transfers go on,
+// until the client closes them all or ctx is done. The handles left open are
+// then closed, as by CloseHandle, and the session is closed, as by Close,
+// which Serve returns from. The replies to the requests served are sent
+// before, so Shutdown is not to be called from the Handlers.
+//
+// It returns the statistics of the shutdown, along with ctx.Err() if the
+// handles had to be closed or the replies were not sent, or the error of
+// closing the session.
+func (rs *RequestServer) Shutdown(ctx context.Context) (ShutdownStats, error) {
+	d := &requestServerDrain{closed: make(chan struct{}, 1)}
+	rs.drainMu.Lock()
+	if rs.drain != nil {
+		rs.drainMu.Unlock()
+		return ShutdownStats{}, errShuttingDown
+	}
+	rs.drain = d
+	atomic.StoreInt32(&rs.shuttingDown, 1)
+	rs.drainMu.Unlock()
+
+	var err error
+	for err == nil && rs.openRequests.len() > 0 {
+		select {
+		case <-d.closed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err == nil {
+		// the replies to the closes are sent before the session is closed
+		select {
+		case <-rs.pktMgr.flushed():
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	d.mu.Lock()
+	d.interrupting = true
+	d.mu.Unlock()
+	var handles []string
+	rs.openRequests.each(func(handle string, _ interface{}) {
+		handles = append(handles, handle)
+	})
+	for _, handle := range handles {
+		rs.closeRequest(handle)
+	}
+
+	if cerr := rs.Close(); err == nil {
+		err = cerr
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats, err
+}
+
+// refuses reports whether pkt is refused by a Shutdown, counting it.
+func (rs *RequestServer) refuses(pkt requestPacket) bool {
+	if atomic.LoadInt32(&rs.shuttingDown) == 0 {
+		return false
+	}
+	if _, ok := pkt.(hasHandle); ok {
+		return false
+	}
+
+	d := rs.shutdownDrain()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stats.Refused++
+	return true
+}
+
+// shutdownDrain returns the drain of the Shutdown of rs, or nil.
+func (rs *RequestServer) shutdownDrain() *requestServerDrain {
+	rs.drainMu.Lock()
+	defer rs.drainMu.Unlock()
+	return rs.drain
+}
+
+// closedDuringShutdown counts the handle of r closed, if rs is shutting down.
+func (rs *RequestServer) closedDuringShutdown(r *Request) {
+	if atomic.LoadInt32(&rs.shuttingDown) == 0 {
+		return
+	}
+
+	d := rs.shutdownDrain()
+	d.mu.Lock()
+	if d.interrupting {
+		d.stats.Interrupted++
+	} else {
+		d.stats.Completed++
+	}
+	if s := r.stats; s != nil {
+		d.stats.BytesRead += atomic.LoadInt64(&s.read)
+		d.stats.BytesWritten += atomic.LoadInt64(&s.written)
+	}
+	d.mu.Unlock()
+
+	select {
+	case d.closed <- struct{}{}:
+	default:
+	}
+}
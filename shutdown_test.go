@@ -0,0 +1,89 @@
+package sftp
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startShutdown calls server.Shutdown in the background, once refusing.
+func startShutdown(ctx context.Context, t *testing.T, server *RequestServer) <-chan ShutdownStats {
+	done := make(chan ShutdownStats, 1)
+	go func() {
+		stats, err := server.Shutdown(ctx)
+		if ctx.Err() == nil {
+			assert.NoError(t, err)
+		} else {
+			assert.Equal(t, ctx.Err(), err)
+		}
+		done <- stats
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&server.shuttingDown) != 0
+	}, time.Second, time.Millisecond)
+	return done
+}
+
+func TestRequestServerShutdown(t *testing.T) {
+	client, server := handlersClientPair(t, InMemHandler(), nil)
+
+	w, err := client.Create("/upload")
+	require.NoError(t, err)
+	_, err = w.Write(make([]byte, 100))
+	require.NoError(t, err)
+
+	done := startShutdown(context.Background(), t, server)
+
+	// the transfer goes on, the new requests are refused
+	_, err = w.Write(make([]byte, 50))
+	require.NoError(t, err)
+	_, err = client.Open("/upload")
+	assert.EqualError(t, err, "sftp: \"server shutting down\" (SSH_FX_FAILURE)")
+	_, err = client.Stat("/upload")
+	assert.Error(t, err)
+	_, err = server.Shutdown(context.Background())
+	assert.Equal(t, errShuttingDown, err)
+
+	select {
+	case <-done:
+		t.Fatal("shut down with a handle open")
+	default:
+	}
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, ShutdownStats{
+		Completed:    1,
+		Refused:      2,
+		BytesWritten: 150,
+	}, <-done)
+	_, err = client.Getwd()
+	assert.Error(t, err)
+}
+
+func TestRequestServerShutdownInterrupted(t *testing.T) {
+	client, server := handlersClientPair(t, InMemHandler(), nil)
+
+	_, err := putTestFile(client, "/download", "some data")
+	require.NoError(t, err)
+	r, err := client.Open("/download")
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = r.Read(make([]byte, 4))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := startShutdown(ctx, t, server)
+
+	assert.Equal(t, ShutdownStats{
+		Interrupted: 1,
+		BytesRead:   4,
+	}, <-done)
+	assert.Zero(t, server.openRequests.len())
+	_, err = r.Read(make([]byte, 4))
+	assert.Error(t, err)
+}
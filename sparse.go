@@ -0,0 +1,165 @@
+package sftp
+
+import "io"
+
+// sparseBlockSize is the size of the blocks of zeros the sparse transfers
+// skip, that of the blocks of most file systems, the blocks being aligned
+// on their offset in the file.
+const sparseBlockSize = 4096
+
+// PreserveSparse makes Upload, Download, ResumeUpload and ResumeDownload
+// skip the blocks of zeros of the files transferred, like File.SetSparse,
+// so that the holes of sparse files such as disk images stay holes on the
+// destination side, and are not sent.
+func PreserveSparse() TransferOption {
+	return func(o *transferOptions) {
+		o.sparse = true
+	}
+}
+
+// SetSparse makes the next transfers of ReadFrom and WriteTo of the File
+// skip the blocks of zeros of the data transferred, leaving holes in their
+// place: ReadFrom does not send them, and WriteTo seeks over them in the
+// Writer, when it is an io.Seeker, such as an *os.File. The size of the
+// destination is still that of the data. The blocks skipped must read as
+// zeros once transferred, as those past the end of the destination do, such
+// as for a file created or truncated to be written.
+func (f *File) SetSparse(sparse bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sparse = sparse
+}
+
+// isZeros returns whether b has only zeros.
+func isZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sparseBlocks calls fn with each run of the blocks of b, at off, which are
+// all zeros or not, until fn returns an error.
+func sparseBlocks(b []byte, off int64, fn func(run []byte, off int64, zeros bool) error) error {
+	start, zeros := 0, false
+	for i := 0; i < len(b); {
+		end := i + sparseBlockSize - int((off+int64(i))%sparseBlockSize)
+		if end > len(b) {
+			end = len(b)
+		}
+		z := isZeros(b[i:end])
+		if i > start && z != zeros {
+			if err := fn(b[start:i], off+int64(start), zeros); err != nil {
+				return err
+			}
+			start = i
+		}
+		zeros = z
+		i = end
+	}
+	if start < len(b) {
+		return fn(b[start:], off+int64(start), zeros)
+	}
+	return nil
+}
+
+// writeSparseAt writes b at off like WriteAt, but for its blocks of zeros.
+func (f *File) writeSparseAt(b []byte, off int64) (int, error) {
+	written := 0
+	err := sparseBlocks(b, off, func(run []byte, runOff int64, zeros bool) error {
+		if zeros {
+			written += len(run)
+			return nil
+		}
+		n, err := f.WriteAt(run, runOff)
+		written += n
+		return err
+	})
+	return written, err
+}
+
+// extendSparse writes the last byte of the data ending at end, a zero, in
+// case it was skipped, for the file to be of the size of the data.
+func (f *File) extendSparse(end int64) error {
+	_, err := f.writeChunkAt(nil, []byte{0}, end-1)
+	return err
+}
+
+// readFromSparse implements ReadFrom with SetSparse. f.mu is held.
+func (f *File) readFromSparse(r io.Reader, p *progress) (read int64, err error) {
+	b := make([]byte, f.c.maxPacket*f.maxConcurrentRequests())
+
+	lastZero := false
+	for {
+		n, err := io.ReadFull(r, b)
+		if n > 0 {
+			read += int64(n)
+			lastZero = b[n-1] == 0
+
+			m, err2 := f.writeSparseAt(b[:n], f.offset)
+			f.offset += int64(m)
+			p.add(m)
+
+			if err2 != nil {
+				return read, err2
+			}
+		}
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			if lastZero {
+				return read, f.extendSparse(f.offset)
+			}
+			return read, nil
+		default:
+			return read, err
+		}
+	}
+}
+
+// sparseWriter seeks over the blocks of zeros written to it, which are to
+// be at off of the file.
+type sparseWriter struct {
+	w    io.WriteSeeker
+	off  int64
+	hole int64 // the zeros skipped since the data last written
+}
+
+func (w *sparseWriter) Write(b []byte) (int, error) {
+	written := 0
+	err := sparseBlocks(b, w.off, func(run []byte, _ int64, zeros bool) error {
+		if zeros {
+			w.hole += int64(len(run))
+			written += len(run)
+			return nil
+		}
+		if w.hole > 0 {
+			if _, err := w.w.Seek(w.hole, io.SeekCurrent); err != nil {
+				return err
+			}
+			w.hole = 0
+		}
+		n, err := w.w.Write(run)
+		written += n
+		return err
+	})
+	w.off += int64(written)
+	return written, err
+}
+
+// finish writes the last of the zeros skipped, for the file to be of the
+// size of the data.
+func (w *sparseWriter) finish() error {
+	if w.hole == 0 {
+		return nil
+	}
+	if _, err := w.w.Seek(w.hole-1, io.SeekCurrent); err != nil {
+		return err
+	}
+	w.hole = 0
+	_, err := w.w.Write([]byte{0})
+	return err
+}
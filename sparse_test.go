@@ -0,0 +1,116 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSparseBlocks(t *testing.T) {
+	b := make([]byte, 3*sparseBlockSize)
+	b[sparseBlockSize+1] = 1
+
+	type run struct {
+		off, len int64
+		zeros    bool
+	}
+	var runs []run
+	require.NoError(t, sparseBlocks(b[10:], 10, func(r []byte, off int64, zeros bool) error {
+		runs = append(runs, run{off, int64(len(r)), zeros})
+		return nil
+	}))
+	assert.Equal(t, []run{
+		{10, sparseBlockSize - 10, true},
+		{sparseBlockSize, sparseBlockSize, false},
+		{2 * sparseBlockSize, sparseBlockSize, true},
+	}, runs)
+}
+
+// seekRecorder records the writes and seeks of a sparseWriter.
+type seekRecorder struct {
+	bytes.Buffer
+	ops []string
+}
+
+func (r *seekRecorder) Write(b []byte) (int, error) {
+	r.ops = append(r.ops, "write")
+	return r.Buffer.Write(b)
+}
+
+func (r *seekRecorder) Seek(offset int64, whence int) (int64, error) {
+	r.ops = append(r.ops, "seek")
+	r.Buffer.Write(make([]byte, offset))
+	return int64(r.Len()), nil
+}
+
+func TestSparseWriter(t *testing.T) {
+	data := make([]byte, 4*sparseBlockSize)
+	copy(data[sparseBlockSize:], "data")
+
+	var r seekRecorder
+	w := &sparseWriter{w: &r}
+	_, err := w.Write(data[:sparseBlockSize+10])
+	require.NoError(t, err)
+	_, err = w.Write(data[sparseBlockSize+10:])
+	require.NoError(t, err)
+	require.NoError(t, w.finish())
+
+	assert.Equal(t, []string{"seek", "write", "seek", "write"}, r.ops)
+	assert.Equal(t, data, r.Bytes())
+}
+
+func TestPreserveSparse(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	handlers := InMemHandler()
+	writes := &countedWrites{FileWriter: handlers.FilePut}
+	handlers.FilePut = writes
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	dir, err := ioutil.TempDir("", "sftptest-sparse")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a disk image of sorts: data between holes
+	content := make([]byte, 64*client.maxPacket)
+	copy(content[10*client.maxPacket:], "boot")
+	copy(content[40*client.maxPacket+100:], "data")
+	src := filepath.Join(dir, "src")
+	require.NoError(t, ioutil.WriteFile(src, content, 0644))
+
+	for _, opts := range [][]TransferOption{{PreserveSparse()}, {PreserveSparse(), UseMmap()}} {
+		require.NoError(t, client.Upload(src, "/image", opts...))
+		// the blocks of the data, and the last byte
+		assert.Equal(t, 3, writes.reset())
+		got, err := getTestFile(client, "/image")
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(content, got))
+	}
+	require.NoError(t, client.Upload(src, "/image"))
+	assert.Greater(t, writes.reset(), 3)
+
+	dst := filepath.Join(dir, "dst")
+	require.NoError(t, client.Download("/image", dst, PreserveSparse()))
+	got, err := ioutil.ReadFile(dst)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(content, got))
+
+	// ReadFrom of the File, with the data ending in the middle of a block
+	f, err := client.Create("/file")
+	require.NoError(t, err)
+	f.SetSparse(true)
+	_, err = f.ReadFrom(io.LimitReader(bytes.NewReader(content), int64(20*client.maxPacket+10)))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, 2, writes.reset())
+	got, err = getTestFile(client, "/file")
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(content[:20*client.maxPacket+10], got))
+}
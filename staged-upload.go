@@ -0,0 +1,213 @@
+package sftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// WithStagedUploads writes the files opened to be created or truncated to
+// a hidden temporary file next to them, renamed to the path opened only once
+// the file is closed without error, so that programs watching the directory
+// never pick up half-written files. The temporary file is removed if writing
+// or closing fails, or if the session ends with the file still open.
+//
+// A replaced file is replaced by a new file, with its permissions, rather
+// than truncated, and a symbolic link at the path is replaced rather than
+// written through. The files opened with os.O_EXCL are linked to the path
+// rather than renamed, for a file created there meanwhile not to be replaced
+// but the close to fail, which requires a file system supporting hard links.
+//
+// The RequestServer equivalent is WithRSStagedUploads.
+func WithStagedUploads() ServerOption {
+	return func(s *Server) error {
+		s.stagedUploads = true
+		return nil
+	}
+}
+
+// WithRSStagedUploads writes the files opened to be created or truncated
+// under a hidden temporary name next to them, renamed to the path opened only
+// once the file is closed without error, so that programs watching the
+// directory never pick up half-written files. The temporary file is removed
+// if writing or closing fails, or if the session ends with the file still open.
+//
+// The Handlers see the Put or Open requests under the temporary name, and
+// the existence of the path opened is checked with a Stat request, to enforce
+// the Creat, Excl and Trunc flags. The rename is a PosixRename request if the
+// FileCmder is a PosixRenameFileCmder, and otherwise a Remove request of the
+// path opened, if it exists, followed by a Rename request. It is a Rename
+// request only for the files opened with Excl, for a file created at the path
+// meanwhile not to be replaced, as Rename requests do not.
+//
+// The Server equivalent is WithStagedUploads.
+func WithRSStagedUploads() RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.stagedUploads = true
+	}
+}
+
+// stagingName returns a hidden temporary name for the upload of a file
+// with the base name base.
+func stagingName(base string) string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return "." + base + "." + hex.EncodeToString(b[:]) + ".part"
+}
+
+// stage reports whether an open with flags, of a file that exists or not,
+// is to be staged, or the error failing the open.
+func stage(flags FileOpenFlags, exists bool) (bool, error) {
+	if !flags.Write {
+		return false, nil
+	}
+	create, truncate, err := flags.Check(exists)
+	return create || truncate, err
+}
+
+// openStaged opens the temporary file of a staged upload of name, opened
+// with the flags pflags, or returns a nil file if it is not to be staged.
+func (svr *Server) openStaged(name string, pflags uint32) (*os.File, error) {
+	flags := newFileOpenFlags(pflags)
+	fi, err := os.Stat(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && !fi.Mode().IsRegular() {
+		// fail as opening it does
+		return nil, nil
+	}
+	if ok, err := stage(flags, err == nil); !ok {
+		return nil, err
+	}
+
+	perm := os.FileMode(0644)
+	if fi != nil {
+		perm = fi.Mode().Perm()
+	}
+	osFlags := (FileOpenFlags{Read: flags.Read, Write: true, Creat: true, Excl: true}).OSFlags()
+	tmp := filepath.Join(filepath.Dir(name), stagingName(filepath.Base(name)))
+	f, err := os.OpenFile(tmp, osFlags, perm)
+	if err != nil {
+		return nil, err
+	}
+	if fi != nil {
+		// the permissions of the replaced file, regardless of the umask
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// commitStaged renames the temporary file of a staged upload closed with
+// err to the path opened, or removes it if err is not nil.
+func (f *serverFile) commitStaged(err error) error {
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if f.stagedExcl {
+		// a file created meanwhile is not replaced, as by a rename
+		err := os.Link(f.Name(), f.stagedPath)
+		os.Remove(f.Name())
+		if os.IsExist(err) {
+			return os.ErrExist
+		}
+		return err
+	}
+	return os.Rename(f.Name(), f.stagedPath)
+}
+
+// stageUpload makes r, opening a file, open the temporary file of a staged
+// upload instead, if it is to be staged.
+func (rs *RequestServer) stageUpload(r *Request) error {
+	flags := r.Pflags()
+	if !flags.Write {
+		return nil
+	}
+	exists, err := rs.exists(r)
+	if err != nil {
+		return err
+	}
+	if ok, err := stage(flags, exists); !ok {
+		return err
+	}
+
+	r.stagedPath, r.stagedExcl = r.Filepath, flags.Excl
+	r.Filepath = path.Join(path.Dir(r.Filepath), stagingName(path.Base(r.Filepath)))
+	if flags.Read {
+		r.Flags = sshFxfRead
+	} else {
+		r.Flags = 0
+	}
+	r.Flags |= sshFxfWrite | sshFxfCreat | sshFxfExcl
+	return nil
+}
+
+// exists reports whether the file r opens exists, with a Stat request.
+func (rs *RequestServer) exists(r *Request) (bool, error) {
+	stat := NewRequest("Stat", r.Filepath).WithContext(r.Context())
+	var lister ListerAt
+	err := handleRequest(stat, func(r *Request) (err error) {
+		lister, err = rs.Handlers.FileList.Filelist(r)
+		return err
+	})
+	if err == nil {
+		var fi [1]os.FileInfo
+		var n int
+		n, err = listAt(stat.Context(), lister, fi[:], 0)
+		if n == 1 {
+			return true, nil
+		}
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	if err == io.EOF || errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// commitStaged renames the temporary file of the staged upload of r, closed
+// with err, to the path opened, or removes it if err is not nil.
+func (rs *RequestServer) commitStaged(r *Request, err error) error {
+	// the context of r is canceled once closed
+	ctx := rs.baseContext()
+	cmd := func(method, p, target string) error {
+		req := NewRequest(method, p).WithContext(ctx)
+		req.Target = target
+		return handleRequest(req, rs.Handlers.FileCmd.Filecmd)
+	}
+
+	if err != nil {
+		cmd("Remove", r.Filepath, "")
+		return err
+	}
+	if r.stagedExcl {
+		if err := cmd("Rename", r.Filepath, r.stagedPath); err != nil {
+			cmd("Remove", r.Filepath, "")
+			return err
+		}
+		return nil
+	}
+	if posixRenamer, ok := rs.Handlers.FileCmd.(PosixRenameFileCmder); ok {
+		req := NewRequest("PosixRename", r.Filepath).WithContext(ctx)
+		req.Target = r.stagedPath
+		return handleRequest(req, posixRenamer.PosixRename)
+	}
+	if err := cmd("Remove", r.stagedPath, ""); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return cmd("Rename", r.Filepath, r.stagedPath)
+}
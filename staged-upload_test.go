@@ -0,0 +1,169 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerStagedUploads(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t, WithStagedUploads())
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-staged")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	names := func() []string {
+		fis, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+
+	name := filepath.Join(dir, "file")
+	f, err := client.Create(name)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// only the hidden temporary file exists while uploading
+	staged := names()
+	require.Len(t, staged, 1)
+	assert.True(t, strings.HasPrefix(staged[0], ".file."), staged[0])
+	assert.True(t, strings.HasSuffix(staged[0], ".part"), staged[0])
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), fi.Size())
+
+	require.NoError(t, f.Close())
+	assert.Equal(t, []string{"file"}, names())
+	b, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// the replaced file keeps its permissions
+	require.NoError(t, os.Chmod(name, 0600))
+	f, err = client.OpenFile(name, os.O_WRONLY|os.O_TRUNC)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("bye"))
+	require.NoError(t, err)
+	b, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	require.NoError(t, f.Close())
+	b, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(b))
+	fi, err = os.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// the flags are enforced on the path opened
+	_, err = client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	assert.Error(t, err)
+	_, err = client.OpenFile(filepath.Join(dir, "missing"), os.O_WRONLY|os.O_TRUNC)
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	// writing in place is not staged
+	f, err = client.OpenFile(name, os.O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("e"), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"file"}, names())
+	require.NoError(t, f.Close())
+	b, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "bee", string(b))
+	assert.Equal(t, []string{"file"}, names())
+}
+
+func TestServerStagedUploadsLeftOpen(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t, WithStagedUploads())
+	defer client.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-staged")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := client.Create(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	server.Close()
+	require.Eventually(t, func() bool {
+		fis, err := ioutil.ReadDir(dir)
+		return err == nil && len(fis) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestRequestStagedUploads(t *testing.T) {
+	p := clientRequestServerPair(t, WithRSStagedUploads())
+	defer p.Close()
+
+	f, err := p.cli.Create("/file")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	fis, err := p.cli.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, fis, 1)
+	staged := fis[0].Name()
+	assert.True(t, strings.HasPrefix(staged, ".file."), staged)
+	_, err = p.cli.Stat("/file")
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	require.NoError(t, f.Close())
+	b, err := getTestFile(p.cli, "/file")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	_, err = p.cli.Stat(path.Join("/", staged))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	// replacing an existing file
+	_, err = putTestFile(p.cli, "/file", "bye")
+	require.NoError(t, err)
+	b, err = getTestFile(p.cli, "/file")
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(b))
+
+	_, err = p.cli.OpenFile("/file", os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	assert.Error(t, err)
+	_, err = p.cli.OpenFile("/missing", os.O_WRONLY|os.O_TRUNC)
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	// an exclusive upload does not replace the file created meanwhile
+	f, err = p.cli.OpenFile("/later", os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	require.NoError(t, err)
+	_, err = putTestFile(p.cli, "/later", "hello")
+	require.NoError(t, err)
+	assert.Error(t, f.Close())
+	b, err = getTestFile(p.cli, "/later")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	require.NoError(t, p.cli.Remove("/later"))
+
+	fis, err = p.cli.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, fis, 1)
+	assert.Equal(t, "file", fis[0].Name())
+}
@@ -0,0 +1,259 @@
+package sftp
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStatCacheEntries is the number of entries over which the expired
+// entries of a stat cache are dropped, and all of them if none expired.
+const maxStatCacheEntries = 1 << 14
+
+// UseStatCache makes the Client cache the results of Stat, Lstat and ReadDir,
+// the missing files included, for ttl, which saves the round trips of
+// workloads stating or listing the same paths over and over, such as the
+// syncs of trees.
+//
+// The entries of the paths the Client changes, by writing to them, renaming,
+// removing or setting their attributes, are dropped as the change is made,
+// along with the entries of their directory, and of the files under them.
+// Changes made by other clients, or through other paths such as links, are
+// only seen once the entries expire. A ttl of 0 disables the cache.
+func UseStatCache(ttl time.Duration) ClientOption {
+	return func(c *Client) error {
+		if ttl <= 0 {
+			c.statCache = nil
+			return nil
+		}
+		c.statCache = newStatCache(ttl)
+		return nil
+	}
+}
+
+type statCacheKey struct {
+	path   string
+	follow bool // Stat rather than Lstat
+	list   bool // ReadDir
+}
+
+type statCacheEntry struct {
+	attrs   FileStat
+	list    []os.FileInfo // of ReadDir
+	err     error         // os.ErrNotExist, if not nil
+	expires time.Time
+}
+
+// statCache holds the results of the Stat, Lstat and ReadDir of a Client.
+type statCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	gen     uint64 // incremented by each invalidation
+	entries map[statCacheKey]*statCacheEntry
+	handles map[string]string // handle -> path, of the files opened
+}
+
+func newStatCache(ttl time.Duration) *statCache {
+	return &statCache{
+		ttl:     ttl,
+		entries: make(map[statCacheKey]*statCacheEntry),
+		handles: make(map[string]string),
+	}
+}
+
+// cachedStat is Stat, or Lstat if follow is false, through the cache.
+func (c *Client) cachedStat(p string, follow bool, stat func(string) (*FileStat, error)) (os.FileInfo, error) {
+	sc := c.statCache
+	if sc == nil {
+		fs, err := stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return fileInfoFromStat(fs, path.Base(p)), nil
+	}
+
+	key := statCacheKey{path: c.cachePath(p), follow: follow}
+	if e, ok := sc.get(key); ok {
+		if e.err != nil {
+			return nil, e.err
+		}
+		attrs := e.attrs
+		return fileInfoFromStat(&attrs, path.Base(p)), nil
+	}
+
+	gen := sc.generation()
+	fs, err := stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			sc.put(key, gen, &statCacheEntry{err: err})
+		}
+		return nil, err
+	}
+	sc.put(key, gen, &statCacheEntry{attrs: *fs})
+	return fileInfoFromStat(fs, path.Base(p)), nil
+}
+
+// cachedReadDir is ReadDir through the cache.
+func (c *Client) cachedReadDir(p string, readDir func(string) ([]os.FileInfo, error)) ([]os.FileInfo, error) {
+	sc := c.statCache
+	if sc == nil {
+		return readDir(p)
+	}
+
+	key := statCacheKey{path: c.cachePath(p), list: true}
+	if e, ok := sc.get(key); ok {
+		if e.err != nil {
+			return nil, e.err
+		}
+		// the callers may sort or change the list
+		return append([]os.FileInfo(nil), e.list...), nil
+	}
+
+	gen := sc.generation()
+	list, err := readDir(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			sc.put(key, gen, &statCacheEntry{err: err})
+		}
+		return list, err
+	}
+	sc.put(key, gen, &statCacheEntry{list: append([]os.FileInfo(nil), list...)})
+	return list, nil
+}
+
+// cachePath returns the path p stands for, as sent to the server.
+func (c *Client) cachePath(p string) string {
+	if dir, _ := c.dir.Load().(string); dir != "" && !path.IsAbs(p) {
+		return path.Join(dir, p)
+	}
+	return path.Clean(p)
+}
+
+func (sc *statCache) generation() uint64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return sc.gen
+}
+
+func (sc *statCache) get(key statCacheKey) (*statCacheEntry, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	e, ok := sc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !pkgClock.Now().Before(e.expires) {
+		delete(sc.entries, key)
+		return nil, false
+	}
+	return e, true
+}
+
+// put caches e, unless an invalidation happened since gen, as e might
+// then be out of date.
+func (sc *statCache) put(key statCacheKey, gen uint64, e *statCacheEntry) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.gen != gen {
+		return
+	}
+	now := pkgClock.Now()
+	if len(sc.entries) >= maxStatCacheEntries {
+		for k, e := range sc.entries {
+			if !now.Before(e.expires) {
+				delete(sc.entries, k)
+			}
+		}
+		if len(sc.entries) >= maxStatCacheEntries {
+			sc.entries = make(map[statCacheKey]*statCacheEntry)
+		}
+	}
+	e.expires = now.Add(sc.ttl)
+	sc.entries[key] = e
+}
+
+// opened records the path of the handle of a file opened.
+func (sc *statCache) opened(handle, p string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.handles[handle] = p
+}
+
+// sent drops the entries changed by the request p, once answered.
+func (sc *statCache) sent(p idmarshaler) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	switch p := p.(type) {
+	case *sshFxpMkdirPacket:
+		sc.invalidate(p.Path, true)
+	case *sshFxpRmdirPacket:
+		sc.invalidate(p.Path, true)
+	case *sshFxpRemovePacket:
+		sc.invalidate(p.Filename, true)
+	case *sshFxpRenamePacket:
+		sc.invalidate(p.Oldpath, true)
+		sc.invalidate(p.Newpath, true)
+	case *sshFxpPosixRenamePacket:
+		sc.invalidate(p.Oldpath, true)
+		sc.invalidate(p.Newpath, true)
+	case *sshFxpHardlinkPacket:
+		sc.invalidate(p.Oldpath, false)
+		sc.invalidate(p.Newpath, true)
+	case *sshFxpSymlinkPacket:
+		sc.invalidate(p.Linkpath, true)
+	case *sshFxpSetstatPacket:
+		sc.invalidate(p.Path, false)
+	case *sshFxpOpenPacket:
+		if p.Pflags&(sshFxfWrite|sshFxfAppend|sshFxfCreat|sshFxfTrunc) != 0 {
+			sc.invalidate(p.Path, true)
+		}
+	case *sshFxpWritePacket:
+		if name, ok := sc.handles[p.Handle]; ok {
+			sc.invalidate(name, false)
+		}
+	case *sshFxpFsetstatPacket:
+		if name, ok := sc.handles[p.Handle]; ok {
+			sc.invalidate(name, false)
+		}
+	case *sshFxpExtendedPacketCopyData:
+		if name, ok := sc.handles[p.WriteHandle]; ok {
+			sc.invalidate(name, false)
+		}
+	case *sshFxpExtendedPacketCopyFile:
+		sc.invalidate(p.Destination, true)
+	case *sshFxpClosePacket:
+		if name, ok := sc.handles[p.Handle]; ok {
+			// the modtime may be set on close
+			sc.invalidate(name, false)
+			delete(sc.handles, p.Handle)
+		}
+	}
+}
+
+// invalidate drops the entries of p and of the files under it, and of its
+// directory if dir is set, as its entries changed. The listing of the
+// directory is dropped either way, as it has the attributes of p.
+func (sc *statCache) invalidate(p string, dir bool) {
+	sc.gen++
+
+	p = path.Clean(p)
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	parent := path.Dir(p)
+	for k := range sc.entries {
+		switch {
+		case k.path == p, strings.HasPrefix(k.path, prefix):
+		case (dir || k.list) && k.path == parent:
+		default:
+			continue
+		}
+		delete(sc.entries, k)
+	}
+}
@@ -0,0 +1,141 @@
+package sftp
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statCounter counts the Stat and Lstat requests, and the List requests.
+type statCounter struct {
+	FileLister
+	stats int32
+	lists int32
+}
+
+func (l *statCounter) Filelist(r *Request) (ListerAt, error) {
+	switch r.Method {
+	case "Stat", "Lstat":
+		atomic.AddInt32(&l.stats, 1)
+	case "List":
+		atomic.AddInt32(&l.lists, 1)
+	}
+	return l.FileLister.Filelist(r)
+}
+
+func TestClientStatCache(t *testing.T) {
+	clock := useFakeClock(t, time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+
+	handlers := InMemHandler()
+	counter := &statCounter{FileLister: handlers.FileList}
+	handlers.FileList = counter
+
+	client, _ := handlersClientPair(t, handlers, []ClientOption{UseStatCache(time.Minute)})
+
+	stats := func() int32 { return atomic.LoadInt32(&counter.stats) }
+	size := func(p string) int64 {
+		fi, err := client.Stat(p)
+		require.NoError(t, err)
+		return fi.Size()
+	}
+
+	putTestFile(client, "/a", "data")
+	assert.EqualValues(t, 4, size("/a"))
+	assert.EqualValues(t, 4, size("/a"))
+	assert.EqualValues(t, 1, stats())
+
+	fi, err := client.Lstat("/a")
+	require.NoError(t, err)
+	assert.Equal(t, "a", fi.Name())
+	assert.EqualValues(t, 2, stats())
+
+	for i := 0; i < 2; i++ {
+		_, err = client.Stat("/missing")
+		assert.True(t, os.IsNotExist(err), err)
+	}
+	assert.EqualValues(t, 3, stats())
+
+	f, err := client.OpenFile("/a", os.O_WRONLY)
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, size("/a"))
+	_, err = f.WriteAt([]byte("more"), 4)
+	require.NoError(t, err)
+	assert.EqualValues(t, 8, size("/a"))
+	require.NoError(t, f.Close())
+	assert.EqualValues(t, 8, size("/a"))
+	assert.EqualValues(t, 6, stats())
+
+	require.NoError(t, client.Rename("/a", "/missing"))
+	_, err = client.Stat("/a")
+	assert.True(t, os.IsNotExist(err), err)
+	assert.EqualValues(t, 8, size("/missing"))
+	assert.EqualValues(t, 8, stats())
+
+	require.NoError(t, client.Truncate("/missing", 2))
+	assert.EqualValues(t, 2, size("/missing"))
+	assert.EqualValues(t, 9, stats())
+
+	clock.Advance(time.Minute)
+	assert.EqualValues(t, 2, size("/missing"))
+	assert.EqualValues(t, 10, stats())
+}
+
+func TestClientStatCacheReadDir(t *testing.T) {
+	clock := useFakeClock(t, time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+
+	handlers := InMemHandler()
+	counter := &statCounter{FileLister: handlers.FileList}
+	handlers.FileList = counter
+
+	client, _ := handlersClientPair(t, handlers, []ClientOption{UseStatCache(time.Minute)})
+
+	lists := func() int32 { return atomic.LoadInt32(&counter.lists) }
+	sizes := func(p string) map[string]int64 {
+		entries, err := client.ReadDir(p)
+		require.NoError(t, err)
+		sizes := make(map[string]int64)
+		for _, fi := range entries {
+			sizes[fi.Name()] = fi.Size()
+		}
+		return sizes
+	}
+
+	require.NoError(t, client.MkdirAll("/dir/sub"))
+	_, err := putTestFile(client, "/dir/a", "data")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"a": 4, "sub": 0}, sizes("/dir"))
+	assert.Equal(t, map[string]int64{"a": 4, "sub": 0}, sizes("/dir"))
+	assert.EqualValues(t, 1, lists())
+
+	for i := 0; i < 2; i++ {
+		_, err = client.ReadDir("/missing")
+		assert.True(t, os.IsNotExist(err), err)
+	}
+	assert.EqualValues(t, 2, lists())
+
+	// the attributes of an entry changed
+	require.NoError(t, client.Truncate("/dir/a", 2))
+	assert.Equal(t, map[string]int64{"a": 2, "sub": 0}, sizes("/dir"))
+	assert.EqualValues(t, 3, lists())
+
+	// an entry added, under a directory listed
+	_, err = putTestFile(client, "/dir/sub/b", "b")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"b": 1}, sizes("/dir/sub"))
+	assert.Equal(t, map[string]int64{"a": 2, "sub": 0}, sizes("/dir"))
+	assert.EqualValues(t, 4, lists())
+
+	require.NoError(t, client.Rename("/dir/sub", "/dir/moved"))
+	assert.Equal(t, map[string]int64{"a": 2, "moved": 0}, sizes("/dir"))
+	_, err = client.ReadDir("/dir/sub")
+	assert.True(t, os.IsNotExist(err), err)
+	assert.EqualValues(t, 6, lists())
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, map[string]int64{"a": 2, "moved": 0}, sizes("/dir"))
+	assert.EqualValues(t, 7, lists())
+}
@@ -0,0 +1,199 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// stripeBufferSize is the size of the buffer each client transfers its stripes with.
+const stripeBufferSize = 1 << 20
+
+// StripedDownload downloads the remote file at path into w,
+// splitting it into stripes of stripeSize bytes transferred concurrently
+// over the given clients. Each client should be a session over its own
+// SSH channel, so that the transfer exceeds the window limit of a single channel.
+//
+// The stripes are written to w at their offset, so w receives a copy of the
+// file whichever order they complete in. It returns the number of bytes of the file.
+func StripedDownload(clients []*Client, path string, w io.WriterAt, stripeSize int64) (int64, error) {
+	return StripedDownloadWithCheckpoint(clients, path, w, stripeSize, nil)
+}
+
+// StripedDownloadWithCheckpoint is StripedDownload recording its progress in cp,
+// the stripes already recorded as completed in cp are skipped:
+// w must still hold their data, for example a local file opened without truncating it.
+// If cp is nil, this is StripedDownload.
+func StripedDownloadWithCheckpoint(clients []*Client, path string, w io.WriterAt, stripeSize int64, cp *Checkpoint) (int64, error) {
+	if err := checkStripes(clients, stripeSize); err != nil {
+		return 0, err
+	}
+
+	fi, err := clients[0].Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+
+	open := func(c *Client) (*File, error) {
+		return c.Open(path)
+	}
+	transfer := func(f *File, buf []byte, off int64) error {
+		n, err := f.ReadAt(buf, off)
+		if err == io.EOF && int64(n) == int64(len(buf)) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = w.WriteAt(buf[:n], off)
+		return err
+	}
+
+	return size, runStripes(clients, size, stripeSize, cp, open, transfer)
+}
+
+// StripedUpload uploads size bytes read from r into the remote file at path,
+// splitting them into stripes of stripeSize bytes transferred concurrently
+// over the given clients. See StripedDownload.
+//
+// The remote file is created, or truncated if it already exists.
+func StripedUpload(clients []*Client, r io.ReaderAt, size int64, path string, stripeSize int64) error {
+	return StripedUploadWithCheckpoint(clients, r, size, path, stripeSize, nil)
+}
+
+// StripedUploadWithCheckpoint is StripedUpload recording its progress in cp,
+// the stripes already recorded as completed in cp are skipped,
+// and the remote file is then not truncated.
+// If cp is nil, this is StripedUpload.
+func StripedUploadWithCheckpoint(clients []*Client, r io.ReaderAt, size int64, path string, stripeSize int64, cp *Checkpoint) error {
+	if err := checkStripes(clients, stripeSize); err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if cp != nil {
+		cp.begin(size, stripeSize)
+		if cp.resuming() {
+			flags &^= os.O_TRUNC
+		}
+	}
+	f, err := clients[0].OpenFile(path, flags)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	open := func(c *Client) (*File, error) {
+		return c.OpenFile(path, os.O_WRONLY)
+	}
+	transfer := func(f *File, buf []byte, off int64) error {
+		n, err := r.ReadAt(buf, off)
+		if err == io.EOF && n == len(buf) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(buf[:n], off)
+		return err
+	}
+
+	return runStripes(clients, size, stripeSize, cp, open, transfer)
+}
+
+func checkStripes(clients []*Client, stripeSize int64) error {
+	if len(clients) == 0 {
+		return errors.New("sftp: no clients to transfer stripes with")
+	}
+	if stripeSize < 1 {
+		return errors.New("sftp: stripe size must be greater or equal to 1")
+	}
+	return nil
+}
+
+// runStripes calls transfer for every chunk of the size bytes, by stripes of
+// stripeSize bytes handed out to the clients as they complete the previous one.
+// Each client runs transfer with its own File returned by open.
+// If cp is not nil, it records the completed stripes, and those
+// already recorded are skipped.
+func runStripes(clients []*Client, size, stripeSize int64, cp *Checkpoint,
+	open func(*Client) (*File, error),
+	transfer func(f *File, buf []byte, off int64) error,
+) error {
+	if cp != nil {
+		cp.begin(size, stripeSize)
+	}
+
+	var next int64 = -1 // index of the last stripe handed out, accessed atomically
+	var failed int32    // set when a client fails, accessed atomically
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(clients))
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+
+			f, err := open(c)
+			if err != nil {
+				atomic.StoreInt32(&failed, 1)
+				errs[i] = err
+				return
+			}
+
+			bufSize := stripeSize
+			if bufSize > stripeBufferSize {
+				bufSize = stripeBufferSize
+			}
+			buf := make([]byte, bufSize)
+
+			for err == nil && atomic.LoadInt32(&failed) == 0 {
+				stripe := atomic.AddInt64(&next, 1)
+				start := stripe * stripeSize
+				if start >= size {
+					break
+				}
+				if cp != nil && cp.isDone(stripe) {
+					continue
+				}
+				end := start + stripeSize
+				if end > size {
+					end = size
+				}
+
+				for off := start; err == nil && off < end; off += int64(len(buf)) {
+					n := end - off
+					if n > int64(len(buf)) {
+						n = int64(len(buf))
+					}
+					err = transfer(f, buf[:n], off)
+				}
+				if err == nil && cp != nil {
+					err = cp.markDone(stripe)
+				}
+			}
+			if err != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			errs[i] = err
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
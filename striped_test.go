@@ -0,0 +1,65 @@
+package sftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stripedClients(t *testing.T, n int) ([]*Client, func()) {
+	var clients []*Client
+	var servers []*Server
+	for i := 0; i < n; i++ {
+		client, server := clientServerPair(t)
+		clients = append(clients, client)
+		servers = append(servers, server)
+	}
+	return clients, func() {
+		for i := range clients {
+			servers[i].Close()
+			clients[i].Close()
+		}
+	}
+}
+
+func TestStripedTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-striped")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clients, closeAll := stripedClients(t, 3)
+	defer closeAll()
+
+	data := make([]byte, 1<<20+12345)
+	rand.Read(data)
+	remote := path.Join(dir, "remote")
+
+	err = StripedUpload(clients, bytes.NewReader(data), int64(len(data)), remote, 100000)
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(remote)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	local, err := os.Create(path.Join(dir, "local"))
+	require.NoError(t, err)
+	defer local.Close()
+	n, err := StripedDownload(clients, remote, local, 100000)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), n)
+	got, err = ioutil.ReadFile(local.Name())
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = StripedDownload(clients, path.Join(dir, "missing"), local, 100000)
+	assert.True(t, os.IsNotExist(err), "unexpected error: %v", err)
+	_, err = StripedDownload(nil, remote, local, 100000)
+	assert.Error(t, err)
+	_, err = StripedDownload(clients, remote, local, 0)
+	assert.Error(t, err)
+}
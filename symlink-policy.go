@@ -0,0 +1,143 @@
+package sftp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ServerSymlinkPolicy is how the Server follows the symbolic links met
+// resolving the paths of the requests.
+type ServerSymlinkPolicy int
+
+// The symbolic link policies of the Server.
+const (
+	// SymlinkFollowAll follows the links wherever they lead.
+	// It is the default.
+	SymlinkFollowAll ServerSymlinkPolicy = iota
+
+	// SymlinkFollowInsideRoot follows the links leading to files of the
+	// root served, and fails the requests through the others.
+	SymlinkFollowInsideRoot
+
+	// SymlinkDeny follows no link, and fails the requests through one, and
+	// those creating one. The links themselves can still be read, removed
+	// and renamed.
+	SymlinkDeny
+)
+
+// WithSymlinkPolicy sets how the Server follows the symbolic links met
+// resolving the paths of the requests. The requests denied fail with
+// permission denied.
+//
+// The root served is the jail set with WithJail, in which the links are
+// always resolved, so that SymlinkFollowInsideRoot is then SymlinkFollowAll.
+// Otherwise it is the working directory of the process, the one the relative
+// paths are resolved against, as it is when the option is applied. Only the
+// links followed are confined to the root: the files outside of it can still
+// be named by their own paths, unless jailed.
+//
+// The links are found before the requests are served: other processes
+// replacing files of the paths with links meanwhile may still have them
+// followed, except for the last element of the path with SymlinkDeny, where
+// the system has O_NOFOLLOW.
+func WithSymlinkPolicy(policy ServerSymlinkPolicy) ServerOption {
+	return func(s *Server) error {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		// the paths resolved are compared to a root free of links
+		if wd, err = filepath.EvalSymlinks(wd); err != nil {
+			return err
+		}
+		s.symlinks = policy
+		s.symlinkRoot = wd
+		return nil
+	}
+}
+
+// checkSymlinks fails the packet p of the Server not jailed if one of its
+// paths leads through a link not followed by the policy of the Server.
+func (svr *Server) checkSymlinks(p requestPacket) error {
+	if _, ok := p.(*sshFxpSymlinkPacket); ok && svr.symlinks == SymlinkDeny {
+		return ErrSSHFxPermissionDenied
+	}
+	var err error
+	packetPaths(p, func(name *string, follow, change bool) {
+		if err == nil {
+			err = svr.checkPathSymlinks(*name, follow)
+		}
+	})
+	return err
+}
+
+// checkPathSymlinks returns an error if the local path name leads through a
+// link not followed by the policy of the Server, the last element included
+// if follow is true.
+func (svr *Server) checkPathSymlinks(name string, follow bool) error {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	sep := string(filepath.Separator)
+	vol := filepath.VolumeName(name)
+	resolved := vol + sep
+	rest := strings.Split(name[len(vol):], sep)
+	links := 0
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, elem)
+		if len(rest) == 0 && !follow {
+			resolved = next
+			break
+		}
+		fi, err := os.Lstat(next)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// what is missing is left for the request to fail, or create
+			resolved = next
+			continue
+		}
+		if svr.symlinks == SymlinkDeny {
+			return ErrSSHFxPermissionDenied
+		}
+
+		links++
+		if links > maxSymlinks {
+			return errors.Errorf("sftp: too many links resolving %q", name)
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+		vol = filepath.VolumeName(target)
+		resolved = vol + sep
+		rest = append(strings.Split(target[len(vol):], sep), rest...)
+	}
+
+	if links > 0 && !inRoot(svr.symlinkRoot, resolved) {
+		return ErrSSHFxPermissionDenied
+	}
+	return nil
+}
+
+// inRoot reports whether the clean local path name is root or in it.
+func inRoot(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,147 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeSymlinkTree creates in dir a root directory with links leading inside
+// and outside of it, and returns the root.
+func makeSymlinkTree(t *testing.T, dir string) string {
+	root := filepath.Join(dir, "root")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "dir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte("inside"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("outside"), 0644))
+	require.NoError(t, os.Symlink("dir/file", filepath.Join(root, "inside")))
+	require.NoError(t, os.Symlink("dir", filepath.Join(root, "dirlink")))
+	require.NoError(t, os.Symlink("../secret", filepath.Join(root, "outside")))
+	require.NoError(t, os.Symlink(dir, filepath.Join(root, "up")))
+	return root
+}
+
+func TestServerSymlinkPolicy(t *testing.T) {
+	skipIfWindows(t) // the links
+	skipIfPlan9(t)
+
+	dir, err := ioutil.TempDir("", "sftptest-symlinks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the temporary directory itself may be reached through links
+	dir, err = filepath.EvalSymlinks(dir)
+	require.NoError(t, err)
+	root := makeSymlinkTree(t, dir)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(root))
+	defer os.Chdir(wd)
+
+	read := func(client *Client, p string) (string, error) {
+		data, err := getTestFile(client, p)
+		return string(data), err
+	}
+
+	t.Run("FollowAll", func(t *testing.T) {
+		client, server := clientServerPair(t, WithSymlinkPolicy(SymlinkFollowAll))
+		defer client.Close()
+		defer server.Close()
+
+		data, err := read(client, "outside")
+		require.NoError(t, err)
+		assert.Equal(t, "outside", data)
+		require.NoError(t, client.Symlink("dir/file", "created"))
+		require.NoError(t, client.Remove("created"))
+	})
+
+	t.Run("FollowInsideRoot", func(t *testing.T) {
+		client, server := clientServerPair(t, WithSymlinkPolicy(SymlinkFollowInsideRoot))
+		defer client.Close()
+		defer server.Close()
+
+		data, err := read(client, "inside")
+		require.NoError(t, err)
+		assert.Equal(t, "inside", data)
+		data, err = read(client, "dirlink/file")
+		require.NoError(t, err)
+		assert.Equal(t, "inside", data)
+		// out, and back in
+		data, err = read(client, "up/root/dir/file")
+		require.NoError(t, err)
+		assert.Equal(t, "inside", data)
+
+		_, err = read(client, "outside")
+		assert.True(t, os.IsPermission(err), err)
+		_, err = client.Stat("up/secret")
+		assert.True(t, os.IsPermission(err), err)
+		_, err = client.ReadDir("up")
+		assert.True(t, os.IsPermission(err), err)
+		// no link followed
+		data, err = read(client, filepath.Join(dir, "secret"))
+		require.NoError(t, err)
+		assert.Equal(t, "outside", data)
+
+		fi, err := client.Lstat("outside")
+		require.NoError(t, err)
+		assert.True(t, fi.Mode()&os.ModeSymlink != 0)
+		target, err := client.ReadLink("outside")
+		require.NoError(t, err)
+		assert.Equal(t, "../secret", target)
+	})
+
+	t.Run("Deny", func(t *testing.T) {
+		client, server := clientServerPair(t, WithSymlinkPolicy(SymlinkDeny))
+		defer client.Close()
+		defer server.Close()
+
+		_, err := read(client, "inside")
+		assert.True(t, os.IsPermission(err), err)
+		_, err = client.Stat("dirlink/file")
+		assert.True(t, os.IsPermission(err), err)
+		_, err = read(client, "outside")
+		assert.True(t, os.IsPermission(err), err)
+		assert.True(t, os.IsPermission(client.Symlink("dir/file", "created")))
+		_, err = os.Lstat(filepath.Join(root, "created"))
+		assert.True(t, os.IsNotExist(err), err)
+
+		data, err := read(client, "dir/file")
+		require.NoError(t, err)
+		assert.Equal(t, "inside", data)
+		target, err := client.ReadLink("inside")
+		require.NoError(t, err)
+		assert.Equal(t, "dir/file", target)
+		require.NoError(t, client.Rename("inside", "renamed"))
+		require.NoError(t, client.Remove("renamed"))
+	})
+}
+
+func TestServerJailSymlinkDeny(t *testing.T) {
+	skipIfWindows(t) // the links
+	skipIfPlan9(t)
+
+	dir, err := ioutil.TempDir("", "sftptest-symlinks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := makeSymlinkTree(t, dir)
+
+	client, server := clientServerPair(t, WithJail(root), WithSymlinkPolicy(SymlinkDeny))
+	defer client.Close()
+	defer server.Close()
+
+	_, err = getTestFile(client, "/inside")
+	assert.True(t, os.IsPermission(err), err)
+	_, err = client.Stat("/dirlink/file")
+	assert.True(t, os.IsPermission(err), err)
+	assert.True(t, os.IsPermission(client.Symlink("/dir/file", "/created")))
+
+	data, err := getTestFile(client, "/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "inside", string(data))
+	fi, err := client.Lstat("/inside")
+	require.NoError(t, err)
+	assert.True(t, fi.Mode()&os.ModeSymlink != 0)
+}
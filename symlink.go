@@ -0,0 +1,198 @@
+package sftp
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SymlinkPolicy is how the helpers walking a tree treat symbolic links.
+type SymlinkPolicy int
+
+// The symbolic link policies.
+const (
+	// SymlinkRecreate reports the links as such, without following them,
+	// for the links to be recreated as links on the destination side.
+	// It is the default.
+	SymlinkRecreate SymlinkPolicy = iota
+
+	// SymlinkSkip ignores the links.
+	SymlinkSkip
+
+	// SymlinkFollow follows the links, as if they were the files they point
+	// to. A link to a directory is not followed if that would walk the tree
+	// in a cycle, nor is a broken link: they are reported as links.
+	SymlinkFollow
+)
+
+// WithSymlinks sets how the symbolic links met walking a tree are treated,
+// such as by Walk. A single file named for a transfer is always followed.
+func WithSymlinks(policy SymlinkPolicy) TransferOption {
+	return func(o *transferOptions) {
+		o.symlinks = policy
+	}
+}
+
+// symlinkFS walks the remote filesystem with a policy other than
+// SymlinkRecreate, the policy of Client itself.
+type symlinkFS struct {
+	c      *Client
+	policy SymlinkPolicy
+
+	// the real paths of the directories to list, and of their ancestors
+	// in the walk, to detect cycles when following links
+	mu     sync.Mutex
+	chains map[string][]string
+}
+
+func newSymlinkFS(c *Client, policy SymlinkPolicy) *symlinkFS {
+	return &symlinkFS{
+		c:      c,
+		policy: policy,
+		chains: make(map[string][]string),
+	}
+}
+
+func (fsys *symlinkFS) Join(elem ...string) string { return fsys.c.Join(elem...) }
+
+func (fsys *symlinkFS) Lstat(name string) (os.FileInfo, error) {
+	if fsys.policy == SymlinkFollow {
+		return fsys.c.Stat(name)
+	}
+	return fsys.c.Lstat(name)
+}
+
+func (fsys *symlinkFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := fsys.c.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	if fsys.policy == SymlinkSkip {
+		entries := list[:0]
+		for _, fi := range list {
+			if fi.Mode()&os.ModeSymlink == 0 {
+				entries = append(entries, fi)
+			}
+		}
+		return entries, nil
+	}
+
+	fsys.mu.Lock()
+	chain, ok := fsys.chains[dirname]
+	delete(fsys.chains, dirname)
+	fsys.mu.Unlock()
+	if !ok {
+		// the root of the walk
+		real, err := fsys.c.evalSymlinks(dirname)
+		if err != nil {
+			return nil, err
+		}
+		chain = []string{real}
+	}
+	dir := chain[len(chain)-1]
+
+	for i, fi := range list {
+		real := path.Join(dir, fi.Name())
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := fsys.c.evalSymlinks(real)
+			if err != nil {
+				// broken
+				continue
+			}
+			tfi, err := fsys.c.Stat(target)
+			if err != nil || (tfi.IsDir() && inChain(chain, target)) {
+				continue
+			}
+			real = target
+			list[i] = renamedFileInfo{tfi, fi.Name()}
+			fi = list[i]
+		}
+		if fi.IsDir() {
+			childChain := make([]string, len(chain), len(chain)+1)
+			copy(childChain, chain)
+			fsys.mu.Lock()
+			fsys.chains[fsys.Join(dirname, fi.Name())] = append(childChain, real)
+			fsys.mu.Unlock()
+		}
+	}
+	return list, nil
+}
+
+// inChain reports whether walking the directory p would walk again
+// one of the directories of chain.
+func inChain(chain []string, p string) bool {
+	for _, dir := range chain {
+		if dir == p || p == "/" || strings.HasPrefix(dir, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// renamedFileInfo is the FileInfo of the file a link points to,
+// under the name of the link.
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi renamedFileInfo) Name() string { return fi.name }
+
+// maxSymlinks is the max number of links followed resolving a path.
+const maxSymlinks = 255
+
+// evalSymlinks returns the absolute path p resolves to once its links are
+// followed, like filepath.EvalSymlinks does for local paths.
+func (c *Client) evalSymlinks(p string) (string, error) {
+	if !path.IsAbs(p) {
+		wd, err := c.Getwd()
+		if err != nil {
+			return "", err
+		}
+		p = path.Join(wd, p)
+	}
+
+	resolved := "/"
+	rest := strings.Split(p, "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, name)
+		fi, err := c.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.Errorf("sftp: too many links resolving %q", p)
+		}
+		target, err := c.ReadLink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
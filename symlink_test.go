@@ -0,0 +1,103 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkSymlinks(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-symlinks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	require.NoError(t, err)
+
+	// root/
+	//   a/file
+	//   a/up -> ..         cycle
+	//   b/to-c -> ../c     cycle through c
+	//   c/to-b -> ../b     cycle through b
+	//   file-link -> a/file
+	//   dir-link -> a
+	//   broken -> missing
+	root := filepath.Join(dir, "root")
+	for _, d := range []string{"a", "b", "c"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, d), 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "a", "file"), []byte("hello"), 0644))
+	links := map[string]string{
+		"a/up":      "..",
+		"b/to-c":    "../c",
+		"c/to-b":    "../b",
+		"file-link": "a/file",
+		"dir-link":  filepath.Join(root, "a"),
+		"broken":    "missing",
+	}
+	for name, target := range links {
+		require.NoError(t, os.Symlink(target, filepath.Join(root, name)))
+	}
+
+	walk := func(opts ...TransferOption) map[string]string {
+		got := make(map[string]string)
+		w := client.Walk(root, opts...)
+		for w.Step() {
+			require.NoError(t, w.Err())
+			rel, err := filepath.Rel(root, w.Path())
+			require.NoError(t, err)
+			var typ string
+			switch mode := w.Stat().Mode(); {
+			case mode&os.ModeSymlink != 0:
+				typ = "link"
+			case mode.IsDir():
+				typ = "dir"
+			default:
+				typ = "file"
+			}
+			got[rel] = typ
+		}
+		return got
+	}
+	keys := func(m map[string]string) []string {
+		var s []string
+		for k := range m {
+			s = append(s, k)
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	recreated := map[string]string{
+		".": "dir", "a": "dir", "a/file": "file", "a/up": "link",
+		"b": "dir", "b/to-c": "link", "c": "dir", "c/to-b": "link",
+		"file-link": "link", "dir-link": "link", "broken": "link",
+	}
+	assert.Equal(t, recreated, walk())
+	assert.Equal(t, recreated, walk(WithSymlinks(SymlinkRecreate)))
+
+	assert.Equal(t, map[string]string{
+		".": "dir", "a": "dir", "a/file": "file", "b": "dir", "c": "dir",
+	}, walk(WithSymlinks(SymlinkSkip)))
+
+	followed := walk(WithSymlinks(SymlinkFollow))
+	assert.Equal(t, map[string]string{
+		".": "dir", "a": "dir", "a/file": "file", "a/up": "link",
+		"b": "dir", "b/to-c": "dir", "b/to-c/to-b": "link",
+		"c": "dir", "c/to-b": "dir", "c/to-b/to-c": "link",
+		"file-link": "file",
+		"dir-link":  "dir", "dir-link/file": "file", "dir-link/up": "link",
+		"broken": "link",
+	}, followed, "%v", keys(followed))
+}
@@ -0,0 +1,328 @@
+package sftp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SyncBaseline records the state of the files of two directories after
+// they were last synchronized by SyncDirs, saved as JSON in a local file.
+// It tells which side changed a file since then.
+type SyncBaseline struct {
+	file  string
+	files map[string]syncState
+}
+
+// syncState is the state of a synchronized file, identical on both sides.
+type syncState struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"` // in seconds, as supported by SFTP
+}
+
+func syncStateOf(fi os.FileInfo) syncState {
+	return syncState{Size: fi.Size(), ModTime: fi.ModTime().Unix()}
+}
+
+// LoadSyncBaseline loads the baseline saved in file,
+// or returns an empty baseline if file does not exist,
+// as for directories never synchronized.
+func LoadSyncBaseline(file string) (*SyncBaseline, error) {
+	b := &SyncBaseline{
+		file:  file,
+		files: make(map[string]syncState),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.files); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Save saves the baseline into its file.
+func (b *SyncBaseline) Save() error {
+	data, err := json.Marshal(b.files)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.file, data, 0600)
+}
+
+// SyncConflict describes a file changed on both sides since the last synchronization.
+type SyncConflict struct {
+	// Path of the file, slash separated and relative to the synchronized directories.
+	Path string
+	// Local and Remote describe each version of the file, nil if deleted.
+	Local  os.FileInfo
+	Remote os.FileInfo
+}
+
+// SyncResolution tells SyncDirs how to resolve a conflict.
+type SyncResolution int
+
+// Resolutions of a SyncConflict.
+const (
+	// SyncSkip leaves both versions as they are,
+	// the conflict is reported again by the next synchronization.
+	SyncSkip SyncResolution = iota
+	// SyncNewestWins propagates the version modified last,
+	// a deleted version only wins if the other one is deleted too.
+	SyncNewestWins
+	// SyncRename keeps both versions: the remote version is propagated at Path,
+	// and the local version is renamed with a ".conflict" suffix before being propagated.
+	// If a version was deleted, the one left is propagated.
+	SyncRename
+)
+
+// SyncConflictSuffix is appended to the name of the local version
+// of a file renamed by SyncRename.
+const SyncConflictSuffix = ".conflict"
+
+// SyncResolver decides how to resolve a conflict.
+type SyncResolver func(SyncConflict) SyncResolution
+
+// SyncDirs synchronizes the local and remote directories both ways, using
+// baseline to detect the regular files created, modified or deleted on each
+// side since the last synchronization: a change on one side only is
+// propagated to the other side, changes on both sides are conflicts
+// resolved by resolve. If resolve is nil, conflicts are skipped.
+//
+// Directories are created as needed, but not removed when empty.
+// Modification times are propagated along with the content.
+// The baseline is updated and saved, even when an error stops the synchronization.
+func (c *Client) SyncDirs(localDir, remoteDir string, baseline *SyncBaseline, resolve SyncResolver) error {
+	local, err := localSyncFiles(localDir)
+	if err != nil {
+		return err
+	}
+	remote, err := c.remoteSyncFiles(remoteDir)
+	if err != nil {
+		return err
+	}
+
+	s := &syncer{
+		c:         c,
+		localDir:  localDir,
+		remoteDir: remoteDir,
+		baseline:  baseline,
+	}
+	err = s.run(local, remote, resolve)
+	if err2 := baseline.Save(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func localSyncFiles(dir string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			files[filepath.ToSlash(rel)] = fi
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (c *Client) remoteSyncFiles(dir string) (map[string]os.FileInfo, error) {
+	dir = path.Clean(dir)
+	files := make(map[string]os.FileInfo)
+	w := c.Walk(dir)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return nil, err
+		}
+		if w.Stat().Mode().IsRegular() {
+			files[strings.TrimPrefix(w.Path()[len(dir):], "/")] = w.Stat()
+		}
+	}
+	return files, nil
+}
+
+type syncer struct {
+	c                   *Client
+	localDir, remoteDir string
+	baseline            *SyncBaseline
+}
+
+func (s *syncer) run(local, remote map[string]os.FileInfo, resolve SyncResolver) error {
+	paths := make(map[string]bool)
+	for p := range local {
+		paths[p] = true
+	}
+	for p := range remote {
+		paths[p] = true
+	}
+	for p := range s.baseline.files {
+		paths[p] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	for _, p := range sorted {
+		if err := s.syncFile(p, local[p], remote[p], resolve); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syncer) syncFile(p string, lfi, rfi os.FileInfo, resolve SyncResolver) error {
+	base, known := s.baseline.files[p]
+	changed := func(fi os.FileInfo) bool {
+		if fi == nil {
+			return known
+		}
+		return !known || syncStateOf(fi) != base
+	}
+	localChanged, remoteChanged := changed(lfi), changed(rfi)
+
+	switch {
+	case !localChanged && !remoteChanged:
+		return nil
+	case lfi != nil && rfi != nil && syncStateOf(lfi) == syncStateOf(rfi):
+		// same change on both sides
+		s.baseline.files[p] = syncStateOf(lfi)
+		return nil
+	case lfi == nil && rfi == nil:
+		delete(s.baseline.files, p)
+		return nil
+	case !remoteChanged:
+		return s.propagateLocal(p, lfi)
+	case !localChanged:
+		return s.propagateRemote(p, rfi)
+	}
+
+	resolution := SyncSkip
+	if resolve != nil {
+		resolution = resolve(SyncConflict{Path: p, Local: lfi, Remote: rfi})
+	}
+
+	switch resolution {
+	case SyncNewestWins:
+		if rfi == nil || (lfi != nil && lfi.ModTime().After(rfi.ModTime())) {
+			return s.propagateLocal(p, lfi)
+		}
+		return s.propagateRemote(p, rfi)
+	case SyncRename:
+		if lfi == nil {
+			return s.propagateRemote(p, rfi)
+		}
+		if rfi == nil {
+			return s.propagateLocal(p, lfi)
+		}
+		renamed := p + SyncConflictSuffix
+		if err := os.Rename(s.localPath(p), s.localPath(renamed)); err != nil {
+			return err
+		}
+		if err := s.propagateLocal(renamed, lfi); err != nil {
+			return err
+		}
+		return s.propagateRemote(p, rfi)
+	default:
+		return nil
+	}
+}
+
+func (s *syncer) localPath(p string) string {
+	return filepath.Join(s.localDir, filepath.FromSlash(p))
+}
+
+func (s *syncer) remotePath(p string) string {
+	return path.Join(s.remoteDir, p)
+}
+
+// propagateLocal propagates the local version of p to the remote side,
+// it was deleted if lfi is nil.
+func (s *syncer) propagateLocal(p string, lfi os.FileInfo) error {
+	if lfi == nil {
+		if err := s.c.Remove(s.remotePath(p)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.baseline.files, p)
+		return nil
+	}
+
+	src, err := os.Open(s.localPath(p))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := s.c.createFile(context.Background(), s.remotePath(p), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, true)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.ReadFrom(src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := s.c.Chtimes(s.remotePath(p), pkgClock.Now(), lfi.ModTime()); err != nil {
+		return err
+	}
+
+	s.baseline.files[p] = syncStateOf(lfi)
+	return nil
+}
+
+// propagateRemote propagates the remote version of p to the local side,
+// it was deleted if rfi is nil.
+func (s *syncer) propagateRemote(p string, rfi os.FileInfo) error {
+	if rfi == nil {
+		if err := os.Remove(s.localPath(p)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.baseline.files, p)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.localPath(p)), 0755); err != nil {
+		return err
+	}
+	src, err := s.c.Open(s.remotePath(p))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(s.localPath(p), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := src.WriteTo(dst); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(s.localPath(p), pkgClock.Now(), rfi.ModTime()); err != nil {
+		return err
+	}
+
+	s.baseline.files[p] = syncStateOf(rfi)
+	return nil
+}
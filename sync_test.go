@@ -0,0 +1,94 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSyncFile(t *testing.T, p, content string, mtime time.Time) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+	require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	require.NoError(t, os.Chtimes(p, mtime, mtime))
+}
+
+func readSyncFile(t *testing.T, p string) string {
+	b, err := ioutil.ReadFile(p)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestClientSyncDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-sync")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	remote := filepath.Join(dir, "remote")
+	require.NoError(t, os.Mkdir(local, 0755))
+	require.NoError(t, os.Mkdir(remote, 0755))
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	baseline, err := LoadSyncBaseline(filepath.Join(dir, "baseline.json"))
+	require.NoError(t, err)
+
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeSyncFile(t, filepath.Join(local, "a"), "a", t0)
+	writeSyncFile(t, filepath.Join(remote, "sub", "b"), "b", t0)
+	writeSyncFile(t, filepath.Join(local, "c"), "c", t0)
+
+	require.NoError(t, client.SyncDirs(local, remote, baseline, nil))
+	assert.Equal(t, "a", readSyncFile(t, filepath.Join(remote, "a")))
+	assert.Equal(t, "b", readSyncFile(t, filepath.Join(local, "sub", "b")))
+	assert.Equal(t, "c", readSyncFile(t, filepath.Join(remote, "c")))
+	fi, err := os.Stat(filepath.Join(remote, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, t0, fi.ModTime())
+
+	// one-sided changes, with the baseline reloaded as after a restart
+	baseline, err = LoadSyncBaseline(filepath.Join(dir, "baseline.json"))
+	require.NoError(t, err)
+	t1 := t0.Add(time.Minute)
+	writeSyncFile(t, filepath.Join(local, "a"), "a1", t1)
+	require.NoError(t, os.Remove(filepath.Join(remote, "sub", "b")))
+
+	require.NoError(t, client.SyncDirs(local, remote, baseline, nil))
+	assert.Equal(t, "a1", readSyncFile(t, filepath.Join(remote, "a")))
+	_, err = os.Stat(filepath.Join(local, "sub", "b"))
+	assert.True(t, os.IsNotExist(err))
+
+	// conflicting changes
+	writeSyncFile(t, filepath.Join(local, "c"), "local", t1)
+	writeSyncFile(t, filepath.Join(remote, "c"), "remote", t1.Add(time.Minute))
+
+	var conflicts []SyncConflict
+	skip := func(c SyncConflict) SyncResolution {
+		conflicts = append(conflicts, c)
+		return SyncSkip
+	}
+	require.NoError(t, client.SyncDirs(local, remote, baseline, skip))
+	require.Len(t, conflicts, 1)
+	assert.Equal(t, "c", conflicts[0].Path)
+	assert.Equal(t, "local", readSyncFile(t, filepath.Join(local, "c")))
+	assert.Equal(t, "remote", readSyncFile(t, filepath.Join(remote, "c")))
+
+	rename := func(SyncConflict) SyncResolution { return SyncRename }
+	require.NoError(t, client.SyncDirs(local, remote, baseline, rename))
+	for _, d := range []string{local, remote} {
+		assert.Equal(t, "remote", readSyncFile(t, filepath.Join(d, "c")))
+		assert.Equal(t, "local", readSyncFile(t, filepath.Join(d, "c"+SyncConflictSuffix)))
+	}
+
+	writeSyncFile(t, filepath.Join(local, "c"), "newest", t1.Add(time.Hour))
+	writeSyncFile(t, filepath.Join(remote, "c"), "older", t1.Add(time.Minute))
+	newest := func(SyncConflict) SyncResolution { return SyncNewestWins }
+	require.NoError(t, client.SyncDirs(local, remote, baseline, newest))
+	assert.Equal(t, "newest", readSyncFile(t, filepath.Join(remote, "c")))
+}
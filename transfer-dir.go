@@ -0,0 +1,270 @@
+package sftp
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultTreeWorkers is the number of files UploadDir and DownloadDir
+// transfer at the same time, unless set with WithWorkers.
+const defaultTreeWorkers = 4
+
+// WithWorkers sets the number of files UploadDir and DownloadDir transfer
+// at the same time. The default is 4.
+func WithWorkers(n int) TransferOption {
+	return func(o *transferOptions) {
+		o.workers = n
+	}
+}
+
+// UploadDir copies the local directory localDir and its tree to remoteDir,
+// creating the missing directories and replacing the files which exist,
+// like the put command of sftp(1) with -r and -p. The files are uploaded as
+// by Upload, several at a time, see WithWorkers. The permission bits and the
+// modification times of the files and directories are preserved, along with
+// the attributes selected by opts. The symbolic links are recreated unless
+// set otherwise with WithSymlinks; the files other than regular files,
+// directories and links are skipped.
+func (c *Client) UploadDir(localDir, remoteDir string, opts ...TransferOption) error {
+	opts = append(opts[:len(opts):len(opts)], PreserveMode(), PreserveTimes())
+	o := newTransferOptions(opts)
+
+	root := filepath.Clean(localDir)
+	t := newTreeTransfer(o.workers)
+	err := walkLocal(root, o.symlinks, func(p string, fi os.FileInfo) error {
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(remoteDir, filepath.ToSlash(rel))
+
+		switch {
+		case fi.IsDir():
+			if err := c.MkdirAll(remote); err != nil {
+				return err
+			}
+			t.dir(func() error { return preserveAttrs(c, remote, fi, o) })
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := c.Remove(remote); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return c.Symlink(filepath.ToSlash(target), remote)
+		case fi.Mode().IsRegular():
+			return t.file(func() error { return c.Upload(p, remote, opts...) })
+		}
+		return nil
+	})
+	return t.wait(err)
+}
+
+// DownloadDir copies the remote directory remoteDir and its tree to
+// localDir, creating the missing directories and replacing the files which
+// exist, like the get command of sftp(1) with -r and -p. The files are
+// downloaded as by Download, several at a time, see WithWorkers. The
+// permission bits and the modification times of the files and directories
+// are preserved, along with the attributes selected by opts. The symbolic
+// links are recreated unless set otherwise with WithSymlinks; the files
+// other than regular files, directories and links are skipped.
+func (c *Client) DownloadDir(remoteDir, localDir string, opts ...TransferOption) error {
+	opts = append(opts[:len(opts):len(opts)], PreserveMode(), PreserveTimes())
+	o := newTransferOptions(opts)
+
+	root := path.Clean(remoteDir)
+	t := newTreeTransfer(o.workers)
+	walker := c.Walk(root, opts...)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return t.wait(err)
+		}
+		p, fi := walker.Path(), walker.Stat()
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+		local := filepath.Join(localDir, filepath.FromSlash(rel))
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(local, 0755); err != nil {
+				return t.wait(err)
+			}
+			t.dir(func() error { return preserveAttrs(localAttrs{}, local, fi, o) })
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := c.ReadLink(p)
+			if err == nil {
+				if err = os.Remove(local); os.IsNotExist(err) {
+					err = nil
+				}
+			}
+			if err == nil {
+				err = os.Symlink(filepath.FromSlash(target), local)
+			}
+			if err != nil {
+				return t.wait(err)
+			}
+		case fi.Mode().IsRegular():
+			if err := t.file(func() error { return c.Download(p, local, opts...) }); err != nil {
+				return t.wait(err)
+			}
+		}
+	}
+	return t.wait(nil)
+}
+
+// walkLocal calls fn with the local file p and, if it is a directory, the
+// files of its tree, the directories before their files, with the symbolic
+// links treated by policy. The file p itself is always followed.
+func walkLocal(p string, policy SymlinkPolicy, fn func(p string, fi os.FileInfo) error) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	return walkLocalTree(p, fi, policy, nil, fn)
+}
+
+// walkLocalTree implements walkLocal, with the real paths of the
+// directories walked down to p when following the links, to detect cycles.
+func walkLocalTree(p string, fi os.FileInfo, policy SymlinkPolicy, chain []string, fn func(p string, fi os.FileInfo) error) error {
+	if err := fn(p, fi); err != nil || !fi.IsDir() {
+		return err
+	}
+
+	if policy == SymlinkFollow {
+		real, err := localRealPath(p)
+		if err != nil {
+			return err
+		}
+		chain = append(chain[:len(chain):len(chain)], real)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := filepath.Join(p, name)
+		cfi, err := os.Lstat(child)
+		if err != nil {
+			return err
+		}
+		if cfi.Mode()&os.ModeSymlink != 0 {
+			switch policy {
+			case SymlinkSkip:
+				continue
+			case SymlinkFollow:
+				// broken links, and links to a directory walked down to, stay links
+				if tfi, err := os.Stat(child); err == nil {
+					if !tfi.IsDir() {
+						cfi = renamedFileInfo{tfi, name}
+					} else if real, err := localRealPath(child); err == nil && !inChain(chain, real) {
+						cfi = renamedFileInfo{tfi, name}
+					}
+				}
+			}
+		}
+		if err := walkLocalTree(child, cfi, policy, chain, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localRealPath returns the absolute path of the local file p, once its
+// links are followed, with slashes to compare it with inChain.
+func localRealPath(p string) (string, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	real, err = filepath.Abs(real)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(real), nil
+}
+
+// treeTransfer transfers the files of a tree with a pool of workers, and
+// sets the attributes of its directories once all the files are done, the
+// subdirectories before their parents.
+type treeTransfer struct {
+	files chan func() error
+	wg    sync.WaitGroup
+	dirs  []func() error
+
+	once sync.Once
+	err  error         // the first error of the files
+	done chan struct{} // closed once err is set
+}
+
+func newTreeTransfer(workers int) *treeTransfer {
+	if workers < 1 {
+		workers = defaultTreeWorkers
+	}
+	t := &treeTransfer{
+		files: make(chan func() error),
+		done:  make(chan struct{}),
+	}
+	t.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer t.wg.Done()
+			for transfer := range t.files {
+				if err := transfer(); err != nil {
+					t.once.Do(func() {
+						t.err = err
+						close(t.done)
+					})
+				}
+			}
+		}()
+	}
+	return t
+}
+
+// file queues the transfer of a file. It returns the error of a previous
+// transfer, which stops the tree transfer, instead.
+func (t *treeTransfer) file(transfer func() error) error {
+	select {
+	case t.files <- transfer:
+		return nil
+	case <-t.done:
+		return t.err
+	}
+}
+
+// dir adds the setting of the attributes of a directory, after the ones
+// added before.
+func (t *treeTransfer) dir(setAttrs func() error) {
+	t.dirs = append(t.dirs, setAttrs)
+}
+
+// wait waits for the transfers of the files, and then sets the attributes
+// of the directories, unless err, or the error of a transfer, is not nil.
+func (t *treeTransfer) wait(err error) error {
+	close(t.files)
+	t.wg.Wait()
+	if err != nil {
+		return err
+	}
+	if t.err != nil {
+		return t.err
+	}
+	for i := len(t.dirs) - 1; i >= 0; i-- {
+		if err := t.dirs[i](); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadDirDownloadDir(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-transferdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mtime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		"a":         "hello",
+		"sub/b":     "world",
+		"sub/sub/c": "again",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0640))
+		require.NoError(t, os.Chtimes(p, mtime, mtime))
+	}
+	require.NoError(t, os.Symlink("a", filepath.Join(src, "link")))
+	require.NoError(t, os.Chmod(filepath.Join(src, "sub"), 0750))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "sub"), mtime, mtime))
+
+	check := func(t *testing.T, root string) {
+		for name, content := range files {
+			p := filepath.Join(root, filepath.FromSlash(name))
+			b, err := ioutil.ReadFile(p)
+			require.NoError(t, err)
+			assert.Equal(t, content, string(b))
+			fi, err := os.Stat(p)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0640), fi.Mode().Perm(), name)
+			assert.True(t, fi.ModTime().Equal(mtime), "%s mtime %v", name, fi.ModTime())
+		}
+		target, err := os.Readlink(filepath.Join(root, "link"))
+		require.NoError(t, err)
+		assert.Equal(t, "a", target)
+
+		fi, err := os.Stat(filepath.Join(root, "sub"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+		assert.True(t, fi.ModTime().Equal(mtime), "sub mtime %v", fi.ModTime())
+	}
+
+	uploaded := filepath.Join(dir, "uploaded", "tree")
+	require.NoError(t, client.UploadDir(src, uploaded, WithWorkers(2)))
+	check(t, uploaded)
+	// again, over the files uploaded
+	require.NoError(t, client.UploadDir(src, uploaded))
+	check(t, uploaded)
+
+	downloaded := filepath.Join(dir, "downloaded")
+	require.NoError(t, client.DownloadDir(uploaded, downloaded))
+	check(t, downloaded)
+
+	// the links followed are copied as the files they point to
+	followed := filepath.Join(dir, "followed")
+	require.NoError(t, client.DownloadDir(uploaded, followed, WithSymlinks(SymlinkFollow)))
+	fi, err := os.Lstat(filepath.Join(followed, "link"))
+	require.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+
+	// the first error stops the transfer, before the directories are set
+	failed := filepath.Join(dir, "failed")
+	require.NoError(t, os.MkdirAll(filepath.Join(failed, "a"), 0755))
+	assert.Error(t, client.UploadDir(src, failed))
+	fi, err = os.Stat(filepath.Join(failed, "sub"))
+	require.NoError(t, err)
+	assert.False(t, fi.ModTime().Equal(mtime), "sub mtime %v", fi.ModTime())
+}
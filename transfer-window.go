@@ -0,0 +1,153 @@
+package sftp
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// minTransferWindow is the number of requests a transferWindow starts with,
+// and keeps in flight at least.
+const minTransferWindow = 4
+
+// transferWindowGain is how many times the bandwidth-delay product of the
+// link a transferWindow keeps in flight once settled, for the variations of
+// the round trips not to leave the link idle.
+const transferWindowGain = 2
+
+// transferWindow is the adaptive number of requests in flight of WriteTo
+// and ReadFrom, in the manner of a congestion window. It doubles each round,
+// the time its requests take to complete, while that increases the
+// throughput by a quarter at least, and then settles at the bandwidth-delay
+// product of the link, from the best throughput of a round and the shortest
+// round trip of a request, times transferWindowGain: enough requests to keep
+// the link busy, without queuing more at the server.
+//
+// The methods of a nil transferWindow do nothing, for a fixed number of
+// requests to be sent.
+type transferWindow struct {
+	max   int // requests
+	chunk int // bytes per request
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	size     int
+	inflight int
+	closed   bool
+
+	startup    bool
+	roundStart time.Time
+	roundBytes int64
+	roundDone  int
+	bestRate   float64 // bytes per second
+	minRTT     time.Duration
+}
+
+func newTransferWindow(max, chunk int) *transferWindow {
+	w := &transferWindow{
+		max:     max,
+		chunk:   chunk,
+		size:    minTransferWindow,
+		startup: true,
+	}
+	if w.size > max {
+		w.size = max
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// acquire waits for room in the window for a request, and returns the time
+// the request is sent at, or false once the window is closed.
+func (w *transferWindow) acquire() (time.Time, bool) {
+	if w == nil {
+		return time.Time{}, true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for !w.closed && w.inflight >= w.size {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return time.Time{}, false
+	}
+	w.inflight++
+	now := pkgClock.Now()
+	if w.roundStart.IsZero() {
+		w.roundStart = now
+	}
+	return now, true
+}
+
+// done releases the room of the request sent at sent, which transferred n
+// bytes, and resizes the window at the end of a round.
+func (w *transferWindow) done(sent time.Time, n int) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.inflight--
+	now := pkgClock.Now()
+	if rtt := now.Sub(sent); rtt > 0 && (w.minRTT == 0 || rtt < w.minRTT) {
+		w.minRTT = rtt
+	}
+	w.roundBytes += int64(n)
+	w.roundDone++
+	if w.roundDone >= w.size {
+		w.endRound(now)
+	}
+	w.cond.Broadcast()
+}
+
+func (w *transferWindow) endRound(now time.Time) {
+	elapsed := now.Sub(w.roundStart)
+	bytes := w.roundBytes
+	w.roundStart, w.roundBytes, w.roundDone = now, 0, 0
+	if elapsed <= 0 {
+		return
+	}
+
+	rate := float64(bytes) / elapsed.Seconds()
+	grew := rate >= w.bestRate*1.25
+	if rate > w.bestRate {
+		w.bestRate = rate
+	}
+
+	if w.startup && grew {
+		w.resize(2 * w.size)
+		return
+	}
+	w.startup = false
+
+	bdp := w.bestRate * w.minRTT.Seconds() / float64(w.chunk)
+	w.resize(int(math.Min(math.Ceil(bdp*transferWindowGain), float64(w.max))))
+}
+
+// resize sets the size of the window, within its bounds.
+func (w *transferWindow) resize(size int) {
+	if size < minTransferWindow {
+		size = minTransferWindow
+	}
+	if size > w.max {
+		size = w.max
+	}
+	w.size = size
+}
+
+// close fails the calls to acquire, waiting or to come.
+func (w *transferWindow) close() {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	w.cond.Broadcast()
+}
@@ -0,0 +1,88 @@
+package sftp
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// simulateTransfer sends n requests through w over a link transferring a
+// chunk each perChunk, with the round trip rtt on top, and returns the sizes
+// of the window seen.
+func simulateTransfer(t *testing.T, w *transferWindow, n int, rtt, perChunk time.Duration) []int {
+	clock := useFakeClock(t, time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+
+	type request struct {
+		sent, completes time.Time
+	}
+	var inflight []request
+	var linkFree time.Time
+	var sizes []int
+	for sent := 0; sent < n || len(inflight) > 0; {
+		for sent < n && w.inflight < w.size {
+			at, ok := w.acquire()
+			assert.True(t, ok)
+			// the chunks are transferred one at a time
+			start := at
+			if linkFree.After(start) {
+				start = linkFree
+			}
+			linkFree = start.Add(perChunk)
+			inflight = append(inflight, request{at, linkFree.Add(rtt)})
+			sent++
+		}
+
+		sort.Slice(inflight, func(i, j int) bool { return inflight[i].completes.Before(inflight[j].completes) })
+		next := inflight[0]
+		inflight = inflight[1:]
+		clock.Advance(next.completes.Sub(clock.Now()))
+		w.done(next.sent, w.chunk)
+		sizes = append(sizes, w.size)
+	}
+	return sizes
+}
+
+func TestTransferWindowSettles(t *testing.T) {
+	// 10ms round trips at a chunk per ms: 11 chunks in flight keep it busy
+	w := newTransferWindow(64, 32768)
+	sizes := simulateTransfer(t, w, 2000, 10*time.Millisecond, time.Millisecond)
+
+	assert.Equal(t, minTransferWindow, sizes[0])
+	assert.Contains(t, sizes, 2*minTransferWindow, "doubled")
+	assert.False(t, w.startup)
+	assert.Equal(t, 11*time.Millisecond, w.minRTT)
+	assert.Equal(t, 11*transferWindowGain, w.size)
+}
+
+func TestTransferWindowMax(t *testing.T) {
+	// the link is never busy: the window grows up to its max
+	w := newTransferWindow(16, 32768)
+	sizes := simulateTransfer(t, w, 2000, 100*time.Millisecond, time.Microsecond)
+	assert.Equal(t, 16, sizes[len(sizes)-1])
+
+	w = newTransferWindow(2, 32768)
+	assert.Equal(t, 2, w.size)
+	simulateTransfer(t, w, 100, 10*time.Millisecond, time.Millisecond)
+	assert.Equal(t, 2, w.size)
+}
+
+func TestTransferWindowClose(t *testing.T) {
+	w := newTransferWindow(1, 32768)
+	_, ok := w.acquire()
+	assert.True(t, ok)
+
+	acquired := make(chan bool)
+	go func() {
+		_, ok := w.acquire()
+		acquired <- ok
+	}()
+	w.close()
+	assert.False(t, <-acquired)
+
+	var nilWindow *transferWindow
+	_, ok = nilWindow.acquire()
+	assert.True(t, ok)
+	nilWindow.done(time.Time{}, 0)
+}
@@ -0,0 +1,236 @@
+package sftp
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// TransferOption configures a transfer between the local and remote sides,
+// such as by Upload and Download, or a walk of the tree, such as by Walk.
+// The options not relevant to an operation are ignored.
+type TransferOption func(*transferOptions)
+
+type transferOptions struct {
+	preserveMode    bool
+	preserveTimes   bool
+	preserveOwner   bool
+	symlinks        SymlinkPolicy
+	mmap            bool
+	sparse          bool
+	createParents   bool
+	verifyTail      int64
+	progress        func(transferred, total int64)
+	workers         int
+	matchLimit      int
+	walkConcurrency int
+}
+
+func newTransferOptions(opts []TransferOption) transferOptions {
+	var o transferOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// PreserveMode applies the permission bits of the source, including the
+// setuid, setgid and sticky bits, to the destination once transferred.
+func PreserveMode() TransferOption {
+	return func(o *transferOptions) {
+		o.preserveMode = true
+	}
+}
+
+// PreserveTimes applies the modification time of the source to the
+// destination once transferred. The access time is set to the current time.
+func PreserveTimes() TransferOption {
+	return func(o *transferOptions) {
+		o.preserveTimes = true
+	}
+}
+
+// PreserveOwner applies the user and group IDs of the source, where known,
+// to the destination once transferred. Changing the owner usually requires
+// privileges on the destination side, and is not supported on all systems.
+func PreserveOwner() TransferOption {
+	return func(o *transferOptions) {
+		o.preserveOwner = true
+	}
+}
+
+// UseMmap memory-maps the regular local files read by an upload, and sends
+// the data of the writes straight from the mapping, instead of copying it
+// through buffers, which saves CPU on multi-gigabyte uploads. The local files
+// must not be truncated while being uploaded: reading the part of a mapping
+// past the end of its file crashes the program. Platforms without mmap, and
+// the files that cannot be mapped, are read as usual.
+func UseMmap() TransferOption {
+	return func(o *transferOptions) {
+		o.mmap = true
+	}
+}
+
+// CreateParents creates the missing parent directories of the remote files
+// uploaded, like MkdirAll. Directories created at the same time by another
+// client are used as they are.
+func CreateParents() TransferOption {
+	return func(o *transferOptions) {
+		o.createParents = true
+	}
+}
+
+// Upload copies the local file localPath to remotePath, creating or
+// truncating it, like the put command of sftp(1).
+// The attributes selected by opts are applied once the content is copied.
+func (c *Client) Upload(localPath, remotePath string, opts ...TransferOption) error {
+	o := newTransferOptions(opts)
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := c.createFile(context.Background(), remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, o.createParents)
+	if err != nil {
+		return err
+	}
+	dst.SetProgress(o.progress)
+	dst.SetSparse(o.sparse)
+	if err := upload(dst, src, fi, o); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		short, ok := err.(*ShortWriteError)
+		if !ok {
+			return err
+		}
+		if err := c.rewrite(remotePath, src, short); err != nil {
+			return err
+		}
+	}
+
+	return preserveAttrs(c, remotePath, fi, o)
+}
+
+// upload writes the content of src, with the FileInfo fi, to dst.
+func upload(dst *File, src *os.File, fi os.FileInfo, o transferOptions) error {
+	if o.mmap {
+		if mapped := mmapRegular(src, fi); mapped != nil {
+			n, err := writeMapped(dst, mapped, o)
+			dst.newProgress(int64(len(mapped))).add(n)
+			if err2 := munmapFile(mapped); err == nil {
+				err = err2
+			}
+			return err
+		}
+	}
+	_, err := dst.ReadFrom(src)
+	return err
+}
+
+// writeMapped writes the memory-mapped content of a local file to dst.
+func writeMapped(dst *File, mapped []byte, o transferOptions) (int, error) {
+	if !o.sparse {
+		return dst.WriteAt(mapped, 0)
+	}
+	n, err := dst.writeSparseAt(mapped, 0)
+	if err == nil && mapped[len(mapped)-1] == 0 {
+		err = dst.extendSparse(int64(len(mapped)))
+	}
+	return n, err
+}
+
+// Download copies the remote file remotePath to localPath, creating it with
+// mode 0666 (before umask) or truncating it, like the get command of sftp(1).
+// The attributes selected by opts are applied once the content is copied.
+func (c *Client) Download(remotePath, localPath string, opts ...TransferOption) error {
+	o := newTransferOptions(opts)
+
+	src, err := c.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	src.SetProgress(o.progress)
+	src.SetSparse(o.sparse)
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := src.WriteTo(dst); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return preserveAttrs(localAttrs{}, localPath, fi, o)
+}
+
+// attrSetter sets the attributes of the files on one side of a transfer,
+// as implemented by Client for the remote side.
+type attrSetter interface {
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// localAttrs sets the attributes of the local files.
+type localAttrs struct{}
+
+func (localAttrs) Chmod(name string, mode os.FileMode) error { return os.Chmod(name, mode) }
+func (localAttrs) Chown(name string, uid, gid int) error     { return os.Chown(name, uid, gid) }
+func (localAttrs) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// preserveAttrs applies the attributes of src selected by o to the
+// destination name. The owner goes first, as changing it may clear the
+// setuid and setgid bits, and the times last.
+func preserveAttrs(dst attrSetter, name string, src os.FileInfo, o transferOptions) error {
+	if o.preserveOwner {
+		if uid, gid, ok := fileOwner(src); ok {
+			if err := dst.Chown(name, int(uid), int(gid)); err != nil {
+				return err
+			}
+		}
+	}
+	if o.preserveMode {
+		const mask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+		if err := dst.Chmod(name, src.Mode()&mask); err != nil {
+			return err
+		}
+	}
+	if o.preserveTimes {
+		if err := dst.Chtimes(name, pkgClock.Now(), src.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileOwner returns the user and group IDs of a local or remote file,
+// if known.
+func fileOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	if fs, ok := fi.Sys().(*FileStat); ok {
+		return fs.UID, fs.GID, true
+	}
+	flags, fs := fileStatFromInfo(fi)
+	if flags&sshFileXferAttrUIDGID == 0 {
+		return 0, 0, false
+	}
+	return fs.UID, fs.GID, true
+}
@@ -0,0 +1,125 @@
+package sftp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadDownload(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-transfer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mtime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	src := filepath.Join(dir, "src")
+	require.NoError(t, ioutil.WriteFile(src, []byte("hello"), 0600))
+	require.NoError(t, os.Chmod(src, 0751))
+	require.NoError(t, os.Chtimes(src, mtime, mtime))
+
+	uid, gid := os.Getuid(), os.Getgid()
+
+	check := func(t *testing.T, name string, preserved bool) {
+		b, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+
+		fi, err := os.Stat(name)
+		require.NoError(t, err)
+		if preserved {
+			assert.Equal(t, os.FileMode(0751), fi.Mode().Perm())
+			assert.True(t, fi.ModTime().Equal(mtime), "mtime %v", fi.ModTime())
+			owner, group, ok := fileOwner(fi)
+			require.True(t, ok)
+			assert.Equal(t, uint32(uid), owner)
+			assert.Equal(t, uint32(gid), group)
+		} else {
+			assert.False(t, fi.ModTime().Equal(mtime), "mtime %v", fi.ModTime())
+		}
+	}
+
+	opts := []TransferOption{PreserveMode(), PreserveTimes(), PreserveOwner()}
+
+	t.Run("Upload", func(t *testing.T) {
+		dst := filepath.Join(dir, "uploaded")
+		require.NoError(t, client.Upload(src, dst))
+		check(t, dst, false)
+
+		require.NoError(t, client.Upload(src, dst, opts...))
+		check(t, dst, true)
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		dst := filepath.Join(dir, "downloaded")
+		require.NoError(t, client.Download(src, dst))
+		check(t, dst, false)
+
+		require.NoError(t, client.Download(src, dst, opts...))
+		check(t, dst, true)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		err := client.Upload(filepath.Join(dir, "missing"), filepath.Join(dir, "dst"))
+		assert.True(t, os.IsNotExist(err), "%v", err)
+		err = client.Download(filepath.Join(dir, "missing"), filepath.Join(dir, "dst"))
+		assert.True(t, os.IsNotExist(err), "%v", err)
+	})
+}
+
+func TestUploadCreateParents(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-transfer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	require.NoError(t, ioutil.WriteFile(src, []byte("hello"), 0600))
+
+	err = p.cli.Upload(src, "/a/b/file")
+	assert.True(t, os.IsNotExist(err), "%v", err)
+	require.NoError(t, p.cli.Upload(src, "/a/b/file", CreateParents()))
+	data, err := getTestFile(p.cli, "/a/b/file")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// clients creating the same directories at once
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := p.cli.CreateAll(fmt.Sprintf("/c/d/e/file%d", i))
+			if err == nil {
+				err = f.Close()
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	entries, err := p.cli.ReadDir("/c/d/e")
+	require.NoError(t, err)
+	assert.Len(t, entries, cap(errs))
+
+	_, err = p.cli.CreateAll("/a/b/file/file")
+	assert.Error(t, err)
+}
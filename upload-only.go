@@ -0,0 +1,46 @@
+package sftp
+
+import "syscall"
+
+// UploadOnly configures a Server as a drop box, for the clients to deliver
+// files they cannot read back: files are created and written, but never
+// read, listed or overwritten. The files opened are created, as if opened
+// with os.O_EXCL, so that opening a file which exists fails, and only the
+// files just created are written. The directories can be created, and the
+// files and directories stated, as the clients do to upload into a
+// directory, but nothing is removed, renamed or linked.
+//
+// The other requests fail with a permission denied.
+func UploadOnly() ServerOption {
+	return func(s *Server) error {
+		s.uploadOnly = true
+		return nil
+	}
+}
+
+// checkUploadOnly returns the error failing pkt, if denied by UploadOnly,
+// making the open requests create the files.
+func checkUploadOnly(pkt requestPacket) error {
+	switch p := pkt.(type) {
+	case *sshFxpOpenPacket:
+		// possibly for reading too, as by Client.Create, the reads being denied
+		if !p.hasPflags(sshFxfWrite, sshFxfCreat) {
+			return syscall.EPERM
+		}
+		// never overwritten, be it by a staged upload
+		p.Pflags |= sshFxfExcl
+		return nil
+	case *sshFxInitPacket, *sshFxpWritePacket, *sshFxpClosePacket,
+		*sshFxpFstatPacket, *sshFxpFsetstatPacket,
+		*sshFxpStatPacket, *sshFxpLstatPacket, *sshFxpRealpathPacket,
+		*sshFxpMkdirPacket:
+		return nil
+	case *sshFxpExtendedPacket:
+		switch p.SpecificPacket.(type) {
+		case *sshFxpExtendedPacketFsync, *sshFxpExtendedPacketStatVFS,
+			*sshFxpExtendedPacketLimits:
+			return nil
+		}
+	}
+	return syscall.EPERM
+}
@@ -0,0 +1,109 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerUploadOnly(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t, UploadOnly())
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-upload-only")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	f, err := client.Create(name)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = f.ReadAt(make([]byte, 5), 0)
+	assert.True(t, os.IsPermission(err), err)
+	require.NoError(t, f.Close())
+	b, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// stated, not read nor listed
+	fi, err := client.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), fi.Size())
+	_, err = client.Open(name)
+	assert.True(t, os.IsPermission(err), err)
+	_, err = client.ReadDir(dir)
+	assert.True(t, os.IsPermission(err), err)
+	_, err = client.ReadLink(name)
+	assert.True(t, os.IsPermission(err), err)
+
+	// not overwritten
+	_, err = client.Create(name)
+	assert.Error(t, err)
+	_, err = client.OpenFile(name, os.O_WRONLY)
+	assert.True(t, os.IsPermission(err), err)
+	assert.True(t, os.IsPermission(client.Truncate(name, 0)))
+	assert.True(t, os.IsPermission(client.Remove(name)))
+	assert.True(t, os.IsPermission(client.Rename(name, name+".old")))
+	assert.True(t, os.IsPermission(client.PosixRename(filepath.Join(dir, "other"), name)))
+	b, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// uploaded into new directories
+	require.NoError(t, client.Mkdir(filepath.Join(dir, "sub")))
+	f, err = client.OpenFile(filepath.Join(dir, "sub", "file"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	b, err = ioutil.ReadFile(filepath.Join(dir, "sub", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+}
+
+func TestServerUploadOnlyStaged(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	client, server := clientServerPair(t, UploadOnly(), WithStagedUploads())
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-upload-only")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(name, []byte("hello"), 0644))
+	_, err = client.Create(name)
+	assert.Error(t, err)
+	b, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	fis, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, fis, 1)
+	// nor replaced by an upload staged before it is created
+	name = filepath.Join(dir, "later")
+	f, err := client.Create(name)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("upload"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(name, []byte("hello"), 0644))
+	assert.Error(t, f.Close())
+	b, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	fis, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, fis, 2)
+}
@@ -0,0 +1,222 @@
+package sftp
+
+// usersGroupsExtension looks up the names of users and groups by their
+// IDs, as specified by the PROTOCOL file of OpenSSH, for clients to show
+// the owners of files under the protocol version 3, which only has IDs.
+const usersGroupsExtension = "users-groups-by-id@openssh.com"
+
+// NamesLookup looks up the names of the users and groups of a server by
+// their IDs, returning "" for the IDs unknown. Servers set with one, see
+// WithNamesLookup and WithRSNamesLookup, answer the names to the clients
+// asking with Client.UserGroupNames, and list them as the owners and groups
+// of the directory entries in the default longnames.
+type NamesLookup interface {
+	LookupUserName(uid uint32) string
+	LookupGroupName(gid uint32) string
+}
+
+// WithNamesLookup sets the lookup of the names of users and groups the
+// Server answers with, and lists in the longnames of the directory entries
+// unless a LongNameFormatter is set.
+//
+// The RequestServer equivalent is WithRSNamesLookup.
+func WithNamesLookup(names NamesLookup) ServerOption {
+	return func(s *Server) error {
+		s.names = names
+		return nil
+	}
+}
+
+// WithRSNamesLookup sets the lookup of the names of users and groups the
+// RequestServer answers with, and lists in the longnames of the directory
+// entries unless a LongNameFormatter is set.
+//
+// The Server equivalent is WithNamesLookup.
+func WithRSNamesLookup(names NamesLookup) RequestServerOption {
+	return func(rs *RequestServer) {
+		rs.names = names
+	}
+}
+
+// withUsersGroups adds usersGroupsExtension to exts, for a server with a
+// lookup of names.
+func withUsersGroups(exts []sshExtensionPair, names NamesLookup) []sshExtensionPair {
+	if names == nil {
+		return exts
+	}
+	return append(exts, sshExtensionPair{usersGroupsExtension, "1"})
+}
+
+type sshFxpExtendedPacketUsersGroupsByID struct {
+	ID              uint32
+	ExtendedRequest string
+	UIDs            []uint32
+	GIDs            []uint32
+}
+
+func (p *sshFxpExtendedPacketUsersGroupsByID) id() uint32     { return p.ID }
+func (p *sshFxpExtendedPacketUsersGroupsByID) readonly() bool { return true }
+func (p *sshFxpExtendedPacketUsersGroupsByID) MarshalBinary() ([]byte, error) {
+	l := 4 + 1 + 4 + // uint32(length) + byte(type) + uint32(id)
+		4 + len(usersGroupsExtension) +
+		4 + 4*len(p.UIDs) +
+		4 + 4*len(p.GIDs)
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtended)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, usersGroupsExtension)
+	for _, ids := range [][]uint32{p.UIDs, p.GIDs} {
+		b = marshalUint32(b, uint32(4*len(ids)))
+		for _, id := range ids {
+			b = marshalUint32(b, id)
+		}
+	}
+
+	return b, nil
+}
+
+func (p *sshFxpExtendedPacketUsersGroupsByID) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.ExtendedRequest, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+	for _, ids := range []*[]uint32{&p.UIDs, &p.GIDs} {
+		var s string
+		if s, b, err = unmarshalStringSafe(b); err != nil {
+			return err
+		}
+		if len(s)%4 != 0 {
+			return errShortPacket
+		}
+		data := []byte(s)
+		*ids = make([]uint32, 0, len(s)/4)
+		for len(data) > 0 {
+			var id uint32
+			id, data = unmarshalUint32(data)
+			*ids = append(*ids, id)
+		}
+	}
+	return nil
+}
+
+func (p *sshFxpExtendedPacketUsersGroupsByID) respond(s *Server) responsePacket {
+	return usersGroupsReply(p, s.names)
+}
+
+// usersGroupsReply returns the names of the IDs of p, as looked up by
+// names.
+func usersGroupsReply(p *sshFxpExtendedPacketUsersGroupsByID, names NamesLookup) responsePacket {
+	if names == nil {
+		return statusFromError(p.ID, ErrSSHFxOpUnsupported)
+	}
+	reply := &sshFxpUsersGroupsPacket{
+		ID:     p.ID,
+		Users:  make([]string, len(p.UIDs)),
+		Groups: make([]string, len(p.GIDs)),
+	}
+	for i, uid := range p.UIDs {
+		reply.Users[i] = names.LookupUserName(uid)
+	}
+	for i, gid := range p.GIDs {
+		reply.Groups[i] = names.LookupGroupName(gid)
+	}
+	return reply
+}
+
+// sshFxpUsersGroupsPacket is the SSH_FXP_EXTENDED_REPLY to
+// users-groups-by-id@openssh.com, with the names in the order of the IDs.
+type sshFxpUsersGroupsPacket struct {
+	ID     uint32
+	Users  []string
+	Groups []string
+}
+
+func (p *sshFxpUsersGroupsPacket) id() uint32 { return p.ID }
+
+func (p *sshFxpUsersGroupsPacket) MarshalBinary() ([]byte, error) {
+	l := 4 + 1 + 4 // uint32(length) + byte(type) + uint32(id)
+	for _, names := range [][]string{p.Users, p.Groups} {
+		l += 4
+		for _, name := range names {
+			l += 4 + len(name)
+		}
+	}
+
+	b := make([]byte, 4, l)
+	b = append(b, sshFxpExtendedReply)
+	b = marshalUint32(b, p.ID)
+	for _, names := range [][]string{p.Users, p.Groups} {
+		var list []byte
+		for _, name := range names {
+			list = marshalString(list, name)
+		}
+		b = marshalString(b, string(list))
+	}
+
+	return b, nil
+}
+
+// UserGroupNames returns the names of the users uids and of the groups
+// gids on the server, in the same order, with "" for the IDs the server
+// does not know. The server must support the users-groups-by-id@openssh.com
+// extension; otherwise ErrExtensionNotSupported is returned.
+func (c *Client) UserGroupNames(uids, gids []uint32) (users, groups []string, err error) {
+	if err := c.RequireExtension(usersGroupsExtension); err != nil {
+		return nil, nil, err
+	}
+
+	id := c.nextID()
+	typ, data, err := c.sendPacket(nil, &sshFxpExtendedPacketUsersGroupsByID{
+		ID:   id,
+		UIDs: uids,
+		GIDs: gids,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch typ {
+	case sshFxpExtendedReply:
+		sid, data, err := unmarshalUint32Safe(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sid != id {
+			return nil, nil, &unexpectedIDErr{id, sid}
+		}
+		if users, data, err = unmarshalNames(data, len(uids)); err != nil {
+			return nil, nil, err
+		}
+		if groups, _, err = unmarshalNames(data, len(gids)); err != nil {
+			return nil, nil, err
+		}
+		return users, groups, nil
+	case sshFxpStatus:
+		return nil, nil, normaliseError(unmarshalStatus(id, data))
+	default:
+		return nil, nil, unimplementedPacketErr(typ)
+	}
+}
+
+// unmarshalNames decodes the string of the n names of a reply to
+// users-groups-by-id@openssh.com.
+func unmarshalNames(b []byte, n int) ([]string, []byte, error) {
+	s, b, err := unmarshalStringSafe(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	list := []byte(s)
+	names := make([]string, n)
+	for i := range names {
+		if names[i], list, err = unmarshalStringSafe(list); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(list) > 0 {
+		return nil, nil, errLongPacket
+	}
+	return names, b, nil
+}
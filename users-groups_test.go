@@ -0,0 +1,91 @@
+package sftp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mapNames looks up the names of its maps.
+type mapNames struct {
+	users, groups map[uint32]string
+}
+
+func (n mapNames) LookupUserName(uid uint32) string  { return n.users[uid] }
+func (n mapNames) LookupGroupName(gid uint32) string { return n.groups[gid] }
+
+func testNames(uid, gid uint32) mapNames {
+	return mapNames{
+		users:  map[uint32]string{uid: "gopher"},
+		groups: map[uint32]string{gid: "burrow"},
+	}
+}
+
+func checkUserGroupNames(t *testing.T, c *Client, uid, gid uint32) {
+	users, groups, err := c.UserGroupNames([]uint32{uid, uid + 1}, []uint32{gid + 1, gid, gid + 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gopher", ""}, users)
+	assert.Equal(t, []string{"", "burrow", ""}, groups)
+
+	users, groups, err = c.UserGroupNames(nil, nil)
+	require.NoError(t, err)
+	assert.Empty(t, users)
+	assert.Empty(t, groups)
+}
+
+func TestServerUsersGroups(t *testing.T) {
+	skipIfWindows(t)
+	skipIfPlan9(t)
+
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	client, server := clientServerPair(t, WithNamesLookup(testNames(uid, gid)))
+	defer client.Close()
+	defer server.Close()
+
+	checkUserGroupNames(t, client, uid, gid)
+
+	dir, err := ioutil.TempDir("", "sftptest-names")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(p, []byte("data"), 0644))
+	fi, err := os.Stat(p)
+	require.NoError(t, err)
+
+	longName := FormatLongName(dir, fi)
+	if !strings.Contains(longName, " "+strconv.Itoa(os.Getuid())+" ") {
+		t.Skip("no IDs in the longnames of this build")
+	}
+	longNames := readdirLongNames(t, client, dir)
+	require.Len(t, longNames, 1)
+	assert.Regexp(t, `^-rw-r--r-- +1 gopher +burrow +4 .* file$`, longNames[0])
+}
+
+func TestRequestUsersGroups(t *testing.T) {
+	p := clientRequestServerPair(t, WithRSNamesLookup(testNames(65534, 65534)))
+	defer p.Close()
+
+	checkUserGroupNames(t, p.cli, 65534, 65534)
+
+	putTestFile(p.cli, "/file", "data")
+	longNames := readdirLongNames(t, p.cli, "/")
+	require.Len(t, longNames, 1)
+	assert.Regexp(t, `^-rw-r--r-- +0 gopher +burrow +4 .* file$`, longNames[0])
+}
+
+func TestUserGroupNamesUnsupported(t *testing.T) {
+	p := clientRequestServerPair(t)
+	defer p.Close()
+
+	_, ok := p.cli.HasExtension(usersGroupsExtension)
+	assert.False(t, ok)
+	_, _, err := p.cli.UserGroupNames([]uint32{0}, nil)
+	assert.True(t, errors.Is(err, ErrExtensionNotSupported), "got %v", err)
+}
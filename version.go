@@ -0,0 +1,237 @@
+package sftp
+
+import (
+	"github.com/pkg/errors"
+)
+
+// maxProtocolVersion is the highest version of the protocol the Client
+// speaks, see https://tools.ietf.org/html/draft-ietf-secsh-filexfer-13
+const maxProtocolVersion = 6
+
+// The desired access of the SSH_FXP_OPEN of the protocol versions 5 and
+// later, as ACE4 masks.
+const (
+	ace4ReadData        = 0x00000001
+	ace4WriteData       = 0x00000002
+	ace4AppendData      = 0x00000004
+	ace4ReadAttributes  = 0x00000080
+	ace4WriteAttributes = 0x00000100
+)
+
+// The flags of the SSH_FXP_OPEN of the protocol versions 5 and later.
+const (
+	sshFxfAccessDisposition = 0x00000007
+	sshFxfCreateNew         = 0x00000000
+	sshFxfCreateTruncate    = 0x00000001
+	sshFxfOpenExisting      = 0x00000002
+	sshFxfOpenOrCreate      = 0x00000003
+	sshFxfTruncateExisting  = 0x00000004
+	sshFxfAppendData        = 0x00000008
+	sshFxfAppendDataAtomic  = 0x00000010
+	sshFxfTextMode          = 0x00000020
+	sshFxfBlockRead         = 0x00000040
+	sshFxfBlockWrite        = 0x00000080
+	sshFxfBlockDelete       = 0x00000100
+	sshFxfBlockAdvisory     = 0x00000200
+)
+
+// The flags of the SSH_FXP_RENAME of the protocol versions 5 and later.
+const (
+	sshFxfRenameOverwrite = 0x00000001
+	sshFxfRenameAtomic    = 0x00000002
+	sshFxfRenameNative    = 0x00000004
+)
+
+// MaxProtocolVersion sets the highest version of the SFTP protocol the
+// Client negotiates, from 3, the default and the only version most servers
+// speak, to 6. The server answers with the version to use, returned by
+// ProtocolVersion.
+//
+// With the versions 4 and later, the attributes the version 3 has no room
+// for, such as the creation times and the owner and group names of the
+// files, are held by the V4 of the FileStat returned by the Sys method of
+// their os.FileInfo. Chown sends the uid and gid as numeric owner and
+// group names.
+func MaxProtocolVersion(version int) ClientOption {
+	return func(c *Client) error {
+		if version < sftpProtocolVersion || version > maxProtocolVersion {
+			return errors.Errorf("protocol version must be from %d to %d", sftpProtocolVersion, maxProtocolVersion)
+		}
+		c.maxVersion = uint32(version)
+		return nil
+	}
+}
+
+// ProtocolVersion returns the version of the SFTP protocol negotiated with
+// the server, see MaxProtocolVersion.
+func (c *Client) ProtocolVersion() int {
+	return int(c.version)
+}
+
+// requestedVersion returns the version of the protocol sent to the server.
+func (c *Client) requestedVersion() uint32 {
+	if c.maxVersion == 0 {
+		return sftpProtocolVersion
+	}
+	return c.maxVersion
+}
+
+// unmarshalAttrs unmarshals the attributes of a response, in the layout of
+// the version negotiated.
+func (c *Client) unmarshalAttrs(b []byte) (*FileStat, []byte, error) {
+	if c.version <= sftpProtocolVersion {
+		fs, b := unmarshalAttrs(b)
+		return fs, b, nil
+	}
+	return unmarshalAttrsV4(b, c.version)
+}
+
+// versioned returns p marshalled in the layout of the version negotiated,
+// for the packets the versions 4 and later changed.
+func (c *Client) versioned(p idmarshaler) idmarshaler {
+	if c.version <= sftpProtocolVersion {
+		return p
+	}
+	switch p.(type) {
+	case *sshFxpStatPacket, *sshFxpLstatPacket, *sshFxpFstatPacket,
+		*sshFxpSetstatPacket, *sshFxpFsetstatPacket, *sshFxpOpenPacket,
+		*sshFxpMkdirPacket, *sshFxpSymlinkPacket:
+		return &versionedPacket{p, c.version}
+	case *sshFxpRenamePacket:
+		if c.version >= 5 {
+			return &versionedPacket{p, c.version}
+		}
+	}
+	return p
+}
+
+// versionedPacket is a packet of the version 3 layout, marshalled in the
+// layout of the version 4 or later.
+type versionedPacket struct {
+	idmarshaler
+	version uint32
+}
+
+func (p *versionedPacket) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 4, 64)
+	switch pkt := p.idmarshaler.(type) {
+	case *sshFxpStatPacket:
+		b = append(b, sshFxpStat)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalString(b, pkt.Path)
+		b = marshalUint32(b, p.statFlags())
+	case *sshFxpLstatPacket:
+		b = append(b, sshFxpLstat)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalString(b, pkt.Path)
+		b = marshalUint32(b, p.statFlags())
+	case *sshFxpFstatPacket:
+		b = append(b, sshFxpFstat)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalString(b, pkt.Handle)
+		b = marshalUint32(b, p.statFlags())
+	case *sshFxpSetstatPacket:
+		b = append(b, sshFxpSetstat)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalString(b, pkt.Path)
+		b = p.attrs(b, pkt.Flags, pkt.Attrs, sshFileXferTypeUnknown)
+	case *sshFxpFsetstatPacket:
+		b = append(b, sshFxpFsetstat)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalString(b, pkt.Handle)
+		b = p.attrs(b, pkt.Flags, pkt.Attrs, sshFileXferTypeUnknown)
+	case *sshFxpOpenPacket:
+		b = append(b, sshFxpOpen)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalString(b, pkt.Path)
+		if p.version >= 5 {
+			access, flags := openFlagsV5(pkt.Pflags)
+			b = marshalUint32(b, access)
+			b = marshalUint32(b, flags)
+		} else {
+			b = marshalUint32(b, pkt.Pflags)
+		}
+		b = p.attrs(b, pkt.Flags, pkt.Attrs, sshFileXferTypeRegular)
+	case *sshFxpMkdirPacket:
+		b = append(b, sshFxpMkdir)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalString(b, pkt.Path)
+		b = p.attrs(b, 0, nil, sshFileXferTypeDirectory)
+	case *sshFxpSymlinkPacket:
+		if p.version >= 6 {
+			b = append(b, sshFxpLink)
+			b = marshalUint32(b, pkt.ID)
+			b = marshalString(b, pkt.Linkpath)
+			b = marshalString(b, pkt.Targetpath)
+			b = append(b, 1) // symbolic
+			break
+		}
+		// the order of the paths of the specification, not OpenSSH's
+		b = append(b, sshFxpSymlink)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalString(b, pkt.Linkpath)
+		b = marshalString(b, pkt.Targetpath)
+	case *sshFxpRenamePacket:
+		b = append(b, sshFxpRename)
+		b = marshalUint32(b, pkt.ID)
+		b = marshalString(b, pkt.Oldpath)
+		b = marshalString(b, pkt.Newpath)
+		b = marshalUint32(b, 0) // rename flags
+	default:
+		return p.idmarshaler.MarshalBinary()
+	}
+	return b, nil
+}
+
+// statFlags returns the attributes requested by the *STAT of the version.
+func (p *versionedPacket) statFlags() uint32 {
+	flags := uint32(sshFileXferAttrSize | sshFileXferAttrPermissions |
+		sshFileXferAttrAccessTime | sshFileXferAttrCreateTime |
+		sshFileXferAttrModifyTime | sshFileXferAttrACL |
+		sshFileXferAttrOwnerGroup | sshFileXferAttrSubsecondTimes)
+	if p.version >= 5 {
+		flags |= sshFileXferAttrBits
+	}
+	if p.version >= 6 {
+		flags |= sshFileXferAttrAllocationSize | sshFileXferAttrTextHint |
+			sshFileXferAttrMimeType | sshFileXferAttrLinkCount |
+			sshFileXferAttrUntranslatedName | sshFileXferAttrCtime
+	}
+	return flags
+}
+
+// attrs marshals the attributes of the v3 flags, of a file of the type
+// typ.
+func (p *versionedPacket) attrs(b []byte, flags uint32, attrs interface{}, typ uint8) []byte {
+	fs, _ := getFileStat(flags, marshal(nil, attrs))
+	return marshalAttrsV4(b, p.version, attrsV4FromV3(flags, fs, typ))
+}
+
+// openFlagsV5 returns the desired access and the flags of the SSH_FXP_OPEN
+// of the versions 5 and later for the v3 pflags.
+func openFlagsV5(pflags uint32) (access, flags uint32) {
+	if pflags&sshFxfRead != 0 {
+		access |= ace4ReadData | ace4ReadAttributes
+	}
+	if pflags&sshFxfWrite != 0 {
+		access |= ace4WriteData | ace4WriteAttributes
+	}
+	if pflags&sshFxfAppend != 0 {
+		access |= ace4AppendData
+		flags |= sshFxfAppendData
+	}
+
+	switch {
+	case pflags&(sshFxfCreat|sshFxfExcl) == sshFxfCreat|sshFxfExcl:
+		flags |= sshFxfCreateNew
+	case pflags&(sshFxfCreat|sshFxfTrunc) == sshFxfCreat|sshFxfTrunc:
+		flags |= sshFxfCreateTruncate
+	case pflags&sshFxfCreat != 0:
+		flags |= sshFxfOpenOrCreate
+	case pflags&sshFxfTrunc != 0:
+		flags |= sshFxfTruncateExisting
+	default:
+		flags |= sshFxfOpenExisting
+	}
+	return access, flags
+}
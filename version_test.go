@@ -0,0 +1,174 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxProtocolVersionFallback(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	require.NoError(t, err)
+	go server.Serve()
+
+	assert.Error(t, MaxProtocolVersion(2)(&Client{}))
+	assert.Error(t, MaxProtocolVersion(7)(&Client{}))
+
+	client, err := NewClientPipe(cr, cw, MaxProtocolVersion(6))
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	// the Server speaks version 3 only
+	assert.Equal(t, 3, client.ProtocolVersion())
+	_, err = client.Stat(os.TempDir())
+	assert.NoError(t, err)
+}
+
+// rawPacket is a packet of the type typ with the payload data.
+type rawPacket struct {
+	typ  byte
+	data []byte
+}
+
+func (p rawPacket) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 4, 5+len(p.data))
+	b = append(b, p.typ)
+	return append(b, p.data...), nil
+}
+
+func TestProtocolVersion6(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	recv := func(want byte) []byte {
+		typ, data, err := recvPacket(sr, nil, 0)
+		require.NoError(t, err)
+		require.Equal(t, fxp(want), fxp(typ))
+		return data
+	}
+	send := func(typ byte, data []byte) {
+		require.NoError(t, sendPacket(sw, rawPacket{typ, data}))
+	}
+	id := func(data []byte) []byte {
+		return append([]byte(nil), data[:4]...)
+	}
+
+	attrs := marshalUint32(nil, sshFileXferAttrSize|sshFileXferAttrOwnerGroup|
+		sshFileXferAttrPermissions|sshFileXferAttrAccessTime|sshFileXferAttrCreateTime|
+		sshFileXferAttrModifyTime|sshFileXferAttrSubsecondTimes|sshFileXferAttrACL)
+	attrs = append(attrs, sshFileXferTypeRegular)
+	attrs = marshalUint64(attrs, 42)
+	attrs = marshalString(attrs, "alice")
+	attrs = marshalString(attrs, "staff")
+	attrs = marshalUint32(attrs, 0644)
+	for _, sec := range []uint64{100, 200, 300} {
+		attrs = marshalUint64(attrs, sec)
+		attrs = marshalUint32(attrs, uint32(sec/100))
+	}
+	acl := marshalUint32(nil, 0) // acl-flags
+	acl = marshalUint32(acl, 1)
+	acl = append(acl, make([]byte, 8)...)
+	acl = marshalUint32(acl, ace4ReadData)
+	acl = marshalString(acl, "EVERYONE@")
+	attrs = marshalString(attrs, string(acl))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		version, _ := unmarshalUint32(recv(sshFxpInit))
+		assert.EqualValues(t, 6, version)
+		send(sshFxpVersion, marshalUint32(nil, 6))
+
+		stat := recv(sshFxpStat)
+		p, rest := unmarshalString(stat[4:])
+		assert.Equal(t, "/file", p)
+		flags, _ := unmarshalUint32(rest)
+		assert.NotZero(t, flags&sshFileXferAttrCreateTime)
+		send(sshFxpAttrs, append(id(stat), attrs...))
+
+		open := recv(sshFxpOpen)
+		p, rest = unmarshalString(open[4:])
+		assert.Equal(t, "/new", p)
+		access, rest := unmarshalUint32(rest)
+		assert.EqualValues(t, ace4ReadData|ace4ReadAttributes|ace4WriteData|ace4WriteAttributes, access)
+		flags, rest = unmarshalUint32(rest)
+		assert.EqualValues(t, sshFxfCreateTruncate, flags)
+		assert.Equal(t, []byte{0, 0, 0, 0, sshFileXferTypeRegular}, rest)
+		send(sshFxpStatus, marshalUint32(id(open), sshFxPermissionDenied))
+
+		link := recv(sshFxpLink)
+		newPath, rest := unmarshalString(link[4:])
+		existing, rest := unmarshalString(rest)
+		assert.Equal(t, []string{"/link", "target"}, []string{newPath, existing})
+		assert.Equal(t, []byte{1}, rest)
+		send(sshFxpStatus, marshalUint32(id(link), sshFxOk))
+	}()
+
+	client, err := NewClientPipe(cr, cw, MaxProtocolVersion(6))
+	require.NoError(t, err)
+	defer client.Close()
+	defer sw.Close()
+	assert.Equal(t, 6, client.ProtocolVersion())
+
+	fi, err := client.Stat("/file")
+	require.NoError(t, err)
+	assert.EqualValues(t, 42, fi.Size())
+	assert.Equal(t, os.FileMode(0644), fi.Mode())
+	assert.Equal(t, time.Unix(300, 3), fi.ModTime())
+
+	fs := fi.Sys().(*FileStat)
+	require.NotNil(t, fs.V4)
+	assert.EqualValues(t, 100, fs.Atime)
+	assert.Equal(t, "alice", fs.V4.Owner)
+	assert.Equal(t, "staff", fs.V4.Group)
+	assert.Equal(t, int64(200), fs.V4.Createtime)
+	assert.EqualValues(t, 2, fs.V4.CreatetimeNsec)
+	assert.Equal(t, []ACE{{Mask: ace4ReadData, Who: "EVERYONE@"}}, fs.V4.ACL)
+
+	_, err = client.Create("/new")
+	assert.True(t, os.IsPermission(err), "%v", err)
+
+	assert.NoError(t, client.Symlink("target", "/link"))
+	<-done
+}
+
+func TestAttrsV4RoundTrip(t *testing.T) {
+	for version := uint32(4); version <= maxProtocolVersion; version++ {
+		fs := &FileStat{
+			Size: 7,
+			Mode: syscall.S_IFDIR | 0755,
+			V4: &FileStatV4{
+				Flags: sshFileXferAttrSize | sshFileXferAttrPermissions |
+					sshFileXferAttrModifyTime | sshFileXferAttrBits | sshFileXferAttrACL,
+				Type:       sshFileXferTypeDirectory,
+				Mtime:      1 << 40,
+				AttribBits: 3,
+				ACL:        []ACE{{Type: 1, Flag: 2, Mask: 3, Who: "OWNER@"}},
+			},
+		}
+		b := marshalAttrsV4(nil, version, fs)
+		got, rest, err := unmarshalAttrsV4(b, version)
+		require.NoError(t, err, version)
+		assert.Empty(t, rest, version)
+		assert.Equal(t, fs.Size, got.Size, version)
+		assert.Equal(t, fs.Mode, got.Mode, version)
+		assert.Equal(t, fs.V4.Mtime, got.V4.Mtime, version)
+		assert.Equal(t, fs.V4.AttribBits, got.V4.AttribBits, version)
+		assert.Equal(t, fs.V4.ACL, got.V4.ACL, version)
+
+		_, _, err = unmarshalAttrsV4(b[:len(b)-1], version)
+		assert.Error(t, err, version)
+	}
+}
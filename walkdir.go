@@ -0,0 +1,69 @@
+// +build go1.16
+
+package sftp
+
+import (
+	"io/fs"
+	"os"
+)
+
+// WalkDir walks the remote tree rooted at root, calling fn for each file or
+// directory in the tree, including root, as fs.WalkDir does: the entries of
+// a directory are walked in lexical order, fn returning fs.SkipDir skips the
+// directory, or the rest of the directory of a file, and fn returning
+// SkipAll skips all the remaining files and directories.
+//
+// The subdirectories of a directory are listed concurrently, ahead of the
+// walk, as by Walk, which on deep trees is much faster than the walk of the
+// fs.FS of AsFS. The symbolic links are reported as such, without being
+// followed, unless set otherwise with WithSymlinks.
+func (c *Client) WalkDir(root string, fn fs.WalkDirFunc, opts ...TransferOption) error {
+	fsys := c.walkFS(newTransferOptions(opts))
+
+	fi, err := fsys.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(fsys, root, dirEntry{fi}, fn)
+	}
+	if err == fs.SkipDir || err == SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkDirFS is the part of the FileSystem of walkFS used by walkDir.
+type walkDirFS interface {
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	Join(elem ...string) string
+}
+
+func walkDir(fsys walkDirFS, name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	list, err := fsys.ReadDir(name)
+	if err != nil {
+		// a second call, to report the error of ReadDir
+		if err = fn(name, d, err); err != nil {
+			if err == fs.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, e := range dirEntries(list) {
+		if err := walkDir(fsys, fsys.Join(name, e.Name()), e, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
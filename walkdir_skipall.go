@@ -0,0 +1,10 @@
+// +build go1.16,!go1.20
+
+package sftp
+
+import "errors"
+
+// SkipAll is used as a return value from the WalkDirFunc of WalkDir to skip
+// all the remaining files and directories, as fs.SkipAll of Go 1.20 and
+// later, which it is on those versions.
+var SkipAll = errors.New("skip everything and stop the walk")
@@ -0,0 +1,9 @@
+// +build go1.20
+
+package sftp
+
+import "io/fs"
+
+// SkipAll is used as a return value from the WalkDirFunc of WalkDir to skip
+// all the remaining files and directories. It is fs.SkipAll.
+var SkipAll = fs.SkipAll
@@ -0,0 +1,112 @@
+// +build go1.16
+
+package sftp
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientWalkDir(t *testing.T) {
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-walkdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	makeTestTree(t, dir, 4, 3)
+
+	walk := func(opts ...TransferOption) []string {
+		var paths []string
+		err := client.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			require.NoError(t, err)
+			paths = append(paths, p)
+			if d.Name() == "dir2" {
+				assert.True(t, d.IsDir())
+				return fs.SkipDir
+			}
+			return nil
+		}, opts...)
+		require.NoError(t, err)
+		return paths
+	}
+
+	sequential := walk(WithWalkConcurrency(1))
+	require.Len(t, sequential, 67)
+	assert.Equal(t, dir, sequential[0])
+	for _, p := range sequential {
+		assert.NotContains(t, p, "dir2"+string(filepath.Separator), "skipped")
+	}
+	assert.Equal(t, sequential, walk(WithWalkConcurrency(8)))
+	assert.Equal(t, sequential, walk())
+
+	_, ok := client.walkFS(newTransferOptions([]TransferOption{WithWalkConcurrency(1)})).(*prefetchFS)
+	assert.False(t, ok, "listed in turns")
+	_, ok = client.walkFS(newTransferOptions([]TransferOption{WithWalkConcurrency(8)})).(*prefetchFS)
+	assert.True(t, ok, "listed ahead")
+}
+
+func TestClientWalkDirSkip(t *testing.T) {
+	client, server := clientServerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest-walkdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	makeTestTree(t, dir, 2, 3)
+
+	// SkipDir from a file skips the rest of its directory
+	var paths []string
+	err = client.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		paths = append(paths, p)
+		if d.Name() == "dir1" {
+			return fs.SkipDir
+		}
+		if d.Name() == "file0" && filepath.Dir(p) == filepath.Join(dir, "dir0") {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		dir,
+		filepath.Join(dir, "dir0"),
+		filepath.Join(dir, "dir0", "file0"),
+		filepath.Join(dir, "dir1"),
+		filepath.Join(dir, "dir2"),
+		filepath.Join(dir, "dir2", "file0"),
+		filepath.Join(dir, "dir2", "file1"),
+		filepath.Join(dir, "dir2", "file2"),
+		filepath.Join(dir, "file0"),
+		filepath.Join(dir, "file1"),
+		filepath.Join(dir, "file2"),
+	}, paths)
+
+	paths = nil
+	err = client.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		paths = append(paths, p)
+		if d.Name() == "file1" {
+			return SkipAll
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "dir0", "file1"), paths[len(paths)-1])
+
+	var reported error
+	err = client.WalkDir(filepath.Join(dir, "missing"), func(p string, d fs.DirEntry, err error) error {
+		assert.Nil(t, d)
+		reported = err
+		return err
+	})
+	assert.True(t, os.IsNotExist(reported), reported)
+	assert.Equal(t, reported, err)
+}
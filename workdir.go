@@ -0,0 +1,133 @@
+package sftp
+
+import (
+	"context"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Chdir changes the working directory of the Client to dir, against which
+// the relative paths given to the methods of the Client are resolved, rather
+// than against the working directory of the server. It is not a jail: the
+// absolute paths and the relative paths leading out of dir are not confined
+// to it. Getwd returns dir once resolved.
+func (c *Client) Chdir(dir string) error {
+	real, err := c.RealPath(dir)
+	if err != nil {
+		return err
+	}
+	fi, err := c.Stat(real)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &os.PathError{Op: "chdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	c.dir.Store(real)
+	return nil
+}
+
+// sendPacket sends p, with its relative paths resolved against the
+// working directory set by Chdir, if any, in the layout of the protocol
+// version negotiated. Once answered, the entries of the stat cache changed
+// by p are dropped.
+func (c *Client) sendPacket(ch chan result, p idmarshaler) (byte, []byte, error) {
+	return c.sendPacketContext(context.Background(), ch, p)
+}
+
+// sendPacketContext is like sendPacket, but returns ctx.Err() once ctx is
+// done, without sending p if ctx is done already. SFTP has no way to cancel
+// a request, so a request in flight is abandoned instead: it may still take
+// effect, and its response is dropped, see abandon.
+func (c *Client) sendPacketContext(ctx context.Context, ch chan result, p idmarshaler) (byte, []byte, error) {
+	if dir, _ := c.dir.Load().(string); dir != "" {
+		for _, name := range clientPacketPaths(p) {
+			if !path.IsAbs(*name) {
+				*name = path.Join(dir, *name)
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		c.clientConn.release(p.id())
+		return 0, nil, err
+	}
+	if cap(ch) < 1 {
+		ch = make(chan result, 1)
+	}
+	c.clientConn.dispatchRequest(ch, c.versioned(p))
+
+	var s result
+	select {
+	case s = <-ch:
+	case <-ctx.Done():
+		go c.abandon(ch, p)
+		return 0, nil, ctx.Err()
+	}
+	if c.statCache != nil {
+		c.statCache.sent(p)
+	}
+	return s.typ, s.data, s.err
+}
+
+// abandon waits for the response to the abandoned request p, to drop the
+// entries of the stat cache it changed, and to close the handle it opened,
+// which nobody is left to close.
+func (c *Client) abandon(ch <-chan result, p idmarshaler) {
+	s := <-ch
+	if c.statCache != nil {
+		c.statCache.sent(p)
+	}
+	if s.err != nil || s.typ != sshFxpHandle {
+		return
+	}
+	_, data, err := unmarshalUint32Safe(s.data)
+	if err != nil {
+		return
+	}
+	if handle, _, err := unmarshalStringSafe(data); err == nil {
+		c.close(handle)
+	}
+}
+
+// clientPacketPaths returns the paths of the files sent by the Client in p.
+// The target of a symbolic link is not one: it is relative to the link.
+func clientPacketPaths(p idmarshaler) []*string {
+	switch p := p.(type) {
+	case *sshFxpStatPacket:
+		return []*string{&p.Path}
+	case *sshFxpLstatPacket:
+		return []*string{&p.Path}
+	case *sshFxpMkdirPacket:
+		return []*string{&p.Path}
+	case *sshFxpRmdirPacket:
+		return []*string{&p.Path}
+	case *sshFxpRemovePacket:
+		return []*string{&p.Filename}
+	case *sshFxpRenamePacket:
+		return []*string{&p.Oldpath, &p.Newpath}
+	case *sshFxpPosixRenamePacket:
+		return []*string{&p.Oldpath, &p.Newpath}
+	case *sshFxpHardlinkPacket:
+		return []*string{&p.Oldpath, &p.Newpath}
+	case *sshFxpSymlinkPacket:
+		return []*string{&p.Linkpath}
+	case *sshFxpReadlinkPacket:
+		return []*string{&p.Path}
+	case *sshFxpRealpathPacket:
+		return []*string{&p.Path}
+	case *sshFxpOpendirPacket:
+		return []*string{&p.Path}
+	case *sshFxpOpenPacket:
+		return []*string{&p.Path}
+	case *sshFxpSetstatPacket:
+		return []*string{&p.Path}
+	case *sshFxpStatvfsPacket:
+		return []*string{&p.Path}
+	case *sshFxpExtendedPacketCopyFile:
+		return []*string{&p.Source, &p.Destination}
+	case *sshFxpExtendedPacketCheckFileName:
+		return []*string{&p.Path}
+	}
+	return nil
+}
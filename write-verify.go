@@ -0,0 +1,89 @@
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// UseWriteVerification makes the Client check, when closing a File it wrote
+// to, that the file is at least as large as the data the server acknowledged
+// writing, which protects against servers dropping writes under load.
+// Close then returns a *ShortWriteError if the file is shorter.
+//
+// Upload retries once the writes of the missing region, from the local file.
+func UseWriteVerification(value bool) ClientOption {
+	return func(c *Client) error {
+		c.verifyWrites = value
+		return nil
+	}
+}
+
+// ShortWriteError is returned by File.Close, with UseWriteVerification, when
+// the remote file is shorter than the data the server acknowledged writing
+// to it: the region from Size to Acknowledged is missing.
+type ShortWriteError struct {
+	Path         string
+	Size         int64 // the size of the file once closed
+	Acknowledged int64 // the end of the data acknowledged as written
+}
+
+func (e *ShortWriteError) Error() string {
+	return fmt.Sprintf("sftp: short write to %s: size %d, acknowledged writes up to %d", e.Path, e.Size, e.Acknowledged)
+}
+
+// acknowledged records that the server acknowledged writing up to end.
+func (f *File) acknowledged(end int64) {
+	for {
+		acked := atomic.LoadInt64(&f.ackedEnd)
+		if end <= acked || atomic.CompareAndSwapInt64(&f.ackedEnd, acked, end) {
+			return
+		}
+	}
+}
+
+// truncated records that the file was truncated to size.
+func (f *File) truncated(size int64) {
+	for {
+		acked := atomic.LoadInt64(&f.ackedEnd)
+		if size >= acked || atomic.CompareAndSwapInt64(&f.ackedEnd, acked, size) {
+			return
+		}
+	}
+}
+
+// verifyWrites checks, once the File is closed, that it is not shorter
+// than the data acknowledged as written.
+func (f *File) verifyWrites() error {
+	acked := atomic.LoadInt64(&f.ackedEnd)
+	if acked == 0 {
+		return nil
+	}
+	fi, err := f.c.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() < acked {
+		return &ShortWriteError{Path: f.path, Size: fi.Size(), Acknowledged: acked}
+	}
+	return nil
+}
+
+// rewrite writes again the region missing from remotePath according to e,
+// from src.
+func (c *Client) rewrite(remotePath string, src io.ReaderAt, e *ShortWriteError) error {
+	dst, err := c.OpenFile(remotePath, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Seek(e.Size, io.SeekStart); err != nil {
+		dst.Close()
+		return err
+	}
+	if _, err := dst.ReadFrom(io.NewSectionReader(src, e.Size, e.Acknowledged-e.Size)); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,95 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// droppingWriter acknowledges but drops the writes past limit, for the
+// first drops files opened.
+type droppingWriter struct {
+	FileWriter
+	limit int64
+	drops int32
+}
+
+func (w *droppingWriter) Filewrite(r *Request) (io.WriterAt, error) {
+	wr, err := w.FileWriter.Filewrite(r)
+	if err != nil || atomic.AddInt32(&w.drops, -1) < 0 {
+		return wr, err
+	}
+	return droppingWriterAt{wr, w.limit}, nil
+}
+
+type droppingWriterAt struct {
+	io.WriterAt
+	limit int64
+}
+
+func (w droppingWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	if off+int64(len(b)) > w.limit {
+		if off >= w.limit {
+			return len(b), nil
+		}
+		b = b[:w.limit-off]
+	}
+	return w.WriterAt.WriteAt(b, off)
+}
+
+func droppingClient(t *testing.T, w *droppingWriter) *Client {
+	handlers := InMemHandler()
+	w.FileWriter = handlers.FilePut
+	handlers.FilePut = w
+
+	client, _ := handlersClientPair(t, handlers, []ClientOption{UseWriteVerification(true), MaxPacket(1024)})
+	return client
+}
+
+func TestWriteVerification(t *testing.T) {
+	client := droppingClient(t, &droppingWriter{limit: 3000, drops: 1})
+
+	f, err := client.Create("/short")
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 5000))
+	require.NoError(t, err)
+	err = f.Close()
+	assert.Equal(t, &ShortWriteError{Path: "/short", Size: 3000, Acknowledged: 5000}, err)
+
+	// truncating is not a short write
+	f, err = client.Create("/truncated")
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 2000))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(1000))
+	require.NoError(t, f.Close())
+
+	// opening without writing is not either
+	f, err = client.OpenFile("/short", os.O_WRONLY)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestUploadRetriesShortWrite(t *testing.T) {
+	client := droppingClient(t, &droppingWriter{limit: 3000, drops: 1})
+
+	dir, err := ioutil.TempDir("", "sftptest-writeverify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789"), 500)
+	src := filepath.Join(dir, "src")
+	require.NoError(t, ioutil.WriteFile(src, content, 0644))
+
+	require.NoError(t, client.Upload(src, "/dst"))
+	got, err := getTestFile(client, "/dst")
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
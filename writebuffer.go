@@ -0,0 +1,91 @@
+package sftp
+
+// EnableWriteBuffer makes the Writes of the File buffered, up to bufferBytes,
+// so that a loop calling Write with little data each call, such as one
+// writing a file line by line, has the data sent in requests of the max
+// packet size rather than waiting for a round trip each call. Writes as
+// large as the buffer are sent directly.
+//
+// The data buffered is written once the buffer is full, by Flush, and before
+// the Read, Seek, Sync, Truncate, ReadFrom, WriteTo and Close of the File, or
+// a Write at another offset. It is not seen by ReadAt, WriteAt and Stat until
+// then. The error writing it is returned by the call flushing it, the data
+// being dropped. A bufferBytes less than 1 flushes the buffer and disables
+// the buffering.
+func (f *File) EnableWriteBuffer(bufferBytes int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.flushWriteBuffer()
+	if bufferBytes < 1 {
+		f.writeBuffer = nil
+		return err
+	}
+	f.writeBuffer = &writeBuffer{buf: make([]byte, 0, bufferBytes)}
+	return err
+}
+
+// writeBuffer is the data buffered by the Writes of a File.
+type writeBuffer struct {
+	buf []byte
+	off int64 // offset of the data buffered
+}
+
+// Flush writes the data buffered by the Writes of the File, see
+// EnableWriteBuffer.
+func (f *File) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.flushWriteBuffer()
+}
+
+// flushWriteBuffer writes the data buffered. f.mu is held.
+func (f *File) flushWriteBuffer() error {
+	wb := f.writeBuffer
+	if wb == nil || len(wb.buf) == 0 {
+		return nil
+	}
+
+	_, err := f.WriteAt(wb.buf, wb.off)
+	wb.buf = wb.buf[:0]
+	return err
+}
+
+// bufferedWrite implements Write with the write buffer. f.mu is held.
+func (f *File) bufferedWrite(b []byte) (int, error) {
+	if err := f.checkOpen("write"); err != nil {
+		return 0, err
+	}
+
+	wb := f.writeBuffer
+	if len(wb.buf) > 0 && wb.off+int64(len(wb.buf)) != f.offset {
+		if err := f.flushWriteBuffer(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	for n < len(b) {
+		if len(wb.buf) == 0 {
+			if len(b)-n >= cap(wb.buf) {
+				m, err := f.WriteAt(b[n:], f.offset)
+				f.offset += int64(m)
+				return n + m, err
+			}
+			wb.off = f.offset
+		}
+
+		m := copy(wb.buf[len(wb.buf):cap(wb.buf)], b[n:])
+		wb.buf = wb.buf[:len(wb.buf)+m]
+		n += m
+		f.offset += int64(m)
+
+		if len(wb.buf) == cap(wb.buf) {
+			if err := f.flushWriteBuffer(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,113 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countedWrites counts the writes of the files it opens.
+type countedWrites struct {
+	FileWriter
+
+	mu sync.Mutex
+	n  int
+}
+
+func (w *countedWrites) Filewrite(req *Request) (io.WriterAt, error) {
+	wr, err := w.FileWriter.Filewrite(req)
+	if err != nil {
+		return nil, err
+	}
+	return countedWriterAt{wr, w}, nil
+}
+
+func (w *countedWrites) reset() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := w.n
+	w.n = 0
+	return n
+}
+
+type countedWriterAt struct {
+	io.WriterAt
+	w *countedWrites
+}
+
+func (wr countedWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	wr.w.mu.Lock()
+	wr.w.n++
+	wr.w.mu.Unlock()
+	return wr.WriterAt.WriteAt(b, off)
+}
+
+func TestFileEnableWriteBuffer(t *testing.T) {
+	handlers := InMemHandler()
+	writes := &countedWrites{FileWriter: handlers.FilePut}
+	handlers.FilePut = writes
+	client, _ := handlersClientPair(t, handlers, nil)
+
+	f, err := client.Create("/file")
+	require.NoError(t, err)
+	require.NoError(t, f.EnableWriteBuffer(2*client.maxPacket))
+
+	var want bytes.Buffer
+	for i := 0; want.Len() < 2*client.maxPacket+1000; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		want.WriteString(line)
+		n, err := f.Write([]byte(line))
+		require.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	// a request for each max packet of the buffer filled
+	assert.Equal(t, 2, writes.reset())
+	require.NoError(t, f.Flush())
+	assert.Equal(t, 1, writes.reset())
+	require.NoError(t, f.Flush())
+	assert.Equal(t, 0, writes.reset())
+
+	// a Write at another offset flushes the data buffered first
+	_, err = f.Write([]byte("ab"))
+	require.NoError(t, err)
+	_, err = f.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	assert.Equal(t, 1, writes.reset())
+	_, err = f.Write([]byte("cd"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, writes.reset())
+
+	// the Writes as large as the buffer are sent directly
+	large := bytes.Repeat([]byte("x"), 2*client.maxPacket)
+	_, err = f.Write(large)
+	require.NoError(t, err)
+	assert.Equal(t, 2, writes.reset())
+	require.NoError(t, f.Close())
+	assert.Equal(t, 1, writes.reset())
+
+	want.WriteString("ab")
+	data := want.Bytes()
+	copy(data[5:], "cd")
+	copy(data[7:], large)
+	got, err := getTestFile(client, "/file")
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+
+	f, err = client.OpenFile("/file", 0x2) // os.O_RDWR
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, f.EnableWriteBuffer(100))
+	_, err = f.Write([]byte("unbuffered"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, writes.reset())
+	require.NoError(t, f.EnableWriteBuffer(0))
+	assert.Equal(t, 1, writes.reset())
+	_, err = f.Write([]byte("unbuffered"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, writes.reset())
+}